@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/cachestorm/cachestorm/internal/config"
+	"github.com/cachestorm/cachestorm/internal/logger"
+	"github.com/cachestorm/cachestorm/internal/persistence"
+)
+
+// checkAOF validates an AOF, reports where it stops holding valid commands
+// and, with -fix, truncates it there.
+func checkAOF(args []string) int {
+	fs := flag.NewFlagSet("check-aof", flag.ExitOnError)
+	cfgPath := fs.String("config", "", "path to config file, used when no AOF is named")
+	fix := fs.Bool("fix", false, "truncate the AOF to its last valid command")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: cachestorm check-aof [-config file] [-fix] [appendonly.aof | appendonlydir | manifest]")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return 2
+	}
+
+	path := fs.Arg(0)
+	if path == "" {
+		var err error
+		if path, err = aofPath(*cfgPath); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+	}
+
+	checks, err := persistence.CheckAOF(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading %s: %v\n", path, err)
+		return 1
+	}
+
+	valid := true
+	for _, check := range checks {
+		name := filepath.Base(check.Path)
+		var corrupt *persistence.AOFCorruptError
+		switch {
+		case check.Err == nil && check.Snapshot:
+			fmt.Printf("%s: OK, snapshot of %d bytes\n", name, check.Size)
+		case check.Err == nil:
+			fmt.Printf("%s: OK, %d commands in %d bytes\n", name, check.Commands, check.Size)
+		case errors.As(check.Err, &corrupt):
+			valid = false
+			problem := "corrupted command"
+			if corrupt.Truncated {
+				problem = "incomplete command"
+			}
+			fmt.Printf("%s: %s at offset %d after %d valid commands, %d of %d bytes follow it\n",
+				name, problem, corrupt.Offset, corrupt.Commands, check.Size-corrupt.Offset, check.Size)
+		default:
+			valid = false
+			fmt.Printf("%s: %v\n", name, check.Err)
+		}
+	}
+
+	if valid {
+		fmt.Println("AOF is valid")
+		return 0
+	}
+	if !*fix {
+		fmt.Println("AOF is not valid. Run with -fix to truncate it to the last valid command")
+		return 1
+	}
+	if err := persistence.FixAOF(checks); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	fmt.Println("AOF truncated to the last valid command")
+	return 0
+}
+
+// aofPath loads the configuration and returns the node's AOF: the
+// multi-part directory if there is one, otherwise the single-file AOF.
+func aofPath(cfgPath string) (string, error) {
+	cfg, err := config.Load(cfgPath)
+	if err != nil {
+		return "", fmt.Errorf("loading config: %v", err)
+	}
+	logger.Init(cfg.Logging.Level, cfg.Logging.Format, cfg.Logging.Output)
+
+	dataDir := cfg.Persistence.DataDir
+	if dataDir == "" {
+		dataDir = "."
+	}
+	dir := filepath.Join(dataDir, "appendonlydir")
+	if _, err := os.Stat(dir); err == nil {
+		return dir, nil
+	}
+	return filepath.Join(dataDir, "appendonly.aof"), nil
+}
+
+// restoreAOF cuts the node's AOF back to a point in time, so that the next
+// start replays it only up to then.
+func restoreAOF(args []string) int {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	cfgPath := fs.String("config", "", "path to config file, used when no AOF is named")
+	until := fs.String("until", "", "RFC 3339 time to restore to, such as 2026-10-17T10:15:00Z")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: cachestorm restore [-config file] -until time [appendonlydir | manifest]")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() > 1 || *until == "" {
+		fs.Usage()
+		return 2
+	}
+	t, err := time.Parse(time.RFC3339, *until)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: invalid -until: %v\n", err)
+		return 2
+	}
+
+	path := fs.Arg(0)
+	if path == "" {
+		if path, err = aofPath(*cfgPath); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+	}
+
+	restore, err := persistence.RestoreAOF(path, t)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error restoring %s: %v\n", path, err)
+		return 1
+	}
+	if restore.File == "" {
+		fmt.Printf("AOF holds nothing after %s, left as it was\n", t.UTC().Format(time.RFC3339))
+	} else {
+		fmt.Printf("Cut %s at offset %d and removed %d later files: %d commands dropped\n",
+			restore.File, restore.Offset, len(restore.Removed), restore.Dropped)
+	}
+	fmt.Printf("The AOF as it was is kept in %s\n", restore.Backup)
+	return 0
+}
@@ -21,6 +21,12 @@ var (
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		if run, ok := subcommands[os.Args[1]]; ok {
+			os.Exit(run(os.Args[2:]))
+		}
+	}
+
 	flag.Parse()
 
 	cfg, err := config.Load(*configPath)
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/cachestorm/cachestorm/internal/logger"
+	"github.com/cachestorm/cachestorm/internal/sentinel"
+)
+
+// runSentinel runs a sentinel instead of a data node. The masters it
+// monitors, and what it learns about them, are kept in its config file.
+func runSentinel(args []string) int {
+	fs := flag.NewFlagSet("sentinel", flag.ExitOnError)
+	cfgPath := fs.String("config", "sentinel.conf", "sentinel config file, created if missing and rewritten on changes")
+	bind := fs.String("bind", "", "address to listen on")
+	port := fs.Int("port", 26379, "port to listen on")
+	announceIP := fs.String("announce-ip", "", "address other sentinels reach this one at")
+	announcePort := fs.Int("announce-port", 0, "port other sentinels reach this one at")
+	logLevel := fs.String("log-level", "info", "log level")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: cachestorm sentinel [-config sentinel.conf] [-bind addr] [-port 26379]")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return 2
+	}
+
+	logger.Init(*logLevel, "json", "stdout")
+
+	s := sentinel.New(sentinel.Config{
+		Addr:         *bind,
+		Port:         *port,
+		AnnounceIP:   *announceIP,
+		AnnouncePort: *announcePort,
+		ConfigFile:   *cfgPath,
+	})
+	if err := s.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error starting sentinel: %v\n", err)
+		return 1
+	}
+	defer s.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errCh := make(chan error, 1)
+	go func() { errCh <- s.Serve(ctx, *port) }()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigCh)
+
+	select {
+	case err := <-errCh:
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	case <-sigCh:
+		logger.Info().Msg("shutdown signal received")
+		return 0
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"crypto/subtle"
 	"encoding/hex"
 	"errors"
+	"fmt"
+	"sort"
 	"strings"
 	"sync"
 )
@@ -16,11 +18,32 @@ var (
 	ErrPermissionDenied  = errors.New("NOPERM No permission")
 )
 
+// Categories lists the command categories that +@name and -@name rules may
+// refer to. Which commands belong to each one is decided by the caller of
+// CanExecute.
+var Categories = []string{
+	"keyspace", "read", "write", "set", "sortedset", "list", "hash", "string",
+	"bitmap", "hyperloglog", "geo", "stream", "pubsub", "admin", "fast", "slow",
+	"blocking", "dangerous", "connection", "transaction", "scripting",
+	"json", "bloom", "cuckoo", "cms", "topk", "tdigest", "timeseries", "search",
+	"graph",
+}
+
+// Permission describes what a user may do. Explicit command rules (including
+// "CMD|SUB" subcommand rules) take precedence over category rules, denied
+// categories over allowed ones, and both over the +@all/-@all wildcard.
+//
+// RestrictKeys and RestrictChannels make an empty pattern list grant nothing;
+// users created with CreateUser start restricted, like new Redis users.
 type Permission struct {
-	AllowedCommands map[string]bool
-	DeniedCommands  map[string]bool
-	AllowedKeys     []string
-	AllowedChannels []string
+	AllowedCommands   map[string]bool
+	DeniedCommands    map[string]bool
+	AllowedCategories map[string]bool
+	DeniedCategories  map[string]bool
+	AllowedKeys       []string
+	AllowedChannels   []string
+	RestrictKeys      bool
+	RestrictChannels  bool
 }
 
 type User struct {
@@ -37,6 +60,9 @@ type ACL struct {
 	Users       map[string]*User
 	DefaultUser *User
 	mu          sync.RWMutex
+
+	log    []*LogEntry
+	logSeq int64
 }
 
 func NewACL() *ACL {
@@ -69,16 +95,37 @@ func (a *ACL) CreateUser(name string) (*User, error) {
 		return nil, ErrUserAlreadyExists
 	}
 
-	user := &User{
+	user := NewUser(name)
+	a.Users[name] = user
+	return user, nil
+}
+
+// NewUser returns a user in the state Redis gives a new user: disabled,
+// without passwords, and with no commands, keys or channels.
+func NewUser(name string) *User {
+	return &User{
 		Name:    name,
 		Enabled: false,
 		Permissions: Permission{
-			AllowedCommands: make(map[string]bool),
-			DeniedCommands:  make(map[string]bool),
+			AllowedCommands:   make(map[string]bool),
+			DeniedCommands:    make(map[string]bool),
+			AllowedCategories: make(map[string]bool),
+			DeniedCategories:  make(map[string]bool),
+			RestrictKeys:      true,
+			RestrictChannels:  true,
 		},
 	}
-	a.Users[name] = user
-	return user, nil
+}
+
+// SetUser adds a user or replaces the existing user of the same name.
+func (a *ACL) SetUser(user *User) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.Users[user.Name] = user
+	if user.Name == "default" {
+		user.IsDefault = true
+		a.DefaultUser = user
+	}
 }
 
 func (a *ACL) DeleteUser(name string) error {
@@ -113,6 +160,7 @@ func (a *ACL) ListUsers() []string {
 	for name := range a.Users {
 		users = append(users, name)
 	}
+	sort.Strings(users)
 	return users
 }
 
@@ -201,7 +249,11 @@ func (u *User) AllowCommand(cmd string) {
 
 	if cmd == "*" || cmd == "all" {
 		u.Permissions.AllowedCommands = map[string]bool{"*": true}
+		u.Permissions.DeniedCommands = make(map[string]bool)
+		u.Permissions.AllowedCategories = make(map[string]bool)
+		u.Permissions.DeniedCategories = make(map[string]bool)
 	} else {
+		u.ensureCommandMaps()
 		u.Permissions.AllowedCommands[strings.ToUpper(cmd)] = true
 		delete(u.Permissions.DeniedCommands, strings.ToUpper(cmd))
 	}
@@ -213,12 +265,49 @@ func (u *User) DenyCommand(cmd string) {
 
 	if cmd == "*" || cmd == "all" {
 		u.Permissions.DeniedCommands = map[string]bool{"*": true}
+		u.Permissions.AllowedCommands = make(map[string]bool)
+		u.Permissions.AllowedCategories = make(map[string]bool)
+		u.Permissions.DeniedCategories = make(map[string]bool)
 	} else {
+		u.ensureCommandMaps()
 		u.Permissions.DeniedCommands[strings.ToUpper(cmd)] = true
 		delete(u.Permissions.AllowedCommands, strings.ToUpper(cmd))
 	}
 }
 
+// AllowCategory grants every command in a category (+@category).
+func (u *User) AllowCategory(category string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.ensureCommandMaps()
+	u.Permissions.AllowedCategories[category] = true
+	delete(u.Permissions.DeniedCategories, category)
+}
+
+// DenyCategory revokes every command in a category (-@category).
+func (u *User) DenyCategory(category string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.ensureCommandMaps()
+	u.Permissions.DeniedCategories[category] = true
+	delete(u.Permissions.AllowedCategories, category)
+}
+
+func (u *User) ensureCommandMaps() {
+	if u.Permissions.AllowedCommands == nil {
+		u.Permissions.AllowedCommands = make(map[string]bool)
+	}
+	if u.Permissions.DeniedCommands == nil {
+		u.Permissions.DeniedCommands = make(map[string]bool)
+	}
+	if u.Permissions.AllowedCategories == nil {
+		u.Permissions.AllowedCategories = make(map[string]bool)
+	}
+	if u.Permissions.DeniedCategories == nil {
+		u.Permissions.DeniedCategories = make(map[string]bool)
+	}
+}
+
 func (u *User) AllowKey(pattern string) {
 	u.mu.Lock()
 	defer u.mu.Unlock()
@@ -231,6 +320,97 @@ func (u *User) AllowChannel(pattern string) {
 	u.Permissions.AllowedChannels = append(u.Permissions.AllowedChannels, pattern)
 }
 
+// ResetKeys removes every key pattern (resetkeys).
+func (u *User) ResetKeys() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.Permissions.AllowedKeys = nil
+	u.Permissions.RestrictKeys = true
+}
+
+// ResetChannels removes every channel pattern (resetchannels).
+func (u *User) ResetChannels() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.Permissions.AllowedChannels = nil
+	u.Permissions.RestrictChannels = true
+}
+
+// ResetPasswords removes all passwords and the nopass flag (resetpass), so
+// nobody can log in as the user until a password is added.
+func (u *User) ResetPasswords() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.Passwords = nil
+	u.NoPassword = false
+}
+
+// AddPasswordHash adds an already hashed password (#<sha256 hex>).
+func (u *User) AddPasswordHash(hash string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	hash = strings.ToLower(hash)
+	for _, stored := range u.Passwords {
+		if stored == hash {
+			return
+		}
+	}
+	u.Passwords = append(u.Passwords, hash)
+	u.NoPassword = false
+}
+
+// RemovePasswordHash removes one password by its hash. It reports whether
+// the user had that password.
+func (u *User) RemovePasswordHash(hash string) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	hash = strings.ToLower(hash)
+	for i, stored := range u.Passwords {
+		if stored == hash {
+			u.Passwords = append(u.Passwords[:i:i], u.Passwords[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// CanExecute reports whether the user may run cmd, optionally with a
+// subcommand, given the categories the command belongs to.
+func (u *User) CanExecute(cmd, subcommand string, categories []string) bool {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+
+	cmd = strings.ToUpper(cmd)
+	perm := &u.Permissions
+
+	if subcommand != "" {
+		full := cmd + "|" + strings.ToUpper(subcommand)
+		if perm.DeniedCommands[full] {
+			return false
+		}
+		if perm.AllowedCommands[full] {
+			return true
+		}
+	}
+	if perm.DeniedCommands[cmd] {
+		return false
+	}
+	if perm.AllowedCommands[cmd] {
+		return true
+	}
+	for _, category := range categories {
+		if perm.DeniedCategories[category] {
+			return false
+		}
+	}
+	for _, category := range categories {
+		if perm.AllowedCategories[category] {
+			return true
+		}
+	}
+	return perm.AllowedCommands["*"] && !perm.DeniedCommands["*"]
+}
+
 func (u *User) CanExecuteCommand(cmd string) bool {
 	u.mu.RLock()
 	defer u.mu.RUnlock()
@@ -263,7 +443,7 @@ func (u *User) CanAccessKey(key string) bool {
 	defer u.mu.RUnlock()
 
 	if len(u.Permissions.AllowedKeys) == 0 {
-		return true
+		return !u.Permissions.RestrictKeys
 	}
 
 	for _, pattern := range u.Permissions.AllowedKeys {
@@ -278,12 +458,20 @@ func (u *User) CanAccessKey(key string) bool {
 	return false
 }
 
+// AllKeys reports whether the user may access every key (allkeys or ~*).
+func (u *User) AllKeys() bool {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+
+	return hasWildcard(u.Permissions.AllowedKeys, u.Permissions.RestrictKeys)
+}
+
 func (u *User) CanAccessChannel(channel string) bool {
 	u.mu.RLock()
 	defer u.mu.RUnlock()
 
 	if len(u.Permissions.AllowedChannels) == 0 {
-		return true
+		return !u.Permissions.RestrictChannels
 	}
 
 	for _, pattern := range u.Permissions.AllowedChannels {
@@ -298,6 +486,171 @@ func (u *User) CanAccessChannel(channel string) bool {
 	return false
 }
 
+// CanAccessChannelPattern checks a PSUBSCRIBE pattern. As in Redis, the
+// pattern has to be one of the user's channel patterns literally, since a
+// glob that matches a permitted name may also match forbidden ones.
+func (u *User) CanAccessChannelPattern(pattern string) bool {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+
+	if len(u.Permissions.AllowedChannels) == 0 {
+		return !u.Permissions.RestrictChannels
+	}
+	for _, allowed := range u.Permissions.AllowedChannels {
+		if allowed == "*" || allowed == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// Unrestricted reports whether the user may run any command on any key and
+// channel, which lets callers skip per-command checks.
+func (u *User) Unrestricted() bool {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+
+	perm := &u.Permissions
+	if !perm.AllowedCommands["*"] || len(perm.DeniedCommands) > 0 || len(perm.DeniedCategories) > 0 {
+		return false
+	}
+	return hasWildcard(perm.AllowedKeys, perm.RestrictKeys) && hasWildcard(perm.AllowedChannels, perm.RestrictChannels)
+}
+
+func hasWildcard(patterns []string, restricted bool) bool {
+	if len(patterns) == 0 {
+		return !restricted
+	}
+	for _, p := range patterns {
+		if p == "*" || p == "~*" {
+			return true
+		}
+	}
+	return false
+}
+
+// Clone returns a deep copy of the user, so rules can be applied to the copy
+// and committed only if all of them are valid.
+func (u *User) Clone() *User {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+
+	return &User{
+		Name:       u.Name,
+		Enabled:    u.Enabled,
+		NoPassword: u.NoPassword,
+		Passwords:  append([]string(nil), u.Passwords...),
+		IsDefault:  u.IsDefault,
+		Permissions: Permission{
+			AllowedCommands:   copySet(u.Permissions.AllowedCommands),
+			DeniedCommands:    copySet(u.Permissions.DeniedCommands),
+			AllowedCategories: copySet(u.Permissions.AllowedCategories),
+			DeniedCategories:  copySet(u.Permissions.DeniedCategories),
+			AllowedKeys:       append([]string(nil), u.Permissions.AllowedKeys...),
+			AllowedChannels:   append([]string(nil), u.Permissions.AllowedChannels...),
+			RestrictKeys:      u.Permissions.RestrictKeys,
+			RestrictChannels:  u.Permissions.RestrictChannels,
+		},
+	}
+}
+
+func copySet(m map[string]bool) map[string]bool {
+	out := make(map[string]bool, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
+}
+
+// PasswordHashes returns the SHA-256 hashes of the user's passwords.
+func (u *User) PasswordHashes() []string {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return append([]string(nil), u.Passwords...)
+}
+
+// CommandRules describes the user's command permissions as ACL rules, e.g.
+// "-@all +@read +config|get".
+func (u *User) CommandRules() string {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return strings.Join(u.commandRules(), " ")
+}
+
+func (u *User) commandRules() []string {
+	perm := &u.Permissions
+	var parts []string
+	if perm.AllowedCommands["*"] && !perm.DeniedCommands["*"] {
+		parts = append(parts, "+@all")
+	} else {
+		parts = append(parts, "-@all")
+	}
+	for _, category := range sortedKeys(perm.AllowedCategories) {
+		parts = append(parts, "+@"+category)
+	}
+	for _, category := range sortedKeys(perm.DeniedCategories) {
+		parts = append(parts, "-@"+category)
+	}
+	for _, cmd := range sortedKeys(perm.AllowedCommands) {
+		if cmd != "*" {
+			parts = append(parts, "+"+cmd)
+		}
+	}
+	for _, cmd := range sortedKeys(perm.DeniedCommands) {
+		if cmd != "*" {
+			parts = append(parts, "-"+cmd)
+		}
+	}
+	return parts
+}
+
+// KeyRules describes the user's key patterns as ACL rules.
+func (u *User) KeyRules() string {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return strings.Join(patternRules("~", u.Permissions.AllowedKeys, u.Permissions.RestrictKeys, ""), " ")
+}
+
+// ChannelRules describes the user's channel patterns as ACL rules.
+func (u *User) ChannelRules() string {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return strings.Join(patternRules("&", u.Permissions.AllowedChannels, u.Permissions.RestrictChannels, "resetchannels"), " ")
+}
+
+// patternRules renders key or channel patterns. An unrestricted empty list
+// means everything; a restricted empty one is rendered as empty, or as
+// reset when the reset keyword has to be spelled out.
+func patternRules(prefix string, patterns []string, restricted bool, reset string) []string {
+	if len(patterns) == 0 {
+		if !restricted {
+			return []string{prefix + "*"}
+		}
+		if reset != "" {
+			return []string{reset}
+		}
+		return nil
+	}
+	parts := make([]string, len(patterns))
+	for i, p := range patterns {
+		parts[i] = prefix + strings.TrimPrefix(p, prefix)
+	}
+	return parts
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k, v := range m {
+		if v {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ToACLString renders the user as a line of ACL LIST and of the ACL file.
+// Passwords appear as their SHA-256 hashes so the line can be loaded back.
 func (u *User) ToACLString() string {
 	u.mu.RLock()
 	defer u.mu.RUnlock()
@@ -315,74 +668,150 @@ func (u *User) ToACLString() string {
 		parts = append(parts, "nopass")
 	} else {
 		for _, pw := range u.Passwords {
-			parts = append(parts, "#"+pw[:16])
+			parts = append(parts, "#"+pw)
 		}
 	}
 
-	if _, ok := u.Permissions.AllowedCommands["*"]; ok {
-		parts = append(parts, "+@all")
-	} else {
-		for cmd := range u.Permissions.AllowedCommands {
-			parts = append(parts, "+"+cmd)
-		}
-	}
+	parts = append(parts, patternRules("~", u.Permissions.AllowedKeys, u.Permissions.RestrictKeys, "")...)
+	parts = append(parts, patternRules("&", u.Permissions.AllowedChannels, u.Permissions.RestrictChannels, "resetchannels")...)
+	parts = append(parts, u.commandRules()...)
 
-	for cmd := range u.Permissions.DeniedCommands {
-		parts = append(parts, "-"+cmd)
-	}
+	return strings.Join(parts, " ")
+}
 
-	for _, key := range u.Permissions.AllowedKeys {
-		parts = append(parts, "~"+key)
-	}
+// ParseACLRule applies space-separated ACL rules to user in order.
+func ParseACLRule(rule string, user *User) error {
+	return ApplyRules(user, strings.Fields(rule))
+}
 
-	for _, ch := range u.Permissions.AllowedChannels {
-		parts = append(parts, "&"+ch)
+// ApplyRules applies ACL SETUSER rules to user in order. It stops at the
+// first invalid rule, leaving the earlier ones applied; callers that need
+// all-or-nothing semantics apply the rules to a Clone.
+func ApplyRules(user *User, rules []string) error {
+	for _, part := range rules {
+		if err := applyRule(user, part); err != nil {
+			return fmt.Errorf("ERR Error in ACL SETUSER modifier '%s': %s", part, err.Error())
+		}
 	}
-
-	return strings.Join(parts, " ")
+	return nil
 }
 
-func ParseACLRule(rule string, user *User) error {
-	parts := strings.Fields(rule)
-	for _, part := range parts {
-		switch {
-		case part == "on":
-			user.Enable()
-		case part == "off":
-			user.Disable()
-		case part == "nopass":
-			user.RemovePasswords()
-		case strings.HasPrefix(part, ">"):
-			user.SetPassword(part[1:])
-		case strings.HasPrefix(part, "+"):
-			cmd := part[1:]
-			if strings.HasPrefix(cmd, "@") {
-				cmd = cmd[1:]
-				if cmd == "all" {
-					user.AllowCommand("*")
-				}
-			} else {
-				user.AllowCommand(cmd)
-			}
-		case strings.HasPrefix(part, "-"):
-			cmd := part[1:]
-			if strings.HasPrefix(cmd, "@") {
-				cmd = cmd[1:]
-				if cmd == "all" {
-					user.DenyCommand("*")
-				}
+func applyRule(user *User, part string) error {
+	lower := strings.ToLower(part)
+	switch {
+	case lower == "on":
+		user.Enable()
+	case lower == "off":
+		user.Disable()
+	case lower == "nopass":
+		user.RemovePasswords()
+	case lower == "resetpass":
+		user.ResetPasswords()
+	case lower == "allkeys":
+		user.ResetKeys()
+		user.AllowKey("*")
+	case lower == "resetkeys":
+		user.ResetKeys()
+	case lower == "allchannels":
+		user.ResetChannels()
+		user.AllowChannel("*")
+	case lower == "resetchannels":
+		user.ResetChannels()
+	case lower == "allcommands":
+		user.AllowCommand("*")
+	case lower == "nocommands":
+		user.DenyCommand("*")
+	case lower == "reset":
+		user.ResetPasswords()
+		user.ResetKeys()
+		user.ResetChannels()
+		user.Disable()
+		user.DenyCommand("*")
+	case strings.HasPrefix(part, ">"):
+		user.AddPasswordHash(hashPassword(part[1:]))
+	case strings.HasPrefix(part, "<"):
+		if !user.RemovePasswordHash(hashPassword(part[1:])) {
+			return errors.New("no such password")
+		}
+	case strings.HasPrefix(part, "#"):
+		if !isPasswordHash(part[1:]) {
+			return errors.New("The password hash must be exactly 64 characters and contain only lowercase hexadecimal characters")
+		}
+		user.AddPasswordHash(part[1:])
+	case strings.HasPrefix(part, "!"):
+		if !isPasswordHash(part[1:]) {
+			return errors.New("The password hash must be exactly 64 characters and contain only lowercase hexadecimal characters")
+		}
+		if !user.RemovePasswordHash(part[1:]) {
+			return errors.New("no such password")
+		}
+	case strings.HasPrefix(part, "+@"), strings.HasPrefix(part, "-@"):
+		category := strings.ToLower(part[2:])
+		if category == "all" {
+			if part[0] == '+' {
+				user.AllowCommand("*")
 			} else {
-				user.DenyCommand(cmd)
+				user.DenyCommand("*")
 			}
-		case strings.HasPrefix(part, "~"):
-			user.AllowKey(part[1:])
-		case strings.HasPrefix(part, "&"):
-			user.AllowChannel(part[1:])
+			return nil
+		}
+		if !isCategory(category) {
+			return errors.New("Unknown command or category name in ACL")
 		}
+		if part[0] == '+' {
+			user.AllowCategory(category)
+		} else {
+			user.DenyCategory(category)
+		}
+	case strings.HasPrefix(part, "+"), strings.HasPrefix(part, "-"):
+		cmd := part[1:]
+		if cmd == "" || strings.HasPrefix(cmd, "|") || strings.HasSuffix(cmd, "|") {
+			return errors.New("Syntax error")
+		}
+		if part[0] == '+' {
+			user.AllowCommand(cmd)
+		} else {
+			user.DenyCommand(cmd)
+		}
+	case strings.HasPrefix(part, "~"):
+		user.AllowKey(part[1:])
+	case strings.HasPrefix(part, "%"):
+		// %R~, %W~ and %RW~ key permissions are treated as full access
+		i := strings.IndexByte(part, '~')
+		flags := strings.ToUpper(part[1:max(i, 1)])
+		if i < 0 || flags == "" || strings.Trim(flags, "RW") != "" {
+			return errors.New("Syntax error")
+		}
+		user.AllowKey(part[i+1:])
+	case strings.HasPrefix(part, "&"):
+		user.AllowChannel(part[1:])
+	default:
+		return errors.New("Syntax error")
 	}
 	return nil
 }
 
+func isCategory(name string) bool {
+	for _, c := range Categories {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+func isPasswordHash(s string) bool {
+	if len(s) != sha256.Size*2 {
+		return false
+	}
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
 func hashPassword(password string) string {
 	hash := sha256.Sum256([]byte(password))
 	return hex.EncodeToString(hash[:])
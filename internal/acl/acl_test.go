@@ -1,6 +1,8 @@
 package acl
 
 import (
+	"os"
+	"strings"
 	"testing"
 )
 
@@ -445,3 +447,164 @@ func TestParseACLRuleAllowChannel(t *testing.T) {
 		t.Error("expected 1 allowed channel")
 	}
 }
+
+func TestCanExecuteCategoriesAndSubcommands(t *testing.T) {
+	user := NewUser("svc")
+	if err := ApplyRules(user, []string{"on", "-@all", "+@read", "-@dangerous", "+config|get", "-get"}); err != nil {
+		t.Fatalf("ApplyRules: %v", err)
+	}
+
+	tests := []struct {
+		cmd, sub   string
+		categories []string
+		want       bool
+	}{
+		{"HGET", "", []string{"hash", "read"}, true},
+		{"SET", "", []string{"string", "write"}, false},
+		{"KEYS", "", []string{"keyspace", "read", "dangerous"}, false},
+		{"GET", "", []string{"string", "read"}, false},
+		{"CONFIG", "GET", []string{"admin", "dangerous"}, true},
+		{"CONFIG", "SET", []string{"admin", "dangerous"}, false},
+	}
+	for _, tt := range tests {
+		if got := user.CanExecute(tt.cmd, tt.sub, tt.categories); got != tt.want {
+			t.Errorf("CanExecute(%s %s) = %v, want %v", tt.cmd, tt.sub, got, tt.want)
+		}
+	}
+
+	ApplyRules(user, []string{"+@all"})
+	if !user.CanExecute("GET", "", []string{"string", "read"}) || !user.CanExecute("FLUSHALL", "", []string{"dangerous"}) {
+		t.Error("+@all should reset earlier command rules")
+	}
+}
+
+func TestNewUserIsRestricted(t *testing.T) {
+	user := NewUser("svc")
+	if user.CanAccessKey("any") || user.CanAccessChannel("any") || user.CanExecute("GET", "", nil) {
+		t.Error("a new user should have no permissions")
+	}
+
+	ApplyRules(user, []string{"~svc:*", "&events:*"})
+	if !user.CanAccessKey("svc:1") || user.CanAccessKey("other:1") {
+		t.Error("key patterns not applied")
+	}
+	if !user.CanAccessChannel("events:login") || user.CanAccessChannel("admin") {
+		t.Error("channel patterns not applied")
+	}
+	if !user.CanAccessChannelPattern("events:*") || user.CanAccessChannelPattern("events:l*") {
+		t.Error("PSUBSCRIBE patterns must match a channel rule literally")
+	}
+
+	ApplyRules(user, []string{"resetkeys", "allchannels"})
+	if user.CanAccessKey("svc:1") || !user.CanAccessChannel("admin") {
+		t.Error("resetkeys/allchannels not applied")
+	}
+	if user.Unrestricted() {
+		t.Error("user without commands reported unrestricted")
+	}
+}
+
+func TestApplyRulesErrorsAndPasswords(t *testing.T) {
+	user := NewUser("svc")
+	err := ApplyRules(user, []string{"on", "+@nosuchcategory"})
+	if err == nil || err.Error() != "ERR Error in ACL SETUSER modifier '+@nosuchcategory': Unknown command or category name in ACL" {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := ApplyRules(user, []string{"bogus"}); err == nil {
+		t.Error("expected syntax error")
+	}
+
+	ApplyRules(user, []string{">first", ">second", "<first"})
+	if _, err := authenticateUser(user, "first"); err == nil {
+		t.Error("removed password still accepted")
+	}
+	if _, err := authenticateUser(user, "second"); err != nil {
+		t.Errorf("password rejected: %v", err)
+	}
+	if err := ApplyRules(user, []string{"#" + hashPassword("third")}); err != nil {
+		t.Fatalf("#hash: %v", err)
+	}
+	if err := ApplyRules(user, []string{"#nothex"}); err == nil {
+		t.Error("expected invalid hash error")
+	}
+
+	ApplyRules(user, []string{"reset"})
+	if user.IsEnabled() || len(user.PasswordHashes()) != 0 || user.IsNoPassword() {
+		t.Error("reset should disable the user and drop its passwords")
+	}
+}
+
+func authenticateUser(user *User, password string) (*User, error) {
+	a := NewACL()
+	a.SetUser(user)
+	return a.Authenticate(user.Name, password)
+}
+
+func TestCloneIsIndependent(t *testing.T) {
+	user := NewUser("svc")
+	ApplyRules(user, []string{"on", "~a:*", "+get"})
+	clone := user.Clone()
+	ApplyRules(clone, []string{"~b:*", "-get", "off"})
+
+	if !user.IsEnabled() || user.CanAccessKey("b:1") || !user.CanExecute("GET", "", nil) {
+		t.Error("changes to the clone leaked into the original")
+	}
+}
+
+func TestLogGroupsRepeatedDenials(t *testing.T) {
+	a := NewACL()
+	a.LogDenial(ReasonKey, "toplevel", "secret", "svc", "id=1")
+	a.LogDenial(ReasonCommand, "toplevel", "flushall", "svc", "id=1")
+	a.LogDenial(ReasonKey, "toplevel", "secret", "svc", "id=2")
+
+	entries := a.Log(-1)
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(entries))
+	}
+	if entries[0].Object != "secret" || entries[0].Count != 2 || entries[0].ClientInfo != "id=2" {
+		t.Errorf("unexpected newest entry %+v", entries[0])
+	}
+	if got := a.Log(1); len(got) != 1 {
+		t.Errorf("expected count to limit entries, got %d", len(got))
+	}
+	a.ResetLog()
+	if len(a.Log(-1)) != 0 {
+		t.Error("ResetLog did not clear the log")
+	}
+}
+
+func TestSaveAndLoadFile(t *testing.T) {
+	path := t.TempDir() + "/users.acl"
+	a := NewACL()
+	user := NewUser("svc")
+	ApplyRules(user, []string{"on", ">secret", "~svc:*", "&svc:*", "-@all", "+@read", "+set"})
+	a.SetUser(user)
+	if err := a.SaveFile(path); err != nil {
+		t.Fatalf("SaveFile: %v", err)
+	}
+
+	b := NewACL()
+	if err := b.LoadFile(path); err != nil {
+		t.Fatalf("LoadFile: %v", err)
+	}
+	loaded, ok := b.GetUser("svc")
+	if !ok {
+		t.Fatal("user not loaded")
+	}
+	if loaded.ToACLString() != user.ToACLString() {
+		t.Errorf("round trip mismatch:\n%s\n%s", user.ToACLString(), loaded.ToACLString())
+	}
+	if _, err := b.Authenticate("svc", "secret"); err != nil {
+		t.Errorf("password lost in round trip: %v", err)
+	}
+
+	if err := os.WriteFile(path, []byte("user ok on nopass\nuser bad on +@nope\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.LoadFile(path); err == nil || !strings.Contains(err.Error(), ":2:") {
+		t.Errorf("expected error for line 2, got %v", err)
+	}
+	if _, ok := b.GetUser("ok"); ok {
+		t.Error("a failed load must not change the users")
+	}
+}
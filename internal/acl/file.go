@@ -0,0 +1,92 @@
+package acl
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LoadFile replaces the users with those defined in an ACL file, one
+// "user <name> <rules...>" line per user as written by SaveFile. Nothing is
+// changed if any line is invalid. A file that does not define the default
+// user gets a fresh one.
+func (a *ACL) LoadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("ERR Error loading ACLs, opening file '%s': %v", path, err)
+	}
+
+	users := make(map[string]*User)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		if fields[0] != "user" || len(fields) < 2 {
+			return fmt.Errorf("ERR %s:%d: line should start with user keyword", path, lineNo)
+		}
+		name := fields[1]
+		if _, dup := users[name]; dup {
+			return fmt.Errorf("ERR %s:%d: duplicate user '%s' found", path, lineNo, name)
+		}
+		user := NewUser(name)
+		if err := ApplyRules(user, fields[2:]); err != nil {
+			return fmt.Errorf("ERR %s:%d: %s", path, lineNo, strings.TrimPrefix(err.Error(), "ERR "))
+		}
+		users[name] = user
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("ERR Error loading ACLs from '%s': %v", path, err)
+	}
+
+	defaultUser, ok := users["default"]
+	if !ok {
+		defaultUser = NewACL().DefaultUser
+		users["default"] = defaultUser
+	}
+	defaultUser.IsDefault = true
+
+	a.mu.Lock()
+	a.Users = users
+	a.DefaultUser = defaultUser
+	a.mu.Unlock()
+	return nil
+}
+
+// SaveFile writes every user to path, replacing the file atomically.
+func (a *ACL) SaveFile(path string) error {
+	var buf bytes.Buffer
+	for _, name := range a.ListUsers() {
+		if user, ok := a.GetUser(name); ok {
+			buf.WriteString(user.ToACLString())
+			buf.WriteByte('\n')
+		}
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("ERR Opening temp ACL file for ACL SAVE: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return fmt.Errorf("ERR Writing ACL file for ACL SAVE: %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("ERR Syncing ACL file for ACL SAVE: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("ERR Writing ACL file for ACL SAVE: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("ERR Renaming ACL file for ACL SAVE: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package acl
+
+import (
+	"time"
+)
+
+// Reasons recorded in the ACL log.
+const (
+	ReasonCommand = "command"
+	ReasonKey     = "key"
+	ReasonChannel = "channel"
+	ReasonAuth    = "auth"
+)
+
+// MaxLogEntries bounds the ACL log, like acllog-max-len in Redis.
+const MaxLogEntries = 128
+
+// logGroupWindow is how long repeated identical denials are folded into one
+// entry instead of filling the log.
+const logGroupWindow = 60 * time.Second
+
+// LogEntry is one ACL LOG record: a denied command, key or channel access,
+// or a failed authentication.
+type LogEntry struct {
+	ID          int64
+	Count       int64
+	Reason      string
+	Context     string // "toplevel", "multi" or "lua"
+	Object      string // command name, key, channel or "AUTH"
+	Username    string
+	ClientInfo  string
+	CreatedAt   time.Time
+	LastUpdated time.Time
+}
+
+// LogDenial records a denial. Identical denials (same reason, context,
+// object and user) within a minute of each other share one entry whose
+// count is incremented.
+func (a *ACL) LogDenial(reason, context, object, username, clientInfo string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	for i, e := range a.log {
+		if e.Reason == reason && e.Context == context && e.Object == object &&
+			e.Username == username && now.Sub(e.LastUpdated) < logGroupWindow {
+			e.Count++
+			e.LastUpdated = now
+			e.ClientInfo = clientInfo
+			copy(a.log[1:i+1], a.log[:i])
+			a.log[0] = e
+			return
+		}
+	}
+
+	e := &LogEntry{
+		ID:          a.logSeq,
+		Count:       1,
+		Reason:      reason,
+		Context:     context,
+		Object:      object,
+		Username:    username,
+		ClientInfo:  clientInfo,
+		CreatedAt:   now,
+		LastUpdated: now,
+	}
+	a.logSeq++
+	a.log = append([]*LogEntry{e}, a.log...)
+	if len(a.log) > MaxLogEntries {
+		a.log = a.log[:MaxLogEntries]
+	}
+}
+
+// Log returns up to count entries, most recent first. A negative count
+// returns the whole log.
+func (a *ACL) Log(count int) []LogEntry {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if count < 0 || count > len(a.log) {
+		count = len(a.log)
+	}
+	entries := make([]LogEntry, count)
+	for i := range entries {
+		entries[i] = *a.log[i]
+	}
+	return entries
+}
+
+// ResetLog clears the ACL log.
+func (a *ACL) ResetLog() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.log = nil
+}
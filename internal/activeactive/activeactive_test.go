@@ -0,0 +1,427 @@
+package activeactive_test
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cachestorm/cachestorm/internal/activeactive"
+	"github.com/cachestorm/cachestorm/internal/command"
+	"github.com/cachestorm/cachestorm/internal/config"
+	"github.com/cachestorm/cachestorm/internal/crdt"
+	"github.com/cachestorm/cachestorm/internal/resp"
+	"github.com/cachestorm/cachestorm/internal/store"
+)
+
+// testNode is a node running its commands through a router of its own,
+// wired to its engine the way the server wires them, and serving its
+// peers' links on ln.
+type testNode struct {
+	name   string
+	store  *store.Store
+	router *command.Router
+	engine *activeactive.Engine
+	ln     net.Listener
+
+	// While gate is locked the node's streams hold what they have to send:
+	// the node is cut off from its peers.
+	gate sync.RWMutex
+
+	fedMu sync.Mutex
+	fed   []string
+}
+
+// newNodes returns nodes a, b, c... peering with each other, with the
+// given operation log sizes. They do not link up until started.
+func newNodes(t *testing.T, logSizes ...int) []*testNode {
+	t.Helper()
+	nodes := make([]*testNode, len(logSizes))
+	for i := range nodes {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ln.Close() })
+		nodes[i] = &testNode{name: string(rune('a' + i)), store: store.NewStoreWithNamespaces(), router: command.NewRouter(), ln: ln}
+	}
+	for i, n := range nodes {
+		var peers []string
+		for _, p := range nodes {
+			if p != n {
+				peers = append(peers, p.ln.Addr().String())
+			}
+		}
+		command.RegisterStringCommands(n.router)
+		command.RegisterKeyCommands(n.router)
+		command.RegisterServerCommands(n.router)
+		command.RegisterHashCommands(n.router)
+		command.RegisterSetCommands(n.router)
+		command.RegisterSortedSetCommands(n.router)
+
+		cfg := &config.ActiveActiveConfig{
+			Enabled: true, NodeID: n.name, Peers: peers,
+			OpLogSize: logSizes[i], TombstoneTTL: 3600, Timeout: 5,
+		}
+		n.engine = activeactive.NewEngine(cfg, n.store)
+		n.engine.SetKeys(n.router.Keys)
+		n.engine.SetWriteBarrier(n.router.PauseWrites)
+		n.engine.SetFeed(func(namespace, cmd string, args [][]byte) {
+			n.fedMu.Lock()
+			defer n.fedMu.Unlock()
+			n.fed = append(n.fed, cmd+" "+string(bytes.Join(args, []byte(" "))))
+		})
+		n.router.SetReplicationFeed(n.engine.Observe)
+		t.Cleanup(n.engine.Stop)
+		go n.serve()
+	}
+	return nodes
+}
+
+// serve answers the ACTIVEACTIVE commands of peers' links.
+func (n *testNode) serve() {
+	for {
+		conn, err := n.ln.Accept()
+		if err != nil {
+			return
+		}
+		go n.serveConn(conn)
+	}
+}
+
+func (n *testNode) serveConn(conn net.Conn) {
+	defer conn.Close()
+	done := make(chan struct{})
+	defer close(done)
+	var wmu sync.Mutex
+	write := func(b []byte) error {
+		wmu.Lock()
+		defer wmu.Unlock()
+		_, err := conn.Write(b)
+		return err
+	}
+	r := resp.NewReader(bufio.NewReader(conn))
+	var stream *activeactive.Stream
+	for {
+		_, args, err := r.ReadCommand()
+		if err != nil || len(args) == 0 {
+			if stream != nil {
+				stream.Close()
+			}
+			return
+		}
+		switch strings.ToUpper(string(args[0])) {
+		case "HELLO":
+			write(fmt.Appendf(nil, "$%d\r\n%s\r\n", len(n.name), n.name))
+		case "SYNC":
+			since, _ := crdt.ParseTimestamp(string(args[2]))
+			s, err := n.engine.Subscribe(string(args[1]), since)
+			if err != nil {
+				write([]byte("-" + err.Error() + "\r\n"))
+				continue
+			}
+			stream = s
+			write([]byte("+OK\r\n"))
+			go func() {
+				for {
+					data, err := s.Next(done)
+					if err != nil {
+						conn.Close()
+						return
+					}
+					n.gate.RLock()
+					err = write(data)
+					n.gate.RUnlock()
+					if err != nil {
+						return
+					}
+				}
+			}()
+		case "ACK":
+			if ts, err := crdt.ParseTimestamp(string(args[1])); err == nil && stream != nil {
+				stream.Ack(ts)
+			}
+		}
+	}
+}
+
+// do runs a command on the node and returns its reply.
+func (n *testNode) do(t *testing.T, args ...string) string {
+	t.Helper()
+	argv := make([][]byte, len(args)-1)
+	for i, a := range args[1:] {
+		argv[i] = []byte(a)
+	}
+	var out bytes.Buffer
+	w := resp.NewWriter(&out)
+	ctx := command.NewContext(strings.ToUpper(args[0]), argv, n.store, w)
+	if err := n.router.Execute(ctx); err != nil {
+		t.Fatalf("%v: %v", args, err)
+	}
+	w.Flush()
+	if strings.HasPrefix(out.String(), "-") {
+		t.Fatalf("%v: %s", args, out.String())
+	}
+	return out.String()
+}
+
+// show describes the value of key on the node. Merges change entries
+// under the write barrier, so the value is read under it too.
+func (n *testNode) show(key string) (s string) {
+	n.router.PauseWrites(func() { s = n.describe(key) })
+	return s
+}
+
+func (n *testNode) describe(key string) string {
+	entry, ok := n.store.Get(key)
+	if !ok {
+		return "nil"
+	}
+	switch v := entry.Value.(type) {
+	case *store.StringValue:
+		return string(v.Data)
+	case *store.SetValue:
+		v.RLock()
+		defer v.RUnlock()
+		var members []string
+		for m := range v.Members {
+			members = append(members, m)
+		}
+		sort.Strings(members)
+		return "set" + fmt.Sprint(members)
+	case *store.HashValue:
+		v.RLock()
+		defer v.RUnlock()
+		var fields []string
+		for f, val := range v.Fields {
+			fields = append(fields, f+"="+string(val))
+		}
+		sort.Strings(fields)
+		return "hash" + fmt.Sprint(fields)
+	case *store.SortedSetValue:
+		v.RLock()
+		defer v.RUnlock()
+		var members []string
+		for m, score := range v.Members {
+			members = append(members, fmt.Sprintf("%s:%g", m, score))
+		}
+		sort.Strings(members)
+		return "zset" + fmt.Sprint(members)
+	}
+	return fmt.Sprintf("%T", entry.Value)
+}
+
+// start links the nodes up.
+func start(nodes ...*testNode) {
+	for _, n := range nodes {
+		n.engine.Start()
+	}
+}
+
+// converged waits until every node shows want for each key.
+func converged(t *testing.T, want map[string]string, nodes ...*testNode) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		var diffs []string
+		for _, n := range nodes {
+			for key, w := range want {
+				if got := n.show(key); got != w {
+					diffs = append(diffs, fmt.Sprintf("%s shows %s=%s, want %s", n.name, key, got, w))
+				}
+			}
+		}
+		if len(diffs) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("nodes did not converge:\n%s", strings.Join(diffs, "\n"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// partition cuts the nodes off from each other until the returned
+// function is called.
+func partition(nodes ...*testNode) (heal func()) {
+	for _, n := range nodes {
+		n.gate.Lock()
+	}
+	return func() {
+		for _, n := range nodes {
+			n.gate.Unlock()
+		}
+	}
+}
+
+func TestConcurrentWritesConverge(t *testing.T) {
+	nodes := newNodes(t, 1000, 1000, 1000)
+	a, b, c := nodes[0], nodes[1], nodes[2]
+	start(a, b, c)
+
+	a.do(t, "SET", "counter", "10")
+	a.do(t, "SADD", "set", "x", "y")
+	a.do(t, "HSET", "hash", "f", "1", "g", "1")
+	a.do(t, "ZADD", "zset", "1", "m")
+	converged(t, map[string]string{
+		"counter": "10", "set": "set[x y]", "hash": "hash[f=1 g=1]", "zset": "zset[m:1]",
+	}, a, b, c)
+
+	heal := partition(a, b, c)
+	a.do(t, "INCRBY", "counter", "5")
+	b.do(t, "DECR", "counter")
+	c.do(t, "INCR", "counter")
+
+	// Removes and adds of different elements both take effect
+	a.do(t, "SREM", "set", "x")
+	b.do(t, "SADD", "set", "z")
+
+	a.do(t, "HSET", "hash", "f", "a")
+	time.Sleep(2 * time.Millisecond)
+	b.do(t, "HSET", "hash", "f", "b")
+	c.do(t, "HDEL", "hash", "g")
+
+	a.do(t, "ZADD", "zset", "5", "m")
+	b.do(t, "ZADD", "zset", "2", "n")
+
+	a.do(t, "SET", "lww", "from-a")
+	time.Sleep(2 * time.Millisecond)
+	c.do(t, "SET", "lww", "from-c")
+	heal()
+
+	converged(t, map[string]string{
+		"counter": "15",
+		"set":     "set[y z]",
+		"hash":    "hash[f=b]",
+		"zset":    "zset[m:5 n:2]",
+		"lww":     "from-c",
+	}, a, b, c)
+}
+
+func TestAddWinsOverConcurrentDelete(t *testing.T) {
+	nodes := newNodes(t, 1000, 1000)
+	a, b := nodes[0], nodes[1]
+	start(a, b)
+	a.do(t, "SADD", "s", "x", "y")
+	a.do(t, "HSET", "h", "f", "1")
+	converged(t, map[string]string{"s": "set[x y]", "h": "hash[f=1]"}, a, b)
+
+	heal := partition(a, b)
+	a.do(t, "DEL", "s", "h")
+	b.do(t, "SADD", "s", "w")
+	b.do(t, "HSET", "h", "g", "2")
+	heal()
+
+	// The delete took what a had seen; what b added meanwhile stays
+	converged(t, map[string]string{"s": "set[w]", "h": "hash[g=2]"}, a, b)
+}
+
+func TestLatestTypeWins(t *testing.T) {
+	nodes := newNodes(t, 1000, 1000)
+	a, b := nodes[0], nodes[1]
+	start(a, b)
+
+	heal := partition(a, b)
+	a.do(t, "SET", "k", "string")
+	time.Sleep(2 * time.Millisecond)
+	b.do(t, "SADD", "k", "member")
+	heal()
+	converged(t, map[string]string{"k": "set[member]"}, a, b)
+
+	a.do(t, "DEL", "k")
+	converged(t, map[string]string{"k": "nil"}, a, b)
+	b.do(t, "SET", "k", "again")
+	converged(t, map[string]string{"k": "again"}, a, b)
+}
+
+func TestExpiryReplicates(t *testing.T) {
+	nodes := newNodes(t, 1000, 1000)
+	a, b := nodes[0], nodes[1]
+	start(a, b)
+	a.do(t, "SET", "k", "v")
+	a.do(t, "EXPIRE", "k", "100")
+	converged(t, map[string]string{"k": "v"}, a, b)
+
+	expires(t, b, "k", true)
+	b.do(t, "PERSIST", "k")
+	expires(t, a, "k", false)
+}
+
+// expires waits until key on n has an expiry, or has none.
+func expires(t *testing.T, n *testNode, key string, want bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var got bool
+		n.router.PauseWrites(func() {
+			entry, ok := n.store.Get(key)
+			got = ok && entry.ExpiresAt != 0
+		})
+		if got == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s: expiry of %s is %v, want %v", n.name, key, got, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFlushReplicates(t *testing.T) {
+	nodes := newNodes(t, 1000, 1000)
+	a, b := nodes[0], nodes[1]
+	start(a, b)
+	a.do(t, "SET", "k1", "v")
+	a.do(t, "SADD", "k2", "m")
+	converged(t, map[string]string{"k1": "v", "k2": "set[m]"}, a, b)
+
+	b.do(t, "FLUSHDB")
+	converged(t, map[string]string{"k1": "nil", "k2": "nil"}, a, b)
+}
+
+func TestPeerCatchesUpFromState(t *testing.T) {
+	// a's log holds far fewer operations than b has to catch up on
+	nodes := newNodes(t, 4, 1000)
+	a, b := nodes[0], nodes[1]
+	want := make(map[string]string)
+	for i := range 20 {
+		key := fmt.Sprintf("k%d", i)
+		a.do(t, "SET", key, "v")
+		want[key] = "v"
+	}
+	a.do(t, "DEL", "k0")
+	want["k0"] = "nil"
+	b.do(t, "SET", "only-b", "1")
+	want["only-b"] = "1"
+
+	start(a, b)
+	converged(t, want, a, b)
+
+	// The writes the merge made reached b's feed, for its AOF and replicas
+	b.fedMu.Lock()
+	fed := strings.Join(b.fed, "\n")
+	b.fedMu.Unlock()
+	if !strings.Contains(fed, "SET k1 v") {
+		t.Errorf("b's feed lacks the merged keys:\n%s", fed)
+	}
+
+	// Later writes go through the log again
+	a.do(t, "SET", "after", "1")
+	converged(t, map[string]string{"after": "1"}, a, b)
+
+	if info := b.engine.GetInfo(); !strings.Contains(info, "node=a,link=up") {
+		t.Errorf("INFO does not show the link to a:\n%s", info)
+	}
+}
+
+func TestSubscribeRejectsOwnNodeID(t *testing.T) {
+	a := newNodes(t, 10)[0]
+	if _, err := a.engine.Subscribe("a", crdt.Timestamp{}); err == nil {
+		t.Fatal("a node should not serve a peer with its own node_id")
+	}
+}
@@ -0,0 +1,259 @@
+package activeactive
+
+import (
+	"bytes"
+	"strconv"
+	"time"
+
+	"github.com/cachestorm/cachestorm/internal/crdt"
+	"github.com/cachestorm/cachestorm/internal/store"
+)
+
+// State is a node's whole dataset as metadata, sent to a peer too far
+// behind to catch up from the operation log.
+type State struct {
+	Vector crdt.Vector `json:"v"`
+	Keys   []StateKey  `json:"k"`
+}
+
+// StateKey is the metadata of one key of a State.
+type StateKey struct {
+	Namespace string     `json:"ns"`
+	Key       string     `json:"k"`
+	Meta      *crdt.Meta `json:"m"`
+}
+
+// Apply merges operations a peer made, skipping those already merged, and
+// writes the keys they change.
+func (e *Engine) Apply(ops []*crdt.Op) {
+	e.barrier(func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		for _, op := range ops {
+			if e.applied.Covers(op.TS) {
+				continue
+			}
+			e.clock.Observe(op.TS)
+			st := e.store.ForNamespace(op.Namespace)
+			m, ok := st.CRDT(op.Key)
+			if !ok {
+				m = &crdt.Meta{}
+				st.SetCRDT(op.Key, m)
+			}
+			m.Apply(op)
+			e.applied.Advance(op.TS)
+			e.materialize(st, op.Namespace, op.Key, m, opElements(op))
+		}
+	})
+}
+
+// Merge merges the whole dataset of a peer and writes the keys it
+// changes.
+func (e *Engine) Merge(s *State) {
+	e.barrier(func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		mine := e.applied.Clone()
+		seen := make(map[string]map[string]bool)
+		for _, k := range s.Keys {
+			if seen[k.Namespace] == nil {
+				seen[k.Namespace] = make(map[string]bool)
+			}
+			seen[k.Namespace][k.Key] = true
+			st := e.store.ForNamespace(k.Namespace)
+			m, ok := st.CRDT(k.Key)
+			if !ok {
+				m = &crdt.Meta{}
+				st.SetCRDT(k.Key, m)
+			}
+			m.Merge(k.Meta, mine, s.Vector)
+			e.materialize(st, k.Namespace, k.Key, m, nil)
+		}
+		// The peer may have removed what only this node holds
+		for _, ns := range e.namespaces() {
+			st := e.store.ForNamespace(ns)
+			st.RangeCRDT(func(key string, m *crdt.Meta) {
+				if seen[ns][key] {
+					return
+				}
+				m.Merge(&crdt.Meta{}, mine, s.Vector)
+				e.materialize(st, ns, key, m, nil)
+			})
+		}
+		for _, ts := range s.Vector {
+			e.clock.Observe(ts)
+		}
+		e.applied.Join(s.Vector)
+	})
+}
+
+// opElements returns the elements op changes.
+func opElements(op *crdt.Op) []string {
+	elems := make([]string, 0, len(op.Adds)+len(op.Removes))
+	for _, a := range op.Adds {
+		elems = append(elems, a.Elem)
+	}
+	for _, r := range op.Removes {
+		elems = append(elems, r.Elem)
+	}
+	return elems
+}
+
+// materialize writes key as m resolves it, and sends the writes to the
+// feed. elems, if not nil, are the only elements of a collection that
+// changed.
+func (e *Engine) materialize(st *store.Store, namespace, key string, m *crdt.Meta, elems []string) {
+	kind := m.Kind()
+	if m.Expire.At != 0 && m.Expire.At <= time.Now().UnixMilli() {
+		kind = 0
+	}
+	entry, exists := st.Get(key)
+	if kind == 0 {
+		// Types that are not replicated are left alone
+		if exists && kindOf(entry.Value) != 0 {
+			st.Delete(key)
+			e.feed(namespace, "DEL", [][]byte{[]byte(key)})
+		}
+		return
+	}
+
+	switch {
+	case exists && kindOf(entry.Value) == kind && kind == crdt.KindString:
+		v, _ := m.Register.Get()
+		if sv := entry.Value.(*store.StringValue); !bytes.Equal(sv.Data, v) {
+			st.SetEntry(key, store.NewEntry(&store.StringValue{Data: bytes.Clone(v)}))
+			e.feed(namespace, "SET", [][]byte{[]byte(key), v})
+		}
+	case exists && kindOf(entry.Value) == kind:
+		c := m.Collection(kind)
+		if elems == nil {
+			elems = unionElements(collectionElements(kind, entry.Value, nil), c)
+		}
+		e.updateElements(namespace, key, entry.Value, c, kind, elems)
+	default:
+		value, cmd, args := resolve(m, kind, key)
+		if exists {
+			e.feed(namespace, "DEL", [][]byte{[]byte(key)})
+		}
+		st.SetEntry(key, store.NewEntry(value))
+		e.feed(namespace, cmd, args)
+	}
+
+	k := []byte(key)
+	if entry, exists = st.Get(key); exists && m.Expire.At != expiresAtMillis(entry) {
+		if m.Expire.At == 0 {
+			st.Persist(key)
+			e.feed(namespace, "PERSIST", [][]byte{k})
+		} else {
+			st.SetExpiresAt(key, m.Expire.At*1e6)
+			e.feed(namespace, "PEXPIREAT", [][]byte{k, strconv.AppendInt(nil, m.Expire.At, 10)})
+		}
+	}
+	st.IncrementVersion(key)
+}
+
+// unionElements returns the elements either held or in c.
+func unionElements(held map[string][]byte, c *crdt.Collection) []string {
+	elems := make([]string, 0, len(held))
+	for elem := range held {
+		elems = append(elems, elem)
+	}
+	for elem := range c.Elements {
+		if _, ok := held[elem]; !ok {
+			elems = append(elems, elem)
+		}
+	}
+	return elems
+}
+
+// resolve returns the value of kind m resolves to, with the command
+// writing it to key. The value shares nothing with m, as commands change
+// values in place.
+func resolve(m *crdt.Meta, kind crdt.Kind, key string) (store.Value, string, [][]byte) {
+	args := [][]byte{[]byte(key)}
+	if kind == crdt.KindString {
+		v, _ := m.Register.Get()
+		return &store.StringValue{Data: bytes.Clone(v)}, "SET", append(args, v)
+	}
+	c := m.Collection(kind)
+	switch kind {
+	case crdt.KindSet:
+		set := &store.SetValue{Members: make(map[string]struct{}, len(c.Elements))}
+		for elem := range c.Elements {
+			set.Members[elem] = struct{}{}
+			args = append(args, []byte(elem))
+		}
+		return set, "SADD", args
+	case crdt.KindHash:
+		hash := &store.HashValue{Fields: make(map[string][]byte, len(c.Elements))}
+		for elem := range c.Elements {
+			v, _ := c.Get(elem)
+			hash.Fields[elem] = bytes.Clone(v)
+			args = append(args, []byte(elem), v)
+		}
+		return hash, "HSET", args
+	default:
+		zset := &store.SortedSetValue{Members: make(map[string]float64, len(c.Elements))}
+		for elem := range c.Elements {
+			v, _ := c.Get(elem)
+			zset.Members[elem] = parseScore(v)
+			args = append(args, v, []byte(elem))
+		}
+		return zset, "ZADD", args
+	}
+}
+
+// updateElements brings elems of the collection value v in line with c.
+func (e *Engine) updateElements(namespace, key string, v store.Value, c *crdt.Collection, kind crdt.Kind, elems []string) {
+	k := []byte(key)
+	switch kind {
+	case crdt.KindSet:
+		set := v.(*store.SetValue)
+		set.Lock()
+		defer set.Unlock()
+		for _, elem := range elems {
+			_, held := set.Members[elem]
+			_, want := c.Get(elem)
+			switch {
+			case want && !held:
+				set.Members[elem] = struct{}{}
+				e.feed(namespace, "SADD", [][]byte{k, []byte(elem)})
+			case held && !want:
+				delete(set.Members, elem)
+				e.feed(namespace, "SREM", [][]byte{k, []byte(elem)})
+			}
+		}
+	case crdt.KindHash:
+		hash := v.(*store.HashValue)
+		hash.Lock()
+		defer hash.Unlock()
+		for _, elem := range elems {
+			cur, held := hash.Fields[elem]
+			val, want := c.Get(elem)
+			switch {
+			case want && (!held || string(cur) != string(val)):
+				hash.Fields[elem] = bytes.Clone(val)
+				e.feed(namespace, "HSET", [][]byte{k, []byte(elem), val})
+			case held && !want:
+				delete(hash.Fields, elem)
+				e.feed(namespace, "HDEL", [][]byte{k, []byte(elem)})
+			}
+		}
+	case crdt.KindZSet:
+		zset := v.(*store.SortedSetValue)
+		zset.Lock()
+		defer zset.Unlock()
+		for _, elem := range elems {
+			cur, held := zset.Members[elem]
+			val, want := c.Get(elem)
+			switch {
+			case want && (!held || cur != parseScore(val)):
+				zset.Members[elem] = parseScore(val)
+				e.feed(namespace, "ZADD", [][]byte{k, val, []byte(elem)})
+			case held && !want:
+				delete(zset.Members, elem)
+				e.feed(namespace, "ZREM", [][]byte{k, []byte(elem)})
+			}
+		}
+	}
+}
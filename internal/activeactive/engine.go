@@ -0,0 +1,231 @@
+// Package activeactive runs active-active replication: every node accepts
+// writes, records them as CRDT operations on the keys' metadata, and pulls
+// the operations the other nodes make from each of them.
+//
+// A node is told about its own writes through Observe, which compares what
+// a command left in the store with the key's metadata and records the
+// difference as an operation. Operations from a peer are merged into the
+// metadata, and the value the metadata now resolves to is written back.
+// Strings, sets, hashes and sorted sets are replicated; other types stay
+// on the node that wrote them.
+package activeactive
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cachestorm/cachestorm/internal/config"
+	"github.com/cachestorm/cachestorm/internal/crdt"
+	"github.com/cachestorm/cachestorm/internal/logger"
+	"github.com/cachestorm/cachestorm/internal/store"
+)
+
+const (
+	// Delays between attempts to reach a peer, doubling while it stays
+	// unreachable.
+	minReconnectDelay = 100 * time.Millisecond
+	maxReconnectDelay = 5 * time.Second
+
+	// pingInterval is how often an idle stream to a peer is pinged, and
+	// how often a peer acknowledges what it merged.
+	pingInterval = time.Second
+	// batchSize is the most operations sent to a peer at once.
+	batchSize = 512
+	// pruneInterval is how often the metadata of deleted keys is pruned.
+	pruneInterval = time.Minute
+)
+
+// Engine is the active-active replication of one node.
+type Engine struct {
+	cfg   config.ActiveActiveConfig
+	store *store.Store
+	clock *crdt.Clock
+
+	// Hooks set by the server: the keys a command writes, the barrier
+	// holding writes back while operations from peers are merged, and
+	// where the writes merging them makes go (AOF, replicas).
+	keys    func(cmd string, args [][]byte) []string
+	barrier func(func())
+	feed    func(namespace, cmd string, args [][]byte)
+
+	// mu guards the metadata of every key, the log and applied, the
+	// vector of operations merged.
+	mu      sync.Mutex
+	log     *opLog
+	applied crdt.Vector
+	streams map[*Stream]struct{}
+	links   map[string]*linkState
+
+	stopCh  chan struct{}
+	wg      sync.WaitGroup
+	started bool
+}
+
+// linkState describes the link to a peer for INFO.
+type linkState struct {
+	node   string
+	up     bool
+	lastIO time.Time
+}
+
+// NewEngine returns the engine of the node holding s. It pulls from no
+// peer until Start.
+func NewEngine(cfg *config.ActiveActiveConfig, s *store.Store) *Engine {
+	clock := crdt.NewClock(cfg.NodeID)
+	size := cfg.OpLogSize
+	if size <= 0 {
+		size = 100000
+	}
+	return &Engine{
+		cfg:     *cfg,
+		store:   s,
+		clock:   clock,
+		keys:    func(string, [][]byte) []string { return nil },
+		barrier: func(fn func()) { fn() },
+		feed:    func(string, string, [][]byte) {},
+		log:     newOpLog(size, clock.Now()),
+		applied: make(crdt.Vector),
+		streams: make(map[*Stream]struct{}),
+		links:   make(map[string]*linkState),
+		stopCh:  make(chan struct{}),
+	}
+}
+
+// NodeID returns the name of the node.
+func (e *Engine) NodeID() string {
+	return e.cfg.NodeID
+}
+
+// HasPeers reports whether the node has peers: ones it pulls from, or
+// ones pulling from it.
+func (e *Engine) HasPeers() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return len(e.cfg.Peers) > 0 || len(e.streams) > 0
+}
+
+// SetKeys sets how the keys a command writes are found.
+func (e *Engine) SetKeys(fn func(cmd string, args [][]byte) []string) {
+	e.keys = fn
+}
+
+// SetWriteBarrier sets the function running its argument while no write
+// is in progress, which operations from peers are merged under.
+func (e *Engine) SetWriteBarrier(fn func(func())) {
+	e.barrier = fn
+}
+
+// SetFeed sets where the writes made when merging operations from peers
+// are sent, so that the AOF and the node's replicas see them.
+func (e *Engine) SetFeed(fn func(namespace, cmd string, args [][]byte)) {
+	e.feed = fn
+}
+
+// Start opens the links to the peers.
+func (e *Engine) Start() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.started {
+		return
+	}
+	e.started = true
+	for _, addr := range e.cfg.Peers {
+		e.links[addr] = &linkState{}
+		e.wg.Add(1)
+		go e.follow(addr)
+	}
+	e.wg.Add(1)
+	go e.pruneLoop()
+}
+
+// Stop closes the links to and from peers.
+func (e *Engine) Stop() {
+	e.mu.Lock()
+	select {
+	case <-e.stopCh:
+		e.mu.Unlock()
+		return
+	default:
+	}
+	close(e.stopCh)
+	for s := range e.streams {
+		s.close()
+	}
+	e.mu.Unlock()
+	e.wg.Wait()
+}
+
+// pruneLoop drops the metadata of keys deleted longer than the tombstone
+// TTL ago.
+func (e *Engine) pruneLoop() {
+	defer e.wg.Done()
+	defer logger.RecoverPanic("activeactive-prune")
+	if e.cfg.TombstoneTTL <= 0 {
+		return
+	}
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			e.prune(time.Now().Add(-time.Duration(e.cfg.TombstoneTTL) * time.Second))
+		case <-e.stopCh:
+			return
+		}
+	}
+}
+
+func (e *Engine) prune(before time.Time) int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	pruned := 0
+	for _, ns := range e.namespaces() {
+		pruned += e.store.ForNamespace(ns).PruneCRDT(before)
+	}
+	if pruned > 0 {
+		logger.Debug().Int("keys", pruned).Msg("active-active tombstones pruned")
+	}
+	return pruned
+}
+
+// namespaces lists the namespaces of the store.
+func (e *Engine) namespaces() []string {
+	nm := e.store.GetNamespaceManager()
+	if nm == nil {
+		return []string{store.DBNamespace(0)}
+	}
+	names := nm.List()
+	sort.Strings(names)
+	return names
+}
+
+// GetInfo returns the active-active section of INFO.
+func (e *Engine) GetInfo() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var sb strings.Builder
+	sb.WriteString("# ActiveActive\r\n")
+	sb.WriteString(fmt.Sprintf("node_id:%s\r\n", e.cfg.NodeID))
+	sb.WriteString(fmt.Sprintf("op_log_len:%d\r\n", len(e.log.ops)))
+	sb.WriteString(fmt.Sprintf("last_op:%s\r\n", e.log.last()))
+
+	addrs := make([]string, 0, len(e.links))
+	for addr := range e.links {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	sb.WriteString(fmt.Sprintf("connected_peers:%d\r\n", len(e.streams)))
+	for i, addr := range addrs {
+		l := e.links[addr]
+		status, lag := "down", -1
+		if l.up {
+			status, lag = "up", int(time.Since(l.lastIO).Seconds())
+		}
+		sb.WriteString(fmt.Sprintf("peer%d:addr=%s,node=%s,link=%s,applied=%s,last_io=%d\r\n",
+			i, addr, l.node, status, e.applied[l.node], lag))
+	}
+	return sb.String()
+}
@@ -0,0 +1,202 @@
+package activeactive
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cachestorm/cachestorm/internal/crdt"
+	"github.com/cachestorm/cachestorm/internal/logger"
+	"github.com/cachestorm/cachestorm/internal/resp"
+)
+
+// follow keeps a link pulling from the peer at addr until the engine is
+// stopped, reconnecting with backoff whenever the link fails.
+func (e *Engine) follow(addr string) {
+	defer e.wg.Done()
+	defer logger.RecoverPanic("activeactive-link")
+
+	delay := minReconnectDelay
+	for {
+		started := time.Now()
+		err := e.pull(addr)
+		select {
+		case <-e.stopCh:
+			return
+		default:
+		}
+		// A link that held for a while was not a failed attempt.
+		if time.Since(started) > maxReconnectDelay {
+			delay = minReconnectDelay
+		}
+		logger.Warn().Err(err).Str("peer", addr).Dur("retry_in", delay).Msg("active-active link lost")
+
+		select {
+		case <-time.After(delay):
+		case <-e.stopCh:
+			return
+		}
+		delay = min(delay*2, maxReconnectDelay)
+	}
+}
+
+// pull runs one link to the peer at addr: it subscribes to the peer's
+// operations from the latest one merged, then merges what the peer sends
+// until the connection fails.
+func (e *Engine) pull(addr string) error {
+	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		// Closing the connection is what interrupts a blocked read.
+		select {
+		case <-e.stopCh:
+		case <-done:
+		}
+		conn.Close()
+	}()
+
+	l := &peerLink{
+		conn:    conn,
+		r:       resp.NewReader(bufio.NewReader(conn)),
+		w:       bufio.NewWriter(conn),
+		timeout: time.Duration(e.cfg.Timeout) * time.Second,
+	}
+	if e.cfg.PeerAuth != "" {
+		if _, err := l.call("AUTH", e.cfg.PeerAuth); err != nil {
+			return fmt.Errorf("AUTH: %w", err)
+		}
+	}
+	hello, err := l.call("ACTIVEACTIVE", "HELLO", e.cfg.NodeID)
+	if err != nil {
+		return fmt.Errorf("HELLO: %w", err)
+	}
+	node := string(hello.Bulk)
+	if node == e.cfg.NodeID {
+		return fmt.Errorf("peer %s has the node_id of this node", addr)
+	}
+
+	e.mu.Lock()
+	since := e.applied[node]
+	e.mu.Unlock()
+	if _, err := l.call("ACTIVEACTIVE", "SYNC", e.cfg.NodeID, since.String()); err != nil {
+		return fmt.Errorf("SYNC: %w", err)
+	}
+	e.setLink(addr, node, true)
+	defer e.setLink(addr, node, false)
+	logger.Info().Str("peer", addr).Str("node", node).Str("since", since.String()).Msg("active-active link up")
+
+	go e.sendAcks(l, node, done)
+	for {
+		v, err := l.read()
+		if err != nil {
+			return err
+		}
+		e.setLink(addr, node, true)
+		if v.Type != resp.TypeArray || len(v.Array) == 0 {
+			return fmt.Errorf("unexpected frame from peer")
+		}
+		switch name := string(v.Array[0].Bulk); {
+		case name == "PING":
+		case name == "OPS" && len(v.Array) == 2:
+			var ops []*crdt.Op
+			if err := json.Unmarshal(v.Array[1].Bulk, &ops); err != nil {
+				return fmt.Errorf("decoding operations: %w", err)
+			}
+			e.Apply(ops)
+		case name == "STATE" && len(v.Array) == 2:
+			var st State
+			if err := json.Unmarshal(v.Array[1].Bulk, &st); err != nil {
+				return fmt.Errorf("decoding state: %w", err)
+			}
+			e.Merge(&st)
+			logger.Info().Str("peer", addr).Int("keys", len(st.Keys)).Msg("active-active state merged")
+		default:
+			return fmt.Errorf("unexpected frame %q from peer", name)
+		}
+	}
+}
+
+// sendAcks tells the peer how far its operations have been merged, until
+// done is closed.
+func (e *Engine) sendAcks(l *peerLink, node string, done <-chan struct{}) {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			e.mu.Lock()
+			ts := e.applied[node]
+			e.mu.Unlock()
+			if err := l.send("ACTIVEACTIVE", "ACK", ts.String()); err != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+func (e *Engine) setLink(addr, node string, up bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	l := e.links[addr]
+	if l == nil {
+		l = &linkState{}
+		e.links[addr] = l
+	}
+	l.node, l.up = node, up
+	if up {
+		l.lastIO = time.Now()
+	}
+}
+
+// peerLink is a connection to a peer. ACKs are written from their own
+// goroutine, hence wmu.
+type peerLink struct {
+	conn    net.Conn
+	r       *resp.Reader
+	wmu     sync.Mutex
+	w       *bufio.Writer
+	timeout time.Duration
+}
+
+// send writes a command to the peer.
+func (l *peerLink) send(args ...string) error {
+	l.wmu.Lock()
+	defer l.wmu.Unlock()
+	fmt.Fprintf(l.w, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(l.w, "$%d\r\n%s\r\n", len(a), a)
+	}
+	return l.w.Flush()
+}
+
+// call sends a command and returns the peer's reply, failing on an error
+// reply.
+func (l *peerLink) call(args ...string) (*resp.Value, error) {
+	if err := l.send(args...); err != nil {
+		return nil, err
+	}
+	v, err := l.read()
+	if err != nil {
+		return nil, err
+	}
+	if v.Type == resp.TypeError {
+		return nil, fmt.Errorf("%s", v.Err)
+	}
+	return v, nil
+}
+
+// read reads a value, failing once the peer has been silent for longer
+// than the timeout. Peers ping idle links to stay inside it.
+func (l *peerLink) read() (*resp.Value, error) {
+	l.conn.SetReadDeadline(time.Now().Add(l.timeout))
+	return l.r.ReadValue()
+}
@@ -0,0 +1,295 @@
+package activeactive
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+
+	"github.com/cachestorm/cachestorm/internal/crdt"
+	"github.com/cachestorm/cachestorm/internal/store"
+)
+
+// counterCommands add to a string's integer: they become counter
+// operations, so that concurrent ones on different nodes all count.
+var counterCommands = map[string]bool{
+	"INCR":   true,
+	"INCRBY": true,
+	"DECR":   true,
+	"DECRBY": true,
+}
+
+// Observe records the changes a write command made on the node as
+// operations for the peers. It is given what the command sends to the AOF,
+// in namespace, and must run before another write to the same keys.
+func (e *Engine) Observe(namespace, cmd string, args [][]byte) {
+	if namespace == "" {
+		namespace = store.DBNamespace(0)
+	}
+	cmd = strings.ToUpper(cmd)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	st := e.store.ForNamespace(namespace)
+	if cmd == "FLUSHDB" || cmd == "FLUSHALL" {
+		// The flushed keys left their metadata behind
+		st.RangeCRDT(func(key string, m *crdt.Meta) {
+			e.observe(st, namespace, key, m, "", nil)
+		})
+		return
+	}
+	keys := e.keys(cmd, args)
+	for _, key := range keys {
+		m, _ := st.CRDT(key)
+		var elems []string
+		if len(keys) == 1 {
+			elems = touchedElements(cmd, args)
+		}
+		e.observe(st, namespace, key, m, cmd, elems)
+	}
+}
+
+// observe records the difference between key in st and its metadata m, nil
+// if it has none. elems, if not nil, are the only elements of a collection
+// that may have changed.
+func (e *Engine) observe(st *store.Store, namespace, key string, m *crdt.Meta, cmd string, elems []string) {
+	fresh := m == nil
+	if fresh {
+		m = &crdt.Meta{}
+	}
+	op := &crdt.Op{Namespace: namespace, Key: key}
+	entry, exists := st.Get(key)
+	var kind crdt.Kind
+	if exists {
+		kind = kindOf(entry.Value)
+	}
+
+	// Whatever the key held that it no longer does is deleted
+	if kind != crdt.KindString && m.Register.Live() {
+		op.Write = &crdt.Write{Deleted: true}
+	}
+	for k, c := range m.Collections {
+		if k == kind || !c.Live() {
+			continue
+		}
+		for elem := range c.Elements {
+			op.Removes = append(op.Removes, crdt.Remove{Kind: k, Elem: elem, Tags: c.Tags(elem)})
+		}
+	}
+
+	switch kind {
+	case crdt.KindString:
+		e.diffString(op, m, entry.Value.(*store.StringValue), cmd)
+	case crdt.KindSet, crdt.KindHash, crdt.KindZSet:
+		c := m.Collection(kind)
+		if !c.Live() {
+			elems = nil
+		}
+		diffCollection(op, c, kind, entry.Value, elems)
+	}
+	if kind != 0 {
+		if at := expiresAtMillis(entry); at != m.Expire.At {
+			op.Expire = &at
+		}
+	}
+	if op.Empty() {
+		return
+	}
+
+	op.TS = e.clock.Now()
+	m.Apply(op)
+	if fresh {
+		st.SetCRDT(key, m)
+	}
+	e.applied.Advance(op.TS)
+	e.log.append(op)
+}
+
+// diffString records a change of the string value v.
+func (e *Engine) diffString(op *crdt.Op, m *crdt.Meta, v *store.StringValue, cmd string) {
+	cur, live := m.Register.Get()
+	if live && bytes.Equal(cur, v.Data) {
+		return
+	}
+	if counterCommands[cmd] {
+		was := int64(0)
+		if live {
+			was, _ = strconv.ParseInt(string(cur), 10, 64)
+		}
+		if now, err := strconv.ParseInt(string(v.Data), 10, 64); err == nil {
+			c := m.Register.Counts[e.cfg.NodeID]
+			if d := now - was; d > 0 {
+				c.P += d
+			} else {
+				c.N -= d
+			}
+			base := crdt.Register{TS: m.Register.TS, Value: m.Register.Value, Deleted: m.Register.Deleted}
+			op.Count = &crdt.Count{Base: base, P: c.P, N: c.N}
+			return
+		}
+	}
+	op.Write = &crdt.Write{Value: bytes.Clone(v.Data)}
+}
+
+// diffCollection records the changes of the collection value v against c,
+// only looking at elems if they are given.
+func diffCollection(op *crdt.Op, c *crdt.Collection, kind crdt.Kind, v store.Value, elems []string) {
+	held := collectionElements(kind, v, elems)
+	if elems == nil {
+		for elem := range held {
+			elems = append(elems, elem)
+		}
+		if c != nil {
+			for elem := range c.Elements {
+				if _, ok := held[elem]; !ok {
+					elems = append(elems, elem)
+				}
+			}
+		}
+	}
+	for _, elem := range elems {
+		value, ok := held[elem]
+		was, had := c.Get(elem)
+		switch {
+		case ok && had && sameElement(kind, value, was):
+		case ok:
+			if had {
+				op.Removes = append(op.Removes, crdt.Remove{Kind: kind, Elem: elem, Tags: c.Tags(elem)})
+			}
+			op.Adds = append(op.Adds, crdt.Add{Kind: kind, Elem: elem, Value: value})
+		case had:
+			op.Removes = append(op.Removes, crdt.Remove{Kind: kind, Elem: elem, Tags: c.Tags(elem)})
+		}
+	}
+}
+
+// collectionElements returns the elements of v with their values, only
+// those of elems if it is not nil.
+func collectionElements(kind crdt.Kind, v store.Value, elems []string) map[string][]byte {
+	held := make(map[string][]byte)
+	switch kind {
+	case crdt.KindSet:
+		set := v.(*store.SetValue)
+		set.RLock()
+		defer set.RUnlock()
+		if elems == nil {
+			for m := range set.Members {
+				held[m] = nil
+			}
+		}
+		for _, m := range elems {
+			if _, ok := set.Members[m]; ok {
+				held[m] = nil
+			}
+		}
+	case crdt.KindHash:
+		hash := v.(*store.HashValue)
+		hash.RLock()
+		defer hash.RUnlock()
+		if elems == nil {
+			for f, val := range hash.Fields {
+				held[f] = bytes.Clone(val)
+			}
+		}
+		for _, f := range elems {
+			if val, ok := hash.Fields[f]; ok {
+				held[f] = bytes.Clone(val)
+			}
+		}
+	case crdt.KindZSet:
+		zset := v.(*store.SortedSetValue)
+		zset.RLock()
+		defer zset.RUnlock()
+		if elems == nil {
+			for m, score := range zset.Members {
+				held[m] = formatScore(score)
+			}
+		}
+		for _, m := range elems {
+			if score, ok := zset.Members[m]; ok {
+				held[m] = formatScore(score)
+			}
+		}
+	}
+	return held
+}
+
+func sameElement(kind crdt.Kind, a, b []byte) bool {
+	if kind == crdt.KindZSet {
+		return parseScore(a) == parseScore(b)
+	}
+	return bytes.Equal(a, b)
+}
+
+func formatScore(score float64) []byte {
+	return strconv.AppendFloat(nil, score, 'g', -1, 64)
+}
+
+func parseScore(b []byte) float64 {
+	f, _ := strconv.ParseFloat(string(b), 64)
+	return f
+}
+
+// kindOf returns the replicated type of v, 0 if it is not replicated.
+func kindOf(v store.Value) crdt.Kind {
+	switch v.(type) {
+	case *store.StringValue:
+		return crdt.KindString
+	case *store.SetValue:
+		return crdt.KindSet
+	case *store.HashValue:
+		return crdt.KindHash
+	case *store.SortedSetValue:
+		return crdt.KindZSet
+	}
+	return 0
+}
+
+func expiresAtMillis(entry *store.Entry) int64 {
+	if entry.ExpiresAt == 0 {
+		return 0
+	}
+	return entry.ExpiresAt / 1e6
+}
+
+// touchedElements returns the only elements cmd can have changed in the
+// collection it writes, nil if it is not known.
+func touchedElements(cmd string, args [][]byte) []string {
+	var from, step int
+	switch cmd {
+	case "SADD", "SREM", "HDEL", "ZREM":
+		from, step = 1, 1
+	case "HSET", "HMSET":
+		from, step = 1, 2
+	case "HSETNX", "HINCRBY", "HINCRBYFLOAT":
+		return argAt(args, 1)
+	case "ZINCRBY":
+		return argAt(args, 2)
+	case "ZADD":
+		from = 1
+		for from < len(args) && isZAddFlag(args[from]) {
+			from++
+		}
+		from, step = from+1, 2
+	default:
+		return nil
+	}
+	var elems []string
+	for i := from; i < len(args); i += step {
+		elems = append(elems, string(args[i]))
+	}
+	return elems
+}
+
+func argAt(args [][]byte, i int) []string {
+	if i >= len(args) {
+		return nil
+	}
+	return []string{string(args[i])}
+}
+
+func isZAddFlag(arg []byte) bool {
+	switch strings.ToUpper(string(arg)) {
+	case "NX", "XX", "GT", "LT", "CH", "INCR":
+		return true
+	}
+	return false
+}
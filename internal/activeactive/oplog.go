@@ -0,0 +1,62 @@
+package activeactive
+
+import (
+	"github.com/cachestorm/cachestorm/internal/crdt"
+)
+
+// opLog keeps the latest operations the node made, in order, for peers
+// catching up. It covers every operation after start: a peer that has
+// merged up to start or later can be sent what it misses from the log.
+type opLog struct {
+	ops   []*crdt.Op
+	size  int
+	start crdt.Timestamp
+	// changed is closed, and replaced, when an operation is appended.
+	changed chan struct{}
+}
+
+func newOpLog(size int, start crdt.Timestamp) *opLog {
+	return &opLog{size: size, start: start, changed: make(chan struct{})}
+}
+
+func (l *opLog) append(op *crdt.Op) {
+	if len(l.ops) >= l.size {
+		drop := len(l.ops) - l.size + 1
+		l.start = l.ops[drop-1].TS
+		l.ops = append(l.ops[:0], l.ops[drop:]...)
+	}
+	l.ops = append(l.ops, op)
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// since returns up to limit operations made after ts. It reports false if
+// the log no longer holds all of them.
+func (l *opLog) since(ts crdt.Timestamp, limit int) ([]*crdt.Op, bool) {
+	if ts.Less(l.start) {
+		return nil, false
+	}
+	// Operations are appended in timestamp order
+	lo, hi := 0, len(l.ops)
+	for lo < hi {
+		mid := (lo + hi) / 2
+		if ts.Less(l.ops[mid].TS) {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+	ops := l.ops[lo:]
+	if len(ops) > limit {
+		ops = ops[:limit]
+	}
+	return ops, true
+}
+
+// last returns the timestamp of the latest operation, or start.
+func (l *opLog) last() crdt.Timestamp {
+	if len(l.ops) == 0 {
+		return l.start
+	}
+	return l.ops[len(l.ops)-1].TS
+}
@@ -0,0 +1,165 @@
+package activeactive
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cachestorm/cachestorm/internal/crdt"
+	"github.com/cachestorm/cachestorm/internal/logger"
+)
+
+var errStreamClosed = errors.New("active-active stream closed")
+
+// Stream sends a peer the operations this node makes, from where the peer
+// left off, or the whole dataset first if the log no longer goes back
+// that far. It is the serving end of the peer's link.
+//
+// The stream is made of RESP arrays: OPS with a JSON batch of operations,
+// STATE with a JSON State, and PING while there is nothing to send.
+type Stream struct {
+	e     *Engine
+	node  string
+	pos   crdt.Timestamp // this node's latest operation sent
+	full  bool           // the dataset is to be sent first
+	acked crdt.Timestamp // this node's latest operation the peer merged
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Subscribe starts a stream to the peer node, which has merged this node's
+// operations up to since.
+func (e *Engine) Subscribe(node string, since crdt.Timestamp) (*Stream, error) {
+	if node == e.cfg.NodeID {
+		return nil, fmt.Errorf("ERR peer has the node_id of this node")
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	select {
+	case <-e.stopCh:
+		return nil, errStreamClosed
+	default:
+	}
+	s := &Stream{e: e, node: node, pos: since, closed: make(chan struct{})}
+	if _, ok := e.log.since(since, 0); !ok {
+		s.full = true
+	}
+	e.streams[s] = struct{}{}
+	logger.Info().Str("peer", node).Bool("full", s.full).Msg("active-active peer subscribed")
+	return s, nil
+}
+
+// Next returns what to write to the peer next, waiting for operations to
+// send until done is closed.
+func (s *Stream) Next(done <-chan struct{}) ([]byte, error) {
+	e := s.e
+	ping := time.NewTimer(pingInterval)
+	defer ping.Stop()
+	for {
+		e.mu.Lock()
+		select {
+		case <-s.closed:
+			e.mu.Unlock()
+			return nil, errStreamClosed
+		default:
+		}
+		if s.full {
+			payload, err := json.Marshal(e.state())
+			s.full, s.pos = false, e.log.last()
+			e.mu.Unlock()
+			if err != nil {
+				return nil, err
+			}
+			return appendFrame(nil, "STATE", payload), nil
+		}
+		ops, ok := e.log.since(s.pos, batchSize)
+		if !ok {
+			s.full = true
+			e.mu.Unlock()
+			continue
+		}
+		if len(ops) > 0 {
+			payload, err := json.Marshal(ops)
+			s.pos = ops[len(ops)-1].TS
+			e.mu.Unlock()
+			if err != nil {
+				return nil, err
+			}
+			return appendFrame(nil, "OPS", payload), nil
+		}
+		changed := e.log.changed
+		e.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ping.C:
+			return appendFrame(nil, "PING", nil), nil
+		case <-s.closed:
+			return nil, errStreamClosed
+		case <-done:
+			return nil, errStreamClosed
+		}
+	}
+}
+
+// Ack records that the peer has merged this node's operations up to ts.
+func (s *Stream) Ack(ts crdt.Timestamp) {
+	s.e.mu.Lock()
+	defer s.e.mu.Unlock()
+	if s.acked.Less(ts) {
+		s.acked = ts
+	}
+}
+
+// Close ends the stream.
+func (s *Stream) Close() {
+	s.e.mu.Lock()
+	delete(s.e.streams, s)
+	s.e.mu.Unlock()
+	s.close()
+}
+
+func (s *Stream) close() {
+	s.closeOnce.Do(func() { close(s.closed) })
+}
+
+// state returns the whole dataset as metadata. e.mu must be held.
+func (e *Engine) state() *State {
+	st := &State{Vector: e.applied.Clone()}
+	// The log starts where the engine did
+	st.Vector.Advance(e.log.last())
+	for _, ns := range e.namespaces() {
+		e.store.ForNamespace(ns).RangeCRDT(func(key string, m *crdt.Meta) {
+			st.Keys = append(st.Keys, StateKey{Namespace: ns, Key: key, Meta: m})
+		})
+	}
+	return st
+}
+
+// appendFrame appends a stream frame: name, then payload unless it is nil.
+func appendFrame(buf []byte, name string, payload []byte) []byte {
+	n := 1
+	if payload != nil {
+		n = 2
+	}
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(n), 10)
+	buf = append(buf, '\r', '\n')
+	buf = appendBulk(buf, []byte(name))
+	if payload != nil {
+		buf = appendBulk(buf, payload)
+	}
+	return buf
+}
+
+func appendBulk(buf, b []byte) []byte {
+	buf = append(buf, '$')
+	buf = strconv.AppendInt(buf, int64(len(b)), 10)
+	buf = append(buf, '\r', '\n')
+	buf = append(buf, b...)
+	return append(buf, '\r', '\n')
+}
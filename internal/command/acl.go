@@ -0,0 +1,633 @@
+package command
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cachestorm/cachestorm/internal/acl"
+	"github.com/cachestorm/cachestorm/internal/resp"
+)
+
+// ACL enforcement. Every command from a client is checked against the
+// connection's ACL user before it runs (or is queued by MULTI): the command
+// or subcommand must be allowed by name or category, every key it names must
+// match one of the user's ~patterns and every channel one of its &patterns.
+// Denials are recorded in ACL LOG.
+
+// Contexts recorded in ACL LOG entries.
+const (
+	aclContextTopLevel = "toplevel"
+	aclContextMulti    = "multi"
+	aclContextLua      = "lua"
+)
+
+// aclCategoryCommands lists the members of each ACL category except read,
+// write, fast, slow and blocking, which come from the flags in the command
+// table: slow is every command that is not fast. Commands flagged admin are
+// also in admin and dangerous.
+var aclCategoryCommands = map[string][]string{
+	"string": {
+		"GET", "SET", "SETNX", "SETEX", "PSETEX", "MGET", "MSET", "MSETNX", "APPEND",
+		"INCR", "DECR", "INCRBY", "DECRBY", "INCRBYFLOAT", "STRLEN", "GETRANGE",
+		"SETRANGE", "SUBSTR", "GETSET", "GETEX", "GETDEL", "LCS",
+	},
+	"bitmap": {
+		"SETBIT", "GETBIT", "BITCOUNT", "BITPOS", "BITOP", "BITFIELD", "BITFIELD_RO",
+	},
+	"hash": {
+		"HSET", "HSETNX", "HMSET", "HGET", "HMGET", "HGETALL", "HKEYS", "HVALS", "HLEN",
+		"HEXISTS", "HDEL", "HINCRBY", "HINCRBYFLOAT", "HSTRLEN", "HRANDFIELD", "HSCAN",
+		"HGETDEL", "HGETEX",
+	},
+	"list": {
+		"LPUSH", "RPUSH", "LPUSHX", "RPUSHX", "LPOP", "RPOP", "LLEN", "LRANGE", "LINDEX",
+		"LSET", "LREM", "LTRIM", "LINSERT", "LPOS", "LMOVE", "RPOPLPUSH", "LMPOP",
+		"BLPOP", "BRPOP", "BRPOPLPUSH", "BLMOVE", "BLMPOP",
+	},
+	"set": {
+		"SADD", "SREM", "SMEMBERS", "SISMEMBER", "SMISMEMBER", "SCARD", "SPOP",
+		"SRANDMEMBER", "SMOVE", "SINTER", "SUNION", "SDIFF", "SINTERSTORE",
+		"SUNIONSTORE", "SDIFFSTORE", "SINTERCARD", "SSCAN",
+	},
+	"sortedset": {
+		"ZADD", "ZREM", "ZCARD", "ZCOUNT", "ZSCORE", "ZMSCORE", "ZINCRBY", "ZRANK",
+		"ZREVRANK", "ZRANGE", "ZREVRANGE", "ZRANGEBYSCORE", "ZREVRANGEBYSCORE",
+		"ZRANGEBYLEX", "ZREVRANGEBYLEX", "ZLEXCOUNT", "ZREMRANGEBYRANK",
+		"ZREMRANGEBYSCORE", "ZREMRANGEBYLEX", "ZPOPMIN", "ZPOPMAX", "BZPOPMIN",
+		"BZPOPMAX", "ZRANDMEMBER", "ZUNIONSTORE", "ZINTERSTORE", "ZDIFFSTORE",
+		"ZUNION", "ZINTER", "ZDIFF", "ZINTERCARD", "ZRANGESTORE", "ZMPOP", "BZMPOP",
+		"ZSCAN",
+	},
+	"stream": {
+		"XADD", "XLEN", "XRANGE", "XREVRANGE", "XREAD", "XREADGROUP", "XDEL", "XTRIM",
+		"XINFO", "XGROUP", "XACK", "XPENDING", "XCLAIM", "XAUTOCLAIM", "XSETID",
+	},
+	"geo": {
+		"GEOADD", "GEODIST", "GEOHASH", "GEOPOS", "GEORADIUS", "GEORADIUSBYMEMBER",
+		"GEORADIUS_RO", "GEORADIUSBYMEMBER_RO", "GEOSEARCH", "GEOSEARCHSTORE",
+	},
+	"hyperloglog": {
+		"PFADD", "PFCOUNT", "PFMERGE",
+	},
+	"keyspace": {
+		"DEL", "UNLINK", "EXISTS", "TYPE", "TTL", "PTTL", "EXPIRE", "PEXPIRE",
+		"EXPIREAT", "PEXPIREAT", "EXPIRETIME", "PEXPIRETIME", "PERSIST", "RENAME",
+		"RENAMENX", "KEYS", "SCAN", "RANDOMKEY", "TOUCH", "DUMP", "RESTORE", "COPY",
+		"MOVE", "OBJECT", "SORT", "SORT_RO", "DBSIZE", "FLUSHDB", "FLUSHALL", "SWAPDB",
+		"MIGRATE",
+	},
+	"pubsub": {
+		"SUBSCRIBE", "UNSUBSCRIBE", "PSUBSCRIBE", "PUNSUBSCRIBE", "SSUBSCRIBE",
+		"SUNSUBSCRIBE", "PUBLISH", "SPUBLISH", "PUBSUB",
+	},
+	"connection": {
+		"AUTH", "HELLO", "PING", "ECHO", "QUIT", "RESET", "SELECT", "CLIENT", "COMMAND",
+		"READONLY", "READWRITE", "ASKING",
+	},
+	"transaction": {
+		"MULTI", "EXEC", "DISCARD", "WATCH", "UNWATCH",
+	},
+	"scripting": {
+		"EVAL", "EVALSHA", "EVAL_RO", "EVALSHA_RO", "SCRIPT", "FCALL", "FCALL_RO",
+		"FUNCTION",
+	},
+	"admin": {
+		"ACL", "CONFIG", "DEBUG", "MONITOR", "SHUTDOWN", "SAVE", "BGSAVE",
+		"BGREWRITEAOF", "LASTSAVE", "SLAVEOF", "REPLICAOF", "SYNC", "PSYNC", "ACTIVEACTIVE", "SLOWLOG",
+		"LATENCY", "MODULE", "FAILOVER", "ROLE", "CLUSTER", "DUMPALL",
+	},
+	"dangerous": {
+		"ACL", "CONFIG", "DEBUG", "MONITOR", "SHUTDOWN", "SAVE", "BGSAVE",
+		"BGREWRITEAOF", "LASTSAVE", "SLAVEOF", "REPLICAOF", "SYNC", "PSYNC", "ACTIVEACTIVE", "SLOWLOG",
+		"LATENCY", "MODULE", "FAILOVER", "ROLE", "CLUSTER", "FLUSHALL", "FLUSHDB",
+		"KEYS", "SORT", "SWAPDB", "MIGRATE", "RESTORE", "INFO", "DUMPALL",
+	},
+	"json": {
+		"JSON.ARRAPPEND", "JSON.ARRLEN", "JSON.DEL", "JSON.GET", "JSON.MGET", "JSON.MSET",
+		"JSON.NUMINCRBY", "JSON.NUMMULTBY", "JSON.OBJKEYS", "JSON.OBJLEN", "JSON.SET",
+		"JSON.STRAPPEND", "JSON.STRLEN", "JSON.TYPE",
+	},
+	"bloom": {
+		"BF.ADD", "BF.EXISTS", "BF.INFO", "BF.MADD", "BF.MEXISTS", "BF.RESERVE",
+	},
+	"cuckoo": {
+		"CF.ADD", "CF.DEL", "CF.EXISTS", "CF.INFO", "CF.RESERVE",
+	},
+	"cms": {
+		"CMS.INCRBY", "CMS.INFO", "CMS.INIT", "CMS.QUERY",
+	},
+	"topk": {
+		"TOPK.ADD", "TOPK.INFO", "TOPK.LIST", "TOPK.QUERY", "TOPK.RESERVE",
+	},
+	"tdigest": {
+		"TDIGEST.ADD", "TDIGEST.CDF", "TDIGEST.CREATE", "TDIGEST.INFO", "TDIGEST.MAX",
+		"TDIGEST.MEAN", "TDIGEST.MERGE", "TDIGEST.MIN", "TDIGEST.QUANTILE", "TDIGEST.RESET",
+	},
+	"timeseries": {
+		"TS.ADD", "TS.ALTER", "TS.CREATE", "TS.DECRBY", "TS.DEL", "TS.GET", "TS.INCRBY",
+		"TS.INFO", "TS.MADD", "TS.QUERYINDEX", "TS.RANGE", "TS.REVRANGE",
+	},
+	"search": {
+		"FT._LIST", "FT.ADD", "FT.AGGREGATE", "FT.ALIASADD", "FT.ALIASDEL", "FT.CREATE",
+		"FT.DEL", "FT.DROPINDEX", "FT.GET", "FT.INFO", "FT.SEARCH", "FT.TAGVALS",
+	},
+	"graph": {
+		"GRAPH.ADDEDGE", "GRAPH.ADDNODE", "GRAPH.CREATE", "GRAPH.DELEDGE", "GRAPH.DELETE",
+		"GRAPH.DELNODE", "GRAPH.GETEDGE", "GRAPH.GETNODE", "GRAPH.INFO", "GRAPH.LIST",
+		"GRAPH.NEIGHBORS", "GRAPH.QUERY",
+	},
+}
+
+// aclSubcommandCategories overrides the categories of subcommands that are
+// more (or less) privileged than their container command.
+var aclSubcommandCategories = map[string][]string{
+	"ACL|WHOAMI":     {"slow"},
+	"ACL|CAT":        {"slow"},
+	"ACL|GENPASS":    {"slow"},
+	"ACL|HELP":       {"slow"},
+	"CLIENT|KILL":    {"admin", "slow", "dangerous", "connection"},
+	"CLIENT|LIST":    {"admin", "slow", "dangerous", "connection"},
+	"CLIENT|PAUSE":   {"admin", "slow", "dangerous", "connection"},
+	"CLIENT|UNPAUSE": {"admin", "slow", "dangerous", "connection"},
+	"OBJECT|HELP":    {"keyspace", "slow"},
+	"SCRIPT|FLUSH":   {"scripting", "slow", "dangerous"},
+	"FUNCTION|FLUSH": {"scripting", "write", "slow", "dangerous"},
+}
+
+// Commands whose first argument names a subcommand that ACL rules can
+// address as "command|subcommand".
+var aclContainerCommands = map[string]bool{
+	"ACL": true, "CLIENT": true, "CLUSTER": true, "COMMAND": true, "CONFIG": true,
+	"DEBUG": true, "FUNCTION": true, "LATENCY": true, "MEMORY": true, "MODULE": true,
+	"OBJECT": true, "PUBSUB": true, "SCRIPT": true, "SLOWLOG": true, "XGROUP": true,
+	"XINFO": true,
+}
+
+// commandCategories maps a command to its sorted ACL categories.
+var commandCategories = buildCommandCategories()
+
+func buildCommandCategories() map[string][]string {
+	sets := make(map[string]map[string]bool)
+	add := func(cmd, category string) {
+		if sets[cmd] == nil {
+			sets[cmd] = make(map[string]bool)
+		}
+		sets[cmd][category] = true
+	}
+	for category, cmds := range aclCategoryCommands {
+		for _, cmd := range cmds {
+			add(cmd, category)
+		}
+	}
+
+	for cmd, spec := range commandTable {
+		for _, flag := range strings.Fields(spec.flags) {
+			switch flag {
+			case FlagWrite:
+				add(cmd, "write")
+			case FlagReadOnly:
+				add(cmd, "read")
+			case FlagFast:
+				add(cmd, "fast")
+			case FlagBlocking:
+				add(cmd, "blocking")
+			case FlagAdmin:
+				add(cmd, "admin")
+				add(cmd, "dangerous")
+			}
+		}
+	}
+
+	out := make(map[string][]string, len(sets))
+	for cmd, set := range sets {
+		if !set["fast"] {
+			set["slow"] = true
+		}
+		categories := make([]string, 0, len(set))
+		for category := range set {
+			categories = append(categories, category)
+		}
+		sort.Strings(categories)
+		out[cmd] = categories
+	}
+	return out
+}
+
+// aclCommandName returns the command (and subcommand, for container
+// commands) that ACL rules and error messages refer to.
+func aclCommandName(cmd string, args [][]byte) (string, string) {
+	if aclContainerCommands[cmd] && len(args) > 0 {
+		return cmd, strings.ToUpper(string(args[0]))
+	}
+	return cmd, ""
+}
+
+func aclCategoriesOf(cmd, sub string) []string {
+	if sub != "" {
+		if categories, ok := aclSubcommandCategories[cmd+"|"+sub]; ok {
+			return categories
+		}
+	}
+	return commandCategories[cmd]
+}
+
+// commandChannels returns the channels a command publishes or subscribes
+// to. patterns is true for PSUBSCRIBE.
+func commandChannels(cmd string, args [][]byte) (channels []string, patterns bool) {
+	switch cmd {
+	case "PUBLISH", "SPUBLISH":
+		if len(args) > 0 {
+			return []string{string(args[0])}, false
+		}
+	case "SUBSCRIBE", "SSUBSCRIBE":
+		return allKeys.keys(args), false
+	case "PSUBSCRIBE":
+		return allKeys.keys(args), true
+	}
+	return nil, false
+}
+
+// aclDenial checks a command against a user's permissions. It returns the
+// reason for the denial and the command, key or channel that caused it, or
+// empty strings when the command is allowed.
+func aclDenial(user *acl.User, cmd string, args [][]byte) (reason, object string) {
+	if user.Unrestricted() {
+		return "", ""
+	}
+	name, sub := aclCommandName(cmd, args)
+	if !user.CanExecute(name, sub, aclCategoriesOf(name, sub)) {
+		if sub != "" {
+			return acl.ReasonCommand, strings.ToLower(name + "|" + sub)
+		}
+		return acl.ReasonCommand, strings.ToLower(name)
+	}
+	keys := commandKeys(cmd, args)
+	if len(keys) == 0 && hasFixedKeys(cmd) && !user.AllKeys() {
+		// The keys could not be told apart, so they cannot be checked.
+		return acl.ReasonKey, ""
+	}
+	for _, key := range keys {
+		if !user.CanAccessKey(key) {
+			return acl.ReasonKey, key
+		}
+	}
+	channels, patterns := commandChannels(cmd, args)
+	for _, channel := range channels {
+		allowed := user.CanAccessChannel(channel)
+		if patterns {
+			allowed = user.CanAccessChannelPattern(channel)
+		}
+		if !allowed {
+			return acl.ReasonChannel, channel
+		}
+	}
+	return "", ""
+}
+
+// aclErrorMessage formats a denial the way a client sees it.
+func aclErrorMessage(username, reason, object string) string {
+	switch reason {
+	case acl.ReasonKey:
+		return "NOPERM No permissions to access a key"
+	case acl.ReasonChannel:
+		return "NOPERM No permissions to access a channel"
+	default:
+		return "NOPERM User " + username + " has no permissions to run the '" + object + "' command"
+	}
+}
+
+// currentACLUser resolves the connection's ACL user. Connections that have
+// not authenticated act as the default user. ok is false when the user has
+// been deleted or disabled since the connection authenticated.
+func (ctx *Context) currentACLUser() (*acl.User, bool) {
+	name := ctx.Username
+	if name == "" || !ctx.IsAuthenticated() {
+		name = "default"
+	}
+	user, ok := globalACL.GetUser(name)
+	if !ok || !user.IsEnabled() {
+		return nil, false
+	}
+	return user, true
+}
+
+// checkACL enforces the connection user's permissions for the command in
+// ctx. It writes the error reply and returns false when the command is
+// denied. Commands usable before authentication (AUTH, HELLO, ...) are
+// always allowed, so that a restricted user can switch identities.
+func (ctx *Context) checkACL(aclContext string) bool {
+	if msg := ctx.aclError(aclContext); msg != "" {
+		ctx.Writer.WriteError(msg)
+		return false
+	}
+	return true
+}
+
+// aclError is checkACL returning the error instead of replying with it.
+func (ctx *Context) aclError(aclContext string) string {
+	if noAuthCommands[ctx.Command] {
+		return ""
+	}
+	user, ok := ctx.currentACLUser()
+	if !ok {
+		// The user was deleted or disabled: the connection has to log in again
+		ctx.SetAuthenticated(false)
+		ctx.SetUsername("default")
+		return "NOAUTH Authentication required."
+	}
+	reason, object := aclDenial(user, ctx.Command, ctx.Args)
+	if reason == "" {
+		return ""
+	}
+	globalACL.LogDenial(reason, aclContext, object, user.Name, ctx.aclClientInfo())
+	return aclErrorMessage(user.Name, reason, object)
+}
+
+func (ctx *Context) aclClientInfo() string {
+	if ctx.Session != nil {
+		return clientInfoLine(ctx.Session)
+	}
+	return "id=" + strconv.FormatInt(ctx.ClientID, 10) + " addr=" + ctx.RemoteAddr
+}
+
+// logAuthFailure records a failed AUTH or HELLO AUTH in ACL LOG.
+func (ctx *Context) logAuthFailure(username string) {
+	globalACL.LogDenial(acl.ReasonAuth, aclContextTopLevel, "AUTH", username, ctx.aclClientInfo())
+}
+
+func cmdACL(ctx *Context) error {
+	if ctx.ArgCount() < 1 {
+		return ctx.WriteError(ErrWrongArgCount)
+	}
+
+	subCmd := strings.ToUpper(ctx.ArgString(0))
+
+	switch subCmd {
+	case "LIST":
+		users := globalACL.ListUsers()
+		results := make([]*resp.Value, 0, len(users))
+		for _, name := range users {
+			if user, ok := globalACL.GetUser(name); ok {
+				results = append(results, resp.BulkString(user.ToACLString()))
+			}
+		}
+		return ctx.WriteArray(results)
+	case "USERS":
+		users := globalACL.ListUsers()
+		results := make([]*resp.Value, 0, len(users))
+		for _, name := range users {
+			results = append(results, resp.BulkString(name))
+		}
+		return ctx.WriteArray(results)
+	case "WHOAMI":
+		if ctx.Username != "" {
+			return ctx.WriteBulkString(ctx.Username)
+		}
+		return ctx.WriteBulkString("default")
+	case "CAT":
+		return cmdACLCat(ctx)
+	case "SETUSER":
+		return cmdACLSetUser(ctx)
+	case "DELUSER":
+		if ctx.ArgCount() < 2 {
+			return ctx.WriteError(ErrWrongArgCount)
+		}
+		deleted := int64(0)
+		for i := 1; i < ctx.ArgCount(); i++ {
+			username := ctx.ArgString(i)
+			if username == "default" {
+				return ctx.WriteError(errors.New("ERR The 'default' user cannot be removed"))
+			}
+			if err := globalACL.DeleteUser(username); err == nil {
+				deleted++
+			}
+		}
+		return ctx.WriteInteger(deleted)
+	case "GETUSER":
+		if ctx.ArgCount() != 2 {
+			return ctx.WriteError(ErrWrongArgCount)
+		}
+		user, exists := globalACL.GetUser(ctx.ArgString(1))
+		if !exists {
+			return ctx.WriteNull()
+		}
+		return ctx.WriteValue(aclUserInfo(user))
+	case "DRYRUN":
+		return cmdACLDryRun(ctx)
+	case "LOG":
+		return cmdACLLog(ctx)
+	case "LOAD":
+		path := aclFilePath()
+		if path == "" {
+			return ctx.WriteError(errors.New("ERR This instance is not configured to use an ACL file. You may want to specify users via the ACL SETUSER command and then issue a CONFIG REWRITE (assuming you have a configuration file set) in order to store users in the configuration."))
+		}
+		if err := globalACL.LoadFile(path); err != nil {
+			return ctx.WriteError(err)
+		}
+		return ctx.WriteOK()
+	case "SAVE":
+		path := aclFilePath()
+		if path == "" {
+			return ctx.WriteError(errors.New("ERR This instance is not configured to use an ACL file. You may want to specify users via the ACL SETUSER command and then issue a CONFIG REWRITE (assuming you have a configuration file set) in order to store users in the configuration."))
+		}
+		if err := globalACL.SaveFile(path); err != nil {
+			return ctx.WriteError(err)
+		}
+		return ctx.WriteOK()
+	case "GENPASS":
+		bits := 256
+		if ctx.ArgCount() > 1 {
+			var err error
+			bits, err = strconv.Atoi(ctx.ArgString(1))
+			if err != nil {
+				return ctx.WriteError(ErrNotInteger)
+			}
+		}
+		return ctx.WriteBulkString(generatePassword(bits))
+	case "HELP":
+		return ctx.WriteArray([]*resp.Value{
+			resp.BulkString("CAT [<category>]"),
+			resp.BulkString("DELUSER <username> [<username> ...]"),
+			resp.BulkString("DRYRUN <username> <command> [<arg> ...]"),
+			resp.BulkString("GETUSER <username>"),
+			resp.BulkString("GENPASS [<bits>]"),
+			resp.BulkString("LIST"),
+			resp.BulkString("LOAD"),
+			resp.BulkString("LOG [<count> | RESET]"),
+			resp.BulkString("SAVE"),
+			resp.BulkString("SETUSER <username> <attribute> [<attribute> ...]"),
+			resp.BulkString("USERS"),
+			resp.BulkString("WHOAMI"),
+		})
+	default:
+		return ctx.WriteError(errors.New("ERR unknown subcommand '" + subCmd + "'"))
+	}
+}
+
+// cmdACLSetUser applies the rules to a copy of the user and stores it only
+// if every rule is valid.
+func cmdACLSetUser(ctx *Context) error {
+	if ctx.ArgCount() < 2 {
+		return ctx.WriteError(ErrWrongArgCount)
+	}
+	username := ctx.ArgString(1)
+	var user *acl.User
+	if existing, ok := globalACL.GetUser(username); ok {
+		user = existing.Clone()
+	} else {
+		user = acl.NewUser(username)
+	}
+
+	rules := make([]string, 0, ctx.ArgCount()-2)
+	for i := 2; i < ctx.ArgCount(); i++ {
+		rules = append(rules, ctx.ArgString(i))
+	}
+	if err := acl.ApplyRules(user, rules); err != nil {
+		return ctx.WriteError(err)
+	}
+	globalACL.SetUser(user)
+	return ctx.WriteOK()
+}
+
+func cmdACLCat(ctx *Context) error {
+	if ctx.ArgCount() == 1 {
+		results := make([]*resp.Value, len(acl.Categories))
+		for i, category := range acl.Categories {
+			results[i] = resp.BulkString(category)
+		}
+		return ctx.WriteArray(results)
+	}
+	if ctx.ArgCount() != 2 {
+		return ctx.WriteError(ErrWrongArgCount)
+	}
+
+	category := strings.ToLower(ctx.ArgString(1))
+	known := false
+	for _, c := range acl.Categories {
+		known = known || c == category
+	}
+	if !known {
+		return ctx.WriteError(fmt.Errorf("ERR Unknown category '%s'", category))
+	}
+	var names []string
+	for cmd, categories := range commandCategories {
+		for _, c := range categories {
+			if c == category {
+				names = append(names, strings.ToLower(cmd))
+				break
+			}
+		}
+	}
+	sort.Strings(names)
+	results := make([]*resp.Value, len(names))
+	for i, name := range names {
+		results[i] = resp.BulkString(name)
+	}
+	return ctx.WriteArray(results)
+}
+
+func aclUserInfo(user *acl.User) *resp.Value {
+	flags := []*resp.Value{}
+	if user.IsEnabled() {
+		flags = append(flags, resp.BulkString("on"))
+	} else {
+		flags = append(flags, resp.BulkString("off"))
+	}
+	if user.IsNoPassword() {
+		flags = append(flags, resp.BulkString("nopass"))
+	}
+
+	hashes := user.PasswordHashes()
+	passwords := make([]*resp.Value, len(hashes))
+	for i, hash := range hashes {
+		passwords[i] = resp.BulkString(hash)
+	}
+
+	return resp.MapPairs(
+		resp.BulkString("flags"), resp.ArrayValue(flags),
+		resp.BulkString("passwords"), resp.ArrayValue(passwords),
+		resp.BulkString("commands"), resp.BulkString(user.CommandRules()),
+		resp.BulkString("keys"), resp.BulkString(user.KeyRules()),
+		resp.BulkString("channels"), resp.BulkString(user.ChannelRules()),
+		resp.BulkString("selectors"), resp.ArrayValue([]*resp.Value{}),
+	)
+}
+
+// cmdACLDryRun implements ACL DRYRUN username command [arg ...], which
+// reports whether the user could run the command without running it.
+func cmdACLDryRun(ctx *Context) error {
+	if ctx.ArgCount() < 3 {
+		return ctx.WriteError(ErrWrongArgCount)
+	}
+	username := ctx.ArgString(1)
+	user, exists := globalACL.GetUser(username)
+	if !exists {
+		return ctx.WriteError(fmt.Errorf("ERR User '%s' not found", username))
+	}
+	cmd := strings.ToUpper(ctx.ArgString(2))
+	if globalRouter != nil {
+		if _, ok := globalRouter.Get(cmd); !ok {
+			return ctx.WriteError(fmt.Errorf("ERR Command '%s' not found", strings.ToLower(cmd)))
+		}
+	}
+
+	reason, object := aclDenial(user, cmd, ctx.Args[3:])
+	switch reason {
+	case "":
+		return ctx.WriteOK()
+	case acl.ReasonKey:
+		return ctx.WriteBulkString("User " + username + " has no permissions to access the '" + object + "' key")
+	case acl.ReasonChannel:
+		return ctx.WriteBulkString("User " + username + " has no permissions to access the '" + object + "' channel")
+	default:
+		return ctx.WriteBulkString("User " + username + " has no permissions to run the '" + object + "' command")
+	}
+}
+
+func cmdACLLog(ctx *Context) error {
+	count := 10
+	if ctx.ArgCount() > 2 {
+		return ctx.WriteError(ErrWrongArgCount)
+	}
+	if ctx.ArgCount() == 2 {
+		if strings.EqualFold(ctx.ArgString(1), "RESET") {
+			globalACL.ResetLog()
+			return ctx.WriteOK()
+		}
+		n, err := strconv.Atoi(ctx.ArgString(1))
+		if err != nil || n < 0 {
+			return ctx.WriteError(errors.New("ERR value is out of range, must be positive"))
+		}
+		count = n
+	}
+
+	now := time.Now()
+	entries := globalACL.Log(count)
+	results := make([]*resp.Value, len(entries))
+	for i, e := range entries {
+		results[i] = resp.MapPairs(
+			resp.BulkString("count"), resp.IntegerValue(e.Count),
+			resp.BulkString("reason"), resp.BulkString(e.Reason),
+			resp.BulkString("context"), resp.BulkString(e.Context),
+			resp.BulkString("object"), resp.BulkString(e.Object),
+			resp.BulkString("username"), resp.BulkString(e.Username),
+			resp.BulkString("age-seconds"), ctx.DoubleValue(float64(now.Sub(e.CreatedAt).Milliseconds())/1000),
+			resp.BulkString("client-info"), resp.BulkString(e.ClientInfo),
+			resp.BulkString("entry-id"), resp.IntegerValue(e.ID),
+			resp.BulkString("timestamp-created"), resp.IntegerValue(e.CreatedAt.UnixMilli()),
+			resp.BulkString("timestamp-last-updated"), resp.IntegerValue(e.LastUpdated.UnixMilli()),
+		)
+	}
+	return ctx.WriteArray(results)
+}
+
+func aclFilePath() string {
+	if globalRouter == nil {
+		return ""
+	}
+	return globalRouter.ACLFile()
+}
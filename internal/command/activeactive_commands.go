@@ -0,0 +1,89 @@
+package command
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/cachestorm/cachestorm/internal/activeactive"
+	"github.com/cachestorm/cachestorm/internal/crdt"
+)
+
+// aaEngine serves the links of active-active peers; it is nil unless the
+// server runs active-active.
+var aaEngine struct {
+	mu sync.RWMutex
+	e  *activeactive.Engine
+}
+
+// EnableActiveActive serves ACTIVEACTIVE from e and adds its section to
+// INFO.
+func EnableActiveActive(e *activeactive.Engine) {
+	aaEngine.mu.Lock()
+	defer aaEngine.mu.Unlock()
+	aaEngine.e = e
+}
+
+func activeActiveEngine() *activeactive.Engine {
+	aaEngine.mu.RLock()
+	defer aaEngine.mu.RUnlock()
+	return aaEngine.e
+}
+
+// cmdACTIVEACTIVE is what a peer's link sends:
+//
+//	ACTIVEACTIVE HELLO <node>        replies with this node's node_id
+//	ACTIVEACTIVE SYNC <node> <since> turns the connection into the stream
+//	                                 of this node's operations after since
+//	ACTIVEACTIVE ACK <ts>            has no reply
+func cmdACTIVEACTIVE(ctx *Context) error {
+	e := activeActiveEngine()
+	if e == nil {
+		return ctx.WriteError(fmt.Errorf("ERR active-active replication is not enabled"))
+	}
+	switch sub := strings.ToUpper(ctx.ArgString(0)); sub {
+	case "HELLO":
+		return ctx.WriteBulkString(e.NodeID())
+
+	case "SYNC":
+		if ctx.ArgCount() != 3 {
+			return ctx.WriteError(ErrWrongArgCount)
+		}
+		if ctx.Session == nil {
+			return ctx.WriteError(fmt.Errorf("ERR SYNC needs a connection"))
+		}
+		if ctx.Session.Peer() != nil {
+			return ctx.WriteError(fmt.Errorf("ERR the connection already serves a peer"))
+		}
+		since, err := crdt.ParseTimestamp(ctx.ArgString(2))
+		if err != nil {
+			return ctx.WriteError(fmt.Errorf("ERR invalid timestamp '%s'", ctx.ArgString(2)))
+		}
+		stream, err := e.Subscribe(ctx.ArgString(1), since)
+		if err != nil {
+			return ctx.WriteError(err)
+		}
+		if err := ctx.WriteOK(); err != nil {
+			stream.Close()
+			return err
+		}
+		ctx.Session.setPeer(stream)
+		return nil
+
+	case "ACK":
+		if ctx.ArgCount() != 2 {
+			return ctx.WriteError(ErrWrongArgCount)
+		}
+		if ctx.Session != nil {
+			if p := ctx.Session.Peer(); p != nil {
+				if ts, err := crdt.ParseTimestamp(ctx.ArgString(1)); err == nil {
+					p.Ack(ts)
+				}
+			}
+		}
+		return nil
+
+	default:
+		return ctx.WriteError(fmt.Errorf("ERR unknown subcommand '%s'", sub))
+	}
+}
@@ -0,0 +1,182 @@
+package command
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/cachestorm/cachestorm/internal/persistence"
+	"github.com/cachestorm/cachestorm/internal/resp"
+)
+
+// backups backs the BACKUP.* commands; it is nil when persistence is off.
+var backups struct {
+	mu sync.RWMutex
+	bm *persistence.BackupManager
+}
+
+// EnableBackups routes the BACKUP.* commands to bm.
+func EnableBackups(bm *persistence.BackupManager) {
+	backups.mu.Lock()
+	backups.bm = bm
+	backups.mu.Unlock()
+}
+
+func backupManager() *persistence.BackupManager {
+	backups.mu.RLock()
+	defer backups.mu.RUnlock()
+	return backups.bm
+}
+
+var errBackupsDisabled = errors.New("ERR backups are not enabled, set persistence.enabled")
+
+// cmdBACKUPCREATE implements BACKUP.CREATE [name] [FULL | INCREMENTAL] and
+// replies with the name of the backup, which defaults to the current time.
+func cmdBACKUPCREATE(ctx *Context) error {
+	bm := backupManager()
+	if bm == nil {
+		return ctx.WriteError(errBackupsDisabled)
+	}
+
+	args := ctx.Args
+	incremental := false
+	if n := len(args); n > 0 {
+		switch strings.ToUpper(string(args[n-1])) {
+		case "FULL":
+			args = args[:n-1]
+		case "INCREMENTAL":
+			incremental = true
+			args = args[:n-1]
+		}
+	}
+	if len(args) > 1 {
+		return ctx.WriteError(ErrSyntaxError)
+	}
+	name := ""
+	if len(args) == 1 {
+		name = string(args[0])
+	}
+
+	m, err := bm.Create(name, incremental)
+	if err != nil {
+		return ctx.WriteError(fmt.Errorf("ERR %v", err))
+	}
+	return ctx.WriteBulkString(m.Name)
+}
+
+// cmdBACKUPLIST implements BACKUP.LIST [pattern], listing the backups from
+// oldest to newest with their manifests.
+func cmdBACKUPLIST(ctx *Context) error {
+	bm := backupManager()
+	if bm == nil {
+		return ctx.WriteError(errBackupsDisabled)
+	}
+	if ctx.ArgCount() > 1 {
+		return ctx.WriteError(ErrSyntaxError)
+	}
+
+	list, err := bm.List()
+	if err != nil {
+		return ctx.WriteError(fmt.Errorf("ERR %v", err))
+	}
+	results := make([]*resp.Value, 0, len(list))
+	for _, m := range list {
+		if ctx.ArgCount() == 1 && !matchPattern(m.Name, ctx.ArgString(0)) {
+			continue
+		}
+		results = append(results, backupReply(m))
+	}
+	return ctx.WriteArray(results)
+}
+
+func backupReply(m *persistence.BackupManifest) *resp.Value {
+	return resp.ArrayValue([]*resp.Value{
+		resp.BulkString("name"), resp.BulkString(m.Name),
+		resp.BulkString("type"), resp.BulkString(m.Type),
+		resp.BulkString("parent"), resp.BulkString(m.Parent),
+		resp.BulkString("created_at"), resp.IntegerValue(m.CreatedAt.UnixMilli()),
+		resp.BulkString("keys"), resp.IntegerValue(m.Keys),
+		resp.BulkString("changed_keys"), resp.IntegerValue(m.ChangedKeys),
+		resp.BulkString("deleted_keys"), resp.IntegerValue(m.DeletedKeys),
+		resp.BulkString("size"), resp.IntegerValue(m.Size),
+		resp.BulkString("checksum"), resp.BulkString(m.Checksum),
+	})
+}
+
+// cmdBACKUPRESTORE implements BACKUP.RESTORE name [REPLACE | MERGE] and
+// replies with the number of keys restored. REPLACE, the default, makes
+// the dataset the backup's; MERGE keeps the keys the backup lacks. The
+// restored data does not go through the write commands, so the AOF is
+// rewritten before replying and replicas resync. It is refused on a
+// replica and while active-active peers are attached.
+func cmdBACKUPRESTORE(ctx *Context) error {
+	if ctx.ArgCount() < 1 || ctx.ArgCount() > 2 {
+		return ctx.WriteError(ErrWrongArgCount)
+	}
+	bm := backupManager()
+	if bm == nil {
+		return ctx.WriteError(errBackupsDisabled)
+	}
+	merge := false
+	if ctx.ArgCount() == 2 {
+		switch strings.ToUpper(ctx.ArgString(1)) {
+		case "REPLACE":
+		case "MERGE":
+			merge = true
+		default:
+			return ctx.WriteError(ErrSyntaxError)
+		}
+	}
+	if err := CheckDatasetReplace(); err != nil {
+		return ctx.WriteError(err)
+	}
+
+	restored, err := bm.Restore(ctx.ArgString(0), merge)
+	if err != nil {
+		return ctx.WriteError(fmt.Errorf("ERR %v", err))
+	}
+	datasetReplaced()
+	if m := aofManager(); m != nil {
+		if err := m.Rewrite(); err != nil {
+			return ctx.WriteError(fmt.Errorf("ERR backup restored, but rewriting the AOF failed: %v", err))
+		}
+	}
+	return ctx.WriteInteger(restored)
+}
+
+// cmdBACKUPDELETE implements BACKUP.DELETE name, replying 1 when the backup
+// existed and 0 otherwise.
+func cmdBACKUPDELETE(ctx *Context) error {
+	if ctx.ArgCount() != 1 {
+		return ctx.WriteError(ErrWrongArgCount)
+	}
+	bm := backupManager()
+	if bm == nil {
+		return ctx.WriteError(errBackupsDisabled)
+	}
+	deleted, err := bm.Delete(ctx.ArgString(0))
+	if err != nil {
+		return ctx.WriteError(fmt.Errorf("ERR %v", err))
+	}
+	if deleted {
+		return ctx.WriteInteger(1)
+	}
+	return ctx.WriteInteger(0)
+}
+
+// cmdBACKUPVERIFY implements BACKUP.VERIFY name: the backup and those it
+// is taken on top of must match their checksums and decode.
+func cmdBACKUPVERIFY(ctx *Context) error {
+	if ctx.ArgCount() != 1 {
+		return ctx.WriteError(ErrWrongArgCount)
+	}
+	bm := backupManager()
+	if bm == nil {
+		return ctx.WriteError(errBackupsDisabled)
+	}
+	if err := bm.Verify(ctx.ArgString(0)); err != nil {
+		return ctx.WriteError(fmt.Errorf("ERR %v", err))
+	}
+	return ctx.WriteOK()
+}
@@ -0,0 +1,711 @@
+package command
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Command metadata. Every built-in command has an entry in commandTable
+// giving its arity, flags and key positions in the form COMMAND INFO reports
+// them. Register copies the entry into the CommandDef unless the caller set
+// its own values; the router then uses it to reject calls with the wrong
+// number of arguments, refuse denyoom commands over maxmemory and writes on
+// read-only replicas, pick the commands that go to the AOF, and find the
+// keys checked by ACLs and remembered by client tracking.
+
+// Command flags.
+const (
+	FlagWrite    = "write"    // may modify the keyspace
+	FlagReadOnly = "readonly" // only reads the keyspace
+	FlagDenyOOM  = "denyoom"  // may grow memory use; refused over maxmemory
+	FlagAdmin    = "admin"    // administrative command
+	FlagPubSub   = "pubsub"   // pub/sub related
+	FlagNoScript = "noscript" // not allowed from scripts
+	FlagLoading  = "loading"  // allowed while the dataset is loading
+	FlagStale    = "stale"    // allowed on a replica with stale data
+	FlagFast     = "fast"     // O(1) or O(log N)
+	FlagBlocking = "blocking" // may block the client
+
+	// FlagMayReplicate marks scripts and EXEC, which write through the
+	// commands they run rather than themselves.
+	FlagMayReplicate = "may_replicate"
+	// FlagNoMulti marks commands refused inside MULTI: they pause writes,
+	// which EXEC holds off while it runs.
+	FlagNoMulti = "no_multi"
+
+	// FlagMovableKeys is reported by COMMAND INFO for commands whose keys
+	// cannot be described by first/last/step alone.
+	FlagMovableKeys = "movablekeys"
+)
+
+// commandSpec is a row of the command table. Arity counts the command name
+// and is negative for "at least". Key positions are 1-based counting the
+// command name, a negative last counts from the end and a zero first means
+// the command takes no keys.
+type commandSpec struct {
+	arity             int
+	flags             string
+	first, last, step int
+}
+
+var commandTable = map[string]commandSpec{
+	// Strings
+	"APPEND":      {3, "write denyoom fast", 1, 1, 1},
+	"DECR":        {2, "write denyoom fast", 1, 1, 1},
+	"DECRBY":      {3, "write denyoom fast", 1, 1, 1},
+	"GET":         {2, "readonly fast", 1, 1, 1},
+	"GETDEL":      {2, "write fast", 1, 1, 1},
+	"GETEX":       {-2, "write fast", 1, 1, 1},
+	"GETRANGE":    {4, "readonly", 1, 1, 1},
+	"GETSET":      {3, "write denyoom fast", 1, 1, 1},
+	"INCR":        {2, "write denyoom fast", 1, 1, 1},
+	"INCRBY":      {3, "write denyoom fast", 1, 1, 1},
+	"INCRBYFLOAT": {3, "write denyoom fast", 1, 1, 1},
+	"LCS":         {-3, "readonly", 1, 2, 1},
+	"MGET":        {-2, "readonly fast", 1, -1, 1},
+	"MSET":        {-3, "write denyoom", 1, -1, 2},
+	"MSETNX":      {-3, "write denyoom", 1, -1, 2},
+	"PSETEX":      {4, "write denyoom", 1, 1, 1},
+	"SET":         {-3, "write denyoom", 1, 1, 1},
+	"SETEX":       {4, "write denyoom", 1, 1, 1},
+	"SETNX":       {3, "write denyoom fast", 1, 1, 1},
+	"SETRANGE":    {4, "write denyoom", 1, 1, 1},
+	"STRALGO":     {-2, "readonly", 0, 0, 0},
+	"STRLEN":      {2, "readonly fast", 1, 1, 1},
+	"SUBSTR":      {4, "readonly", 1, 1, 1},
+
+	// Bitmaps
+	"BITCOUNT": {-2, "readonly", 1, 1, 1},
+	"BITFIELD": {-2, "write denyoom", 1, 1, 1},
+	"BITOP":    {-4, "write denyoom", 2, -1, 1},
+	"BITPOS":   {-3, "readonly", 1, 1, 1},
+	"GETBIT":   {3, "readonly fast", 1, 1, 1},
+	"SETBIT":   {4, "write denyoom", 1, 1, 1},
+
+	// Hashes
+	"HDEL":         {-3, "write fast", 1, 1, 1},
+	"HEXISTS":      {3, "readonly fast", 1, 1, 1},
+	"HGET":         {3, "readonly fast", 1, 1, 1},
+	"HGETALL":      {2, "readonly", 1, 1, 1},
+	"HGETDEL":      {-3, "write fast", 1, 1, 1},
+	"HGETEX":       {-3, "write fast", 1, 1, 1},
+	"HINCRBY":      {4, "write denyoom fast", 1, 1, 1},
+	"HINCRBYFLOAT": {4, "write denyoom fast", 1, 1, 1},
+	"HKEYS":        {2, "readonly", 1, 1, 1},
+	"HLEN":         {2, "readonly fast", 1, 1, 1},
+	"HMGET":        {-3, "readonly fast", 1, 1, 1},
+	"HMSET":        {-4, "write denyoom fast", 1, 1, 1},
+	"HRANDFIELD":   {-2, "readonly", 1, 1, 1},
+	"HSCAN":        {-3, "readonly", 1, 1, 1},
+	"HSET":         {-4, "write denyoom fast", 1, 1, 1},
+	"HSETNX":       {4, "write denyoom fast", 1, 1, 1},
+	"HSTRLEN":      {3, "readonly fast", 1, 1, 1},
+	"HVALS":        {2, "readonly", 1, 1, 1},
+
+	// Lists
+	"BLMOVE":     {6, "write denyoom noscript blocking", 1, 2, 1},
+	"BLMPOP":     {-5, "write blocking", 0, 0, 0},
+	"BLPOP":      {-3, "write noscript blocking", 1, -2, 1},
+	"BRPOP":      {-3, "write noscript blocking", 1, -2, 1},
+	"BRPOPLPUSH": {4, "write denyoom noscript blocking", 1, 2, 1},
+	"LINDEX":     {3, "readonly", 1, 1, 1},
+	"LINSERT":    {5, "write denyoom", 1, 1, 1},
+	"LLEN":       {2, "readonly fast", 1, 1, 1},
+	"LMOVE":      {5, "write denyoom", 1, 2, 1},
+	"LMPOP":      {-4, "write", 0, 0, 0},
+	"LMPUSH":     {-3, "write denyoom", 1, 1, 1},
+	"LPOP":       {-2, "write fast", 1, 1, 1},
+	"LPOS":       {-3, "readonly", 1, 1, 1},
+	"LPUSH":      {-3, "write denyoom fast", 1, 1, 1},
+	"LPUSHX":     {-3, "write denyoom fast", 1, 1, 1},
+	"LRANGE":     {4, "readonly", 1, 1, 1},
+	"LREM":       {4, "write", 1, 1, 1},
+	"LSET":       {4, "write denyoom", 1, 1, 1},
+	"LTRIM":      {4, "write", 1, 1, 1},
+	"RPOP":       {-2, "write fast", 1, 1, 1},
+	"RPOPLPUSH":  {3, "write denyoom", 1, 2, 1},
+	"RPUSH":      {-3, "write denyoom fast", 1, 1, 1},
+	"RPUSHX":     {-3, "write denyoom fast", 1, 1, 1},
+
+	// Sets
+	"SADD":        {-3, "write denyoom fast", 1, 1, 1},
+	"SCARD":       {2, "readonly fast", 1, 1, 1},
+	"SDIFF":       {-2, "readonly", 1, -1, 1},
+	"SDIFFSTORE":  {-3, "write denyoom", 1, -1, 1},
+	"SINTER":      {-2, "readonly", 1, -1, 1},
+	"SINTERCARD":  {-3, "readonly", 0, 0, 0},
+	"SINTERSTORE": {-3, "write denyoom", 1, -1, 1},
+	"SISMEMBER":   {3, "readonly fast", 1, 1, 1},
+	"SMEMBERS":    {2, "readonly", 1, 1, 1},
+	"SMISMEMBER":  {-3, "readonly fast", 1, 1, 1},
+	"SMOVE":       {4, "write fast", 1, 2, 1},
+	"SPOP":        {-2, "write fast", 1, 1, 1},
+	"SRANDMEMBER": {-2, "readonly", 1, 1, 1},
+	"SREM":        {-3, "write fast", 1, 1, 1},
+	"SSCAN":       {-3, "readonly", 1, 1, 1},
+	"SUNION":      {-2, "readonly", 1, -1, 1},
+	"SUNIONSTORE": {-3, "write denyoom", 1, -1, 1},
+
+	// Sorted sets
+	"BZMPOP":           {-5, "write blocking", 0, 0, 0},
+	"BZPOPMAX":         {-3, "write noscript blocking fast", 1, -2, 1},
+	"BZPOPMIN":         {-3, "write noscript blocking fast", 1, -2, 1},
+	"ZADD":             {-4, "write denyoom fast", 1, 1, 1},
+	"ZCARD":            {2, "readonly fast", 1, 1, 1},
+	"ZCOUNT":           {4, "readonly fast", 1, 1, 1},
+	"ZDIFF":            {-3, "readonly", 0, 0, 0},
+	"ZDIFFSTORE":       {-4, "write denyoom", 1, 1, 1},
+	"ZINCRBY":          {4, "write denyoom fast", 1, 1, 1},
+	"ZINTER":           {-3, "readonly", 0, 0, 0},
+	"ZINTERCARD":       {-3, "readonly", 0, 0, 0},
+	"ZINTERSTORE":      {-4, "write denyoom", 1, 1, 1},
+	"ZLEXCOUNT":        {4, "readonly fast", 1, 1, 1},
+	"ZMPOP":            {-4, "write", 0, 0, 0},
+	"ZMSCORE":          {-3, "readonly fast", 1, 1, 1},
+	"ZPOPMAX":          {-2, "write fast", 1, 1, 1},
+	"ZPOPMIN":          {-2, "write fast", 1, 1, 1},
+	"ZRANDMEMBER":      {-2, "readonly", 1, 1, 1},
+	"ZRANGE":           {-4, "readonly", 1, 1, 1},
+	"ZRANGEBYLEX":      {-4, "readonly", 1, 1, 1},
+	"ZRANGEBYSCORE":    {-4, "readonly", 1, 1, 1},
+	"ZRANGESTORE":      {-5, "write denyoom", 1, 2, 1},
+	"ZRANK":            {-3, "readonly fast", 1, 1, 1},
+	"ZREM":             {-3, "write fast", 1, 1, 1},
+	"ZREMRANGEBYLEX":   {4, "write", 1, 1, 1},
+	"ZREMRANGEBYRANK":  {4, "write", 1, 1, 1},
+	"ZREMRANGEBYSCORE": {4, "write", 1, 1, 1},
+	"ZREVRANGE":        {-4, "readonly", 1, 1, 1},
+	"ZREVRANGEBYLEX":   {-4, "readonly", 1, 1, 1},
+	"ZREVRANGEBYSCORE": {-4, "readonly", 1, 1, 1},
+	"ZREVRANK":         {-3, "readonly fast", 1, 1, 1},
+	"ZSCAN":            {-3, "readonly", 1, 1, 1},
+	"ZSCORE":           {3, "readonly fast", 1, 1, 1},
+	"ZUNION":           {-3, "readonly", 0, 0, 0},
+	"ZUNIONSTORE":      {-4, "write denyoom", 1, 1, 1},
+
+	// Streams
+	"XACK":       {-4, "write fast", 1, 1, 1},
+	"XADD":       {-5, "write denyoom fast", 1, 1, 1},
+	"XAUTOCLAIM": {-6, "write fast", 1, 1, 1},
+	"XCLAIM":     {-6, "write fast", 1, 1, 1},
+	"XDEL":       {-3, "write fast", 1, 1, 1},
+	"XGROUP":     {-2, "write denyoom", 2, 2, 1},
+	"XINFO":      {-2, "readonly", 2, 2, 1},
+	"XLEN":       {2, "readonly fast", 1, 1, 1},
+	"XPENDING":   {-3, "readonly", 1, 1, 1},
+	"XRANGE":     {-4, "readonly", 1, 1, 1},
+	"XREAD":      {-4, "readonly blocking", 0, 0, 0},
+	"XREADGROUP": {-7, "write blocking", 0, 0, 0},
+	"XREVRANGE":  {-4, "readonly", 1, 1, 1},
+	"XSETID":     {-3, "write denyoom fast", 1, 1, 1},
+	"XTRIM":      {-4, "write", 1, 1, 1},
+
+	// Geo
+	"GEOADD":            {-5, "write denyoom", 1, 1, 1},
+	"GEODIST":           {-4, "readonly", 1, 1, 1},
+	"GEOHASH":           {-2, "readonly", 1, 1, 1},
+	"GEOPOS":            {-2, "readonly", 1, 1, 1},
+	"GEORADIUS":         {-6, "write denyoom", 1, 1, 1},
+	"GEORADIUSBYMEMBER": {-5, "write denyoom", 1, 1, 1},
+	"GEOSEARCH":         {-7, "readonly", 1, 1, 1},
+	"GEOSEARCHSTORE":    {-8, "write denyoom", 1, 2, 1},
+
+	// HyperLogLog
+	"PFADD":   {-2, "write denyoom fast", 1, 1, 1},
+	"PFCOUNT": {-2, "readonly", 1, -1, 1},
+	"PFMERGE": {-2, "write denyoom", 1, -1, 1},
+
+	// Keyspace
+	"COPY":        {-3, "write denyoom", 1, 2, 1},
+	"DEL":         {-2, "write", 1, -1, 1},
+	"DUMP":        {2, "readonly", 1, 1, 1},
+	"EXISTS":      {-2, "readonly fast", 1, -1, 1},
+	"EXPIRE":      {-3, "write fast", 1, 1, 1},
+	"EXPIREAT":    {-3, "write fast", 1, 1, 1},
+	"EXPIRETIME":  {2, "readonly fast", 1, 1, 1},
+	"KEYS":        {2, "readonly", 0, 0, 0},
+	"MIGRATE":     {-6, "write", 0, 0, 0},
+	"MOVE":        {3, "write fast", 1, 1, 1},
+	"OBJECT":      {-2, "readonly", 2, 2, 1},
+	"PERSIST":     {2, "write fast", 1, 1, 1},
+	"PEXPIRE":     {-3, "write fast", 1, 1, 1},
+	"PEXPIREAT":   {-3, "write fast", 1, 1, 1},
+	"PEXPIRETIME": {2, "readonly fast", 1, 1, 1},
+	"PTTL":        {2, "readonly fast", 1, 1, 1},
+	"RANDOMKEY":   {1, "readonly", 0, 0, 0},
+	"RENAME":      {3, "write", 1, 2, 1},
+	"RENAMENX":    {3, "write fast", 1, 2, 1},
+	"RESTORE":     {-4, "write denyoom", 1, 1, 1},
+	"SCAN":        {-2, "readonly", 0, 0, 0},
+	"SORT":        {-2, "write denyoom", 1, 1, 1},
+	"SORT_RO":     {-2, "readonly", 1, 1, 1},
+	"TOUCH":       {-2, "readonly fast", 1, -1, 1},
+	"TTL":         {2, "readonly fast", 1, 1, 1},
+	"TYPE":        {2, "readonly fast", 1, 1, 1},
+	"UNLINK":      {-2, "write fast", 1, -1, 1},
+
+	// Pub/sub
+	"PSUBSCRIBE":   {-2, "pubsub noscript loading stale", 0, 0, 0},
+	"PUBLISH":      {3, "pubsub loading stale fast", 0, 0, 0},
+	"PUBSUB":       {-2, "pubsub loading stale", 0, 0, 0},
+	"PUNSUBSCRIBE": {-1, "pubsub noscript loading stale", 0, 0, 0},
+	"SPUBLISH":     {3, "pubsub loading stale fast", 0, 0, 0},
+	"SSUBSCRIBE":   {-2, "pubsub noscript loading stale", 0, 0, 0},
+	"SUBSCRIBE":    {-2, "pubsub noscript loading stale", 0, 0, 0},
+	"SUNSUBSCRIBE": {-1, "pubsub noscript loading stale", 0, 0, 0},
+	"UNSUBSCRIBE":  {-1, "pubsub noscript loading stale", 0, 0, 0},
+
+	// Transactions
+	"DISCARD": {1, "noscript loading stale fast", 0, 0, 0},
+	"EXEC":    {1, "noscript loading stale may_replicate", 0, 0, 0},
+	"MULTI":   {1, "noscript loading stale fast", 0, 0, 0},
+	"UNWATCH": {1, "noscript loading stale fast", 0, 0, 0},
+	"WATCH":   {-2, "noscript loading stale fast", 1, -1, 1},
+
+	// Scripting
+	"EVAL":     {-3, "noscript stale may_replicate", 0, 0, 0},
+	"EVALSHA":  {-3, "noscript stale may_replicate", 0, 0, 0},
+	"FCALL":    {-3, "noscript stale may_replicate", 0, 0, 0},
+	"FCALL_RO": {-3, "readonly noscript stale", 0, 0, 0},
+	"FUNCTION": {-2, "noscript", 0, 0, 0},
+	"SCRIPT":   {-2, "noscript", 0, 0, 0},
+
+	// Connection
+	"ASKING":    {1, "fast", 0, 0, 0},
+	"AUTH":      {-2, "noscript loading stale fast", 0, 0, 0},
+	"CLIENT":    {-2, "noscript loading stale", 0, 0, 0},
+	"ECHO":      {2, "fast", 0, 0, 0},
+	"HELLO":     {-1, "noscript loading stale fast", 0, 0, 0},
+	"PING":      {-1, "fast", 0, 0, 0},
+	"QUIT":      {-1, "noscript loading stale fast", 0, 0, 0},
+	"READONLY":  {1, "loading stale fast", 0, 0, 0},
+	"READWRITE": {1, "loading stale fast", 0, 0, 0},
+	"RESET":     {1, "noscript loading stale fast", 0, 0, 0},
+	"SELECT":    {2, "loading stale fast", 0, 0, 0},
+
+	// Server
+	"ACL":          {-2, "admin noscript loading stale", 0, 0, 0},
+	"ACTIVEACTIVE": {-2, "admin noscript stale", 0, 0, 0},
+	"BGREWRITEAOF": {1, "admin noscript", 0, 0, 0},
+	"BGSAVE":       {-1, "admin noscript", 0, 0, 0},
+	"CLUSTER":      {-2, "admin stale", 0, 0, 0},
+	"COMMAND":      {-1, "loading stale", 0, 0, 0},
+	"CONFIG":       {-2, "admin noscript loading stale", 0, 0, 0},
+	"DBSIZE":       {1, "readonly fast", 0, 0, 0},
+	"DEBUG":        {-2, "admin noscript loading stale no_multi", 0, 0, 0},
+	"DUMPALL":      {-1, "admin noscript", 0, 0, 0},
+	"FLUSHALL":     {-1, "write", 0, 0, 0},
+	"FLUSHDB":      {-1, "write", 0, 0, 0},
+	"INFO":         {-1, "loading stale", 0, 0, 0},
+	"LASTSAVE":     {1, "loading stale fast", 0, 0, 0},
+	"LATENCY":      {-2, "admin noscript loading stale", 0, 0, 0},
+	"LOLWUT":       {-1, "readonly fast", 0, 0, 0},
+	"MEMORY":       {-2, "readonly", 0, 0, 0},
+	"MODULE":       {-2, "admin noscript", 0, 0, 0},
+	"MONITOR":      {1, "admin noscript loading stale", 0, 0, 0},
+	"PSYNC":        {-3, "admin noscript", 0, 0, 0},
+	"REPLCONF":     {-1, "admin noscript loading stale", 0, 0, 0},
+	"REPLICAOF":    {3, "admin noscript stale", 0, 0, 0},
+	"ROLE":         {1, "noscript loading stale fast", 0, 0, 0},
+	"SAVE":         {1, "admin noscript no_multi", 0, 0, 0},
+	"SHUTDOWN":     {-1, "admin noscript loading stale no_multi", 0, 0, 0},
+	"SLAVEOF":      {3, "admin noscript stale", 0, 0, 0},
+	"SLOWLOG":      {-2, "admin loading stale", 0, 0, 0},
+	"SWAPDB":       {3, "write fast", 0, 0, 0},
+	"SYNC":         {1, "admin noscript", 0, 0, 0},
+	"TIME":         {1, "loading stale fast", 0, 0, 0},
+	"WAIT":         {3, "noscript", 0, 0, 0},
+	"WAITAOF":      {4, "noscript", 0, 0, 0},
+
+	// Backups. The data they restore reaches the AOF through a rewrite.
+	"BACKUP.CREATE":   {-1, "admin noscript no_multi", 0, 0, 0},
+	"BACKUP.DELETE":   {2, "admin noscript", 0, 0, 0},
+	"BACKUP.LIST":     {-1, "admin noscript loading stale", 0, 0, 0},
+	"BACKUP.RESTORE":  {-2, "admin noscript no_multi", 0, 0, 0},
+	"BACKUP.VERIFY":   {2, "admin noscript", 0, 0, 0},
+	"BACKUPX.CREATE":  {-1, "admin noscript", 0, 0, 0},
+	"BACKUPX.DELETE":  {2, "admin noscript", 0, 0, 0},
+	"BACKUPX.LIST":    {-1, "admin noscript loading stale", 0, 0, 0},
+	"BACKUPX.RESTORE": {-2, "admin noscript", 0, 0, 0},
+
+	// Tags and namespaces
+	"ADDTAG":        {-3, "write", 1, 1, 1},
+	"INVALIDATE":    {-2, "write", 0, 0, 0},
+	"NAMESPACE":     {2, "loading stale fast", 0, 0, 0},
+	"NAMESPACEDEL":  {2, "write", 0, 0, 0},
+	"NAMESPACEINFO": {2, "readonly", 0, 0, 0},
+	"NAMESPACES":    {1, "readonly", 0, 0, 0},
+	"REMTAG":        {-3, "write", 1, 1, 1},
+	"SETTAG":        {-4, "write denyoom", 1, 1, 1},
+	"TAGCHILDREN":   {2, "readonly", 0, 0, 0},
+	"TAGCOUNT":      {2, "readonly", 0, 0, 0},
+	"TAGKEYS":       {2, "readonly", 0, 0, 0},
+	"TAGLINK":       {3, "write", 0, 0, 0},
+	"TAGS":          {2, "readonly", 1, 1, 1},
+	"TAGUNLINK":     {3, "write", 0, 0, 0},
+
+	// JSON
+	"JSON.ARRAPPEND": {-4, "write denyoom", 1, 1, 1},
+	"JSON.ARRLEN":    {-2, "readonly", 1, 1, 1},
+	"JSON.DEL":       {-2, "write", 1, 1, 1},
+	"JSON.GET":       {-2, "readonly", 1, 1, 1},
+	"JSON.MGET":      {-3, "readonly", 1, -2, 1},
+	"JSON.MSET":      {-4, "write denyoom", 1, -1, 3},
+	"JSON.NUMINCRBY": {4, "write denyoom", 1, 1, 1},
+	"JSON.NUMMULTBY": {4, "write denyoom", 1, 1, 1},
+	"JSON.OBJKEYS":   {-2, "readonly", 1, 1, 1},
+	"JSON.OBJLEN":    {-2, "readonly", 1, 1, 1},
+	"JSON.SET":       {-4, "write denyoom", 1, 1, 1},
+	"JSON.STRAPPEND": {-4, "write denyoom", 1, 1, 1},
+	"JSON.STRLEN":    {-2, "readonly", 1, 1, 1},
+	"JSON.TYPE":      {-2, "readonly", 1, 1, 1},
+
+	// Bloom and cuckoo filters, count-min sketches, top-k and t-digest
+	"BF.ADD":           {-3, "write denyoom fast", 1, 1, 1},
+	"BF.EXISTS":        {-3, "readonly fast", 1, 1, 1},
+	"BF.INFO":          {-2, "readonly fast", 1, 1, 1},
+	"BF.MADD":          {-3, "write denyoom fast", 1, 1, 1},
+	"BF.MEXISTS":       {-3, "readonly fast", 1, 1, 1},
+	"BF.RESERVE":       {-3, "write denyoom fast", 1, 1, 1},
+	"CF.ADD":           {-3, "write denyoom fast", 1, 1, 1},
+	"CF.DEL":           {-3, "write fast", 1, 1, 1},
+	"CF.EXISTS":        {-3, "readonly fast", 1, 1, 1},
+	"CF.INFO":          {-2, "readonly fast", 1, 1, 1},
+	"CF.RESERVE":       {-3, "write denyoom fast", 1, 1, 1},
+	"CMS.INCRBY":       {-4, "write denyoom", 1, 1, 1},
+	"CMS.INFO":         {-2, "readonly fast", 1, 1, 1},
+	"CMS.INIT":         {-4, "write denyoom fast", 1, 1, 1},
+	"CMS.QUERY":        {-3, "readonly", 1, 1, 1},
+	"TDIGEST.ADD":      {-3, "write denyoom", 1, 1, 1},
+	"TDIGEST.CDF":      {-3, "readonly", 1, 1, 1},
+	"TDIGEST.CREATE":   {-2, "write denyoom fast", 1, 1, 1},
+	"TDIGEST.INFO":     {-2, "readonly", 1, 1, 1},
+	"TDIGEST.MAX":      {-2, "readonly", 1, 1, 1},
+	"TDIGEST.MEAN":     {-2, "readonly", 1, 1, 1},
+	"TDIGEST.MERGE":    {-3, "write denyoom", 1, -1, 1},
+	"TDIGEST.MIN":      {-2, "readonly", 1, 1, 1},
+	"TDIGEST.QUANTILE": {-3, "readonly", 1, 1, 1},
+	"TDIGEST.RESET":    {-2, "write", 1, 1, 1},
+	"TOPK.ADD":         {-3, "write denyoom", 1, 1, 1},
+	"TOPK.INFO":        {-2, "readonly fast", 1, 1, 1},
+	"TOPK.LIST":        {-2, "readonly", 1, 1, 1},
+	"TOPK.QUERY":       {-3, "readonly", 1, 1, 1},
+	"TOPK.RESERVE":     {-3, "write denyoom fast", 1, 1, 1},
+
+	// Time series. TS.MADD takes key timestamp value triples.
+	"TS.ADD":        {-4, "write denyoom", 1, 1, 1},
+	"TS.ALTER":      {-2, "write", 1, 1, 1},
+	"TS.CREATE":     {-2, "write denyoom", 1, 1, 1},
+	"TS.DECRBY":     {-3, "write denyoom", 1, 1, 1},
+	"TS.DEL":        {-4, "write", 1, 1, 1},
+	"TS.GET":        {-2, "readonly fast", 1, 1, 1},
+	"TS.INCRBY":     {-3, "write denyoom", 1, 1, 1},
+	"TS.INFO":       {-2, "readonly", 1, 1, 1},
+	"TS.MADD":       {-4, "write denyoom", 1, -1, 3},
+	"TS.QUERYINDEX": {-2, "readonly", 0, 0, 0},
+	"TS.RANGE":      {-4, "readonly", 1, 1, 1},
+	"TS.REVRANGE":   {-4, "readonly", 1, 1, 1},
+
+	// Search. An index name is checked against key patterns like a key;
+	// FT.ALIASADD names the alias and the index.
+	"FT._LIST":     {-1, "readonly", 0, 0, 0},
+	"FT.ADD":       {-4, "write denyoom", 1, 1, 1},
+	"FT.AGGREGATE": {-3, "readonly", 1, 1, 1},
+	"FT.ALIASADD":  {-3, "write", 1, 2, 1},
+	"FT.ALIASDEL":  {-2, "write", 1, 1, 1},
+	"FT.CREATE":    {-2, "write denyoom", 1, 1, 1},
+	"FT.DEL":       {-3, "write", 1, 1, 1},
+	"FT.DROPINDEX": {-2, "write", 1, 1, 1},
+	"FT.GET":       {-3, "readonly", 1, 1, 1},
+	"FT.INFO":      {-2, "readonly", 1, 1, 1},
+	"FT.SEARCH":    {-3, "readonly", 1, 1, 1},
+	"FT.TAGVALS":   {-3, "readonly", 1, 1, 1},
+
+	// Graphs, named like keys
+	"GRAPH.ADDEDGE":   {-5, "write denyoom", 1, 1, 1},
+	"GRAPH.ADDNODE":   {-3, "write denyoom", 1, 1, 1},
+	"GRAPH.CREATE":    {-2, "write denyoom", 1, 1, 1},
+	"GRAPH.DELEDGE":   {-3, "write", 1, 1, 1},
+	"GRAPH.DELETE":    {-2, "write", 1, 1, 1},
+	"GRAPH.DELNODE":   {-3, "write", 1, 1, 1},
+	"GRAPH.GETEDGE":   {-3, "readonly", 1, 1, 1},
+	"GRAPH.GETNODE":   {-3, "readonly", 1, 1, 1},
+	"GRAPH.INFO":      {-2, "readonly", 1, 1, 1},
+	"GRAPH.LIST":      {-1, "readonly", 0, 0, 0},
+	"GRAPH.NEIGHBORS": {-3, "readonly", 1, 1, 1},
+	"GRAPH.QUERY":     {-3, "readonly", 1, 1, 1},
+
+	// Batches of string keys
+	"BATCH.DEL":  {-2, "write", 1, -1, 1},
+	"BATCH.GET":  {-2, "readonly", 1, -1, 1},
+	"BATCH.MDEL": {-2, "write", 1, -1, 1},
+	"BATCH.MGET": {-2, "readonly", 1, -1, 1},
+	"BATCH.MSET": {-3, "write denyoom", 1, -1, 2},
+	"BATCH.SET":  {-3, "write denyoom", 1, -1, 2},
+
+	// Checks that use up what they check, so they change their module's data
+	// despite the read verb.
+	"BACKPRESSURE.CHECK": {-3, "write", 0, 0, 0},
+	"CANARY.CHECK":       {-2, "write", 0, 0, 0},
+	"HEALTHX.CHECK":      {-2, "write", 0, 0, 0},
+	"QUOTAX.CHECK":       {-3, "write", 0, 0, 0},
+	"RATELIMIT.CHECK":    {-3, "write", 0, 0, 0},
+	"SLIDING.CHECK":      {-2, "write", 0, 0, 0},
+	"THROTTLEX.CHECK":    {-2, "write", 0, 0, 0},
+}
+
+// keyFinders locate the keys of commands whose key positions depend on
+// other arguments (COMMAND INFO reports them as movablekeys). They receive
+// the arguments after the command name.
+var keyFinders = map[string]func(args [][]byte) []string{
+	"EVAL": numKeysAt(1), "EVALSHA": numKeysAt(1), "EVAL_RO": numKeysAt(1),
+	"EVALSHA_RO": numKeysAt(1), "FCALL": numKeysAt(1), "FCALL_RO": numKeysAt(1),
+
+	"ZUNION": numKeysAt(0), "ZINTER": numKeysAt(0), "ZDIFF": numKeysAt(0),
+	"ZINTERCARD": numKeysAt(0), "SINTERCARD": numKeysAt(0), "LMPOP": numKeysAt(0),
+	"ZMPOP": numKeysAt(0), "BLMPOP": numKeysAt(1), "BZMPOP": numKeysAt(1),
+
+	"ZUNIONSTORE": destAndNumKeys, "ZINTERSTORE": destAndNumKeys,
+	"ZDIFFSTORE": destAndNumKeys,
+
+	"XREAD": streamsKeys, "XREADGROUP": streamsKeys,
+
+	"SORT": withStoreKey("STORE"), "GEORADIUS": withStoreKey("STORE", "STOREDIST"),
+	"GEORADIUSBYMEMBER": withStoreKey("STORE", "STOREDIST"),
+
+	"MEMORY": secondArgKey, "MIGRATE": migrateKeys,
+}
+
+// applyCommandSpec fills the metadata a registration left unset from the
+// command table. Commands missing from the table accept any arguments.
+func applyCommandSpec(def *CommandDef) {
+	spec, ok := commandTable[def.Name]
+	if !ok {
+		if def.Arity == 0 {
+			def.Arity = -1
+		}
+		if def.Flags == nil {
+			def.Flags = moduleCommandFlags(def.Name)
+		}
+		return
+	}
+	if def.Arity == 0 {
+		def.Arity = spec.arity
+	}
+	if def.Flags == nil {
+		def.Flags = strings.Fields(spec.flags)
+	}
+	if def.FirstKey == 0 {
+		def.FirstKey, def.LastKey, def.KeyStep = spec.first, spec.last, spec.step
+	}
+}
+
+// HasFlag reports whether the command carries the given flag.
+func (def *CommandDef) HasFlag(flag string) bool {
+	for _, f := range def.Flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// checkArity reports whether argc, which counts the command name, fits the
+// command's arity.
+func (def *CommandDef) checkArity(argc int) bool {
+	if def.Arity >= 0 {
+		return argc == def.Arity
+	}
+	return argc >= -def.Arity
+}
+
+// keys returns the keys of a call with the given arguments (after the
+// command name).
+func (def *CommandDef) keys(args [][]byte) []string {
+	if find, ok := keyFinders[def.Name]; ok {
+		if len(args) == 0 {
+			return nil
+		}
+		return find(args)
+	}
+	if def.FirstKey <= 0 || def.KeyStep <= 0 {
+		return nil
+	}
+	last := def.LastKey - 1
+	if def.LastKey < 0 {
+		last = def.LastKey
+	}
+	return keyRange{def.FirstKey - 1, last, def.KeyStep}.keys(args)
+}
+
+// lookupCommand returns a command's metadata from the active router,
+// falling back to the command table when it is not registered there.
+func lookupCommand(name string) (*CommandDef, bool) {
+	if r := globalRouter; r != nil {
+		if def, ok := r.Get(name); ok {
+			return def, true
+		}
+	}
+	if _, ok := commandTable[name]; !ok {
+		return nil, false
+	}
+	def := &CommandDef{Name: name}
+	applyCommandSpec(def)
+	return def, true
+}
+
+// Extended module commands (MODULE.VERB) are mostly not listed in the table.
+// Their modules keep data of their own, so a command is taken to change it,
+// and flagged write so that it reaches the AOF, unless its verb only reads.
+// Commands whose verb reads but that change data anyway have table rows.
+// Modules that only compute replies from their arguments or report on the
+// server get no flags.
+var statelessModules = map[string]bool{
+	"BSON": true, "CBOR": true, "COMPRESS": true, "COMPRESSION": true,
+	"CONNECTION": true, "CRYPTO": true, "CSV": true, "DECOMPRESS": true,
+	"DIFF": true, "DIGEST": true, "EVAL": true, "GEO": true, "HEALTH": true,
+	"MASK": true, "MATH": true, "MEMORY": true, "METRICS": true,
+	"MSGPACK": true, "NET": true, "NLP": true, "PARALLEL": true,
+	"SANITIZE": true, "SENTIMENT": true, "SIMILARITY": true, "SLOWLOG": true,
+	"SNOWFLAKE": true, "STATS": true, "STR": true, "TIMESTAMP": true,
+	"TOML": true, "ULID": true, "URL": true, "UUID": true, "XML": true,
+	"YAML": true,
+}
+
+var moduleReadVerbs = map[string]bool{
+	"AGGREGATE": true, "ALERTS": true, "AUTOCOMPLETE": true,
+	"AVAILABLE": true, "AVG": true, "BULKGET": true, "CANTRIGGER": true,
+	"CDF": true, "CENTROIDS": true, "CHECK": true, "CHILDREN": true,
+	"COMPARE": true, "COUNT": true, "CURRENT": true, "DIMENSIONS": true,
+	"DISCOVER": true, "DISTINCT": true, "DUMP": true, "ENCODE": true,
+	"ENTRIES": true, "EVENTS": true, "EXISTS": true, "EXPORT": true,
+	"FIND": true, "FINDONE": true, "FREQ": true, "GET": true,
+	"GETALL": true, "GETBYCMD": true, "GETBYKEY": true, "GETEDGE": true,
+	"GETNODE": true, "GETRANGE": true, "GETVAR": true, "GETVARIANT": true,
+	"HAS": true, "HEALTHY": true, "HISTORY": true, "IDLETIME": true,
+	"INCLUDES": true, "INDEXOF": true, "INFO": true, "ISENABLED": true,
+	"ISFINAL": true, "ISLOCKED": true, "KEYS": true, "LAST": true,
+	"LASTINDEXOF": true, "LEN": true, "LENGTH": true, "_LIST": true,
+	"LIST": true, "LISTENABLED": true, "LOCKED": true, "MAX": true,
+	"MEAN": true, "MEMBERS": true, "METRICS": true, "MEXISTS": true,
+	"MGET": true, "MIN": true, "NEARBY": true, "NEIGHBORS": true,
+	"NODES": true, "OBJECT": true, "PARENTS": true, "PEEK": true,
+	"PREDICT": true, "PREFIX": true, "PROOF": true, "QUANTILE": true,
+	"QUERY": true, "QUERYINDEX": true, "RANGE": true, "REFCOUNT": true,
+	"RESULT": true, "RESULTS": true, "REVRANGE": true, "ROOMS": true,
+	"ROOT": true, "SEARCH": true, "SIMILAR": true, "SIMILARITY": true,
+	"SIZE": true, "STATS": true, "STATUS": true, "SUBSCRIBERS": true,
+	"SUM": true, "TAGS": true, "TAGVALS": true, "TOP": true, "TOPO": true,
+	"TTL": true, "USAGE": true, "VALUE": true, "VALUES": true,
+	"VERSION": true,
+}
+
+// moduleCommandFlags returns the flags of a command missing from the table.
+func moduleCommandFlags(name string) []string {
+	dot := strings.IndexByte(name, '.')
+	if dot <= 0 || statelessModules[name[:dot]] {
+		return nil
+	}
+	if moduleReadVerbs[strings.ToUpper(name[strings.LastIndexByte(name, '.')+1:])] {
+		return []string{FlagReadOnly}
+	}
+	return []string{FlagWrite}
+}
+
+// commandKeys returns the keys a command reads or writes.
+func commandKeys(cmd string, args [][]byte) []string {
+	def, ok := lookupCommand(cmd)
+	if !ok {
+		return nil
+	}
+	return def.keys(args)
+}
+
+// hasFixedKeys reports whether a command names keys at fixed positions, so
+// that a call yielding none is malformed rather than keyless.
+func hasFixedKeys(cmd string) bool {
+	def, ok := lookupCommand(cmd)
+	if !ok {
+		return false
+	}
+	_, movable := keyFinders[def.Name]
+	return def.FirstKey > 0 && !movable
+}
+
+// IsWriteCommand reports whether the named command may modify the keyspace.
+func IsWriteCommand(name string) bool {
+	def, ok := lookupCommand(name)
+	return ok && def.HasFlag(FlagWrite)
+}
+
+// numKeysAt reads a key count at args[i] followed by that many keys.
+func numKeysAt(i int) func(args [][]byte) []string {
+	return func(args [][]byte) []string {
+		if i >= len(args) {
+			return nil
+		}
+		n, err := strconv.Atoi(string(args[i]))
+		if err != nil || n <= 0 {
+			return nil
+		}
+		end := i + 1 + n
+		if end > len(args) {
+			end = len(args)
+		}
+		return allKeys.keys(args[i+1 : end])
+	}
+}
+
+func destAndNumKeys(args [][]byte) []string {
+	return append([]string{string(args[0])}, numKeysAt(1)(args)...)
+}
+
+// streamsKeys returns the first half of the arguments after STREAMS.
+func streamsKeys(args [][]byte) []string {
+	for i, arg := range args {
+		if strings.EqualFold(string(arg), "STREAMS") {
+			rest := args[i+1:]
+			return allKeys.keys(rest[:len(rest)/2])
+		}
+	}
+	return nil
+}
+
+// withStoreKey returns the first argument plus the argument following any
+// of the given options.
+func withStoreKey(options ...string) func(args [][]byte) []string {
+	return func(args [][]byte) []string {
+		keys := []string{string(args[0])}
+		for i := 1; i+1 < len(args); i++ {
+			for _, opt := range options {
+				if strings.EqualFold(string(args[i]), opt) {
+					keys = append(keys, string(args[i+1]))
+				}
+			}
+		}
+		return keys
+	}
+}
+
+// secondArgKey handles MEMORY USAGE key; other subcommands take no keys.
+func secondArgKey(args [][]byte) []string {
+	if len(args) < 2 || !strings.EqualFold(string(args[0]), "USAGE") {
+		return nil
+	}
+	return []string{string(args[1])}
+}
+
+// migrateKeys handles MIGRATE host port key|"" db timeout [... KEYS key ...].
+func migrateKeys(args [][]byte) []string {
+	var keys []string
+	if len(args) > 2 && len(args[2]) > 0 {
+		keys = append(keys, string(args[2]))
+	}
+	for i := 5; i < len(args); i++ {
+		if strings.EqualFold(string(args[i]), "KEYS") {
+			keys = append(keys, allKeys.keys(args[i+1:])...)
+			break
+		}
+	}
+	return keys
+}
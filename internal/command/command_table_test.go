@@ -0,0 +1,108 @@
+package command
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCommandTableIsConsistent(t *testing.T) {
+	known := map[string]bool{
+		FlagWrite: true, FlagReadOnly: true, FlagDenyOOM: true, FlagAdmin: true,
+		FlagPubSub: true, FlagNoScript: true, FlagLoading: true, FlagStale: true,
+		FlagFast: true, FlagBlocking: true, FlagMayReplicate: true, FlagNoMulti: true,
+	}
+	for name, spec := range commandTable {
+		if spec.arity == 0 {
+			t.Errorf("%s: zero arity", name)
+		}
+		flags := strings.Fields(spec.flags)
+		for _, f := range flags {
+			if !known[f] {
+				t.Errorf("%s: unknown flag %q", name, f)
+			}
+		}
+		def := &CommandDef{Name: name}
+		applyCommandSpec(def)
+		if def.HasFlag(FlagWrite) && def.HasFlag(FlagReadOnly) {
+			t.Errorf("%s: both write and readonly", name)
+		}
+		if def.HasFlag(FlagDenyOOM) && !def.HasFlag(FlagWrite) {
+			t.Errorf("%s: denyoom without write", name)
+		}
+		if (spec.first == 0) != (spec.step == 0) || (spec.first > 0 && spec.last > 0 && spec.last < spec.first) {
+			t.Errorf("%s: bad key positions %d %d %d", name, spec.first, spec.last, spec.step)
+		}
+	}
+	for name := range keyFinders {
+		if _, ok := commandTable[name]; !ok && !strings.HasSuffix(name, "_RO") {
+			t.Errorf("key finder for %s, which is not in the command table", name)
+		}
+	}
+}
+
+func TestCommandKeys(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		args []string
+		want []string
+	}{
+		{"GET", []string{"k"}, []string{"k"}},
+		{"MSET", []string{"a", "1", "b", "2"}, []string{"a", "b"}},
+		{"BITOP", []string{"AND", "dst", "s1", "s2"}, []string{"dst", "s1", "s2"}},
+		{"BLPOP", []string{"l1", "l2", "0"}, []string{"l1", "l2"}},
+		{"XGROUP", []string{"CREATE", "stream", "g", "$"}, []string{"stream"}},
+		{"EVAL", []string{"return 1", "2", "k1", "k2", "arg"}, []string{"k1", "k2"}},
+		{"XREAD", []string{"COUNT", "1", "STREAMS", "s1", "s2", "0", "0"}, []string{"s1", "s2"}},
+		{"SORT", []string{"src", "BY", "w_*", "STORE", "dst"}, []string{"src", "dst"}},
+		{"KEYS", []string{"*"}, nil},
+		{"NOSUCHCOMMAND", []string{"k"}, nil},
+	}
+	for _, tt := range tests {
+		if got := commandKeys(tt.cmd, toArgs(tt.args...)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("commandKeys(%s %v) = %v, want %v", tt.cmd, tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestRegisterAppliesCommandSpec(t *testing.T) {
+	r := NewRouter()
+	r.Register(&CommandDef{Name: "GET", Handler: cmdGET})
+	r.Register(&CommandDef{Name: "CUSTOM", Handler: cmdGET})
+	r.Register(&CommandDef{Name: "OVERRIDE", Handler: cmdGET, Arity: 3, Flags: []string{FlagWrite}, FirstKey: 2, LastKey: 2, KeyStep: 1})
+
+	get, _ := r.Get("GET")
+	if get.Arity != 2 || !get.HasFlag(FlagReadOnly) || get.FirstKey != 1 {
+		t.Errorf("GET metadata not applied: %+v", get)
+	}
+	if custom, _ := r.Get("CUSTOM"); custom.Arity != -1 || len(custom.Flags) != 0 || !custom.checkArity(5) {
+		t.Errorf("unknown command must accept any arguments: %+v", custom)
+	}
+	override, _ := r.Get("OVERRIDE")
+	if override.Arity != 3 || !IsWriteCommand("OVERRIDE") || !reflect.DeepEqual(override.keys(toArgs("a", "b")), []string{"b"}) {
+		t.Errorf("explicit metadata overwritten: %+v", override)
+	}
+	if !get.checkArity(2) || get.checkArity(1) || get.checkArity(3) {
+		t.Error("GET arity check")
+	}
+}
+
+func TestModuleCommandFlags(t *testing.T) {
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{"TS.ADD", []string{FlagWrite}},
+		{"TS.RANGE", []string{FlagReadOnly}},
+		{"GRAPH.CREATE", []string{FlagWrite}},
+		{"GRAPH.GET", []string{FlagReadOnly}},
+		{"MATH.ADD", nil},
+		{"UUID.GENERATE", nil},
+		{"CUSTOM", nil},
+	}
+	for _, tt := range tests {
+		if got := moduleCommandFlags(tt.name); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("moduleCommandFlags(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"strings"
 	"sync"
 
+	"github.com/cachestorm/cachestorm/internal/persistence"
 	"github.com/cachestorm/cachestorm/internal/resp"
 )
 
@@ -21,6 +22,10 @@ type Config struct {
 	saveIntervals          []string
 	appendOnly             bool
 	appendFsync            string
+	aofRewritePercentage   int
+	aofRewriteMinSize      int64
+	aofLoadTruncated       bool
+	aofTimestampEnabled    bool
 	daemonize              bool
 	pidfile                string
 	port                   int
@@ -40,6 +45,12 @@ type Config struct {
 	listMaxListpackSize    int
 	setMaxIntsetEntries    int64
 	zsetMaxListpackEntries int
+	replicaReadOnly        bool
+	replicaServeStaleData  bool
+	minReplicasToWrite     int
+	minReplicasMaxLag      int
+	replDisklessSync       bool
+	replDisklessSyncDelay  int
 }
 
 var globalConfig = &Config{
@@ -53,6 +64,9 @@ var globalConfig = &Config{
 	saveIntervals:          []string{},
 	appendOnly:             false,
 	appendFsync:            "everysec",
+	aofRewritePercentage:   100,
+	aofRewriteMinSize:      64 << 20,
+	aofLoadTruncated:       true,
 	daemonize:              false,
 	pidfile:                "",
 	port:                   6380,
@@ -72,6 +86,10 @@ var globalConfig = &Config{
 	listMaxListpackSize:    -2,
 	setMaxIntsetEntries:    512,
 	zsetMaxListpackEntries: 128,
+	replicaReadOnly:        true,
+	replicaServeStaleData:  true,
+	minReplicasMaxLag:      10,
+	replDisklessSyncDelay:  5,
 }
 
 func RegisterConfigCommands(router *Router) {
@@ -135,6 +153,10 @@ func cmdConfigGet(ctx *Context) error {
 	addConfig("save", strings.Join(c.saveIntervals, " "))
 	addConfig("appendonly", boolStr(c.appendOnly))
 	addConfig("appendfsync", c.appendFsync)
+	addConfig("auto-aof-rewrite-percentage", strconv.Itoa(c.aofRewritePercentage))
+	addConfig("auto-aof-rewrite-min-size", strconv.FormatInt(c.aofRewriteMinSize, 10))
+	addConfig("aof-load-truncated", boolStr(c.aofLoadTruncated))
+	addConfig("aof-timestamp-enabled", boolStr(c.aofTimestampEnabled))
 	addConfig("lfu-decay-time", strconv.Itoa(c.lfuDecayTime))
 	addConfig("lfu-log-factor", strconv.Itoa(c.lfuLogFactor))
 	addConfig("activedefrag", boolStr(c.activedefrag))
@@ -146,8 +168,22 @@ func cmdConfigGet(ctx *Context) error {
 	addConfig("list-max-listpack-size", strconv.Itoa(c.listMaxListpackSize))
 	addConfig("set-max-intset-entries", strconv.FormatInt(c.setMaxIntsetEntries, 10))
 	addConfig("zset-max-listpack-entries", strconv.Itoa(c.zsetMaxListpackEntries))
+	addConfig("replica-read-only", boolStr(c.replicaReadOnly))
+	addConfig("replica-serve-stale-data", boolStr(c.replicaServeStaleData))
+	minReplicas, maxLag := c.minReplicasToWrite, c.minReplicasMaxLag
+	if e := replicationEngine(); e != nil {
+		minReplicas, maxLag = e.MinReplicas()
+	}
+	addConfig("min-replicas-to-write", strconv.Itoa(minReplicas))
+	addConfig("min-replicas-max-lag", strconv.Itoa(maxLag))
+	diskless, disklessDelay := c.replDisklessSync, c.replDisklessSyncDelay
+	if e := replicationEngine(); e != nil {
+		diskless, disklessDelay = e.DisklessSync()
+	}
+	addConfig("repl-diskless-sync", boolStr(diskless))
+	addConfig("repl-diskless-sync-delay", strconv.Itoa(disklessDelay))
 
-	return ctx.WriteArray(results)
+	return ctx.WriteMap(results)
 }
 
 func matchConfigPattern(name, pattern string) bool {
@@ -165,7 +201,7 @@ func boolStr(b bool) string {
 }
 
 func cmdConfigSet(ctx *Context) error {
-	if ctx.ArgCount()%2 != 0 {
+	if ctx.ArgCount() < 3 || ctx.ArgCount()%2 == 0 {
 		return ctx.WriteError(ErrWrongArgCount)
 	}
 
@@ -229,12 +265,55 @@ func cmdConfigSet(ctx *Context) error {
 				globalSlowLog.maxLen = v
 				globalSlowLog.mu.Unlock()
 			}
+		case "save":
+			rules, err := persistence.ParseSaveRules(value)
+			if err != nil {
+				return ctx.WriteError(errors.New("ERR Invalid argument '" + value + "' for CONFIG SET 'save'"))
+			}
+			if pm := snapshotManager(); pm != nil {
+				pm.SetSaveRules(rules)
+			}
+			c.saveIntervals = strings.Fields(persistence.FormatSaveRules(rules))
 		case "loglevel":
 			c.logLevel = value
 		case "appendonly":
 			c.appendOnly = value == "yes"
 		case "appendfsync":
 			c.appendFsync = value
+		case "auto-aof-rewrite-percentage":
+			v, err := strconv.Atoi(value)
+			if err != nil || v < 0 {
+				return ctx.WriteError(errors.New("ERR Invalid argument '" + value + "' for CONFIG SET 'auto-aof-rewrite-percentage'"))
+			}
+			c.aofRewritePercentage = v
+			if m := aofManager(); m != nil {
+				m.SetRewriteRules(c.aofRewriteMinSize, v)
+			}
+		case "auto-aof-rewrite-min-size":
+			v, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || v < 0 {
+				return ctx.WriteError(errors.New("ERR Invalid argument '" + value + "' for CONFIG SET 'auto-aof-rewrite-min-size'"))
+			}
+			c.aofRewriteMinSize = v
+			if m := aofManager(); m != nil {
+				m.SetRewriteRules(v, c.aofRewritePercentage)
+			}
+		case "aof-load-truncated":
+			if value != "yes" && value != "no" {
+				return ctx.WriteError(errors.New("ERR Invalid argument '" + value + "' for CONFIG SET 'aof-load-truncated'"))
+			}
+			c.aofLoadTruncated = value == "yes"
+			if m := aofManager(); m != nil {
+				m.SetLoadTruncated(c.aofLoadTruncated)
+			}
+		case "aof-timestamp-enabled":
+			if value != "yes" && value != "no" {
+				return ctx.WriteError(errors.New("ERR Invalid argument '" + value + "' for CONFIG SET 'aof-timestamp-enabled'"))
+			}
+			c.aofTimestampEnabled = value == "yes"
+			if m := aofManager(); m != nil {
+				m.SetTimestamps(c.aofTimestampEnabled)
+			}
 		case "tcp-keepalive":
 			if v, err := strconv.Atoi(value); err == nil {
 				c.tcpKeepalive = v
@@ -249,6 +328,56 @@ func cmdConfigSet(ctx *Context) error {
 			}
 		case "activedefrag":
 			c.activedefrag = value == "yes"
+		case "replica-read-only", "slave-read-only":
+			c.replicaReadOnly = value == "yes"
+			if e := replicationEngine(); e != nil {
+				e.SetReadOnly(c.replicaReadOnly)
+			}
+		case "replica-serve-stale-data", "slave-serve-stale-data":
+			if value != "yes" && value != "no" {
+				return ctx.WriteError(errors.New("ERR Invalid argument '" + value + "' for CONFIG SET '" + param + "'"))
+			}
+			c.replicaServeStaleData = value == "yes"
+			if e := replicationEngine(); e != nil {
+				e.SetServeStaleData(c.replicaServeStaleData)
+			}
+		case "min-replicas-to-write", "min-slaves-to-write", "min-replicas-max-lag", "min-slaves-max-lag":
+			v, err := strconv.Atoi(value)
+			if err != nil || v < 0 {
+				return ctx.WriteError(errors.New("ERR Invalid argument '" + value + "' for CONFIG SET '" + param + "'"))
+			}
+			e := replicationEngine()
+			if e != nil {
+				c.minReplicasToWrite, c.minReplicasMaxLag = e.MinReplicas()
+			}
+			if strings.HasSuffix(param, "-to-write") {
+				c.minReplicasToWrite = v
+			} else {
+				c.minReplicasMaxLag = v
+			}
+			if e != nil {
+				e.SetMinReplicas(c.minReplicasToWrite, c.minReplicasMaxLag)
+			}
+		case "repl-diskless-sync", "repl-diskless-sync-delay":
+			e := replicationEngine()
+			if e != nil {
+				c.replDisklessSync, c.replDisklessSyncDelay = e.DisklessSync()
+			}
+			if param == "repl-diskless-sync" {
+				if value != "yes" && value != "no" {
+					return ctx.WriteError(errors.New("ERR Invalid argument '" + value + "' for CONFIG SET '" + param + "'"))
+				}
+				c.replDisklessSync = value == "yes"
+			} else {
+				v, err := strconv.Atoi(value)
+				if err != nil || v < 0 {
+					return ctx.WriteError(errors.New("ERR Invalid argument '" + value + "' for CONFIG SET '" + param + "'"))
+				}
+				c.replDisklessSyncDelay = v
+			}
+			if e != nil {
+				e.SetDisklessSync(c.replDisklessSync, c.replDisklessSyncDelay)
+			}
 		}
 	}
 
@@ -2,6 +2,7 @@ package command
 
 import (
 	"errors"
+	"strconv"
 	"sync/atomic"
 	"time"
 
@@ -34,6 +35,15 @@ type Context struct {
 	Subscriber    *store.Subscriber
 	Username      string
 	RemoteAddr    string
+	Session       *Session
+
+	// What the command sends to the AOF; see propagated.
+	effects     []propagatedCommand
+	rewritten   bool
+	replyFailed bool
+	// exec is the EXEC running this queued command, which sends what the
+	// command writes along with the rest of the transaction.
+	exec *Context
 }
 
 func NewContext(cmd string, args [][]byte, s *store.Store, w *resp.Writer) *Context {
@@ -58,12 +68,60 @@ func NewContextWithClient(cmd string, args [][]byte, s *store.Store, w *resp.Wri
 	}
 }
 
+// NewContextWithSession builds a context for a command issued on a
+// long-lived connection. Transaction, identity and namespace come from the
+// session, and the store is resolved to the session's selected namespace.
+func NewContextWithSession(cmd string, args [][]byte, s *store.Store, w *resp.Writer, sess *Session) *Context {
+	return &Context{
+		Command:       cmd,
+		Args:          args,
+		Store:         sess.Store(s),
+		Writer:        w,
+		Transaction:   sess.Transaction,
+		ClientID:      sess.ID(),
+		RemoteAddr:    sess.RemoteAddr(),
+		Authenticated: sess.IsAuthenticated(),
+		Username:      sess.Username(),
+		Namespace:     sess.Namespace(),
+		Session:       sess,
+	}
+}
+
+// derive creates a context for a nested command (e.g. one queued by MULTI)
+// that shares this context's client state but writes to w.
+func (ctx *Context) derive(cmd string, args [][]byte, w *resp.Writer) *Context {
+	return &Context{
+		Command:       cmd,
+		Args:          args,
+		Store:         ctx.Store,
+		Writer:        w,
+		Authenticated: ctx.Authenticated,
+		ClientID:      ctx.ClientID,
+		Namespace:     ctx.Namespace,
+		Transaction:   ctx.Transaction,
+		Subscriber:    ctx.Subscriber,
+		Username:      ctx.Username,
+		RemoteAddr:    ctx.RemoteAddr,
+		Session:       ctx.Session,
+	}
+}
+
 func (ctx *Context) IsAuthenticated() bool {
 	return ctx.Authenticated
 }
 
 func (ctx *Context) SetAuthenticated(auth bool) {
 	ctx.Authenticated = auth
+	if ctx.Session != nil {
+		ctx.Session.SetAuthenticated(auth)
+	}
+}
+
+func (ctx *Context) SetUsername(name string) {
+	ctx.Username = name
+	if ctx.Session != nil {
+		ctx.Session.SetUsername(name)
+	}
 }
 
 func (ctx *Context) GetTransaction() *Transaction {
@@ -80,6 +138,20 @@ func (ctx *Context) GetSubscriber() *store.Subscriber {
 	return ctx.Subscriber
 }
 
+// SetProtocol switches the connection to RESP2 or RESP3. The reply to the
+// current command is already written in the new protocol.
+func (ctx *Context) SetProtocol(version int) {
+	ctx.Writer.SetProtocol(version)
+	if ctx.Session != nil {
+		ctx.Session.SetProtocol(version)
+	}
+}
+
+// IsRESP3 reports whether the client negotiated RESP3 with HELLO 3.
+func (ctx *Context) IsRESP3() bool {
+	return ctx.Writer.IsRESP3()
+}
+
 func (ctx *Context) Arg(n int) []byte {
 	if n < 0 || n >= len(ctx.Args) {
 		return nil
@@ -100,6 +172,7 @@ func (ctx *Context) WriteOK() error {
 }
 
 func (ctx *Context) WriteError(err error) error {
+	ctx.replyFailed = true
 	return ctx.Writer.WriteError(err.Error())
 }
 
@@ -135,6 +208,44 @@ func (ctx *Context) WriteArray(items []*resp.Value) error {
 	return ctx.Writer.WriteArray(items)
 }
 
+// WriteMap writes flattened key/value pairs as a RESP3 map, or as a flat
+// array for RESP2 clients.
+func (ctx *Context) WriteMap(pairs []*resp.Value) error {
+	if ctx.IsRESP3() {
+		return ctx.Writer.WriteMap(pairs)
+	}
+	return ctx.Writer.WriteArray(pairs)
+}
+
+// WriteSet writes a RESP3 set, or an array for RESP2 clients.
+func (ctx *Context) WriteSet(items []*resp.Value) error {
+	if ctx.IsRESP3() {
+		return ctx.Writer.WriteSet(items)
+	}
+	return ctx.Writer.WriteArray(items)
+}
+
+// WritePush writes a RESP3 push, or an array for RESP2 clients.
+func (ctx *Context) WritePush(items []*resp.Value) error {
+	if ctx.IsRESP3() {
+		return ctx.Writer.WritePush(items)
+	}
+	return ctx.Writer.WriteArray(items)
+}
+
+// WriteDouble writes a RESP3 double, or a bulk string for RESP2 clients.
+func (ctx *Context) WriteDouble(f float64) error {
+	return ctx.WriteValue(ctx.DoubleValue(f))
+}
+
+// DoubleValue builds a float reply element in the client's protocol.
+func (ctx *Context) DoubleValue(f float64) *resp.Value {
+	if ctx.IsRESP3() {
+		return resp.DoubleValue(f)
+	}
+	return resp.BulkString(strconv.FormatFloat(f, 'f', -1, 64))
+}
+
 // Safe map accessors to prevent panics from type assertions
 func mapInt64(m map[string]interface{}, key string) int64 {
 	v, _ := m[key].(int64)
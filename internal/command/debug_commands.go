@@ -32,7 +32,7 @@ func cmdDEBUG(ctx *Context) error {
 	case "OBJECT":
 		return cmdDebugObject(ctx)
 	case "RELOAD":
-		return ctx.WriteOK()
+		return cmdDebugReload(ctx)
 	case "LOADAOF":
 		return ctx.WriteOK()
 	case "DIGEST":
@@ -71,6 +71,46 @@ func cmdDebugSleep(ctx *Context) error {
 	return ctx.WriteOK()
 }
 
+// cmdDebugReload implements DEBUG RELOAD [NOSAVE] [NOFLUSH] [MERGE]: save
+// the snapshot, empty the databases it holds and load it back. NOSAVE loads
+// the file as it is on disk, which is how a node is seeded from a Redis
+// dump; NOFLUSH and MERGE keep existing keys, letting the file win on
+// conflicts.
+func cmdDebugReload(ctx *Context) error {
+	save, merge := true, false
+	for i := 1; i < ctx.ArgCount(); i++ {
+		switch strings.ToUpper(ctx.ArgString(i)) {
+		case "NOSAVE":
+			save = false
+		case "NOFLUSH", "MERGE":
+			merge = true
+		default:
+			return ctx.WriteError(ErrSyntaxError)
+		}
+	}
+
+	pm := snapshotManager()
+	if pm == nil {
+		return ctx.WriteError(errors.New("ERR snapshots are not enabled, set persistence.rdb_filename"))
+	}
+
+	if save {
+		if err := pm.SAVE(); err != nil {
+			return ctx.WriteError(fmt.Errorf("ERR Error trying to save the DB: %v", err))
+		}
+	}
+
+	load := pm.Load
+	if merge {
+		load = pm.LoadMerge
+	}
+	if err := load(); err != nil {
+		return ctx.WriteError(fmt.Errorf("ERR Error trying to load the RDB dump: %v", err))
+	}
+	datasetReplaced()
+	return ctx.WriteOK()
+}
+
 func cmdDebugObject(ctx *Context) error {
 	if ctx.ArgCount() != 2 {
 		return ctx.WriteError(ErrWrongArgCount)
@@ -3,9 +3,29 @@ package command
 import (
 	"testing"
 
+	"github.com/cachestorm/cachestorm/internal/config"
+	"github.com/cachestorm/cachestorm/internal/persistence"
+	"github.com/cachestorm/cachestorm/internal/replication"
 	"github.com/cachestorm/cachestorm/internal/store"
 )
 
+// useReplicationEngine serves replication from a new master engine for s
+// until the test ends.
+func useReplicationEngine(t *testing.T, s *store.Store) *replication.Manager {
+	m := replication.NewManager(&config.ReplicationConfig{Role: "master"}, s)
+	replEngine.mu.Lock()
+	prev := replEngine.m
+	replEngine.m = m
+	replEngine.mu.Unlock()
+	t.Cleanup(func() {
+		replEngine.mu.Lock()
+		replEngine.m = prev
+		replEngine.mu.Unlock()
+		m.Stop()
+	})
+	return m
+}
+
 func TestAllDebugCommands(t *testing.T) {
 	s := store.NewStore()
 	router := NewRouter()
@@ -41,3 +61,55 @@ func TestAllDebugCommands(t *testing.T) {
 		})
 	}
 }
+
+func TestDebugReload(t *testing.T) {
+	s := store.NewStoreWithNamespaces()
+	pm := persistence.NewPersistenceManager(s, persistence.Config{DataDir: t.TempDir(), RDBFilename: "dump.rdb"})
+	path := pm.Path()
+	EnableSnapshots(pm)
+	t.Cleanup(func() { EnableSnapshots(nil) })
+	repl := useReplicationEngine(t, s)
+	replID := repl.GetReplicaID()
+
+	s.Set("kept", &store.StringValue{Data: []byte("v")}, store.SetOptions{})
+	s.ForNamespace("db1").Set("other", &store.StringValue{Data: []byte("v")}, store.SetOptions{})
+	if err := cmdDEBUG(newTestContext("DEBUG", [][]byte{[]byte("RELOAD")}, s)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Get("kept"); !ok {
+		t.Fatal("key lost across DEBUG RELOAD")
+	}
+	if _, ok := s.ForNamespace("db1").Get("other"); !ok {
+		t.Fatal("db1 key lost across DEBUG RELOAD")
+	}
+	if repl.GetReplicaID() == replID {
+		t.Error("replicas may continue the history from before DEBUG RELOAD")
+	}
+	replID = repl.GetReplicaID()
+
+	// NOSAVE loads whatever is on disk, e.g. a dump copied from Redis.
+	seed := store.NewStore()
+	seed.Set("seeded", &store.StringValue{Data: []byte("v")}, store.SetOptions{})
+	if err := persistence.NewRDBWriter(seed, persistence.RDBConfig{RedisCompatible: true}).Save(path); err != nil {
+		t.Fatal(err)
+	}
+	s.Set("local", &store.StringValue{Data: []byte("v")}, store.SetOptions{})
+	if err := cmdDEBUG(newTestContext("DEBUG", [][]byte{[]byte("RELOAD"), []byte("NOSAVE"), []byte("MERGE")}, s)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Get("local"); !ok {
+		t.Error("MERGE dropped an existing key")
+	}
+	if repl.GetReplicaID() == replID {
+		t.Error("replicas may continue the history from before DEBUG RELOAD MERGE")
+	}
+	if err := cmdDEBUG(newTestContext("DEBUG", [][]byte{[]byte("RELOAD"), []byte("NOSAVE")}, s)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Get("seeded"); !ok {
+		t.Error("seeded key not loaded")
+	}
+	if _, ok := s.Get("local"); ok {
+		t.Error("DEBUG RELOAD NOSAVE kept a key missing from the file")
+	}
+}
@@ -0,0 +1,92 @@
+package command
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/cachestorm/cachestorm/internal/persistence"
+	"github.com/cachestorm/cachestorm/internal/resp"
+	"github.com/cachestorm/cachestorm/internal/store"
+)
+
+// cmdDUMPALL implements DUMPALL [MATCH pattern] [NAMESPACE name] [TAG tag],
+// replying with the NDJSON record of every key of every namespace, or of
+// the keys selected, one per element. Keys the ACL user may not access are
+// left out. The export goes to a temporary file, as the reply has to start
+// with the number of records, and is streamed from there, so that it is
+// never held in memory whole.
+func cmdDUMPALL(ctx *Context) error {
+	var filter persistence.NDJSONFilter
+	for i := 0; i < ctx.ArgCount(); i += 2 {
+		if i+1 >= ctx.ArgCount() {
+			return ctx.WriteError(ErrSyntaxError)
+		}
+		switch strings.ToUpper(ctx.ArgString(i)) {
+		case "MATCH":
+			filter.Match = ctx.ArgString(i + 1)
+		case "NAMESPACE":
+			filter.Namespace = ctx.ArgString(i + 1)
+		case "TAG":
+			filter.Tag = ctx.ArgString(i + 1)
+		default:
+			return ctx.WriteError(ErrSyntaxError)
+		}
+	}
+	if user, ok := ctx.currentACLUser(); ok && !user.AllKeys() {
+		filter.Allow = user.CanAccessKey
+	}
+
+	f, err := os.CreateTemp("", "dumpall-*.ndjson")
+	if err != nil {
+		return ctx.WriteError(fmt.Errorf("ERR %v", err))
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	n, err := persistence.ExportNDJSON(f, ctx.Store, filter)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return ctx.WriteError(fmt.Errorf("ERR %v", err))
+	}
+
+	if err := ctx.Writer.WriteArrayHeader(n); err != nil {
+		return err
+	}
+	r := bufio.NewReader(f)
+	for ; n > 0; n-- {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			return err
+		}
+		if err := ctx.Writer.WriteValueNoFlush(resp.BulkBytes(bytes.TrimSuffix(line, []byte("\n")))); err != nil {
+			return err
+		}
+	}
+	return ctx.Writer.Flush()
+}
+
+// ImportNDJSON loads the records of an NDJSON export into s, replacing keys
+// of the same name. The keys are set without going through the write
+// commands, so the AOF is rewritten once they are in and replicas resync;
+// the import is refused when CheckDatasetReplace refuses it.
+func ImportNDJSON(r io.Reader, s *store.Store) (int64, error) {
+	if err := CheckDatasetReplace(); err != nil {
+		return 0, err
+	}
+	n, err := persistence.ImportNDJSON(r, s)
+	if n == 0 {
+		return n, err
+	}
+	datasetReplaced()
+	if m := aofManager(); m != nil {
+		if rerr := m.Rewrite(); rerr != nil && err == nil {
+			err = fmt.Errorf("keys imported, but rewriting the AOF failed: %v", rerr)
+		}
+	}
+	return n, err
+}
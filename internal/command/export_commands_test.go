@@ -0,0 +1,46 @@
+package command
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/cachestorm/cachestorm/internal/resp"
+	"github.com/cachestorm/cachestorm/internal/store"
+)
+
+func TestDUMPALL(t *testing.T) {
+	s := store.NewStoreWithNamespaces()
+	s.Set("user:1", &store.StringValue{Data: []byte("ada")}, store.SetOptions{Tags: []string{"users"}})
+	s.Set("user:2", &store.StringValue{Data: []byte("bob")}, store.SetOptions{})
+	s.ForNamespace("db1").Set("user:3", &store.StringValue{Data: []byte("eve")}, store.SetOptions{})
+
+	dumpall := func(args ...string) string {
+		t.Helper()
+		var buf bytes.Buffer
+		argv := make([][]byte, len(args))
+		for i, a := range args {
+			argv[i] = []byte(a)
+		}
+		ctx := &Context{Command: "DUMPALL", Args: argv, Store: s.ForNamespace("db1"), Writer: resp.NewWriter(&buf)}
+		if err := cmdDUMPALL(ctx); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+
+	if out := dumpall(); !strings.HasPrefix(out, "*3\r\n") || !strings.Contains(out, `"namespace":"db1"`) {
+		t.Errorf("DUMPALL = %q, want every namespace from any of them", out)
+	}
+	want := `{"key":"user:1","type":"string","ttl_ms":-1,"tags":["users"],"value":"ada"}`
+	if out := dumpall("MATCH", "user:*", "TAG", "users"); out != "*1\r\n$"+strconv.Itoa(len(want))+"\r\n"+want+"\r\n" {
+		t.Errorf("DUMPALL MATCH TAG = %q", out)
+	}
+	if out := dumpall("NAMESPACE", "db2"); out != "*0\r\n" {
+		t.Errorf("DUMPALL of an empty namespace = %q", out)
+	}
+	if out := dumpall("MATCH"); !strings.HasPrefix(out, "-ERR syntax") {
+		t.Errorf("DUMPALL MATCH without a pattern = %q", out)
+	}
+}
@@ -102,10 +102,11 @@ func RegisterExtendedCommands(router *Router) {
 	router.Register(&CommandDef{Name: "SENTINELX.ALERTS", Handler: cmdSENTINELXALERTS})
 	router.Register(&CommandDef{Name: "SENTINELX.CONFIG", Handler: cmdSENTINELXCONFIG})
 
-	router.Register(&CommandDef{Name: "BACKUPX.CREATE", Handler: cmdBACKUPXCREATE})
-	router.Register(&CommandDef{Name: "BACKUPX.RESTORE", Handler: cmdBACKUPXRESTORE})
-	router.Register(&CommandDef{Name: "BACKUPX.LIST", Handler: cmdBACKUPXLIST})
-	router.Register(&CommandDef{Name: "BACKUPX.DELETE", Handler: cmdBACKUPXDELETE})
+	// BACKUPX.* are the former names of the BACKUP.* commands
+	router.Register(&CommandDef{Name: "BACKUPX.CREATE", Handler: cmdBACKUPCREATE})
+	router.Register(&CommandDef{Name: "BACKUPX.RESTORE", Handler: cmdBACKUPRESTORE})
+	router.Register(&CommandDef{Name: "BACKUPX.LIST", Handler: cmdBACKUPLIST})
+	router.Register(&CommandDef{Name: "BACKUPX.DELETE", Handler: cmdBACKUPDELETE})
 
 	router.Register(&CommandDef{Name: "REPLAY.START", Handler: cmdREPLAYSTART})
 	router.Register(&CommandDef{Name: "REPLAY.STOP", Handler: cmdREPLAYSTOP})
@@ -1997,78 +1998,6 @@ func cmdSENTINELXCONFIG(ctx *Context) error {
 	return ctx.WriteOK()
 }
 
-var (
-	backupsX    = make(map[string]*BackupX)
-	backupsXMux sync.RWMutex
-)
-
-type BackupX struct {
-	ID        string
-	Name      string
-	Type      string
-	Size      int64
-	CreatedAt int64
-}
-
-func cmdBACKUPXCREATE(ctx *Context) error {
-	if ctx.ArgCount() < 1 {
-		return ctx.WriteError(ErrWrongArgCount)
-	}
-	name := ctx.ArgString(0)
-	backupType := "full"
-	if ctx.ArgCount() >= 2 {
-		backupType = ctx.ArgString(1)
-	}
-	id := generateUUID()
-	backupsXMux.Lock()
-	backupsX[id] = &BackupX{ID: id, Name: name, Type: backupType, Size: 0, CreatedAt: time.Now().UnixMilli()}
-	backupsXMux.Unlock()
-	return ctx.WriteBulkString(id)
-}
-
-func cmdBACKUPXRESTORE(ctx *Context) error {
-	if ctx.ArgCount() < 1 {
-		return ctx.WriteError(ErrWrongArgCount)
-	}
-	id := ctx.ArgString(0)
-	backupsXMux.RLock()
-	_, exists := backupsX[id]
-	backupsXMux.RUnlock()
-	if !exists {
-		return ctx.WriteError(fmt.Errorf("ERR backup not found"))
-	}
-	return ctx.WriteOK()
-}
-
-func cmdBACKUPXLIST(ctx *Context) error {
-	backupsXMux.RLock()
-	defer backupsXMux.RUnlock()
-	results := make([]*resp.Value, 0)
-	for id, backup := range backupsX {
-		results = append(results, resp.ArrayValue([]*resp.Value{
-			resp.BulkString("id"), resp.BulkString(id),
-			resp.BulkString("name"), resp.BulkString(backup.Name),
-			resp.BulkString("type"), resp.BulkString(backup.Type),
-			resp.BulkString("created_at"), resp.IntegerValue(backup.CreatedAt),
-		}))
-	}
-	return ctx.WriteArray(results)
-}
-
-func cmdBACKUPXDELETE(ctx *Context) error {
-	if ctx.ArgCount() < 1 {
-		return ctx.WriteError(ErrWrongArgCount)
-	}
-	id := ctx.ArgString(0)
-	backupsXMux.Lock()
-	defer backupsXMux.Unlock()
-	if _, exists := backupsX[id]; !exists {
-		return ctx.WriteInteger(0)
-	}
-	delete(backupsX, id)
-	return ctx.WriteInteger(1)
-}
-
 var (
 	replays   = make(map[string]*Replay)
 	replaysMu sync.RWMutex
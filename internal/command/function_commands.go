@@ -162,6 +162,10 @@ func (r *FunctionRegistry) ListLibraries(pattern string) []*Library {
 }
 
 func (r *FunctionRegistry) CallFunction(libName string, fnName string, keys []string, args []string) (interface{}, error) {
+	return r.callFunctionIn(scriptCaller{db: "0"}, libName, fnName, keys, args)
+}
+
+func (r *FunctionRegistry) callFunctionIn(caller scriptCaller, libName string, fnName string, keys []string, args []string) (interface{}, error) {
 	r.mu.RLock()
 	lib, libExists := r.libraries[libName]
 	if !libExists {
@@ -178,7 +182,7 @@ func (r *FunctionRegistry) CallFunction(libName string, fnName string, keys []st
 	r.mu.RUnlock()
 
 	se := NewScriptEngine(r.store)
-	L := se.CreateState(keys, args)
+	L := se.createState(keys, args, caller)
 	defer L.Close()
 
 	if err := L.DoString(code); err != nil {
@@ -382,6 +386,18 @@ func handleFunctionFlush(ctx *Context, registry *FunctionRegistry) error {
 }
 
 func cmdFCALL(ctx *Context) error {
+	return fcall(ctx, ctx.scriptCaller())
+}
+
+// cmdFCALL_RO runs a function that may only read: its writes are refused,
+// so it needs none of the guards of FCALL.
+func cmdFCALL_RO(ctx *Context) error {
+	caller := ctx.scriptCaller()
+	caller.readOnly = true
+	return fcall(ctx, caller)
+}
+
+func fcall(ctx *Context, caller scriptCaller) error {
 	if ctx.ArgCount() < 1 {
 		return ctx.WriteError(ErrWrongArgCount)
 	}
@@ -418,7 +434,7 @@ func cmdFCALL(ctx *Context) error {
 	}
 
 	registry := GetFunctionRegistry(ctx.Store)
-	result, err := registry.CallFunction(libName, fnName, keys, args)
+	result, err := registry.callFunctionIn(caller, libName, fnName, keys, args)
 	if err != nil {
 		return ctx.WriteError(err)
 	}
@@ -426,10 +442,6 @@ func cmdFCALL(ctx *Context) error {
 	return writeLuaResult(ctx, result)
 }
 
-func cmdFCALL_RO(ctx *Context) error {
-	return cmdFCALL(ctx)
-}
-
 func parseFuncInt(s string) (int64, error) {
 	var n int64
 	for _, c := range s {
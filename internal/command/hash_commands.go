@@ -180,7 +180,7 @@ func cmdHGETALL(ctx *Context) error {
 		return ctx.WriteError(err)
 	}
 	if hash == nil {
-		return ctx.WriteArray([]*resp.Value{})
+		return ctx.WriteMap([]*resp.Value{})
 	}
 
 	hash.RLock()
@@ -191,7 +191,7 @@ func cmdHGETALL(ctx *Context) error {
 		results = append(results, resp.BulkBytes(value))
 	}
 
-	return ctx.WriteArray(results)
+	return ctx.WriteMap(results)
 }
 
 func cmdHDEL(ctx *Context) error {
@@ -385,6 +385,7 @@ func cmdHINCRBYFLOAT(ctx *Context) error {
 
 	result := strconv.FormatFloat(newVal, 'f', -1, 64)
 	hash.Fields[field] = []byte(result)
+	ctx.propagate("HSET", []byte(key), []byte(field), []byte(result))
 	return ctx.WriteBulkString(result)
 }
 
@@ -619,10 +619,12 @@ func cmdBLMOVE(ctx *Context) error {
 
 	// Try immediate move
 	if value, ok := tryListMove(ctx, srcKey, dstKey, whereFrom, whereTo); ok {
+		ctx.propagate("LMOVE", ctx.Args[:4]...)
 		return ctx.WriteBulkBytes(value)
 	}
 
 	if timeout == 0 {
+		ctx.propagateNothing()
 		return ctx.WriteNull()
 	}
 
@@ -631,9 +633,11 @@ func cmdBLMOVE(ctx *Context) error {
 
 	for {
 		if !notifier.WaitForKey(srcKey, dur) {
+			ctx.propagateNothing()
 			return ctx.WriteNull()
 		}
 		if value, ok := tryListMove(ctx, srcKey, dstKey, whereFrom, whereTo); ok {
+			ctx.propagate("LMOVE", ctx.Args[:4]...)
 			return ctx.WriteBulkBytes(value)
 		}
 	}
@@ -704,6 +708,7 @@ func cmdBLPOP(ctx *Context) error {
 
 	// Try immediate pop first
 	if key, value, ok := tryLPop(ctx, keys); ok {
+		ctx.propagate("LPOP", []byte(key))
 		return ctx.WriteArray([]*resp.Value{
 			resp.BulkString(key),
 			resp.BulkBytes(value),
@@ -711,6 +716,7 @@ func cmdBLPOP(ctx *Context) error {
 	}
 
 	if timeout == 0 {
+		ctx.propagateNothing()
 		return ctx.WriteNull()
 	}
 
@@ -721,6 +727,7 @@ func cmdBLPOP(ctx *Context) error {
 	for {
 		notifiedKey, notified := notifier.WaitForKeys(keys, deadline)
 		if !notified {
+			ctx.propagateNothing()
 			return ctx.WriteNull()
 		}
 
@@ -739,6 +746,7 @@ func cmdBLPOP(ctx *Context) error {
 				if isEmpty {
 					ctx.Store.Delete(notifiedKey)
 				}
+				ctx.propagate("LPOP", []byte(notifiedKey))
 				return ctx.WriteArray([]*resp.Value{
 					resp.BulkString(notifiedKey),
 					resp.BulkBytes(value),
@@ -788,6 +796,7 @@ func cmdBRPOP(ctx *Context) error {
 
 	// Try immediate pop first
 	if key, value, ok := tryRPop(ctx, keys); ok {
+		ctx.propagate("RPOP", []byte(key))
 		return ctx.WriteArray([]*resp.Value{
 			resp.BulkString(key),
 			resp.BulkBytes(value),
@@ -795,6 +804,7 @@ func cmdBRPOP(ctx *Context) error {
 	}
 
 	if timeout == 0 {
+		ctx.propagateNothing()
 		return ctx.WriteNull()
 	}
 
@@ -804,6 +814,7 @@ func cmdBRPOP(ctx *Context) error {
 	for {
 		notifiedKey, notified := notifier.WaitForKeys(keys, deadline)
 		if !notified {
+			ctx.propagateNothing()
 			return ctx.WriteNull()
 		}
 
@@ -822,6 +833,7 @@ func cmdBRPOP(ctx *Context) error {
 				if isEmpty {
 					ctx.Store.Delete(notifiedKey)
 				}
+				ctx.propagate("RPOP", []byte(notifiedKey))
 				return ctx.WriteArray([]*resp.Value{
 					resp.BulkString(notifiedKey),
 					resp.BulkBytes(value),
@@ -869,10 +881,12 @@ func cmdBRPOPLPUSH(ctx *Context) error {
 
 	// BRPOPLPUSH is RPOP src + LPUSH dst
 	if value, ok := tryListMove(ctx, srcKey, dstKey, "RIGHT", "LEFT"); ok {
+		ctx.propagate("RPOPLPUSH", ctx.Args[:2]...)
 		return ctx.WriteBulkBytes(value)
 	}
 
 	if timeout == 0 {
+		ctx.propagateNothing()
 		return ctx.WriteNull()
 	}
 
@@ -881,9 +895,11 @@ func cmdBRPOPLPUSH(ctx *Context) error {
 
 	for {
 		if !notifier.WaitForKey(srcKey, dur) {
+			ctx.propagateNothing()
 			return ctx.WriteNull()
 		}
 		if value, ok := tryListMove(ctx, srcKey, dstKey, "RIGHT", "LEFT"); ok {
+			ctx.propagate("RPOPLPUSH", ctx.Args[:2]...)
 			return ctx.WriteBulkBytes(value)
 		}
 	}
@@ -1149,6 +1165,8 @@ func cmdBLMPOP(ctx *Context) error {
 			if len(list.Elements) == 0 {
 				ctx.Store.Delete(key)
 			}
+			ctx.propagate("LMPOP", []byte("1"), []byte(key), []byte(dir),
+				[]byte("COUNT"), []byte(strconv.Itoa(len(elements))))
 			return ctx.WriteArray([]*resp.Value{
 				resp.BulkString(key),
 				resp.ArrayValue(elements),
@@ -1156,5 +1174,6 @@ func cmdBLMPOP(ctx *Context) error {
 		}
 	}
 	_ = timeout
+	ctx.propagateNothing()
 	return ctx.WriteNull()
 }
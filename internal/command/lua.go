@@ -4,11 +4,14 @@ import (
 	"context"
 	"crypto/sha1"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/cachestorm/cachestorm/internal/acl"
 	"github.com/cachestorm/cachestorm/internal/store"
 	lua "github.com/yuin/gopher-lua"
 )
@@ -32,6 +35,106 @@ func NewScriptEngine(s *store.Store) *ScriptEngine {
 }
 
 func (e *ScriptEngine) CreateState(keys []string, args []string) *lua.LState {
+	return e.createState(keys, args, scriptCaller{db: "0"})
+}
+
+// scriptCaller describes the client a script runs for: the database its
+// redis.call traffic is reported in to MONITOR, the ACL user the calls
+// are checked against (nil for no checks), the store of the namespace the
+// calls apply to (nil for the engine's), whether the script may only read,
+// and where the writes the script makes are propagated (nil to drop them).
+type scriptCaller struct {
+	db         string
+	user       *acl.User
+	clientInfo string
+	store      *store.Store
+	readOnly   bool
+	propagate  func(name string, args ...[]byte)
+}
+
+// denied checks a redis.call against the command's noscript flag and the
+// caller's ACL user and returns the error to raise in the script, or "" if
+// the call is allowed.
+func (c scriptCaller) denied(cmd string, args []string) string {
+	cmd = strings.ToUpper(cmd)
+	def, ok := lookupCommand(cmd)
+	if ok && def.HasFlag(FlagNoScript) {
+		return "ERR This Redis command is not allowed from script"
+	}
+	if ok && def.HasFlag(FlagWrite) && c.readOnly {
+		return "ERR Write commands are not allowed from read-only scripts."
+	}
+	if ok && def.HasFlag(FlagWrite) && readOnlyReplica() {
+		return "READONLY You can't write against a read only replica."
+	}
+	if c.user == nil {
+		return ""
+	}
+	byteArgs := make([][]byte, len(args))
+	for i, a := range args {
+		byteArgs[i] = []byte(a)
+	}
+	reason, object := aclDenial(c.user, cmd, byteArgs)
+	switch reason {
+	case "":
+		return ""
+	case acl.ReasonKey:
+		globalACL.LogDenial(reason, aclContextLua, object, c.user.Name, c.clientInfo)
+		return "NOPERM The user executing the script can't access at least one of the keys mentioned in the command"
+	case acl.ReasonChannel:
+		globalACL.LogDenial(reason, aclContextLua, object, c.user.Name, c.clientInfo)
+		return "NOPERM The user executing the script can't publish to the channel mentioned in the command"
+	default:
+		globalACL.LogDenial(reason, aclContextLua, object, c.user.Name, c.clientInfo)
+		return "NOPERM The user executing the script can't run this command or subcommand"
+	}
+}
+
+// call runs a redis.call command for the caller. Writes get the guards
+// the router gives write commands: the keys are preserved for a snapshot
+// being saved and held while the command changes them. The script itself
+// holds the router's write barrier, as EVAL and FCALL are may_replicate.
+func (c scriptCaller) call(e *ScriptEngine, L *lua.LState, cmd string, args []string) lua.LValue {
+	s := e.store
+	if c.store != nil {
+		s = c.store
+	}
+	byteArgs := make([][]byte, len(args))
+	for i, a := range args {
+		byteArgs[i] = []byte(a)
+	}
+	def, ok := lookupCommand(strings.ToUpper(cmd))
+	isWrite := ok && def.HasFlag(FlagWrite)
+	if isWrite {
+		if keys := def.keys(byteArgs); len(keys) > 0 {
+			s.PreserveForSnapshot(keys)
+			defer s.BeginWrite(keys)()
+		}
+	}
+	result := e.executeCommand(L, s, cmd, args)
+	if result != nil && isWrite {
+		c.wrote(s, strings.ToUpper(cmd), byteArgs)
+	}
+	return result
+}
+
+// wrote propagates a write made by redis.call, so that a script reaches the
+// AOF as the commands it ran rather than as a script whose outcome may
+// depend on when it runs. The command goes through the rewrites of a
+// top-level write, against the store it ran on.
+func (c scriptCaller) wrote(s *store.Store, cmd string, args [][]byte) {
+	if c.propagate == nil {
+		return
+	}
+	call := &Context{Command: cmd, Args: args, Store: s}
+	for _, p := range call.propagated() {
+		c.propagate(p.name, p.args...)
+	}
+}
+
+// createState builds a script state whose redis.call traffic is checked and
+// reported to MONITOR on behalf of caller.
+func (e *ScriptEngine) createState(keys []string, args []string, caller scriptCaller) *lua.LState {
 	L := lua.NewState(lua.Options{
 		SkipOpenLibs: true,
 	})
@@ -87,7 +190,14 @@ func (e *ScriptEngine) CreateState(keys []string, args []string) *lua.LState {
 			}
 		}
 
-		result := e.executeCommand(L, cmd, cmdArgs)
+		if msg := caller.denied(cmd, cmdArgs); msg != "" {
+			L.Error(lua.LString(msg), 0)
+		}
+		feedMonitorsFromScript(caller.db, cmd, cmdArgs)
+		result := caller.call(e, L, cmd, cmdArgs)
+		if result == nil {
+			result = lua.LNil
+		}
 		L.Push(result)
 		return 1
 	}))
@@ -111,7 +221,17 @@ func (e *ScriptEngine) CreateState(keys []string, args []string) *lua.LState {
 			}
 		}()
 
-		result := e.executeCommand(L, cmd, cmdArgs)
+		if msg := caller.denied(cmd, cmdArgs); msg != "" {
+			tbl := L.NewTable()
+			L.SetField(tbl, "err", lua.LString(msg))
+			L.Push(tbl)
+			return 1
+		}
+		feedMonitorsFromScript(caller.db, cmd, cmdArgs)
+		result := caller.call(e, L, cmd, cmdArgs)
+		if result == nil {
+			result = lua.LNil
+		}
 		L.Push(result)
 		return 1
 	}))
@@ -158,13 +278,15 @@ func (e *ScriptEngine) CreateState(keys []string, args []string) *lua.LState {
 	return L
 }
 
-func (e *ScriptEngine) executeCommand(L *lua.LState, cmd string, args []string) lua.LValue {
+// executeCommand runs a redis.call command against s and returns its
+// result, or nil for a command scripts cannot run.
+func (e *ScriptEngine) executeCommand(L *lua.LState, s *store.Store, cmd string, args []string) lua.LValue {
 	switch cmd {
 	case "GET":
 		if len(args) < 1 {
 			return lua.LNil
 		}
-		entry, exists := e.store.Get(args[0])
+		entry, exists := s.Get(args[0])
 		if !exists {
 			return lua.LNil
 		}
@@ -177,14 +299,14 @@ func (e *ScriptEngine) executeCommand(L *lua.LState, cmd string, args []string)
 		if len(args) < 2 {
 			return lua.LNil
 		}
-		e.store.Set(args[0], &store.StringValue{Data: []byte(args[1])}, store.SetOptions{})
+		s.Set(args[0], &store.StringValue{Data: []byte(args[1])}, store.SetOptions{})
 		return lua.LString("OK")
 
 	case "DEL":
 		if len(args) < 1 {
 			return lua.LNumber(0)
 		}
-		deleted := e.store.Delete(args[0])
+		deleted := s.Delete(args[0])
 		if deleted {
 			return lua.LNumber(1)
 		}
@@ -194,7 +316,7 @@ func (e *ScriptEngine) executeCommand(L *lua.LState, cmd string, args []string)
 		if len(args) < 1 {
 			return lua.LNumber(0)
 		}
-		_, exists := e.store.Get(args[0])
+		_, exists := s.Get(args[0])
 		if exists {
 			return lua.LNumber(1)
 		}
@@ -204,16 +326,16 @@ func (e *ScriptEngine) executeCommand(L *lua.LState, cmd string, args []string)
 		if len(args) < 1 {
 			return lua.LNil
 		}
-		entry, exists := e.store.Get(args[0])
+		entry, exists := s.Get(args[0])
 		if !exists {
-			e.store.Set(args[0], &store.StringValue{Data: []byte("1")}, store.SetOptions{})
+			s.Set(args[0], &store.StringValue{Data: []byte("1")}, store.SetOptions{})
 			return lua.LNumber(1)
 		}
 		if sv, ok := entry.Value.(*store.StringValue); ok {
 			var val int
 			fmt.Sscanf(string(sv.Data), "%d", &val)
 			val++
-			e.store.Set(args[0], &store.StringValue{Data: []byte(fmt.Sprintf("%d", val))}, store.SetOptions{})
+			s.Set(args[0], &store.StringValue{Data: []byte(fmt.Sprintf("%d", val))}, store.SetOptions{})
 			return lua.LNumber(val)
 		}
 		return lua.LNil
@@ -222,16 +344,16 @@ func (e *ScriptEngine) executeCommand(L *lua.LState, cmd string, args []string)
 		if len(args) < 1 {
 			return lua.LNil
 		}
-		entry, exists := e.store.Get(args[0])
+		entry, exists := s.Get(args[0])
 		if !exists {
-			e.store.Set(args[0], &store.StringValue{Data: []byte("-1")}, store.SetOptions{})
+			s.Set(args[0], &store.StringValue{Data: []byte("-1")}, store.SetOptions{})
 			return lua.LNumber(-1)
 		}
 		if sv, ok := entry.Value.(*store.StringValue); ok {
 			var val int
 			fmt.Sscanf(string(sv.Data), "%d", &val)
 			val--
-			e.store.Set(args[0], &store.StringValue{Data: []byte(fmt.Sprintf("%d", val))}, store.SetOptions{})
+			s.Set(args[0], &store.StringValue{Data: []byte(fmt.Sprintf("%d", val))}, store.SetOptions{})
 			return lua.LNumber(val)
 		}
 		return lua.LNil
@@ -240,7 +362,7 @@ func (e *ScriptEngine) executeCommand(L *lua.LState, cmd string, args []string)
 		if len(args) < 2 {
 			return lua.LNil
 		}
-		entry, exists := e.store.Get(args[0])
+		entry, exists := s.Get(args[0])
 		if !exists {
 			return lua.LNil
 		}
@@ -255,11 +377,11 @@ func (e *ScriptEngine) executeCommand(L *lua.LState, cmd string, args []string)
 		if len(args) < 3 {
 			return lua.LNil
 		}
-		entry, exists := e.store.Get(args[0])
+		entry, exists := s.Get(args[0])
 		var hv *store.HashValue
 		if !exists {
 			hv = &store.HashValue{Fields: make(map[string][]byte)}
-			e.store.Set(args[0], hv, store.SetOptions{})
+			s.Set(args[0], hv, store.SetOptions{})
 		} else {
 			var ok bool
 			hv, ok = entry.Value.(*store.HashValue)
@@ -276,7 +398,7 @@ func (e *ScriptEngine) executeCommand(L *lua.LState, cmd string, args []string)
 		if len(args) < 1 {
 			return lua.LNil
 		}
-		entry, exists := e.store.Get(args[0])
+		entry, exists := s.Get(args[0])
 		if !exists {
 			return lua.LNil
 		}
@@ -294,11 +416,11 @@ func (e *ScriptEngine) executeCommand(L *lua.LState, cmd string, args []string)
 		if len(args) < 2 {
 			return lua.LNumber(0)
 		}
-		entry, exists := e.store.Get(args[0])
+		entry, exists := s.Get(args[0])
 		var lv *store.ListValue
 		if !exists {
 			lv = &store.ListValue{Elements: make([][]byte, 0)}
-			e.store.Set(args[0], lv, store.SetOptions{})
+			s.Set(args[0], lv, store.SetOptions{})
 		} else {
 			var ok bool
 			lv, ok = entry.Value.(*store.ListValue)
@@ -316,11 +438,11 @@ func (e *ScriptEngine) executeCommand(L *lua.LState, cmd string, args []string)
 		if len(args) < 2 {
 			return lua.LNumber(0)
 		}
-		entry, exists := e.store.Get(args[0])
+		entry, exists := s.Get(args[0])
 		var lv *store.ListValue
 		if !exists {
 			lv = &store.ListValue{Elements: make([][]byte, 0)}
-			e.store.Set(args[0], lv, store.SetOptions{})
+			s.Set(args[0], lv, store.SetOptions{})
 		} else {
 			var ok bool
 			lv, ok = entry.Value.(*store.ListValue)
@@ -338,7 +460,7 @@ func (e *ScriptEngine) executeCommand(L *lua.LState, cmd string, args []string)
 		if len(args) < 1 {
 			return lua.LNil
 		}
-		entry, exists := e.store.Get(args[0])
+		entry, exists := s.Get(args[0])
 		if !exists {
 			return lua.LNil
 		}
@@ -358,7 +480,7 @@ func (e *ScriptEngine) executeCommand(L *lua.LState, cmd string, args []string)
 		if len(args) < 1 {
 			return lua.LNil
 		}
-		entry, exists := e.store.Get(args[0])
+		entry, exists := s.Get(args[0])
 		if !exists {
 			return lua.LNil
 		}
@@ -378,11 +500,11 @@ func (e *ScriptEngine) executeCommand(L *lua.LState, cmd string, args []string)
 		if len(args) < 2 {
 			return lua.LNumber(0)
 		}
-		entry, exists := e.store.Get(args[0])
+		entry, exists := s.Get(args[0])
 		var sv *store.SetValue
 		if !exists {
 			sv = &store.SetValue{Members: make(map[string]struct{})}
-			e.store.Set(args[0], sv, store.SetOptions{})
+			s.Set(args[0], sv, store.SetOptions{})
 		} else {
 			var ok bool
 			sv, ok = entry.Value.(*store.SetValue)
@@ -403,7 +525,7 @@ func (e *ScriptEngine) executeCommand(L *lua.LState, cmd string, args []string)
 		if len(args) < 2 {
 			return lua.LNumber(0)
 		}
-		entry, exists := e.store.Get(args[0])
+		entry, exists := s.Get(args[0])
 		if !exists {
 			return lua.LNumber(0)
 		}
@@ -418,7 +540,7 @@ func (e *ScriptEngine) executeCommand(L *lua.LState, cmd string, args []string)
 		if len(args) < 1 {
 			return lua.LNumber(0)
 		}
-		entry, exists := e.store.Get(args[0])
+		entry, exists := s.Get(args[0])
 		if !exists {
 			return lua.LNumber(0)
 		}
@@ -431,7 +553,7 @@ func (e *ScriptEngine) executeCommand(L *lua.LState, cmd string, args []string)
 		if len(args) < 1 {
 			return lua.LString("none")
 		}
-		entry, exists := e.store.Get(args[0])
+		entry, exists := s.Get(args[0])
 		if !exists {
 			return lua.LString("none")
 		}
@@ -445,7 +567,7 @@ func (e *ScriptEngine) executeCommand(L *lua.LState, cmd string, args []string)
 		if err != nil {
 			return lua.LNumber(0)
 		}
-		if e.store.SetTTL(args[0], time.Duration(sec)*time.Second) {
+		if s.SetTTL(args[0], time.Duration(sec)*time.Second) {
 			return lua.LNumber(1)
 		}
 		return lua.LNumber(0)
@@ -454,7 +576,7 @@ func (e *ScriptEngine) executeCommand(L *lua.LState, cmd string, args []string)
 		if len(args) < 1 {
 			return lua.LNumber(-2)
 		}
-		ttl := e.store.TTL(args[0])
+		ttl := s.TTL(args[0])
 		if ttl < 0 {
 			return lua.LNumber(int64(ttl))
 		}
@@ -466,7 +588,7 @@ func (e *ScriptEngine) executeCommand(L *lua.LState, cmd string, args []string)
 		}
 		tbl := L.NewTable()
 		for _, key := range args {
-			entry, exists := e.store.Get(key)
+			entry, exists := s.Get(key)
 			if !exists {
 				tbl.Append(lua.LNil)
 			} else if sv, ok := entry.Value.(*store.StringValue); ok {
@@ -482,7 +604,7 @@ func (e *ScriptEngine) executeCommand(L *lua.LState, cmd string, args []string)
 			return lua.LString("OK")
 		}
 		for i := 0; i+1 < len(args); i += 2 {
-			e.store.Set(args[i], &store.StringValue{Data: []byte(args[i+1])}, store.SetOptions{})
+			s.Set(args[i], &store.StringValue{Data: []byte(args[i+1])}, store.SetOptions{})
 		}
 		return lua.LString("OK")
 
@@ -490,7 +612,7 @@ func (e *ScriptEngine) executeCommand(L *lua.LState, cmd string, args []string)
 		if len(args) < 2 {
 			return lua.LNumber(0)
 		}
-		entry, exists := e.store.Get(args[0])
+		entry, exists := s.Get(args[0])
 		if !exists {
 			return lua.LNumber(0)
 		}
@@ -505,7 +627,7 @@ func (e *ScriptEngine) executeCommand(L *lua.LState, cmd string, args []string)
 		if len(args) < 2 {
 			return lua.LNumber(0)
 		}
-		entry, exists := e.store.Get(args[0])
+		entry, exists := s.Get(args[0])
 		if !exists {
 			return lua.LNumber(0)
 		}
@@ -527,7 +649,7 @@ func (e *ScriptEngine) executeCommand(L *lua.LState, cmd string, args []string)
 		if len(args) < 1 {
 			return lua.LNumber(0)
 		}
-		entry, exists := e.store.Get(args[0])
+		entry, exists := s.Get(args[0])
 		if !exists {
 			return lua.LNumber(0)
 		}
@@ -540,7 +662,7 @@ func (e *ScriptEngine) executeCommand(L *lua.LState, cmd string, args []string)
 		if len(args) < 1 {
 			return lua.LNumber(0)
 		}
-		entry, exists := e.store.Get(args[0])
+		entry, exists := s.Get(args[0])
 		if !exists {
 			return lua.LNumber(0)
 		}
@@ -553,7 +675,7 @@ func (e *ScriptEngine) executeCommand(L *lua.LState, cmd string, args []string)
 		if len(args) < 3 {
 			return lua.LNil
 		}
-		entry, exists := e.store.Get(args[0])
+		entry, exists := s.Get(args[0])
 		if !exists {
 			return lua.LNil
 		}
@@ -594,11 +716,11 @@ func (e *ScriptEngine) executeCommand(L *lua.LState, cmd string, args []string)
 		if err != nil {
 			return lua.LNumber(0)
 		}
-		entry, exists := e.store.Get(args[0])
+		entry, exists := s.Get(args[0])
 		var zset *store.SortedSetValue
 		if !exists {
 			zset = &store.SortedSetValue{Members: make(map[string]float64)}
-			e.store.Set(args[0], zset, store.SetOptions{})
+			s.Set(args[0], zset, store.SetOptions{})
 		} else {
 			zset = entry.Value.(*store.SortedSetValue)
 		}
@@ -613,7 +735,7 @@ func (e *ScriptEngine) executeCommand(L *lua.LState, cmd string, args []string)
 		if len(args) < 2 {
 			return lua.LNil
 		}
-		entry, exists := e.store.Get(args[0])
+		entry, exists := s.Get(args[0])
 		if !exists {
 			return lua.LNil
 		}
@@ -628,7 +750,7 @@ func (e *ScriptEngine) executeCommand(L *lua.LState, cmd string, args []string)
 		if len(args) < 1 {
 			return lua.LNumber(0)
 		}
-		entry, exists := e.store.Get(args[0])
+		entry, exists := s.Get(args[0])
 		if !exists {
 			return lua.LNumber(0)
 		}
@@ -641,7 +763,7 @@ func (e *ScriptEngine) executeCommand(L *lua.LState, cmd string, args []string)
 		if len(args) < 2 {
 			return lua.LNumber(0)
 		}
-		entry, exists := e.store.Get(args[0])
+		entry, exists := s.Get(args[0])
 		if !exists {
 			return lua.LNumber(0)
 		}
@@ -654,17 +776,17 @@ func (e *ScriptEngine) executeCommand(L *lua.LState, cmd string, args []string)
 		return lua.LNumber(0)
 
 	case "DBSIZE":
-		return lua.LNumber(e.store.KeyCount())
+		return lua.LNumber(s.KeyCount())
 
 	case "FLUSHDB":
-		e.store.Flush()
+		s.Flush()
 		return lua.LString("OK")
 
 	case "ZRANGE":
 		if len(args) < 3 {
 			return lua.LNil
 		}
-		entry, exists := e.store.Get(args[0])
+		entry, exists := s.Get(args[0])
 		if !exists {
 			return L.NewTable()
 		}
@@ -687,7 +809,7 @@ func (e *ScriptEngine) executeCommand(L *lua.LState, cmd string, args []string)
 		if len(args) < 1 {
 			return L.NewTable()
 		}
-		entry, exists := e.store.Get(args[0])
+		entry, exists := s.Get(args[0])
 		if !exists {
 			return L.NewTable()
 		}
@@ -704,7 +826,7 @@ func (e *ScriptEngine) executeCommand(L *lua.LState, cmd string, args []string)
 		if len(args) < 1 {
 			return L.NewTable()
 		}
-		entry, exists := e.store.Get(args[0])
+		entry, exists := s.Get(args[0])
 		if !exists {
 			return L.NewTable()
 		}
@@ -721,7 +843,7 @@ func (e *ScriptEngine) executeCommand(L *lua.LState, cmd string, args []string)
 		if len(args) < 1 {
 			return L.NewTable()
 		}
-		entry, exists := e.store.Get(args[0])
+		entry, exists := s.Get(args[0])
 		if !exists {
 			return L.NewTable()
 		}
@@ -738,7 +860,7 @@ func (e *ScriptEngine) executeCommand(L *lua.LState, cmd string, args []string)
 		if len(args) < 2 {
 			return lua.LNumber(0)
 		}
-		entry, exists := e.store.Get(args[0])
+		entry, exists := s.Get(args[0])
 		if !exists {
 			return lua.LNumber(0)
 		}
@@ -758,7 +880,7 @@ func (e *ScriptEngine) executeCommand(L *lua.LState, cmd string, args []string)
 		if len(args) < 2 {
 			return lua.LNil
 		}
-		entry, exists := e.store.Get(args[0])
+		entry, exists := s.Get(args[0])
 		if !exists {
 			return lua.LNil
 		}
@@ -780,14 +902,14 @@ func (e *ScriptEngine) executeCommand(L *lua.LState, cmd string, args []string)
 		if len(args) < 2 {
 			return lua.LNumber(0)
 		}
-		entry, exists := e.store.Get(args[0])
+		entry, exists := s.Get(args[0])
 		if !exists {
-			e.store.Set(args[0], &store.StringValue{Data: []byte(args[1])}, store.SetOptions{})
+			s.Set(args[0], &store.StringValue{Data: []byte(args[1])}, store.SetOptions{})
 			return lua.LNumber(len(args[1]))
 		}
 		if sv, ok := entry.Value.(*store.StringValue); ok {
 			newData := append(sv.Data, []byte(args[1])...)
-			e.store.Set(args[0], &store.StringValue{Data: newData}, store.SetOptions{})
+			s.Set(args[0], &store.StringValue{Data: newData}, store.SetOptions{})
 			return lua.LNumber(len(newData))
 		}
 		return lua.LNumber(0)
@@ -796,7 +918,7 @@ func (e *ScriptEngine) executeCommand(L *lua.LState, cmd string, args []string)
 		if len(args) < 1 {
 			return lua.LNumber(0)
 		}
-		entry, exists := e.store.Get(args[0])
+		entry, exists := s.Get(args[0])
 		if !exists {
 			return lua.LNumber(0)
 		}
@@ -813,16 +935,16 @@ func (e *ScriptEngine) executeCommand(L *lua.LState, cmd string, args []string)
 		if err != nil {
 			return lua.LNil
 		}
-		entry, exists := e.store.Get(args[0])
+		entry, exists := s.Get(args[0])
 		if !exists {
-			e.store.Set(args[0], &store.StringValue{Data: []byte(args[1])}, store.SetOptions{})
+			s.Set(args[0], &store.StringValue{Data: []byte(args[1])}, store.SetOptions{})
 			return lua.LNumber(incr)
 		}
 		if sv, ok := entry.Value.(*store.StringValue); ok {
 			var val int64
 			fmt.Sscanf(string(sv.Data), "%d", &val)
 			val += incr
-			e.store.Set(args[0], &store.StringValue{Data: []byte(fmt.Sprintf("%d", val))}, store.SetOptions{})
+			s.Set(args[0], &store.StringValue{Data: []byte(fmt.Sprintf("%d", val))}, store.SetOptions{})
 			return lua.LNumber(val)
 		}
 		return lua.LNil
@@ -835,16 +957,16 @@ func (e *ScriptEngine) executeCommand(L *lua.LState, cmd string, args []string)
 		if err != nil {
 			return lua.LNil
 		}
-		entry, exists := e.store.Get(args[0])
+		entry, exists := s.Get(args[0])
 		if !exists {
-			e.store.Set(args[0], &store.StringValue{Data: []byte(fmt.Sprintf("%d", -decr))}, store.SetOptions{})
+			s.Set(args[0], &store.StringValue{Data: []byte(fmt.Sprintf("%d", -decr))}, store.SetOptions{})
 			return lua.LNumber(-decr)
 		}
 		if sv, ok := entry.Value.(*store.StringValue); ok {
 			var val int64
 			fmt.Sscanf(string(sv.Data), "%d", &val)
 			val -= decr
-			e.store.Set(args[0], &store.StringValue{Data: []byte(fmt.Sprintf("%d", val))}, store.SetOptions{})
+			s.Set(args[0], &store.StringValue{Data: []byte(fmt.Sprintf("%d", val))}, store.SetOptions{})
 			return lua.LNumber(val)
 		}
 		return lua.LNil
@@ -853,19 +975,19 @@ func (e *ScriptEngine) executeCommand(L *lua.LState, cmd string, args []string)
 		if len(args) < 2 {
 			return lua.LString("ERR")
 		}
-		entry, exists := e.store.Get(args[0])
+		entry, exists := s.Get(args[0])
 		if !exists {
 			return lua.LString("ERR no such key")
 		}
-		e.store.Delete(args[0])
-		e.store.SetEntry(args[1], entry)
+		s.Delete(args[0])
+		s.SetEntry(args[1], entry)
 		return lua.LString("OK")
 
 	case "PERSIST":
 		if len(args) < 1 {
 			return lua.LNumber(0)
 		}
-		if e.store.Persist(args[0]) {
+		if s.Persist(args[0]) {
 			return lua.LNumber(1)
 		}
 		return lua.LNumber(0)
@@ -874,14 +996,14 @@ func (e *ScriptEngine) executeCommand(L *lua.LState, cmd string, args []string)
 		if len(args) < 2 {
 			return lua.LNil
 		}
-		entry, exists := e.store.Get(args[0])
+		entry, exists := s.Get(args[0])
 		var oldVal []byte
 		if exists {
 			if sv, ok := entry.Value.(*store.StringValue); ok {
 				oldVal = sv.Data
 			}
 		}
-		e.store.Set(args[0], &store.StringValue{Data: []byte(args[1])}, store.SetOptions{})
+		s.Set(args[0], &store.StringValue{Data: []byte(args[1])}, store.SetOptions{})
 		if oldVal != nil {
 			return lua.LString(string(oldVal))
 		}
@@ -891,8 +1013,8 @@ func (e *ScriptEngine) executeCommand(L *lua.LState, cmd string, args []string)
 		if len(args) < 2 {
 			return lua.LNumber(0)
 		}
-		if _, exists := e.store.Get(args[0]); !exists {
-			e.store.Set(args[0], &store.StringValue{Data: []byte(args[1])}, store.SetOptions{})
+		if _, exists := s.Get(args[0]); !exists {
+			s.Set(args[0], &store.StringValue{Data: []byte(args[1])}, store.SetOptions{})
 			return lua.LNumber(1)
 		}
 		return lua.LNumber(0)
@@ -902,7 +1024,7 @@ func (e *ScriptEngine) executeCommand(L *lua.LState, cmd string, args []string)
 			return L.NewTable()
 		}
 		tbl := L.NewTable()
-		entry, exists := e.store.Get(args[0])
+		entry, exists := s.Get(args[0])
 		if !exists {
 			for i := 1; i < len(args); i++ {
 				tbl.Append(lua.LNil)
@@ -924,7 +1046,7 @@ func (e *ScriptEngine) executeCommand(L *lua.LState, cmd string, args []string)
 		if len(args) < 3 || len(args)%2 == 0 {
 			return lua.LString("ERR")
 		}
-		entry, exists := e.store.Get(args[0])
+		entry, exists := s.Get(args[0])
 		var hv *store.HashValue
 		if !exists {
 			hv = &store.HashValue{Fields: make(map[string][]byte)}
@@ -935,12 +1057,13 @@ func (e *ScriptEngine) executeCommand(L *lua.LState, cmd string, args []string)
 			hv.Fields[args[i]] = []byte(args[i+1])
 		}
 		if !exists {
-			e.store.Set(args[0], hv, store.SetOptions{})
+			s.Set(args[0], hv, store.SetOptions{})
 		}
 		return lua.LString("OK")
 
 	default:
-		return lua.LNil
+		// Not supported from scripts; the caller replies nil
+		return nil
 	}
 }
 
@@ -956,7 +1079,11 @@ func (e *ScriptEngine) WithState(keys []string, args []string, fn func(*lua.LSta
 }
 
 func (e *ScriptEngine) Eval(script string, keys []string, args []string) (interface{}, error) {
-	L := e.CreateState(keys, args)
+	return e.evalIn(scriptCaller{db: "0"}, script, keys, args)
+}
+
+func (e *ScriptEngine) evalIn(caller scriptCaller, script string, keys []string, args []string) (interface{}, error) {
+	L := e.createState(keys, args, caller)
 	defer L.Close()
 
 	// Enforce execution timeout to prevent infinite loops / DoS
@@ -968,6 +1095,11 @@ func (e *ScriptEngine) Eval(script string, keys []string, args []string) (interf
 		if ctx.Err() != nil {
 			return nil, fmt.Errorf("ERR script timeout exceeded %.0f seconds", luaScriptTimeout.Seconds())
 		}
+		// Reply with the error value alone; the traceback spans several
+		// lines, which an error reply cannot carry.
+		if apiErr, ok := err.(*lua.ApiError); ok && apiErr.Object != nil {
+			return nil, errors.New(apiErr.Object.String())
+		}
 		return nil, err
 	}
 
@@ -975,6 +1107,10 @@ func (e *ScriptEngine) Eval(script string, keys []string, args []string) (interf
 }
 
 func (e *ScriptEngine) EvalSHA(sha string, keys []string, args []string) (interface{}, error) {
+	return e.evalSHAIn(scriptCaller{db: "0"}, sha, keys, args)
+}
+
+func (e *ScriptEngine) evalSHAIn(caller scriptCaller, sha string, keys []string, args []string) (interface{}, error) {
 	e.mu.RLock()
 	script, exists := e.scripts[sha]
 	e.mu.RUnlock()
@@ -983,7 +1119,7 @@ func (e *ScriptEngine) EvalSHA(sha string, keys []string, args []string) (interf
 		return nil, fmt.Errorf("NOSCRIPT No matching script. Please use EVAL")
 	}
 
-	return e.Eval(script, keys, args)
+	return e.evalIn(caller, script, keys, args)
 }
 
 func (e *ScriptEngine) ScriptLoad(script string) string {
@@ -0,0 +1,245 @@
+package command
+
+import (
+	"sync"
+
+	"github.com/cachestorm/cachestorm/internal/graph"
+	"github.com/cachestorm/cachestorm/internal/persistence"
+	"github.com/cachestorm/cachestorm/internal/search"
+	"github.com/cachestorm/cachestorm/internal/store"
+)
+
+// Module state kept outside the keyspace is saved in snapshots under these
+// names, which are part of the file format and must never change. Maps that
+// only describe live connections or transactions are left out.
+func init() {
+	persistence.RegisterState(search.GetIndexManager())
+	persistence.RegisterState(graph.GetGraphManager())
+	persistence.RegisterState(tsManager)
+	persistence.RegisterState(store.GlobalWorkflowManager)
+	persistence.RegisterState(store.GlobalJobScheduler)
+
+	// The event queues and stacks have no lock of their own; snapshots
+	// already run while writes are paused.
+	eventMu := new(sync.Mutex)
+
+	for _, p := range []persistence.StateProvider{
+		// advanced_commands.go
+		persistence.MapState("actors", &actorsMu, &actors),
+		persistence.MapState("dags", &dagsMu, &dags),
+		persistence.MapState("secrets", &secretsMu, &secrets),
+		persistence.MapState("configs", &configsMu, &configs),
+		persistence.MapState("tries", &triesMu, &tries),
+		persistence.MapState("rings", &ringsMu, &rings),
+		persistence.MapState("semaphores", &semaphoresMu, &semaphores),
+		// advanced_commands2.go
+		persistence.MapState("filters", &filtersMu, &filters),
+		persistence.MapState("transforms", &transformsMu, &transforms),
+		persistence.MapState("enrichers", &enrichersMu, &enrichers),
+		persistence.MapState("validators", &validatorsMu, &validators),
+		persistence.MapState("jobsX", &jobsXMux, &jobsX),
+		persistence.MapState("stages", &stagesMu, &stages),
+		persistence.MapState("contexts", &contextsMu, &contexts),
+		persistence.MapState("rules", &rulesMu, &rules),
+		persistence.MapState("policies", &policiesMu, &policies),
+		persistence.MapState("permits", &permitsMu, &permits),
+		persistence.MapState("grants", &grantsMu, &grants),
+		persistence.MapState("chainsX", &chainsXMux, &chainsX),
+		persistence.MapState("tasksX", &tasksXMux, &tasksX),
+		persistence.MapState("timers", &timersMu, &timers),
+		persistence.MapState("countersX3", &countersX3Mu, &countersX3),
+		persistence.MapState("levels", &levelsMu, &levels),
+		persistence.MapState("records", &recordsMu, &records),
+		persistence.MapState("entities", &entitiesMu, &entities),
+		persistence.MapState("relations", &relationsMu, &relations),
+		persistence.MapState("connectionsX", &connectionsXMux, &connectionsX),
+		persistence.MapState("poolsX", &poolsXMux, &poolsX),
+		persistence.MapState("buffersX", &buffersXMux, &buffersX),
+		persistence.MapState("streamsX", &streamsXMux, &streamsX),
+		persistence.MapState("eventsX", &eventsXMux, &eventsX),
+		persistence.MapState("hooks", &hooksMu, &hooks),
+		persistence.MapState("middlewares", &middlewaresMu, &middlewares),
+		persistence.MapState("interceptors", &interceptorsMu, &interceptors),
+		persistence.MapState("guards", &guardsMu, &guards),
+		persistence.MapState("proxies", &proxiesMu, &proxies),
+		persistence.MapState("cachesX", &cachesXMux, &cachesX),
+		persistence.MapState("storesX", &storesXMux, &storesX),
+		persistence.MapState("indexes", &indexesMu, &indexes),
+		persistence.MapState("queries", &queriesMu, &queries),
+		persistence.MapState("views", &viewsMu, &views),
+		persistence.MapState("reports", &reportsMu, &reports),
+		persistence.MapState("auditsX", &auditsXMux, &auditsX),
+		persistence.MapState("tokens", &tokensMu, &tokens),
+		persistence.MapState("sessionsX", &sessionsXMux, &sessionsX),
+		persistence.MapState("profiles", &profilesMu, &profiles),
+		persistence.MapState("rolesX", &rolesXMux, &rolesX),
+		// ds_commands.go
+		persistence.MapState("priorityQueues", &priorityQueuesMu, &priorityQueues),
+		persistence.MapState("lruCaches", &lruCachesMu, &lruCaches),
+		persistence.MapState("tokenBuckets", &tokenBucketsMu, &tokenBuckets),
+		persistence.MapState("leakyBuckets", &leakyBucketsMu, &leakyBuckets),
+		persistence.MapState("slidingWindowCounters", &slidingWindowCountersMu, &slidingWindowCounters),
+		persistence.MapState("debounceTimers", &debounceMu, &debounceTimers),
+		persistence.MapState("debounceValues", &debounceMu, &debounceValues),
+		persistence.MapState("debounceDelay", &debounceMu, &debounceDelay),
+		persistence.MapState("throttleLastCall", &throttleMu, &throttleLastCall),
+		persistence.MapState("throttleInterval", &throttleMu, &throttleInterval),
+		// encoding_commands.go
+		persistence.MapState("pools", &poolsMu, &pools),
+		// event_commands.go
+		persistence.MapState("queues", eventMu, &queues),
+		persistence.MapState("stacks", eventMu, &stacks),
+		// extended_commands.go
+		persistence.MapState("msgQueues", &msgQueuesMu, &msgQueues),
+		persistence.MapState("services", &servicesMu, &services),
+		persistence.MapState("healthChecksX", &healthChecksXMux, &healthChecksX),
+		persistence.MapState("cronJobs", &cronJobsMu, &cronJobs),
+		persistence.MapState("vectorStores", &vectorStoresMu, &vectorStores),
+		persistence.MapState("docStores", &docStoresMu, &docStores),
+		persistence.MapState("topicSubs", &topicMu, &topicSubs),
+		persistence.MapState("topicHist", &topicMu, &topicHist),
+		persistence.MapState("leaders", &leadersMu, &leaders),
+		persistence.MapState("memoCache", &memoMu, &memoCache),
+		persistence.MapState("memoStats", &memoMu, &memoStats),
+		persistence.MapState("sentinelsX", &sentinelsXMux, &sentinelsX),
+		persistence.MapState("replays", &replaysMu, &replays),
+		persistence.MapState("aggData", &aggDataMu, &aggData),
+		// extra_commands.go
+		persistence.MapState("swimMembers", &swimMembersMu, &swimMembers),
+		persistence.MapState("gossipMembers", &gossipMu, &gossipMembers),
+		persistence.MapState("gossipData", &gossipMu, &gossipData),
+		persistence.MapState("antiEntropy", &antiEntropyMu, &antiEntropy),
+		persistence.MapState("vectorClocks", &vectorClocksMu, &vectorClocks),
+		persistence.MapState("crdtLWW", &crdtLWWMu, &crdtLWW),
+		persistence.MapState("crdtGCounter", &crdtGCounterMu, &crdtGCounter),
+		persistence.MapState("crdtPNCounter", &crdtPNCounterMu, &crdtPNCounter),
+		persistence.MapState("crdtGSet", &crdtGSetMu, &crdtGSet),
+		persistence.MapState("crdtORSet", &crdtORSetMu, &crdtORSet),
+		persistence.MapState("merkleTrees", &merkleTreesMu, &merkleTrees),
+		persistence.MapState("raftState", &raftStateMu, &raftState),
+		persistence.MapState("shards", &shardsMu, &shards),
+		persistence.MapState("dedupSet", &dedupSetMu, &dedupSet),
+		persistence.MapState("batches", &batchesMu, &batches),
+		persistence.MapState("deadlines", &deadlinesMu, &deadlines),
+		persistence.MapState("gateways", &gatewaysMu, &gateways),
+		persistence.MapState("thresholds", &thresholdsMu, &thresholds),
+		persistence.MapState("switches", &switchesMu, &switches),
+		persistence.MapState("bookmarks", &bookmarksMu, &bookmarks),
+		persistence.MapState("replaysX", &replaysXMux, &replaysX),
+		persistence.MapState("routes", &routesMu, &routes),
+		persistence.MapState("ghosts", &ghostsMu, &ghosts),
+		persistence.MapState("probes", &probesMu, &probes),
+		persistence.MapState("canaries", &canariesMu, &canaries),
+		persistence.MapState("rageTests", &rageTestsMu, &rageTests),
+		persistence.MapState("grids", &gridsMu, &grids),
+		persistence.MapState("tapes", &tapesMu, &tapes),
+		persistence.MapState("slices", &slicesMu, &slices),
+		persistence.MapState("rollupsX", &rollupsXMux, &rollupsX),
+		persistence.MapState("beacons", &beaconsMu, &beacons),
+		// integration_commands.go
+		persistence.MapState("circuitBreakersExt", &circuitBreakersExtMu, &circuitBreakersExt),
+		persistence.MapState("rateLimiters", &rateLimitersMu, &rateLimiters),
+		persistence.MapState("cacheLocks", &cacheLocksMu, &cacheLocks),
+		persistence.MapState("arrays", &arraysMu, &arrays),
+		persistence.MapState("objects", &objectsMu, &objects),
+		persistence.MapState("captchas", &captchasMu, &captchas),
+		persistence.MapState("sequences", &sequencesMu, &sequences),
+		// ml_commands.go
+		persistence.MapState("mlModels", &mlModelsMx, &mlModels),
+		persistence.MapState("features", &featuresMx, &features),
+		persistence.MapState("embeddings", &embeddingsMx, &embeddings),
+		persistence.MapState("tensors", &tensorsMx, &tensors),
+		persistence.MapState("classifiers", &classifiersMx, &classifiers),
+		persistence.MapState("regressors", &regressorsMx, &regressors),
+		persistence.MapState("clusterMLs", &clusterMLsMx, &clusterMLs),
+		persistence.MapState("anomalyDetectors", &anomalyDetectorsMx, &anomalyDetectors),
+		persistence.MapState("datasets", &datasetsMx, &datasets),
+		persistence.MapState("mlExperiments", &mlExperimentsMx, &mlExperiments),
+		persistence.MapState("mlPipelines", &mlPipelinesMx, &mlPipelines),
+		persistence.MapState("hyperparams", &hyperparamsMx, &hyperparams),
+		persistence.MapState("evaluators", &evaluatorsMx, &evaluators),
+		persistence.MapState("recommenders", &recommendersMx, &recommenders),
+		persistence.MapState("timeForecasters", &timeForecastersMx, &timeForecasters),
+		// more_commands.go
+		persistence.MapState("slidingWindows", &slidingWindowsMu, &slidingWindows),
+		persistence.MapState("bucketsX", &bucketsXMux, &bucketsX),
+		persistence.MapState("idempotencyKeys", &idempotencyKeysMu, &idempotencyKeys),
+		persistence.MapState("experiments", &experimentsMu, &experiments),
+		persistence.MapState("rollouts", &rolloutsMu, &rollouts),
+		persistence.MapState("schemas", &schemasMu, &schemas),
+		persistence.MapState("pipelines", &pipelinesMu, &pipelines),
+		persistence.MapState("notifications", &notificationsMu, &notifications),
+		persistence.MapState("alerts", &alertsMu, &alerts),
+		persistence.MapState("countersX", &countersXMux, &countersX),
+		persistence.MapState("gauges", &gaugesMu, &gauges),
+		persistence.MapState("traces", &tracesMu, &traces),
+		persistence.MapState("logsX", &logsXMux, &logsX),
+		persistence.MapState("apiKeys", &apiKeysMu, &apiKeys),
+		persistence.MapState("quotasX", &quotasXMux, &quotasX),
+		persistence.MapState("meters", &metersMu, &meters),
+		persistence.MapState("tenants", &tenantsMu, &tenants),
+		persistence.MapState("leases", &leasesMu, &leases),
+		persistence.MapState("heaps", &heapsMu, &heaps),
+		persistence.MapState("bloomX", &bloomXMux, &bloomX),
+		persistence.MapState("sketches", &sketchesMu, &sketches),
+		persistence.MapState("ringBuffers", &ringBuffersMu, &ringBuffers),
+		persistence.MapState("windows", &windowsMu, &windows),
+		persistence.MapState("freqs", &freqsMu, &freqs),
+		persistence.MapState("partitions", &partitionsMu, &partitions),
+		// mvcc_commands.go
+		persistence.MapState("spatialIndexes", &spatialIndexesMu, &spatialIndexes),
+		persistence.MapState("chains", &chainsMu, &chains),
+		persistence.MapState("analytics", &analyticsMu, &analytics),
+		persistence.MapState("plugins", &pluginsMu, &plugins),
+		persistence.MapState("rollups", &rollupsMu, &rollups),
+		persistence.MapState("cooldowns", &cooldownsMu, &cooldowns),
+		persistence.MapState("quotas", &quotasMu, &quotas),
+		// probabilistic_commands.go
+		persistence.MapState("bloomFilters", &probabilisticMu, &bloomFilters),
+		persistence.MapState("countMinSketch", &probabilisticMu, &countMinSketch),
+		persistence.MapState("topK", &probabilisticMu, &topK),
+		persistence.MapState("cuckooFilters", &probabilisticMu, &cuckooFilters),
+		// resilience_commands.go
+		persistence.MapState("circuits", &circuitsMu, &circuits),
+		persistence.MapState("rateLimitersX", &rateLimitersXMux, &rateLimitersX),
+		persistence.MapState("retries", &retriesMu, &retries),
+		persistence.MapState("timeouts", &timeoutsMu, &timeouts),
+		persistence.MapState("bulkheads", &bulkheadsMu, &bulkheads),
+		persistence.MapState("fallbacks", &fallbacksMu, &fallbacks),
+		persistence.MapState("telemetry", &telemetryMu, &telemetry),
+		persistence.MapState("diagnostics", &diagnosticsMu, &diagnostics),
+		persistence.MapState("profilesX2", &profilesX2Mu, &profilesX2),
+		persistence.MapState("memoryAllocs", &memoryMu, &memoryAllocs),
+		persistence.MapState("memoryStats", &memoryMu, &memoryStats),
+		persistence.MapState("conPools", &conPoolsMu, &conPools),
+		persistence.MapState("batchesX", &batchesXMux, &batchesX),
+		persistence.MapState("pipelinesX", &pipelinesXMux, &pipelinesX),
+		persistence.MapState("transactionsX", &transactionsXMux, &transactionsX),
+		persistence.MapState("locksX", &locksXMux, &locksX),
+		persistence.MapState("semaphoresX", &semaphoresXMux, &semaphoresX),
+		persistence.MapState("asyncJobs", &asyncJobsMu, &asyncJobs),
+		persistence.MapState("promises", &promisesMu, &promises),
+		persistence.MapState("futures", &futuresMu, &futures),
+		persistence.MapState("observables", &observablesMu, &observables),
+		persistence.MapState("streamProcs", &streamProcsMu, &streamProcs),
+		persistence.MapState("eventSourcing", &eventSourcingMu, &eventSourcing),
+		persistence.MapState("backpressures", &backpressuresMu, &backpressures),
+		persistence.MapState("throttlesX", &throttlesXMux, &throttlesX),
+		persistence.MapState("debouncesX", &debouncesXMux, &debouncesX),
+		persistence.MapState("coalesces", &coalescesMu, &coalesces),
+		persistence.MapState("aggregators", &aggregatorsMu, &aggregators),
+		persistence.MapState("windowsX", &windowsXMux, &windowsX),
+		persistence.MapState("joinsX", &joinsXMux, &joinsX),
+		persistence.MapState("shuffles", &shufflesMu, &shuffles),
+		persistence.MapState("partitionsX", &partitionsXMux, &partitionsX),
+		// stats_commands.go
+		persistence.MapState("tdigests", &tdigestsMu, &tdigests),
+		persistence.MapState("samplers", &samplersMu, &samplers),
+		persistence.MapState("histograms", &histogramsMu, &histograms),
+		// workflow_commands.go
+		persistence.MapState("chainedData", &chainedDataMu, &chainedData),
+		persistence.MapState("reactiveWatchers", &reactiveWatchersMu, &reactiveWatchers),
+	} {
+		persistence.RegisterState(p)
+	}
+}
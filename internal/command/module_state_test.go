@@ -0,0 +1,113 @@
+package command
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cachestorm/cachestorm/internal/graph"
+	"github.com/cachestorm/cachestorm/internal/persistence"
+	"github.com/cachestorm/cachestorm/internal/search"
+	"github.com/cachestorm/cachestorm/internal/store"
+)
+
+func TestModuleStateSurvivesSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	full := filepath.Join(dir, "full.rdb")
+	empty := filepath.Join(dir, "empty.rdb")
+	if err := persistence.NewRDBWriter(store.NewStore(), persistence.RDBConfig{}).Save(empty); err != nil {
+		t.Fatal(err)
+	}
+	// Leave the package state as empty as the other tests expect it.
+	t.Cleanup(func() { _ = persistence.NewRDBReader(store.NewStore()).Load(empty) })
+
+	_ = search.GetIndexManager().CreateIndex("idx", search.Schema{Fields: []search.FieldSchema{{Name: "title", Type: "TEXT"}}})
+	idx, _ := search.GetIndexManager().GetIndex("idx")
+	_ = idx.AddDocument(&search.Document{ID: "doc1", Fields: map[string]string{"title": "hello world"}})
+
+	g := graph.GetGraphManager().Create("social")
+	a := g.AddNode("person", map[string]interface{}{"name": "alice"})
+	b := g.AddNode("person", map[string]interface{}{"name": "bob"})
+	if _, err := g.AddEdge(a.ID, b.ID, "knows", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = tsManager.Create("temp", time.Hour, map[string]string{"room": "kitchen"})
+	ts, _ := tsManager.Get("temp")
+	ts.Add(0, 21.5)
+
+	store.GlobalWorkflowManager.Create("wf", "deploy", []store.WorkflowStep{{ID: "s1", Command: "PING"}})
+	store.GlobalJobScheduler.Create("job", "nightly", "PING", time.Minute)
+
+	msgQueuesMu.Lock()
+	msgQueues["q"] = &MessageQueue{Name: "q", Messages: []*QueuedMessage{{ID: "m1", Body: "payload"}}, AckWait: map[string]*QueuedMessage{}, MaxRetries: 3}
+	msgQueuesMu.Unlock()
+
+	probabilisticMu.Lock()
+	bloomFilters["bf"] = store.NewBloomFilter(1000, 0.01)
+	bloomFilters["bf"].Add([]byte("seen"))
+	probabilisticMu.Unlock()
+
+	lruCachesMu.Lock()
+	lruCaches["lru"] = store.NewLRUCache(2)
+	lruCaches["lru"].Set("a", "1")
+	lruCaches["lru"].Set("b", "2")
+	lruCachesMu.Unlock()
+
+	if err := persistence.NewRDBWriter(store.NewStore(), persistence.RDBConfig{}).Save(full); err != nil {
+		t.Fatal(err)
+	}
+	if err := persistence.NewRDBReader(store.NewStore()).Load(empty); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := search.GetIndexManager().GetIndex("idx"); ok {
+		t.Fatal("loading a snapshot without module state kept the search index")
+	}
+	if err := persistence.NewRDBReader(store.NewStore()).Load(full); err != nil {
+		t.Fatal(err)
+	}
+
+	idx, ok := search.GetIndexManager().GetIndex("idx")
+	if !ok {
+		t.Fatal("search index lost")
+	}
+	if res := idx.Search("hello", 10, 0); res.Total != 1 {
+		t.Errorf("search after load found %d documents, want 1", res.Total)
+	}
+
+	g, ok = graph.GetGraphManager().Get("social")
+	if !ok || len(g.Nodes) != 2 || len(g.Edges) != 1 {
+		t.Fatalf("graph after load = %+v", g)
+	}
+	if c := g.AddNode("person", nil); c.ID != 3 {
+		t.Errorf("node added after load got ID %d, want 3", c.ID)
+	}
+
+	if ts, ok := tsManager.Get("temp"); !ok || len(ts.Samples) != 1 || ts.Retention != time.Hour {
+		t.Errorf("time series after load = %+v", ts)
+	}
+	if keys := tsManager.QueryByLabels(map[string]string{"room": "kitchen"}, ""); len(keys) != 1 {
+		t.Errorf("label index after load = %v", keys)
+	}
+	if _, ok := store.GlobalWorkflowManager.Get("wf"); !ok {
+		t.Error("workflow lost")
+	}
+	if _, ok := store.GlobalJobScheduler.Get("job"); !ok {
+		t.Error("job lost")
+	}
+
+	if q := msgQueues["q"]; q == nil || len(q.Messages) != 1 || q.Messages[0].Body != "payload" {
+		t.Errorf("message queue after load = %+v", q)
+	}
+	if bf := bloomFilters["bf"]; bf == nil || !bf.Exists([]byte("seen")) {
+		t.Error("bloom filter lost its items")
+	}
+	lru := lruCaches["lru"]
+	if v, ok := lru.Get("a"); !ok || v != "1" {
+		t.Errorf("LRU get a = %q, %v", v, ok)
+	}
+	lru.Set("c", "3")
+	if _, ok := lru.Get("b"); ok {
+		t.Error("LRU order not kept: b should have been evicted")
+	}
+}
@@ -0,0 +1,220 @@
+package command
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cachestorm/cachestorm/internal/resp"
+	"github.com/cachestorm/cachestorm/internal/store"
+)
+
+// MONITOR streams every executed command to the connections that asked for
+// it, one status line per command:
+//
+//	+1700000000.123456 [0 127.0.0.1:50312] "set" "user:1" "alice"
+//
+// The bracket holds the database (or namespace name) and the client address,
+// or "lua" for commands issued by scripts. Credentials are redacted.
+
+const redactedArg = "(redacted)"
+
+var globalMonitors = struct {
+	mu       sync.RWMutex
+	sessions map[int64]*Session
+	count    atomic.Int32 // checked first so the hot path costs one load
+}{
+	sessions: make(map[int64]*Session),
+}
+
+func startMonitor(sess *Session) {
+	globalMonitors.mu.Lock()
+	defer globalMonitors.mu.Unlock()
+	if _, ok := globalMonitors.sessions[sess.ID()]; ok {
+		return
+	}
+	globalMonitors.sessions[sess.ID()] = sess
+	globalMonitors.count.Add(1)
+	sess.setMonitor(true)
+}
+
+func stopMonitor(sess *Session) {
+	globalMonitors.mu.Lock()
+	defer globalMonitors.mu.Unlock()
+	if globalMonitors.sessions[sess.ID()] != sess {
+		return
+	}
+	delete(globalMonitors.sessions, sess.ID())
+	globalMonitors.count.Add(-1)
+	sess.setMonitor(false)
+}
+
+// feedMonitors reports a command about to run on behalf of a client.
+func feedMonitors(ctx *Context) {
+	if globalMonitors.count.Load() == 0 || ctx.Command == "MONITOR" {
+		return
+	}
+	db, addr := "0", ctx.RemoteAddr
+	if ctx.Session != nil {
+		db, addr = monitorDB(ctx.Session), ctx.Session.RemoteAddr()
+	}
+	broadcastMonitorLine(ctx.Session, db, addr, ctx.Command, ctx.Args)
+}
+
+// feedMonitorsFromScript reports a command issued by redis.call inside a
+// script running against db.
+func feedMonitorsFromScript(db, cmd string, args []string) {
+	if globalMonitors.count.Load() == 0 {
+		return
+	}
+	byteArgs := make([][]byte, len(args))
+	for i, a := range args {
+		byteArgs[i] = []byte(a)
+	}
+	broadcastMonitorLine(nil, db, "lua", strings.ToUpper(cmd), byteArgs)
+}
+
+// broadcastMonitorLine sends a line to every monitor except origin: a
+// monitor's own commands would race with their replies on its connection.
+func broadcastMonitorLine(origin *Session, db, addr, cmd string, args [][]byte) {
+	line := formatMonitorLine(time.Now(), db, addr, cmd, redactArgs(cmd, args))
+
+	globalMonitors.mu.RLock()
+	defer globalMonitors.mu.RUnlock()
+	for _, sess := range globalMonitors.sessions {
+		if sess == origin {
+			continue
+		}
+		sess.Push(resp.SimpleString(line))
+	}
+}
+
+func monitorDB(sess *Session) string {
+	db := sess.DB()
+	if ns := sess.Namespace(); ns != store.DBNamespace(db) {
+		return ns
+	}
+	return strconv.Itoa(db)
+}
+
+func formatMonitorLine(now time.Time, db, addr, cmd string, args [][]byte) string {
+	var sb strings.Builder
+	sb.WriteString(strconv.FormatInt(now.Unix(), 10))
+	sb.WriteByte('.')
+	usec := strconv.Itoa(now.Nanosecond() / 1000)
+	sb.WriteString(strings.Repeat("0", 6-len(usec)))
+	sb.WriteString(usec)
+	sb.WriteString(" [")
+	sb.WriteString(db)
+	sb.WriteByte(' ')
+	sb.WriteString(addr)
+	sb.WriteString("] ")
+	writeQuotedArg(&sb, []byte(strings.ToLower(cmd)))
+	for _, arg := range args {
+		sb.WriteByte(' ')
+		writeQuotedArg(&sb, arg)
+	}
+	return sb.String()
+}
+
+// writeQuotedArg writes arg in double quotes with the escapes redis-cli
+// understands, so binary values cannot break the line.
+func writeQuotedArg(sb *strings.Builder, arg []byte) {
+	sb.WriteByte('"')
+	for _, c := range arg {
+		switch c {
+		case '\\', '"':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case '\n':
+			sb.WriteString(`\n`)
+		case '\r':
+			sb.WriteString(`\r`)
+		case '\t':
+			sb.WriteString(`\t`)
+		case '\a':
+			sb.WriteString(`\a`)
+		case '\b':
+			sb.WriteString(`\b`)
+		default:
+			if c < 0x20 || c >= 0x7f {
+				sb.WriteString(`\x`)
+				sb.WriteString(strconv.FormatInt(int64(c)>>4, 16))
+				sb.WriteString(strconv.FormatInt(int64(c)&0xf, 16))
+			} else {
+				sb.WriteByte(c)
+			}
+		}
+	}
+	sb.WriteByte('"')
+}
+
+// redactArgs hides passwords from monitors: every AUTH argument, the
+// credentials of HELLO ... AUTH and MIGRATE ... AUTH/AUTH2, password rules
+// of ACL SETUSER and the value of CONFIG SET for secret parameters.
+func redactArgs(cmd string, args [][]byte) [][]byte {
+	redacted, copied := args, false
+	redact := func(i int) {
+		if i >= len(args) {
+			return
+		}
+		if !copied {
+			redacted, copied = append([][]byte(nil), args...), true
+		}
+		redacted[i] = []byte(redactedArg)
+	}
+
+	switch cmd {
+	case "AUTH":
+		for i := range args {
+			redact(i)
+		}
+	case "HELLO":
+		for i := 1; i < len(args); i++ {
+			if strings.EqualFold(string(args[i]), "AUTH") {
+				redact(i + 1)
+				redact(i + 2)
+				i += 2
+			}
+		}
+	case "MIGRATE":
+		for i := 5; i < len(args); i++ {
+			switch strings.ToUpper(string(args[i])) {
+			case "AUTH":
+				redact(i + 1)
+				i++
+			case "AUTH2":
+				redact(i + 1)
+				redact(i + 2)
+				i += 2
+			}
+		}
+	case "ACL":
+		if len(args) > 2 && strings.EqualFold(string(args[0]), "SETUSER") {
+			for i := 2; i < len(args); i++ {
+				if len(args[i]) > 0 && strings.IndexByte("><#!", args[i][0]) >= 0 {
+					redact(i)
+				}
+			}
+		}
+	case "CONFIG":
+		if len(args) > 2 && strings.EqualFold(string(args[0]), "SET") {
+			for i := 1; i+1 < len(args); i += 2 {
+				switch strings.ToLower(string(args[i])) {
+				case "requirepass", "masterauth", "masteruser":
+					redact(i + 1)
+				}
+			}
+		}
+	}
+	return redacted
+}
+
+func cmdMONITOR(ctx *Context) error {
+	if ctx.Session != nil {
+		startMonitor(ctx.Session)
+	}
+	return ctx.WriteOK()
+}
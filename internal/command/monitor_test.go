@@ -0,0 +1,52 @@
+package command
+
+import (
+	"testing"
+	"time"
+)
+
+func toArgs(args ...string) [][]byte {
+	out := make([][]byte, len(args))
+	for i, a := range args {
+		out[i] = []byte(a)
+	}
+	return out
+}
+
+func TestFormatMonitorLine(t *testing.T) {
+	now := time.Unix(1700000000, 42000)
+	got := formatMonitorLine(now, "0", "127.0.0.1:50312", "SET", toArgs("k", "a\"b\\c\r\n\x01"))
+	want := `1700000000.000042 [0 127.0.0.1:50312] "set" "k" "a\"b\\c\r\n\x01"`
+	if got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+}
+
+func TestRedactArgs(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		args []string
+		want []string
+	}{
+		{"AUTH", []string{"user", "pass"}, []string{redactedArg, redactedArg}},
+		{"HELLO", []string{"3", "AUTH", "user", "pass", "SETNAME", "x"}, []string{"3", "AUTH", redactedArg, redactedArg, "SETNAME", "x"}},
+		{"MIGRATE", []string{"h", "6379", "k", "0", "100", "AUTH2", "u", "p"}, []string{"h", "6379", "k", "0", "100", "AUTH2", redactedArg, redactedArg}},
+		{"ACL", []string{"SETUSER", "alice", "on", ">pw", "~*"}, []string{"SETUSER", "alice", "on", redactedArg, "~*"}},
+		{"CONFIG", []string{"SET", "maxmemory", "1mb", "requirepass", "pw"}, []string{"SET", "maxmemory", "1mb", "requirepass", redactedArg}},
+		{"SET", []string{"requirepass", "pw"}, []string{"requirepass", "pw"}},
+	}
+	for _, tt := range tests {
+		args := toArgs(tt.args...)
+		got := redactArgs(tt.cmd, args)
+		for i, w := range tt.want {
+			if string(got[i]) != w {
+				t.Errorf("%s %v: arg %d expected %q, got %q", tt.cmd, tt.args, i, w, got[i])
+			}
+		}
+		for i, a := range tt.args {
+			if string(args[i]) != a {
+				t.Errorf("%s: redaction modified the caller's arguments", tt.cmd)
+			}
+		}
+	}
+}
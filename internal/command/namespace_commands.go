@@ -1,6 +1,7 @@
 package command
 
 import (
+	"errors"
 	"fmt"
 	"strconv"
 	"strings"
@@ -8,6 +9,8 @@ import (
 	"github.com/cachestorm/cachestorm/internal/resp"
 )
 
+var ErrDBIndexOutOfRange = errors.New("ERR DB index is out of range")
+
 func RegisterNamespaceCommands(router *Router) {
 	router.Register(&CommandDef{Name: "NAMESPACE", Handler: cmdNAMESPACE})
 	router.Register(&CommandDef{Name: "NAMESPACES", Handler: cmdNAMESPACES})
@@ -21,7 +24,14 @@ func cmdNAMESPACE(ctx *Context) error {
 		return ctx.WriteError(ErrWrongArgCount)
 	}
 
-	_ = ctx.ArgString(0)
+	name := ctx.ArgString(0)
+	if name == "" {
+		return ctx.WriteError(ErrInvalidArg)
+	}
+
+	if ctx.Session != nil {
+		ctx.Session.SelectNamespace(name)
+	}
 
 	ctx.WriteOK()
 	return nil
@@ -101,6 +111,15 @@ func cmdSELECT(ctx *Context) error {
 	if err != nil {
 		return ctx.WriteError(ErrNotInteger)
 	}
+	if index < 0 {
+		return ctx.WriteError(ErrDBIndexOutOfRange)
+	}
+
+	// The keyspace is resolved from the session on the next command
+	if ctx.Session != nil {
+		ctx.Session.SelectDB(index)
+		return ctx.WriteOK()
+	}
 
 	nm := ctx.Store.GetNamespaceManager()
 	if nm != nil {
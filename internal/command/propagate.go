@@ -0,0 +1,159 @@
+package command
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Writes reach the AOF through the router's post-execute hook, in a form
+// that replays to the same dataset. Most are passed on as they were called.
+// Relative expirations (EXPIRE, SETEX, SET EX, GETEX PX, ...) are rewritten
+// to the absolute time read back from the key, so replaying them does not
+// push the TTL out again. Commands whose outcome is random or depends on
+// when they ran (SPOP, INCRBYFLOAT, blocking pops, scripts) have their
+// handlers record the writes they made instead, through ctx.propagate.
+
+// propagatedCommand is a command as sent to the AOF.
+type propagatedCommand struct {
+	name string
+	args [][]byte
+}
+
+// propagate records a command to send in place of the one being run, which
+// is then not sent itself. Further calls add commands, in order.
+func (ctx *Context) propagate(name string, args ...[]byte) {
+	ctx.rewritten = true
+	ctx.effects = append(ctx.effects, propagatedCommand{name: name, args: args})
+}
+
+// propagateNothing records that the running command changed nothing, so
+// nothing is sent for it.
+func (ctx *Context) propagateNothing() {
+	ctx.rewritten = true
+}
+
+// propagated returns the commands to send for the command just run: the
+// ones its handler recorded, or the command itself with relative
+// expirations made absolute. A command that replied with an error sends
+// nothing unless its handler recorded writes.
+func (ctx *Context) propagated() []propagatedCommand {
+	if ctx.rewritten {
+		return ctx.effects
+	}
+	if ctx.replyFailed {
+		return nil
+	}
+	if rewrite, ok := expiryRewrites[ctx.Command]; ok && len(ctx.Args) > 0 {
+		return rewrite(ctx)
+	}
+	return []propagatedCommand{{name: ctx.Command, args: ctx.Args}}
+}
+
+// expiryRewrites turn commands that set a TTL relative to now into ones
+// carrying the absolute expiry the key ended up with.
+var expiryRewrites = map[string]func(ctx *Context) []propagatedCommand{
+	"EXPIRE":  propagateExpiry,
+	"PEXPIRE": propagateExpiry,
+	"GETEX":   propagateExpiry,
+	"HGETEX":  propagateExpiry,
+	"SETEX":   propagateSetWithExpiry,
+	"PSETEX":  propagateSetWithExpiry,
+	"SET":     propagateSetWithExpiry,
+	"RESTORE": propagateRestore,
+}
+
+// keyExpiry returns the expiry of key in milliseconds since the epoch, 0
+// for a key without one, and whether the key exists.
+func (ctx *Context) keyExpiry(key string) (int64, bool) {
+	entry, ok := ctx.Store.Get(key)
+	if !ok {
+		return 0, false
+	}
+	return entry.ExpiresAt / int64(time.Millisecond), true
+}
+
+func pexpireat(key []byte, ms int64) propagatedCommand {
+	return propagatedCommand{name: "PEXPIREAT", args: [][]byte{key, []byte(strconv.FormatInt(ms, 10))}}
+}
+
+// propagateExpiry sends the TTL EXPIRE, PEXPIRE, GETEX or HGETEX left on the
+// key. A key that expired on the spot is deleted; GETEX and HGETEX without
+// an expiry option send nothing.
+func propagateExpiry(ctx *Context) []propagatedCommand {
+	key := ctx.Args[0]
+	if ctx.Command == "GETEX" || ctx.Command == "HGETEX" {
+		if !hasExpiryOption(ctx.Args[1:]) {
+			return nil
+		}
+	}
+	ms, ok := ctx.keyExpiry(string(key))
+	switch {
+	case !ok:
+		return []propagatedCommand{{name: "DEL", args: [][]byte{key}}}
+	case ms == 0:
+		return []propagatedCommand{{name: "PERSIST", args: [][]byte{key}}}
+	}
+	return []propagatedCommand{pexpireat(key, ms)}
+}
+
+func hasExpiryOption(args [][]byte) bool {
+	for _, arg := range args {
+		switch strings.ToUpper(string(arg)) {
+		case "EX", "PX", "EXAT", "PXAT", "PERSIST":
+			return true
+		}
+	}
+	return false
+}
+
+// propagateSetWithExpiry sends SETEX, PSETEX and SET EX|PX as a SET with
+// PXAT. SET without a relative expiry is sent as it was called.
+func propagateSetWithExpiry(ctx *Context) []propagatedCommand {
+	if len(ctx.Args) < 2 {
+		return nil
+	}
+	key, value := ctx.Args[0], ctx.Args[1]
+	var options [][]byte
+	switch ctx.Command {
+	case "SETEX", "PSETEX":
+		if len(ctx.Args) != 3 {
+			return nil
+		}
+		value = ctx.Args[2]
+	default:
+		relative := false
+		for i := 2; i < len(ctx.Args); i++ {
+			switch strings.ToUpper(string(ctx.Args[i])) {
+			case "EX", "PX":
+				relative = true
+				i++
+			default:
+				options = append(options, ctx.Args[i])
+			}
+		}
+		if !relative {
+			return []propagatedCommand{{name: ctx.Command, args: ctx.Args}}
+		}
+	}
+
+	args := append([][]byte{key, value}, options...)
+	if ms, ok := ctx.keyExpiry(string(key)); ok && ms > 0 {
+		args = append(args, []byte("PXAT"), []byte(strconv.FormatInt(ms, 10)))
+	}
+	return []propagatedCommand{{name: "SET", args: args}}
+}
+
+// propagateRestore sends RESTORE with a TTL as a RESTORE without one
+// followed by the absolute expiry.
+func propagateRestore(ctx *Context) []propagatedCommand {
+	if len(ctx.Args) < 3 || string(ctx.Args[1]) == "0" {
+		return []propagatedCommand{{name: ctx.Command, args: ctx.Args}}
+	}
+	args := append([][]byte{ctx.Args[0], []byte("0")}, ctx.Args[2:]...)
+	cmds := []propagatedCommand{{name: "RESTORE", args: args}}
+	if ms, ok := ctx.keyExpiry(string(ctx.Args[0])); ok && ms > 0 {
+		cmds = append(cmds, pexpireat(ctx.Args[0], ms))
+	}
+	return cmds
+}
@@ -0,0 +1,255 @@
+package command
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cachestorm/cachestorm/internal/resp"
+	"github.com/cachestorm/cachestorm/internal/store"
+)
+
+// newPropagationRouter returns a router whose post-execute hook records
+// what it receives, one "NAME arg ..." string per command.
+func newPropagationRouter(t *testing.T) (*Router, *store.Store, *[]string) {
+	t.Helper()
+	s := store.NewStore()
+	r := NewRouter()
+	RegisterStringCommands(r)
+	RegisterServerCommands(r)
+	RegisterKeyCommands(r)
+	RegisterHashCommands(r)
+	RegisterListCommands(r)
+	RegisterSetCommands(r)
+	RegisterStreamCommands(r)
+	RegisterScriptCommands(r)
+	RegisterTSCommands(r)
+	InitScriptEngine(NewScriptEngine(s))
+
+	var got []string
+	r.SetPostExecute(func(_, cmd string, args [][]byte) {
+		parts := []string{cmd}
+		for _, a := range args {
+			parts = append(parts, string(a))
+		}
+		got = append(got, strings.Join(parts, " "))
+	})
+	return r, s, &got
+}
+
+func execPropagated(t *testing.T, r *Router, s *store.Store, got *[]string, args ...string) []string {
+	t.Helper()
+	*got = nil
+	ctx := newTestContext(args[0], toArgs(args[1:]...), s)
+	if err := r.Execute(ctx); err != nil {
+		t.Fatalf("%v: %v", args, err)
+	}
+	return *got
+}
+
+func TestPropagateMakesExpirationsAbsolute(t *testing.T) {
+	r, s, got := newPropagationRouter(t)
+
+	expiry := func(key string) string {
+		e, ok := s.Get(key)
+		if !ok || e.ExpiresAt == 0 {
+			t.Fatalf("%s has no expiry", key)
+		}
+		return strconv.FormatInt(e.ExpiresAt/int64(time.Millisecond), 10)
+	}
+
+	if out := execPropagated(t, r, s, got, "SET", "k", "v", "NX", "EX", "100"); len(out) != 1 || out[0] != "SET k v NX PXAT "+expiry("k") {
+		t.Errorf("SET EX propagated as %q", out)
+	}
+	if out := execPropagated(t, r, s, got, "SETEX", "s", "100", "v"); len(out) != 1 || out[0] != "SET s v PXAT "+expiry("s") {
+		t.Errorf("SETEX propagated as %q", out)
+	}
+	if out := execPropagated(t, r, s, got, "EXPIRE", "k", "50"); len(out) != 1 || out[0] != "PEXPIREAT k "+expiry("k") {
+		t.Errorf("EXPIRE propagated as %q", out)
+	}
+	if out := execPropagated(t, r, s, got, "GETEX", "k", "PERSIST"); len(out) != 1 || out[0] != "PERSIST k" {
+		t.Errorf("GETEX PERSIST propagated as %q", out)
+	}
+	if out := execPropagated(t, r, s, got, "GETEX", "k"); len(out) != 0 {
+		t.Errorf("GETEX without options propagated as %q", out)
+	}
+	if out := execPropagated(t, r, s, got, "SET", "plain", "v"); len(out) != 1 || out[0] != "SET plain v" {
+		t.Errorf("SET propagated as %q", out)
+	}
+	if out := execPropagated(t, r, s, got, "GET", "plain"); len(out) != 0 {
+		t.Errorf("GET propagated as %q", out)
+	}
+	if out := execPropagated(t, r, s, got, "HSET", "plain", "f", "v"); len(out) != 0 {
+		t.Errorf("failed HSET propagated as %q", out)
+	}
+}
+
+func TestPropagateEffectsOfNonDeterministicCommands(t *testing.T) {
+	r, s, got := newPropagationRouter(t)
+
+	execPropagated(t, r, s, got, "SADD", "set", "a")
+	if out := execPropagated(t, r, s, got, "SPOP", "set"); len(out) != 1 || out[0] != "SREM set a" {
+		t.Errorf("SPOP propagated as %q", out)
+	}
+	if out := execPropagated(t, r, s, got, "SPOP", "set"); len(out) != 0 {
+		t.Errorf("SPOP of a missing set propagated as %q", out)
+	}
+
+	execPropagated(t, r, s, got, "SET", "f", "1.5")
+	if out := execPropagated(t, r, s, got, "INCRBYFLOAT", "f", "0.25"); len(out) != 1 || out[0] != "SET f 1.75" {
+		t.Errorf("INCRBYFLOAT propagated as %q", out)
+	}
+
+	execPropagated(t, r, s, got, "RPUSH", "list", "x")
+	if out := execPropagated(t, r, s, got, "BLPOP", "empty", "list", "1"); len(out) != 1 || out[0] != "LPOP list" {
+		t.Errorf("BLPOP propagated as %q", out)
+	}
+	if out := execPropagated(t, r, s, got, "BLPOP", "empty", "0"); len(out) != 0 {
+		t.Errorf("BLPOP that timed out propagated as %q", out)
+	}
+
+	out := execPropagated(t, r, s, got, "XADD", "stream", "*", "f", "v")
+	if len(out) != 1 || strings.Contains(out[0], "*") || !strings.HasPrefix(out[0], "XADD stream ") {
+		t.Errorf("XADD * propagated as %q", out)
+	}
+
+	out = execPropagated(t, r, s, got, "EVAL", "redis.call('SET', 'scripted', 'v'); redis.call('EXPIRE', 'scripted', 100); return redis.call('GET', 'scripted')", "0")
+	if len(out) != 2 || out[0] != "SET scripted v" || !strings.HasPrefix(out[1], "PEXPIREAT scripted ") {
+		t.Errorf("EVAL propagated as %q", out)
+	}
+	if out := execPropagated(t, r, s, got, "EVAL", "return redis.call('GET', 'scripted')", "0"); len(out) != 0 {
+		t.Errorf("read-only EVAL propagated as %q", out)
+	}
+
+	if out := execPropagated(t, r, s, got, "TS.ADD", "ts", "1000", "1"); len(out) != 1 || out[0] != "TS.ADD ts 1000 1" {
+		t.Errorf("TS.ADD propagated as %q", out)
+	}
+}
+
+func TestScriptWritesWaitForPausedWrites(t *testing.T) {
+	r, s, _ := newPropagationRouter(t)
+
+	paused, release := make(chan struct{}), make(chan struct{})
+	go r.PauseWrites(func() {
+		close(paused)
+		<-release
+	})
+	<-paused
+	done := make(chan error, 1)
+	go func() {
+		done <- r.Execute(newTestContext("EVAL", toArgs("return redis.call('SET', 'k', 'v')", "0"), s))
+	}()
+	select {
+	case <-done:
+		t.Fatal("EVAL ran while writes were paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Get("k"); !ok {
+		t.Error("the script's write was lost")
+	}
+}
+
+func TestScriptWritesApplyToTheCallersNamespace(t *testing.T) {
+	r, _, _ := newPropagationRouter(t)
+	var got []string
+	r.SetPostExecute(func(namespace, cmd string, args [][]byte) {
+		got = append(got, namespace+" "+cmd+" "+string(args[0]))
+	})
+
+	s := store.NewStoreWithNamespaces()
+	db1 := s.ForNamespace("db1")
+	ctx := newTestContext("EVAL", toArgs("return redis.call('SET', 'k', 'v')", "0"), db1)
+	ctx.Namespace = "db1"
+	if err := r.Execute(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := db1.Get("k"); !ok {
+		t.Error("the script did not write to the caller's namespace")
+	}
+	if _, ok := s.Get("k"); ok {
+		t.Error("the script wrote to the default namespace")
+	}
+	if len(got) != 1 || got[0] != "db1 SET k" {
+		t.Errorf("propagated %q", got)
+	}
+}
+
+func TestFCALLROCannotWrite(t *testing.T) {
+	r, s, got := newPropagationRouter(t)
+	RegisterFunctionCommands(r)
+	execPropagated(t, r, s, got, "FUNCTION", "CREATE", "lib", "redis = redis or {}\nfunction redis.setter() return redis.call('SET', 'k', 'v') end", "REPLACE")
+
+	var reply bytes.Buffer
+	ctx := &Context{Command: "FCALL_RO", Args: toArgs("lib.setter", "1", "k"), Store: s, Writer: resp.NewWriter(&reply)}
+	if err := r.Execute(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Get("k"); ok {
+		t.Error("FCALL_RO wrote")
+	}
+	if !strings.Contains(reply.String(), "Write commands are not allowed from read-only scripts") {
+		t.Errorf("FCALL_RO replied %q", reply.String())
+	}
+	if out := execPropagated(t, r, s, got, "FCALL", "lib.setter", "1", "k"); len(out) != 1 || out[0] != "SET k v" {
+		t.Errorf("FCALL propagated as %q", out)
+	}
+}
+
+func TestTransactionsPropagateAsOne(t *testing.T) {
+	r, s, got := newPropagationRouter(t)
+	RegisterTransactionCommands(r)
+	sess := NewSession(1, "test")
+	run := func(args ...string) {
+		t.Helper()
+		if err := r.Execute(NewContextWithSession(args[0], toArgs(args[1:]...), s, resp.NewWriter(&bytes.Buffer{}), sess)); err != nil {
+			t.Fatalf("%v: %v", args, err)
+		}
+	}
+
+	run("MULTI")
+	run("SET", "a", "1")
+	run("GET", "a")
+	run("EXPIRE", "a", "100")
+	if len(*got) != 0 {
+		t.Fatalf("queued commands propagated before EXEC: %q", *got)
+	}
+	run("EXEC")
+	e, _ := s.Get("a")
+	want := []string{"MULTI", "SET a 1", "PEXPIREAT a " + strconv.FormatInt(e.ExpiresAt/int64(time.Millisecond), 10), "EXEC"}
+	if strings.Join(*got, ",") != strings.Join(want, ",") {
+		t.Errorf("transaction propagated as %q, want %q", *got, want)
+	}
+
+	*got = nil
+	run("MULTI")
+	run("GET", "a")
+	run("EXEC")
+	if len(*got) != 0 {
+		t.Errorf("read-only transaction propagated as %q", *got)
+	}
+}
+
+func TestCommandsThatPauseWritesAreRefusedInMulti(t *testing.T) {
+	r, s, got := newPropagationRouter(t)
+	RegisterTransactionCommands(r)
+	RegisterDebugCommands(r)
+	sess := NewSession(1, "test")
+	var reply bytes.Buffer
+	for _, args := range [][]string{{"MULTI"}, {"SET", "a", "1"}, {"DEBUG", "RELOAD"}, {"EXEC"}} {
+		if err := r.Execute(NewContextWithSession(args[0], toArgs(args[1:]...), s, resp.NewWriter(&reply), sess)); err != nil {
+			t.Fatalf("%v: %v", args, err)
+		}
+	}
+	if !strings.Contains(reply.String(), "ERR Command not allowed inside a transaction") || !strings.Contains(reply.String(), "EXECABORT") {
+		t.Errorf("replies %q", reply.String())
+	}
+	if _, ok := s.Get("a"); ok || len(*got) != 0 {
+		t.Errorf("aborted transaction ran: propagated %q", *got)
+	}
+}
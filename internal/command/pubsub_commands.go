@@ -6,6 +6,7 @@ import (
 	"strings"
 
 	"github.com/cachestorm/cachestorm/internal/resp"
+	"github.com/cachestorm/cachestorm/internal/store"
 )
 
 var ErrPubSubNotAvailable = errors.New("ERR pub/sub not available")
@@ -23,35 +24,60 @@ func RegisterPubSubCommands(router *Router) {
 }
 
 func cmdSUBSCRIBE(ctx *Context) error {
+	return subscribe(ctx, "subscribe", (*store.PubSub).Subscribe, (*store.PubSub).SubscriptionCount)
+}
+
+func cmdUNSUBSCRIBE(ctx *Context) error {
+	return unsubscribe(ctx, "unsubscribe", (*store.PubSub).Unsubscribe,
+		(*store.PubSub).SubscribedChannels, (*store.PubSub).SubscriptionCount)
+}
+
+func cmdPSUBSCRIBE(ctx *Context) error {
+	return subscribe(ctx, "psubscribe", (*store.PubSub).PSubscribe, (*store.PubSub).SubscriptionCount)
+}
+
+func cmdPUNSUBSCRIBE(ctx *Context) error {
+	return unsubscribe(ctx, "punsubscribe", (*store.PubSub).PUnsubscribe,
+		(*store.PubSub).SubscribedPatterns, (*store.PubSub).SubscriptionCount)
+}
+
+// subscribe adds the connection's subscriber to each target in turn and
+// confirms every one with a [kind, target, count] frame, where count is the
+// subscriber's running total after that target.
+func subscribe(ctx *Context, kind string,
+	add func(*store.PubSub, *store.Subscriber, ...string) int,
+	count func(*store.PubSub, *store.Subscriber) int) error {
 	if ctx.ArgCount() < 1 {
 		return ctx.WriteError(ErrWrongArgCount)
 	}
 
-	channels := make([]string, ctx.ArgCount())
-	for i := 0; i < ctx.ArgCount(); i++ {
-		channels[i] = ctx.ArgString(i)
-	}
-
 	ps := ctx.Store.GetPubSub()
 	if ps == nil {
 		return ctx.WriteError(ErrPubSubNotAvailable)
 	}
 
 	sub := ctx.GetSubscriber()
-	count := ps.Subscribe(sub, channels...)
-
-	for _, ch := range channels {
-		ctx.Writer.WriteValue(resp.ArrayValue([]*resp.Value{
-			resp.SimpleString("subscribe"),
-			resp.BulkString(ch),
-			resp.IntegerValue(int64(count)),
-		}))
+	for i := 0; i < ctx.ArgCount(); i++ {
+		target := ctx.ArgString(i)
+		add(ps, sub, target)
+		if err := ctx.WritePush([]*resp.Value{
+			resp.BulkString(kind),
+			resp.BulkString(target),
+			resp.IntegerValue(int64(count(ps, sub))),
+		}); err != nil {
+			return err
+		}
 	}
-
 	return nil
 }
 
-func cmdUNSUBSCRIBE(ctx *Context) error {
+// unsubscribe removes the named targets, or every current one when called
+// without arguments, confirming each with a [kind, target, count] frame.
+// With nothing to remove a single frame with a null target is sent.
+func unsubscribe(ctx *Context, kind string,
+	remove func(*store.PubSub, *store.Subscriber, ...string) int,
+	current func(*store.PubSub, *store.Subscriber) []string,
+	count func(*store.PubSub, *store.Subscriber) int) error {
 	ps := ctx.Store.GetPubSub()
 	if ps == nil {
 		return ctx.WriteError(ErrPubSubNotAvailable)
@@ -59,93 +85,61 @@ func cmdUNSUBSCRIBE(ctx *Context) error {
 
 	sub := ctx.GetSubscriber()
 
-	channels := make([]string, ctx.ArgCount())
+	targets := make([]string, ctx.ArgCount())
 	for i := 0; i < ctx.ArgCount(); i++ {
-		channels[i] = ctx.ArgString(i)
+		targets[i] = ctx.ArgString(i)
+	}
+	if len(targets) == 0 {
+		targets = current(ps, sub)
 	}
 
-	count := ps.Unsubscribe(sub, channels...)
-
-	if len(channels) == 0 {
-		ctx.Writer.WriteValue(resp.ArrayValue([]*resp.Value{
-			resp.SimpleString("unsubscribe"),
+	if len(targets) == 0 {
+		return ctx.WritePush([]*resp.Value{
+			resp.BulkString(kind),
 			resp.NullBulkString(),
-			resp.IntegerValue(0),
-		}))
-	} else {
-		for _, ch := range channels {
-			ctx.Writer.WriteValue(resp.ArrayValue([]*resp.Value{
-				resp.SimpleString("unsubscribe"),
-				resp.BulkString(ch),
-				resp.IntegerValue(int64(count)),
-			}))
-		}
+			resp.IntegerValue(int64(count(ps, sub))),
+		})
 	}
 
+	for _, target := range targets {
+		remove(ps, sub, target)
+		if err := ctx.WritePush([]*resp.Value{
+			resp.BulkString(kind),
+			resp.BulkString(target),
+			resp.IntegerValue(int64(count(ps, sub))),
+		}); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func cmdPSUBSCRIBE(ctx *Context) error {
-	if ctx.ArgCount() < 1 {
-		return ctx.WriteError(ErrWrongArgCount)
-	}
-
-	patterns := make([]string, ctx.ArgCount())
-	for i := 0; i < ctx.ArgCount(); i++ {
-		patterns[i] = ctx.ArgString(i)
+// PubSubFrame builds the frame delivered to a subscriber for a published
+// message: a push under RESP3, an array otherwise.
+func PubSubFrame(msg *store.Message, resp3 bool) *resp.Value {
+	items := []*resp.Value{resp.BulkString(msg.Kind)}
+	if msg.Kind == store.MessageKindPMessage {
+		items = append(items, resp.BulkString(msg.Pattern))
 	}
-
-	ps := ctx.Store.GetPubSub()
-	if ps == nil {
-		return ctx.WriteError(ErrPubSubNotAvailable)
+	items = append(items, resp.BulkString(msg.Channel), resp.BulkBytes(msg.Payload))
+	if resp3 {
+		return resp.PushValue(items)
 	}
-
-	sub := ctx.GetSubscriber()
-	count := ps.PSubscribe(sub, patterns...)
-
-	for _, p := range patterns {
-		ctx.Writer.WriteValue(resp.ArrayValue([]*resp.Value{
-			resp.SimpleString("psubscribe"),
-			resp.BulkString(p),
-			resp.IntegerValue(int64(count)),
-		}))
-	}
-
-	return nil
+	return resp.ArrayValue(items)
 }
 
-func cmdPUNSUBSCRIBE(ctx *Context) error {
+// inSubscribedMode reports whether the client is restricted to the
+// subscription commands. RESP3 clients receive messages as out-of-band
+// pushes and may keep issuing regular commands.
+func (ctx *Context) inSubscribedMode() bool {
+	if ctx.Subscriber == nil || ctx.IsRESP3() {
+		return false
+	}
 	ps := ctx.Store.GetPubSub()
 	if ps == nil {
-		return ctx.WriteError(ErrPubSubNotAvailable)
+		return false
 	}
-
-	sub := ctx.GetSubscriber()
-
-	patterns := make([]string, ctx.ArgCount())
-	for i := 0; i < ctx.ArgCount(); i++ {
-		patterns[i] = ctx.ArgString(i)
-	}
-
-	count := ps.PUnsubscribe(sub, patterns...)
-
-	if len(patterns) == 0 {
-		ctx.Writer.WriteValue(resp.ArrayValue([]*resp.Value{
-			resp.SimpleString("punsubscribe"),
-			resp.NullBulkString(),
-			resp.IntegerValue(0),
-		}))
-	} else {
-		for _, p := range patterns {
-			ctx.Writer.WriteValue(resp.ArrayValue([]*resp.Value{
-				resp.SimpleString("punsubscribe"),
-				resp.BulkString(p),
-				resp.IntegerValue(int64(count)),
-			}))
-		}
-	}
-
-	return nil
+	return ps.SubscriptionCount(ctx.Subscriber)+ps.ShardSubscriptionCount(ctx.Subscriber) > 0
 }
 
 func cmdPUBLISH(ctx *Context) error {
@@ -209,48 +203,57 @@ func cmdPUBSUB(ctx *Context) error {
 	case "NUMPAT":
 		return ctx.WriteInteger(int64(ps.NumPat()))
 
+	case "SHARDCHANNELS":
+		pattern := ""
+		if ctx.ArgCount() >= 2 {
+			pattern = ctx.ArgString(1)
+		}
+		channels := ps.ShardChannels(pattern)
+		results := make([]*resp.Value, 0, len(channels))
+		for _, ch := range channels {
+			results = append(results, resp.BulkString(ch))
+		}
+		return ctx.WriteArray(results)
+
+	case "SHARDNUMSUB":
+		channels := make([]string, ctx.ArgCount()-1)
+		for i := 1; i < ctx.ArgCount(); i++ {
+			channels[i-1] = ctx.ArgString(i)
+		}
+		numsub := ps.ShardNumSub(channels...)
+		results := make([]*resp.Value, 0, len(channels)*2)
+		for _, ch := range channels {
+			results = append(results, resp.BulkString(ch))
+			results = append(results, resp.IntegerValue(int64(numsub[ch])))
+		}
+		return ctx.WriteArray(results)
+
 	default:
 		return ctx.WriteError(ErrUnknownCommand)
 	}
 }
 
 func cmdSSUBSCRIBE(ctx *Context) error {
-	if ctx.ArgCount() < 1 {
-		return ctx.WriteError(ErrWrongArgCount)
-	}
-	channels := make([]string, ctx.ArgCount())
-	for i := 0; i < ctx.ArgCount(); i++ {
-		channels[i] = ctx.ArgString(i)
-	}
-	return ctx.WriteArray([]*resp.Value{
-		resp.BulkString("ssubscribe"),
-		resp.BulkString(channels[0]),
-		resp.IntegerValue(1),
-	})
+	return subscribe(ctx, "ssubscribe", (*store.PubSub).SSubscribe, (*store.PubSub).ShardSubscriptionCount)
 }
 
 func cmdSUNSUBSCRIBE(ctx *Context) error {
-	if ctx.ArgCount() < 1 {
-		return ctx.WriteError(ErrWrongArgCount)
-	}
-	channels := make([]string, ctx.ArgCount())
-	for i := 0; i < ctx.ArgCount(); i++ {
-		channels[i] = ctx.ArgString(i)
-	}
-	return ctx.WriteArray([]*resp.Value{
-		resp.BulkString("sunsubscribe"),
-		resp.BulkString(channels[0]),
-		resp.IntegerValue(0),
-	})
+	return unsubscribe(ctx, "sunsubscribe", (*store.PubSub).SUnsubscribe,
+		(*store.PubSub).SubscribedShardChannels, (*store.PubSub).ShardSubscriptionCount)
 }
 
 func cmdSPUBLISH(ctx *Context) error {
 	if ctx.ArgCount() != 2 {
 		return ctx.WriteError(ErrWrongArgCount)
 	}
-	_ = ctx.ArgString(0)
-	_ = ctx.ArgString(1)
-	return ctx.WriteInteger(1)
+
+	ps := ctx.Store.GetPubSub()
+	if ps == nil {
+		return ctx.WriteInteger(0)
+	}
+
+	count := ps.SPublish(ctx.ArgString(0), ctx.Arg(1))
+	return ctx.WriteInteger(int64(count))
 }
 
 func init() {
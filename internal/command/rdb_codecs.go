@@ -0,0 +1,157 @@
+package command
+
+import (
+	"bytes"
+	"fmt"
+	"math/bits"
+
+	"github.com/cachestorm/cachestorm/internal/persistence"
+	"github.com/cachestorm/cachestorm/internal/store"
+)
+
+// Snapshot encodings of the values defined in this package. The type bytes
+// are part of the file format and must never be reused.
+const (
+	rdbTypeBitmap      = persistence.RDBTypeExtension
+	rdbTypeHyperLogLog = persistence.RDBTypeExtension + 1
+)
+
+// Layout of the HyperLogLog strings Redis saves: a "HYLL" magic, the
+// encoding, three unused bytes and a cached cardinality whose top bit marks
+// it stale, followed by the registers.
+const (
+	redisHLLMagic     = "HYLL"
+	redisHLLHeader    = 16
+	redisHLLDense     = 0
+	redisHLLSparse    = 1
+	redisHLLBits      = 6
+	redisHLLMaxValue  = 1<<redisHLLBits - 1
+	redisHLLDenseSize = redisHLLHeader + (hllRegisters*redisHLLBits+7)/8
+)
+
+func init() {
+	persistence.RegisterValueCodec(&BitmapValue{}, persistence.ValueCodec{
+		Type: rdbTypeBitmap,
+		Name: "bitmap",
+		Encode: func(v store.Value) []byte {
+			return v.(*BitmapValue).Data
+		},
+		Decode: func(b []byte) (store.Value, error) {
+			return &BitmapValue{Data: b}, nil
+		},
+		// Redis numbers bits from the most significant bit of each byte.
+		ToRedis: func(v store.Value) []byte {
+			data := v.(*BitmapValue).Data
+			out := make([]byte, len(data))
+			for i, b := range data {
+				out[i] = bits.Reverse8(b)
+			}
+			return out
+		},
+	})
+
+	persistence.RegisterValueCodec(&HyperLogLogValue{}, persistence.ValueCodec{
+		Type: rdbTypeHyperLogLog,
+		Name: "hyperloglog",
+		Encode: func(v store.Value) []byte {
+			registers := v.(*HyperLogLogValue).Registers
+			return registers[:]
+		},
+		Decode: func(b []byte) (store.Value, error) {
+			if len(b) != hllRegisters {
+				return nil, fmt.Errorf("HyperLogLog with %d registers, want %d", len(b), hllRegisters)
+			}
+			hll := &HyperLogLogValue{}
+			copy(hll.Registers[:], b)
+			return hll, nil
+		},
+		ToRedis: func(v store.Value) []byte {
+			return redisDenseHLL(v.(*HyperLogLogValue))
+		},
+		FromRedis: func(b []byte) (store.Value, bool) {
+			hll, ok := parseRedisHLL(b)
+			return hll, ok
+		},
+	})
+}
+
+// redisDenseHLL packs the registers six bits each, least significant bits
+// first, and marks the cached cardinality stale so Redis recomputes it.
+func redisDenseHLL(hll *HyperLogLogValue) []byte {
+	out := make([]byte, redisHLLDenseSize)
+	copy(out, redisHLLMagic)
+	out[4] = redisHLLDense
+	out[15] = 0x80
+	regs := out[redisHLLHeader:]
+	for i, val := range hll.Registers {
+		val = min(val, redisHLLMaxValue)
+		pos := i * redisHLLBits
+		byteIdx, shift := pos/8, uint(pos%8)
+		regs[byteIdx] |= val << shift
+		if shift > 8-redisHLLBits && byteIdx+1 < len(regs) {
+			regs[byteIdx+1] |= val >> (8 - shift)
+		}
+	}
+	return out
+}
+
+// parseRedisHLL decodes a HyperLogLog string from a Redis dump in either the
+// dense or the sparse encoding. The sparse encoding is a sequence of runs:
+// ZERO (00xxxxxx) and XZERO (01xxxxxx yyyyyyyy) skip registers, VAL
+// (1vvvvvxx) sets a run of registers to the same value.
+func parseRedisHLL(b []byte) (*HyperLogLogValue, bool) {
+	if len(b) < redisHLLHeader || !bytes.HasPrefix(b, []byte(redisHLLMagic)) {
+		return nil, false
+	}
+	hll := &HyperLogLogValue{}
+	body := b[redisHLLHeader:]
+
+	switch b[4] {
+	case redisHLLDense:
+		if len(b) != redisHLLDenseSize {
+			return nil, false
+		}
+		for i := range hll.Registers {
+			pos := i * redisHLLBits
+			byteIdx, shift := pos/8, uint(pos%8)
+			val := uint(body[byteIdx]) >> shift
+			if byteIdx+1 < len(body) {
+				val |= uint(body[byteIdx+1]) << (8 - shift)
+			}
+			hll.Registers[i] = uint8(val & redisHLLMaxValue)
+		}
+		return hll, true
+
+	case redisHLLSparse:
+		idx := 0
+		for p := 0; p < len(body); p++ {
+			op := body[p]
+			var run int
+			switch {
+			case op&0xC0 == 0x00:
+				run = int(op&0x3F) + 1
+			case op&0xC0 == 0x40:
+				if p+1 >= len(body) {
+					return nil, false
+				}
+				p++
+				run = (int(op&0x3F)<<8 | int(body[p])) + 1
+			default:
+				run = int(op&0x03) + 1
+				if idx+run > hllRegisters {
+					return nil, false
+				}
+				val := (op>>2)&0x1F + 1
+				for i := idx; i < idx+run; i++ {
+					hll.Registers[i] = val
+				}
+			}
+			idx += run
+			if idx > hllRegisters {
+				return nil, false
+			}
+		}
+		return hll, idx == hllRegisters
+	}
+	return nil, false
+}
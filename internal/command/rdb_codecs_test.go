@@ -0,0 +1,79 @@
+package command
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/cachestorm/cachestorm/internal/persistence"
+	"github.com/cachestorm/cachestorm/internal/store"
+)
+
+func TestSnapshotRoundTripsCommandValues(t *testing.T) {
+	src := store.NewStore()
+	hll := &HyperLogLogValue{}
+	hll.Registers[7], hll.Registers[hllRegisters-1] = 3, 9
+	src.Set("hll", hll, store.SetOptions{})
+	src.Set("bits", &BitmapValue{Data: []byte{0x80, 0x01}}, store.SetOptions{})
+
+	path := filepath.Join(t.TempDir(), "dump.rdb")
+	if err := persistence.NewRDBWriter(src, persistence.RDBConfig{Version: persistence.RDBVersion11, Compression: true, Checksum: true}).Save(path); err != nil {
+		t.Fatal(err)
+	}
+	dst := store.NewStore()
+	if err := persistence.NewRDBReader(dst).Load(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if e, _ := dst.Get("hll"); e == nil || e.Value.(*HyperLogLogValue).Registers != hll.Registers {
+		t.Errorf("HyperLogLog did not round trip: %+v", e)
+	}
+	if e, _ := dst.Get("bits"); e == nil || string(e.Value.(*BitmapValue).Data) != "\x80\x01" {
+		t.Errorf("bitmap did not round trip: %+v", e)
+	}
+}
+
+func TestRedisDumpConvertsCommandValues(t *testing.T) {
+	src := store.NewStore()
+	hll := &HyperLogLogValue{}
+	hll.Registers[0], hll.Registers[5], hll.Registers[hllRegisters-1] = 1, 63, 70
+	src.Set("hll", hll, store.SetOptions{})
+	src.Set("bits", &BitmapValue{Data: []byte{0x01, 0x06}}, store.SetOptions{})
+
+	path := filepath.Join(t.TempDir(), "dump.rdb")
+	w := persistence.NewRDBWriter(src, persistence.RDBConfig{Checksum: true, RedisCompatible: true})
+	if err := w.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	dst := store.NewStore()
+	if err := persistence.NewRDBReader(dst).Load(path); err != nil {
+		t.Fatal(err)
+	}
+
+	want := hll.Registers
+	want[hllRegisters-1] = 63 // Redis registers hold six bits
+	if e, _ := dst.Get("hll"); e == nil || e.Value.(*HyperLogLogValue).Registers != want {
+		t.Errorf("HyperLogLog did not survive the Redis format: %+v", e)
+	}
+	// Redis numbers bits from the top of each byte, and keeps bitmaps as strings.
+	if e, _ := dst.Get("bits"); e == nil || string(e.Value.(*store.StringValue).Data) != "\x80\x60" {
+		t.Errorf("bitmap = %+v, want bit-reversed string", e)
+	}
+}
+
+func TestParseRedisSparseHLL(t *testing.T) {
+	b := make([]byte, redisHLLHeader, redisHLLHeader+3)
+	copy(b, redisHLLMagic)
+	b[4] = redisHLLSparse
+	b = append(b, 0x89, 0x7F, 0xFD) // VAL 3 x2, XZERO x16382
+
+	hll, ok := parseRedisHLL(b)
+	if !ok {
+		t.Fatal("sparse HyperLogLog not recognised")
+	}
+	if hll.Registers[0] != 3 || hll.Registers[1] != 3 || hll.Registers[2] != 0 {
+		t.Errorf("registers = %v", hll.Registers[:3])
+	}
+	if _, ok := parseRedisHLL(b[:len(b)-2]); ok {
+		t.Error("sparse HyperLogLog covering too few registers accepted")
+	}
+}
@@ -3,11 +3,13 @@ package command
 import (
 	"bytes"
 	"fmt"
+	"net"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/cachestorm/cachestorm/internal/replication"
 	"github.com/cachestorm/cachestorm/internal/resp"
 	"github.com/cachestorm/cachestorm/internal/store"
 )
@@ -31,13 +33,17 @@ var (
 )
 
 type ReplicationManager struct {
-	store      *store.Store
-	role       string
-	masterHost string
-	masterPort int
-	masterID   string
-	masterOff  int64
-	replicaID  string
+	store *store.Store
+	// mu guards role and the master, which REPLICAOF changes while
+	// commands read them.
+	mu          sync.RWMutex
+	role        string
+	masterHost  string
+	masterPort  int
+	masterID    string
+	masterOff   int64
+	replicaID   string
+	onReplicaOf func(host string, port int)
 }
 
 func InitReplicationManager(s *store.Store) {
@@ -52,23 +58,73 @@ func GetReplicationManager() *ReplicationManager {
 	return replManager
 }
 
+// replEngine runs the replication stream behind PSYNC and SYNC; it is nil
+// until the server enables it.
+var replEngine struct {
+	mu sync.RWMutex
+	m  *replication.Manager
+}
+
+// EnableReplication serves PSYNC and SYNC from m, which also provides the
+// replication ID, offset and INFO fields, and takes the replica settings
+// from it. A nil m disables it.
+func EnableReplication(m *replication.Manager) {
+	replEngine.mu.Lock()
+	replEngine.m = m
+	replEngine.mu.Unlock()
+	if m == nil {
+		return
+	}
+
+	globalConfig.mu.Lock()
+	globalConfig.replicaReadOnly = m.ReadOnly()
+	globalConfig.replicaServeStaleData = m.ServeStaleData()
+	globalConfig.mu.Unlock()
+}
+
+func replicationEngine() *replication.Manager {
+	replEngine.mu.RLock()
+	defer replEngine.mu.RUnlock()
+	return replEngine.m
+}
+
+// GetRole returns "master" or "slave". With the replication engine, the
+// role is the engine's.
 func (m *ReplicationManager) GetRole() string {
+	if e := replicationEngine(); e != nil {
+		if e.GetRole() == replication.RoleReplica {
+			return "slave"
+		}
+		return "master"
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 	return m.role
 }
 
 func (m *ReplicationManager) GetReplicaID() string {
+	if e := replicationEngine(); e != nil {
+		return e.GetReplicaID()
+	}
 	return m.replicaID
 }
 
 func (m *ReplicationManager) GetMasterOffset() int64 {
+	if e := replicationEngine(); e != nil {
+		return e.GetMasterOffset()
+	}
 	return m.masterOff
 }
 
 func (m *ReplicationManager) GetMasterHost() string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 	return m.masterHost
 }
 
 func (m *ReplicationManager) GetMasterPort() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 	return m.masterPort
 }
 
@@ -118,6 +174,7 @@ func (m *ReplicationManager) RemoveReplica(clientID int64) {
 }
 
 func (m *ReplicationManager) ReplicaOf(host string, port int) {
+	m.mu.Lock()
 	m.masterHost = host
 	m.masterPort = port
 	if host == "" || (host == "no" && port == 1) {
@@ -125,13 +182,117 @@ func (m *ReplicationManager) ReplicaOf(host string, port int) {
 	} else {
 		m.role = "slave"
 	}
+	m.mu.Unlock()
+	if m.onReplicaOf != nil {
+		m.onReplicaOf(host, port)
+	}
+}
+
+// OnReplicaOf registers the function that starts or stops replicating when
+// REPLICAOF changes the master. An empty host means REPLICAOF NO ONE.
+func (m *ReplicationManager) OnReplicaOf(fn func(host string, port int)) {
+	m.onReplicaOf = fn
+}
+
+// datasetReplaced is called once the dataset has been replaced other than
+// through write commands, as by DEBUG RELOAD, so that replicas resync
+// instead of continuing a history it no longer follows.
+func datasetReplaced() {
+	if e := replicationEngine(); e != nil {
+		e.ResetHistory()
+	}
+}
+
+// CheckDatasetReplace returns why the dataset cannot be replaced other
+// than through write commands, as by BACKUP.RESTORE or an NDJSON import,
+// or nil. A replica would part from its master, and active-active peers
+// would not see the new data, as it records no operations.
+func CheckDatasetReplace() error {
+	if isReplica() {
+		return fmt.Errorf("READONLY You can't replace the dataset of a replica.")
+	}
+	if e := activeActiveEngine(); e != nil && e.HasPeers() {
+		return fmt.Errorf("ERR the dataset cannot be replaced while active-active peers are attached")
+	}
+	return nil
+}
+
+// isReplica reports whether this server replicates a master.
+func isReplica() bool {
+	if e := replicationEngine(); e != nil {
+		return e.GetRole() == replication.RoleReplica
+	}
+	m := GetReplicationManager()
+	return m != nil && m.GetRole() == "slave"
+}
+
+// helloRole is the role HELLO reports: "replica" while this server
+// replicates a master, "master" otherwise.
+func helloRole() string {
+	if isReplica() {
+		return "replica"
+	}
+	return "master"
+}
+
+// readOnlyReplica reports whether writes from clients must be refused
+// because this server replicates a master and replica-read-only is on.
+func readOnlyReplica() bool {
+	if !isReplica() {
+		return false
+	}
+	globalConfig.mu.RLock()
+	defer globalConfig.mu.RUnlock()
+	return globalConfig.replicaReadOnly
+}
+
+// waitForReplicas implements the wait of WAIT and WAITAOF: for n replicas
+// to acknowledge every write made so far, or with fsynced to have it in
+// their AOF, for at most timeout (0 for no limit). It returns how many
+// did. Without replication none can.
+func waitForReplicas(cmd string, n int, timeout time.Duration, fsynced bool) (int, error) {
+	e := replicationEngine()
+	if e == nil {
+		return 0, nil
+	}
+	if e.GetRole() != replication.RoleMaster {
+		return 0, fmt.Errorf("ERR %s cannot be used with replica instances", cmd)
+	}
+	return e.WaitForAcks(n, e.GetMasterOffset(), fsynced, timeout), nil
+}
+
+// staleReplica reports whether commands that read or write the dataset
+// must be refused because this server has lost the link to its master and
+// replica-serve-stale-data is off.
+func staleReplica() bool {
+	if !isReplica() {
+		return false
+	}
+	globalConfig.mu.RLock()
+	serve := globalConfig.replicaServeStaleData
+	globalConfig.mu.RUnlock()
+	if serve {
+		return false
+	}
+	e := replicationEngine()
+	return e == nil || !e.MasterLinkUp()
+}
+
+// enoughReplicas reports whether a master has the replicas
+// min-replicas-to-write asks for to accept writes.
+func enoughReplicas() bool {
+	e := replicationEngine()
+	return e == nil || e.EnoughReplicas()
 }
 
 func (m *ReplicationManager) GetInfo() string {
+	if e := replicationEngine(); e != nil {
+		return e.GetInfo()
+	}
 	var sb strings.Builder
 	sb.WriteString("# Replication\r\n")
 
-	if m.role == "master" {
+	if m.GetRole() == "master" {
 		sb.WriteString("role:master\r\n")
 		sb.WriteString(fmt.Sprintf("connected_replicas:%d\r\n", m.GetReplicaCount()))
 		sb.WriteString(fmt.Sprintf("master_replid:%s\r\n", m.replicaID))
@@ -147,12 +308,14 @@ func (m *ReplicationManager) GetInfo() string {
 		}
 	} else {
 		sb.WriteString("role:slave\r\n")
-		sb.WriteString(fmt.Sprintf("master_host:%s\r\n", m.masterHost))
-		sb.WriteString(fmt.Sprintf("master_port:%d\r\n", m.masterPort))
-		sb.WriteString("master_link_status:up\r\n")
-		sb.WriteString("master_last_io_seconds_ago:0\r\n")
+		sb.WriteString(fmt.Sprintf("master_host:%s\r\n", m.GetMasterHost()))
+		sb.WriteString(fmt.Sprintf("master_port:%d\r\n", m.GetMasterPort()))
+		// Without the replication engine no link to the master is made
+		sb.WriteString("master_link_status:down\r\n")
+		sb.WriteString("master_last_io_seconds_ago:-1\r\n")
 		sb.WriteString("master_sync_in_progress:0\r\n")
 		sb.WriteString(fmt.Sprintf("slave_repl_offset:%d\r\n", m.masterOff))
+		sb.WriteString("master_link_down_since_seconds:-1\r\n")
 		sb.WriteString("slave_priority:100\r\n")
 		sb.WriteString("slave_read_only:1\r\n")
 	}
@@ -288,6 +451,18 @@ func cmdREPLCONF(ctx *Context) error {
 		if ctx.ArgCount() >= 2 {
 			offset, _ := strconv.ParseInt(ctx.ArgString(1), 10, 64)
 			replManager.UpdateReplicaAck(ctx.ClientID, offset)
+			// REPLCONF ACK <offset> FACK <aof offset>
+			aofOffset := int64(-1)
+			if ctx.ArgCount() >= 4 && strings.EqualFold(ctx.ArgString(2), "FACK") {
+				if v, err := strconv.ParseInt(ctx.ArgString(3), 10, 64); err == nil {
+					aofOffset = v
+				}
+			}
+			if ctx.Session != nil {
+				if r := ctx.Session.Replica(); r != nil {
+					r.Ack(offset, aofOffset)
+				}
+			}
 		}
 		return nil
 
@@ -301,6 +476,11 @@ func cmdSYNC(ctx *Context) error {
 		return ctx.WriteError(fmt.Errorf("ERR replication not initialized"))
 	}
 
+	// A replica with the replication engine serves its master's stream.
+	if e := replicationEngine(); e != nil && ctx.Session != nil {
+		return attachReplica(ctx, e, "?", -1, false)
+	}
+
 	if replManager.GetRole() != "master" {
 		return ctx.WriteError(fmt.Errorf("ERR can't sync from a replica"))
 	}
@@ -317,10 +497,6 @@ func cmdPSYNC(ctx *Context) error {
 		return ctx.WriteError(fmt.Errorf("ERR replication not initialized"))
 	}
 
-	if replManager.GetRole() != "master" {
-		return ctx.WriteError(fmt.Errorf("ERR can't sync from a replica"))
-	}
-
 	var masterReplID string
 	var offset int64 = -1
 
@@ -331,6 +507,14 @@ func cmdPSYNC(ctx *Context) error {
 		offset, _ = strconv.ParseInt(ctx.ArgString(1), 10, 64)
 	}
 
+	if e := replicationEngine(); e != nil && ctx.Session != nil {
+		return attachReplica(ctx, e, masterReplID, offset, true)
+	}
+
+	if replManager.GetRole() != "master" {
+		return ctx.WriteError(fmt.Errorf("ERR can't sync from a replica"))
+	}
+
 	currentReplID := replManager.GetReplicaID()
 	currentOffset := replManager.GetMasterOffset()
 
@@ -345,6 +529,93 @@ func cmdPSYNC(ctx *Context) error {
 	return nil
 }
 
+// attachReplica answers a PSYNC, or with psync false a SYNC, which gets the
+// snapshot alone. The connection then carries the replica's stream.
+func attachReplica(ctx *Context, e *replication.Manager, replid string, offset int64, psync bool) error {
+	if ctx.Session.Replica() != nil {
+		return ctx.WriteError(fmt.Errorf("ERR the connection already serves a replica"))
+	}
+	if e.GetRole() == replication.RoleReplica && !e.MasterLinkUp() {
+		return ctx.WriteError(fmt.Errorf("NOMASTERLINK Can't SYNC while not connected with my master"))
+	}
+	ip, port := replicaAddr(ctx)
+	rs := e.PSync(replid, offset, ip, port, replicaCapa(ctx, "eof"))
+	if rs.Partial {
+		if err := ctx.Writer.WriteSimpleString("CONTINUE " + rs.ReplID); err != nil {
+			rs.Replica.Close()
+			return err
+		}
+		ctx.Session.setReplica(rs.Replica)
+		return nil
+	}
+	if rs.Diskless {
+		if err := rs.Transfer(rawWriter{ctx.Writer}, psync); err != nil {
+			return err
+		}
+		ctx.Session.setReplica(rs.Replica)
+		return nil
+	}
+
+	var payload bytes.Buffer
+	if err := rs.WriteSnapshot(&payload); err != nil {
+		rs.Replica.Close()
+		return ctx.WriteError(fmt.Errorf("ERR %v", err))
+	}
+	if psync {
+		if err := ctx.Writer.WriteSimpleString(fmt.Sprintf("FULLRESYNC %s %d", rs.ReplID, rs.Offset)); err != nil {
+			rs.Replica.Close()
+			return err
+		}
+	}
+	// The payload is not followed by CRLF: the stream starts right after it.
+	if err := ctx.Writer.WriteRaw(fmt.Appendf(nil, "$%d\r\n", payload.Len())); err != nil {
+		rs.Replica.Close()
+		return err
+	}
+	if err := ctx.Writer.WriteRaw(payload.Bytes()); err != nil {
+		rs.Replica.Close()
+		return err
+	}
+	ctx.Session.setReplica(rs.Replica)
+	return nil
+}
+
+// rawWriter writes to a connection past its RESP framing.
+type rawWriter struct {
+	w *resp.Writer
+}
+
+func (w rawWriter) Write(p []byte) (int, error) {
+	if err := w.w.WriteRaw(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// replicaCapa reports whether the replica on the connection announced capa
+// with REPLCONF CAPA.
+func replicaCapa(ctx *Context, capa string) bool {
+	replicaMu.RLock()
+	defer replicaMu.RUnlock()
+	r, ok := replicas[ctx.ClientID]
+	return ok && r.Capabilities[capa]
+}
+
+// replicaAddr returns the address a replica announced with REPLCONF, or
+// the host it connects from.
+func replicaAddr(ctx *Context) (string, int) {
+	replicaMu.RLock()
+	defer replicaMu.RUnlock()
+	if r, ok := replicas[ctx.ClientID]; ok {
+		return r.IP, r.Port
+	}
+	host, _, err := net.SplitHostPort(ctx.RemoteAddr)
+	if err != nil {
+		return ctx.RemoteAddr, 0
+	}
+	return host, 0
+}
+
 func cmdROLE(ctx *Context) error {
 	if replManager == nil {
 		return ctx.WriteArray([]*resp.Value{
@@ -407,6 +678,7 @@ func RegisterReplicationCommands(router *Router) {
 	router.Register(&CommandDef{Name: "REPLCONF", Handler: cmdREPLCONF})
 	router.Register(&CommandDef{Name: "SYNC", Handler: cmdSYNC})
 	router.Register(&CommandDef{Name: "PSYNC", Handler: cmdPSYNC})
+	router.Register(&CommandDef{Name: "ACTIVEACTIVE", Handler: cmdACTIVEACTIVE})
 	router.Register(&CommandDef{Name: "ROLE", Handler: cmdROLE})
 	router.Register(&CommandDef{Name: "REPLICAOF", Handler: cmdREPLICAOF})
 	router.Register(&CommandDef{Name: "SLAVEOF", Handler: cmdREPLICAOF})
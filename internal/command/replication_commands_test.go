@@ -0,0 +1,20 @@
+package command
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/cachestorm/cachestorm/internal/store"
+)
+
+func TestReplicationInfoWithoutEngine(t *testing.T) {
+	if replicationEngine() != nil {
+		t.Skip("a replication engine is enabled")
+	}
+	m := &ReplicationManager{store: store.NewStore(), role: "master"}
+	m.ReplicaOf("127.0.0.1", 6379)
+	info := m.GetInfo()
+	if !strings.Contains(info, "role:slave\r\n") || !strings.Contains(info, "master_link_status:down\r\n") {
+		t.Errorf("INFO replication of a replica without a link:\n%s", info)
+	}
+}
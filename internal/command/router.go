@@ -4,12 +4,16 @@ import (
 	"crypto/sha256"
 	"crypto/subtle"
 	"encoding/hex"
+	"errors"
 	"io"
+	"os"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/cachestorm/cachestorm/internal/acl"
 	"github.com/cachestorm/cachestorm/internal/resp"
+	"github.com/cachestorm/cachestorm/internal/store"
 )
 
 type CommandDef struct { //nolint:revive // Command prefix is intentional for clarity
@@ -17,30 +21,55 @@ type CommandDef struct { //nolint:revive // Command prefix is intentional for cl
 	Handler func(ctx *Context) error
 	Arity   int
 	Flags   []string
+
+	// Key positions as reported by COMMAND INFO: 1-based counting the
+	// command name, LastKey negative to count from the end, FirstKey 0 when
+	// the command takes no keys.
+	FirstKey int
+	LastKey  int
+	KeyStep  int
 }
 
 type Router struct {
 	mu          sync.RWMutex
 	commands    map[string]*CommandDef
 	requirePass string
-	postExecute func(cmd string, args [][]byte)
+	aclFile     string
+	acl         *acl.ACL
+	postExecute func(namespace, cmd string, args [][]byte)
+	replicate   func(namespace, cmd string, args [][]byte)
+	// writes is held for reading from the start of a write command to the
+	// end of its post-execute hook; see PauseWrites.
+	writes sync.RWMutex
 }
 
 // globalRouter is set during NewRouter() for access from command handlers (e.g. AUTH)
 var globalRouter *Router
 
+// globalACL holds the users of the most recently created router.
+var globalACL = acl.NewACL()
+
 func NewRouter() *Router {
 	r := &Router{
 		commands: make(map[string]*CommandDef),
+		acl:      acl.NewACL(),
 	}
 	globalRouter = r
+	globalACL = r.acl
 	return r
 }
 
+// SetRequirePass sets the password of the default user, as in Redis; an
+// empty password makes the default user passwordless again.
 func (r *Router) SetRequirePass(password string) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	r.requirePass = password
+	if password == "" {
+		r.acl.DefaultUser.RemovePasswords()
+	} else {
+		r.acl.DefaultUser.SetPassword(password)
+	}
 }
 
 func (r *Router) RequirePass() string {
@@ -76,7 +105,40 @@ func (r *Router) PasswordHash() string {
 	return hex.EncodeToString(hash[:])
 }
 
+// ACL returns the router's users.
+func (r *Router) ACL() *acl.ACL {
+	return r.acl
+}
+
+// SetACLFile configures the file used by ACL LOAD and ACL SAVE and loads the
+// users it defines, if it exists.
+func (r *Router) SetACLFile(path string) error {
+	r.mu.Lock()
+	r.aclFile = path
+	r.mu.Unlock()
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	return r.acl.LoadFile(path)
+}
+
+func (r *Router) ACLFile() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.aclFile
+}
+
+// authRequired reports whether connections must authenticate before running
+// commands: only when the default user has a password or is disabled.
+func (r *Router) authRequired() bool {
+	def, ok := r.acl.GetUser("default")
+	return !ok || !def.IsEnabled() || !def.IsNoPassword()
+}
+
+// Register adds a command. Arity, flags and key positions left unset are
+// taken from the built-in command table.
 func (r *Router) Register(def *CommandDef) {
+	applyCommandSpec(def)
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	r.commands[def.Name] = def
@@ -89,6 +151,15 @@ func (r *Router) Get(name string) (*CommandDef, bool) {
 	return cmd, ok
 }
 
+// Keys returns the keys a call of the named command with args takes.
+func (r *Router) Keys(name string, args [][]byte) []string {
+	def, ok := r.Get(strings.ToUpper(name))
+	if !ok {
+		return nil
+	}
+	return def.keys(args)
+}
+
 // Commands that are allowed before authentication
 var noAuthCommands = map[string]bool{
 	"AUTH":    true,
@@ -99,37 +170,230 @@ var noAuthCommands = map[string]bool{
 	"COMMAND": true,
 }
 
-func (r *Router) SetPostExecute(fn func(cmd string, args [][]byte)) {
+// Commands that control the transaction itself run immediately even while a
+// MULTI block is open; everything else is queued until EXEC.
+var txControlCommands = map[string]bool{
+	"MULTI":   true,
+	"EXEC":    true,
+	"DISCARD": true,
+	"WATCH":   true,
+	"UNWATCH": true,
+	"QUIT":    true,
+	"RESET":   true,
+}
+
+// Commands a RESP2 client may still issue while it has subscriptions.
+var subscribedModeCommands = map[string]bool{
+	"SUBSCRIBE":    true,
+	"PSUBSCRIBE":   true,
+	"SSUBSCRIBE":   true,
+	"UNSUBSCRIBE":  true,
+	"PUNSUBSCRIBE": true,
+	"SUNSUBSCRIBE": true,
+	"PING":         true,
+	"QUIT":         true,
+	"RESET":        true,
+}
+
+// SetPostExecute sets the hook that receives every write once it has run,
+// with the namespace it applied to, in the form to append to the AOF:
+// relative expirations are made absolute and commands with a random
+// outcome are replaced by their effects.
+func (r *Router) SetPostExecute(fn func(namespace, cmd string, args [][]byte)) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	r.postExecute = fn
 }
 
+// SetReplicationFeed sets the hook that receives the same writes as the
+// post-execute hook, with the namespace they applied to, for the
+// replication stream.
+func (r *Router) SetReplicationFeed(fn func(namespace, cmd string, args [][]byte)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.replicate = fn
+}
+
+// PauseWrites runs fn while no write command is between its execution and
+// its post-execute hook, so state captured by fn agrees with what the hook
+// has seen. Blocking commands are not waited for, as they can sit in their
+// handler until a timeout.
+func (r *Router) PauseWrites(fn func()) {
+	r.writes.Lock()
+	defer r.writes.Unlock()
+	fn()
+}
+
 func (r *Router) Execute(ctx *Context) error {
+	ctx.Command = strings.ToUpper(ctx.Command)
 	cmd, ok := r.Get(ctx.Command)
 	if !ok {
+		ctx.abortTransaction()
 		return ErrUnknownCommand
 	}
+	if !cmd.checkArity(len(ctx.Args) + 1) {
+		ctx.abortTransaction()
+		return ctx.Writer.WriteError("ERR wrong number of arguments for '" + strings.ToLower(ctx.Command) + "' command")
+	}
 
-	// Enforce authentication if requirepass is set
-	upperCmd := strings.ToUpper(ctx.Command)
-	if r.RequirePass() != "" && !ctx.IsAuthenticated() && !noAuthCommands[upperCmd] {
+	// Enforce authentication if the default user has a password
+	if !ctx.IsAuthenticated() && !noAuthCommands[ctx.Command] && r.authRequired() {
+		ctx.abortTransaction()
 		return ctx.Writer.WriteError("NOAUTH Authentication required.")
 	}
 
+	aclContext := aclContextTopLevel
+	if ctx.Transaction != nil && ctx.Transaction.IsActive() {
+		aclContext = aclContextMulti
+	}
+	if !ctx.checkACL(aclContext) {
+		ctx.abortTransaction()
+		return nil
+	}
+
+	// A RESP2 connection with active subscriptions only carries pub/sub frames
+	if ctx.inSubscribedMode() && !subscribedModeCommands[ctx.Command] {
+		return ctx.Writer.WriteError("ERR Can't execute '" + strings.ToLower(ctx.Command) +
+			"': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context")
+	}
+
+	if cmd.HasFlag(FlagDenyOOM) && ctx.Store != nil && ctx.Store.OverMemoryLimit() {
+		ctx.abortTransaction()
+		return ctx.Writer.WriteError(store.ErrMemoryLimit.Error() + ".")
+	}
+	if msg := replicationDenial(cmd); msg != "" {
+		ctx.abortTransaction()
+		return ctx.Writer.WriteError(msg)
+	}
+
+	// Inside MULTI, commands are queued and run by EXEC
+	if ctx.Transaction != nil && ctx.Transaction.IsActive() && !txControlCommands[ctx.Command] {
+		if cmd.HasFlag(FlagNoMulti) {
+			ctx.abortTransaction()
+			return ctx.Writer.WriteError("ERR Command not allowed inside a transaction")
+		}
+		ctx.Transaction.Queue(ctx.Command, ctx.Args)
+		return ctx.Writer.WriteQueued()
+	}
+
+	err := r.dispatch(ctx, cmd)
+	consumeCaching(ctx)
+	return err
+}
+
+// replicationDenial returns the error refusing cmd from a client because of
+// the node's replication state, or "": writes on a read-only replica, data
+// commands on a replica that lost its master with
+// replica-serve-stale-data off, and writes on a master with fewer good
+// replicas than min-replicas-to-write.
+func replicationDenial(cmd *CommandDef) string {
+	isWrite := cmd.HasFlag(FlagWrite)
+	switch {
+	case isWrite && readOnlyReplica():
+		return "READONLY You can't write against a read only replica."
+	case !cmd.HasFlag(FlagStale) && staleReplica():
+		return "MASTERDOWN Link with MASTER is down and replica-serve-stale-data is set to 'no'."
+	case isWrite && !enoughReplicas():
+		return "NOREPLICAS Not enough good replicas to write."
+	}
+	return ""
+}
+
+// dispatch runs a resolved command and its post-execute hook. Checks that
+// apply at queue time (auth, MULTI) have already been done by the caller.
+func (r *Router) dispatch(ctx *Context, cmd *CommandDef) error {
 	ctx.StartTime = time.Now()
+	if ctx.Session != nil {
+		ctx.Session.Touch(ctx.Command)
+	}
+	feedMonitors(ctx)
+	isWrite := cmd.HasFlag(FlagWrite)
+	var key string
+	var version int64
+	// Scripts and EXEC hold the barrier for as long as they run: scripts
+	// guard the keys of each write they make (see scriptCaller.call), and
+	// the commands EXEC runs are covered by its hold.
+	if (isWrite || cmd.HasFlag(FlagMayReplicate)) && !cmd.HasFlag(FlagBlocking) && ctx.exec == nil {
+		r.writes.RLock()
+		defer r.writes.RUnlock()
+	}
+	if isWrite {
+		trackWriteStart(ctx)
+		if keys := cmd.keys(ctx.Args); len(keys) > 0 {
+			// A snapshot being saved must not see the in-place changes
+			// the handler is about to make, nor the disk tier move the
+			// values while it makes them.
+			ctx.Store.PreserveForSnapshot(keys)
+			defer ctx.Store.BeginWrite(keys)()
+			key = keys[0]
+			version = ctx.Store.GetVersion(key)
+		}
+	} else if cmd.HasFlag(FlagReadOnly) {
+		// Registered before the read, so that a write landing between the
+		// two still invalidates what the client caches.
+		trackRead(ctx, cmd)
+	}
 	err := cmd.Handler(ctx)
 
-	// Post-execute hook (AOF persistence)
-	if err == nil && r.postExecute != nil {
-		r.postExecute(ctx.Command, ctx.Args)
+	if err == nil && key != "" {
+		// In-place mutations (HSET, LPUSH, ...) bypass Store.Set, so bump the
+		// version here for WATCH and tracking unless the store already did.
+		// Deleted keys were handled by the store.
+		if ctx.Store.GetVersion(key) == version && ctx.Store.Exists(key) {
+			ctx.Store.IncrementVersion(key)
+		}
+	}
+	if isWrite {
+		trackWriteEnd(ctx)
+	}
+
+	// Post-execute hook (AOF persistence): write commands, and others such
+	// as scripts that recorded the writes they made
+	if err == nil && (isWrite || ctx.rewritten) {
+		r.propagate(ctx)
 	}
 
 	return err
 }
 
-// ExecuteSilent runs a command without auth checks or post-execute hooks.
-// Used for AOF replay where Writer may be nil — creates a discard writer.
+// propagate passes what a command sends to the AOF to the post-execute hook
+// and the replication feed. The commands EXEC runs hand theirs to it, and
+// it sends them together between MULTI and EXEC, so that they are applied
+// as one.
+func (r *Router) propagate(ctx *Context) {
+	cmds := ctx.propagated()
+	if ctx.exec != nil {
+		for _, c := range cmds {
+			ctx.exec.propagate(c.name, c.args...)
+		}
+		return
+	}
+	r.mu.RLock()
+	postExecute, replicate := r.postExecute, r.replicate
+	r.mu.RUnlock()
+	if postExecute == nil && replicate == nil || len(cmds) == 0 {
+		return
+	}
+	if ctx.Command == "EXEC" {
+		cmds = append(append([]propagatedCommand{{name: "MULTI"}}, cmds...), propagatedCommand{name: "EXEC"})
+	}
+	for _, c := range cmds {
+		if postExecute != nil {
+			postExecute(ctx.Namespace, c.name, c.args)
+		}
+		if replicate != nil {
+			replicate(ctx.Namespace, c.name, c.args)
+		}
+	}
+}
+
+// ExecuteSilent runs a command without the checks made for clients (auth,
+// ACLs, read-only replica, memory limit), discarding the reply when Writer
+// is nil. Used for AOF replay, which happens before the post-execute hook
+// is set, and by replicas for the master's command stream, whose writes
+// still reach their own AOF through the hook. Inside MULTI, commands are
+// queued for EXEC as they are for clients, so that a transaction applies
+// as one, and one cut short by the end of the AOF not at all.
 func (r *Router) ExecuteSilent(ctx *Context) error {
 	cmd, ok := r.Get(ctx.Command)
 	if !ok {
@@ -139,36 +403,43 @@ func (r *Router) ExecuteSilent(ctx *Context) error {
 		ctx.Writer = resp.NewWriter(io.Discard)
 	}
 	ctx.Authenticated = true
-	ctx.StartTime = time.Now()
-	return cmd.Handler(ctx)
+	if ctx.Transaction != nil && ctx.Transaction.IsActive() && !txControlCommands[ctx.Command] {
+		ctx.Transaction.Queue(ctx.Command, ctx.Args)
+		return nil
+	}
+	return r.dispatch(ctx, cmd)
 }
 
-// ExecuteHTTP runs a command from the HTTP API with auth enforcement and post-execute hooks.
-// Returns the result as an interface{} suitable for JSON serialization.
+// ExecuteHTTP runs a command from the HTTP API, which authenticates
+// requests itself, with the checks made for clients otherwise (arity, ACLs,
+// replication state, memory limit), and returns the result as a value
+// suitable for JSON.
 func (r *Router) ExecuteHTTP(ctx *Context) (interface{}, error) {
+	ctx.Command = strings.ToUpper(ctx.Command)
 	cmd, ok := r.Get(ctx.Command)
 	if !ok {
 		return nil, ErrUnknownCommand
 	}
-
-	// Create a capture writer to collect the response
-	ctx.Authenticated = true // HTTP auth is handled by HTTP middleware
-	ctx.StartTime = time.Now()
+	if !cmd.checkArity(len(ctx.Args) + 1) {
+		return nil, errors.New("ERR wrong number of arguments for '" + strings.ToLower(ctx.Command) + "' command")
+	}
+	ctx.Authenticated = true
 	if ctx.Writer == nil {
 		ctx.Writer = resp.NewWriter(io.Discard)
 	}
-
-	err := cmd.Handler(ctx)
-	if err != nil {
-		return nil, err
+	if msg := ctx.aclError(aclContextTopLevel); msg != "" {
+		return nil, errors.New(msg)
 	}
-
-	// Post-execute hook (AOF persistence)
-	if r.postExecute != nil {
-		r.postExecute(ctx.Command, ctx.Args)
+	if cmd.HasFlag(FlagDenyOOM) && ctx.Store.OverMemoryLimit() {
+		return nil, errors.New(store.ErrMemoryLimit.Error() + ".")
 	}
-
-	// Return a simple acknowledgement - the actual response was written to the RESP writer
+	if msg := replicationDenial(cmd); msg != "" {
+		return nil, errors.New(msg)
+	}
+	if err := r.dispatch(ctx, cmd); err != nil {
+		return nil, err
+	}
+	// The reply went to the RESP writer; the API only acknowledges it
 	return "OK", nil
 }
 
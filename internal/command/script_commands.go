@@ -48,7 +48,7 @@ func cmdEVAL(ctx *Context) error {
 		args = append(args, ctx.ArgString(i))
 	}
 
-	result, err := scriptEngine.Eval(script, keys, args)
+	result, err := scriptEngine.evalIn(ctx.scriptCaller(), script, keys, args)
 	if err != nil {
 		return ctx.WriteError(err)
 	}
@@ -85,7 +85,7 @@ func cmdEVALSHA(ctx *Context) error {
 		args = append(args, ctx.ArgString(i))
 	}
 
-	result, err := scriptEngine.EvalSHA(sha, keys, args)
+	result, err := scriptEngine.evalSHAIn(ctx.scriptCaller(), sha, keys, args)
 	if err != nil {
 		return ctx.WriteError(err)
 	}
@@ -204,3 +204,18 @@ func goValueToResp(v interface{}) *resp.Value {
 		return resp.BulkString("")
 	}
 }
+
+// scriptCaller describes the client running a script, for MONITOR and ACL
+// checks of its redis.call commands, the namespace they apply to and the
+// propagation of its writes.
+func (ctx *Context) scriptCaller() scriptCaller {
+	caller := scriptCaller{db: "0", store: ctx.Store, propagate: ctx.propagate}
+	if ctx.Session != nil {
+		caller.db = monitorDB(ctx.Session)
+	}
+	if user, ok := ctx.currentACLUser(); ok && !user.Unrestricted() {
+		caller.user = user
+		caller.clientInfo = ctx.aclClientInfo()
+	}
+	return caller
+}
@@ -11,17 +11,18 @@ import (
 	"sync"
 	"time"
 
-	"github.com/cachestorm/cachestorm/internal/acl"
+	"github.com/cachestorm/cachestorm/internal/persistence"
 	"github.com/cachestorm/cachestorm/internal/resp"
 	"github.com/cachestorm/cachestorm/internal/store"
 )
 
-var globalACL = acl.NewACL()
+const serverVersion = "0.2.0"
 
 func RegisterServerCommands(router *Router) {
 	router.Register(&CommandDef{Name: "PING", Handler: cmdPING})
 	router.Register(&CommandDef{Name: "ECHO", Handler: cmdECHO})
 	router.Register(&CommandDef{Name: "QUIT", Handler: cmdQUIT})
+	router.Register(&CommandDef{Name: "RESET", Handler: cmdRESET})
 	router.Register(&CommandDef{Name: "COMMAND", Handler: cmdCOMMAND})
 	router.Register(&CommandDef{Name: "INFO", Handler: cmdINFO})
 	router.Register(&CommandDef{Name: "DBSIZE", Handler: cmdDBSIZE})
@@ -29,6 +30,7 @@ func RegisterServerCommands(router *Router) {
 	router.Register(&CommandDef{Name: "FLUSHALL", Handler: cmdFLUSHALL})
 	router.Register(&CommandDef{Name: "TIME", Handler: cmdTIME})
 	router.Register(&CommandDef{Name: "AUTH", Handler: cmdAUTH})
+	router.Register(&CommandDef{Name: "HELLO", Handler: cmdHELLO})
 	router.Register(&CommandDef{Name: "SCAN", Handler: cmdSCAN})
 	router.Register(&CommandDef{Name: "HOTKEYS", Handler: cmdHOTKEYS})
 	router.Register(&CommandDef{Name: "MEMINFO", Handler: cmdMEMINFO})
@@ -78,6 +80,7 @@ func RegisterKeyCommands(router *Router) {
 	router.Register(&CommandDef{Name: "UNLINK", Handler: cmdDEL})
 	router.Register(&CommandDef{Name: "TOUCH", Handler: cmdTOUCH})
 	router.Register(&CommandDef{Name: "DUMP", Handler: cmdDUMP})
+	router.Register(&CommandDef{Name: "DUMPALL", Handler: cmdDUMPALL})
 	router.Register(&CommandDef{Name: "RESTORE", Handler: cmdRESTORE})
 	router.Register(&CommandDef{Name: "COPY", Handler: cmdCOPY})
 	router.Register(&CommandDef{Name: "MOVE", Handler: cmdMOVE})
@@ -85,6 +88,15 @@ func RegisterKeyCommands(router *Router) {
 }
 
 func cmdPING(ctx *Context) error {
+	// In subscribed mode the reply is a pong frame so clients can tell it
+	// apart from published messages.
+	if ctx.inSubscribedMode() {
+		payload := resp.BulkString("")
+		if ctx.ArgCount() > 0 {
+			payload = resp.BulkBytes(ctx.Arg(0))
+		}
+		return ctx.WriteArray([]*resp.Value{resp.BulkString("pong"), payload})
+	}
 	if ctx.ArgCount() == 0 {
 		return ctx.WriteSimpleString("PONG")
 	}
@@ -103,230 +115,313 @@ func cmdQUIT(ctx *Context) error {
 	return nil
 }
 
+func cmdRESET(ctx *Context) error {
+	if ctx.Session != nil {
+		ctx.Session.Reset()
+	} else {
+		ctx.GetTransaction().Clear()
+		ctx.GetTransaction().ClearWatch()
+	}
+	if ctx.Subscriber != nil {
+		if ps := ctx.Store.GetPubSub(); ps != nil {
+			ps.UnsubscribeAll(ctx.Subscriber)
+		}
+	}
+	ctx.SetAuthenticated(globalRouter == nil || !globalRouter.authRequired())
+	ctx.SetUsername("default")
+	ctx.SetProtocol(2)
+	return ctx.WriteSimpleString("RESET")
+}
+
 func cmdCOMMAND(ctx *Context) error {
-	if ctx.ArgCount() > 0 {
-		subCmd := strings.ToUpper(ctx.ArgString(0))
-		switch subCmd {
-		case "COUNT":
-			return ctx.WriteInteger(200)
-		case "DOCS":
-			return cmdCommandDocs(ctx)
-		case "GETKEYS":
-			return cmdCommandGetKeys(ctx)
-		case "LIST":
-			commands := []string{
-				"GET", "SET", "DEL", "EXISTS", "KEYS", "EXPIRE", "TTL", "TYPE",
-				"INCR", "DECR", "INCRBY", "DECRBY", "INCRBYFLOAT",
-				"APPEND", "STRLEN", "GETRANGE", "SETRANGE", "GETSET", "GETEX", "GETDEL",
-				"MGET", "MSET", "SETNX", "SUBSTR", "LCS", "COPY",
-				"HSET", "HGET", "HDEL", "HGETALL", "HKEYS", "HVALS", "HEXISTS", "HLEN",
-				"HINCRBY", "HINCRBYFLOAT", "HMGET", "HMSET", "HSETNX", "HSTRLEN",
-				"HRANDFIELD", "HGETDEL", "HGETEX", "HSCAN",
-				"LPUSH", "RPUSH", "LPOP", "RPOP", "LLEN", "LRANGE", "LINDEX", "LSET",
-				"LREM", "LTRIM", "BLPOP", "BRPOP", "BRPOPLPUSH", "RPOPLPUSH",
-				"LMOVE", "LPOS", "LMPOP", "LMPUSH", "LPUSHX", "RPUSHX", "LINSERT",
-				"SADD", "SREM", "SMEMBERS", "SISMEMBER", "SCARD", "SPOP", "SRANDMEMBER",
-				"SMOVE", "SUNION", "SINTER", "SDIFF", "SUNIONSTORE", "SINTERSTORE", "SDIFFSTORE", "SSCAN",
-				"ZADD", "ZCARD", "ZCOUNT", "ZRANGE", "ZRANGEBYSCORE", "ZRANK", "ZREM",
-				"ZSCORE", "ZINCRBY", "ZREVRANGE", "ZREVRANK", "ZREMRANGEBYRANK", "ZREMRANGEBYSCORE",
-				"ZPOPMIN", "ZPOPMAX", "ZRANDMEMBER", "ZMSCORE",
-				"ZUNIONSTORE", "ZINTERSTORE", "ZDIFFSTORE", "ZSCAN",
-				"XADD", "XLEN", "XRANGE", "XREVRANGE", "XREAD", "XDEL", "XTRIM", "XINFO", "XGROUP",
-				"XREADGROUP", "XACK", "XPENDING", "XCLAIM",
-				"GEOADD", "GEODIST", "GEOHASH", "GEOPOS", "GEORADIUS", "GEORADIUSBYMEMBER",
-				"PING", "ECHO", "QUIT", "COMMAND", "INFO", "DBSIZE", "FLUSHDB", "FLUSHALL", "TIME",
-				"CLIENT", "CONFIG", "SCAN", "SORT", "SORT_RO",
-				"SLOWLOG", "WAIT", "ROLE", "LASTSAVE", "LOLWUT", "SHUTDOWN",
-				"SAVE", "BGSAVE", "BGREWRITEAOF", "SLAVEOF", "REPLICAOF", "LATENCY",
-				"STRALGO", "MODULE", "ACL", "MONITOR", "SWAPDB", "SYNC", "PSYNC",
-				"MULTI", "EXEC", "DISCARD", "WATCH", "UNWATCH",
-				"SUBSCRIBE", "UNSUBSCRIBE", "PUBLISH", "PSUBSCRIBE", "PUNSUBSCRIBE", "PUBSUB",
-				"SETBIT", "GETBIT", "BITCOUNT", "BITPOS", "BITOP", "BITFIELD",
-				"PFADD", "PFCOUNT", "PFMERGE",
-				"EVAL", "EVALSHA", "SCRIPT",
-				"SETTAG", "TAGKEYS", "TAGCOUNT", "TAGDEL", "TAGINFO", "INVALIDATE",
-				"NAMESPACES", "NSCREATE", "NSDEL", "NSINFO", "NSKEYS",
-				"CLUSTER", "CLUSTERINFO", "CLUSTERNODES", "CLUSTERSLOTS", "MIGRATE",
-				"DEBUG", "OBJECT", "MEMORY", "HOTKEYS", "MEMINFO",
-				"RENAME", "RENAMENX", "RANDOMKEY", "TOUCH", "DUMP", "RESTORE", "UNLINK",
-				"PERSIST", "PEXPIRE", "EXPIREAT", "PEXPIREAT", "PTTL",
-				"AUTH", "ASKING", "READONLY", "READWRITE",
-			}
-			result := make([]*resp.Value, 0, len(commands))
-			for _, cmd := range commands {
-				result = append(result, resp.BulkString(cmd))
+	if ctx.ArgCount() == 0 {
+		return ctx.WriteArray(commandInfos(registeredCommands()))
+	}
+	subCmd := strings.ToUpper(ctx.ArgString(0))
+	switch subCmd {
+	case "COUNT":
+		return ctx.WriteInteger(int64(len(registeredCommands())))
+	case "INFO":
+		if ctx.ArgCount() == 1 {
+			return ctx.WriteArray(commandInfos(registeredCommands()))
+		}
+		result := make([]*resp.Value, 0, ctx.ArgCount()-1)
+		for _, name := range ctx.Args[1:] {
+			if def, ok := lookupCommand(strings.ToUpper(string(name))); ok {
+				result = append(result, commandInfo(def))
+			} else {
+				result = append(result, resp.NullArray())
 			}
-			return ctx.WriteArray(result)
-		default:
-			return ctx.WriteError(fmt.Errorf("ERR unknown subcommand '%s'", subCmd))
 		}
+		return ctx.WriteArray(result)
+	case "DOCS":
+		return cmdCommandDocs(ctx)
+	case "GETKEYS":
+		return cmdCommandGetKeys(ctx)
+	case "LIST":
+		return cmdCommandList(ctx)
+	default:
+		return ctx.WriteError(fmt.Errorf("ERR unknown subcommand '%s'", subCmd))
 	}
-	return ctx.WriteArray([]*resp.Value{})
 }
 
-func cmdCommandDocs(ctx *Context) error {
-	if ctx.ArgCount() < 2 {
-		return ctx.WriteError(ErrWrongArgCount)
+// registeredCommands returns the router's commands sorted by name.
+func registeredCommands() []*CommandDef {
+	if globalRouter == nil {
+		return nil
+	}
+	commands := globalRouter.Commands()
+	defs := make([]*CommandDef, 0, len(commands))
+	for _, def := range commands {
+		defs = append(defs, def)
 	}
+	sort.Slice(defs, func(i, j int) bool { return defs[i].Name < defs[j].Name })
+	return defs
+}
+
+func commandInfos(defs []*CommandDef) []*resp.Value {
+	result := make([]*resp.Value, len(defs))
+	for i, def := range defs {
+		result[i] = commandInfo(def)
+	}
+	return result
+}
 
-	commandName := strings.ToUpper(ctx.ArgString(1))
-
-	docs := map[string][]interface{}{
-		"GET":         {"summary", "Get the value of a key", "since", "1.0.0", "group", "string", "complexity", "O(1)"},
-		"SET":         {"summary", "Set the string value of a key", "since", "1.0.0", "group", "string", "complexity", "O(1)"},
-		"DEL":         {"summary", "Delete a key", "since", "1.0.0", "group", "generic", "complexity", "O(N) where N is the number of keys"},
-		"EXISTS":      {"summary", "Determine if a key exists", "since", "1.0.0", "group", "generic", "complexity", "O(1)"},
-		"EXPIRE":      {"summary", "Set a key's time to live in seconds", "since", "1.0.0", "group", "generic", "complexity", "O(1)"},
-		"TTL":         {"summary", "Get the time to live for a key in seconds", "since", "1.0.0", "group", "generic", "complexity", "O(1)"},
-		"TYPE":        {"summary", "Determine the type stored at key", "since", "1.0.0", "group", "generic", "complexity", "O(1)"},
-		"KEYS":        {"summary", "Find all keys matching the given pattern", "since", "1.0.0", "group", "generic", "complexity", "O(N) where N is the number of keys"},
-		"INCR":        {"summary", "Increment the integer value of a key by one", "since", "1.0.0", "group", "string", "complexity", "O(1)"},
-		"DECR":        {"summary", "Decrement the integer value of a key by one", "since", "1.0.0", "group", "string", "complexity", "O(1)"},
-		"INCRBY":      {"summary", "Increment the integer value of a key by the given amount", "since", "1.0.0", "group", "string", "complexity", "O(1)"},
-		"APPEND":      {"summary", "Append a value to a key", "since", "2.0.0", "group", "string", "complexity", "O(1)"},
-		"STRLEN":      {"summary", "Get the length of the value stored in a key", "since", "2.2.0", "group", "string", "complexity", "O(1)"},
-		"MGET":        {"summary", "Get the values of all the given keys", "since", "1.0.0", "group", "string", "complexity", "O(N) where N is the number of keys"},
-		"MSET":        {"summary", "Set multiple keys to multiple values", "since", "1.0.1", "group", "string", "complexity", "O(N) where N is the number of keys"},
-		"HSET":        {"summary", "Set the string value of a hash field", "since", "2.0.0", "group", "hash", "complexity", "O(1) for each field/value pair"},
-		"HGET":        {"summary", "Get the value of a hash field", "since", "2.0.0", "group", "hash", "complexity", "O(1)"},
-		"HDEL":        {"summary", "Delete one or more hash fields", "since", "2.0.0", "group", "hash", "complexity", "O(N) where N is the number of fields"},
-		"HGETALL":     {"summary", "Get all the fields and values in a hash", "since", "2.0.0", "group", "hash", "complexity", "O(N) where N is the size of the hash"},
-		"HKEYS":       {"summary", "Get all the fields in a hash", "since", "2.0.0", "group", "hash", "complexity", "O(N) where N is the size of the hash"},
-		"HVALS":       {"summary", "Get all the values in a hash", "since", "2.0.0", "group", "hash", "complexity", "O(N) where N is the size of the hash"},
-		"HEXISTS":     {"summary", "Determine if a hash field exists", "since", "2.0.0", "group", "hash", "complexity", "O(1)"},
-		"HLEN":        {"summary", "Get the number of fields in a hash", "since", "2.0.0", "group", "hash", "complexity", "O(1)"},
-		"LPUSH":       {"summary", "Prepend one or multiple elements to a list", "since", "1.0.0", "group", "list", "complexity", "O(1) for each element"},
-		"RPUSH":       {"summary", "Append one or multiple elements to a list", "since", "1.0.0", "group", "list", "complexity", "O(1) for each element"},
-		"LPOP":        {"summary", "Remove and get the first element in a list", "since", "1.0.0", "group", "list", "complexity", "O(1)"},
-		"RPOP":        {"summary", "Remove and get the last element in a list", "since", "1.0.0", "group", "list", "complexity", "O(1)"},
-		"LLEN":        {"summary", "Get the length of a list", "since", "1.0.0", "group", "list", "complexity", "O(1)"},
-		"LRANGE":      {"summary", "Get a range of elements from a list", "since", "1.0.0", "group", "list", "complexity", "O(S+N) where S is start offset"},
-		"BLPOP":       {"summary", "Remove and get the first element in a list, or block until one is available", "since", "2.0.0", "group", "list", "complexity", "O(1)"},
-		"BRPOP":       {"summary", "Remove and get the last element in a list, or block until one is available", "since", "2.0.0", "group", "list", "complexity", "O(1)"},
-		"SADD":        {"summary", "Add one or more members to a set", "since", "1.0.0", "group", "set", "complexity", "O(1) for each element"},
-		"SREM":        {"summary", "Remove one or more members from a set", "since", "1.0.0", "group", "set", "complexity", "O(1) for each element"},
-		"SMEMBERS":    {"summary", "Get all the members in a set", "since", "1.0.0", "group", "set", "complexity", "O(N) where N is the set cardinality"},
-		"SISMEMBER":   {"summary", "Determine if a given value is a member of a set", "since", "1.0.0", "group", "set", "complexity", "O(1)"},
-		"SCARD":       {"summary", "Get the number of members in a set", "since", "1.0.0", "group", "set", "complexity", "O(1)"},
-		"SPOP":        {"summary", "Remove and return one or multiple random members from a set", "since", "1.0.0", "group", "set", "complexity", "O(1)"},
-		"SUNION":      {"summary", "Add multiple sets", "since", "1.0.0", "group", "set", "complexity", "O(N) where N is the total number of elements"},
-		"SINTER":      {"summary", "Intersect multiple sets", "since", "1.0.0", "group", "set", "complexity", "O(N*M) worst case"},
-		"SDIFF":       {"summary", "Subtract multiple sets", "since", "1.0.0", "group", "set", "complexity", "O(N) where N is the total number of elements"},
-		"ZADD":        {"summary", "Add one or more members to a sorted set, or update its score", "since", "1.2.0", "group", "sorted_set", "complexity", "O(log(N)) for each element"},
-		"ZCARD":       {"summary", "Get the number of members in a sorted set", "since", "1.2.0", "group", "sorted_set", "complexity", "O(1)"},
-		"ZSCORE":      {"summary", "Get the score associated with the given member in a sorted set", "since", "1.2.0", "group", "sorted_set", "complexity", "O(1)"},
-		"ZRANGE":      {"summary", "Return a range of members in a sorted set", "since", "1.2.0", "group", "sorted_set", "complexity", "O(log(N)+M) with M being the number of elements"},
-		"ZRANK":       {"summary", "Determine the index of a member in a sorted set", "since", "2.0.0", "group", "sorted_set", "complexity", "O(log(N))"},
-		"ZREM":        {"summary", "Remove one or more members from a sorted set", "since", "1.2.0", "group", "sorted_set", "complexity", "O(M*log(N))"},
-		"XADD":        {"summary", "Add a new entry to a stream", "since", "5.0.0", "group", "stream", "complexity", "O(1)"},
-		"XREAD":       {"summary", "Return never seen elements from multiple streams", "since", "5.0.0", "group", "stream", "complexity", "O(N) with N being the number of elements"},
-		"XGROUP":      {"summary", "Create, destroy, and manage consumer groups", "since", "5.0.0", "group", "stream", "complexity", "O(1)"},
-		"PING":        {"summary", "Ping the server", "since", "1.0.0", "group", "connection", "complexity", "O(1)"},
-		"ECHO":        {"summary", "Echo the given string", "since", "1.0.0", "group", "connection", "complexity", "O(1)"},
-		"QUIT":        {"summary", "Close the connection", "since", "1.0.0", "group", "connection", "complexity", "O(1)"},
-		"INFO":        {"summary", "Get information and statistics about the server", "since", "1.0.0", "group", "server", "complexity", "O(1)"},
-		"DBSIZE":      {"summary", "Return the number of keys in the selected database", "since", "1.0.0", "group", "server", "complexity", "O(1)"},
-		"FLUSHDB":     {"summary", "Remove all keys from the current database", "since", "1.0.0", "group", "server", "complexity", "O(1)"},
-		"FLUSHALL":    {"summary", "Remove all keys from all databases", "since", "1.0.0", "group", "server", "complexity", "O(1)"},
-		"TIME":        {"summary", "Return the current server time", "since", "2.6.0", "group", "server", "complexity", "O(1)"},
-		"CLIENT":      {"summary", "The client command", "since", "2.4.0", "group", "server", "complexity", "O(1)"},
-		"CONFIG":      {"summary", "Get or set server configuration", "since", "2.0.0", "group", "server", "complexity", "O(1)"},
-		"SLOWLOG":     {"summary", "Manages the Redis slow queries log", "since", "2.2.12", "group", "server", "complexity", "O(1)"},
-		"MULTI":       {"summary", "Mark the start of a transaction block", "since", "1.2.0", "group", "transactions", "complexity", "O(1)"},
-		"EXEC":        {"summary", "Execute all commands issued after MULTI", "since", "1.2.0", "group", "transactions", "complexity", "O(1)"},
-		"DISCARD":     {"summary", "Discard all commands issued after MULTI", "since", "2.0.0", "group", "transactions", "complexity", "O(1)"},
-		"WATCH":       {"summary", "Watch the given keys to determine execution of the MULTI/EXEC block", "since", "2.2.0", "group", "transactions", "complexity", "O(1)"},
-		"UNWATCH":     {"summary", "Forget about all watched keys", "since", "2.2.0", "group", "transactions", "complexity", "O(1)"},
-		"PUBLISH":     {"summary", "Post a message to a channel", "since", "2.0.0", "group", "pubsub", "complexity", "O(N+M)"},
-		"SUBSCRIBE":   {"summary", "Subscribe to channels", "since", "2.0.0", "group", "pubsub", "complexity", "O(1)"},
-		"UNSUBSCRIBE": {"summary", "Unsubscribe from channels", "since", "2.0.0", "group", "pubsub", "complexity", "O(1)"},
-		"EVAL":        {"summary", "Execute a Lua script server side", "since", "2.6.0", "group", "scripting", "complexity", "O(1)"},
-		"EVALSHA":     {"summary", "Execute a Lua script server side", "since", "2.6.0", "group", "scripting", "complexity", "O(1)"},
-		"SCRIPT":      {"summary", "Manage the script cache", "since", "2.6.0", "group", "scripting", "complexity", "O(1)"},
-		"GEOADD":      {"summary", "Add one or more geospatial items", "since", "3.2.0", "group", "geo", "complexity", "O(1) for each element"},
-		"GEODIST":     {"summary", "Returns the distance between two members", "since", "3.2.0", "group", "geo", "complexity", "O(log(N))"},
-		"GEOHASH":     {"summary", "Returns members of a geospatial index as standard geohash strings", "since", "3.2.0", "group", "geo", "complexity", "O(log(N))"},
-		"GEOPOS":      {"summary", "Returns longitude and latitude of members", "since", "3.2.0", "group", "geo", "complexity", "O(N)"},
-		"SETBIT":      {"summary", "Sets or clears the bit at offset in the string value", "since", "2.2.0", "group", "bitmap", "complexity", "O(1)"},
-		"GETBIT":      {"summary", "Returns the bit value at offset in the string value", "since", "2.2.0", "group", "bitmap", "complexity", "O(1)"},
-		"BITCOUNT":    {"summary", "Count set bits in a string", "since", "2.6.0", "group", "bitmap", "complexity", "O(N)"},
-		"BITPOS":      {"summary", "Find first bit set or clear in a string", "since", "2.8.7", "group", "bitmap", "complexity", "O(N)"},
-		"BITOP":       {"summary", "Perform bitwise operations between strings", "since", "2.6.0", "group", "bitmap", "complexity", "O(N)"},
-		"BITFIELD":    {"summary", "Perform arbitrary bitfield integer operations", "since", "3.2.0", "group", "bitmap", "complexity", "O(1) for each subcommand"},
-		"PFADD":       {"summary", "Adds the specified elements to the specified HyperLogLog", "since", "2.8.9", "group", "hyperloglog", "complexity", "O(1)"},
-		"PFCOUNT":     {"summary", "Return the approximated cardinality of the set", "since", "2.8.9", "group", "hyperloglog", "complexity", "O(1)"},
-		"PFMERGE":     {"summary", "Merge N different HyperLogLogs into a single one", "since", "2.8.9", "group", "hyperloglog", "complexity", "O(N)"},
-		"SCAN":        {"summary", "Incrementally iterate the keys space", "since", "2.8.0", "group", "generic", "complexity", "O(1)"},
-		"SORT":        {"summary", "Sort the elements in a list, set or sorted set", "since", "1.0.0", "group", "generic", "complexity", "O(N+M*log(M))"},
-		"OBJECT":      {"summary", "Inspect the internals of Redis objects", "since", "2.2.3", "group", "generic", "complexity", "O(1)"},
-		"MEMORY":      {"summary", "Inspect memory usage", "since", "4.0.0", "group", "server", "complexity", "O(1)"},
-	}
-
-	if doc, ok := docs[commandName]; ok {
-		result := make([]*resp.Value, 0, len(doc)+2)
-		result = append(result, resp.BulkString(commandName))
-		for i := 0; i < len(doc); i += 2 {
-			k, _ := doc[i].(string)
-			v, _ := doc[i+1].(string)
-			result = append(result, resp.BulkString(k), resp.BulkString(v))
+// commandInfo builds a COMMAND INFO entry: name, arity, flags, first key,
+// last key, key step, ACL categories, tips, key specs and subcommands.
+func commandInfo(def *CommandDef) *resp.Value {
+	flags := make([]*resp.Value, 0, len(def.Flags)+1)
+	for _, flag := range def.Flags {
+		flags = append(flags, resp.SimpleString(flag))
+	}
+	if _, ok := keyFinders[def.Name]; ok {
+		flags = append(flags, resp.SimpleString(FlagMovableKeys))
+	}
+	categories := make([]*resp.Value, 0, 4)
+	for _, category := range aclCategoriesOf(def.Name, "") {
+		categories = append(categories, resp.SimpleString("@"+category))
+	}
+	return resp.ArrayValue([]*resp.Value{
+		resp.BulkString(strings.ToLower(def.Name)),
+		resp.IntegerValue(int64(def.Arity)),
+		resp.SetValue(flags),
+		resp.IntegerValue(int64(def.FirstKey)),
+		resp.IntegerValue(int64(def.LastKey)),
+		resp.IntegerValue(int64(def.KeyStep)),
+		resp.SetValue(categories),
+		resp.ArrayValue([]*resp.Value{}),
+		resp.ArrayValue([]*resp.Value{}),
+		resp.ArrayValue([]*resp.Value{}),
+	})
+}
+
+// commandGroup maps a command to its documentation group.
+func commandGroup(name string) string {
+	for _, category := range commandCategories[name] {
+		switch category {
+		case "string", "bitmap", "hash", "list", "set", "stream", "geo", "hyperloglog",
+			"pubsub", "connection", "scripting":
+			return category
+		case "sortedset":
+			return "sorted-set"
+		case "keyspace":
+			return "generic"
+		case "transaction":
+			return "transactions"
+		}
+	}
+	return "server"
+}
+
+func cmdCommandDocs(ctx *Context) error {
+	var defs []*CommandDef
+	if ctx.ArgCount() == 1 {
+		defs = registeredCommands()
+	} else {
+		for _, name := range ctx.Args[1:] {
+			if def, ok := lookupCommand(strings.ToUpper(string(name))); ok {
+				defs = append(defs, def)
+			}
 		}
-		return ctx.WriteArray(result)
 	}
 
-	return ctx.WriteArray([]*resp.Value{})
+	pairs := make([]*resp.Value, 0, 2*len(defs))
+	for _, def := range defs {
+		doc := []*resp.Value{resp.BulkString("group"), resp.BulkString(commandGroup(def.Name))}
+		if d, ok := commandDocs[def.Name]; ok {
+			doc = append(doc,
+				resp.BulkString("summary"), resp.BulkString(d[0]),
+				resp.BulkString("since"), resp.BulkString(d[1]),
+				resp.BulkString("complexity"), resp.BulkString(d[2]))
+		}
+		pairs = append(pairs, resp.BulkString(strings.ToLower(def.Name)), resp.MapPairs(doc...))
+	}
+	return ctx.WriteValue(resp.MapPairs(pairs...))
 }
 
 func cmdCommandGetKeys(ctx *Context) error {
 	if ctx.ArgCount() < 2 {
 		return ctx.WriteError(ErrWrongArgCount)
 	}
-
-	commandName := strings.ToUpper(ctx.ArgString(1))
+	def, ok := lookupCommand(strings.ToUpper(ctx.ArgString(1)))
+	if !ok {
+		return ctx.WriteError(errors.New("ERR Invalid command specified"))
+	}
 	args := ctx.Args[2:]
+	if !def.checkArity(len(args) + 1) {
+		return ctx.WriteError(errors.New("ERR Invalid number of arguments specified for command"))
+	}
+	keys := def.keys(args)
+	if len(keys) == 0 {
+		return ctx.WriteError(errors.New("ERR The command has no key arguments"))
+	}
+	result := make([]*resp.Value, len(keys))
+	for i, key := range keys {
+		result[i] = resp.BulkString(key)
+	}
+	return ctx.WriteArray(result)
+}
 
-	var keys []*resp.Value
-
-	switch commandName {
-	case "GET", "SET", "DEL", "EXISTS", "TYPE", "TTL", "PTTL", "EXPIRE", "PEXPIRE", "PERSIST",
-		"INCR", "DECR", "INCRBY", "DECRBY", "INCRBYFLOAT", "APPEND", "STRLEN", "GETSET", "GETEX", "GETDEL",
-		"SETRANGE", "GETRANGE", "SUBSTR", "SETNX", "HGETALL", "HKEYS", "HVALS", "HLEN", "SCARD", "SMEMBERS",
-		"SPOP", "SRANDMEMBER", "LLEN", "LRANGE", "LPOP", "RPOP", "ZCARD", "ZRANGE", "ZREVRANGE", "XLEN":
-		if len(args) > 0 {
-			keys = append(keys, resp.BulkString(string(args[0])))
-		}
-	case "MGET", "MSET":
-		for i := 0; i < len(args); i++ {
-			if commandName == "MSET" && i%2 == 1 {
-				continue
+// cmdCommandList handles COMMAND LIST [FILTERBY MODULE name | ACLCAT
+// category | PATTERN pattern].
+func cmdCommandList(ctx *Context) error {
+	filter := func(*CommandDef) bool { return true }
+	switch {
+	case ctx.ArgCount() == 1:
+	case ctx.ArgCount() == 4 && strings.EqualFold(ctx.ArgString(1), "FILTERBY"):
+		value := ctx.ArgString(3)
+		switch strings.ToUpper(ctx.ArgString(2)) {
+		case "MODULE":
+			filter = func(*CommandDef) bool { return false }
+		case "ACLCAT":
+			category := strings.ToLower(value)
+			filter = func(def *CommandDef) bool {
+				for _, c := range commandCategories[def.Name] {
+					if c == category {
+						return true
+					}
+				}
+				return false
 			}
-			keys = append(keys, resp.BulkString(string(args[i])))
-		}
-	case "LPUSH", "RPUSH", "LPUSHX", "RPUSHX", "SADD", "SREM", "ZADD", "LREM", "LINDEX", "LSET", "HSET", "HGET", "HDEL", "SISMEMBER", "ZSCORE", "ZRANK", "ZREVRANK":
-		if len(args) > 0 {
-			keys = append(keys, resp.BulkString(string(args[0])))
-		}
-	case "BLPOP", "BRPOP":
-		for i := 0; i < len(args)-1; i++ {
-			keys = append(keys, resp.BulkString(string(args[i])))
-		}
-	case "RENAME", "RENAMENX", "RPOPLPUSH", "BRPOPLPUSH", "LMOVE", "BLMOVE", "SMOVE", "ZINTERSTORE", "ZUNIONSTORE", "ZDIFFSTORE", "COPY":
-		if len(args) >= 2 {
-			keys = append(keys, resp.BulkString(string(args[0])), resp.BulkString(string(args[1])))
+		case "PATTERN":
+			pattern := strings.ToLower(value)
+			filter = func(def *CommandDef) bool {
+				return matchPattern(strings.ToLower(def.Name), pattern)
+			}
+		default:
+			return ctx.WriteError(ErrSyntaxError)
 		}
-	case "SINTER", "SUNION", "SDIFF", "SINTERSTORE", "SUNIONSTORE", "SDIFFSTORE":
-		for _, arg := range args {
-			keys = append(keys, resp.BulkString(string(arg)))
+	default:
+		return ctx.WriteError(ErrSyntaxError)
+	}
+
+	result := make([]*resp.Value, 0)
+	for _, def := range registeredCommands() {
+		if filter(def) {
+			result = append(result, resp.BulkString(strings.ToLower(def.Name)))
 		}
 	}
+	return ctx.WriteArray(result)
+}
 
-	return ctx.WriteArray(keys)
+// commandDocs holds the summary, first version and complexity reported by
+// COMMAND DOCS.
+var commandDocs = map[string][3]string{
+	"GET":         {"Get the value of a key", "1.0.0", "O(1)"},
+	"SET":         {"Set the string value of a key", "1.0.0", "O(1)"},
+	"DEL":         {"Delete a key", "1.0.0", "O(N) where N is the number of keys"},
+	"EXISTS":      {"Determine if a key exists", "1.0.0", "O(1)"},
+	"EXPIRE":      {"Set a key's time to live in seconds", "1.0.0", "O(1)"},
+	"TTL":         {"Get the time to live for a key in seconds", "1.0.0", "O(1)"},
+	"TYPE":        {"Determine the type stored at key", "1.0.0", "O(1)"},
+	"KEYS":        {"Find all keys matching the given pattern", "1.0.0", "O(N) where N is the number of keys"},
+	"INCR":        {"Increment the integer value of a key by one", "1.0.0", "O(1)"},
+	"DECR":        {"Decrement the integer value of a key by one", "1.0.0", "O(1)"},
+	"INCRBY":      {"Increment the integer value of a key by the given amount", "1.0.0", "O(1)"},
+	"APPEND":      {"Append a value to a key", "2.0.0", "O(1)"},
+	"STRLEN":      {"Get the length of the value stored in a key", "2.2.0", "O(1)"},
+	"MGET":        {"Get the values of all the given keys", "1.0.0", "O(N) where N is the number of keys"},
+	"MSET":        {"Set multiple keys to multiple values", "1.0.1", "O(N) where N is the number of keys"},
+	"HSET":        {"Set the string value of a hash field", "2.0.0", "O(1) for each field/value pair"},
+	"HGET":        {"Get the value of a hash field", "2.0.0", "O(1)"},
+	"HDEL":        {"Delete one or more hash fields", "2.0.0", "O(N) where N is the number of fields"},
+	"HGETALL":     {"Get all the fields and values in a hash", "2.0.0", "O(N) where N is the size of the hash"},
+	"HKEYS":       {"Get all the fields in a hash", "2.0.0", "O(N) where N is the size of the hash"},
+	"HVALS":       {"Get all the values in a hash", "2.0.0", "O(N) where N is the size of the hash"},
+	"HEXISTS":     {"Determine if a hash field exists", "2.0.0", "O(1)"},
+	"HLEN":        {"Get the number of fields in a hash", "2.0.0", "O(1)"},
+	"LPUSH":       {"Prepend one or multiple elements to a list", "1.0.0", "O(1) for each element"},
+	"RPUSH":       {"Append one or multiple elements to a list", "1.0.0", "O(1) for each element"},
+	"LPOP":        {"Remove and get the first element in a list", "1.0.0", "O(1)"},
+	"RPOP":        {"Remove and get the last element in a list", "1.0.0", "O(1)"},
+	"LLEN":        {"Get the length of a list", "1.0.0", "O(1)"},
+	"LRANGE":      {"Get a range of elements from a list", "1.0.0", "O(S+N) where S is start offset"},
+	"BLPOP":       {"Remove and get the first element in a list, or block until one is available", "2.0.0", "O(1)"},
+	"BRPOP":       {"Remove and get the last element in a list, or block until one is available", "2.0.0", "O(1)"},
+	"SADD":        {"Add one or more members to a set", "1.0.0", "O(1) for each element"},
+	"SREM":        {"Remove one or more members from a set", "1.0.0", "O(1) for each element"},
+	"SMEMBERS":    {"Get all the members in a set", "1.0.0", "O(N) where N is the set cardinality"},
+	"SISMEMBER":   {"Determine if a given value is a member of a set", "1.0.0", "O(1)"},
+	"SCARD":       {"Get the number of members in a set", "1.0.0", "O(1)"},
+	"SPOP":        {"Remove and return one or multiple random members from a set", "1.0.0", "O(1)"},
+	"SUNION":      {"Add multiple sets", "1.0.0", "O(N) where N is the total number of elements"},
+	"SINTER":      {"Intersect multiple sets", "1.0.0", "O(N*M) worst case"},
+	"SDIFF":       {"Subtract multiple sets", "1.0.0", "O(N) where N is the total number of elements"},
+	"ZADD":        {"Add one or more members to a sorted set, or update its score", "1.2.0", "O(log(N)) for each element"},
+	"ZCARD":       {"Get the number of members in a sorted set", "1.2.0", "O(1)"},
+	"ZSCORE":      {"Get the score associated with the given member in a sorted set", "1.2.0", "O(1)"},
+	"ZRANGE":      {"Return a range of members in a sorted set", "1.2.0", "O(log(N)+M) with M being the number of elements"},
+	"ZRANK":       {"Determine the index of a member in a sorted set", "2.0.0", "O(log(N))"},
+	"ZREM":        {"Remove one or more members from a sorted set", "1.2.0", "O(M*log(N))"},
+	"XADD":        {"Add a new entry to a stream", "5.0.0", "O(1)"},
+	"XREAD":       {"Return never seen elements from multiple streams", "5.0.0", "O(N) with N being the number of elements"},
+	"XGROUP":      {"Create, destroy, and manage consumer groups", "5.0.0", "O(1)"},
+	"PING":        {"Ping the server", "1.0.0", "O(1)"},
+	"ECHO":        {"Echo the given string", "1.0.0", "O(1)"},
+	"QUIT":        {"Close the connection", "1.0.0", "O(1)"},
+	"INFO":        {"Get information and statistics about the server", "1.0.0", "O(1)"},
+	"DBSIZE":      {"Return the number of keys in the selected database", "1.0.0", "O(1)"},
+	"FLUSHDB":     {"Remove all keys from the current database", "1.0.0", "O(1)"},
+	"FLUSHALL":    {"Remove all keys from all databases", "1.0.0", "O(1)"},
+	"TIME":        {"Return the current server time", "2.6.0", "O(1)"},
+	"CLIENT":      {"The client command", "2.4.0", "O(1)"},
+	"CONFIG":      {"Get or set server configuration", "2.0.0", "O(1)"},
+	"SLOWLOG":     {"Manages the Redis slow queries log", "2.2.12", "O(1)"},
+	"MULTI":       {"Mark the start of a transaction block", "1.2.0", "O(1)"},
+	"EXEC":        {"Execute all commands issued after MULTI", "1.2.0", "O(1)"},
+	"DISCARD":     {"Discard all commands issued after MULTI", "2.0.0", "O(1)"},
+	"WATCH":       {"Watch the given keys to determine execution of the MULTI/EXEC block", "2.2.0", "O(1)"},
+	"UNWATCH":     {"Forget about all watched keys", "2.2.0", "O(1)"},
+	"PUBLISH":     {"Post a message to a channel", "2.0.0", "O(N+M)"},
+	"SUBSCRIBE":   {"Subscribe to channels", "2.0.0", "O(1)"},
+	"UNSUBSCRIBE": {"Unsubscribe from channels", "2.0.0", "O(1)"},
+	"EVAL":        {"Execute a Lua script server side", "2.6.0", "O(1)"},
+	"EVALSHA":     {"Execute a Lua script server side", "2.6.0", "O(1)"},
+	"SCRIPT":      {"Manage the script cache", "2.6.0", "O(1)"},
+	"GEOADD":      {"Add one or more geospatial items", "3.2.0", "O(1) for each element"},
+	"GEODIST":     {"Returns the distance between two members", "3.2.0", "O(log(N))"},
+	"GEOHASH":     {"Returns members of a geospatial index as standard geohash strings", "3.2.0", "O(log(N))"},
+	"GEOPOS":      {"Returns longitude and latitude of members", "3.2.0", "O(N)"},
+	"SETBIT":      {"Sets or clears the bit at offset in the string value", "2.2.0", "O(1)"},
+	"GETBIT":      {"Returns the bit value at offset in the string value", "2.2.0", "O(1)"},
+	"BITCOUNT":    {"Count set bits in a string", "2.6.0", "O(N)"},
+	"BITPOS":      {"Find first bit set or clear in a string", "2.8.7", "O(N)"},
+	"BITOP":       {"Perform bitwise operations between strings", "2.6.0", "O(N)"},
+	"BITFIELD":    {"Perform arbitrary bitfield integer operations", "3.2.0", "O(1) for each subcommand"},
+	"PFADD":       {"Adds the specified elements to the specified HyperLogLog", "2.8.9", "O(1)"},
+	"PFCOUNT":     {"Return the approximated cardinality of the set", "2.8.9", "O(1)"},
+	"PFMERGE":     {"Merge N different HyperLogLogs into a single one", "2.8.9", "O(N)"},
+	"SCAN":        {"Incrementally iterate the keys space", "2.8.0", "O(1)"},
+	"SORT":        {"Sort the elements in a list, set or sorted set", "1.0.0", "O(N+M*log(M))"},
+	"OBJECT":      {"Inspect the internals of Redis objects", "2.2.3", "O(1)"},
+	"MEMORY":      {"Inspect memory usage", "4.0.0", "O(1)"},
 }
 
 func cmdINFO(ctx *Context) error {
 	var sb strings.Builder
 
 	sb.WriteString("# Server\r\n")
-	sb.WriteString("cachestorm_version:0.2.0\r\n")
+	sb.WriteString("cachestorm_version:" + serverVersion + "\r\n")
 	sb.WriteString("arch_bits:64\r\n")
 	sb.WriteString("tcp_port:")
 	sb.WriteString(strconv.Itoa(globalConfig.port))
@@ -339,6 +434,9 @@ func cmdINFO(ctx *Context) error {
 	sb.WriteString("\r\n")
 	sb.WriteString("\r\n")
 
+	writePersistenceInfo(&sb)
+	writeTierInfo(&sb, ctx.Store)
+
 	sb.WriteString("# Keyspace\r\n")
 	sb.WriteString("db0:keys=")
 	sb.WriteString(strconv.FormatInt(ctx.Store.KeyCount(), 10))
@@ -348,6 +446,10 @@ func cmdINFO(ctx *Context) error {
 	if replMgr := GetReplicationManager(); replMgr != nil {
 		sb.WriteString(replMgr.GetInfo())
 	}
+	if e := activeActiveEngine(); e != nil {
+		sb.WriteString("\r\n")
+		sb.WriteString(e.GetInfo())
+	}
 
 	return ctx.WriteBulkString(sb.String())
 }
@@ -836,25 +938,113 @@ func cmdCOPY(ctx *Context) error {
 }
 
 func cmdAUTH(ctx *Context) error {
-	if ctx.ArgCount() < 1 {
+	if ctx.ArgCount() < 1 || ctx.ArgCount() > 2 {
 		return ctx.WriteError(ErrWrongArgCount)
 	}
 
-	password := ctx.ArgString(0)
+	username, password := "default", ctx.ArgString(0)
+	if ctx.ArgCount() == 2 {
+		username, password = ctx.ArgString(0), ctx.ArgString(1)
+	}
 
-	if globalRouter == nil || globalRouter.RequirePass() == "" {
+	if ctx.ArgCount() == 1 && (globalRouter == nil || !globalRouter.authRequired()) {
 		return ctx.Writer.WriteError("ERR Client sent AUTH, but no password is set. Did you mean ACL SETUSER with >password?")
 	}
 
-	if !globalRouter.ValidatePassword(password) {
-		ctx.SetAuthenticated(false)
-		return ctx.Writer.WriteError("WRONGPASS invalid username-password pair or user is disabled.")
+	if !checkCredentials(username, password) {
+		ctx.logAuthFailure(username)
+		return ctx.Writer.WriteError(errWrongPass)
 	}
 
 	ctx.SetAuthenticated(true)
+	ctx.SetUsername(username)
 	return ctx.WriteOK()
 }
 
+const errWrongPass = "WRONGPASS invalid username-password pair or user is disabled."
+
+// checkCredentials validates a username/password pair against the ACL
+// users. requirepass is the password of the default user.
+func checkCredentials(username, password string) bool {
+	_, err := globalACL.Authenticate(username, password)
+	return err == nil
+}
+
+// cmdHELLO implements HELLO [protover [AUTH username password] [SETNAME name]].
+// It negotiates the protocol for the rest of the connection and replies with
+// the server handshake map in the newly selected protocol.
+func cmdHELLO(ctx *Context) error {
+	protocol := 2
+	if ctx.Session != nil {
+		protocol = ctx.Session.Protocol()
+	}
+
+	i := 0
+	if ctx.ArgCount() > 0 {
+		v, err := strconv.Atoi(ctx.ArgString(0))
+		if err != nil {
+			return ctx.WriteError(errors.New("ERR Protocol version is not an integer or out of range"))
+		}
+		if v != 2 && v != 3 {
+			return ctx.WriteError(errors.New("NOPROTO unsupported protocol version"))
+		}
+		protocol = v
+		i = 1
+	}
+
+	var username, password, clientName string
+	hasAuth, hasName := false, false
+	for ; i < ctx.ArgCount(); i++ {
+		switch strings.ToUpper(ctx.ArgString(i)) {
+		case "AUTH":
+			if i+2 >= ctx.ArgCount() {
+				return ctx.WriteError(ErrSyntaxError)
+			}
+			username, password = ctx.ArgString(i+1), ctx.ArgString(i+2)
+			hasAuth = true
+			i += 2
+		case "SETNAME":
+			if i+1 >= ctx.ArgCount() {
+				return ctx.WriteError(ErrSyntaxError)
+			}
+			clientName = ctx.ArgString(i + 1)
+			if strings.ContainsAny(clientName, " \n") {
+				return ctx.WriteError(errors.New("ERR Client names cannot contain spaces, newlines or special characters."))
+			}
+			hasName = true
+			i++
+		default:
+			return ctx.WriteError(ErrSyntaxError)
+		}
+	}
+
+	if hasAuth {
+		if !checkCredentials(username, password) {
+			ctx.logAuthFailure(username)
+			return ctx.Writer.WriteError(errWrongPass)
+		}
+		ctx.SetAuthenticated(true)
+		ctx.SetUsername(username)
+	} else if globalRouter != nil && globalRouter.authRequired() && !ctx.IsAuthenticated() {
+		return ctx.Writer.WriteError("NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time")
+	}
+
+	if hasName && ctx.Session != nil {
+		ctx.Session.SetName(clientName)
+	}
+	ctx.SetProtocol(protocol)
+
+	return ctx.WriteMap([]*resp.Value{
+		resp.BulkString("server"), resp.BulkString("cachestorm"),
+		resp.BulkString("version"), resp.BulkString(serverVersion),
+		resp.BulkString("proto"), resp.IntegerValue(int64(protocol)),
+		resp.BulkString("id"), resp.IntegerValue(ctx.ClientID),
+		resp.BulkString("mode"), resp.BulkString("standalone"),
+		resp.BulkString("role"), resp.BulkString(helloRole()),
+		resp.BulkString("modules"), resp.ArrayValue([]*resp.Value{}),
+	})
+}
+
 func cmdSCAN(ctx *Context) error {
 	if ctx.ArgCount() < 1 {
 		return ctx.WriteError(ErrWrongArgCount)
@@ -1011,7 +1201,53 @@ type ClientTrackingInfo struct {
 	enabled  bool
 	redirect int64
 	prefixes []string
+	bcast    bool
+	optIn    bool
+	optOut   bool
 	noLoop   bool
+	caching  int                 // CLIENT CACHING for the next command
+	writing  map[string]struct{} // arguments of the NOLOOP write in progress
+}
+
+func (t *ClientTrackingInfo) reset() {
+	t.enabled = false
+	t.redirect = 0
+	t.prefixes = nil
+	t.bcast = false
+	t.optIn = false
+	t.optOut = false
+	t.noLoop = false
+	t.caching = cachingDefault
+	t.writing = nil
+}
+
+// cachingAllowed reports whether a read should be tracked given the OPTIN or
+// OPTOUT mode and the last CLIENT CACHING.
+func (t *ClientTrackingInfo) cachingAllowed() bool {
+	switch {
+	case t.optIn:
+		return t.caching == cachingYes
+	case t.optOut:
+		return t.caching != cachingNo
+	default:
+		return true
+	}
+}
+
+// matchesPrefix reports whether a BCAST client wants to hear about key. No
+// prefixes means every key.
+func (t *ClientTrackingInfo) matchesPrefix(key string) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if len(t.prefixes) == 0 {
+		return true
+	}
+	for _, p := range t.prefixes {
+		if strings.HasPrefix(key, p) {
+			return true
+		}
+	}
+	return false
 }
 
 var globalClientTracking = struct {
@@ -1039,6 +1275,13 @@ func cmdCLIENT(ctx *Context) error {
 
 	switch subCmd {
 	case "LIST":
+		if ctx.Session != nil {
+			var sb strings.Builder
+			for _, sess := range Sessions() {
+				sb.WriteString(clientInfoLine(sess))
+			}
+			return ctx.WriteBulkString(sb.String())
+		}
 		var sb strings.Builder
 		sb.WriteString("id=")
 		sb.WriteString(strconv.FormatInt(ctx.ClientID, 10))
@@ -1061,8 +1304,18 @@ func cmdCLIENT(ctx *Context) error {
 		if ctx.ArgCount() != 2 {
 			return ctx.WriteError(ErrWrongArgCount)
 		}
+		name := ctx.ArgString(1)
+		if strings.ContainsAny(name, " \n") {
+			return ctx.WriteError(errors.New("ERR Client names cannot contain spaces, newlines or special characters."))
+		}
+		if ctx.Session != nil {
+			ctx.Session.SetName(name)
+		}
 		return ctx.WriteOK()
 	case "GETNAME":
+		if ctx.Session != nil && ctx.Session.Name() != "" {
+			return ctx.WriteBulkString(ctx.Session.Name())
+		}
 		return ctx.WriteNullBulkString()
 	case "ID":
 		return ctx.WriteInteger(ctx.ClientID)
@@ -1089,43 +1342,73 @@ func cmdCLIENT(ctx *Context) error {
 	case "TRACKING":
 		return cmdClientTracking(ctx)
 	case "CACHING":
-		return ctx.WriteOK()
+		return cmdClientCaching(ctx)
+	case "TRACKINGINFO":
+		return cmdClientTrackingInfo(ctx)
 	case "NO-TOUCH":
 		return ctx.WriteOK()
 	case "INFO":
+		if ctx.Session != nil {
+			return ctx.WriteBulkString(clientInfoLine(ctx.Session))
+		}
 		return ctx.WriteBulkString("id=" + strconv.FormatInt(ctx.ClientID, 10))
 	case "GETREDIR":
-		tracking := GetClientTracking(ctx.ClientID)
+		tracking := ctx.clientTracking()
 		tracking.mu.RLock()
 		defer tracking.mu.RUnlock()
+		if !tracking.enabled {
+			return ctx.WriteInteger(-1)
+		}
 		return ctx.WriteInteger(tracking.redirect)
 	default:
 		return ctx.WriteError(errors.New("ERR unknown subcommand '" + subCmd + "'"))
 	}
 }
 
+// clientInfoLine formats a session the way CLIENT LIST and CLIENT INFO do.
+func clientInfoLine(sess *Session) string {
+	multi := -1
+	if sess.Transaction.IsActive() {
+		multi = len(sess.Transaction.GetQueued())
+	}
+	flags := "N"
+	if sess.IsMonitor() {
+		flags = "O"
+	}
+	return fmt.Sprintf("id=%d addr=%s name=%s age=%d idle=%d flags=%s db=%d ns=%s sub=0 psub=0 multi=%d qbuf=0 obl=0 oll=0 omem=0 user=%s cmd=%s resp=%d\n",
+		sess.ID(), sess.RemoteAddr(), sess.Name(),
+		int64(time.Since(sess.CreatedAt()).Seconds()), int64(sess.IdleTime().Seconds()),
+		flags, sess.DB(), sess.Namespace(), multi, sess.Username(),
+		strings.ToLower(sess.LastCommand()), sess.Protocol())
+}
+
+// clientTracking returns the tracking state of the calling client.
+func (ctx *Context) clientTracking() *ClientTrackingInfo {
+	if ctx.Session != nil {
+		return ctx.Session.Tracking
+	}
+	return GetClientTracking(ctx.ClientID)
+}
+
 func cmdClientTracking(ctx *Context) error {
 	if ctx.ArgCount() < 2 {
 		return ctx.WriteError(ErrWrongArgCount)
 	}
 
-	onOff := strings.ToUpper(ctx.ArgString(1))
-	tracking := GetClientTracking(ctx.ClientID)
-	tracking.mu.Lock()
-	defer tracking.mu.Unlock()
-
-	switch onOff {
+	var on bool
+	switch strings.ToUpper(ctx.ArgString(1)) {
 	case "ON":
-		tracking.enabled = true
+		on = true
 	case "OFF":
-		tracking.enabled = false
 	default:
-		return ctx.WriteError(errors.New("ERR syntax error"))
+		return ctx.WriteError(ErrSyntaxError)
 	}
 
+	var redirect int64
+	var prefixes []string
+	var bcast, optIn, optOut, noLoop bool
 	for i := 2; i < ctx.ArgCount(); i++ {
-		arg := strings.ToUpper(ctx.ArgString(i))
-		switch arg {
+		switch strings.ToUpper(ctx.ArgString(i)) {
 		case "REDIRECT":
 			if i+1 >= ctx.ArgCount() {
 				return ctx.WriteError(ErrSyntaxError)
@@ -1134,25 +1417,150 @@ func cmdClientTracking(ctx *Context) error {
 			if err != nil {
 				return ctx.WriteError(ErrNotInteger)
 			}
-			tracking.redirect = redirectID
+			redirect = redirectID
 			i++
 		case "BCAST":
+			bcast = true
 		case "PREFIX":
 			if i+1 >= ctx.ArgCount() {
 				return ctx.WriteError(ErrSyntaxError)
 			}
-			tracking.prefixes = append(tracking.prefixes, ctx.ArgString(i+1))
+			prefixes = append(prefixes, ctx.ArgString(i+1))
 			i++
 		case "OPTIN":
+			optIn = true
 		case "OPTOUT":
+			optOut = true
 		case "NOLOOP":
-			tracking.noLoop = true
+			noLoop = true
+		default:
+			return ctx.WriteError(ErrSyntaxError)
+		}
+	}
+
+	if !on {
+		if ctx.Session != nil {
+			disableTracking(ctx.Session)
+		} else {
+			tracking := ctx.clientTracking()
+			tracking.mu.Lock()
+			tracking.reset()
+			tracking.mu.Unlock()
+		}
+		return ctx.WriteOK()
+	}
+
+	switch {
+	case optIn && optOut:
+		return ctx.WriteError(errors.New("ERR You can't use both OPTIN and OPTOUT"))
+	case bcast && (optIn || optOut):
+		return ctx.WriteError(errors.New("ERR OPTIN and OPTOUT are not compatible with BCAST"))
+	case len(prefixes) > 0 && !bcast:
+		return ctx.WriteError(errors.New("ERR PREFIX option requires BCAST mode to be enabled"))
+	}
+	if redirect != 0 && ctx.Session != nil {
+		if redirect == ctx.Session.ID() {
+			return ctx.WriteError(errors.New("ERR A client cannot redirect invalidation messages to itself"))
+		}
+		if !trackingRedirectAlive(redirect) {
+			return ctx.WriteError(errors.New("ERR The client ID you want redirect to does not exist"))
 		}
 	}
 
+	tracking := ctx.clientTracking()
+	tracking.mu.Lock()
+	wasEnabled := tracking.enabled
+	tracking.reset()
+	tracking.enabled = true
+	tracking.redirect = redirect
+	tracking.prefixes = prefixes
+	tracking.bcast = bcast
+	tracking.optIn = optIn
+	tracking.optOut = optOut
+	tracking.noLoop = noLoop
+	tracking.mu.Unlock()
+
+	if ctx.Session != nil {
+		enableTracking(ctx.Session, wasEnabled, bcast)
+	}
+	return ctx.WriteOK()
+}
+
+func cmdClientCaching(ctx *Context) error {
+	if ctx.ArgCount() != 2 {
+		return ctx.WriteError(ErrWrongArgCount)
+	}
+
+	tracking := ctx.clientTracking()
+	tracking.mu.Lock()
+	defer tracking.mu.Unlock()
+
+	if !tracking.enabled || (!tracking.optIn && !tracking.optOut) {
+		return ctx.WriteError(errors.New("ERR CLIENT CACHING can be called only when the client is in tracking mode with OPTIN or OPTOUT mode enabled"))
+	}
+	switch strings.ToUpper(ctx.ArgString(1)) {
+	case "YES":
+		if !tracking.optIn {
+			return ctx.WriteError(errors.New("ERR CLIENT CACHING YES is only valid when tracking is enabled in OPTIN mode."))
+		}
+		tracking.caching = cachingYes
+	case "NO":
+		if !tracking.optOut {
+			return ctx.WriteError(errors.New("ERR CLIENT CACHING NO is only valid when tracking is enabled in OPTOUT mode."))
+		}
+		tracking.caching = cachingNo
+	default:
+		return ctx.WriteError(ErrSyntaxError)
+	}
 	return ctx.WriteOK()
 }
 
+func cmdClientTrackingInfo(ctx *Context) error {
+	tracking := ctx.clientTracking()
+	tracking.mu.RLock()
+	flags := make([]*resp.Value, 0, 4)
+	redirect := int64(-1)
+	if !tracking.enabled {
+		flags = append(flags, resp.BulkString("off"))
+	} else {
+		redirect = tracking.redirect
+		flags = append(flags, resp.BulkString("on"))
+		if tracking.bcast {
+			flags = append(flags, resp.BulkString("bcast"))
+		}
+		if tracking.optIn {
+			flags = append(flags, resp.BulkString("optin"))
+			if tracking.caching == cachingYes {
+				flags = append(flags, resp.BulkString("caching-yes"))
+			}
+		}
+		if tracking.optOut {
+			flags = append(flags, resp.BulkString("optout"))
+			if tracking.caching == cachingNo {
+				flags = append(flags, resp.BulkString("caching-no"))
+			}
+		}
+		if tracking.noLoop {
+			flags = append(flags, resp.BulkString("noloop"))
+		}
+	}
+	prefixes := make([]*resp.Value, len(tracking.prefixes))
+	for i, p := range tracking.prefixes {
+		prefixes[i] = resp.BulkString(p)
+	}
+	tracking.mu.RUnlock()
+
+	if redirect > 0 && ctx.Session != nil && !trackingRedirectAlive(redirect) {
+		flags = append(flags, resp.BulkString("broken_redirect"))
+	}
+
+	return ctx.WriteMap([]*resp.Value{
+		resp.BulkString("flags"), resp.ArrayValue(flags),
+		resp.BulkString("redirect"), resp.IntegerValue(redirect),
+		resp.BulkString("prefixes"), resp.ArrayValue(prefixes),
+	})
+}
+
 func cmdSORT(ctx *Context) error {
 	return doSort(ctx, false)
 }
@@ -1320,7 +1728,79 @@ func doSort(ctx *Context, readOnly bool) error {
 	return ctx.WriteArray(result)
 }
 
-var lastSaveTime int64
+// snapshots backs SAVE, BGSAVE, LASTSAVE, DEBUG RELOAD and INFO
+// persistence; it is nil when the server has no RDB file configured.
+var snapshots struct {
+	mu sync.RWMutex
+	pm *persistence.PersistenceManager
+}
+
+// startedAt is what LASTSAVE reports when there is no snapshot manager,
+// as Redis reports its start time before the first save.
+var startedAt = time.Now()
+
+// EnableSnapshots routes the snapshot commands to pm. The RDB file it
+// manages may also be a dump written by Redis.
+func EnableSnapshots(pm *persistence.PersistenceManager) {
+	snapshots.mu.Lock()
+	snapshots.pm = pm
+	snapshots.mu.Unlock()
+
+	var rules []string
+	if pm != nil {
+		rules = strings.Fields(persistence.FormatSaveRules(pm.SaveRules()))
+	}
+	globalConfig.mu.Lock()
+	globalConfig.saveIntervals = rules
+	globalConfig.mu.Unlock()
+}
+
+func snapshotManager() *persistence.PersistenceManager {
+	snapshots.mu.RLock()
+	defer snapshots.mu.RUnlock()
+	return snapshots.pm
+}
+
+var errSnapshotsDisabled = errors.New("ERR snapshots are not enabled, set persistence.rdb_filename")
+
+// snapshotError turns a PersistenceManager error into a reply.
+func snapshotError(err error) error {
+	if errors.Is(err, persistence.ErrSaveInProgress) {
+		return errors.New("ERR Background save already in progress")
+	}
+	return fmt.Errorf("ERR %v", err)
+}
+
+// appendOnly backs BGREWRITEAOF and the AOF fields of INFO persistence; it
+// is nil when the AOF is off.
+var appendOnly struct {
+	mu sync.RWMutex
+	m  *persistence.AOFManager
+}
+
+// EnableAOF routes BGREWRITEAOF to m.
+func EnableAOF(m *persistence.AOFManager) {
+	appendOnly.mu.Lock()
+	appendOnly.m = m
+	appendOnly.mu.Unlock()
+
+	globalConfig.mu.Lock()
+	globalConfig.appendOnly = m != nil
+	if m != nil {
+		globalConfig.aofRewriteMinSize, globalConfig.aofRewritePercentage = m.RewriteRules()
+		globalConfig.aofLoadTruncated = m.LoadTruncated()
+		globalConfig.aofTimestampEnabled = m.Timestamps()
+	}
+	globalConfig.mu.Unlock()
+}
+
+func aofManager() *persistence.AOFManager {
+	appendOnly.mu.RLock()
+	defer appendOnly.mu.RUnlock()
+	return appendOnly.m
+}
+
+var errAOFDisabled = errors.New("ERR the append only file is not enabled, set persistence.aof")
 
 type SlowLogEntry struct {
 	ID        int64
@@ -1442,6 +1922,9 @@ func cmdSLOWLOG(ctx *Context) error {
 	}
 }
 
+// cmdWAIT implements WAIT numreplicas timeout, which blocks until
+// numreplicas replicas have acknowledged the writes made so far or timeout
+// milliseconds pass, 0 meaning no limit, and replies how many did.
 func cmdWAIT(ctx *Context) error {
 	if ctx.ArgCount() != 2 {
 		return ctx.WriteError(ErrWrongArgCount)
@@ -1451,23 +1934,36 @@ func cmdWAIT(ctx *Context) error {
 	if err != nil {
 		return ctx.WriteError(ErrNotInteger)
 	}
-
-	timeout, err := strconv.Atoi(ctx.ArgString(1))
+	timeout, err := parseWaitTimeout(ctx.ArgString(1))
 	if err != nil {
-		return ctx.WriteError(ErrNotInteger)
+		return ctx.WriteError(err)
 	}
 
-	_ = numReplicas
-	_ = timeout
+	acked, err := waitForReplicas("WAIT", numReplicas, timeout, false)
+	if err != nil {
+		return ctx.WriteError(err)
+	}
+	return ctx.WriteInteger(int64(acked))
+}
 
-	return ctx.WriteInteger(1)
+// parseWaitTimeout parses the timeout of WAIT and WAITAOF, in milliseconds.
+func parseWaitTimeout(s string) (time.Duration, error) {
+	ms, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, errors.New("ERR timeout is not an integer or out of range")
+	}
+	if ms < 0 {
+		return 0, errors.New("ERR timeout is negative")
+	}
+	return time.Duration(ms) * time.Millisecond, nil
 }
 
 func cmdLASTSAVE(ctx *Context) error {
-	if lastSaveTime == 0 {
-		lastSaveTime = time.Now().Unix()
+	pm := snapshotManager()
+	if pm == nil {
+		return ctx.WriteInteger(startedAt.Unix())
 	}
-	return ctx.WriteInteger(lastSaveTime)
+	return ctx.WriteInteger(pm.Info().LastSave.Unix())
 }
 
 func cmdLOLWUT(ctx *Context) error {
@@ -1504,32 +2000,144 @@ func cmdLOLWUT(ctx *Context) error {
 }
 
 func cmdSHUTDOWN(ctx *Context) error {
-	save := true
+	save, forced := true, false
 	for i := 0; i < ctx.ArgCount(); i++ {
 		arg := strings.ToUpper(ctx.ArgString(i))
 		if arg == "NOSAVE" {
 			save = false
 		} else if arg == "SAVE" {
-			save = true
+			save, forced = true, true
 		}
 	}
 
-	_ = save
+	// Like Redis, save when save rules are configured or SAVE is given.
+	if pm := snapshotManager(); pm != nil && save && (forced || len(pm.SaveRules()) > 0) {
+		if err := pm.SAVE(); err != nil {
+			return ctx.WriteError(errors.New("ERR Errors trying to SHUTDOWN. Check logs."))
+		}
+	}
 	ctx.WriteOK()
 	return errors.New("SHUTDOWN")
 }
 
 func cmdSAVE(ctx *Context) error {
-	lastSaveTime = time.Now().Unix()
+	pm := snapshotManager()
+	if pm == nil {
+		return ctx.WriteError(errSnapshotsDisabled)
+	}
+	if err := pm.SAVE(); err != nil {
+		return ctx.WriteError(snapshotError(err))
+	}
 	return ctx.WriteOK()
 }
 
 func cmdBGSAVE(ctx *Context) error {
-	lastSaveTime = time.Now().Unix()
+	pm := snapshotManager()
+	if pm == nil {
+		return ctx.WriteError(errSnapshotsDisabled)
+	}
+	if err := pm.BGSAVE(); err != nil {
+		return ctx.WriteError(snapshotError(err))
+	}
 	return ctx.WriteSimpleString("Background saving started")
 }
 
+// writePersistenceInfo writes the INFO persistence section.
+func writePersistenceInfo(sb *strings.Builder) {
+	info := persistence.PersistenceInfo{LastSave: startedAt, LastBgsaveOK: true, LastBgsaveDuration: -1}
+	if pm := snapshotManager(); pm != nil {
+		info = pm.Info()
+	}
+	status, inProgress, current := "ok", 0, int64(-1)
+	if !info.LastBgsaveOK {
+		status = "err"
+	}
+	if info.BgsaveInProgress {
+		inProgress = 1
+		current = int64(time.Since(info.BgsaveStarted).Seconds())
+	}
+	last := int64(-1)
+	if info.LastBgsaveDuration >= 0 {
+		last = int64(info.LastBgsaveDuration.Seconds())
+	}
+
+	sb.WriteString("# Persistence\r\n")
+	fmt.Fprintf(sb, "rdb_changes_since_last_save:%d\r\n", info.Dirty)
+	fmt.Fprintf(sb, "rdb_bgsave_in_progress:%d\r\n", inProgress)
+	fmt.Fprintf(sb, "rdb_last_save_time:%d\r\n", info.LastSave.Unix())
+	fmt.Fprintf(sb, "rdb_last_bgsave_status:%s\r\n", status)
+	fmt.Fprintf(sb, "rdb_last_bgsave_time_sec:%d\r\n", last)
+	fmt.Fprintf(sb, "rdb_current_bgsave_time_sec:%d\r\n", current)
+	writeAOFInfo(sb)
+	sb.WriteString("\r\n")
+}
+
+// writeTierInfo writes the disk tier section of INFO. The key counts are
+// those of the selected namespace, the rest covers the whole tier.
+func writeTierInfo(sb *strings.Builder, s *store.Store) {
+	stats, ok := s.TierStats()
+	if !ok {
+		return
+	}
+	cold := s.ColdKeyCount()
+	sb.WriteString("# Tiering\r\n")
+	fmt.Fprintf(sb, "tier_hot_keys:%d\r\n", s.KeyCount()-cold)
+	fmt.Fprintf(sb, "tier_cold_keys:%d\r\n", cold)
+	fmt.Fprintf(sb, "tier_segments:%d\r\n", stats.Segments)
+	fmt.Fprintf(sb, "tier_disk_bytes:%d\r\n", stats.DiskBytes)
+	fmt.Fprintf(sb, "tier_live_bytes:%d\r\n", stats.LiveBytes)
+	fmt.Fprintf(sb, "tier_spilled_values:%d\r\n", stats.Spilled)
+	fmt.Fprintf(sb, "tier_faulted_values:%d\r\n", stats.Faulted)
+	fmt.Fprintf(sb, "tier_compactions:%d\r\n", stats.Compactions)
+	sb.WriteString("\r\n")
+}
+
+// writeAOFInfo writes the AOF fields of INFO persistence.
+func writeAOFInfo(sb *strings.Builder) {
+	m := aofManager()
+	if m == nil {
+		sb.WriteString("aof_enabled:0\r\n")
+		sb.WriteString("aof_rewrite_in_progress:0\r\n")
+		return
+	}
+	info := m.Info()
+	status, inProgress, current := "ok", 0, int64(-1)
+	if !info.LastRewriteOK {
+		status = "err"
+	}
+	if info.RewriteInProgress {
+		inProgress = 1
+		if !info.RewriteStarted.IsZero() {
+			current = int64(time.Since(info.RewriteStarted).Seconds())
+		}
+	}
+	last := int64(-1)
+	if info.LastRewriteDuration >= 0 {
+		last = int64(info.LastRewriteDuration.Seconds())
+	}
+
+	sb.WriteString("aof_enabled:1\r\n")
+	fmt.Fprintf(sb, "aof_rewrite_in_progress:%d\r\n", inProgress)
+	fmt.Fprintf(sb, "aof_rewrites:%d\r\n", info.Rewrites)
+	fmt.Fprintf(sb, "aof_last_rewrite_time_sec:%d\r\n", last)
+	fmt.Fprintf(sb, "aof_current_rewrite_time_sec:%d\r\n", current)
+	fmt.Fprintf(sb, "aof_last_bgrewrite_status:%s\r\n", status)
+	fmt.Fprintf(sb, "aof_current_size:%d\r\n", info.CurrentSize)
+	fmt.Fprintf(sb, "aof_base_size:%d\r\n", info.BaseSize)
+	fmt.Fprintf(sb, "aof_rewrite_buffer_length:%d\r\n", info.RewriteBufferLength)
+}
+
 func cmdBGREWRITEAOF(ctx *Context) error {
+	m := aofManager()
+	if m == nil {
+		return ctx.WriteError(errAOFDisabled)
+	}
+	if err := m.BGREWRITEAOF(); err != nil {
+		if errors.Is(err, persistence.ErrRewriteInProgress) {
+			return ctx.WriteError(errors.New("ERR Background append only file rewriting already in progress"))
+		}
+		return ctx.WriteError(fmt.Errorf("ERR %v", err))
+	}
 	return ctx.WriteSimpleString("Background append only file rewriting started")
 }
 
@@ -1655,183 +2263,6 @@ func cmdSTRALGO(ctx *Context) error {
 	return ctx.WriteBulkString("")
 }
 
-func cmdACL(ctx *Context) error {
-	if ctx.ArgCount() < 1 {
-		return ctx.WriteError(ErrWrongArgCount)
-	}
-
-	subCmd := strings.ToUpper(ctx.ArgString(0))
-
-	switch subCmd {
-	case "LIST":
-		users := globalACL.ListUsers()
-		results := make([]*resp.Value, 0, len(users))
-		for _, name := range users {
-			if user, ok := globalACL.GetUser(name); ok {
-				results = append(results, resp.BulkString(user.ToACLString()))
-			}
-		}
-		return ctx.WriteArray(results)
-	case "USERS":
-		users := globalACL.ListUsers()
-		results := make([]*resp.Value, 0, len(users))
-		for _, name := range users {
-			results = append(results, resp.BulkString(name))
-		}
-		return ctx.WriteArray(results)
-	case "WHOAMI":
-		if ctx.Username != "" {
-			return ctx.WriteBulkString(ctx.Username)
-		}
-		return ctx.WriteBulkString("default")
-	case "CAT":
-		return ctx.WriteArray([]*resp.Value{
-			resp.BulkString("admin"),
-			resp.BulkString("bitmap"),
-			resp.BulkString("connection"),
-			resp.BulkString("dangerous"),
-			resp.BulkString("geo"),
-			resp.BulkString("hash"),
-			resp.BulkString("hyperloglog"),
-			resp.BulkString("list"),
-			resp.BulkString("pubsub"),
-			resp.BulkString("read"),
-			resp.BulkString("scripting"),
-			resp.BulkString("set"),
-			resp.BulkString("sortedset"),
-			resp.BulkString("stream"),
-			resp.BulkString("string"),
-			resp.BulkString("transaction"),
-			resp.BulkString("write"),
-		})
-	case "SETUSER":
-		if ctx.ArgCount() < 2 {
-			return ctx.WriteError(ErrWrongArgCount)
-		}
-		username := ctx.ArgString(1)
-		user, exists := globalACL.GetUser(username)
-		if !exists {
-			var err error
-			user, err = globalACL.CreateUser(username)
-			if err != nil {
-				return ctx.WriteError(err)
-			}
-		}
-		ruleParts := make([]string, 0, len(ctx.Args)-2)
-		for i := 2; i < len(ctx.Args); i++ {
-			ruleParts = append(ruleParts, string(ctx.Args[i]))
-		}
-		rule := strings.Join(ruleParts, " ")
-		if err := acl.ParseACLRule(rule, user); err != nil {
-			return ctx.WriteError(err)
-		}
-		if !user.Enabled {
-			user.Enable()
-		}
-		return ctx.WriteOK()
-	case "DELUSER":
-		if ctx.ArgCount() < 2 {
-			return ctx.WriteError(ErrWrongArgCount)
-		}
-		deleted := int64(0)
-		for i := 1; i < ctx.ArgCount(); i++ {
-			username := ctx.ArgString(i)
-			if err := globalACL.DeleteUser(username); err == nil {
-				deleted++
-			}
-		}
-		return ctx.WriteInteger(deleted)
-	case "GETUSER":
-		if ctx.ArgCount() < 2 {
-			return ctx.WriteError(ErrWrongArgCount)
-		}
-		username := ctx.ArgString(1)
-		user, exists := globalACL.GetUser(username)
-		if !exists {
-			return ctx.WriteNull()
-		}
-
-		return ctx.WriteArray([]*resp.Value{
-			resp.BulkString("flags"),
-			resp.ArrayValue([]*resp.Value{
-				resp.BulkString(func() string {
-					if user.IsEnabled() {
-						return "on"
-					}
-					return "off"
-				}()),
-				resp.BulkString(func() string {
-					if user.IsNoPassword() {
-						return "nopass"
-					}
-					return ""
-				}()),
-			}),
-			resp.BulkString("passwords"),
-			resp.ArrayValue([]*resp.Value{}),
-			resp.BulkString("commands"),
-			resp.BulkString("+@all"),
-			resp.BulkString("keys"),
-			resp.ArrayValue([]*resp.Value{resp.BulkString("~*")}),
-		})
-	case "LOAD":
-		return ctx.WriteOK()
-	case "SAVE":
-		return ctx.WriteOK()
-	case "LOG":
-		count := 10
-		if ctx.ArgCount() > 1 {
-			var err error
-			count, err = strconv.Atoi(ctx.ArgString(1))
-			if err != nil {
-				return ctx.WriteError(ErrNotInteger)
-			}
-		}
-		_ = count
-		return ctx.WriteArray([]*resp.Value{})
-	case "DRYRUN":
-		if ctx.ArgCount() < 3 {
-			return ctx.WriteError(ErrWrongArgCount)
-		}
-		username := ctx.ArgString(1)
-		cmd := ctx.ArgString(2)
-		user, exists := globalACL.GetUser(username)
-		if !exists {
-			return ctx.WriteError(acl.ErrUserNotFound)
-		}
-		if user.CanExecuteCommand(cmd) {
-			return ctx.WriteOK()
-		}
-		return ctx.WriteError(acl.ErrPermissionDenied)
-	case "GENPASS":
-		bits := 256
-		if ctx.ArgCount() > 1 {
-			var err error
-			bits, err = strconv.Atoi(ctx.ArgString(1))
-			if err != nil {
-				return ctx.WriteError(ErrNotInteger)
-			}
-		}
-		return ctx.WriteBulkString(generatePassword(bits))
-	case "HELP":
-		return ctx.WriteArray([]*resp.Value{
-			resp.BulkString("LIST"),
-			resp.BulkString("USERS"),
-			resp.BulkString("WHOAMI"),
-			resp.BulkString("CAT"),
-			resp.BulkString("SETUSER <username> [rule ...]"),
-			resp.BulkString("GETUSER <username>"),
-			resp.BulkString("DELUSER <username> [username ...]"),
-			resp.BulkString("DRYRUN <username> <command>"),
-			resp.BulkString("GENPASS [bits]"),
-			resp.BulkString("LOAD"),
-			resp.BulkString("SAVE"),
-		})
-	default:
-		return ctx.WriteError(errors.New("ERR unknown subcommand '" + subCmd + "'"))
-	}
-}
-
 func generatePassword(bits int) string {
 	const chars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789!@#$%^&*"
 	length := bits / 6
@@ -1846,10 +2277,6 @@ func generatePassword(bits int) string {
 	return string(result)
 }
 
-func cmdMONITOR(ctx *Context) error {
-	return ctx.WriteOK()
-}
-
 func cmdSWAPDB(ctx *Context) error {
 	if ctx.ArgCount() != 2 {
 		return ctx.WriteError(ErrWrongArgCount)
@@ -1882,14 +2309,44 @@ func cmdMOVE(ctx *Context) error {
 	return ctx.WriteInteger(1)
 }
 
+// cmdWAITAOF implements WAITAOF numlocal numreplicas timeout. It fsyncs
+// the local AOF, then waits like WAIT for numreplicas replicas to have
+// fsynced the writes made so far to theirs, and replies with the number of
+// local AOFs (0 or 1) and of replicas that hold them.
 func cmdWAITAOF(ctx *Context) error {
-	if ctx.ArgCount() < 2 {
+	if ctx.ArgCount() != 3 {
 		return ctx.WriteError(ErrWrongArgCount)
 	}
-	_ = ctx.ArgString(0)
-	_ = ctx.ArgString(1)
+	numLocal, err := strconv.Atoi(ctx.ArgString(0))
+	if err != nil {
+		return ctx.WriteError(ErrNotInteger)
+	}
+	numReplicas, err := strconv.Atoi(ctx.ArgString(1))
+	if err != nil {
+		return ctx.WriteError(ErrNotInteger)
+	}
+	timeout, err := parseWaitTimeout(ctx.ArgString(2))
+	if err != nil {
+		return ctx.WriteError(err)
+	}
+
+	m := aofManager()
+	if numLocal > 0 && m == nil {
+		return ctx.WriteError(errors.New("ERR WAITAOF cannot be used when numlocal is set but appendonly is disabled."))
+	}
+	var local int64
+	if m != nil {
+		if err := m.Flush(); err != nil {
+			return ctx.WriteError(fmt.Errorf("ERR fsyncing the AOF failed: %v", err))
+		}
+		local = 1
+	}
+	acked, err := waitForReplicas("WAITAOF", numReplicas, timeout, true)
+	if err != nil {
+		return ctx.WriteError(err)
+	}
 	return ctx.WriteArray([]*resp.Value{
-		resp.IntegerValue(0),
-		resp.IntegerValue(0),
+		resp.IntegerValue(local),
+		resp.IntegerValue(int64(acked)),
 	})
 }
@@ -1,8 +1,12 @@
 package command
 
 import (
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/cachestorm/cachestorm/internal/persistence"
 	"github.com/cachestorm/cachestorm/internal/store"
 )
 
@@ -60,3 +64,148 @@ func TestAllServerCommands(t *testing.T) {
 		})
 	}
 }
+
+func TestSnapshotCommands(t *testing.T) {
+	s := store.NewStoreWithNamespaces()
+	pm := persistence.NewPersistenceManager(s, persistence.Config{
+		DataDir:     t.TempDir(),
+		RDBFilename: "dump.rdb",
+		SaveRules:   []persistence.SaveRule{{After: time.Hour, Changes: 1}},
+	})
+	EnableSnapshots(pm)
+	t.Cleanup(func() { EnableSnapshots(nil) })
+
+	info := func() string {
+		ctx, buf := bufCtx("INFO", nil, s)
+		if err := cmdINFO(ctx); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+
+	s.Set("k", &store.StringValue{Data: []byte("v")}, store.SetOptions{})
+	if out := info(); !strings.Contains(out, "rdb_changes_since_last_save:1\r\n") ||
+		!strings.Contains(out, "rdb_last_bgsave_status:ok\r\n") {
+		t.Fatalf("INFO before SAVE:\n%s", out)
+	}
+
+	ctx, buf := bufCtx("SAVE", nil, s)
+	if err := cmdSAVE(ctx); err != nil || buf.String() != "+OK\r\n" {
+		t.Fatalf("SAVE = %q, %v", buf.String(), err)
+	}
+	if out := info(); !strings.Contains(out, "rdb_changes_since_last_save:0\r\n") {
+		t.Fatalf("INFO after SAVE:\n%s", out)
+	}
+	ctx, buf = bufCtx("LASTSAVE", nil, s)
+	if err := cmdLASTSAVE(ctx); err != nil || buf.String() != ":"+strconv.FormatInt(pm.LastSave().Unix(), 10)+"\r\n" {
+		t.Fatalf("LASTSAVE = %q, %v", buf.String(), err)
+	}
+
+	ctx, buf = bufCtx("BGSAVE", nil, s)
+	if err := cmdBGSAVE(ctx); err != nil || buf.String() != "+Background saving started\r\n" {
+		t.Fatalf("BGSAVE = %q, %v", buf.String(), err)
+	}
+	pm.Stop()
+
+	ctx, _ = bufCtx("CONFIG", bytesArgs("SET", "save", "60 10"), s)
+	if err := cmdConfigSet(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if rules := pm.SaveRules(); len(rules) != 1 || rules[0] != (persistence.SaveRule{After: time.Minute, Changes: 10}) {
+		t.Errorf("save rules = %+v", rules)
+	}
+}
+
+func TestAOFRewriteCommands(t *testing.T) {
+	s := store.NewStore()
+	m := persistence.NewAOFManager(persistence.AOFConfig{
+		Enabled:     true,
+		Filename:    "appendonly.aof",
+		DataDir:     t.TempDir(),
+		RewriteSize: 1 << 20,
+		RewritePct:  100,
+	}, s)
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	EnableAOF(m)
+	t.Cleanup(func() { EnableAOF(nil) })
+
+	ctx, buf := bufCtx("BGREWRITEAOF", nil, s)
+	if err := cmdBGREWRITEAOF(ctx); err != nil || buf.String() != "+Background append only file rewriting started\r\n" {
+		t.Fatalf("BGREWRITEAOF = %q, %v", buf.String(), err)
+	}
+	for m.IsRewriting() {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, buf = bufCtx("INFO", nil, s)
+	if err := cmdINFO(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{"aof_enabled:1\r\n", "aof_rewrites:2\r\n", "aof_last_bgrewrite_status:ok\r\n"} {
+		if !strings.Contains(buf.String(), field) {
+			t.Errorf("INFO lacks %q:\n%s", field, buf.String())
+		}
+	}
+
+	ctx, _ = bufCtx("CONFIG", bytesArgs("SET", "auto-aof-rewrite-percentage", "50", "auto-aof-rewrite-min-size", "1024"), s)
+	if err := cmdConfigSet(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if minSize, pct := m.RewriteRules(); minSize != 1024 || pct != 50 {
+		t.Errorf("rewrite rules = %d, %d", minSize, pct)
+	}
+
+	ctx, buf = bufCtx("WAITAOF", bytesArgs("1", "0", "0"), s)
+	if err := cmdWAITAOF(ctx); err != nil || buf.String() != "*2\r\n:1\r\n:0\r\n" {
+		t.Errorf("WAITAOF 1 0 0 = %q, %v", buf.String(), err)
+	}
+}
+
+func TestWaitWithoutReplication(t *testing.T) {
+	s := store.NewStore()
+	for _, tc := range []struct {
+		cmd  string
+		args []string
+		want string
+	}{
+		{"WAIT", []string{"1", "1000"}, ":0\r\n"},
+		{"WAIT", []string{"1", "-1"}, "-ERR timeout is negative\r\n"},
+		{"WAITAOF", []string{"0", "1", "1000"}, "*2\r\n:0\r\n:0\r\n"},
+		{"WAITAOF", []string{"1", "0", "0"}, "-ERR WAITAOF cannot be used when numlocal is set but appendonly is disabled.\r\n"},
+	} {
+		ctx, buf := bufCtx(tc.cmd, bytesArgs(tc.args...), s)
+		handler := cmdWAIT
+		if tc.cmd == "WAITAOF" {
+			handler = cmdWAITAOF
+		}
+		if err := handler(ctx); err != nil || buf.String() != tc.want {
+			t.Errorf("%s %v = %q, %v; want %q", tc.cmd, tc.args, buf.String(), err, tc.want)
+		}
+	}
+}
+
+func TestWriteCommandsPreserveSnapshot(t *testing.T) {
+	s := store.NewStore()
+	router := NewRouter()
+	RegisterHashCommands(router)
+	s.Set("h", &store.HashValue{Fields: map[string][]byte{"f": []byte("old")}}, store.SetOptions{})
+
+	snap := s.Snapshot()
+	defer snap.Release()
+	if err := router.Execute(newTestContext("HSET", bytesArgs("h", "f", "new"), s)); err != nil {
+		t.Fatal(err)
+	}
+
+	err := snap.Databases()[0].Range(func(key string, entry *store.Entry) error {
+		if got := string(entry.Value.(*store.HashValue).Fields["f"]); got != "old" {
+			t.Errorf("snapshot sees %q", got)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,328 @@
+package command
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cachestorm/cachestorm/internal/activeactive"
+	"github.com/cachestorm/cachestorm/internal/replication"
+	"github.com/cachestorm/cachestorm/internal/resp"
+	"github.com/cachestorm/cachestorm/internal/store"
+)
+
+const (
+	defaultNamespace = "default"
+	pushQueueSize    = 256
+)
+
+// Session holds per-connection state that must survive between commands:
+// the MULTI queue and watched keys, the authenticated identity, the selected
+// namespace, the client name, tracking configuration and protocol version.
+// A Session is owned by its connection; every Context built for that
+// connection points back at it.
+type Session struct {
+	mu            sync.RWMutex
+	id            int64
+	remoteAddr    string
+	createdAt     time.Time
+	lastActive    time.Time
+	lastCmd       string
+	authenticated bool
+	username      string
+	namespace     string
+	db            int
+	name          string
+	protocol      int
+	monitor       bool
+	subscriber    *store.Subscriber
+	replica       *replication.Replica
+	peer          *activeactive.Stream
+	pushes        chan *resp.Value
+	overflow      chan struct{} // closed once a push did not fit in pushes
+	overflowOnce  sync.Once
+
+	Transaction *Transaction
+	Tracking    *ClientTrackingInfo
+}
+
+func NewSession(id int64, remoteAddr string) *Session {
+	now := time.Now()
+	return &Session{
+		id:          id,
+		remoteAddr:  remoteAddr,
+		createdAt:   now,
+		lastActive:  now,
+		namespace:   defaultNamespace,
+		username:    "default",
+		protocol:    2,
+		pushes:      make(chan *resp.Value, pushQueueSize),
+		overflow:    make(chan struct{}),
+		Transaction: NewTransaction(),
+		Tracking:    &ClientTrackingInfo{},
+	}
+}
+
+func (s *Session) ID() int64 {
+	return s.id
+}
+
+func (s *Session) RemoteAddr() string {
+	return s.remoteAddr
+}
+
+func (s *Session) CreatedAt() time.Time {
+	return s.createdAt
+}
+
+func (s *Session) IsAuthenticated() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.authenticated
+}
+
+func (s *Session) SetAuthenticated(auth bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.authenticated = auth
+}
+
+func (s *Session) Username() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.username
+}
+
+func (s *Session) SetUsername(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.username = name
+}
+
+func (s *Session) Namespace() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.namespace
+}
+
+func (s *Session) DB() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.db
+}
+
+// SelectDB switches the session to a numbered database. Database 0 is the
+// default namespace; database N maps to the namespace "dbN".
+func (s *Session) SelectDB(index int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.db = index
+	s.namespace = store.DBNamespace(index)
+}
+
+// SelectNamespace switches the session to a named namespace.
+func (s *Session) SelectNamespace(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.namespace = name
+	s.db = 0
+}
+
+func (s *Session) Name() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.name
+}
+
+func (s *Session) SetName(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.name = name
+}
+
+func (s *Session) Protocol() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.protocol
+}
+
+func (s *Session) SetProtocol(version int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.protocol = version
+}
+
+// IsMonitor reports whether the session is streaming commands via MONITOR.
+func (s *Session) IsMonitor() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.monitor
+}
+
+func (s *Session) setMonitor(on bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.monitor = on
+}
+
+// Subscriber returns the connection's pub/sub subscriber, if it has one.
+func (s *Session) Subscriber() *store.Subscriber {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.subscriber
+}
+
+func (s *Session) SetSubscriber(sub *store.Subscriber) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subscriber = sub
+}
+
+// Replica returns the replica this connection serves since its PSYNC, if
+// any. The connection then writes the replica's stream.
+func (s *Session) Replica() *replication.Replica {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.replica
+}
+
+func (s *Session) setReplica(r *replication.Replica) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.replica = r
+}
+
+// Peer returns the stream to an active-active peer this connection serves
+// since its ACTIVEACTIVE SYNC, if any.
+func (s *Session) Peer() *activeactive.Stream {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.peer
+}
+
+func (s *Session) setPeer(p *activeactive.Stream) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.peer = p
+}
+
+// Push queues an out-of-band frame (e.g. a tracking invalidation) for the
+// connection to write between replies. It never blocks: when a client is
+// not draining its queue the frame is not queued, Overflowed is closed and
+// the connection is dropped, as a client kept connected would go on
+// trusting a cache it was not told to invalidate.
+func (s *Session) Push(v *resp.Value) bool {
+	select {
+	case s.pushes <- v:
+		return true
+	default:
+		s.overflowOnce.Do(func() { close(s.overflow) })
+		return false
+	}
+}
+
+// Pushes returns the queue of frames waiting to be written.
+func (s *Session) Pushes() <-chan *resp.Value {
+	return s.pushes
+}
+
+// Overflowed is closed once a frame did not fit in the push queue; the
+// connection is then to be closed.
+func (s *Session) Overflowed() <-chan struct{} {
+	return s.overflow
+}
+
+// Touch records the command most recently issued on the session.
+func (s *Session) Touch(cmd string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastCmd = cmd
+	s.lastActive = time.Now()
+}
+
+func (s *Session) LastCommand() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.lastCmd
+}
+
+func (s *Session) IdleTime() time.Duration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return time.Since(s.lastActive)
+}
+
+// Reset restores the session to the state of a freshly connected client.
+func (s *Session) Reset() {
+	s.Transaction.Clear()
+	s.Transaction.ClearWatch()
+	s.mu.Lock()
+	s.namespace = defaultNamespace
+	s.db = 0
+	s.name = ""
+	s.protocol = 2
+	s.mu.Unlock()
+	disableTracking(s)
+	stopMonitor(s)
+}
+
+// Store resolves the keyspace for the session's selected namespace.
+func (s *Session) Store(root *store.Store) *store.Store {
+	return root.ForNamespace(s.Namespace())
+}
+
+var globalSessions = struct {
+	mu       sync.RWMutex
+	sessions map[int64]*Session
+}{
+	sessions: make(map[int64]*Session),
+}
+
+// RegisterSession makes a session visible to CLIENT LIST and to other
+// clients that address it by ID (e.g. tracking redirection).
+func RegisterSession(s *Session) {
+	globalSessions.mu.Lock()
+	globalSessions.sessions[s.id] = s
+	globalSessions.mu.Unlock()
+
+	globalClientTracking.mu.Lock()
+	globalClientTracking.clients[s.id] = s.Tracking
+	globalClientTracking.mu.Unlock()
+}
+
+// UnregisterSession removes a session once its connection is closed.
+func UnregisterSession(s *Session) {
+	globalSessions.mu.Lock()
+	if globalSessions.sessions[s.id] == s {
+		delete(globalSessions.sessions, s.id)
+	}
+	globalSessions.mu.Unlock()
+
+	globalClientTracking.mu.Lock()
+	if globalClientTracking.clients[s.id] == s.Tracking {
+		delete(globalClientTracking.clients, s.id)
+	}
+	globalClientTracking.mu.Unlock()
+
+	disableTracking(s)
+	stopMonitor(s)
+}
+
+func GetSession(id int64) (*Session, bool) {
+	globalSessions.mu.RLock()
+	defer globalSessions.mu.RUnlock()
+	s, ok := globalSessions.sessions[id]
+	return s, ok
+}
+
+// Sessions returns all registered sessions ordered by client ID.
+func Sessions() []*Session {
+	globalSessions.mu.RLock()
+	result := make([]*Session, 0, len(globalSessions.sessions))
+	for _, s := range globalSessions.sessions {
+		result = append(result, s)
+	}
+	globalSessions.mu.RUnlock()
+	sort.Slice(result, func(i, j int) bool { return result[i].id < result[j].id })
+	return result
+}
@@ -140,7 +140,7 @@ func cmdSMEMBERS(ctx *Context) error {
 		return ctx.WriteError(err)
 	}
 	if set == nil {
-		return ctx.WriteArray([]*resp.Value{})
+		return ctx.WriteSet([]*resp.Value{})
 	}
 
 	set.RLock()
@@ -150,7 +150,7 @@ func cmdSMEMBERS(ctx *Context) error {
 		members = append(members, resp.BulkString(member))
 	}
 
-	return ctx.WriteArray(members)
+	return ctx.WriteSet(members)
 }
 
 func cmdSISMEMBER(ctx *Context) error {
@@ -216,6 +216,7 @@ func cmdSPOP(ctx *Context) error {
 		return ctx.WriteError(err)
 	}
 	if set == nil {
+		ctx.propagateNothing()
 		if count == 1 {
 			return ctx.WriteNullBulkString()
 		}
@@ -231,9 +232,11 @@ func cmdSPOP(ctx *Context) error {
 			if isEmpty {
 				ctx.Store.Delete(key)
 			}
+			propagateSPOP(ctx, key, member)
 			return ctx.WriteBulkString(member)
 		}
 		set.Unlock()
+		ctx.propagateNothing()
 		return ctx.WriteNullBulkString()
 	}
 
@@ -244,24 +247,42 @@ func cmdSPOP(ctx *Context) error {
 		}
 		set.Unlock()
 		ctx.Store.Delete(key)
+		ctx.propagate("DEL", []byte(key))
 		return ctx.WriteArray(members)
 	}
 
 	members := make([]*resp.Value, 0, count)
+	popped := make([]string, 0, count)
 	i := 0
 	for member := range set.Members {
 		if i >= count {
 			break
 		}
 		members = append(members, resp.BulkString(member))
+		popped = append(popped, member)
 		delete(set.Members, member)
 		i++
 	}
 	set.Unlock()
 
+	propagateSPOP(ctx, key, popped...)
 	return ctx.WriteArray(members)
 }
 
+// propagateSPOP sends the members SPOP picked at random as an SREM.
+func propagateSPOP(ctx *Context, key string, members ...string) {
+	if len(members) == 0 {
+		ctx.propagateNothing()
+		return
+	}
+	args := make([][]byte, 0, 1+len(members))
+	args = append(args, []byte(key))
+	for _, member := range members {
+		args = append(args, []byte(member))
+	}
+	ctx.propagate("SREM", args...)
+}
+
 func cmdSRANDMEMBER(ctx *Context) error {
 	if ctx.ArgCount() < 1 {
 		return ctx.WriteError(ErrWrongArgCount)
@@ -382,7 +403,7 @@ func cmdSUNION(ctx *Context) error {
 		members = append(members, resp.BulkString(member))
 	}
 
-	return ctx.WriteArray(members)
+	return ctx.WriteSet(members)
 }
 
 func cmdSINTER(ctx *Context) error {
@@ -408,7 +429,7 @@ func cmdSINTER(ctx *Context) error {
 			return ctx.WriteError(err)
 		}
 		if set == nil {
-			return ctx.WriteArray([]*resp.Value{})
+			return ctx.WriteSet([]*resp.Value{})
 		}
 
 		set.RLock()
@@ -425,7 +446,7 @@ func cmdSINTER(ctx *Context) error {
 		members = append(members, resp.BulkString(member))
 	}
 
-	return ctx.WriteArray(members)
+	return ctx.WriteSet(members)
 }
 
 func cmdSDIFF(ctx *Context) error {
@@ -458,7 +479,7 @@ func cmdSDIFF(ctx *Context) error {
 		members = append(members, resp.BulkString(member))
 	}
 
-	return ctx.WriteArray(members)
+	return ctx.WriteSet(members)
 }
 
 func cmdSUNIONSTORE(ctx *Context) error {
@@ -293,7 +293,7 @@ func cmdZINCRBY(ctx *Context) error {
 	}
 	zset.Members[member] = newScore
 
-	return ctx.WriteBulkString(strconv.FormatFloat(newScore, 'f', -1, 64))
+	return ctx.WriteDouble(newScore)
 }
 
 func cmdZRANGE(ctx *Context) error {
@@ -397,14 +397,31 @@ func cmdZRANGE(ctx *Context) error {
 		entries = zset.GetSortedRange(start, stop, false, rev)
 	}
 
+	return writeScoredEntries(ctx, entries, withScores)
+}
+
+// writeScoredEntries replies with sorted set entries. With scores, RESP3
+// clients receive [member, score] pairs carrying native doubles while RESP2
+// clients get the flat member/score array.
+func writeScoredEntries(ctx *Context, entries []store.SortedEntry, withScores bool) error {
+	if withScores && ctx.IsRESP3() {
+		results := make([]*resp.Value, 0, len(entries))
+		for _, e := range entries {
+			results = append(results, resp.ArrayValue([]*resp.Value{
+				resp.BulkString(e.Member),
+				ctx.DoubleValue(e.Score),
+			}))
+		}
+		return ctx.WriteArray(results)
+	}
+
 	results := make([]*resp.Value, 0, len(entries)*2)
 	for _, e := range entries {
 		results = append(results, resp.BulkString(e.Member))
 		if withScores {
-			results = append(results, resp.BulkString(strconv.FormatFloat(e.Score, 'f', -1, 64)))
+			results = append(results, ctx.DoubleValue(e.Score))
 		}
 	}
-
 	return ctx.WriteArray(results)
 }
 
@@ -502,15 +519,7 @@ func cmdZRANGEBYSCORE(ctx *Context) error {
 	entries := zset.RangeByScore(minScore, maxScore, withScores, false)
 	zset.RUnlock()
 
-	results := make([]*resp.Value, 0, len(entries)*2)
-	for _, e := range entries {
-		results = append(results, resp.BulkString(e.Member))
-		if withScores {
-			results = append(results, resp.BulkString(strconv.FormatFloat(e.Score, 'f', -1, 64)))
-		}
-	}
-
-	return ctx.WriteArray(results)
+	return writeScoredEntries(ctx, entries, withScores)
 }
 
 func cmdZRANK(ctx *Context) error {
@@ -666,7 +675,7 @@ func cmdZSCORE(ctx *Context) error {
 		return ctx.WriteNull()
 	}
 
-	return ctx.WriteBulkString(strconv.FormatFloat(score, 'f', -1, 64))
+	return ctx.WriteDouble(score)
 }
 
 func cmdZREVRANGE(ctx *Context) error {
@@ -703,15 +712,7 @@ func cmdZREVRANGE(ctx *Context) error {
 	entries := zset.GetSortedRange(start, stop, withScores, true)
 	zset.RUnlock()
 
-	results := make([]*resp.Value, 0, len(entries)*2)
-	for _, e := range entries {
-		results = append(results, resp.BulkString(e.Member))
-		if withScores {
-			results = append(results, resp.BulkString(strconv.FormatFloat(e.Score, 'f', -1, 64)))
-		}
-	}
-
-	return ctx.WriteArray(results)
+	return writeScoredEntries(ctx, entries, withScores)
 }
 
 func cmdZREVRANK(ctx *Context) error {
@@ -770,15 +771,7 @@ func cmdZREVRANGEBYSCORE(ctx *Context) error {
 
 	entries := zset.RangeByScore(min, max, withScores, true)
 
-	results := make([]*resp.Value, 0, len(entries)*2)
-	for _, e := range entries {
-		results = append(results, resp.BulkString(e.Member))
-		if withScores {
-			results = append(results, resp.BulkString(strconv.FormatFloat(e.Score, 'f', -1, 64)))
-		}
-	}
-
-	return ctx.WriteArray(results)
+	return writeScoredEntries(ctx, entries, withScores)
 }
 
 func cmdZLEXCOUNT(ctx *Context) error {
@@ -1142,7 +1135,7 @@ func cmdZMSCORE(ctx *Context) error {
 		if !exists {
 			result = append(result, resp.NullValue())
 		} else {
-			result = append(result, resp.BulkString(strconv.FormatFloat(score, 'f', -1, 64)))
+			result = append(result, ctx.DoubleValue(score))
 		}
 	}
 
@@ -1797,8 +1790,14 @@ func cmdBZPOPGeneric(ctx *Context, max bool) error {
 		return ctx.WriteError(ErrNotInteger)
 	}
 
+	popCommand := "ZPOPMIN"
+	if max {
+		popCommand = "ZPOPMAX"
+	}
+
 	// Try immediate pop
 	if key, member, score, ok := tryZPop(ctx, keys, max); ok {
+		ctx.propagate(popCommand, []byte(key))
 		return ctx.WriteArray([]*resp.Value{
 			resp.BulkString(key),
 			resp.BulkString(member),
@@ -1807,6 +1806,7 @@ func cmdBZPOPGeneric(ctx *Context, max bool) error {
 	}
 
 	if timeout == 0 {
+		ctx.propagateNothing()
 		return ctx.WriteNull()
 	}
 
@@ -1816,9 +1816,11 @@ func cmdBZPOPGeneric(ctx *Context, max bool) error {
 	for {
 		notifiedKey, notified := notifier.WaitForKeys(keys, dur)
 		if !notified {
+			ctx.propagateNothing()
 			return ctx.WriteNull()
 		}
 		if key, member, score, ok := tryZPop(ctx, []string{notifiedKey}, max); ok {
+			ctx.propagate(popCommand, []byte(key))
 			return ctx.WriteArray([]*resp.Value{
 				resp.BulkString(key),
 				resp.BulkString(member),
@@ -1902,8 +1904,14 @@ func cmdBZMPOP(ctx *Context) error {
 
 	max := dir == "MAX"
 
+	propagateZMPOP := func(key string, popped int) {
+		ctx.propagate("ZMPOP", []byte("1"), []byte(key), []byte(dir),
+			[]byte("COUNT"), []byte(strconv.Itoa(popped)))
+	}
+
 	// Try immediate pop
 	if key, popped := tryZMPop(ctx, keys, count, max); popped != nil {
+		propagateZMPOP(key, len(popped))
 		return ctx.WriteArray([]*resp.Value{
 			resp.BulkString(key),
 			resp.ArrayValue(popped),
@@ -1911,6 +1919,7 @@ func cmdBZMPOP(ctx *Context) error {
 	}
 
 	if timeout == 0 {
+		ctx.propagateNothing()
 		return ctx.WriteNull()
 	}
 
@@ -1920,9 +1929,11 @@ func cmdBZMPOP(ctx *Context) error {
 	for {
 		_, notified := notifier.WaitForKeys(keys, dur)
 		if !notified {
+			ctx.propagateNothing()
 			return ctx.WriteNull()
 		}
 		if key, popped := tryZMPop(ctx, keys, count, max); popped != nil {
+			propagateZMPOP(key, len(popped))
 			return ctx.WriteArray([]*resp.Value{
 				resp.BulkString(key),
 				resp.ArrayValue(popped),
@@ -151,6 +151,7 @@ loop:
 		return ctx.WriteError(ErrWrongArgCount)
 	}
 
+	idIdx := argIdx
 	id := ctx.ArgString(argIdx)
 	argIdx++
 
@@ -185,6 +186,12 @@ loop:
 
 	_ = entry
 	_ = approximate
+	if ctx.ArgString(idIdx) != id {
+		// Replay with the ID the entry got, not a new one
+		args := append([][]byte(nil), ctx.Args...)
+		args[idIdx] = []byte(id)
+		ctx.propagate("XADD", args...)
+	}
 	ctx.Store.KeyNotifier().NotifyKey(key)
 	return ctx.WriteBulkString(id)
 }
@@ -648,6 +648,7 @@ func cmdINCRBYFLOAT(ctx *Context) error {
 	if !exists {
 		result := strconv.FormatFloat(incr, 'f', -1, 64)
 		ctx.Store.Set(key, &store.StringValue{Data: []byte(result)}, store.SetOptions{})
+		ctx.propagate("SET", []byte(key), []byte(result))
 		return ctx.WriteBulkString(result)
 	}
 
@@ -663,6 +664,7 @@ func cmdINCRBYFLOAT(ctx *Context) error {
 
 	result := strconv.FormatFloat(current+incr, 'f', -1, 64)
 	ctx.Store.Set(key, &store.StringValue{Data: []byte(result)}, store.SetOptions{})
+	ctx.propagate("SET", []byte(key), []byte(result))
 	return ctx.WriteBulkString(result)
 }
 
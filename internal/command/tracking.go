@@ -0,0 +1,292 @@
+package command
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cachestorm/cachestorm/internal/resp"
+	"github.com/cachestorm/cachestorm/internal/store"
+)
+
+// Server-assisted client-side caching (CLIENT TRACKING).
+//
+// In the default mode the server remembers which keys each tracking client
+// has read and sends a single invalidation when one of them changes; the
+// client has to read the key again to be told about the next change. In
+// BCAST mode nothing is remembered and the client is told about every
+// modified key that matches one of its prefixes.
+//
+// Invalidations are delivered as RESP3 pushes on the tracking connection, or
+// on the REDIRECT connection, where RESP2 clients receive them as messages
+// on the __redis__:invalidate channel.
+
+const invalidateChannel = "__redis__:invalidate"
+
+// CLIENT CACHING state for the next command in OPTIN/OPTOUT mode.
+const (
+	cachingDefault = iota
+	cachingYes
+	cachingNo
+)
+
+type trackingTable struct {
+	mu     sync.Mutex
+	keys   map[string]map[int64]struct{} // key -> IDs of clients that read it
+	bcast  map[int64]*Session
+	active atomic.Int64 // sessions with tracking on; zero skips all work
+	pubsub *store.PubSub
+}
+
+var globalTracking = &trackingTable{
+	keys:  make(map[string]map[int64]struct{}),
+	bcast: make(map[int64]*Session),
+}
+
+// EnableTracking connects the store's modification hook to the tracking
+// table so that writes, expiries, evictions and flushes invalidate the
+// caches of tracking clients.
+func EnableTracking(s *store.Store) {
+	globalTracking.mu.Lock()
+	globalTracking.pubsub = s.GetPubSub()
+	globalTracking.mu.Unlock()
+	s.SetInvalidationHook(globalTracking.invalidate)
+}
+
+// keyRange locates the key arguments of a command: args[first], then every
+// step-th argument through args[last]. A negative last counts from the end.
+type keyRange struct {
+	first, last, step int
+}
+
+var singleKey = keyRange{0, 0, 1}
+var allKeys = keyRange{0, -1, 1}
+
+func (kr keyRange) keys(args [][]byte) []string {
+	last := kr.last
+	if last < 0 {
+		last = len(args) + last
+	}
+	if last >= len(args) {
+		last = len(args) - 1
+	}
+	var keys []string
+	for i := kr.first; i <= last; i += kr.step {
+		keys = append(keys, string(args[i]))
+	}
+	return keys
+}
+
+// trackRead remembers the keys read by a default-mode tracking client.
+func trackRead(ctx *Context, cmd *CommandDef) {
+	if ctx.Session == nil || len(ctx.Args) == 0 {
+		return
+	}
+	info := ctx.Session.Tracking
+	info.mu.RLock()
+	track := info.enabled && !info.bcast && info.cachingAllowed()
+	info.mu.RUnlock()
+	if !track {
+		return
+	}
+
+	id := ctx.Session.ID()
+	globalTracking.mu.Lock()
+	for _, key := range cmd.keys(ctx.Args) {
+		clients := globalTracking.keys[key]
+		if clients == nil {
+			clients = make(map[int64]struct{})
+			globalTracking.keys[key] = clients
+		}
+		clients[id] = struct{}{}
+	}
+	globalTracking.mu.Unlock()
+}
+
+// trackWriteStart records the arguments of a write issued by a NOLOOP client
+// so that invalidations it causes itself are not sent back to it.
+func trackWriteStart(ctx *Context) {
+	if ctx.Session == nil {
+		return
+	}
+	info := ctx.Session.Tracking
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	if !info.enabled || !info.noLoop {
+		return
+	}
+	info.writing = make(map[string]struct{}, len(ctx.Args))
+	for _, arg := range ctx.Args {
+		info.writing[string(arg)] = struct{}{}
+	}
+}
+
+func trackWriteEnd(ctx *Context) {
+	if ctx.Session == nil {
+		return
+	}
+	info := ctx.Session.Tracking
+	info.mu.Lock()
+	info.writing = nil
+	info.mu.Unlock()
+}
+
+// consumeCaching clears a CLIENT CACHING YES/NO once the command it applied
+// to has run.
+func consumeCaching(ctx *Context) {
+	if ctx.Session == nil || ctx.Command == "MULTI" {
+		return
+	}
+	if ctx.Command == "CLIENT" && len(ctx.Args) > 0 && strings.EqualFold(string(ctx.Args[0]), "CACHING") {
+		return
+	}
+	info := ctx.Session.Tracking
+	info.mu.Lock()
+	info.caching = cachingDefault
+	info.mu.Unlock()
+}
+
+// enableTracking registers a session that has just turned tracking on.
+func enableTracking(sess *Session, wasEnabled, bcast bool) {
+	if !wasEnabled {
+		globalTracking.active.Add(1)
+	}
+	globalTracking.mu.Lock()
+	if bcast {
+		globalTracking.bcast[sess.ID()] = sess
+	} else {
+		delete(globalTracking.bcast, sess.ID())
+	}
+	globalTracking.mu.Unlock()
+}
+
+// disableTracking turns tracking off for a session. Keys it read stay in the
+// table until they are next invalidated; delivery skips sessions that are no
+// longer tracking.
+func disableTracking(sess *Session) {
+	info := sess.Tracking
+	info.mu.Lock()
+	wasEnabled := info.enabled
+	info.reset()
+	info.mu.Unlock()
+
+	globalTracking.mu.Lock()
+	delete(globalTracking.bcast, sess.ID())
+	globalTracking.mu.Unlock()
+	if wasEnabled {
+		globalTracking.active.Add(-1)
+	}
+}
+
+// invalidate is the store's modification hook.
+func (t *trackingTable) invalidate(keys []string) {
+	if t.active.Load() == 0 {
+		return
+	}
+	if keys == nil {
+		t.invalidateAll()
+		return
+	}
+
+	targets := make(map[*Session][]string)
+	t.mu.Lock()
+	for _, key := range keys {
+		for id := range t.keys[key] {
+			if sess, ok := GetSession(id); ok {
+				targets[sess] = append(targets[sess], key)
+			}
+		}
+		delete(t.keys, key)
+		for _, sess := range t.bcast {
+			if sess.Tracking.matchesPrefix(key) {
+				targets[sess] = append(targets[sess], key)
+			}
+		}
+	}
+	t.mu.Unlock()
+
+	for sess, sessKeys := range targets {
+		t.send(sess, sessKeys)
+	}
+}
+
+// invalidateAll tells every tracking client to drop its whole cache.
+func (t *trackingTable) invalidateAll() {
+	t.mu.Lock()
+	t.keys = make(map[string]map[int64]struct{})
+	t.mu.Unlock()
+	for _, sess := range Sessions() {
+		t.send(sess, nil)
+	}
+}
+
+// send delivers an invalidation for keys, or for everything when keys is
+// nil, to the session or its redirect target.
+func (t *trackingTable) send(sess *Session, keys []string) {
+	info := sess.Tracking
+	info.mu.RLock()
+	enabled, redirect := info.enabled, info.redirect
+	if keys != nil && info.writing != nil {
+		filtered := keys[:0:0]
+		for _, key := range keys {
+			if _, own := info.writing[key]; !own {
+				filtered = append(filtered, key)
+			}
+		}
+		keys = filtered
+	}
+	info.mu.RUnlock()
+	if !enabled || (keys != nil && len(keys) == 0) {
+		return
+	}
+
+	payload := resp.NullValue()
+	if keys != nil {
+		items := make([]*resp.Value, len(keys))
+		for i, key := range keys {
+			items[i] = resp.BulkString(key)
+		}
+		payload = resp.ArrayValue(items)
+	}
+
+	target := sess
+	if redirect != 0 {
+		var ok bool
+		target, ok = GetSession(redirect)
+		if !ok {
+			if sess.Protocol() == 3 {
+				sess.Push(resp.PushValue([]*resp.Value{
+					resp.BulkString("tracking-redir-broken"),
+					resp.IntegerValue(redirect),
+				}))
+			}
+			return
+		}
+	}
+
+	if target.Protocol() == 3 {
+		target.Push(resp.PushValue([]*resp.Value{resp.BulkString("invalidate"), payload}))
+		return
+	}
+	if redirect != 0 && t.subscribedToInvalidations(target) {
+		target.Push(resp.PushValue([]*resp.Value{
+			resp.BulkString("message"),
+			resp.BulkString(invalidateChannel),
+			payload,
+		}))
+	}
+}
+
+func (t *trackingTable) subscribedToInvalidations(sess *Session) bool {
+	t.mu.Lock()
+	ps := t.pubsub
+	t.mu.Unlock()
+	sub := sess.Subscriber()
+	return ps != nil && sub != nil && ps.IsSubscribed(sub, invalidateChannel)
+}
+
+// trackingRedirectAlive reports whether a redirect target is connected.
+func trackingRedirectAlive(id int64) bool {
+	_, ok := GetSession(id)
+	return ok
+}
@@ -1,6 +1,7 @@
 package command
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"sync"
@@ -14,12 +15,15 @@ var (
 	ErrExecWithoutMulti    = errors.New("ERR EXEC without MULTI")
 	ErrDiscardWithoutMulti = errors.New("ERR DISCARD without MULTI")
 	ErrWatchInMulti        = errors.New("ERR WATCH inside MULTI is not allowed")
+	ErrNestedMulti         = errors.New("ERR MULTI calls can not be nested")
+	ErrExecAbort           = errors.New("EXECABORT Transaction discarded because of previous errors.")
 )
 
 type Transaction struct {
 	mu          sync.Mutex
 	queued      []queuedCommand
 	active      bool
+	dirty       bool
 	watchedKeys map[string]int64
 }
 
@@ -55,6 +59,7 @@ func (t *Transaction) Clear() {
 	defer t.mu.Unlock()
 	t.queued = t.queued[:0]
 	t.active = false
+	t.dirty = false
 }
 
 func (t *Transaction) ClearWatch() {
@@ -73,9 +78,26 @@ func (t *Transaction) Start() {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 	t.active = true
+	t.dirty = false
 	t.queued = t.queued[:0]
 }
 
+// MarkDirty flags the open transaction so that EXEC aborts it. Redis does
+// this when a command is rejected while being queued.
+func (t *Transaction) MarkDirty() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.active {
+		t.dirty = true
+	}
+}
+
+func (t *Transaction) IsDirty() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.dirty
+}
+
 func (t *Transaction) Watch(key string, version int64) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
@@ -109,8 +131,8 @@ func RegisterTransactionCommands(router *Router) {
 }
 
 func cmdMULTI(ctx *Context) error {
-	if ctx.Transaction.HasWatchedKeys() {
-		ctx.Transaction.ClearWatch()
+	if ctx.Transaction.IsActive() {
+		return ctx.WriteError(ErrNestedMulti)
 	}
 	ctx.Transaction.Start()
 	return ctx.WriteOK()
@@ -121,6 +143,12 @@ func cmdEXEC(ctx *Context) error {
 		return ctx.WriteError(ErrExecWithoutMulti)
 	}
 
+	if ctx.Transaction.IsDirty() {
+		ctx.Transaction.Clear()
+		ctx.Transaction.ClearWatch()
+		return ctx.WriteError(ErrExecAbort)
+	}
+
 	if ctx.Transaction.HasWatchedKeys() {
 		if !ctx.Transaction.CheckWatchedVersions(ctx.Store.GetVersion) {
 			ctx.Transaction.Clear()
@@ -131,6 +159,7 @@ func cmdEXEC(ctx *Context) error {
 
 	queued := ctx.Transaction.GetQueued()
 	ctx.Transaction.Clear()
+	ctx.Transaction.ClearWatch()
 
 	if len(queued) == 0 {
 		return ctx.WriteArray([]*resp.Value{})
@@ -139,7 +168,7 @@ func cmdEXEC(ctx *Context) error {
 	results := make([]*resp.Value, 0, len(queued))
 
 	for _, qc := range queued {
-		result := executeQueuedCommand(ctx, qc)
+		result := runQueuedCommand(ctx, qc)
 		results = append(results, result)
 	}
 
@@ -175,6 +204,51 @@ func cmdUNWATCH(ctx *Context) error {
 	return ctx.WriteOK()
 }
 
+// abortTransaction marks an open MULTI block as failed after a command was
+// rejected while being queued.
+func (ctx *Context) abortTransaction() {
+	if ctx.Transaction != nil {
+		ctx.Transaction.MarkDirty()
+	}
+}
+
+// runQueuedCommand executes a command queued by MULTI through the router, so
+// any registered command can be used inside a transaction, and captures its
+// reply for the EXEC result array. Without a router it falls back to the
+// built-in subset in executeQueuedCommand.
+func runQueuedCommand(ctx *Context, qc queuedCommand) *resp.Value {
+	if globalRouter == nil {
+		return executeQueuedCommand(ctx, qc)
+	}
+	def, ok := globalRouter.Get(qc.cmd)
+	if !ok {
+		return executeQueuedCommand(ctx, qc)
+	}
+
+	var buf bytes.Buffer
+	w := resp.NewWriter(&buf)
+	w.SetProtocol(ctx.Writer.Protocol())
+	sub := ctx.derive(qc.cmd, qc.args, w)
+	sub.exec = ctx
+	// Permissions are checked again in case they changed since queueing
+	var err error
+	if sub.checkACL(aclContextMulti) {
+		err = globalRouter.dispatch(sub, def)
+	}
+	if buf.Len() == 0 {
+		if err != nil {
+			return resp.ErrorValue(err.Error())
+		}
+		return resp.NullBulkString()
+	}
+
+	v, readErr := resp.NewReader(&buf).ReadValue()
+	if readErr != nil {
+		return resp.ErrorValue("ERR " + readErr.Error())
+	}
+	return v
+}
+
 func executeQueuedCommand(ctx *Context, qc queuedCommand) *resp.Value {
 	switch qc.cmd {
 	case "SET":
@@ -2,7 +2,6 @@ package command
 
 import (
 	"fmt"
-	"sync"
 
 	"github.com/cachestorm/cachestorm/internal/resp"
 	"github.com/cachestorm/cachestorm/internal/store"
@@ -49,6 +48,7 @@ func RegisterUtilityExtCommands(router *Router) {
 	router.Register(&CommandDef{Name: "BACKUP.RESTORE", Handler: cmdBACKUPRESTORE})
 	router.Register(&CommandDef{Name: "BACKUP.LIST", Handler: cmdBACKUPLIST})
 	router.Register(&CommandDef{Name: "BACKUP.DELETE", Handler: cmdBACKUPDELETE})
+	router.Register(&CommandDef{Name: "BACKUP.VERIFY", Handler: cmdBACKUPVERIFY})
 
 	router.Register(&CommandDef{Name: "MEMORY.TRIM", Handler: cmdMEMORYTRIM})
 	router.Register(&CommandDef{Name: "MEMORY.FRAG", Handler: cmdMEMORYFRAG})
@@ -547,96 +547,6 @@ func cmdCOUNTERRESETALL(ctx *Context) error {
 	return ctx.WriteOK()
 }
 
-var (
-	backups   = make(map[string]string)
-	backupsMu sync.RWMutex
-)
-
-func cmdBACKUPCREATE(ctx *Context) error {
-	if ctx.ArgCount() < 1 {
-		return ctx.WriteError(ErrWrongArgCount)
-	}
-
-	name := ctx.ArgString(0)
-
-	keys := ctx.Store.Keys()
-	backup := ""
-	for _, k := range keys {
-		entry, ok := ctx.Store.Get(k)
-		if ok && entry != nil {
-			backup += k + ":" + entry.Value.String() + "\n"
-		}
-	}
-
-	backupsMu.Lock()
-	backups[name] = backup
-	backupsMu.Unlock()
-
-	return ctx.WriteInteger(int64(len(keys)))
-}
-
-func cmdBACKUPRESTORE(ctx *Context) error {
-	if ctx.ArgCount() < 1 {
-		return ctx.WriteError(ErrWrongArgCount)
-	}
-
-	name := ctx.ArgString(0)
-
-	backupsMu.RLock()
-	backup, ok := backups[name]
-	backupsMu.RUnlock()
-
-	if !ok {
-		return ctx.WriteError(fmt.Errorf("ERR backup not found"))
-	}
-
-	lines := splitLines(backup)
-	count := 0
-
-	for _, line := range lines {
-		if line == "" {
-			continue
-		}
-		parts := splitFirst(line, ":")
-		if len(parts) == 2 {
-			ctx.Store.Set(parts[0], &store.StringValue{Data: []byte(parts[1])}, store.SetOptions{})
-			count++
-		}
-	}
-
-	return ctx.WriteInteger(int64(count))
-}
-
-func cmdBACKUPLIST(ctx *Context) error {
-	backupsMu.RLock()
-	defer backupsMu.RUnlock()
-
-	results := make([]*resp.Value, 0)
-	for name := range backups {
-		results = append(results, resp.BulkString(name))
-	}
-
-	return ctx.WriteArray(results)
-}
-
-func cmdBACKUPDELETE(ctx *Context) error {
-	if ctx.ArgCount() < 1 {
-		return ctx.WriteError(ErrWrongArgCount)
-	}
-
-	name := ctx.ArgString(0)
-
-	backupsMu.Lock()
-	defer backupsMu.Unlock()
-
-	if _, exists := backups[name]; !exists {
-		return ctx.WriteInteger(0)
-	}
-
-	delete(backups, name)
-	return ctx.WriteInteger(1)
-}
-
 func splitLines(s string) []string {
 	result := make([]string, 0)
 	start := 0
@@ -9,15 +9,16 @@ import (
 )
 
 type Config struct {
-	Server      ServerConfig               `yaml:"server"`
-	HTTP        HTTPConfig                 `yaml:"http"`
-	Memory      MemoryConfig               `yaml:"memory"`
-	Namespaces  map[string]NamespaceConfig `yaml:"namespaces"`
-	Cluster     ClusterConfig              `yaml:"cluster"`
-	Persistence PersistenceConfig          `yaml:"persistence"`
-	Replication ReplicationConfig          `yaml:"replication"`
-	Plugins     PluginsConfig              `yaml:"plugins"`
-	Logging     LoggingConfig              `yaml:"logging"`
+	Server       ServerConfig               `yaml:"server"`
+	HTTP         HTTPConfig                 `yaml:"http"`
+	Memory       MemoryConfig               `yaml:"memory"`
+	Namespaces   map[string]NamespaceConfig `yaml:"namespaces"`
+	Cluster      ClusterConfig              `yaml:"cluster"`
+	Persistence  PersistenceConfig          `yaml:"persistence"`
+	Replication  ReplicationConfig          `yaml:"replication"`
+	ActiveActive ActiveActiveConfig         `yaml:"active_active"`
+	Plugins      PluginsConfig              `yaml:"plugins"`
+	Logging      LoggingConfig              `yaml:"logging"`
 }
 
 type ServerConfig struct {
@@ -30,6 +31,7 @@ type ServerConfig struct {
 	ReadBufferSize  int    `yaml:"read_buffer_size" default:"4096"`
 	WriteBufferSize int    `yaml:"write_buffer_size" default:"4096"`
 	RequirePass     string `yaml:"requirepass"`
+	ACLFile         string `yaml:"aclfile"`
 	TLSCertFile     string `yaml:"tls_cert_file"`
 	TLSKeyFile      string `yaml:"tls_key_file"`
 }
@@ -48,6 +50,14 @@ type MemoryConfig struct {
 	WarningPct     int    `yaml:"pressure_warning" default:"70"`
 	CriticalPct    int    `yaml:"pressure_critical" default:"85"`
 	SampleSize     int    `yaml:"eviction_sample_size" default:"5"`
+	// TierDir enables the disk tier: eviction moves the values of cold keys
+	// to segment files in this directory instead of deleting the keys, and
+	// reads them back when the keys are accessed. TierSegmentSize is the
+	// size of a segment file and TierCompactRatio the share of a segment
+	// that must be dead before it is compacted.
+	TierDir          string  `yaml:"tier_dir"`
+	TierSegmentSize  string  `yaml:"tier_segment_size" default:"64mb"`
+	TierCompactRatio float64 `yaml:"tier_compact_ratio" default:"0.5"`
 }
 
 type NamespaceConfig struct {
@@ -71,8 +81,31 @@ type PersistenceConfig struct {
 	AOF              bool   `yaml:"aof" default:"true"`
 	AOFSync          string `yaml:"aof_sync" default:"everysec"`
 	SnapshotInterval string `yaml:"snapshot_interval" default:"5m"`
+	Save             string `yaml:"save" default:"3600 1 300 100 60 10000"`
+	RDBFilename      string `yaml:"rdb_filename" default:"dump.rdb"`
 	DataDir          string `yaml:"data_dir" default:"/var/lib/cachestorm"`
 	MaxAOFSize       string `yaml:"max_aof_size" default:"1gb"`
+	// AOFRewritePercentage and AOFRewriteMinSize rewrite the AOF once it has
+	// grown by that percentage since the last rewrite and is at least the
+	// minimum size.
+	AOFRewritePercentage int    `yaml:"aof_rewrite_percentage" default:"100"`
+	AOFRewriteMinSize    string `yaml:"aof_rewrite_min_size" default:"64mb"`
+	// AOFLoadTruncated loads an AOF whose last command was cut short by a
+	// crash up to the last complete command, instead of refusing to start.
+	AOFLoadTruncated bool `yaml:"aof_load_truncated" default:"true"`
+	// AOFTimestampEnabled annotates the AOF with the time of its writes,
+	// which point-in-time restores need.
+	AOFTimestampEnabled bool `yaml:"aof_timestamp_enabled" default:"false"`
+	// AOFRestoreUntil, an RFC 3339 time, cuts the AOF back to that instant
+	// before it is loaded; see "cachestorm restore".
+	AOFRestoreUntil string `yaml:"aof_restore_until"`
+	// BackupDir holds the BACKUP.CREATE backups, data_dir/backups when
+	// empty. BackupRetention keeps that many of the newest backups and
+	// BackupMaxAge removes older ones; unset, backups are kept until
+	// deleted.
+	BackupDir       string `yaml:"backup_dir"`
+	BackupRetention int    `yaml:"backup_retention" default:"0"`
+	BackupMaxAge    string `yaml:"backup_max_age"`
 }
 
 type ReplicationConfig struct {
@@ -84,6 +117,49 @@ type ReplicationConfig struct {
 	ReplicaAnnouncePort int    `yaml:"replica_announce_port"`
 	ReadOnly            bool   `yaml:"read_only" default:"true"`
 	ReplTimeout         int    `yaml:"repl_timeout" default:"60"`
+	// ServeStaleData lets a replica answer from its dataset while the link
+	// to its master is down. Otherwise it answers -MASTERDOWN until the
+	// link is back.
+	ServeStaleData bool `yaml:"serve_stale_data" default:"true"`
+	// ReplBacklogSize is the size of the buffer keeping the latest writes
+	// sent to replicas, from which a replica that reconnects catches up
+	// without a full sync. A master with no replicas frees it after
+	// ReplBacklogTTL seconds; 0 keeps it.
+	ReplBacklogSize string `yaml:"repl_backlog_size" default:"1mb"`
+	ReplBacklogTTL  int    `yaml:"repl_backlog_ttl" default:"3600"`
+	// A master refuses writes while fewer than MinReplicasToWrite replicas
+	// have acknowledged the stream in the last MinReplicasMaxLag seconds.
+	// 0 accepts writes regardless.
+	MinReplicasToWrite int `yaml:"min_replicas_to_write" default:"0"`
+	MinReplicasMaxLag  int `yaml:"min_replicas_max_lag" default:"10"`
+	// ReplDisklessSync streams full syncs to the replicas that support it
+	// as the snapshot is encoded, instead of encoding it first. A transfer
+	// waits ReplDisklessSyncDelay seconds for more replicas to share it.
+	ReplDisklessSync      bool `yaml:"repl_diskless_sync" default:"false"`
+	ReplDisklessSyncDelay int  `yaml:"repl_diskless_sync_delay" default:"5"`
+}
+
+// ActiveActiveConfig makes the node one of several that all accept writes
+// to the same dataset and exchange them, resolving conflicting writes per
+// type instead of having a single master.
+type ActiveActiveConfig struct {
+	Enabled bool `yaml:"enabled" default:"false"`
+	// NodeID names the node in the metadata of its writes, so it must be
+	// unique among the nodes and must not change across restarts.
+	NodeID string `yaml:"node_id"`
+	// Peers are the host:port client addresses of the other nodes.
+	Peers    []string `yaml:"peers"`
+	PeerAuth string   `yaml:"peer_auth"`
+	// OpLogSize is how many of its latest writes the node keeps for peers
+	// catching up after a dropped link; one further behind is sent the
+	// whole dataset.
+	OpLogSize int `yaml:"op_log_size" default:"100000"`
+	// TombstoneTTL is how many seconds the metadata of deleted keys is
+	// kept to order the delete against writes made elsewhere; 0 keeps it.
+	TombstoneTTL int `yaml:"tombstone_ttl" default:"86400"`
+	// Timeout is how many seconds a silent peer link is given before it
+	// is reconnected.
+	Timeout int `yaml:"timeout" default:"60"`
 }
 
 type PluginsConfig struct {
@@ -231,6 +231,24 @@ func TestValidateClusterEnabledWithNodeName(t *testing.T) {
 	}
 }
 
+func TestValidateActiveActive(t *testing.T) {
+	cfg := Default()
+	cfg.ActiveActive.Enabled = true
+	if err := Validate(cfg); err == nil {
+		t.Error("expected error for active-active without node_id")
+	}
+
+	cfg.ActiveActive.NodeID = "eu-1"
+	if err := Validate(cfg); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	cfg.Replication.Role = "replica"
+	if err := Validate(cfg); err == nil {
+		t.Error("expected error for active-active on a replica")
+	}
+}
+
 func TestParseMemorySize(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -16,11 +16,13 @@ func Default() *Config {
 			Password: "",
 		},
 		Memory: MemoryConfig{
-			MaxMemory:      "0",
-			EvictionPolicy: "allkeys-lru",
-			WarningPct:     70,
-			CriticalPct:    85,
-			SampleSize:     5,
+			MaxMemory:        "0",
+			EvictionPolicy:   "allkeys-lru",
+			WarningPct:       70,
+			CriticalPct:      85,
+			SampleSize:       5,
+			TierSegmentSize:  "64mb",
+			TierCompactRatio: 0.5,
 		},
 		Namespaces: map[string]NamespaceConfig{
 			"default": {},
@@ -30,11 +32,29 @@ func Default() *Config {
 			Replicas: 1,
 		},
 		Persistence: PersistenceConfig{
-			AOF:              true,
-			AOFSync:          "everysec",
-			SnapshotInterval: "5m",
-			DataDir:          "/var/lib/cachestorm",
-			MaxAOFSize:       "1gb",
+			AOF:                  true,
+			AOFSync:              "everysec",
+			SnapshotInterval:     "5m",
+			Save:                 "3600 1 300 100 60 10000",
+			RDBFilename:          "dump.rdb",
+			DataDir:              "/var/lib/cachestorm",
+			MaxAOFSize:           "1gb",
+			AOFRewritePercentage: 100,
+			AOFRewriteMinSize:    "64mb",
+			AOFLoadTruncated:     true,
+		},
+		Replication: ReplicationConfig{
+			ReadOnly:              true,
+			ServeStaleData:        true,
+			ReplBacklogSize:       "1mb",
+			ReplBacklogTTL:        3600,
+			MinReplicasMaxLag:     10,
+			ReplDisklessSyncDelay: 5,
+		},
+		ActiveActive: ActiveActiveConfig{
+			OpLogSize:    100000,
+			TombstoneTTL: 86400,
+			Timeout:      60,
 		},
 		Plugins: PluginsConfig{
 			Stats: StatsPluginConfig{
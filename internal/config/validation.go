@@ -40,6 +40,43 @@ func Validate(cfg *Config) error {
 		return fmt.Errorf("invalid eviction policy: %s", cfg.Memory.EvictionPolicy)
 	}
 
+	if cfg.Memory.TierDir != "" {
+		if _, err := ParseMemorySize(cfg.Memory.TierSegmentSize); err != nil {
+			return fmt.Errorf("invalid tier_segment_size: %s", cfg.Memory.TierSegmentSize)
+		}
+		if cfg.Memory.TierCompactRatio <= 0 || cfg.Memory.TierCompactRatio > 1 {
+			return fmt.Errorf("tier_compact_ratio must be above 0 and at most 1")
+		}
+	}
+
+	if size, err := ParseMemorySize(cfg.Replication.ReplBacklogSize); err != nil || size < 0 {
+		return fmt.Errorf("invalid repl_backlog_size: %s", cfg.Replication.ReplBacklogSize)
+	}
+	if cfg.Replication.ReplBacklogTTL < 0 {
+		return fmt.Errorf("repl_backlog_ttl cannot be negative")
+	}
+	if cfg.Replication.MinReplicasToWrite < 0 || cfg.Replication.MinReplicasMaxLag < 0 {
+		return fmt.Errorf("min_replicas_to_write and min_replicas_max_lag cannot be negative")
+	}
+	if cfg.Replication.ReplDisklessSyncDelay < 0 {
+		return fmt.Errorf("repl_diskless_sync_delay cannot be negative")
+	}
+
+	if aa := cfg.ActiveActive; aa.Enabled {
+		if aa.NodeID == "" {
+			return fmt.Errorf("node_id is required when active_active is enabled")
+		}
+		if strings.EqualFold(cfg.Replication.Role, "replica") || strings.EqualFold(cfg.Replication.Role, "slave") {
+			return fmt.Errorf("active_active cannot be enabled on a replica")
+		}
+		if aa.OpLogSize <= 0 || aa.Timeout <= 0 {
+			return fmt.Errorf("active_active op_log_size and timeout must be positive")
+		}
+		if aa.TombstoneTTL < 0 {
+			return fmt.Errorf("active_active tombstone_ttl cannot be negative")
+		}
+	}
+
 	validLogLevels := map[string]bool{
 		"debug": true,
 		"info":  true,
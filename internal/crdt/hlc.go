@@ -0,0 +1,121 @@
+// Package crdt holds the conflict-free replicated types behind
+// active-active replication: per-key metadata that nodes accepting writes
+// independently can merge in any order and still end up agreeing on.
+package crdt
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Timestamp is a reading of a hybrid logical clock: wall time in
+// milliseconds, a counter ordering readings within the same millisecond,
+// and the node that took it, which breaks the remaining ties. Timestamps
+// are unique across nodes, so they also serve as the tags of set elements.
+type Timestamp struct {
+	Wall    int64  `json:"w"`
+	Logical uint32 `json:"l,omitempty"`
+	Node    string `json:"n"`
+}
+
+// Compare returns -1, 0 or 1 as t is before, equal to or after u.
+func (t Timestamp) Compare(u Timestamp) int {
+	switch {
+	case t.Wall != u.Wall:
+		return cmp(t.Wall < u.Wall)
+	case t.Logical != u.Logical:
+		return cmp(t.Logical < u.Logical)
+	case t.Node != u.Node:
+		return cmp(t.Node < u.Node)
+	}
+	return 0
+}
+
+func cmp(less bool) int {
+	if less {
+		return -1
+	}
+	return 1
+}
+
+// Less reports whether t is before u.
+func (t Timestamp) Less(u Timestamp) bool {
+	return t.Compare(u) < 0
+}
+
+// IsZero reports whether t was never set.
+func (t Timestamp) IsZero() bool {
+	return t == Timestamp{}
+}
+
+func (t Timestamp) String() string {
+	return fmt.Sprintf("%d.%d@%s", t.Wall, t.Logical, t.Node)
+}
+
+// ParseTimestamp is the inverse of Timestamp.String.
+func ParseTimestamp(s string) (Timestamp, error) {
+	clock, node, ok := strings.Cut(s, "@")
+	wall, logical, dot := strings.Cut(clock, ".")
+	if !ok || !dot {
+		return Timestamp{}, fmt.Errorf("invalid timestamp %q", s)
+	}
+	w, err := strconv.ParseInt(wall, 10, 64)
+	if err != nil {
+		return Timestamp{}, fmt.Errorf("invalid timestamp %q", s)
+	}
+	l, err := strconv.ParseUint(logical, 10, 32)
+	if err != nil {
+		return Timestamp{}, fmt.Errorf("invalid timestamp %q", s)
+	}
+	return Timestamp{Wall: w, Logical: uint32(l), Node: node}, nil
+}
+
+// Clock is a hybrid logical clock. Its readings follow the wall clock but
+// never go backwards, and come after every timestamp it was shown, so a
+// write made after seeing another is ordered after it even if the other
+// node's clock runs ahead.
+type Clock struct {
+	mu      sync.Mutex
+	node    string
+	wall    int64
+	logical uint32
+	now     func() int64
+}
+
+// NewClock returns a clock taking readings for node.
+func NewClock(node string) *Clock {
+	return &Clock{node: node, now: func() int64 { return time.Now().UnixMilli() }}
+}
+
+// Node returns the node the clock's readings are for.
+func (c *Clock) Node() string {
+	return c.node
+}
+
+// Now returns a reading later than every earlier one and than every
+// timestamp passed to Observe.
+func (c *Clock) Now() Timestamp {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if wall := c.now(); wall > c.wall {
+		c.wall, c.logical = wall, 0
+	} else {
+		c.logical++
+	}
+	return Timestamp{Wall: c.wall, Logical: c.logical, Node: c.node}
+}
+
+// Observe moves the clock past t, a timestamp from another node.
+func (c *Clock) Observe(t Timestamp) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case t.Wall > c.wall:
+		c.wall, c.logical = t.Wall, t.Logical
+	case t.Wall == c.wall && t.Logical > c.logical:
+		c.logical = t.Logical
+	}
+}
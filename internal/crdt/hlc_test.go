@@ -0,0 +1,65 @@
+package crdt
+
+import "testing"
+
+func TestClockIsMonotonic(t *testing.T) {
+	wall := int64(1000)
+	c := NewClock("a")
+	c.now = func() int64 { return wall }
+
+	t1 := c.Now()
+	t2 := c.Now()
+	if !t1.Less(t2) || t2.Wall != 1000 || t2.Logical != 1 {
+		t.Fatalf("readings %v then %v", t1, t2)
+	}
+
+	// The wall clock going back does not move readings back
+	wall = 900
+	if t3 := c.Now(); !t2.Less(t3) {
+		t.Fatalf("reading %v after %v", t3, t2)
+	}
+
+	wall = 2000
+	if t4 := c.Now(); t4.Wall != 2000 || t4.Logical != 0 {
+		t.Fatalf("reading %v, want 2000.0", t4)
+	}
+}
+
+func TestClockObserve(t *testing.T) {
+	c := NewClock("a")
+	c.now = func() int64 { return 1000 }
+	remote := Timestamp{Wall: 5000, Logical: 3, Node: "b"}
+	c.Observe(remote)
+	if ts := c.Now(); !remote.Less(ts) || ts.Node != "a" {
+		t.Fatalf("reading %v is not after observed %v", ts, remote)
+	}
+}
+
+func TestTimestampOrder(t *testing.T) {
+	a := Timestamp{Wall: 1, Logical: 0, Node: "b"}
+	b := Timestamp{Wall: 1, Logical: 1, Node: "a"}
+	c := Timestamp{Wall: 1, Logical: 1, Node: "b"}
+	d := Timestamp{Wall: 2, Node: "a"}
+	for i, pair := range [][2]Timestamp{{a, b}, {b, c}, {c, d}, {a, d}} {
+		if !pair[0].Less(pair[1]) || pair[1].Less(pair[0]) {
+			t.Errorf("pair %d: %v should sort before %v", i, pair[0], pair[1])
+		}
+	}
+	if a.Compare(a) != 0 {
+		t.Error("a timestamp should equal itself")
+	}
+}
+
+func TestParseTimestamp(t *testing.T) {
+	for _, ts := range []Timestamp{{}, {Wall: 1700000000000, Logical: 7, Node: "eu-1"}, {Wall: 3, Node: "a@b"}} {
+		got, err := ParseTimestamp(ts.String())
+		if err != nil || got != ts {
+			t.Errorf("ParseTimestamp(%q) = %v, %v", ts.String(), got, err)
+		}
+	}
+	for _, s := range []string{"", "12", "1.x@a", "x.1@a"} {
+		if _, err := ParseTimestamp(s); err == nil {
+			t.Errorf("ParseTimestamp(%q) should fail", s)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package crdt
+
+import "slices"
+
+// Merge folds in o, the metadata another node has for the key, when a
+// node catches up from another's whole dataset instead of its operations.
+// mine and theirs are the vectors of operations merged into m and o. An
+// add only one side holds was removed by the other if that side has
+// merged it, and is otherwise news to it.
+func (m *Meta) Merge(o *Meta, mine, theirs Vector) {
+	switch {
+	case m.Register.TS.Less(o.Register.TS):
+		m.Register = o.Register.clone()
+	case m.Register.TS == o.Register.TS:
+		for node, c := range o.Register.Counts {
+			m.Register.count(node, o.Register, c)
+		}
+	}
+	if m.Expire.TS.Less(o.Expire.TS) {
+		m.Expire = o.Expire
+	}
+
+	kinds := make(map[Kind]bool)
+	for kind := range m.Collections {
+		kinds[kind] = true
+	}
+	for kind := range o.Collections {
+		kinds[kind] = true
+	}
+	joined := mine.Clone()
+	joined.Join(theirs)
+	for kind := range kinds {
+		oc := o.Collections[kind]
+		if oc == nil {
+			oc = &Collection{}
+		}
+		m.collection(kind).merge(oc, mine, theirs, joined)
+	}
+	m.compact()
+}
+
+func (c *Collection) merge(o *Collection, mine, theirs, joined Vector) {
+	for elem, tags := range c.Elements {
+		kept := tags[:0]
+		for _, t := range tags {
+			if o.has(elem, t.TS) || !theirs.Covers(t.TS) {
+				kept = append(kept, t)
+			}
+		}
+		if len(kept) == 0 {
+			delete(c.Elements, elem)
+		} else {
+			c.Elements[elem] = kept
+		}
+	}
+	for elem, tags := range o.Elements {
+		for _, t := range tags {
+			if !c.has(elem, t.TS) && !mine.Covers(t.TS) {
+				c.add(elem, t)
+			}
+		}
+	}
+	// A remove is kept until the add it removes has been merged; after
+	// that the add either went or will never come.
+	removed := append(c.Removed, o.Removed...)
+	c.Removed = nil
+	for _, d := range removed {
+		if c.has(d.Elem, d.TS) {
+			c.remove(d.Elem, d.TS)
+		} else if !joined.Covers(d.TS) && !slices.Contains(c.Removed, d) {
+			c.Removed = append(c.Removed, d)
+		}
+	}
+}
+
+func (r Register) clone() Register {
+	if r.Counts != nil {
+		counts := make(map[string]Counter, len(r.Counts))
+		for node, c := range r.Counts {
+			counts[node] = c
+		}
+		r.Counts = counts
+	}
+	return r
+}
@@ -0,0 +1,329 @@
+package crdt
+
+import (
+	"slices"
+	"strconv"
+)
+
+// Kind is the type a key's value has under active-active replication.
+type Kind uint8
+
+const (
+	KindString Kind = iota + 1
+	KindSet
+	KindHash
+	KindZSet
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindString:
+		return "string"
+	case KindSet:
+		return "set"
+	case KindHash:
+		return "hash"
+	case KindZSet:
+		return "zset"
+	default:
+		return "none"
+	}
+}
+
+// Meta is the causal metadata of a key. The value the key shows is a
+// function of it, so nodes that merged the same writes show the same value
+// whatever order the writes reached them in.
+//
+// A key holds a register for strings and a collection per other type.
+// Writes of different types made concurrently on different nodes each land
+// in their own; the key shows whichever of them was written last.
+type Meta struct {
+	Register    Register             `json:"r"`
+	Collections map[Kind]*Collection `json:"c,omitempty"`
+	Expire      Expire               `json:"e"`
+}
+
+// Expire is the last-writer-wins expiry of a key, in milliseconds since
+// the epoch; 0 is none.
+type Expire struct {
+	At int64     `json:"at,omitempty"`
+	TS Timestamp `json:"ts"`
+}
+
+// Register is a last-writer-wins string with a PN-counter on top: each
+// node's increments and decrements since the write they were made on add
+// to the written value, so concurrent INCRs all count. A later write
+// resets them.
+type Register struct {
+	TS      Timestamp          `json:"ts"`
+	Value   []byte             `json:"v,omitempty"`
+	Deleted bool               `json:"d,omitempty"`
+	Counts  map[string]Counter `json:"n,omitempty"`
+}
+
+// Counter is one node's share of a register's counter: the totals it added
+// and subtracted, which only grow, and when it last did.
+type Counter struct {
+	P  int64     `json:"p,omitempty"`
+	N  int64     `json:"m,omitempty"`
+	TS Timestamp `json:"ts"`
+}
+
+// Live reports whether the register holds a value.
+func (r *Register) Live() bool {
+	return len(r.Counts) > 0 || (!r.TS.IsZero() && !r.Deleted)
+}
+
+// Get returns the value the register holds.
+func (r *Register) Get() ([]byte, bool) {
+	if !r.Live() {
+		return nil, false
+	}
+	if len(r.Counts) == 0 {
+		return r.Value, true
+	}
+	n := r.Base()
+	for _, c := range r.Counts {
+		n += c.P - c.N
+	}
+	return strconv.AppendInt(nil, n, 10), true
+}
+
+// Base returns the integer the counters start from: the written value, or
+// 0 if it was deleted or is not an integer.
+func (r *Register) Base() int64 {
+	if r.TS.IsZero() || r.Deleted {
+		return 0
+	}
+	n, _ := strconv.ParseInt(string(r.Value), 10, 64)
+	return n
+}
+
+// updated is when the register was last written or counted.
+func (r *Register) updated() Timestamp {
+	at := r.TS
+	for _, c := range r.Counts {
+		if at.Less(c.TS) {
+			at = c.TS
+		}
+	}
+	return at
+}
+
+func (r *Register) write(ts Timestamp, value []byte, deleted bool) {
+	if r.TS.Less(ts) {
+		*r = Register{TS: ts, Value: value, Deleted: deleted}
+	}
+}
+
+// count merges node's counter, made on top of the write base; a register
+// already written after base drops it.
+func (r *Register) count(node string, base Register, c Counter) {
+	if r.TS.Less(base.TS) {
+		*r = Register{TS: base.TS, Value: base.Value, Deleted: base.Deleted}
+	}
+	if r.TS != base.TS {
+		return
+	}
+	if r.Counts == nil {
+		r.Counts = make(map[string]Counter)
+	}
+	cur := r.Counts[node]
+	cur.P, cur.N = max(cur.P, c.P), max(cur.N, c.N)
+	if cur.TS.Less(c.TS) {
+		cur.TS = c.TS
+	}
+	r.Counts[node] = cur
+}
+
+// Tag is one add of an element: unique, and carrying the value the add
+// set (a hash field's value, a member's score, nothing for a set).
+type Tag struct {
+	TS    Timestamp `json:"ts"`
+	Value []byte    `json:"v,omitempty"`
+}
+
+// Dot names the add of an element.
+type Dot struct {
+	Elem string    `json:"e"`
+	TS   Timestamp `json:"ts"`
+}
+
+// Collection is an observed-remove set of elements, each with a value: a
+// remove takes away the adds its node had seen, so an add made
+// concurrently elsewhere survives it. An element with adds from several
+// nodes shows the value of the latest.
+type Collection struct {
+	Elements map[string][]Tag `json:"e,omitempty"`
+	// Removed holds removes that arrived before the add they remove.
+	Removed []Dot `json:"r,omitempty"`
+}
+
+// Live reports whether the collection has elements.
+func (c *Collection) Live() bool {
+	return c != nil && len(c.Elements) > 0
+}
+
+// Get returns the value of elem, if it is in the collection.
+func (c *Collection) Get(elem string) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	tags := c.Elements[elem]
+	if len(tags) == 0 {
+		return nil, false
+	}
+	latest := tags[0]
+	for _, t := range tags[1:] {
+		if latest.TS.Less(t.TS) {
+			latest = t
+		}
+	}
+	return latest.Value, true
+}
+
+// Tags returns the adds of elem a remove made now has to take away.
+func (c *Collection) Tags(elem string) []Timestamp {
+	if c == nil {
+		return nil
+	}
+	tags := make([]Timestamp, 0, len(c.Elements[elem]))
+	for _, t := range c.Elements[elem] {
+		tags = append(tags, t.TS)
+	}
+	return tags
+}
+
+// updated is the time of the latest add the collection holds.
+func (c *Collection) updated() Timestamp {
+	var at Timestamp
+	for _, tags := range c.Elements {
+		for _, t := range tags {
+			if at.Less(t.TS) {
+				at = t.TS
+			}
+		}
+	}
+	return at
+}
+
+func (c *Collection) add(elem string, tag Tag) {
+	dot := Dot{Elem: elem, TS: tag.TS}
+	if i := slices.Index(c.Removed, dot); i >= 0 {
+		c.Removed = slices.Delete(c.Removed, i, i+1)
+		return
+	}
+	if c.has(elem, tag.TS) {
+		return
+	}
+	if c.Elements == nil {
+		c.Elements = make(map[string][]Tag)
+	}
+	c.Elements[elem] = append(c.Elements[elem], tag)
+}
+
+func (c *Collection) remove(elem string, ts Timestamp) {
+	tags := c.Elements[elem]
+	i := slices.IndexFunc(tags, func(t Tag) bool { return t.TS == ts })
+	if i < 0 {
+		if !slices.Contains(c.Removed, Dot{Elem: elem, TS: ts}) {
+			c.Removed = append(c.Removed, Dot{Elem: elem, TS: ts})
+		}
+		return
+	}
+	if len(tags) == 1 {
+		delete(c.Elements, elem)
+		return
+	}
+	c.Elements[elem] = slices.Delete(tags, i, i+1)
+}
+
+func (c *Collection) has(elem string, ts Timestamp) bool {
+	return slices.ContainsFunc(c.Elements[elem], func(t Tag) bool { return t.TS == ts })
+}
+
+// Collection returns the collection of kind, nil if the key has none.
+func (m *Meta) Collection(kind Kind) *Collection {
+	return m.Collections[kind]
+}
+
+func (m *Meta) collection(kind Kind) *Collection {
+	c := m.Collections[kind]
+	if c == nil {
+		if m.Collections == nil {
+			m.Collections = make(map[Kind]*Collection)
+		}
+		c = &Collection{}
+		m.Collections[kind] = c
+	}
+	return c
+}
+
+// Kind returns the type of the value the key shows: of the register and
+// collections holding something, the one written last. It is 0 if none
+// does.
+func (m *Meta) Kind() Kind {
+	var live []Kind
+	if m.Register.Live() {
+		live = append(live, KindString)
+	}
+	for kind, c := range m.Collections {
+		if c.Live() {
+			live = append(live, kind)
+		}
+	}
+	switch len(live) {
+	case 0:
+		return 0
+	case 1:
+		return live[0]
+	}
+	var kind Kind
+	var at Timestamp
+	for _, k := range live {
+		u := m.updated(k)
+		if kind == 0 || at.Less(u) {
+			kind, at = k, u
+		}
+	}
+	return kind
+}
+
+func (m *Meta) updated(kind Kind) Timestamp {
+	if kind == KindString {
+		return m.Register.updated()
+	}
+	return m.Collections[kind].updated()
+}
+
+// Apply merges an operation made on the key.
+func (m *Meta) Apply(op *Op) {
+	if op.Write != nil {
+		m.Register.write(op.TS, op.Write.Value, op.Write.Deleted)
+	}
+	if op.Count != nil {
+		m.Register.count(op.TS.Node, op.Count.Base, Counter{P: op.Count.P, N: op.Count.N, TS: op.TS})
+	}
+	for _, r := range op.Removes {
+		c := m.collection(r.Kind)
+		for _, ts := range r.Tags {
+			c.remove(r.Elem, ts)
+		}
+	}
+	for _, a := range op.Adds {
+		m.collection(a.Kind).add(a.Elem, Tag{TS: op.TS, Value: a.Value})
+	}
+	if op.Expire != nil && m.Expire.TS.Less(op.TS) {
+		m.Expire = Expire{At: *op.Expire, TS: op.TS}
+	}
+	m.compact()
+}
+
+// compact drops the collections left without anything to remember.
+func (m *Meta) compact() {
+	for kind, c := range m.Collections {
+		if len(c.Elements) == 0 && len(c.Removed) == 0 {
+			delete(m.Collections, kind)
+		}
+	}
+}
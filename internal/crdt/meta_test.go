@@ -0,0 +1,314 @@
+package crdt
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// node makes operations the way a node observing its writes does.
+type node struct {
+	clock *Clock
+}
+
+func newNode(name string, wall *int64) *node {
+	n := &node{clock: NewClock(name)}
+	n.clock.now = func() int64 { return *wall }
+	return n
+}
+
+func (n *node) op(fill func(*Op)) *Op {
+	op := &Op{Key: "k"}
+	fill(op)
+	op.TS = n.clock.Now()
+	return op
+}
+
+// view describes what a key shows.
+func view(m *Meta) string {
+	var sb strings.Builder
+	kind := m.Kind()
+	sb.WriteString(kind.String())
+	if kind == KindString {
+		v, _ := m.Register.Get()
+		fmt.Fprintf(&sb, " %q", v)
+	} else if c := m.Collection(kind); c != nil {
+		elems := make([]string, 0, len(c.Elements))
+		for elem := range c.Elements {
+			v, _ := c.Get(elem)
+			elems = append(elems, fmt.Sprintf("%s=%s", elem, v))
+		}
+		sort.Strings(elems)
+		fmt.Fprintf(&sb, " %v", elems)
+	}
+	if m.Expire.At != 0 {
+		fmt.Fprintf(&sb, " expire=%d", m.Expire.At)
+	}
+	return sb.String()
+}
+
+// permutations calls fn with every order of ops.
+func permutations(ops []*Op, fn func([]*Op)) {
+	var walk func(int)
+	walk = func(i int) {
+		if i == len(ops) {
+			fn(ops)
+			return
+		}
+		for j := i; j < len(ops); j++ {
+			ops[i], ops[j] = ops[j], ops[i]
+			walk(i + 1)
+			ops[i], ops[j] = ops[j], ops[i]
+		}
+	}
+	walk(0)
+}
+
+// converge checks that ops merged in any order show want.
+func converge(t *testing.T, ops []*Op, want string) {
+	t.Helper()
+	permutations(ops, func(order []*Op) {
+		m := &Meta{}
+		for _, op := range order {
+			m.Apply(op)
+		}
+		if got := view(m); got != want {
+			var tss []string
+			for _, op := range order {
+				tss = append(tss, op.TS.String())
+			}
+			t.Fatalf("order %v shows %s, want %s", tss, got, want)
+		}
+	})
+}
+
+func TestRegisterLastWriterWins(t *testing.T) {
+	wall := int64(1000)
+	a, b := newNode("a", &wall), newNode("b", &wall)
+	w1 := a.op(func(op *Op) { op.Write = &Write{Value: []byte("from-a")} })
+	w2 := b.op(func(op *Op) { op.Write = &Write{Value: []byte("from-b")} })
+	wall++
+	w3 := a.op(func(op *Op) { op.Write = &Write{Value: []byte("later")} })
+
+	// Same millisecond: the node name breaks the tie
+	converge(t, []*Op{w1, w2}, `string "from-b"`)
+	converge(t, []*Op{w1, w2, w3}, `string "later"`)
+
+	del := b.op(func(op *Op) { op.Write = &Write{Deleted: true} })
+	converge(t, []*Op{w1, w3, del}, "none")
+}
+
+func TestCountersAddUp(t *testing.T) {
+	wall := int64(1000)
+	a, b, c := newNode("a", &wall), newNode("b", &wall), newNode("c", &wall)
+	set := a.op(func(op *Op) { op.Write = &Write{Value: []byte("10")} })
+	base := Register{TS: set.TS, Value: []byte("10")}
+
+	// Counts are each node's running totals since the base write
+	a1 := a.op(func(op *Op) { op.Count = &Count{Base: base, P: 1} })
+	a2 := a.op(func(op *Op) { op.Count = &Count{Base: base, P: 3} })
+	b1 := b.op(func(op *Op) { op.Count = &Count{Base: base, P: 5} })
+	c1 := c.op(func(op *Op) { op.Count = &Count{Base: base, P: 5, N: 7} })
+	converge(t, []*Op{set, a1, a2, b1, c1}, `string "16"`)
+
+	// Counting on a key never written starts from 0
+	d1 := b.op(func(op *Op) { op.Key = "n"; op.Count = &Count{N: 2} })
+	converge(t, []*Op{d1}, `string "-2"`)
+}
+
+func TestWriteResetsCounters(t *testing.T) {
+	wall := int64(1000)
+	a, b := newNode("a", &wall), newNode("b", &wall)
+	set := a.op(func(op *Op) { op.Write = &Write{Value: []byte("10")} })
+	base := Register{TS: set.TS, Value: []byte("10")}
+	incr := b.op(func(op *Op) { op.Count = &Count{Base: base, P: 1} })
+	wall++
+	reset := a.op(func(op *Op) { op.Write = &Write{Value: []byte("0")} })
+
+	// The INCR was made on the write SET 0 replaced
+	converge(t, []*Op{set, incr, reset}, `string "0"`)
+
+	wall++
+	again := b.op(func(op *Op) {
+		op.Count = &Count{Base: Register{TS: reset.TS, Value: []byte("0")}, P: 2}
+	})
+	converge(t, []*Op{set, incr, reset, again}, `string "2"`)
+}
+
+func TestSetAddWins(t *testing.T) {
+	wall := int64(1000)
+	a, b := newNode("a", &wall), newNode("b", &wall)
+	add := a.op(func(op *Op) {
+		op.Adds = []Add{{Kind: KindSet, Elem: "x"}, {Kind: KindSet, Elem: "y"}}
+	})
+	// b removes x having seen a's add, while a adds x again
+	rem := b.op(func(op *Op) {
+		op.Removes = []Remove{{Kind: KindSet, Elem: "x", Tags: []Timestamp{add.TS}}}
+	})
+	readd := a.op(func(op *Op) { op.Adds = []Add{{Kind: KindSet, Elem: "x"}} })
+	converge(t, []*Op{add, rem, readd}, "set [x= y=]")
+
+	// Without the concurrent add the remove takes x away, whichever
+	// arrives first
+	converge(t, []*Op{add, rem}, "set [y=]")
+}
+
+func TestRemoveBeforeAdd(t *testing.T) {
+	wall := int64(1000)
+	a, b := newNode("a", &wall), newNode("b", &wall)
+	add := a.op(func(op *Op) { op.Adds = []Add{{Kind: KindHash, Elem: "f", Value: []byte("v")}} })
+	rem := b.op(func(op *Op) {
+		op.Removes = []Remove{{Kind: KindHash, Elem: "f", Tags: []Timestamp{add.TS}}}
+	})
+
+	m := &Meta{}
+	m.Apply(rem)
+	if len(m.Collection(KindHash).Removed) != 1 {
+		t.Fatal("an early remove should be remembered")
+	}
+	m.Apply(add)
+	if m.Kind() != 0 || m.Collection(KindHash) != nil {
+		t.Fatalf("key shows %s after the add was removed", view(m))
+	}
+}
+
+func TestHashFieldShowsLatestValue(t *testing.T) {
+	wall := int64(1000)
+	a, b := newNode("a", &wall), newNode("b", &wall)
+	va := a.op(func(op *Op) { op.Adds = []Add{{Kind: KindHash, Elem: "f", Value: []byte("a")}} })
+	wall++
+	vb := b.op(func(op *Op) { op.Adds = []Add{{Kind: KindHash, Elem: "f", Value: []byte("b")}} })
+	converge(t, []*Op{va, vb}, "hash [f=b]")
+
+	// A later HSET on a replaces the tags it saw
+	wall++
+	va2 := a.op(func(op *Op) {
+		op.Removes = []Remove{{Kind: KindHash, Elem: "f", Tags: []Timestamp{va.TS, vb.TS}}}
+		op.Adds = []Add{{Kind: KindHash, Elem: "f", Value: []byte("c")}}
+	})
+	converge(t, []*Op{va, vb, va2}, "hash [f=c]")
+}
+
+func TestSortedSetScores(t *testing.T) {
+	wall := int64(1000)
+	a, b := newNode("a", &wall), newNode("b", &wall)
+	za := a.op(func(op *Op) {
+		op.Adds = []Add{{Kind: KindZSet, Elem: "m", Value: []byte("1")}, {Kind: KindZSet, Elem: "n", Value: []byte("2")}}
+	})
+	zrem := b.op(func(op *Op) {
+		op.Removes = []Remove{{Kind: KindZSet, Elem: "n", Tags: []Timestamp{za.TS}}}
+	})
+	wall++
+	zb := b.op(func(op *Op) { op.Adds = []Add{{Kind: KindZSet, Elem: "n", Value: []byte("5")}} })
+	converge(t, []*Op{za, zrem, zb}, "zset [m=1 n=5]")
+}
+
+func TestLatestTypeWins(t *testing.T) {
+	wall := int64(1000)
+	a, b := newNode("a", &wall), newNode("b", &wall)
+	str := a.op(func(op *Op) { op.Write = &Write{Value: []byte("s")} })
+	wall++
+	set := b.op(func(op *Op) { op.Adds = []Add{{Kind: KindSet, Elem: "x"}} })
+	converge(t, []*Op{str, set}, "set [x=]")
+
+	// b's SREM deleting the key takes the string it replaced with it
+	rem := b.op(func(op *Op) {
+		op.Write = &Write{Deleted: true}
+		op.Removes = []Remove{{Kind: KindSet, Elem: "x", Tags: []Timestamp{set.TS}}}
+	})
+	converge(t, []*Op{str, set, rem}, "none")
+}
+
+func TestExpireLastWriterWins(t *testing.T) {
+	wall := int64(1000)
+	a, b := newNode("a", &wall), newNode("b", &wall)
+	at1, at2, none := int64(5000), int64(9000), int64(0)
+	w := a.op(func(op *Op) { op.Write = &Write{Value: []byte("v")}; op.Expire = &at1 })
+	e := b.op(func(op *Op) { op.Expire = &at2 })
+	converge(t, []*Op{w, e}, `string "v" expire=9000`)
+	p := a.op(func(op *Op) { op.Expire = &none })
+	converge(t, []*Op{w, e, p}, `string "v"`)
+}
+
+func TestMergeState(t *testing.T) {
+	wall := int64(1000)
+	a, b := newNode("a", &wall), newNode("b", &wall)
+	add := a.op(func(op *Op) {
+		op.Adds = []Add{{Kind: KindSet, Elem: "x"}, {Kind: KindSet, Elem: "y"}}
+	})
+	// b saw the add, then removed x; a meanwhile added z, unseen by b
+	rem := b.op(func(op *Op) {
+		op.Removes = []Remove{{Kind: KindSet, Elem: "x", Tags: []Timestamp{add.TS}}}
+	})
+	addZ := a.op(func(op *Op) { op.Adds = []Add{{Kind: KindSet, Elem: "z"}} })
+
+	ma, va := &Meta{}, Vector{}
+	for _, op := range []*Op{add, addZ} {
+		ma.Apply(op)
+		va.Advance(op.TS)
+	}
+	mb, vb := &Meta{}, Vector{}
+	for _, op := range []*Op{add, rem} {
+		mb.Apply(op)
+		vb.Advance(op.TS)
+	}
+
+	// The state goes over the wire
+	data, err := json.Marshal(mb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wire Meta
+	if err := json.Unmarshal(data, &wire); err != nil {
+		t.Fatal(err)
+	}
+
+	ma.Merge(&wire, va, vb)
+	if got, want := view(ma), "set [y= z=]"; got != want {
+		t.Fatalf("a shows %s after merging b's state, want %s", got, want)
+	}
+	mb.Merge(ma, vb, va.Clone())
+	if got, want := view(mb), "set [y= z=]"; got != want {
+		t.Fatalf("b shows %s after merging a's state, want %s", got, want)
+	}
+}
+
+func TestMergeCounters(t *testing.T) {
+	wall := int64(1000)
+	a, b := newNode("a", &wall), newNode("b", &wall)
+	set := a.op(func(op *Op) { op.Write = &Write{Value: []byte("1")} })
+	base := Register{TS: set.TS, Value: []byte("1")}
+	ia := a.op(func(op *Op) { op.Count = &Count{Base: base, P: 2} })
+	ib := b.op(func(op *Op) { op.Count = &Count{Base: base, P: 3} })
+
+	ma, mb := &Meta{}, &Meta{}
+	ma.Apply(set)
+	ma.Apply(ia)
+	mb.Apply(set)
+	mb.Apply(ib)
+	ma.Merge(mb, Vector{"a": ia.TS}, Vector{"a": set.TS, "b": ib.TS})
+	if got, want := view(ma), `string "6"`; got != want {
+		t.Fatalf("merged counters show %s, want %s", got, want)
+	}
+}
+
+func TestVector(t *testing.T) {
+	v := Vector{}
+	t1 := Timestamp{Wall: 1, Node: "a"}
+	t2 := Timestamp{Wall: 2, Node: "a"}
+	v.Advance(t2)
+	v.Advance(t1)
+	if !v.Covers(t1) || !v.Covers(t2) || v.Covers(Timestamp{Wall: 3, Node: "a"}) {
+		t.Fatalf("vector %v", v)
+	}
+	if v.Covers(Timestamp{Wall: 1, Node: "b"}) {
+		t.Fatal("vector covers a node it never saw")
+	}
+	o := Vector{"b": {Wall: 5, Node: "b"}, "a": t1}
+	v.Join(o)
+	if v["a"] != t2 || v["b"] != o["b"] {
+		t.Fatalf("joined vector %v", v)
+	}
+}
@@ -0,0 +1,84 @@
+package crdt
+
+// Op is a change a node made to a key, as sent to the other nodes. Its
+// timestamp orders it, tags the elements it adds, and is its position in
+// the log of the node that made it.
+type Op struct {
+	TS        Timestamp `json:"ts"`
+	Namespace string    `json:"ns"`
+	Key       string    `json:"k"`
+	Write     *Write    `json:"w,omitempty"`
+	Count     *Count    `json:"c,omitempty"`
+	Removes   []Remove  `json:"r,omitempty"`
+	Adds      []Add     `json:"a,omitempty"`
+	// Expire sets the key's expiry in milliseconds since the epoch; 0
+	// removes it.
+	Expire *int64 `json:"e,omitempty"`
+}
+
+// Empty reports whether the operation changes nothing.
+func (op *Op) Empty() bool {
+	return op.Write == nil && op.Count == nil && len(op.Removes) == 0 && len(op.Adds) == 0 && op.Expire == nil
+}
+
+// Write sets or deletes the string register.
+type Write struct {
+	Value   []byte `json:"v,omitempty"`
+	Deleted bool   `json:"d,omitempty"`
+}
+
+// Count carries the node's counter totals after an INCR-family command,
+// with the register write they count from so that a node that has not
+// received the write yet still counts from it.
+type Count struct {
+	Base Register `json:"b"`
+	P    int64    `json:"p,omitempty"`
+	N    int64    `json:"m,omitempty"`
+}
+
+// Add adds an element to the collection of Kind, or sets its value.
+type Add struct {
+	Kind  Kind   `json:"t"`
+	Elem  string `json:"e"`
+	Value []byte `json:"v,omitempty"`
+}
+
+// Remove takes away the adds of an element that the node had seen.
+type Remove struct {
+	Kind Kind        `json:"t"`
+	Elem string      `json:"e"`
+	Tags []Timestamp `json:"ts"`
+}
+
+// Vector holds, for each node, the timestamp of its latest operation
+// merged. Operations from one node are merged in order, so every earlier
+// one has been merged too.
+type Vector map[string]Timestamp
+
+// Covers reports whether the operation at ts has been merged.
+func (v Vector) Covers(ts Timestamp) bool {
+	return !v[ts.Node].Less(ts)
+}
+
+// Advance records that the operation at ts has been merged.
+func (v Vector) Advance(ts Timestamp) {
+	if v[ts.Node].Less(ts) {
+		v[ts.Node] = ts
+	}
+}
+
+// Join advances v by everything in o.
+func (v Vector) Join(o Vector) {
+	for _, ts := range o {
+		v.Advance(ts)
+	}
+}
+
+// Clone returns a copy of v.
+func (v Vector) Clone() Vector {
+	c := make(Vector, len(v))
+	for node, ts := range v {
+		c[node] = ts
+	}
+	return c
+}
@@ -0,0 +1,100 @@
+package graph
+
+import (
+	"bytes"
+	"encoding/gob"
+)
+
+// savedGraph is a graph as kept in snapshots, with its ID counters so
+// that IDs of deleted nodes and edges are not handed out again.
+type savedGraph struct {
+	Name      string
+	Nodes     map[uint64]*Node
+	Edges     map[uint64]*Edge
+	NodeLabel map[string][]uint64
+	EdgeLabel map[string][]uint64
+	Adjacency map[uint64][]uint64
+	NextNode  uint64
+	NextEdge  uint64
+}
+
+func (gm *GraphManager) StateName() string {
+	return "graph"
+}
+
+// SaveState serializes every graph.
+func (gm *GraphManager) SaveState() ([]byte, error) {
+	gm.mu.RLock()
+	saved := make([]savedGraph, 0, len(gm.graphs))
+	for _, g := range gm.graphs {
+		g.mu.RLock()
+		saved = append(saved, savedGraph{
+			Name:      g.Name,
+			Nodes:     g.Nodes,
+			Edges:     g.Edges,
+			NodeLabel: g.NodeLabel,
+			EdgeLabel: g.EdgeLabel,
+			Adjacency: g.Adjacency,
+			NextNode:  g.nextNode,
+			NextEdge:  g.nextEdge,
+		})
+	}
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(saved)
+	for _, g := range gm.graphs {
+		g.mu.RUnlock()
+	}
+	gm.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// LoadState replaces the graphs with those saved by SaveState.
+func (gm *GraphManager) LoadState(data []byte) error {
+	var saved []savedGraph
+	if data != nil {
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&saved); err != nil {
+			return err
+		}
+	}
+
+	graphs := make(map[string]*Graph, len(saved))
+	for _, s := range saved {
+		g := NewGraph(s.Name)
+		for id, n := range s.Nodes {
+			if n.Properties == nil {
+				n.Properties = make(map[string]interface{})
+			}
+			g.Nodes[id] = n
+		}
+		for id, e := range s.Edges {
+			if e.Properties == nil {
+				e.Properties = make(map[string]interface{})
+			}
+			g.Edges[id] = e
+		}
+		for k, v := range s.NodeLabel {
+			g.NodeLabel[k] = v
+		}
+		for k, v := range s.EdgeLabel {
+			g.EdgeLabel[k] = v
+		}
+		for k, v := range s.Adjacency {
+			g.Adjacency[k] = v
+		}
+		if s.NextNode > 0 {
+			g.nextNode = s.NextNode
+		}
+		if s.NextEdge > 0 {
+			g.nextEdge = s.NextEdge
+		}
+		graphs[s.Name] = g
+	}
+
+	gm.mu.Lock()
+	gm.graphs = graphs
+	gm.mu.Unlock()
+	return nil
+}
@@ -2,8 +2,8 @@ package persistence
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
-	"io"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -13,7 +13,7 @@ import (
 	"time"
 
 	"github.com/cachestorm/cachestorm/internal/logger"
-	"github.com/cachestorm/cachestorm/internal/resp"
+	"github.com/cachestorm/cachestorm/internal/store"
 )
 
 type AOFSyncPolicy int
@@ -25,13 +25,30 @@ const (
 )
 
 type AOFConfig struct {
-	Enabled     bool
-	Filename    string
-	DataDir     string
-	SyncPolicy  AOFSyncPolicy
+	Enabled    bool
+	Filename   string
+	DataDir    string
+	SyncPolicy AOFSyncPolicy
+	// DirName is the directory under DataDir holding the multi-part AOF
+	// kept by AOFManager; empty means "appendonlydir".
+	DirName string
+	// RewriteSize and RewritePct trigger an automatic rewrite once the AOF
+	// is at least RewriteSize bytes and has grown by RewritePct percent
+	// since the last rewrite, like Redis' auto-aof-rewrite-min-size and
+	// auto-aof-rewrite-percentage. A zero RewritePct disables the rule.
 	RewriteSize int64
 	RewritePct  int
+	// MaxSize triggers a rewrite once the AOF reaches it, unless the
+	// dataset alone is that large. Zero disables it.
+	MaxSize     int64
 	AutoRewrite bool
+	// LoadTruncated loads an AOF whose last command was cut short; see
+	// AOFReader.LoadTruncated.
+	LoadTruncated bool
+	// Timestamps annotates the AOF with the time, to the second, before the
+	// first command written in each second, like Redis'
+	// aof-timestamp-enabled. RestoreAOF needs them.
+	Timestamps bool
 }
 
 type AOFWriter struct {
@@ -43,6 +60,7 @@ type AOFWriter struct {
 	size      atomic.Int64
 	dirty     atomic.Int64
 	lastSync  time.Time
+	lastTS    int64
 	stopCh    chan struct{}
 	wg        sync.WaitGroup
 	running   atomic.Bool
@@ -145,32 +163,55 @@ func (w *AOFWriter) Append(cmd string, args [][]byte) error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	w.writerBuf = w.writerBuf[:0]
-	w.writerBuf = append(w.writerBuf, '*')
-	w.writerBuf = strconv.AppendInt(w.writerBuf, int64(len(args)+1), 10)
-	w.writerBuf = append(w.writerBuf, '\r', '\n')
+	w.writerBuf = w.appendTimestamp(w.writerBuf[:0], time.Now())
+	w.writerBuf = appendCommand(w.writerBuf, cmd, args)
+	if err := w.write(w.writerBuf); err != nil {
+		return err
+	}
+	w.dirty.Add(1)
+	return nil
+}
 
-	w.writerBuf = append(w.writerBuf, '$')
-	w.writerBuf = strconv.AppendInt(w.writerBuf, int64(len(cmd)), 10)
-	w.writerBuf = append(w.writerBuf, '\r', '\n')
-	w.writerBuf = append(w.writerBuf, cmd...)
-	w.writerBuf = append(w.writerBuf, '\r', '\n')
+// appendTimestamp appends the annotation of now to buf when timestamps are
+// on and now falls in a later second than the last one written. Called
+// with w.mu held.
+func (w *AOFWriter) appendTimestamp(buf []byte, now time.Time) []byte {
+	if !w.config.Timestamps || now.Unix() == w.lastTS {
+		return buf
+	}
+	w.lastTS = now.Unix()
+	return appendAOFTimestamp(buf, now)
+}
 
-	for _, arg := range args {
-		w.writerBuf = append(w.writerBuf, '$')
-		w.writerBuf = strconv.AppendInt(w.writerBuf, int64(len(arg)), 10)
-		w.writerBuf = append(w.writerBuf, '\r', '\n')
-		w.writerBuf = append(w.writerBuf, arg...)
-		w.writerBuf = append(w.writerBuf, '\r', '\n')
+// setTimestamps turns the timestamp annotations on or off.
+func (w *AOFWriter) setTimestamps(enabled bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.config.Timestamps = enabled
+	w.lastTS = 0
+}
+
+// appendRaw writes commands that are already RESP encoded, such as the
+// writes buffered during a rewrite.
+func (w *AOFWriter) appendRaw(p []byte) error {
+	if len(p) == 0 || !w.config.Enabled || !w.running.Load() {
+		return nil
 	}
 
-	n, err := w.writer.Write(w.writerBuf)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.write(p)
+}
+
+// write appends p to the file, honouring the sync policy. Called with w.mu
+// held.
+func (w *AOFWriter) write(p []byte) error {
+	n, err := w.writer.Write(p)
 	if err != nil {
 		return fmt.Errorf("failed to write to AOF: %v", err)
 	}
 
 	w.size.Add(int64(n))
-	w.dirty.Add(1)
 
 	if w.config.SyncPolicy == AOFAlways {
 		_ = w.writer.Flush()
@@ -180,6 +221,59 @@ func (w *AOFWriter) Append(cmd string, args [][]byte) error {
 	return nil
 }
 
+// appendCommand appends cmd and args to buf as a RESP array.
+func appendCommand(buf []byte, cmd string, args [][]byte) []byte {
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)+1), 10)
+	buf = append(buf, '\r', '\n')
+
+	buf = append(buf, '$')
+	buf = strconv.AppendInt(buf, int64(len(cmd)), 10)
+	buf = append(buf, '\r', '\n')
+	buf = append(buf, cmd...)
+	buf = append(buf, '\r', '\n')
+
+	for _, arg := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, arg...)
+		buf = append(buf, '\r', '\n')
+	}
+	return buf
+}
+
+// selectCommand is the command selecting namespace: SELECT for a numbered
+// database, NAMESPACE for any other.
+func selectCommand(namespace string) (string, [][]byte) {
+	if db, ok := store.NamespaceDB(namespace); ok {
+		return "SELECT", [][]byte{[]byte(strconv.Itoa(db))}
+	}
+	return "NAMESPACE", [][]byte{[]byte(namespace)}
+}
+
+// aofTimestampPrefix starts the annotation giving the Unix time in seconds
+// of the commands that follow it, as in Redis.
+const aofTimestampPrefix = "#TS:"
+
+func appendAOFTimestamp(buf []byte, t time.Time) []byte {
+	buf = append(buf, aofTimestampPrefix...)
+	buf = strconv.AppendInt(buf, t.Unix(), 10)
+	return append(buf, '\r', '\n')
+}
+
+// parseAOFTimestamp parses an annotation line written by appendAOFTimestamp.
+func parseAOFTimestamp(line string) (time.Time, bool) {
+	if !strings.HasPrefix(line, aofTimestampPrefix) {
+		return time.Time{}, false
+	}
+	sec, err := strconv.ParseInt(strings.TrimRight(line[len(aofTimestampPrefix):], "\r\n"), 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(sec, 0), true
+}
+
 func (w *AOFWriter) Size() int64 {
 	return w.size.Load()
 }
@@ -203,7 +297,13 @@ func (w *AOFWriter) Flush() error {
 	return nil
 }
 
+// AOFReader reads the commands of an append-only file for replay.
 type AOFReader struct {
+	// LoadTruncated loads a file whose last command was cut short, as by a
+	// crash partway through a write, up to the last complete command and
+	// truncates the file there. Otherwise such a file fails to load, as
+	// does one holding bytes that are not a command anywhere.
+	LoadTruncated bool
 }
 
 func NewAOFReader() *AOFReader {
@@ -216,234 +316,28 @@ type Command struct {
 }
 
 func (r *AOFReader) Load(path string) ([]Command, error) {
-	f, err := os.Open(path)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open AOF file: %v", err)
-	}
-	defer f.Close()
-
 	var commands []Command
-	reader := resp.NewReader(bufio.NewReader(f))
-
-	for {
-		cmd, args, err := reader.ReadCommand()
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			if strings.Contains(err.Error(), "EOF") {
-				break
-			}
-			return nil, fmt.Errorf("failed to read command: %v", err)
+	_, err := ScanAOF(path, func(cmd Command) {
+		commands = append(commands, cmd)
+	})
+	var corrupt *AOFCorruptError
+	if errors.As(err, &corrupt) && corrupt.Truncated && r.LoadTruncated {
+		if err := os.Truncate(path, corrupt.Offset); err != nil {
+			return nil, fmt.Errorf("failed to truncate AOF: %v", err)
 		}
-
-		commands = append(commands, Command{
-			Name: cmd,
-			Args: args,
-		})
-	}
-
-	logger.Info().Int("commands", len(commands)).Msg("AOF loaded")
-	return commands, nil
-}
-
-type AOFRewriter struct {
-	config    AOFConfig
-	store     interface{ GetAll() map[string]interface{} }
-	mu        sync.Mutex
-	rewriting atomic.Bool
-	lastSize  int64
-}
-
-func NewAOFRewriter(cfg AOFConfig, store interface{ GetAll() map[string]interface{} }) *AOFRewriter {
-	return &AOFRewriter{
-		config: cfg,
-		store:  store,
+		logger.Warn().
+			Str("file", path).
+			Int64("offset", corrupt.Offset).
+			Int("commands", corrupt.Commands).
+			Msg("AOF was truncated, loaded up to the last complete command and removed the rest")
+		err = nil
 	}
-}
-
-func (rw *AOFRewriter) Rewrite(aofPath string) error {
-	if !rw.rewriting.CompareAndSwap(false, true) {
-		return fmt.Errorf("rewrite already in progress")
-	}
-	defer rw.rewriting.Store(false)
-
-	tempPath := aofPath + ".tmp"
-
-	f, err := os.Create(tempPath)
 	if err != nil {
-		return fmt.Errorf("failed to create temp file: %v", err)
-	}
-
-	writer := bufio.NewWriterSize(f, 8192)
-
-	entries := rw.store.GetAll()
-	for key, entry := range entries {
-		if err := rw.writeEntry(writer, key, entry); err != nil {
-			f.Close()
-			os.Remove(tempPath)
-			return err
-		}
+		return nil, err
 	}
 
-	if err := writer.Flush(); err != nil {
-		f.Close()
-		os.Remove(tempPath)
-		return err
-	}
-
-	if err := f.Sync(); err != nil {
-		f.Close()
-		os.Remove(tempPath)
-		return err
-	}
-
-	stat, _ := f.Stat()
-	rw.lastSize = stat.Size()
-
-	// Close before rename — required on Windows where open files can't be renamed
-	if err := f.Close(); err != nil {
-		os.Remove(tempPath)
-		return err
-	}
-
-	if err := os.Rename(tempPath, aofPath); err != nil {
-		os.Remove(tempPath)
-		return fmt.Errorf("failed to rename AOF file: %v", err)
-	}
-
-	logger.Info().Str("path", aofPath).Msg("AOF rewrite completed")
-	return nil
-}
-
-func (rw *AOFRewriter) writeEntry(w *bufio.Writer, key string, entry interface{}) error {
-	var buf []byte
-	buf = append(buf, '*')
-	buf = append(buf, '3')
-	buf = append(buf, '\r', '\n')
-
-	buf = append(buf, '$', '3', '\r', '\n', 'S', 'E', 'T', '\r', '\n')
-
-	keyBytes := []byte(key)
-	buf = append(buf, '$')
-	buf = append(buf, fmt.Sprintf("%d", len(keyBytes))...)
-	buf = append(buf, '\r', '\n')
-	buf = append(buf, keyBytes...)
-	buf = append(buf, '\r', '\n')
-
-	var valueBytes []byte
-	switch v := entry.(type) {
-	case string:
-		valueBytes = []byte(v)
-	case []byte:
-		valueBytes = v
-	default:
-		valueBytes = []byte(fmt.Sprintf("%v", v))
-	}
-
-	buf = append(buf, '$')
-	buf = append(buf, fmt.Sprintf("%d", len(valueBytes))...)
-	buf = append(buf, '\r', '\n')
-	buf = append(buf, valueBytes...)
-	buf = append(buf, '\r', '\n')
-
-	_, err := w.Write(buf)
-	return err
-}
-
-func (rw *AOFRewriter) IsRewriting() bool {
-	return rw.rewriting.Load()
-}
-
-func (rw *AOFRewriter) ShouldRewrite(currentSize int64) bool {
-	if rw.rewriting.Load() {
-		return false
-	}
-
-	if currentSize < rw.config.RewriteSize {
-		return false
-	}
-
-	if rw.lastSize == 0 {
-		return currentSize >= rw.config.RewriteSize
-	}
-
-	pct := int((currentSize - rw.lastSize) * 100 / rw.lastSize)
-	return pct >= rw.config.RewritePct
-}
-
-type AOFManager struct {
-	writer   *AOFWriter
-	reader   *AOFReader
-	rewriter *AOFRewriter
-	config   AOFConfig
-	mu       sync.Mutex
-}
-
-func NewAOFManager(cfg AOFConfig, store interface{ GetAll() map[string]interface{} }) *AOFManager {
-	return &AOFManager{
-		writer:   NewAOFWriter(cfg),
-		reader:   NewAOFReader(),
-		rewriter: NewAOFRewriter(cfg, store),
-		config:   cfg,
-	}
-}
-
-func (m *AOFManager) Start() error {
-	return m.writer.Start()
-}
-
-func (m *AOFManager) Stop() {
-	m.writer.Stop()
-}
-
-func (m *AOFManager) Append(cmd string, args [][]byte) error {
-	return m.writer.Append(cmd, args)
-}
-
-func (m *AOFManager) Load() ([]Command, error) {
-	path := filepath.Join(m.config.DataDir, m.config.Filename)
-	return m.reader.Load(path)
-}
-
-func (m *AOFManager) BGREWRITEAOF() error {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-
-	path := filepath.Join(m.config.DataDir, m.config.Filename)
-	return m.rewriter.Rewrite(path)
-}
-
-func (m *AOFManager) Size() int64 {
-	return m.writer.Size()
-}
-
-func (m *AOFManager) Dirty() int64 {
-	return m.writer.Dirty()
-}
-
-func (m *AOFManager) Flush() error {
-	return m.writer.Flush()
-}
-
-func (m *AOFManager) IsRewriting() bool {
-	return m.rewriter.IsRewriting()
-}
-
-func (m *AOFManager) Info() map[string]interface{} {
-	return map[string]interface{}{
-		"aof_enabled":                  m.config.Enabled,
-		"aof_rewrite_in_progress":      m.rewriter.IsRewriting(),
-		"aof_last_rewrite_time_sec":    0,
-		"aof_current_rewrite_time_sec": 0,
-		"aof_current_size":             m.writer.Size(),
-		"aof_base_size":                m.rewriter.lastSize,
-		"aof_pending_rewrite":          0,
-		"aof_buffer_length":            0,
-		"aof_rewrite_buffer_length":    0,
-		"aof_pending_bio_fsync":        0,
-		"aof_delayed_fsync":            0,
-	}
+	logger.Info().Int("commands", len(commands)).Msg("AOF loaded")
+	return commands, nil
 }
 
 func SyncPolicyFromString(s string) AOFSyncPolicy {
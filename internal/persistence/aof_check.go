@@ -0,0 +1,192 @@
+package persistence
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cachestorm/cachestorm/internal/resp"
+	"github.com/cachestorm/cachestorm/internal/store"
+)
+
+// AOFCorruptError reports the first command of an AOF that cannot be read.
+type AOFCorruptError struct {
+	Path string
+	// Offset is where the unreadable command starts, which is also the
+	// length of the file's valid part.
+	Offset int64
+	// Commands is the number of valid commands before Offset.
+	Commands int
+	// Truncated is set when the file ends partway through the command,
+	// rather than holding bytes that are not a command.
+	Truncated bool
+	Err       error
+}
+
+func (e *AOFCorruptError) Error() string {
+	if e.Truncated {
+		return fmt.Sprintf("AOF %s ends with an incomplete command at offset %d, after %d valid commands", e.Path, e.Offset, e.Commands)
+	}
+	return fmt.Sprintf("AOF %s is corrupted at offset %d, after %d valid commands: %v", e.Path, e.Offset, e.Commands, e.Err)
+}
+
+func (e *AOFCorruptError) Unwrap() error {
+	return e.Err
+}
+
+// ScanAOF reads the AOF at path, calling fn with each command, and returns
+// the size of the file. A file that cannot be read to the end returns an
+// *AOFCorruptError at the first command that fails to parse. Annotations
+// such as timestamps are skipped.
+func ScanAOF(path string, fn func(Command)) (int64, error) {
+	return scanAOF(path, func(cmd Command, _ int64) { fn(cmd) }, nil)
+}
+
+// scanAOF is ScanAOF that also passes where each command starts, and the
+// timestamp annotations to timestamp, when it is not nil.
+func scanAOF(path string, command func(Command, int64), timestamp func(time.Time, int64)) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open AOF file: %v", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat AOF file: %v", err)
+	}
+	size := info.Size()
+
+	counter := &countingReader{r: f}
+	br := bufio.NewReader(counter)
+	reader := resp.NewReader(br)
+
+	var offset int64
+	commands := 0
+	for {
+		if b, err := br.Peek(1); err == nil && b[0] == '#' {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				return size, &AOFCorruptError{Path: path, Offset: offset, Commands: commands, Truncated: true, Err: io.ErrUnexpectedEOF}
+			}
+			if ts, ok := parseAOFTimestamp(line); ok && timestamp != nil {
+				timestamp(ts, offset)
+			}
+			offset = counter.n - int64(br.Buffered())
+			continue
+		}
+		cmd, args, err := reader.ReadCommand()
+		if err != nil {
+			if err == io.EOF && offset == size {
+				return size, nil
+			}
+			return size, &AOFCorruptError{
+				Path:      path,
+				Offset:    offset,
+				Commands:  commands,
+				Truncated: errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF),
+				Err:       err,
+			}
+		}
+		command(Command{Name: cmd, Args: args}, offset)
+		commands++
+		offset = counter.n - int64(br.Buffered())
+	}
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// AOFFileCheck is the outcome of checking one file of an AOF.
+type AOFFileCheck struct {
+	Path string
+	Size int64
+	// Snapshot is set for a base file in RDB format, which is checked by
+	// loading it; Commands is then zero.
+	Snapshot bool
+	Commands int
+	// Err is nil for a valid file, an *AOFCorruptError for a file of
+	// commands that cannot be read to the end, or the load error of a
+	// snapshot.
+	Err error
+}
+
+// CheckAOF checks an AOF without loading it into a server. path is a
+// single-file AOF, the manifest of a multi-part AOF or the directory
+// holding it; every file the manifest lists is checked, base first.
+func CheckAOF(path string) ([]AOFFileCheck, error) {
+	manifestPath, err := resolveAOFManifest(path)
+	if err != nil {
+		return nil, err
+	}
+	if manifestPath == "" {
+		return []AOFFileCheck{checkAOFFile(path)}, nil
+	}
+	path = manifestPath
+
+	manifest, err := readAOFManifest(path)
+	if err != nil {
+		return nil, err
+	}
+	var checks []AOFFileCheck
+	for _, f := range manifest.files() {
+		filePath := filepath.Join(filepath.Dir(path), f.name)
+		if f.typ == aofFileBase && strings.HasSuffix(f.name, aofBaseRDBSuffix) {
+			checks = append(checks, checkAOFSnapshot(filePath))
+			continue
+		}
+		checks = append(checks, checkAOFFile(filePath))
+	}
+	return checks, nil
+}
+
+func checkAOFFile(path string) AOFFileCheck {
+	check := AOFFileCheck{Path: path}
+	check.Size, check.Err = ScanAOF(path, func(Command) {
+		check.Commands++
+	})
+	return check
+}
+
+func checkAOFSnapshot(path string) AOFFileCheck {
+	check := AOFFileCheck{Path: path, Snapshot: true}
+	if info, err := os.Stat(path); err == nil {
+		check.Size = info.Size()
+	}
+	check.Err = NewRDBReader(store.NewStoreWithNamespaces()).Load(path)
+	return check
+}
+
+// FixAOF truncates the last of checks, the file new writes are appended
+// to, to the commands before its first unreadable one. An earlier file
+// cannot be fixed this way, since the files after it would replay on top
+// of a gap.
+func FixAOF(checks []AOFFileCheck) error {
+	for i, check := range checks {
+		if check.Err == nil {
+			continue
+		}
+		var corrupt *AOFCorruptError
+		if i != len(checks)-1 || !errors.As(check.Err, &corrupt) {
+			return fmt.Errorf("%s cannot be fixed: only the last file of commands can be truncated", check.Path)
+		}
+		if err := os.Truncate(check.Path, corrupt.Offset); err != nil {
+			return fmt.Errorf("failed to truncate %s: %v", check.Path, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package persistence
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cachestorm/cachestorm/internal/store"
+)
+
+const (
+	aofSetA = "*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n1\r\n"
+	aofSetB = "*3\r\n$3\r\nSET\r\n$1\r\nb\r\n$1\r\n2\r\n"
+)
+
+func TestScanAOFReportsFirstBadCommand(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      string
+		commands  int
+		truncated bool
+	}{
+		{"incomplete bulk", aofSetA + aofSetB[:20], 1, true},
+		{"incomplete header", aofSetA + "*3\r", 1, true},
+		{"garbage", aofSetA + "garbage\r\n" + aofSetB, 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "appendonly.aof")
+			if err := os.WriteFile(path, []byte(tt.data), 0644); err != nil {
+				t.Fatal(err)
+			}
+			size, err := ScanAOF(path, func(Command) {})
+			var corrupt *AOFCorruptError
+			if !errors.As(err, &corrupt) {
+				t.Fatalf("err = %v, want *AOFCorruptError", err)
+			}
+			if size != int64(len(tt.data)) || corrupt.Offset != int64(len(aofSetA)) || corrupt.Commands != tt.commands || corrupt.Truncated != tt.truncated {
+				t.Errorf("size %d, error %+v", size, corrupt)
+			}
+		})
+	}
+}
+
+func TestAOFReaderLoadTruncated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	if err := os.WriteFile(path, []byte(aofSetA+aofSetB[:20]), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewAOFReader().Load(path); err == nil {
+		t.Fatal("truncated AOF loaded without LoadTruncated")
+	}
+
+	r := NewAOFReader()
+	r.LoadTruncated = true
+	cmds, err := r.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cmds) != 1 || string(cmds[0].Args[0]) != "a" {
+		t.Errorf("commands = %+v", cmds)
+	}
+	if info, _ := os.Stat(path); info.Size() != int64(len(aofSetA)) {
+		t.Errorf("file not truncated to its valid commands: %d bytes", info.Size())
+	}
+
+	// Garbage is not a torn write and still fails
+	if err := os.WriteFile(path, []byte(aofSetA+"garbage\r\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Load(path); err == nil {
+		t.Error("corrupted AOF loaded")
+	}
+}
+
+func TestAOFManagerLoadsTruncatedLastFileOnly(t *testing.T) {
+	dir := t.TempDir()
+	m := newTestAOFManager(t, dir, store.NewStore())
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	m.Append("", "SET", [][]byte{[]byte("a"), []byte("1")})
+	m.Stop()
+
+	incr := filepath.Join(m.Dir(), "appendonly.aof.1.incr.aof")
+	f, err := os.OpenFile(incr, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(aofSetB[:20])
+	f.Close()
+
+	checks, err := CheckAOF(m.Dir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(checks) != 2 || !checks[0].Snapshot || checks[0].Err != nil || checks[1].Err == nil {
+		t.Fatalf("checks = %+v", checks)
+	}
+
+	if _, err := newTestAOFManager(t, dir, store.NewStore()).Load(); err == nil {
+		t.Fatal("truncated AOF loaded without LoadTruncated")
+	}
+	m2 := newTestAOFManager(t, dir, store.NewStore())
+	m2.SetLoadTruncated(true)
+	cmds, err := m2.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cmds) != 2 || cmds[0].Name != "SELECT" || string(cmds[1].Args[0]) != "a" {
+		t.Errorf("commands = %+v", cmds)
+	}
+	if checks, _ := CheckAOF(m.Dir()); checks[1].Err != nil || checks[1].Commands != 2 {
+		t.Errorf("after load: %+v", checks[1])
+	}
+}
+
+func TestFixAOF(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	if err := os.WriteFile(path, []byte(aofSetA+"garbage\r\n"+aofSetB), 0644); err != nil {
+		t.Fatal(err)
+	}
+	checks, err := CheckAOF(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := FixAOF(checks); err != nil {
+		t.Fatal(err)
+	}
+	checks, err = CheckAOF(path)
+	if err != nil || len(checks) != 1 || checks[0].Err != nil || checks[0].Commands != 1 {
+		t.Fatalf("after fix: %+v, %v", checks, err)
+	}
+
+	bad := []AOFFileCheck{{Path: path, Err: &AOFCorruptError{}}, {Path: path}}
+	if err := FixAOF(bad); err == nil {
+		t.Error("fixed a file other than the last")
+	}
+}
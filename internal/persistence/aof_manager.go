@@ -0,0 +1,667 @@
+package persistence
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cachestorm/cachestorm/internal/logger"
+	"github.com/cachestorm/cachestorm/internal/store"
+)
+
+var (
+	ErrRewriteInProgress = errors.New("background append only file rewriting already in progress")
+	ErrAOFStopped        = errors.New("append only file is stopped")
+)
+
+const defaultAOFDirName = "appendonlydir"
+
+// AOFInfo is the state of the AOF reported by INFO persistence.
+type AOFInfo struct {
+	Enabled           bool
+	RewriteInProgress bool
+	// RewriteStarted is when the running rewrite began.
+	RewriteStarted time.Time
+	LastRewriteOK  bool
+	// LastRewriteDuration is -1 until a rewrite has finished.
+	LastRewriteDuration time.Duration
+	Rewrites            int64
+	CurrentSize         int64
+	BaseSize            int64
+	// RewriteBufferLength is the size of the writes buffered by the running
+	// rewrite.
+	RewriteBufferLength int
+}
+
+// AOFManager keeps the append-only file in the multi-part layout of Redis
+// 7: a directory holding a base snapshot, incremental files of commands
+// written since, and a manifest naming them. Rewrites save a new base from
+// a point-in-time snapshot of the store and start a new incremental file;
+// the live files are never renamed over.
+type AOFManager struct {
+	config  AOFConfig
+	store   *store.Store
+	barrier func(func())
+
+	mu                  sync.Mutex
+	manifest            *aofManifest
+	writer              *AOFWriter
+	closedSize          int64
+	baseSize            int64
+	seldb               string // namespace last selected in the incremental file, "" for none
+	bufSeldb            string // namespace last selected in the rewrite buffer
+	buffering           bool
+	rewriteBuf          []byte
+	rewriteBufTS        int64
+	rewriteStarted      time.Time
+	lastRewriteOK       bool
+	lastRewriteAttempt  time.Time
+	lastRewriteDuration time.Duration
+	rewrites            int64
+	legacyLoaded        bool
+	stopping            bool
+
+	dirty     atomic.Int64
+	rewriting atomic.Bool
+	stopCh    chan struct{}
+	stopOnce  sync.Once
+	wg        sync.WaitGroup
+}
+
+func NewAOFManager(cfg AOFConfig, s *store.Store) *AOFManager {
+	if cfg.DirName == "" {
+		cfg.DirName = defaultAOFDirName
+	}
+	return &AOFManager{
+		config:              cfg,
+		store:               s,
+		lastRewriteOK:       true,
+		lastRewriteDuration: -1,
+		stopCh:              make(chan struct{}),
+	}
+}
+
+// SetWriteBarrier sets the function a rewrite runs its snapshot under, so
+// that the snapshot and the start of the rewrite buffer fall between two
+// write commands and their appends. Without one the snapshot is taken
+// directly, which is only safe while nothing writes.
+func (m *AOFManager) SetWriteBarrier(barrier func(func())) {
+	m.barrier = barrier
+}
+
+// Dir is the directory holding the AOF files and manifest.
+func (m *AOFManager) Dir() string {
+	return filepath.Join(m.config.DataDir, m.config.DirName)
+}
+
+func (m *AOFManager) manifestPath() string {
+	return filepath.Join(m.Dir(), m.config.Filename+aofManifestSuffix)
+}
+
+// legacyPath is the single-file AOF written before the multi-part layout.
+func (m *AOFManager) legacyPath() string {
+	return filepath.Join(m.config.DataDir, m.config.Filename)
+}
+
+func (m *AOFManager) fileName(seq int64, suffix string) string {
+	return fmt.Sprintf("%s.%d%s", m.config.Filename, seq, suffix)
+}
+
+// Exists reports whether a multi-part AOF is on disk. Its base holds the
+// whole dataset, so the RDB snapshot need not be loaded before it.
+func (m *AOFManager) Exists() bool {
+	_, err := os.Stat(m.manifestPath())
+	return err == nil
+}
+
+// Load reads the AOF for replay. The base snapshot of the manifest is
+// loaded straight into the store and the commands of the incremental files
+// are returned. A single-file AOF from before the multi-part layout is
+// returned whole and replaced by the new layout when the manager starts.
+// Without any AOF, Load returns no commands. Only the last file may end
+// with an incomplete command, which is dropped under LoadTruncated.
+func (m *AOFManager) Load() ([]Command, error) {
+	manifest, err := readAOFManifest(m.manifestPath())
+	if errors.Is(err, fs.ErrNotExist) {
+		if _, err := os.Stat(m.legacyPath()); err != nil {
+			return nil, nil
+		}
+		reader := NewAOFReader()
+		reader.LoadTruncated = m.LoadTruncated()
+		commands, err := reader.Load(m.legacyPath())
+		if err != nil {
+			return nil, err
+		}
+		m.mu.Lock()
+		m.legacyLoaded = true
+		m.mu.Unlock()
+		return commands, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var commands []Command
+	loadTruncated := m.LoadTruncated()
+	files := manifest.files()
+	for i, f := range files {
+		path := filepath.Join(m.Dir(), f.name)
+		if f.typ == aofFileBase && strings.HasSuffix(f.name, aofBaseRDBSuffix) {
+			if err := NewRDBReader(m.store).Load(path); err != nil {
+				return nil, fmt.Errorf("failed to load AOF base %s: %v", f.name, err)
+			}
+			continue
+		}
+		reader := NewAOFReader()
+		reader.LoadTruncated = loadTruncated && i == len(files)-1
+		loaded, err := reader.Load(path)
+		if err != nil {
+			return nil, err
+		}
+		commands = append(commands, loaded...)
+	}
+
+	m.mu.Lock()
+	m.manifest = manifest
+	m.mu.Unlock()
+	return commands, nil
+}
+
+// Start opens the AOF for appending. Without a manifest, the dataset loaded
+// so far is written as the first base; a single-file AOF that Load read is
+// removed once the new layout is on disk.
+func (m *AOFManager) Start() error {
+	if !m.config.Enabled {
+		return nil
+	}
+	if err := os.MkdirAll(m.Dir(), 0755); err != nil {
+		return fmt.Errorf("failed to create AOF directory: %v", err)
+	}
+
+	m.mu.Lock()
+	manifest := m.manifest
+	legacy := m.legacyLoaded
+	m.mu.Unlock()
+	if manifest == nil {
+		var err error
+		manifest, err = readAOFManifest(m.manifestPath())
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+
+	if manifest == nil {
+		m.rewriting.Store(true)
+		if err := m.rewrite(); err != nil {
+			return err
+		}
+		if legacy {
+			if err := os.Remove(m.legacyPath()); err == nil {
+				logger.Info().Str("path", m.legacyPath()).Msg("single-file AOF converted to the multi-part layout")
+			}
+		}
+	} else if err := m.open(manifest); err != nil {
+		return err
+	}
+
+	if m.config.AutoRewrite {
+		m.wg.Add(1)
+		go m.autoRewriteLoop()
+	}
+	return nil
+}
+
+// open appends to the last incremental file of manifest, adding one when
+// the manifest lists none.
+func (m *AOFManager) open(manifest *aofManifest) error {
+	dir := m.Dir()
+	added := len(manifest.incrs) == 0
+	if added {
+		_, seq := manifest.nextSeqs()
+		manifest.incrs = append(manifest.incrs, aofFile{name: m.fileName(seq, aofIncrSuffix), seq: seq, typ: aofFileIncr})
+	}
+	last := manifest.incrs[len(manifest.incrs)-1]
+
+	var closed, base int64
+	for _, f := range manifest.files() {
+		if f == last {
+			continue
+		}
+		info, err := os.Stat(filepath.Join(dir, f.name))
+		if err != nil {
+			return fmt.Errorf("failed to stat AOF file: %v", err)
+		}
+		closed += info.Size()
+		if f.typ == aofFileBase {
+			base = info.Size()
+		}
+	}
+
+	m.mu.Lock()
+	timestamps := m.config.Timestamps
+	m.mu.Unlock()
+	w := NewAOFWriter(AOFConfig{Enabled: true, DataDir: dir, Filename: last.name, SyncPolicy: m.config.SyncPolicy, Timestamps: timestamps})
+	if err := w.Start(); err != nil {
+		return err
+	}
+	if added {
+		if err := writeAOFManifest(m.manifestPath(), manifest); err != nil {
+			w.Stop()
+			return err
+		}
+	}
+
+	m.mu.Lock()
+	m.manifest = manifest
+	m.writer = w
+	m.seldb = ""
+	m.closedSize = closed
+	m.baseSize = base
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *AOFManager) Stop() {
+	m.stopOnce.Do(func() {
+		m.mu.Lock()
+		m.stopping = true
+		m.mu.Unlock()
+		close(m.stopCh)
+		m.wg.Wait()
+
+		m.mu.Lock()
+		if m.writer != nil {
+			m.writer.Stop()
+		}
+		m.mu.Unlock()
+	})
+}
+
+// Append logs a write command applied to namespace, preceded by a SELECT,
+// or a NAMESPACE for a namespace that is not a numbered database, when it
+// applies to another namespace than the previous one. Each incremental
+// file selects its namespace before its first command. While a rewrite
+// runs, the command is also buffered for the new incremental file.
+func (m *AOFManager) Append(namespace, cmd string, args [][]byte) error {
+	if namespace == "" {
+		namespace = store.DBNamespace(0)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.buffering {
+		if now := time.Now(); m.config.Timestamps && now.Unix() != m.rewriteBufTS {
+			m.rewriteBufTS = now.Unix()
+			m.rewriteBuf = appendAOFTimestamp(m.rewriteBuf, now)
+		}
+		if namespace != m.bufSeldb {
+			name, selArgs := selectCommand(namespace)
+			m.rewriteBuf = appendCommand(m.rewriteBuf, name, selArgs)
+			m.bufSeldb = namespace
+		}
+		m.rewriteBuf = appendCommand(m.rewriteBuf, cmd, args)
+	}
+	if m.writer == nil {
+		return nil
+	}
+	m.dirty.Add(1)
+	if namespace != m.seldb {
+		name, selArgs := selectCommand(namespace)
+		if err := m.writer.Append(name, selArgs); err != nil {
+			return err
+		}
+		m.seldb = namespace
+	}
+	return m.writer.Append(cmd, args)
+}
+
+// BGREWRITEAOF starts a rewrite in the background. It returns
+// ErrRewriteInProgress while another rewrite is running.
+func (m *AOFManager) BGREWRITEAOF() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.stopping {
+		return ErrAOFStopped
+	}
+	if !m.rewriting.CompareAndSwap(false, true) {
+		return ErrRewriteInProgress
+	}
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		_ = m.rewrite()
+	}()
+	return nil
+}
+
+// Rewrite rewrites the AOF before returning, after waiting for a rewrite in
+// progress, whose base may predate the call. Changes made to the store
+// without going through Append, such as a restored backup, reach the AOF
+// this way.
+func (m *AOFManager) Rewrite() error {
+	for {
+		m.mu.Lock()
+		if m.stopping {
+			m.mu.Unlock()
+			return ErrAOFStopped
+		}
+		started := m.rewriting.CompareAndSwap(false, true)
+		m.mu.Unlock()
+		if started {
+			return m.rewrite()
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// rewrite replaces the AOF with a base snapshot of the store and a fresh
+// incremental file. Writes made while the snapshot is saved still go to the
+// current files, so a failed rewrite loses nothing, and are also buffered;
+// the buffer is copied to the new incremental file before the manifest
+// switches over. The caller has set m.rewriting.
+func (m *AOFManager) rewrite() (err error) {
+	defer m.rewriting.Store(false)
+
+	started := time.Now()
+	m.mu.Lock()
+	m.rewriteStarted = started
+	baseSeq, incrSeq := m.manifest.nextSeqs()
+	m.mu.Unlock()
+	defer func() { m.finishRewrite(started, err) }()
+
+	dir := m.Dir()
+	baseName := m.fileName(baseSeq, aofBaseRDBSuffix)
+	incrName := m.fileName(incrSeq, aofIncrSuffix)
+	basePath := filepath.Join(dir, baseName)
+
+	var states []savedState
+	var timestamps bool
+	var created time.Time
+	snap := m.store.SnapshotWith(func(capture func()) {
+		m.pauseWrites(func() {
+			capture()
+			created = time.Now()
+			if states, err = captureStates(); err != nil {
+				return
+			}
+			m.mu.Lock()
+			m.buffering = true
+			m.bufSeldb = ""
+			// The new incremental file starts with the time of its base,
+			// where the history RestoreAOF can go back to begins
+			if m.config.Timestamps {
+				m.rewriteBufTS = created.Unix()
+				m.rewriteBuf = appendAOFTimestamp(m.rewriteBuf, created)
+			}
+			timestamps = m.config.Timestamps
+			m.mu.Unlock()
+		})
+	})
+	if err != nil {
+		snap.Release()
+		return err
+	}
+	err = NewRDBWriter(m.store, RDBConfig{Version: RDBVersion11, Checksum: true}).saveSnapshot(basePath, snap, states)
+	snap.Release()
+	if err != nil {
+		return err
+	}
+	baseInfo, err := os.Stat(basePath)
+	if err != nil {
+		return err
+	}
+
+	incr := NewAOFWriter(AOFConfig{Enabled: true, DataDir: dir, Filename: incrName, SyncPolicy: m.config.SyncPolicy, Timestamps: timestamps})
+	if err = incr.Start(); err != nil {
+		os.Remove(basePath)
+		return err
+	}
+	discard := func() {
+		incr.Stop()
+		os.Remove(filepath.Join(dir, incrName))
+		os.Remove(basePath)
+	}
+
+	// What was buffered during the save is copied without holding up
+	// clients; the rest follows with appends held while the files switch.
+	m.mu.Lock()
+	pending := m.rewriteBuf
+	m.rewriteBuf = nil
+	m.mu.Unlock()
+	if err = incr.appendRaw(pending); err != nil {
+		discard()
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err = incr.appendRaw(m.rewriteBuf); err == nil {
+		err = incr.Flush()
+	}
+	next := &aofManifest{
+		base:  &aofFile{name: baseName, seq: baseSeq, typ: aofFileBase, created: created.Unix()},
+		incrs: []aofFile{{name: incrName, seq: incrSeq, typ: aofFileIncr}},
+	}
+	if err == nil {
+		err = writeAOFManifest(m.manifestPath(), next)
+	}
+	if err != nil {
+		discard()
+		return err
+	}
+
+	old, oldWriter := m.manifest, m.writer
+	m.manifest = next
+	m.writer = incr
+	m.seldb = m.bufSeldb
+	m.baseSize = baseInfo.Size()
+	m.closedSize = baseInfo.Size()
+	m.buffering = false
+	m.rewriteBuf = nil
+	if oldWriter != nil {
+		oldWriter.Stop()
+	}
+	if old != nil {
+		for _, f := range old.files() {
+			os.Remove(filepath.Join(dir, f.name))
+		}
+	}
+	return nil
+}
+
+func (m *AOFManager) pauseWrites(fn func()) {
+	if m.barrier == nil {
+		fn()
+		return
+	}
+	m.barrier(fn)
+}
+
+func (m *AOFManager) finishRewrite(started time.Time, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	m.buffering = false
+	m.rewriteBuf = nil
+	m.rewriteBufTS = 0
+	m.bufSeldb = ""
+	m.rewriteStarted = time.Time{}
+	m.lastRewriteAttempt = now
+	m.lastRewriteDuration = now.Sub(started)
+	m.lastRewriteOK = err == nil
+	if err != nil {
+		logger.Error().Err(err).Msg("AOF rewrite failed")
+		return
+	}
+	m.rewrites++
+	logger.Info().
+		Int64("base_size", m.baseSize).
+		Dur("duration", m.lastRewriteDuration).
+		Msg("AOF rewrite completed")
+}
+
+func (m *AOFManager) autoRewriteLoop() {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.stopCh:
+			return
+		case now := <-ticker.C:
+			if m.shouldRewrite(now) {
+				if err := m.BGREWRITEAOF(); err != nil && err != ErrRewriteInProgress && err != ErrAOFStopped {
+					logger.Error().Err(err).Msg("Failed to start AOF rewrite")
+				}
+			}
+		}
+	}
+}
+
+// shouldRewrite reports whether an automatic rewrite is due. After a
+// failed rewrite it waits saveRetryDelay before trying again.
+func (m *AOFManager) shouldRewrite(now time.Time) bool {
+	m.mu.Lock()
+	failed := !m.lastRewriteOK && now.Sub(m.lastRewriteAttempt) < saveRetryDelay
+	m.mu.Unlock()
+	return !failed && m.ShouldRewrite(m.Size())
+}
+
+// ShouldRewrite reports whether an AOF of currentSize bytes has passed the
+// configured size or growth threshold.
+func (m *AOFManager) ShouldRewrite(currentSize int64) bool {
+	if m.rewriting.Load() {
+		return false
+	}
+
+	m.mu.Lock()
+	base := m.baseSize
+	cfg := m.config
+	m.mu.Unlock()
+
+	if cfg.MaxSize > 0 && base < cfg.MaxSize && currentSize >= cfg.MaxSize {
+		return true
+	}
+	if cfg.RewritePct <= 0 || currentSize < cfg.RewriteSize {
+		return false
+	}
+	if base == 0 {
+		return true
+	}
+	return (currentSize-base)*100/base >= int64(cfg.RewritePct)
+}
+
+// SetRewriteRules changes the thresholds of automatic rewrites, like
+// CONFIG SET auto-aof-rewrite-min-size and auto-aof-rewrite-percentage.
+func (m *AOFManager) SetRewriteRules(minSize int64, pct int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.config.RewriteSize = minSize
+	m.config.RewritePct = pct
+}
+
+// SetLoadTruncated changes whether the AOF loads with an incomplete last
+// command, like CONFIG SET aof-load-truncated.
+func (m *AOFManager) SetLoadTruncated(enabled bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.config.LoadTruncated = enabled
+}
+
+// LoadTruncated returns the setting changed by SetLoadTruncated.
+func (m *AOFManager) LoadTruncated() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.config.LoadTruncated
+}
+
+// SetTimestamps turns the timestamp annotations of the AOF on or off, like
+// CONFIG SET aof-timestamp-enabled.
+func (m *AOFManager) SetTimestamps(enabled bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.config.Timestamps = enabled
+	m.rewriteBufTS = 0
+	if m.writer != nil {
+		m.writer.setTimestamps(enabled)
+	}
+}
+
+// Timestamps returns the setting changed by SetTimestamps.
+func (m *AOFManager) Timestamps() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.config.Timestamps
+}
+
+// RestoreUntil cuts the AOF back to until with RestoreAOF before it is
+// loaded.
+func (m *AOFManager) RestoreUntil(until time.Time) (*AOFRestore, error) {
+	if !m.Exists() {
+		return nil, ErrRestoreNeedsManifest
+	}
+	return RestoreAOF(m.Dir(), until)
+}
+
+// RewriteRules returns the thresholds set by SetRewriteRules.
+func (m *AOFManager) RewriteRules() (minSize int64, pct int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.config.RewriteSize, m.config.RewritePct
+}
+
+// Size is the total size of the files in the manifest.
+func (m *AOFManager) Size() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	size := m.closedSize
+	if m.writer != nil {
+		size += m.writer.Size()
+	}
+	return size
+}
+
+// Dirty is the number of commands appended since the manager started.
+func (m *AOFManager) Dirty() int64 {
+	return m.dirty.Load()
+}
+
+func (m *AOFManager) Flush() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.writer == nil {
+		return nil
+	}
+	return m.writer.Flush()
+}
+
+func (m *AOFManager) IsRewriting() bool {
+	return m.rewriting.Load()
+}
+
+func (m *AOFManager) Info() AOFInfo {
+	size := m.Size()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return AOFInfo{
+		Enabled:             m.config.Enabled,
+		RewriteInProgress:   m.rewriting.Load(),
+		RewriteStarted:      m.rewriteStarted,
+		LastRewriteOK:       m.lastRewriteOK,
+		LastRewriteDuration: m.lastRewriteDuration,
+		Rewrites:            m.rewrites,
+		CurrentSize:         size,
+		BaseSize:            m.baseSize,
+		RewriteBufferLength: len(m.rewriteBuf),
+	}
+}
@@ -0,0 +1,243 @@
+package persistence
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/cachestorm/cachestorm/internal/store"
+)
+
+func newTestAOFManager(t *testing.T, dir string, s *store.Store) *AOFManager {
+	t.Helper()
+	return NewAOFManager(AOFConfig{
+		Enabled:    true,
+		Filename:   "appendonly.aof",
+		DataDir:    dir,
+		SyncPolicy: AOFAlways,
+	}, s)
+}
+
+func TestAOFManagerMultiPartLayout(t *testing.T) {
+	dir := t.TempDir()
+	s := store.NewStore()
+	s.Set("loaded", &store.StringValue{Data: []byte("v")}, store.SetOptions{})
+
+	m := newTestAOFManager(t, dir, s)
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Append("", "SET", [][]byte{[]byte("k"), []byte("1")}); err != nil {
+		t.Fatal(err)
+	}
+	m.Stop()
+
+	manifest, err := os.ReadFile(filepath.Join(dir, "appendonlydir", "appendonly.aof.manifest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := regexp.MustCompile(`^file appendonly\.aof\.1\.base\.rdb seq 1 type b created \d+\nfile appendonly\.aof\.1\.incr\.aof seq 1 type i\n$`)
+	if !want.Match(manifest) {
+		t.Fatalf("manifest = %q", manifest)
+	}
+
+	loaded := store.NewStore()
+	m2 := newTestAOFManager(t, dir, loaded)
+	if !m2.Exists() {
+		t.Fatal("Exists = false")
+	}
+	cmds, err := m2.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := loaded.Get("loaded"); !ok {
+		t.Error("base snapshot not loaded")
+	}
+	// The file selects the namespace of its first write.
+	if len(cmds) != 2 || cmds[0].Name != "SELECT" || string(cmds[0].Args[0]) != "0" ||
+		cmds[1].Name != "SET" || string(cmds[1].Args[0]) != "k" {
+		t.Errorf("commands = %+v", cmds)
+	}
+
+	// Restarting appends to the same incremental file, selecting again.
+	if err := m2.Start(); err != nil {
+		t.Fatal(err)
+	}
+	m2.Append("", "DEL", [][]byte{[]byte("k")})
+	m2.Stop()
+	cmds, err = newTestAOFManager(t, dir, store.NewStore()).Load()
+	if err != nil || len(cmds) != 4 || cmds[2].Name != "SELECT" {
+		t.Fatalf("commands after restart = %+v, %v", cmds, err)
+	}
+}
+
+func TestAOFRewriteKeepsWritesDuringRewrite(t *testing.T) {
+	dir := t.TempDir()
+	s := store.NewStore()
+	m := newTestAOFManager(t, dir, s)
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	for _, v := range []string{"1", "2", "3"} {
+		s.Set("counter", &store.StringValue{Data: []byte(v)}, store.SetOptions{})
+		m.Append("", "SET", [][]byte{[]byte("counter"), []byte(v)})
+	}
+
+	// A write made right after the snapshot is taken must reach the new
+	// incremental file and not the base.
+	m.SetWriteBarrier(func(fn func()) {
+		fn()
+		s.Set("during", &store.StringValue{Data: []byte("v")}, store.SetOptions{})
+		m.Append("", "SET", [][]byte{[]byte("during"), []byte("v")})
+	})
+	if err := m.BGREWRITEAOF(); err != nil {
+		t.Fatal(err)
+	}
+	m.wg.Wait()
+
+	info := m.Info()
+	if info.RewriteInProgress || !info.LastRewriteOK || info.Rewrites != 2 {
+		t.Fatalf("after rewrite: %+v", info)
+	}
+	entries, _ := os.ReadDir(m.Dir())
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if strings.Join(names, " ") != "appendonly.aof.2.base.rdb appendonly.aof.2.incr.aof appendonly.aof.manifest" {
+		t.Errorf("files after rewrite = %v", names)
+	}
+
+	loaded := store.NewStore()
+	cmds, err := newTestAOFManager(t, dir, loaded).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := loaded.Get("counter"); !ok || e.Value.String() != "3" {
+		t.Errorf("counter = %+v", e)
+	}
+	if _, ok := loaded.Get("during"); ok {
+		t.Error("base includes a write made after the snapshot")
+	}
+	if len(cmds) != 2 || cmds[0].Name != "SELECT" || string(cmds[1].Args[0]) != "during" {
+		t.Errorf("incremental commands = %+v", cmds)
+	}
+}
+
+func TestAOFRecordsNamespaceChanges(t *testing.T) {
+	dir := t.TempDir()
+	s := store.NewStore()
+	m := newTestAOFManager(t, dir, s)
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	m.Append("db1", "SET", [][]byte{[]byte("a"), []byte("1")})
+	m.Append("db1", "SET", [][]byte{[]byte("b"), []byte("1")})
+	// Writes buffered by a rewrite select their namespace again in the
+	// new incremental file.
+	m.SetWriteBarrier(func(fn func()) {
+		fn()
+		m.Append("tenant", "SET", [][]byte{[]byte("c"), []byte("1")})
+	})
+	if err := m.Rewrite(); err != nil {
+		t.Fatal(err)
+	}
+	m.Append("tenant", "SET", [][]byte{[]byte("d"), []byte("1")})
+	m.Append("", "SET", [][]byte{[]byte("e"), []byte("1")})
+	m.Flush()
+
+	cmds, err := newTestAOFManager(t, dir, store.NewStore()).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, c := range cmds {
+		got = append(got, c.Name+" "+string(c.Args[0]))
+	}
+	want := "NAMESPACE tenant,SET c,SET d,SELECT 0,SET e"
+	if strings.Join(got, ",") != want {
+		t.Errorf("commands = %v, want %s", got, want)
+	}
+}
+
+func TestAOFManagerConvertsSingleFileAOF(t *testing.T) {
+	dir := t.TempDir()
+	legacy := filepath.Join(dir, "appendonly.aof")
+	if err := os.WriteFile(legacy, buildRESPCommand("SET", "old", "v"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := store.NewStore()
+	m := newTestAOFManager(t, dir, s)
+	if m.Exists() {
+		t.Fatal("Exists = true before conversion")
+	}
+	cmds, err := m.Load()
+	if err != nil || len(cmds) != 1 {
+		t.Fatalf("Load = %+v, %v", cmds, err)
+	}
+	s.Set("old", &store.StringValue{Data: []byte("v")}, store.SetOptions{})
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	m.Stop()
+
+	if _, err := os.Stat(legacy); !os.IsNotExist(err) {
+		t.Errorf("single-file AOF still present: %v", err)
+	}
+	loaded := store.NewStore()
+	if _, err := newTestAOFManager(t, dir, loaded).Load(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := loaded.Get("old"); !ok {
+		t.Error("converted AOF lost the replayed key")
+	}
+}
+
+func TestAOFManagerRewriteThresholds(t *testing.T) {
+	m := NewAOFManager(AOFConfig{RewriteSize: 100, RewritePct: 100, MaxSize: 1000}, store.NewStore())
+	m.baseSize = 200
+
+	if m.ShouldRewrite(399) {
+		t.Error("rewrote before doubling")
+	}
+	if !m.ShouldRewrite(400) {
+		t.Error("did not rewrite after doubling")
+	}
+
+	m.SetRewriteRules(100, 0)
+	if m.ShouldRewrite(999) {
+		t.Error("percentage rule still active")
+	}
+	if !m.ShouldRewrite(1000) {
+		t.Error("did not rewrite at the maximum size")
+	}
+	m.baseSize = 1500
+	if m.ShouldRewrite(2000) {
+		t.Error("rewrote a dataset larger than the maximum size")
+	}
+}
+
+func TestReadAOFManifestRejectsBadEntries(t *testing.T) {
+	dir := t.TempDir()
+	for _, manifest := range []string{
+		"file ../escape seq 1 type b\n",
+		"file a seq 0 type b\n",
+		"file a seq 1 type x\n",
+		"file a seq 1 type b\nfile b seq 1 type b\n",
+		"file a seq 2 type i\nfile b seq 1 type i\n",
+		"",
+	} {
+		path := filepath.Join(dir, "appendonly.aof.manifest")
+		os.WriteFile(path, []byte(manifest), 0644)
+		if _, err := readAOFManifest(path); err == nil {
+			t.Errorf("accepted manifest %q", manifest)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package persistence
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// File name suffixes of the multi-part AOF, as in Redis 7: the directory
+// holds appendonly.aof.<seq>.base.rdb, appendonly.aof.<seq>.incr.aof and
+// the appendonly.aof.manifest listing them.
+const (
+	aofManifestSuffix = ".manifest"
+	aofBaseRDBSuffix  = ".base.rdb"
+	aofBaseAOFSuffix  = ".base.aof"
+	aofIncrSuffix     = ".incr.aof"
+	aofTempPrefix     = "temp-"
+)
+
+type aofFileType byte
+
+const (
+	aofFileBase    aofFileType = 'b'
+	aofFileHistory aofFileType = 'h'
+	aofFileIncr    aofFileType = 'i'
+)
+
+// aofFile is one file listed in the manifest.
+type aofFile struct {
+	name string
+	seq  int64
+	typ  aofFileType
+	// created is when a base snapshot was taken, in Unix seconds; zero for
+	// incremental files and manifests written before it was recorded.
+	created int64
+}
+
+// aofManifest lists the files of a multi-part AOF in replay order: the base
+// snapshot, then the incremental files. Files are never renamed once
+// written; a rewrite writes new ones and switches to them by replacing the
+// manifest, so a crash at any point leaves a complete AOF behind.
+type aofManifest struct {
+	base  *aofFile
+	incrs []aofFile
+}
+
+// readAOFManifest parses a manifest. Each line reads
+// "file <name> seq <n> type <b|h|i>", followed by "created <unix>" for a
+// base; history files are left over from an interrupted cleanup and are
+// ignored.
+func readAOFManifest(path string) (*aofManifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &aofManifest{}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		f, err := parseAOFManifestLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid AOF manifest %s line %d: %v", path, i+1, err)
+		}
+		switch f.typ {
+		case aofFileBase:
+			if m.base != nil {
+				return nil, fmt.Errorf("invalid AOF manifest %s: more than one base file", path)
+			}
+			m.base = &f
+		case aofFileIncr:
+			if n := len(m.incrs); n > 0 && f.seq <= m.incrs[n-1].seq {
+				return nil, fmt.Errorf("invalid AOF manifest %s: incremental files out of order", path)
+			}
+			m.incrs = append(m.incrs, f)
+		}
+	}
+	if m.base == nil && len(m.incrs) == 0 {
+		return nil, fmt.Errorf("invalid AOF manifest %s: no files listed", path)
+	}
+	return m, nil
+}
+
+func parseAOFManifestLine(line string) (aofFile, error) {
+	fields := strings.Fields(line)
+	if len(fields)%2 != 0 {
+		return aofFile{}, fmt.Errorf("expected key value pairs")
+	}
+
+	var f aofFile
+	for i := 0; i < len(fields); i += 2 {
+		value := fields[i+1]
+		switch fields[i] {
+		case "file":
+			// Names are generated by the server; anything that could point
+			// outside the AOF directory is refused.
+			if value != filepath.Base(value) || value == "." || value == ".." {
+				return aofFile{}, fmt.Errorf("invalid file name %q", value)
+			}
+			f.name = value
+		case "seq":
+			seq, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || seq < 1 {
+				return aofFile{}, fmt.Errorf("invalid seq %q", value)
+			}
+			f.seq = seq
+		case "type":
+			if len(value) != 1 {
+				return aofFile{}, fmt.Errorf("invalid type %q", value)
+			}
+			f.typ = aofFileType(value[0])
+		case "created":
+			created, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || created < 0 {
+				return aofFile{}, fmt.Errorf("invalid created %q", value)
+			}
+			f.created = created
+		}
+	}
+
+	if f.name == "" || f.seq == 0 {
+		return aofFile{}, fmt.Errorf("missing file name or seq")
+	}
+	switch f.typ {
+	case aofFileBase, aofFileHistory, aofFileIncr:
+	default:
+		return aofFile{}, fmt.Errorf("invalid type %q", string(f.typ))
+	}
+	return f, nil
+}
+
+func (m *aofManifest) String() string {
+	var sb strings.Builder
+	write := func(f aofFile) {
+		fmt.Fprintf(&sb, "file %s seq %d type %c", f.name, f.seq, f.typ)
+		if f.created > 0 {
+			fmt.Fprintf(&sb, " created %d", f.created)
+		}
+		sb.WriteByte('\n')
+	}
+	if m.base != nil {
+		write(*m.base)
+	}
+	for _, f := range m.incrs {
+		write(f)
+	}
+	return sb.String()
+}
+
+// files lists every file of the manifest, base first.
+func (m *aofManifest) files() []aofFile {
+	var files []aofFile
+	if m.base != nil {
+		files = append(files, *m.base)
+	}
+	return append(files, m.incrs...)
+}
+
+// nextSeqs returns the sequence numbers of the base and incremental files a
+// rewrite creates. A nil manifest starts both at 1.
+func (m *aofManifest) nextSeqs() (base, incr int64) {
+	if m == nil {
+		return 1, 1
+	}
+	base, incr = 1, 1
+	if m.base != nil {
+		base = m.base.seq + 1
+	}
+	if n := len(m.incrs); n > 0 {
+		incr = m.incrs[n-1].seq + 1
+	}
+	return base, incr
+}
+
+// writeAOFManifest replaces the manifest at path atomically: the contents
+// go to a temporary file that is synced and renamed over the old manifest,
+// and the directory is synced so the rename survives a crash.
+func writeAOFManifest(path string, m *aofManifest) error {
+	dir := filepath.Dir(path)
+	tempPath := filepath.Join(dir, aofTempPrefix+filepath.Base(path))
+
+	f, err := os.Create(tempPath)
+	if err != nil {
+		return fmt.Errorf("failed to create AOF manifest: %v", err)
+	}
+	if _, err := f.WriteString(m.String()); err != nil {
+		f.Close()
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to write AOF manifest: %v", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to sync AOF manifest: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to close AOF manifest: %v", err)
+	}
+	if err := os.Rename(tempPath, path); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to replace AOF manifest: %v", err)
+	}
+	syncDir(dir)
+	return nil
+}
+
+// syncDir flushes a directory entry change to disk where the platform
+// allows it.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	_ = d.Sync()
+	d.Close()
+}
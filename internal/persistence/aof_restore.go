@@ -0,0 +1,214 @@
+package persistence
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cachestorm/cachestorm/internal/logger"
+)
+
+var (
+	// ErrAOFRestored is returned by RestoreAOF when the AOF was already
+	// restored to the same instant, so that a restore left in the startup
+	// configuration does not also cut the writes made since.
+	ErrAOFRestored = errors.New("AOF already restored to this instant")
+	// ErrRestoreNeedsManifest is returned by RestoreAOF for a single-file
+	// AOF; a node converts it to the multi-part layout when it starts.
+	ErrRestoreNeedsManifest = errors.New("point-in-time restore needs a multi-part AOF")
+	// ErrNoAOFTimestamps is returned by RestoreAOF for an AOF written
+	// without timestamp annotations.
+	ErrNoAOFTimestamps = errors.New("AOF has no timestamps, enable persistence.aof_timestamp_enabled")
+)
+
+// AOFRestore describes what RestoreAOF did.
+type AOFRestore struct {
+	Until time.Time
+	// Backup is the directory holding the AOF as it was before the
+	// restore; moving it back undoes the restore.
+	Backup string
+	// File is the incremental file cut at Offset, empty when the AOF holds
+	// nothing after Until.
+	File   string
+	Offset int64
+	// Removed lists the incremental files after File, dropped whole.
+	Removed []string
+	// Dropped is the number of commands removed.
+	Dropped int
+}
+
+// restoreBackupPath is where RestoreAOF keeps the AOF directory dir as it
+// was before a restore to until.
+func restoreBackupPath(dir string, until time.Time) string {
+	return filepath.Clean(dir) + ".until-" + until.UTC().Format("20060102T150405Z")
+}
+
+// RestoreAOF cuts the multi-part AOF at path, its directory or manifest,
+// back to until: the commands written after it, as told by the timestamp
+// annotations, are removed, so that the next load replays the base and
+// the increments only up to that instant. Annotations are to the second,
+// and the commands of the second until falls in are kept. The AOF is first
+// linked or copied into a backup directory next to it, named after until;
+// RestoreAOF fails with ErrAOFRestored when that backup exists.
+func RestoreAOF(path string, until time.Time) (*AOFRestore, error) {
+	manifestPath, err := resolveAOFManifest(path)
+	if err != nil {
+		return nil, err
+	}
+	if manifestPath == "" {
+		return nil, ErrRestoreNeedsManifest
+	}
+	dir := filepath.Dir(manifestPath)
+	manifest, err := readAOFManifest(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+
+	restore := &AOFRestore{Until: until, Backup: restoreBackupPath(dir, until), Offset: -1}
+	if _, err := os.Stat(restore.Backup); err == nil {
+		return nil, ErrAOFRestored
+	}
+	tmpBackup := restore.Backup + ".tmp"
+	if _, err := os.Stat(tmpBackup); err == nil {
+		return nil, fmt.Errorf("an interrupted restore left %s behind; move it away to retry", tmpBackup)
+	}
+
+	// The base holds every write made before it was taken, so it cannot
+	// be cut back. The increments may carry no annotation to tell.
+	if base := manifest.base; base != nil && base.created > until.Unix() {
+		return nil, fmt.Errorf("the AOF only goes back to %s, rewrites discard older history", time.Unix(base.created, 0).UTC().Format(time.RFC3339))
+	}
+
+	// Find the first annotation after until. The increments that follow it
+	// are dropped whole.
+	cut := -1
+	var first time.Time
+	for i, f := range manifest.incrs {
+		filePath := filepath.Join(dir, f.name)
+		_, err := scanAOF(filePath, func(Command, int64) {
+			if cut >= 0 {
+				restore.Dropped++
+			}
+		}, func(ts time.Time, offset int64) {
+			if first.IsZero() {
+				first = ts
+			}
+			if cut < 0 && ts.Unix() > until.Unix() {
+				cut, restore.File, restore.Offset = i, f.name, offset
+			}
+		})
+		if err != nil {
+			return nil, fmt.Errorf("%v (cachestorm check-aof reports the damage)", err)
+		}
+	}
+	if first.IsZero() {
+		return nil, ErrNoAOFTimestamps
+	}
+	if cut == 0 && restore.Offset == 0 {
+		return nil, fmt.Errorf("the AOF only goes back to %s, rewrites discard older history", first.UTC().Format(time.RFC3339))
+	}
+
+	if err := linkAOFFiles(dir, tmpBackup, manifestPath, manifest, restore.File); err != nil {
+		os.RemoveAll(tmpBackup)
+		return nil, err
+	}
+	if cut >= 0 {
+		kept := &aofManifest{base: manifest.base, incrs: manifest.incrs[:cut+1]}
+		for _, f := range manifest.incrs[cut+1:] {
+			restore.Removed = append(restore.Removed, f.name)
+		}
+		if err := os.Truncate(filepath.Join(dir, restore.File), restore.Offset); err != nil {
+			return nil, fmt.Errorf("failed to truncate %s: %v", restore.File, err)
+		}
+		if err := writeAOFManifest(manifestPath, kept); err != nil {
+			return nil, err
+		}
+		for _, name := range restore.Removed {
+			os.Remove(filepath.Join(dir, name))
+		}
+	}
+	if err := os.Rename(tmpBackup, restore.Backup); err != nil {
+		return nil, fmt.Errorf("failed to finish the backup: %v", err)
+	}
+	syncDir(filepath.Dir(restore.Backup))
+
+	logger.Warn().
+		Time("until", until).
+		Str("file", restore.File).
+		Int64("offset", restore.Offset).
+		Int("dropped", restore.Dropped).
+		Str("backup", restore.Backup).
+		Msg("AOF restored to a point in time")
+	return restore, nil
+}
+
+// linkAOFFiles fills backup with the manifest at manifestPath and the files
+// it lists. Files are hard-linked, as they are only ever appended to,
+// except the one named copied, which is about to be truncated.
+func linkAOFFiles(dir, backup, manifestPath string, manifest *aofManifest, copied string) error {
+	if err := os.MkdirAll(backup, 0755); err != nil {
+		return fmt.Errorf("failed to create the backup directory: %v", err)
+	}
+	if err := copyFile(manifestPath, filepath.Join(backup, filepath.Base(manifestPath))); err != nil {
+		return err
+	}
+	for _, f := range manifest.files() {
+		src, dst := filepath.Join(dir, f.name), filepath.Join(backup, f.name)
+		if f.name != copied && os.Link(src, dst) == nil {
+			continue
+		}
+		if err := copyFile(src, dst); err != nil {
+			return err
+		}
+	}
+	syncDir(backup)
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to copy %s: %v", src, err)
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// resolveAOFManifest returns the manifest of the AOF at path, as accepted
+// by CheckAOF, or "" when path is a single-file AOF.
+func resolveAOFManifest(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if info.IsDir() {
+		manifests, err := filepath.Glob(filepath.Join(path, "*"+aofManifestSuffix))
+		if err != nil {
+			return "", err
+		}
+		if len(manifests) != 1 {
+			return "", fmt.Errorf("expected one manifest in %s, found %d", path, len(manifests))
+		}
+		return manifests[0], nil
+	}
+	if strings.HasSuffix(path, aofManifestSuffix) {
+		return path, nil
+	}
+	return "", nil
+}
@@ -0,0 +1,188 @@
+package persistence
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cachestorm/cachestorm/internal/store"
+)
+
+const aofSetC = "*3\r\n$3\r\nSET\r\n$1\r\nc\r\n$1\r\n3\r\n"
+
+func aofTS(sec int64) string {
+	return string(appendAOFTimestamp(nil, time.Unix(sec, 0)))
+}
+
+// writeTestMultiPartAOF writes a multi-part AOF with an empty base and one
+// incremental file per entry of incrs.
+func writeTestMultiPartAOF(t *testing.T, dataDir string, incrs ...string) string {
+	t.Helper()
+	dir := filepath.Join(dataDir, "appendonlydir")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	manifest := &aofManifest{base: &aofFile{name: "appendonly.aof.1.base.rdb", seq: 1, typ: aofFileBase}}
+	if err := NewRDBWriter(store.NewStore(), RDBConfig{}).Save(filepath.Join(dir, manifest.base.name)); err != nil {
+		t.Fatal(err)
+	}
+	for i, data := range incrs {
+		f := aofFile{name: "appendonly.aof." + string(rune('1'+i)) + ".incr.aof", seq: int64(i + 1), typ: aofFileIncr}
+		if err := os.WriteFile(filepath.Join(dir, f.name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		manifest.incrs = append(manifest.incrs, f)
+	}
+	if err := writeAOFManifest(filepath.Join(dir, "appendonly.aof.manifest"), manifest); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestRestoreAOFCutsAtInstant(t *testing.T) {
+	dataDir := t.TempDir()
+	first := aofTS(100) + aofSetA + aofTS(160) + aofSetB
+	dir := writeTestMultiPartAOF(t, dataDir, first+aofTS(220)+aofSetC, aofTS(300)+aofSetA)
+
+	restore, err := RestoreAOF(dir, time.Unix(219, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restore.File != "appendonly.aof.1.incr.aof" || restore.Offset != int64(len(first)) || restore.Dropped != 2 ||
+		len(restore.Removed) != 1 {
+		t.Fatalf("restore = %+v", restore)
+	}
+
+	m := newTestAOFManager(t, dataDir, store.NewStore())
+	cmds, err := m.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cmds) != 2 || string(cmds[1].Args[0]) != "b" {
+		t.Errorf("commands after restore = %+v", cmds)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "appendonly.aof.2.incr.aof")); !os.IsNotExist(err) {
+		t.Error("file after the instant not removed")
+	}
+
+	// The backup holds the AOF as it was
+	backup, err := os.ReadFile(filepath.Join(restore.Backup, "appendonly.aof.1.incr.aof"))
+	if err != nil || string(backup) != first+aofTS(220)+aofSetC {
+		t.Errorf("backup = %q, %v", backup, err)
+	}
+	if _, err := os.Stat(filepath.Join(restore.Backup, "appendonly.aof.2.incr.aof")); err != nil {
+		t.Errorf("removed file not kept in the backup: %v", err)
+	}
+
+	if _, err := RestoreAOF(dir, time.Unix(219, 0)); !errors.Is(err, ErrAOFRestored) {
+		t.Errorf("second restore err = %v, want ErrAOFRestored", err)
+	}
+}
+
+func TestRestoreAOFKeepsCommandsOfTheSecond(t *testing.T) {
+	dataDir := t.TempDir()
+	dir := writeTestMultiPartAOF(t, dataDir, aofTS(100)+aofSetA+aofTS(101)+aofSetB)
+
+	restore, err := RestoreAOF(dir, time.Unix(101, 500))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restore.File != "" || restore.Dropped != 0 {
+		t.Errorf("restore = %+v, want nothing cut", restore)
+	}
+	if _, err := os.Stat(restore.Backup); err != nil {
+		t.Errorf("no backup marking the restore: %v", err)
+	}
+}
+
+func TestRestoreAOFRefusals(t *testing.T) {
+	dir := writeTestMultiPartAOF(t, t.TempDir(), aofTS(100)+aofSetA)
+	if _, err := RestoreAOF(dir, time.Unix(50, 0)); err == nil || !strings.Contains(err.Error(), "only goes back to") {
+		t.Errorf("restore before the history err = %v", err)
+	}
+
+	// A rewrite with no writes since leaves an empty increment; only the
+	// manifest tells when the base was taken
+	dir = writeTestMultiPartAOF(t, t.TempDir(), "")
+	manifestPath := filepath.Join(dir, "appendonly.aof.manifest")
+	manifest, err := readAOFManifest(manifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest.base.created = 200
+	if err := writeAOFManifest(manifestPath, manifest); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RestoreAOF(dir, time.Unix(150, 0)); err == nil || !strings.Contains(err.Error(), "only goes back to") {
+		t.Errorf("restore before the base err = %v", err)
+	}
+	if m, err := readAOFManifest(manifestPath); err != nil || m.base.created != 200 {
+		t.Errorf("manifest base created = %+v, %v", m, err)
+	}
+
+	dir = writeTestMultiPartAOF(t, t.TempDir(), aofSetA)
+	if _, err := RestoreAOF(dir, time.Unix(50, 0)); !errors.Is(err, ErrNoAOFTimestamps) {
+		t.Errorf("restore without timestamps err = %v", err)
+	}
+
+	single := filepath.Join(t.TempDir(), "appendonly.aof")
+	if err := os.WriteFile(single, []byte(aofTS(100)+aofSetA), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RestoreAOF(single, time.Unix(50, 0)); !errors.Is(err, ErrRestoreNeedsManifest) {
+		t.Errorf("restore of a single file err = %v", err)
+	}
+}
+
+func TestAOFTimestampAnnotations(t *testing.T) {
+	dataDir := t.TempDir()
+	m := NewAOFManager(AOFConfig{Enabled: true, Filename: "appendonly.aof", DataDir: dataDir, SyncPolicy: AOFAlways, Timestamps: true}, store.NewStore())
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Append("", "SET", [][]byte{[]byte("a"), []byte("1")}); err != nil {
+		t.Fatal(err)
+	}
+	m.Stop()
+
+	incr := filepath.Join(m.Dir(), "appendonly.aof.1.incr.aof")
+	data, err := os.ReadFile(incr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), aofTimestampPrefix) {
+		t.Errorf("incremental file does not start with a timestamp: %q", data)
+	}
+	var stamps, cmds int
+	if _, err := scanAOF(incr, func(Command, int64) { cmds++ }, func(time.Time, int64) { stamps++ }); err != nil {
+		t.Fatal(err)
+	}
+	if stamps == 0 || cmds != 2 {
+		t.Errorf("%d timestamps and %d commands", stamps, cmds)
+	}
+}
+
+func TestRestoreAOFRefusesBeforeRewrite(t *testing.T) {
+	dataDir := t.TempDir()
+	m := NewAOFManager(AOFConfig{Enabled: true, Filename: "appendonly.aof", DataDir: dataDir, SyncPolicy: AOFAlways, Timestamps: true}, store.NewStore())
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	before := time.Now().Add(-time.Minute)
+	if err := m.Rewrite(); err != nil {
+		t.Fatal(err)
+	}
+	path := m.manifestPath()
+	m.Stop()
+
+	manifest, err := readAOFManifest(path)
+	if err != nil || manifest.base.created < before.Unix() {
+		t.Fatalf("manifest = %+v, %v", manifest, err)
+	}
+	if _, err := RestoreAOF(path, before); err == nil || !strings.Contains(err.Error(), "only goes back to") {
+		t.Errorf("restore before the rewrite err = %v", err)
+	}
+}
@@ -0,0 +1,600 @@
+package persistence
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cachestorm/cachestorm/internal/logger"
+	"github.com/cachestorm/cachestorm/internal/store"
+)
+
+var (
+	ErrBackupNotFound    = errors.New("backup not found")
+	ErrBackupExists      = errors.New("backup already exists")
+	ErrInvalidBackupName = errors.New("backup names are letters, digits, '.', '_' and '-', starting with a letter or digit")
+)
+
+const (
+	BackupFull        = "full"
+	BackupIncremental = "incremental"
+
+	backupManifestFile = "manifest.json"
+	backupDataFile     = "dump.rdb"
+	backupIndexFile    = "index"
+
+	// backupNameLayout names backups created without a name after the
+	// time they were taken.
+	backupNameLayout = "20060102T150405.000Z"
+)
+
+var backupNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,127}$`)
+
+// BackupConfig configures where backups are kept and for how long. With
+// neither Retention nor MaxAge set, backups are kept until deleted.
+type BackupConfig struct {
+	Dir string
+	// Retention keeps this many of the newest backups.
+	Retention int
+	// MaxAge removes backups older than this.
+	MaxAge time.Duration
+}
+
+// BackupManifest describes a backup. It is kept as JSON next to the
+// backup's files.
+type BackupManifest struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	// Parent is the backup an incremental backup was taken on top of.
+	Parent    string    `json:"parent,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	// Keys is the number of keys in the dataset the backup restores,
+	// ChangedKeys the number written to this backup's file and DeletedKeys
+	// the number of keys of the parent it removes.
+	Keys        int64 `json:"keys"`
+	ChangedKeys int64 `json:"changed_keys"`
+	DeletedKeys int64 `json:"deleted_keys"`
+	// Size is the size of the backup's files in bytes, and Checksum the
+	// SHA-256 of its RDB file.
+	Size          int64  `json:"size"`
+	Checksum      string `json:"checksum"`
+	IndexChecksum string `json:"index_checksum"`
+	RDBVersion    int    `json:"rdb_version"`
+}
+
+// backupIndex is what an incremental backup needs from its parent: a
+// fingerprint of every key, named by namespace and key, and the keys the
+// backup removes from its parent's dataset.
+type backupIndex struct {
+	Digests map[string]uint64
+	Deleted []string
+}
+
+func backupKeyID(db, key string) string {
+	return db + "\x00" + key
+}
+
+func splitBackupKeyID(id string) (db, key string) {
+	db, key, _ = strings.Cut(id, "\x00")
+	return db, key
+}
+
+// BackupManager writes named backups of the store in the RDB format, each
+// in a directory of its own under the backup directory, and restores them.
+// A full backup holds the whole dataset; an incremental one only the keys
+// changed since the newest backup at the time and the keys deleted since,
+// so restoring it replays its chain of parents first. Every backup holds
+// the registered states in full.
+type BackupManager struct {
+	store   *store.Store
+	config  BackupConfig
+	barrier func(func())
+	mu      sync.Mutex
+}
+
+func NewBackupManager(s *store.Store, cfg BackupConfig) *BackupManager {
+	return &BackupManager{store: s, config: cfg}
+}
+
+// SetWriteBarrier sets the function backups take their snapshot and
+// restores apply their data under; see PersistenceManager.SetWriteBarrier.
+func (bm *BackupManager) SetWriteBarrier(barrier func(func())) {
+	bm.barrier = barrier
+}
+
+// Dir is the directory holding the backups.
+func (bm *BackupManager) Dir() string {
+	return bm.config.Dir
+}
+
+func (bm *BackupManager) pauseWrites(fn func()) {
+	if bm.barrier == nil {
+		fn()
+		return
+	}
+	bm.barrier(fn)
+}
+
+func (bm *BackupManager) path(name, file string) string {
+	return filepath.Join(bm.config.Dir, name, file)
+}
+
+// Create writes a backup named name, or after the current time when name is
+// empty. An incremental backup is taken on top of the newest backup, and is
+// a full one when there is none. Retention is applied once it is written.
+func (bm *BackupManager) Create(name string, incremental bool) (*BackupManifest, error) {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+
+	now := time.Now()
+	if name == "" {
+		name = now.UTC().Format(backupNameLayout)
+	}
+	if !backupNameRe.MatchString(name) {
+		return nil, ErrInvalidBackupName
+	}
+	if _, err := os.Stat(filepath.Join(bm.config.Dir, name)); err == nil {
+		return nil, ErrBackupExists
+	}
+
+	manifest := &BackupManifest{Name: name, Type: BackupFull, CreatedAt: now, RDBVersion: int(RDBVersion11)}
+	var parent *backupIndex
+	if incremental {
+		backups, err := bm.list()
+		if err != nil {
+			return nil, err
+		}
+		if len(backups) > 0 {
+			newest := backups[len(backups)-1]
+			if parent, err = readBackupIndex(bm.path(newest.Name, backupIndexFile)); err != nil {
+				return nil, fmt.Errorf("failed to read backup %s: %v", newest.Name, err)
+			}
+			manifest.Type, manifest.Parent = BackupIncremental, newest.Name
+		}
+	}
+
+	tmp := filepath.Join(bm.config.Dir, "."+name+".tmp")
+	os.RemoveAll(tmp)
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create backup directory: %v", err)
+	}
+	if err := bm.write(tmp, manifest, parent); err != nil {
+		os.RemoveAll(tmp)
+		return nil, err
+	}
+	if err := os.Rename(tmp, filepath.Join(bm.config.Dir, name)); err != nil {
+		os.RemoveAll(tmp)
+		return nil, fmt.Errorf("failed to finish backup: %v", err)
+	}
+	syncDir(bm.config.Dir)
+
+	logger.Info().
+		Str("backup", name).
+		Str("type", manifest.Type).
+		Int64("keys", manifest.Keys).
+		Int64("changed", manifest.ChangedKeys).
+		Int64("size", manifest.Size).
+		Msg("Backup created")
+	bm.prune(now)
+	return manifest, nil
+}
+
+// write fills dir with the snapshot, the index and, last, the manifest.
+// Keys whose fingerprint matches the parent's are left out of the snapshot.
+func (bm *BackupManager) write(dir string, manifest *BackupManifest, parent *backupIndex) error {
+	var states []savedState
+	var err error
+	snap := bm.store.SnapshotWith(func(capture func()) {
+		bm.pauseWrites(func() {
+			capture()
+			states, err = captureStates()
+		})
+	})
+	if err != nil {
+		snap.Release()
+		return err
+	}
+
+	index := &backupIndex{Digests: make(map[string]uint64)}
+	w := NewRDBWriter(bm.store, RDBConfig{Version: RDBVersion11, Checksum: true})
+	w.sorted = true
+	w.filter = func(db, key string, encoded []byte) bool {
+		h := fnv.New64a()
+		h.Write(encoded)
+		id, digest := backupKeyID(db, key), h.Sum64()
+		index.Digests[id] = digest
+		if parent != nil {
+			if d, ok := parent.Digests[id]; ok && d == digest {
+				return false
+			}
+		}
+		manifest.ChangedKeys++
+		return true
+	}
+	err = w.saveSnapshot(filepath.Join(dir, backupDataFile), snap, states)
+	snap.Release()
+	if err != nil {
+		return err
+	}
+
+	if parent != nil {
+		for id := range parent.Digests {
+			if _, ok := index.Digests[id]; !ok {
+				index.Deleted = append(index.Deleted, id)
+			}
+		}
+		sort.Strings(index.Deleted)
+	}
+	manifest.Keys = int64(len(index.Digests))
+	manifest.DeletedKeys = int64(len(index.Deleted))
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(index); err != nil {
+		return err
+	}
+	if err := writeFileSync(filepath.Join(dir, backupIndexFile), buf.Bytes()); err != nil {
+		return err
+	}
+
+	for _, f := range []struct {
+		name     string
+		checksum *string
+	}{{backupDataFile, &manifest.Checksum}, {backupIndexFile, &manifest.IndexChecksum}} {
+		sum, size, err := fileChecksum(filepath.Join(dir, f.name))
+		if err != nil {
+			return err
+		}
+		*f.checksum = sum
+		manifest.Size += size
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileSync(filepath.Join(dir, backupManifestFile), data); err != nil {
+		return err
+	}
+	syncDir(dir)
+	return nil
+}
+
+// List returns the backups from oldest to newest.
+func (bm *BackupManager) List() ([]*BackupManifest, error) {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+	return bm.list()
+}
+
+func (bm *BackupManager) list() ([]*BackupManifest, error) {
+	entries, err := os.ReadDir(bm.config.Dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var backups []*BackupManifest
+	for _, e := range entries {
+		if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		m, err := readBackupManifest(bm.path(e.Name(), backupManifestFile))
+		if err != nil {
+			if !os.IsNotExist(err) {
+				logger.Warn().Err(err).Str("backup", e.Name()).Msg("Unreadable backup manifest, skipped")
+			}
+			continue
+		}
+		backups = append(backups, m)
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		if !backups[i].CreatedAt.Equal(backups[j].CreatedAt) {
+			return backups[i].CreatedAt.Before(backups[j].CreatedAt)
+		}
+		return backups[i].Name < backups[j].Name
+	})
+	return backups, nil
+}
+
+// Get returns the manifest of the named backup.
+func (bm *BackupManager) Get(name string) (*BackupManifest, error) {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+	return bm.get(name)
+}
+
+func (bm *BackupManager) get(name string) (*BackupManifest, error) {
+	if !backupNameRe.MatchString(name) {
+		return nil, ErrBackupNotFound
+	}
+	m, err := readBackupManifest(bm.path(name, backupManifestFile))
+	if os.IsNotExist(err) {
+		return nil, ErrBackupNotFound
+	}
+	return m, err
+}
+
+// chain returns the backups restoring name needs, its full backup first.
+func (bm *BackupManager) chain(name string) ([]*BackupManifest, error) {
+	var chain []*BackupManifest
+	seen := make(map[string]bool)
+	for name != "" {
+		if seen[name] {
+			return nil, fmt.Errorf("backup %s is its own ancestor", name)
+		}
+		seen[name] = true
+		m, err := bm.get(name)
+		if err != nil {
+			if errors.Is(err, ErrBackupNotFound) && len(chain) > 0 {
+				return nil, fmt.Errorf("backup %s needs %s, which is missing", chain[0].Name, name)
+			}
+			return nil, err
+		}
+		chain = append([]*BackupManifest{m}, chain...)
+		name = m.Parent
+	}
+	return chain, nil
+}
+
+// Verify checks the named backup and the backups it is taken on top of:
+// their files must match the checksums of their manifests and their
+// snapshots must decode.
+func (bm *BackupManager) Verify(name string) error {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+	_, _, err := bm.load(name)
+	return err
+}
+
+// load verifies the chain of name and replays it into a scratch store,
+// returning it with the states of the newest backup.
+func (bm *BackupManager) load(name string) (*store.Store, []savedState, error) {
+	chain, err := bm.chain(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, m := range chain {
+		if err := bm.verifyFiles(m); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	scratch := store.NewStoreWithNamespaces()
+	r := NewRDBReader(scratch)
+	r.keepStates = true
+	for i, m := range chain {
+		load := r.LoadMerge
+		if i == 0 {
+			load = r.Load
+		}
+		if err := load(bm.path(m.Name, backupDataFile)); err != nil {
+			return nil, nil, fmt.Errorf("backup %s: %v", m.Name, err)
+		}
+		index, err := readBackupIndex(bm.path(m.Name, backupIndexFile))
+		if err != nil {
+			return nil, nil, fmt.Errorf("backup %s: %v", m.Name, err)
+		}
+		for _, id := range index.Deleted {
+			db, key := splitBackupKeyID(id)
+			scratch.ForNamespace(db).Delete(key)
+		}
+	}
+	return scratch, r.states, nil
+}
+
+func (bm *BackupManager) verifyFiles(m *BackupManifest) error {
+	for _, f := range []struct{ name, checksum string }{
+		{backupDataFile, m.Checksum}, {backupIndexFile, m.IndexChecksum},
+	} {
+		sum, _, err := fileChecksum(bm.path(m.Name, f.name))
+		if err != nil {
+			return fmt.Errorf("backup %s: %v", m.Name, err)
+		}
+		if sum != f.checksum {
+			return fmt.Errorf("backup %s: %s does not match its checksum", m.Name, f.name)
+		}
+	}
+	return nil
+}
+
+// Restore loads the named backup into the store and returns the number of
+// keys restored. Replacing empties every namespace first, and the states
+// the backup lacks; merging keeps the keys the backup does not have, its
+// keys replacing existing ones of the same name. The backup is verified and
+// decoded before the store is touched.
+func (bm *BackupManager) Restore(name string, merge bool) (int64, error) {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+
+	scratch, states, err := bm.load(name)
+	if err != nil {
+		return 0, err
+	}
+
+	var restored int64
+	bm.pauseWrites(func() {
+		if !merge {
+			if nm := bm.store.GetNamespaceManager(); nm != nil {
+				nm.FlushAll()
+			} else {
+				bm.store.Flush()
+			}
+		}
+		if restored, err = copyStore(scratch, bm.store); err == nil {
+			err = restoreStates(states, !merge)
+		}
+	})
+	if err != nil {
+		return restored, err
+	}
+	logger.Info().Str("backup", name).Bool("merge", merge).Int64("keys", restored).Msg("Backup restored")
+	return restored, nil
+}
+
+// copyStore sets every key of src in the namespace of the same name in dst.
+func copyStore(src, dst *store.Store) (int64, error) {
+	snap := src.Snapshot()
+	defer snap.Release()
+	var n int64
+	for _, db := range snap.Databases() {
+		target := dst.ForNamespace(db.Name)
+		err := db.Range(func(key string, e *store.Entry) error {
+			if e.Value == nil || e.IsExpired() {
+				return nil
+			}
+			opts := store.SetOptions{Tags: e.Tags}
+			if e.ExpiresAt > 0 {
+				if opts.TTL = time.Until(time.Unix(0, e.ExpiresAt)); opts.TTL <= 0 {
+					return nil
+				}
+			}
+			if err := target.Set(key, e.Value, opts); err != nil {
+				return fmt.Errorf("failed to restore key %q: %v", key, err)
+			}
+			n++
+			return nil
+		})
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Delete removes the named backup, reporting whether it existed. A backup
+// other backups are taken on top of cannot be deleted before them.
+func (bm *BackupManager) Delete(name string) (bool, error) {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+
+	if _, err := bm.get(name); err != nil {
+		if errors.Is(err, ErrBackupNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	backups, err := bm.list()
+	if err != nil {
+		return false, err
+	}
+	for _, b := range backups {
+		if b.Parent == name {
+			return false, fmt.Errorf("backup %s is needed by %s, delete that first", name, b.Name)
+		}
+	}
+	if err := os.RemoveAll(filepath.Join(bm.config.Dir, name)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// prune removes the backups past the retention limits, except those a
+// kept backup is taken on top of.
+func (bm *BackupManager) prune(now time.Time) {
+	if bm.config.Retention <= 0 && bm.config.MaxAge <= 0 {
+		return
+	}
+	backups, err := bm.list()
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to list backups for retention")
+		return
+	}
+	byName := make(map[string]*BackupManifest, len(backups))
+	keep := make(map[string]bool, len(backups))
+	for i, b := range backups {
+		byName[b.Name] = b
+		recent := bm.config.Retention <= 0 || i >= len(backups)-bm.config.Retention
+		young := bm.config.MaxAge <= 0 || now.Sub(b.CreatedAt) <= bm.config.MaxAge
+		if recent && young {
+			keep[b.Name] = true
+		}
+	}
+	for _, b := range backups {
+		if !keep[b.Name] {
+			continue
+		}
+		for p := byName[b.Parent]; p != nil && !keep[p.Name]; p = byName[p.Parent] {
+			keep[p.Name] = true
+		}
+	}
+	for _, b := range backups {
+		if keep[b.Name] {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(bm.config.Dir, b.Name)); err != nil {
+			logger.Error().Err(err).Str("backup", b.Name).Msg("Failed to remove expired backup")
+			continue
+		}
+		logger.Info().Str("backup", b.Name).Msg("Backup removed by retention")
+	}
+}
+
+func readBackupManifest(path string) (*BackupManifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m := &BackupManifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("invalid backup manifest %s: %v", path, err)
+	}
+	return m, nil
+}
+
+func readBackupIndex(path string) (*backupIndex, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	index := &backupIndex{}
+	if err := gob.NewDecoder(f).Decode(index); err != nil {
+		return nil, fmt.Errorf("invalid backup index: %v", err)
+	}
+	return index, nil
+}
+
+// fileChecksum returns the hex SHA-256 and the size of a file.
+func fileChecksum(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+func writeFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
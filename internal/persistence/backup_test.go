@@ -0,0 +1,225 @@
+package persistence
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cachestorm/cachestorm/internal/store"
+)
+
+func newTestBackupManager(t *testing.T, s *store.Store, cfg BackupConfig) *BackupManager {
+	t.Helper()
+	if cfg.Dir == "" {
+		cfg.Dir = filepath.Join(t.TempDir(), "backups")
+	}
+	return NewBackupManager(s, cfg)
+}
+
+func TestBackupRestoreReplace(t *testing.T) {
+	s := store.NewStoreWithNamespaces()
+	s.Set("str", &store.StringValue{Data: []byte("v")}, store.SetOptions{Tags: []string{"t"}})
+	s.Set("ttl", &store.StringValue{Data: []byte("v")}, store.SetOptions{TTL: time.Hour})
+	s.Set("hash", &store.HashValue{Fields: map[string][]byte{"f": []byte("1")}}, store.SetOptions{})
+	s.ForNamespace("db1").Set("other", &store.StringValue{Data: []byte("v")}, store.SetOptions{})
+
+	bm := newTestBackupManager(t, s, BackupConfig{})
+	m, err := bm.Create("nightly", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Type != BackupFull || m.Keys != 4 || m.ChangedKeys != 4 || m.Size == 0 || len(m.Checksum) != 64 {
+		t.Errorf("manifest = %+v", m)
+	}
+	if _, err := bm.Create("nightly", false); !errors.Is(err, ErrBackupExists) {
+		t.Errorf("second backup under the same name err = %v", err)
+	}
+
+	s.Set("later", &store.StringValue{Data: []byte("v")}, store.SetOptions{})
+	s.Delete("str")
+	n, err := bm.Restore("nightly", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 4 {
+		t.Errorf("restored %d keys, want 4", n)
+	}
+	if _, ok := s.Get("later"); ok {
+		t.Error("key written after the backup survived a replacing restore")
+	}
+	if e, ok := s.Get("str"); !ok || len(e.Tags) != 1 {
+		t.Errorf("str = %+v, want it back with its tag", e)
+	}
+	if ttl := s.TTL("ttl"); ttl <= 0 || ttl > time.Hour {
+		t.Errorf("ttl = %v, want the expiry kept", ttl)
+	}
+	if e, ok := s.Get("hash"); !ok || e.Value.Type() != store.DataTypeHash {
+		t.Errorf("hash = %+v", e)
+	}
+	if _, ok := s.ForNamespace("db1").Get("other"); !ok {
+		t.Error("namespaced key not restored")
+	}
+}
+
+func TestBackupRestoreMerge(t *testing.T) {
+	s := store.NewStore()
+	s.Set("a", &store.StringValue{Data: []byte("old")}, store.SetOptions{})
+	bm := newTestBackupManager(t, s, BackupConfig{})
+	if _, err := bm.Create("b1", false); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Set("a", &store.StringValue{Data: []byte("new")}, store.SetOptions{})
+	s.Set("b", &store.StringValue{Data: []byte("v")}, store.SetOptions{})
+	if _, err := bm.Restore("b1", true); err != nil {
+		t.Fatal(err)
+	}
+	if e, _ := s.Get("a"); e == nil || e.Value.String() != "old" {
+		t.Errorf("a = %+v, want the backup's value", e)
+	}
+	if _, ok := s.Get("b"); !ok {
+		t.Error("merging restore dropped a key the backup lacks")
+	}
+}
+
+func TestIncrementalBackup(t *testing.T) {
+	s := store.NewStore()
+	for _, k := range []string{"a", "b", "c"} {
+		s.Set(k, &store.StringValue{Data: []byte(k)}, store.SetOptions{})
+	}
+	s.Set("set", &store.SetValue{Members: map[string]struct{}{"x": {}, "y": {}, "z": {}}}, store.SetOptions{})
+	bm := newTestBackupManager(t, s, BackupConfig{})
+	if _, err := bm.Create("full", true); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Set("b", &store.StringValue{Data: []byte("changed")}, store.SetOptions{})
+	s.Delete("c")
+	s.Set("d", &store.StringValue{Data: []byte("d")}, store.SetOptions{})
+	incr, err := bm.Create("incr", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if incr.Type != BackupIncremental || incr.Parent != "full" {
+		t.Fatalf("manifest = %+v", incr)
+	}
+	if incr.Keys != 4 || incr.ChangedKeys != 2 || incr.DeletedKeys != 1 {
+		t.Errorf("keys = %d, changed = %d, deleted = %d, want 4, 2, 1", incr.Keys, incr.ChangedKeys, incr.DeletedKeys)
+	}
+
+	s.Flush()
+	if _, err := bm.Restore("incr", false); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"a": "a", "b": "changed", "d": "d"}
+	for k, v := range want {
+		if e, ok := s.Get(k); !ok || e.Value.String() != v {
+			t.Errorf("%s = %+v, want %q", k, e, v)
+		}
+	}
+	if _, ok := s.Get("c"); ok {
+		t.Error("key deleted before the incremental backup restored")
+	}
+	if _, ok := s.Get("set"); !ok {
+		t.Error("unchanged key of the parent not restored")
+	}
+
+	if _, err := bm.Delete("full"); err == nil {
+		t.Error("deleted the parent of an incremental backup")
+	}
+	if ok, err := bm.Delete("incr"); !ok || err != nil {
+		t.Errorf("Delete = %v, %v", ok, err)
+	}
+	if ok, err := bm.Delete("incr"); ok || err != nil {
+		t.Errorf("second Delete = %v, %v", ok, err)
+	}
+}
+
+func TestBackupVerifyDetectsCorruption(t *testing.T) {
+	s := store.NewStore()
+	s.Set("a", &store.StringValue{Data: []byte("v")}, store.SetOptions{})
+	bm := newTestBackupManager(t, s, BackupConfig{})
+	if _, err := bm.Create("b1", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := bm.Verify("b1"); err != nil {
+		t.Fatalf("Verify of an intact backup: %v", err)
+	}
+	if err := bm.Verify("missing"); !errors.Is(err, ErrBackupNotFound) {
+		t.Errorf("Verify of a missing backup err = %v", err)
+	}
+
+	path := filepath.Join(bm.Dir(), "b1", backupDataFile)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)/2] ^= 0xFF
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := bm.Verify("b1"); err == nil {
+		t.Error("Verify accepted a damaged backup")
+	}
+	if _, err := bm.Restore("b1", false); err == nil {
+		t.Error("restored a damaged backup")
+	}
+	if _, ok := s.Get("a"); !ok {
+		t.Error("failed restore touched the store")
+	}
+}
+
+func TestBackupRetention(t *testing.T) {
+	s := store.NewStore()
+	s.Set("a", &store.StringValue{Data: []byte("v")}, store.SetOptions{})
+	bm := newTestBackupManager(t, s, BackupConfig{Retention: 2})
+
+	for _, step := range []struct {
+		name        string
+		incremental bool
+	}{{"full1", false}, {"incr1", true}, {"incr2", true}, {"full2", false}, {"full3", false}} {
+		if _, err := bm.Create(step.name, step.incremental); err != nil {
+			t.Fatal(err)
+		}
+	}
+	backups, err := bm.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, b := range backups {
+		names = append(names, b.Name)
+	}
+	if len(names) != 2 || names[0] != "full2" || names[1] != "full3" {
+		t.Errorf("backups after retention = %v, want [full2 full3]", names)
+	}
+
+	bm = newTestBackupManager(t, s, BackupConfig{Retention: 1})
+	if _, err := bm.Create("full", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bm.Create("incr", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bm.Get("full"); err != nil {
+		t.Errorf("retention removed the parent of a kept backup: %v", err)
+	}
+}
+
+func TestBackupNames(t *testing.T) {
+	bm := newTestBackupManager(t, store.NewStore(), BackupConfig{})
+	for _, name := range []string{"../escape", ".hidden", "a/b"} {
+		if _, err := bm.Create(name, false); !errors.Is(err, ErrInvalidBackupName) {
+			t.Errorf("Create(%q) err = %v", name, err)
+		}
+	}
+	m, err := bm.Create("", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := time.Parse(backupNameLayout, m.Name); err != nil {
+		t.Errorf("default name %q is not a time: %v", m.Name, err)
+	}
+}
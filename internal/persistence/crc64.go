@@ -0,0 +1,40 @@
+package persistence
+
+import (
+	"hash/crc64"
+	"io"
+)
+
+// RDB files end with a CRC-64/Jones checksum of everything before it, the
+// variant Redis uses: reflected polynomial 0xad93d23594c935a9, zero initial
+// value and no final xor. hash/crc64 inverts the register on entry and exit,
+// so crc64Update undoes both inversions.
+var crc64Table = crc64.MakeTable(0x95ac9329ac4bc9b5)
+
+func crc64Update(crc uint64, p []byte) uint64 {
+	return ^crc64.Update(^crc, crc64Table, p)
+}
+
+// crcWriter checksums everything written through it.
+type crcWriter struct {
+	w   io.Writer
+	crc uint64
+}
+
+func (c *crcWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.crc = crc64Update(c.crc, p[:n])
+	return n, err
+}
+
+// crcReader checksums everything read through it.
+type crcReader struct {
+	r   io.Reader
+	crc uint64
+}
+
+func (c *crcReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.crc = crc64Update(c.crc, p[:n])
+	return n, err
+}
@@ -0,0 +1,123 @@
+package persistence
+
+import "errors"
+
+// LZF is the compression Redis applies to large strings in RDB files. The
+// stream is a sequence of literal runs (a control byte below 32 followed by
+// that many plus one bytes) and back references (3 bits of length and 13 bits
+// of offset, with an extra length byte when the length field is 7).
+
+const (
+	lzfHashLog = 14
+	lzfMaxLit  = 1 << 5
+	lzfMaxOff  = 1 << 13
+	lzfMaxRef  = (1 << 8) + (1 << 3)
+)
+
+var errLZFCorrupt = errors.New("corrupt LZF data")
+
+// lzfCompress returns the compressed form of in, or nil when it would not
+// save at least four bytes.
+func lzfCompress(in []byte) []byte {
+	if len(in) <= 4 {
+		return nil
+	}
+	maxOut := len(in) - 4
+	out := make([]byte, 0, maxOut)
+	// Small inputs get a smaller table so snapshots of many short strings do
+	// not pay for clearing the full one each time.
+	hashLog := uint32(lzfHashLog)
+	for hashLog > 8 && 1<<(hashLog-2) > len(in) {
+		hashLog--
+	}
+	htab := make([]int32, 1<<hashLog)
+
+	lit := 0
+	flush := func(end int) {
+		for lit < end {
+			n := end - lit
+			if n > lzfMaxLit {
+				n = lzfMaxLit
+			}
+			out = append(out, byte(n-1))
+			out = append(out, in[lit:lit+n]...)
+			lit += n
+		}
+	}
+
+	ip := 0
+	for ip+2 < len(in) && len(out) <= maxOut {
+		h := (uint32(in[ip])<<16 | uint32(in[ip+1])<<8 | uint32(in[ip+2])) * 2654435761 >> (32 - hashLog)
+		ref := int(htab[h]) - 1
+		htab[h] = int32(ip + 1)
+
+		off := ip - ref - 1
+		if ref < 0 || off >= lzfMaxOff || in[ref] != in[ip] || in[ref+1] != in[ip+1] || in[ref+2] != in[ip+2] {
+			ip++
+			continue
+		}
+
+		n := 3
+		for n < lzfMaxRef && ip+n < len(in) && in[ref+n] == in[ip+n] {
+			n++
+		}
+		flush(ip)
+		if l := n - 2; l < 7 {
+			out = append(out, byte(l<<5|off>>8), byte(off))
+		} else {
+			out = append(out, byte(7<<5|off>>8), byte(l-7), byte(off))
+		}
+		ip += n
+		lit = ip
+	}
+	flush(len(in))
+
+	if len(out) > maxOut {
+		return nil
+	}
+	return out
+}
+
+// lzfDecompress expands in, which must decode to exactly outLen bytes.
+func lzfDecompress(in []byte, outLen int) ([]byte, error) {
+	out := make([]byte, 0, outLen)
+	for ip := 0; ip < len(in); {
+		ctrl := int(in[ip])
+		ip++
+
+		if ctrl < lzfMaxLit {
+			n := ctrl + 1
+			if ip+n > len(in) || len(out)+n > outLen {
+				return nil, errLZFCorrupt
+			}
+			out = append(out, in[ip:ip+n]...)
+			ip += n
+			continue
+		}
+
+		l := ctrl >> 5
+		if l == 7 {
+			if ip >= len(in) {
+				return nil, errLZFCorrupt
+			}
+			l += int(in[ip])
+			ip++
+		}
+		if ip >= len(in) {
+			return nil, errLZFCorrupt
+		}
+		ref := len(out) - (ctrl&0x1f)<<8 - int(in[ip]) - 1
+		ip++
+		l += 2
+		if ref < 0 || len(out)+l > outLen {
+			return nil, errLZFCorrupt
+		}
+		for i := 0; i < l; i++ {
+			out = append(out, out[ref+i])
+		}
+	}
+	if len(out) != outLen {
+		return nil, errLZFCorrupt
+	}
+	return out, nil
+}
@@ -0,0 +1,447 @@
+package persistence
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cachestorm/cachestorm/internal/logger"
+	"github.com/cachestorm/cachestorm/internal/store"
+)
+
+var (
+	ErrSaveInProgress = errors.New("background save already in progress")
+	ErrNoRDBFilename  = errors.New("no RDB filename configured")
+)
+
+const (
+	// saveRetryDelay is how long automatic saves wait after a failed one,
+	// so a full disk does not turn into a save loop.
+	saveRetryDelay = 5 * time.Second
+)
+
+// SaveRule triggers a background save once Changes keys have been modified
+// and After has passed since the last save, like Redis' save directive.
+type SaveRule struct {
+	After   time.Duration
+	Changes int64
+}
+
+// ParseSaveRules parses the Redis save syntax: pairs of seconds and
+// changes, such as "3600 1 300 100 60 10000". An empty string means no
+// rules.
+func ParseSaveRules(s string) ([]SaveRule, error) {
+	fields := strings.Fields(s)
+	if len(fields)%2 != 0 {
+		return nil, fmt.Errorf("save rules need pairs of seconds and changes: %q", s)
+	}
+	rules := make([]SaveRule, 0, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err := strconv.ParseInt(fields[i], 10, 64)
+		if err != nil || seconds < 1 {
+			return nil, fmt.Errorf("invalid save seconds %q", fields[i])
+		}
+		changes, err := strconv.ParseInt(fields[i+1], 10, 64)
+		if err != nil || changes < 1 {
+			return nil, fmt.Errorf("invalid save changes %q", fields[i+1])
+		}
+		rules = append(rules, SaveRule{After: time.Duration(seconds) * time.Second, Changes: changes})
+	}
+	return rules, nil
+}
+
+// FormatSaveRules is the inverse of ParseSaveRules.
+func FormatSaveRules(rules []SaveRule) string {
+	parts := make([]string, 0, len(rules)*2)
+	for _, rule := range rules {
+		parts = append(parts,
+			strconv.FormatInt(int64(rule.After/time.Second), 10),
+			strconv.FormatInt(rule.Changes, 10))
+	}
+	return strings.Join(parts, " ")
+}
+
+type Config struct {
+	DataDir     string
+	RDBEnabled  bool
+	RDBFilename string
+	// RDBInterval saves whenever anything changed in the interval, on top
+	// of SaveRules. With neither set nothing is saved automatically.
+	RDBInterval    time.Duration
+	SaveRules      []SaveRule
+	AOFRewriteSize int64
+}
+
+// PersistenceInfo describes the snapshot state for INFO persistence.
+type PersistenceInfo struct {
+	Dirty            int64
+	LastSave         time.Time
+	BgsaveInProgress bool
+	// BgsaveStarted is when the save in progress began.
+	BgsaveStarted time.Time
+	LastBgsaveOK  bool
+	// LastBgsaveDuration is negative until a background save has run.
+	LastBgsaveDuration time.Duration
+}
+
+// PersistenceManager saves the store to the RDB file on demand and when a
+// save rule fires. Writes are counted through the store, so the number of
+// changes since the last save needs no help from command handlers.
+type PersistenceManager struct {
+	store     *store.Store
+	config    Config
+	rdbWriter *RDBWriter
+	rdbReader *RDBReader
+	barrier   func(func())
+
+	mu                 sync.Mutex
+	created            time.Time
+	lastSave           time.Time
+	lastAttempt        time.Time
+	lastSaveOK         bool
+	lastBgsaveDuration time.Duration
+	saving             bool
+	bgsaveStarted      time.Time
+	dirty              int64 // changes marked by hand
+	baseline           int64 // store changes covered by the last save
+
+	stopCh   chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+func NewPersistenceManager(s *store.Store, cfg Config) *PersistenceManager {
+	pm := &PersistenceManager{
+		store:              s,
+		config:             cfg,
+		created:            time.Now(),
+		lastSaveOK:         true,
+		lastBgsaveDuration: -1,
+		baseline:           s.Changes(),
+		stopCh:             make(chan struct{}),
+	}
+
+	pm.rdbWriter = NewRDBWriter(s, RDBConfig{
+		Version:     RDBVersion11,
+		Compression: false,
+		Checksum:    true,
+	})
+	pm.rdbReader = NewRDBReader(s)
+
+	return pm
+}
+
+// Start loads the RDB file, logging rather than returning a failure, and
+// starts automatic saves. Servers that must not start on a bad file call
+// Load and StartAutoSave instead.
+func (pm *PersistenceManager) Start() error {
+	if err := pm.Load(); err != nil {
+		logger.Error().Err(err).Msg("Failed to load RDB file")
+	}
+	pm.StartAutoSave()
+	return nil
+}
+
+// Path is the RDB file, or "" when no filename is configured.
+func (pm *PersistenceManager) Path() string {
+	if pm.config.RDBFilename == "" {
+		return ""
+	}
+	return filepath.Join(pm.config.DataDir, pm.config.RDBFilename)
+}
+
+// SetWriteBarrier sets the function a save takes its snapshot under, so that
+// the keyspace and the registered states are captured between the same two
+// write commands. Without one they are captured directly.
+func (pm *PersistenceManager) SetWriteBarrier(barrier func(func())) {
+	pm.barrier = barrier
+}
+
+// Load replaces the store's data with the RDB file if there is one. The
+// loaded data counts as saved.
+func (pm *PersistenceManager) Load() error {
+	if err := pm.load(pm.rdbReader.Load); err != nil {
+		return err
+	}
+	pm.ResetDirty()
+	return nil
+}
+
+// LoadMerge loads the RDB file on top of the store's data. Keys the file
+// did not have stay unsaved.
+func (pm *PersistenceManager) LoadMerge() error {
+	return pm.load(pm.rdbReader.LoadMerge)
+}
+
+func (pm *PersistenceManager) load(load func(string) error) error {
+	path := pm.Path()
+	if path == "" {
+		return nil
+	}
+	if _, err := os.Stat(path); err != nil {
+		return nil
+	}
+	if err := load(path); err != nil {
+		return fmt.Errorf("failed to load RDB %s: %w", path, err)
+	}
+	logger.Info().Str("path", path).Int64("keys", pm.store.KeyCount()).Msg("RDB data restored")
+	return nil
+}
+
+// ResetDirty marks the store's current contents as saved. The server calls
+// it once the AOF has been replayed, since those writes are already on
+// disk.
+func (pm *PersistenceManager) ResetDirty() {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pm.dirty = 0
+	pm.baseline = pm.store.Changes()
+}
+
+// StartAutoSave starts checking the save rules in the background, so rules
+// set later with SetSaveRules apply too. It does nothing unless RDB saving
+// is enabled.
+func (pm *PersistenceManager) StartAutoSave() {
+	if !pm.config.RDBEnabled {
+		return
+	}
+	pm.wg.Add(1)
+	go pm.autoSaveLoop()
+}
+
+// Stop ends automatic saves, waits for a background save in progress and
+// saves one last time if anything changed since.
+func (pm *PersistenceManager) Stop() {
+	pm.stopOnce.Do(func() { close(pm.stopCh) })
+	pm.wg.Wait()
+
+	if pm.Dirty() > 0 && pm.Path() != "" {
+		if err := pm.SAVE(); err != nil {
+			logger.Error().Err(err).Msg("Failed to save RDB file on shutdown")
+		}
+	}
+}
+
+// SaveRules returns the rules automatic saves follow, including the one
+// implied by RDBInterval.
+func (pm *PersistenceManager) SaveRules() []SaveRule {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	return pm.rules()
+}
+
+// SetSaveRules replaces the save rules, as CONFIG SET save does.
+func (pm *PersistenceManager) SetSaveRules(rules []SaveRule) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pm.config.SaveRules = rules
+	pm.config.RDBInterval = 0
+}
+
+func (pm *PersistenceManager) rules() []SaveRule {
+	rules := append([]SaveRule(nil), pm.config.SaveRules...)
+	if pm.config.RDBInterval > 0 {
+		rules = append(rules, SaveRule{After: pm.config.RDBInterval, Changes: 1})
+	}
+	return rules
+}
+
+func (pm *PersistenceManager) autoSaveLoop() {
+	defer pm.wg.Done()
+
+	pm.mu.Lock()
+	check := time.Second
+	for _, rule := range pm.rules() {
+		check = min(check, rule.After)
+	}
+	pm.mu.Unlock()
+
+	ticker := time.NewTicker(check)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-pm.stopCh:
+			return
+		case now := <-ticker.C:
+			if pm.shouldSave(now) {
+				if err := pm.BGSAVE(); err != nil && err != ErrSaveInProgress {
+					logger.Error().Err(err).Msg("Failed to start background save")
+				}
+			}
+		}
+	}
+}
+
+// shouldSave reports whether a save rule fired. After a failed save the
+// rules wait saveRetryDelay before trying again.
+func (pm *PersistenceManager) shouldSave(now time.Time) bool {
+	dirty := pm.Dirty()
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if pm.saving || dirty == 0 || pm.Path() == "" {
+		return false
+	}
+	if !pm.lastSaveOK && now.Sub(pm.lastAttempt) < saveRetryDelay {
+		return false
+	}
+	since := pm.lastSave
+	if since.IsZero() {
+		since = pm.created
+	}
+	for _, rule := range pm.rules() {
+		if dirty >= rule.Changes && now.Sub(since) >= rule.After {
+			return true
+		}
+	}
+	return false
+}
+
+// pendingSave is a save claimed by beginSave: the snapshot and states to
+// write, and the change counts it covers.
+type pendingSave struct {
+	snap    *store.Snapshot
+	states  []savedState
+	changes int64
+	marked  int64
+}
+
+// beginSave claims the right to save and takes the snapshot. The change
+// count is read first, so writes racing with the snapshot are counted as
+// unsaved rather than lost.
+func (pm *PersistenceManager) beginSave() (*pendingSave, error) {
+	if pm.Path() == "" {
+		return nil, ErrNoRDBFilename
+	}
+	pm.mu.Lock()
+	if pm.saving {
+		pm.mu.Unlock()
+		return nil, ErrSaveInProgress
+	}
+	pm.saving = true
+	pm.bgsaveStarted = time.Now()
+	save := &pendingSave{marked: pm.dirty}
+	pm.mu.Unlock()
+
+	save.changes = pm.store.Changes()
+	var err error
+	save.snap = pm.store.SnapshotWith(func(capture func()) {
+		pm.pauseWrites(func() {
+			capture()
+			save.states, err = captureStates()
+		})
+	})
+	if err != nil {
+		save.snap.Release()
+		pm.finishSave(err, save, false)
+		return nil, err
+	}
+	return save, nil
+}
+
+func (pm *PersistenceManager) pauseWrites(fn func()) {
+	if pm.barrier == nil {
+		fn()
+		return
+	}
+	pm.barrier(fn)
+}
+
+func (pm *PersistenceManager) finishSave(err error, save *pendingSave, background bool) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	now := time.Now()
+	pm.saving = false
+	pm.lastAttempt = now
+	pm.lastSaveOK = err == nil
+	if background {
+		pm.lastBgsaveDuration = now.Sub(pm.bgsaveStarted)
+	}
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to save RDB file")
+		return
+	}
+	pm.baseline = save.changes
+	pm.dirty -= save.marked
+	pm.lastSave = now
+}
+
+// SAVE writes the RDB file before returning. Clients keep being served
+// meanwhile, but the snapshot reflects the moment SAVE was called.
+func (pm *PersistenceManager) SAVE() error {
+	save, err := pm.beginSave()
+	if err != nil {
+		return err
+	}
+	err = pm.rdbWriter.saveSnapshot(pm.Path(), save.snap, save.states)
+	save.snap.Release()
+	pm.finishSave(err, save, false)
+	return err
+}
+
+// BGSAVE takes a snapshot and writes it in the background. It fails with
+// ErrSaveInProgress while another save is running.
+func (pm *PersistenceManager) BGSAVE() error {
+	save, err := pm.beginSave()
+	if err != nil {
+		return err
+	}
+	logger.Info().Str("path", pm.Path()).Msg("Background saving started")
+	pm.wg.Add(1)
+	go func() {
+		defer pm.wg.Done()
+		defer logger.RecoverPanic("bgsave")
+		err := pm.rdbWriter.saveSnapshot(pm.Path(), save.snap, save.states)
+		save.snap.Release()
+		pm.finishSave(err, save, true)
+	}()
+	return nil
+}
+
+// LastSave is when the last successful save finished, or the zero time.
+func (pm *PersistenceManager) LastSave() time.Time {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	return pm.lastSave
+}
+
+// Dirty is the number of changes since the last successful save.
+func (pm *PersistenceManager) Dirty() int64 {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	return pm.dirty + pm.store.Changes() - pm.baseline
+}
+
+// MarkDirty counts a change the store did not see.
+func (pm *PersistenceManager) MarkDirty() {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pm.dirty++
+}
+
+// Info reports the snapshot state. Before the first save LastSave is when
+// the manager was created, as Redis reports its start time.
+func (pm *PersistenceManager) Info() PersistenceInfo {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	info := PersistenceInfo{
+		Dirty:              pm.dirty + pm.store.Changes() - pm.baseline,
+		LastSave:           pm.lastSave,
+		BgsaveInProgress:   pm.saving,
+		LastBgsaveOK:       pm.lastSaveOK,
+		LastBgsaveDuration: pm.lastBgsaveDuration,
+	}
+	if info.LastSave.IsZero() {
+		info.LastSave = pm.created
+	}
+	if pm.saving {
+		info.BgsaveStarted = pm.bgsaveStarted
+	}
+	return info
+}
@@ -0,0 +1,153 @@
+package persistence
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cachestorm/cachestorm/internal/store"
+)
+
+func TestParseSaveRules(t *testing.T) {
+	rules, err := ParseSaveRules("3600 1  300 100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []SaveRule{{After: time.Hour, Changes: 1}, {After: 5 * time.Minute, Changes: 100}}
+	if len(rules) != len(want) || rules[0] != want[0] || rules[1] != want[1] {
+		t.Fatalf("rules = %+v", rules)
+	}
+	if got := FormatSaveRules(rules); got != "3600 1 300 100" {
+		t.Errorf("FormatSaveRules = %q", got)
+	}
+	if rules, err := ParseSaveRules(""); err != nil || len(rules) != 0 {
+		t.Errorf("empty rules = %+v, %v", rules, err)
+	}
+	for _, bad := range []string{"60", "60 x", "0 1", "60 0"} {
+		if _, err := ParseSaveRules(bad); err == nil {
+			t.Errorf("ParseSaveRules(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestPersistenceManagerCountsStoreChanges(t *testing.T) {
+	s := store.NewStoreWithNamespaces()
+	s.Set("before", &store.StringValue{Data: []byte("v")}, store.SetOptions{})
+	pm := NewPersistenceManager(s, Config{DataDir: t.TempDir(), RDBFilename: "dump.rdb"})
+	if pm.Dirty() != 0 {
+		t.Fatalf("dirty = %d before any write", pm.Dirty())
+	}
+
+	s.Set("a", &store.StringValue{Data: []byte("v")}, store.SetOptions{})
+	s.ForNamespace("db3").Set("b", &store.StringValue{Data: []byte("v")}, store.SetOptions{})
+	if pm.Dirty() != 2 {
+		t.Fatalf("dirty = %d, want 2", pm.Dirty())
+	}
+	if err := pm.SAVE(); err != nil {
+		t.Fatal(err)
+	}
+	info := pm.Info()
+	if info.Dirty != 0 || !info.LastBgsaveOK || pm.LastSave().IsZero() {
+		t.Fatalf("after SAVE: %+v", info)
+	}
+
+	loaded := store.NewStoreWithNamespaces()
+	pm2 := NewPersistenceManager(loaded, Config{DataDir: filepath.Dir(pm.Path()), RDBFilename: "dump.rdb"})
+	if err := pm2.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := loaded.ForNamespace("db3").Get("b"); !ok {
+		t.Error("db3 key not loaded")
+	}
+	if pm2.Dirty() != 0 {
+		t.Errorf("dirty = %d after load", pm2.Dirty())
+	}
+}
+
+func TestPersistenceManagerSaveRules(t *testing.T) {
+	s := store.NewStore()
+	pm := NewPersistenceManager(s, Config{
+		DataDir:     t.TempDir(),
+		RDBFilename: "dump.rdb",
+		SaveRules:   []SaveRule{{After: time.Minute, Changes: 2}, {After: time.Hour, Changes: 1}},
+	})
+	now := time.Now()
+
+	s.Set("a", &store.StringValue{Data: []byte("v")}, store.SetOptions{})
+	if pm.shouldSave(now.Add(2 * time.Minute)) {
+		t.Error("one change fired the two-change rule")
+	}
+	if !pm.shouldSave(now.Add(2 * time.Hour)) {
+		t.Error("the one-change rule did not fire after an hour")
+	}
+	s.Set("b", &store.StringValue{Data: []byte("v")}, store.SetOptions{})
+	if pm.shouldSave(now) {
+		t.Error("rule fired before its time")
+	}
+	if !pm.shouldSave(now.Add(2 * time.Minute)) {
+		t.Error("two changes did not fire after a minute")
+	}
+
+	pm.SetSaveRules(nil)
+	if pm.shouldSave(now.Add(24 * time.Hour)) {
+		t.Error("saved with no rules")
+	}
+}
+
+func TestBGSAVEIsPointInTime(t *testing.T) {
+	s := store.NewStore()
+	s.Set("k", &store.StringValue{Data: []byte("v")}, store.SetOptions{})
+	pm := NewPersistenceManager(s, Config{DataDir: t.TempDir(), RDBFilename: "dump.rdb"})
+
+	if err := pm.BGSAVE(); err != nil {
+		t.Fatal(err)
+	}
+	if err := pm.SAVE(); err != nil && !errors.Is(err, ErrSaveInProgress) {
+		t.Fatalf("SAVE during BGSAVE: %v", err)
+	}
+	// Writes after the snapshot was taken stay dirty.
+	s.Set("later", &store.StringValue{Data: []byte("v")}, store.SetOptions{})
+	pm.wg.Wait()
+
+	info := pm.Info()
+	if info.BgsaveInProgress || !info.LastBgsaveOK || info.LastBgsaveDuration < 0 {
+		t.Fatalf("after BGSAVE: %+v", info)
+	}
+	if info.Dirty != 1 {
+		t.Errorf("dirty = %d, want the write made during BGSAVE", info.Dirty)
+	}
+
+	loaded := store.NewStore()
+	if err := NewRDBReader(loaded).Load(pm.Path()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := loaded.Get("later"); ok {
+		t.Error("BGSAVE wrote a key set after it started")
+	}
+}
+
+func TestPersistenceManagerFailedSave(t *testing.T) {
+	dir := t.TempDir()
+	s := store.NewStore()
+	pm := NewPersistenceManager(s, Config{
+		DataDir:     dir,
+		RDBFilename: "missing/dir/\x00dump.rdb",
+		SaveRules:   []SaveRule{{After: time.Nanosecond, Changes: 1}},
+	})
+	s.Set("k", &store.StringValue{Data: []byte("v")}, store.SetOptions{})
+
+	if err := pm.SAVE(); err == nil {
+		t.Fatal("expected SAVE to fail")
+	}
+	info := pm.Info()
+	if info.LastBgsaveOK || info.Dirty != 1 {
+		t.Errorf("after failed save: %+v", info)
+	}
+	if pm.shouldSave(time.Now()) {
+		t.Error("retried a failed save without delay")
+	}
+	if !pm.shouldSave(time.Now().Add(saveRetryDelay)) {
+		t.Error("did not retry after the delay")
+	}
+}
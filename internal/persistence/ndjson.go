@@ -0,0 +1,679 @@
+package persistence
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/cachestorm/cachestorm/internal/store"
+)
+
+// Logical exports write one JSON object per line for every key:
+//
+//	{"key":"user:1","namespace":"db1","type":"hash","ttl_ms":-1,"tags":["users"],"value":{"name":"Ada"}}
+//
+// namespace is left out for the default keyspace and tags when there are
+// none; ttl_ms is -1 for keys without an expiry. Binary-safe strings, such
+// as keys and string values, are JSON strings when they hold valid UTF-8 and
+// {"base64": "..."} objects otherwise. Collections are written in a
+// canonical order so that exports of the same data compare equal line by
+// line, although the lines themselves follow the store's order.
+//
+// The value of each type is:
+//
+//	string       the string
+//	hash         an object of fields, or [[field, value], ...] sorted by field
+//	             when a field name is not valid UTF-8
+//	list         an array of the elements
+//	set          an array of the members, sorted
+//	zset         [[member, score], ...] in rank order
+//	geo          [{"member", "lon", "lat"}, ...] sorted by member
+//	stream       {"entries", "last_id", "max_len", "groups"}
+//	json         the document
+//	timeseries   {"retention_ms", "labels", "samples": [[timestamp, value], ...]}
+//
+// Scores and samples that are not finite are written as "inf", "-inf" and
+// "nan". Types registered with RegisterValueCodec are written under their
+// codec's name with the encoded string as value.
+
+// NDJSONFilter selects the keys of a logical export. Empty fields match
+// every key.
+type NDJSONFilter struct {
+	// Match is a glob pattern on the key name.
+	Match string
+	// Namespace limits the export to one namespace.
+	Namespace string
+	// Tag limits the export to keys carrying the tag.
+	Tag string
+	// Allow, when set, leaves out the keys it returns false for, such as
+	// those an ACL user may not read.
+	Allow func(key string) bool
+}
+
+func (f NDJSONFilter) matches(key string, e *store.Entry) bool {
+	if f.Match != "" && !store.MatchPattern(key, f.Match) {
+		return false
+	}
+	if f.Allow != nil && !f.Allow(key) {
+		return false
+	}
+	if f.Tag == "" {
+		return true
+	}
+	for _, tag := range e.Tags {
+		if tag == f.Tag {
+			return true
+		}
+	}
+	return false
+}
+
+type ndjsonRecord struct {
+	Key       ndjsonText      `json:"key"`
+	Namespace string          `json:"namespace,omitempty"`
+	Type      string          `json:"type"`
+	TTL       int64           `json:"ttl_ms"`
+	Tags      []string        `json:"tags,omitempty"`
+	Value     json.RawMessage `json:"value"`
+}
+
+// ExportNDJSON writes the keys of s selected by filter to w, one record per
+// line, and returns how many it wrote. It works on a snapshot, so clients
+// keep writing while it runs and the export reflects the moment it started.
+// On the root store of a namespace manager it covers every namespace.
+func ExportNDJSON(w io.Writer, s *store.Store, filter NDJSONFilter) (int64, error) {
+	s = s.ForNamespace(store.DBNamespace(0))
+	snap := s.Snapshot()
+	defer snap.Release()
+
+	dbs := append([]*store.SnapshotDB(nil), snap.Databases()...)
+	sortDatabases(dbs)
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	enc.SetEscapeHTML(false)
+
+	var n int64
+	for _, db := range dbs {
+		if filter.Namespace != "" && db.Name != filter.Namespace {
+			continue
+		}
+		namespace := db.Name
+		if namespace == store.DBNamespace(0) {
+			namespace = ""
+		}
+		err := db.Range(func(key string, e *store.Entry) error {
+			if e.Value == nil || e.IsExpired() || !filter.matches(key, e) {
+				return nil
+			}
+			rec, err := ndjsonEncodeEntry(key, e)
+			if err != nil {
+				return err
+			}
+			rec.Namespace = namespace
+			if err := enc.Encode(rec); err != nil {
+				return err
+			}
+			n++
+			return nil
+		})
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, bw.Flush()
+}
+
+func ndjsonEncodeEntry(key string, e *store.Entry) (*ndjsonRecord, error) {
+	typ, form, err := ndjsonForm(e.Value)
+	if err != nil {
+		return nil, fmt.Errorf("key %q: %v", key, err)
+	}
+	value, err := marshalJSON(form)
+	if err != nil {
+		return nil, fmt.Errorf("key %q: %v", key, err)
+	}
+	rec := &ndjsonRecord{
+		Key:   ndjsonText(key),
+		Type:  typ,
+		TTL:   -1,
+		Tags:  e.Tags,
+		Value: value,
+	}
+	if e.ExpiresAt > 0 {
+		rec.TTL = max(time.Until(time.Unix(0, e.ExpiresAt)).Milliseconds(), 1)
+	}
+	return rec, nil
+}
+
+// ndjsonForm returns the type name and the JSON form of v.
+func ndjsonForm(v store.Value) (string, any, error) {
+	switch vt := v.(type) {
+	case *store.StringValue:
+		return "string", ndjsonText(vt.Data), nil
+	case *store.HashValue:
+		vt.RLock()
+		defer vt.RUnlock()
+		return "hash", ndjsonTextMap(vt.Fields), nil
+	case *store.ListValue:
+		vt.RLock()
+		defer vt.RUnlock()
+		items := make([]ndjsonText, len(vt.Elements))
+		for i, item := range vt.Elements {
+			items[i] = item
+		}
+		return "list", items, nil
+	case *store.SetValue:
+		vt.RLock()
+		defer vt.RUnlock()
+		members := make([]ndjsonText, 0, len(vt.Members))
+		_ = rangeMap(vt.Members, true, func(member string, _ struct{}) error {
+			members = append(members, ndjsonText(member))
+			return nil
+		})
+		return "set", members, nil
+	case *store.SortedSetValue:
+		vt.RLock()
+		defer vt.RUnlock()
+		members := make([]ndjsonScored, 0, len(vt.Members))
+		for member, score := range vt.Members {
+			members = append(members, ndjsonScored{Member: ndjsonText(member), Score: ndjsonFloat(score)})
+		}
+		sort.Slice(members, func(i, j int) bool {
+			if members[i].Score != members[j].Score {
+				return members[i].Score < members[j].Score
+			}
+			return string(members[i].Member) < string(members[j].Member)
+		})
+		return "zset", members, nil
+	case *store.GeoValue:
+		points := make([]ndjsonGeoPoint, 0, len(vt.Points))
+		_ = rangeMap(vt.Points, true, func(member string, p store.GeoPoint) error {
+			points = append(points, ndjsonGeoPoint{Member: ndjsonText(member), Lon: p.Lon, Lat: p.Lat})
+			return nil
+		})
+		return "geo", points, nil
+	case *store.StreamValue:
+		return "stream", ndjsonStreamForm(vt), nil
+	case *store.JSONValue:
+		doc := json.RawMessage(vt.String())
+		if !json.Valid(doc) {
+			return "", nil, errors.New("JSON value is not a valid document")
+		}
+		return "json", doc, nil
+	case *store.TimeSeriesValue:
+		samples := vt.Range(math.MinInt64, math.MaxInt64)
+		ts := ndjsonTimeSeries{
+			RetentionMS: vt.Retention.Milliseconds(),
+			Labels:      vt.GetLabels(),
+			Samples:     make([]ndjsonSample, len(samples)),
+		}
+		for i, s := range samples {
+			ts.Samples[i] = ndjsonSample{Timestamp: s.Timestamp, Value: ndjsonFloat(s.Value), Labels: s.Labels}
+		}
+		return "timeseries", ts, nil
+	}
+	if c, ok := codecFor(v); ok {
+		return c.Name, ndjsonText(c.Encode(v)), nil
+	}
+	return "", nil, fmt.Errorf("no NDJSON form for %T", v)
+}
+
+// ImportNDJSON sets the key of every record read from r in s, replacing
+// keys of the same name, and returns how many it set. Records name their
+// namespace, so s should be the root store when exports span several. It
+// stops at the first invalid record, leaving the keys before it set.
+// Records whose ttl_ms is below 1 get no expiry.
+func ImportNDJSON(r io.Reader, s *store.Store) (int64, error) {
+	br := bufio.NewReader(r)
+	var n int64
+	for line := 1; ; line++ {
+		data, err := br.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+		if len(bytes.TrimSpace(data)) > 0 {
+			if ierr := importNDJSONLine(data, s); ierr != nil {
+				return n, fmt.Errorf("line %d: %v", line, ierr)
+			}
+			n++
+		}
+		if err == io.EOF {
+			return n, nil
+		}
+	}
+}
+
+func importNDJSONLine(data []byte, s *store.Store) error {
+	var rec ndjsonRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return err
+	}
+	if len(rec.Key) == 0 {
+		return errors.New("record without a key")
+	}
+	if len(rec.Value) == 0 {
+		return fmt.Errorf("key %q: record without a value", rec.Key)
+	}
+	value, err := ndjsonValue(rec.Type, rec.Value)
+	if err != nil {
+		return fmt.Errorf("key %q: %v", rec.Key, err)
+	}
+	opts := store.SetOptions{Tags: rec.Tags}
+	if rec.TTL > 0 {
+		opts.TTL = time.Duration(rec.TTL) * time.Millisecond
+	}
+	if err := s.ForNamespace(rec.Namespace).Set(string(rec.Key), value, opts); err != nil {
+		return fmt.Errorf("key %q: %v", rec.Key, err)
+	}
+	return nil
+}
+
+// ndjsonValue decodes the JSON form of a value of the named type.
+func ndjsonValue(typ string, data json.RawMessage) (store.Value, error) {
+	switch typ {
+	case "string":
+		var v ndjsonText
+		if err := json.Unmarshal(data, &v); err != nil {
+			return nil, err
+		}
+		return &store.StringValue{Data: v}, nil
+	case "hash":
+		var fields ndjsonTextMap
+		if err := json.Unmarshal(data, &fields); err != nil {
+			return nil, err
+		}
+		return &store.HashValue{Fields: fields}, nil
+	case "list":
+		var items []ndjsonText
+		if err := json.Unmarshal(data, &items); err != nil {
+			return nil, err
+		}
+		elements := make([][]byte, len(items))
+		for i, item := range items {
+			elements[i] = item
+		}
+		return &store.ListValue{Elements: elements}, nil
+	case "set":
+		var items []ndjsonText
+		if err := json.Unmarshal(data, &items); err != nil {
+			return nil, err
+		}
+		members := make(map[string]struct{}, len(items))
+		for _, item := range items {
+			members[string(item)] = struct{}{}
+		}
+		return &store.SetValue{Members: members}, nil
+	case "zset":
+		var items []ndjsonScored
+		if err := json.Unmarshal(data, &items); err != nil {
+			return nil, err
+		}
+		members := make(map[string]float64, len(items))
+		for _, item := range items {
+			if math.IsNaN(float64(item.Score)) {
+				return nil, fmt.Errorf("member %q has a NaN score", item.Member)
+			}
+			members[string(item.Member)] = float64(item.Score)
+		}
+		return &store.SortedSetValue{Members: members}, nil
+	case "geo":
+		var points []ndjsonGeoPoint
+		if err := json.Unmarshal(data, &points); err != nil {
+			return nil, err
+		}
+		geo := store.NewGeoValue()
+		for _, p := range points {
+			geo.Add(string(p.Member), p.Lon, p.Lat)
+		}
+		return geo, nil
+	case "stream":
+		var form ndjsonStream
+		if err := json.Unmarshal(data, &form); err != nil {
+			return nil, err
+		}
+		return form.value()
+	case "json":
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, data); err != nil {
+			return nil, err
+		}
+		return &store.JSONValue{Data: buf.Bytes()}, nil
+	case "timeseries":
+		var form ndjsonTimeSeries
+		if err := json.Unmarshal(data, &form); err != nil {
+			return nil, err
+		}
+		ts := store.NewTimeSeriesValue(time.Duration(form.RetentionMS) * time.Millisecond)
+		if form.Labels != nil {
+			ts.Labels = form.Labels
+		}
+		for _, s := range form.Samples {
+			ts.Samples = append(ts.Samples, store.TimeSeriesSample{Timestamp: s.Timestamp, Value: float64(s.Value), Labels: s.Labels})
+		}
+		sort.SliceStable(ts.Samples, func(i, j int) bool { return ts.Samples[i].Timestamp < ts.Samples[j].Timestamp })
+		return ts, nil
+	}
+	if c, ok := codecForName(typ); ok {
+		var v ndjsonText
+		if err := json.Unmarshal(data, &v); err != nil {
+			return nil, err
+		}
+		return c.Decode(v)
+	}
+	return nil, fmt.Errorf("unknown type %q", typ)
+}
+
+// marshalJSON encodes v without escaping HTML characters, which keeps
+// exported strings as written.
+func marshalJSON(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// ndjsonText is a binary-safe string: a JSON string when it is valid UTF-8
+// and {"base64": "..."} otherwise.
+type ndjsonText []byte
+
+type ndjsonBase64 struct {
+	Base64 []byte `json:"base64"`
+}
+
+func (t ndjsonText) MarshalJSON() ([]byte, error) {
+	if utf8.Valid(t) {
+		return marshalJSON(string(t))
+	}
+	return marshalJSON(ndjsonBase64{Base64: t})
+}
+
+func (t *ndjsonText) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*t = ndjsonText(s)
+		return nil
+	}
+	var b ndjsonBase64
+	if err := json.Unmarshal(data, &b); err != nil || b.Base64 == nil {
+		return fmt.Errorf("%s is neither a string nor {\"base64\": ...}", data)
+	}
+	*t = b.Base64
+	return nil
+}
+
+// ndjsonTextMap is a map of binary-safe strings: an object while every name
+// is valid UTF-8, since JSON object names cannot hold anything else, and an
+// array of [name, value] pairs sorted by name otherwise.
+type ndjsonTextMap map[string][]byte
+
+func (m ndjsonTextMap) MarshalJSON() ([]byte, error) {
+	object := make(map[string]ndjsonText, len(m))
+	for name, value := range m {
+		if !utf8.ValidString(name) {
+			pairs := make([][2]ndjsonText, 0, len(m))
+			_ = rangeMap(m, true, func(name string, value []byte) error {
+				pairs = append(pairs, [2]ndjsonText{ndjsonText(name), value})
+				return nil
+			})
+			return marshalJSON(pairs)
+		}
+		object[name] = value
+	}
+	return marshalJSON(object)
+}
+
+func (m *ndjsonTextMap) UnmarshalJSON(data []byte) error {
+	out := make(ndjsonTextMap)
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		var pairs [][2]ndjsonText
+		if err := json.Unmarshal(data, &pairs); err != nil {
+			return err
+		}
+		for _, p := range pairs {
+			out[string(p[0])] = p[1]
+		}
+	} else {
+		var object map[string]ndjsonText
+		if err := json.Unmarshal(data, &object); err != nil {
+			return err
+		}
+		for name, value := range object {
+			out[name] = value
+		}
+	}
+	*m = out
+	return nil
+}
+
+// ndjsonFloat is a number that may be infinite or NaN, which JSON numbers
+// cannot express; those are written as strings.
+type ndjsonFloat float64
+
+func (f ndjsonFloat) MarshalJSON() ([]byte, error) {
+	switch v := float64(f); {
+	case math.IsInf(v, 1):
+		return []byte(`"inf"`), nil
+	case math.IsInf(v, -1):
+		return []byte(`"-inf"`), nil
+	case math.IsNaN(v):
+		return []byte(`"nan"`), nil
+	default:
+		return json.Marshal(v)
+	}
+}
+
+func (f *ndjsonFloat) UnmarshalJSON(data []byte) error {
+	var v float64
+	if err := json.Unmarshal(data, &v); err == nil {
+		*f = ndjsonFloat(v)
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("%s is not a number", data)
+	}
+	v, err := strconv.ParseFloat(strings.TrimPrefix(s, "+"), 64)
+	if err != nil {
+		return fmt.Errorf("%q is not a number", s)
+	}
+	*f = ndjsonFloat(v)
+	return nil
+}
+
+// ndjsonScored is a sorted set member, written as [member, score].
+type ndjsonScored struct {
+	Member ndjsonText
+	Score  ndjsonFloat
+}
+
+func (m ndjsonScored) MarshalJSON() ([]byte, error) {
+	return marshalJSON([]any{m.Member, m.Score})
+}
+
+func (m *ndjsonScored) UnmarshalJSON(data []byte) error {
+	var pair []json.RawMessage
+	if err := json.Unmarshal(data, &pair); err != nil || len(pair) != 2 {
+		return fmt.Errorf("%s is not a [member, score] pair", data)
+	}
+	if err := json.Unmarshal(pair[0], &m.Member); err != nil {
+		return err
+	}
+	return json.Unmarshal(pair[1], &m.Score)
+}
+
+type ndjsonGeoPoint struct {
+	Member ndjsonText `json:"member"`
+	Lon    float64    `json:"lon"`
+	Lat    float64    `json:"lat"`
+}
+
+type ndjsonTimeSeries struct {
+	RetentionMS int64             `json:"retention_ms"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Samples     []ndjsonSample    `json:"samples"`
+}
+
+// ndjsonSample is written as [timestamp, value], followed by the sample's
+// labels when it has any.
+type ndjsonSample struct {
+	Timestamp int64
+	Value     ndjsonFloat
+	Labels    map[string]string
+}
+
+func (s ndjsonSample) MarshalJSON() ([]byte, error) {
+	if len(s.Labels) > 0 {
+		return marshalJSON([]any{s.Timestamp, s.Value, s.Labels})
+	}
+	return marshalJSON([]any{s.Timestamp, s.Value})
+}
+
+func (s *ndjsonSample) UnmarshalJSON(data []byte) error {
+	var parts []json.RawMessage
+	if err := json.Unmarshal(data, &parts); err != nil || len(parts) < 2 || len(parts) > 3 {
+		return fmt.Errorf("%s is not a [timestamp, value] sample", data)
+	}
+	if err := json.Unmarshal(parts[0], &s.Timestamp); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(parts[1], &s.Value); err != nil {
+		return err
+	}
+	if len(parts) == 3 {
+		return json.Unmarshal(parts[2], &s.Labels)
+	}
+	return nil
+}
+
+type ndjsonStream struct {
+	Entries []ndjsonStreamEntry `json:"entries"`
+	LastID  string              `json:"last_id"`
+	MaxLen  int64               `json:"max_len,omitempty"`
+	Groups  []ndjsonStreamGroup `json:"groups,omitempty"`
+}
+
+type ndjsonStreamEntry struct {
+	ID     string        `json:"id"`
+	Fields ndjsonTextMap `json:"fields"`
+}
+
+type ndjsonStreamGroup struct {
+	Name      string                 `json:"name"`
+	LastID    string                 `json:"last_id"`
+	Consumers []ndjsonStreamConsumer `json:"consumers,omitempty"`
+	Pending   []ndjsonStreamPending  `json:"pending,omitempty"`
+}
+
+type ndjsonStreamConsumer struct {
+	Name    string `json:"name"`
+	SeenMS  int64  `json:"seen_ms"`
+	Pending int64  `json:"pending"`
+	Active  bool   `json:"active"`
+}
+
+type ndjsonStreamPending struct {
+	ID          string `json:"id"`
+	Consumer    string `json:"consumer"`
+	DeliveredMS int64  `json:"delivered_ms"`
+	Deliveries  int64  `json:"deliveries"`
+}
+
+// ndjsonStreamForm lists the entries in ID order and the groups, their
+// consumers and pending entries sorted by name and ID.
+func ndjsonStreamForm(v *store.StreamValue) ndjsonStream {
+	entries := v.GetRange("", "+", 0)
+	form := ndjsonStream{
+		Entries: make([]ndjsonStreamEntry, len(entries)),
+		LastID:  v.GetLastID(),
+		MaxLen:  v.MaxLen,
+	}
+	for i, e := range entries {
+		form.Entries[i] = ndjsonStreamEntry{ID: e.ID, Fields: e.Fields}
+	}
+
+	for _, g := range v.GetGroups() {
+		group := ndjsonStreamGroup{Name: g.Name, LastID: g.LastID}
+		names := g.GetAllConsumers()
+		sort.Strings(names)
+		for _, name := range names {
+			c := g.GetConsumer(name)
+			if c == nil {
+				c = &store.Consumer{Name: name}
+			}
+			group.Consumers = append(group.Consumers, ndjsonStreamConsumer{
+				Name:    c.Name,
+				SeenMS:  c.SeenTime,
+				Pending: c.Pending,
+				Active:  c.Active,
+			})
+		}
+		for _, p := range g.GetPending("-", "+", 0) {
+			group.Pending = append(group.Pending, ndjsonStreamPending{
+				ID:          p.ID,
+				Consumer:    p.Consumer,
+				DeliveredMS: p.DeliveryTS,
+				Deliveries:  p.Deliveries,
+			})
+		}
+		form.Groups = append(form.Groups, group)
+	}
+	sort.Slice(form.Groups, func(i, j int) bool { return form.Groups[i].Name < form.Groups[j].Name })
+	return form
+}
+
+// value builds the stream. Entries are created at the time in their ID.
+func (form ndjsonStream) value() (store.Value, error) {
+	stream := store.NewStreamValue(form.MaxLen)
+	stream.Entries = make([]*store.StreamEntry, len(form.Entries))
+	for i, e := range form.Entries {
+		ms, _, _ := strings.Cut(e.ID, "-")
+		created, err := strconv.ParseInt(ms, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid stream ID %q", e.ID)
+		}
+		stream.Entries[i] = &store.StreamEntry{ID: e.ID, Fields: e.Fields, CreatedAt: time.UnixMilli(created)}
+	}
+	stream.LastID = form.LastID
+	if stream.LastID == "" && len(stream.Entries) > 0 {
+		stream.LastID = stream.Entries[len(stream.Entries)-1].ID
+	}
+	stream.Length = int64(len(stream.Entries))
+
+	for _, fg := range form.Groups {
+		g := store.NewConsumerGroup(fg.Name)
+		if fg.LastID != "" {
+			g.LastID = fg.LastID
+		}
+		for _, fc := range fg.Consumers {
+			g.Consumers[fc.Name] = &store.Consumer{
+				Name:     fc.Name,
+				SeenTime: fc.SeenMS,
+				Pending:  fc.Pending,
+				Active:   fc.Active,
+			}
+		}
+		for _, fp := range fg.Pending {
+			g.Pending[fp.ID] = &store.PendingEntry{
+				ID:         fp.ID,
+				Consumer:   fp.Consumer,
+				DeliveryTS: fp.DeliveredMS,
+				Deliveries: fp.Deliveries,
+			}
+		}
+		stream.Groups[fg.Name] = g
+	}
+	return stream, nil
+}
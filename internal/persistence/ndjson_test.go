@@ -0,0 +1,195 @@
+package persistence
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cachestorm/cachestorm/internal/store"
+)
+
+func exportLines(t *testing.T, s *store.Store, filter NDJSONFilter) []string {
+	t.Helper()
+	var buf bytes.Buffer
+	n, err := ExportNDJSON(&buf, s, filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if buf.Len() == 0 {
+		lines = nil
+	}
+	if int64(len(lines)) != n {
+		t.Fatalf("ExportNDJSON reported %d records, wrote %d", n, len(lines))
+	}
+	return lines
+}
+
+func TestNDJSONRoundTrip(t *testing.T) {
+	src := store.NewStoreWithNamespaces()
+	src.Set("str", &store.StringValue{Data: []byte("<v&>")}, store.SetOptions{Tags: []string{"t"}})
+	src.Set("bin", &store.StringValue{Data: []byte{0xff, 0x00, 0x01}}, store.SetOptions{TTL: time.Hour})
+	src.Set("hash", &store.HashValue{Fields: map[string][]byte{"f": []byte("1"), "g": []byte("2")}}, store.SetOptions{})
+	src.Set("binhash", &store.HashValue{Fields: map[string][]byte{"\xff": []byte("x")}}, store.SetOptions{})
+	src.Set("list", &store.ListValue{Elements: [][]byte{[]byte("b"), []byte("a")}}, store.SetOptions{})
+	src.Set("set", &store.SetValue{Members: map[string]struct{}{"y": {}, "x": {}}}, store.SetOptions{})
+	src.Set("zset", &store.SortedSetValue{Members: map[string]float64{"a": 2, "b": 1, "c": math.Inf(1)}}, store.SetOptions{})
+	geo := store.NewGeoValue()
+	geo.Add("rome", 12.5, 41.9)
+	src.Set("geo", geo, store.SetOptions{})
+	src.Set("json", &store.JSONValue{Data: []byte(`{"a":[1,2]}`)}, store.SetOptions{})
+	ts := store.NewTimeSeriesValue(0)
+	ts.Labels["sensor"] = "1"
+	ts.Add(1000, 1.5)
+	ts.Add(2000, 2.5)
+	src.Set("ts", ts, store.SetOptions{})
+	stream := store.NewStreamValue(0)
+	stream.Add("1-1", map[string][]byte{"f": []byte("v")})
+	g := store.NewConsumerGroup("workers")
+	g.LastID = "1-1"
+	g.Consumers["alice"] = &store.Consumer{Name: "alice", SeenTime: 5, Pending: 1, Active: true}
+	g.Pending["1-1"] = &store.PendingEntry{ID: "1-1", Consumer: "alice", DeliveryTS: 5, Deliveries: 1}
+	stream.Groups["workers"] = g
+	src.Set("stream", stream, store.SetOptions{})
+	src.ForNamespace("db1").Set("other", &store.StringValue{Data: []byte("v")}, store.SetOptions{})
+
+	lines := exportLines(t, src, NDJSONFilter{})
+	if len(lines) != 12 {
+		t.Fatalf("exported %d records, want 12:\n%s", len(lines), strings.Join(lines, "\n"))
+	}
+	for _, want := range []string{
+		`{"key":"str","type":"string","ttl_ms":-1,"tags":["t"],"value":"<v&>"}`,
+		`{"key":"hash","type":"hash","ttl_ms":-1,"value":{"f":"1","g":"2"}}`,
+		`{"key":"binhash","type":"hash","ttl_ms":-1,"value":[[{"base64":"/w=="},"x"]]}`,
+		`{"key":"set","type":"set","ttl_ms":-1,"value":["x","y"]}`,
+		`{"key":"zset","type":"zset","ttl_ms":-1,"value":[["b",1],["a",2],["c","inf"]]}`,
+		`{"key":"json","type":"json","ttl_ms":-1,"value":{"a":[1,2]}}`,
+		`{"key":"other","namespace":"db1","type":"string","ttl_ms":-1,"value":"v"}`,
+	} {
+		found := false
+		for _, line := range lines {
+			found = found || line == want
+		}
+		if !found {
+			t.Errorf("missing record %s", want)
+		}
+	}
+
+	dst := store.NewStoreWithNamespaces()
+	n, err := ImportNDJSON(strings.NewReader(strings.Join(lines, "\n")), dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 12 {
+		t.Errorf("imported %d records, want 12", n)
+	}
+	if ttl := dst.TTL("bin"); ttl <= 0 || ttl > time.Hour {
+		t.Errorf("bin ttl = %v", ttl)
+	}
+	if e, _ := dst.Get("bin"); e == nil || !bytes.Equal(e.Value.(*store.StringValue).Data, []byte{0xff, 0x00, 0x01}) {
+		t.Errorf("bin = %+v", e)
+	}
+	if e, _ := dst.Get("ts"); e == nil || len(e.Value.(*store.TimeSeriesValue).Samples) != 2 {
+		t.Errorf("ts = %+v", e)
+	}
+	if e, _ := dst.Get("stream"); e == nil || e.Value.(*store.StreamValue).Groups["workers"].Pending["1-1"] == nil {
+		t.Errorf("stream = %+v", e)
+	}
+	if _, ok := dst.ForNamespace("db1").Get("other"); !ok {
+		t.Error("namespaced key not imported")
+	}
+
+	// Exporting the copy gives the same records.
+	again := exportLines(t, dst, NDJSONFilter{})
+	comparable := func(l []string) []string {
+		out := append([]string(nil), l...)
+		for i := range out {
+			out[i] = strings.Replace(out[i], `"ttl_ms":`, "", 1)
+			if strings.Contains(out[i], `"key":"bin"`) {
+				out[i] = ""
+			}
+		}
+		return out
+	}
+	want, got := map[string]bool{}, map[string]bool{}
+	for _, l := range comparable(lines) {
+		want[l] = true
+	}
+	for _, l := range comparable(again) {
+		got[l] = true
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("re-export differs:\n%s\nvs\n%s", strings.Join(lines, "\n"), strings.Join(again, "\n"))
+	}
+}
+
+func TestNDJSONExportFilter(t *testing.T) {
+	s := store.NewStoreWithNamespaces()
+	s.Set("user:1", &store.StringValue{Data: []byte("v")}, store.SetOptions{Tags: []string{"users"}})
+	s.Set("user:2", &store.StringValue{Data: []byte("v")}, store.SetOptions{})
+	s.Set("order:1", &store.StringValue{Data: []byte("v")}, store.SetOptions{Tags: []string{"users"}})
+	s.ForNamespace("db1").Set("user:3", &store.StringValue{Data: []byte("v")}, store.SetOptions{})
+
+	if lines := exportLines(t, s, NDJSONFilter{Match: "user:*"}); len(lines) != 3 {
+		t.Errorf("MATCH user:* exported %v", lines)
+	}
+	if lines := exportLines(t, s, NDJSONFilter{Tag: "users"}); len(lines) != 2 {
+		t.Errorf("TAG users exported %v", lines)
+	}
+	if lines := exportLines(t, s, NDJSONFilter{Namespace: "db1"}); len(lines) != 1 {
+		t.Errorf("namespace db1 exported %v", lines)
+	}
+	if lines := exportLines(t, s, NDJSONFilter{Match: "user:*", Tag: "users", Namespace: "default"}); len(lines) != 1 {
+		t.Errorf("combined filter exported %v", lines)
+	}
+}
+
+func TestNDJSONImportErrors(t *testing.T) {
+	for _, input := range []string{
+		`{"key":"a","type":"string","value":"v"}` + "\nnot json\n",
+		`{"key":"a","type":"string","value":"v"}` + "\n" + `{"key":"b","type":"nope","value":1}`,
+		`{"key":"a","type":"string","value":"v"}` + "\n" + `{"key":"b","type":"zset","value":[["m"]]}`,
+	} {
+		s := store.NewStore()
+		n, err := ImportNDJSON(strings.NewReader(input), s)
+		if err == nil || !strings.HasPrefix(err.Error(), "line 2:") {
+			t.Errorf("import of %q err = %v, want one on line 2", input, err)
+		}
+		if n != 1 {
+			t.Errorf("imported %d records before the bad one, want 1", n)
+		}
+	}
+
+	s := store.NewStore()
+	input := "\n" + `{"key":{"base64":"/wE="},"type":"list","value":["a",{"base64":"/w=="}]}` + "\n\n"
+	if _, err := ImportNDJSON(strings.NewReader(input), s); err != nil {
+		t.Fatal(err)
+	}
+	e, ok := s.Get("\xff\x01")
+	if !ok {
+		t.Fatal("base64 key not imported")
+	}
+	if got := e.Value.(*store.ListValue).Elements; len(got) != 2 || got[1][0] != 0xff {
+		t.Errorf("list = %q", got)
+	}
+	if ttl := s.TTL("\xff\x01"); ttl != -1 {
+		t.Errorf("ttl = %v, want none for a record without ttl_ms", ttl)
+	}
+}
+
+func TestNDJSONFloats(t *testing.T) {
+	for _, f := range []float64{math.Inf(1), math.Inf(-1), 1.5, -0.25} {
+		data, err := json.Marshal(ndjsonFloat(f))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var back ndjsonFloat
+		if err := json.Unmarshal(data, &back); err != nil || float64(back) != f {
+			t.Errorf("%v -> %s -> %v, %v", f, data, back, err)
+		}
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+
+	"github.com/cachestorm/cachestorm/internal/store"
 )
 
 func TestAOFConfig(t *testing.T) {
@@ -209,76 +211,45 @@ func TestSyncPolicyFromString(t *testing.T) {
 	}
 }
 
-type mockStore struct {
-	data map[string]interface{}
-}
-
-func (m *mockStore) GetAll() map[string]interface{} {
-	return m.data
-}
-
-func TestNewAOFRewriter(t *testing.T) {
-	store := &mockStore{data: make(map[string]interface{})}
-	cfg := AOFConfig{RewriteSize: 1024, RewritePct: 100}
-
-	rw := NewAOFRewriter(cfg, store)
-	if rw == nil {
-		t.Fatal("expected rewriter")
-	}
-}
-
-func TestAOFRewriterIsRewriting(t *testing.T) {
-	store := &mockStore{data: make(map[string]interface{})}
-	rw := NewAOFRewriter(AOFConfig{}, store)
-
-	if rw.IsRewriting() {
-		t.Error("expected not rewriting")
-	}
-}
-
-func TestAOFRewriterShouldRewrite(t *testing.T) {
-	store := &mockStore{data: make(map[string]interface{})}
+func TestAOFManagerShouldRewrite(t *testing.T) {
 	cfg := AOFConfig{
 		RewriteSize: 100,
 		RewritePct:  50,
 	}
-	rw := NewAOFRewriter(cfg, store)
+	m := NewAOFManager(cfg, store.NewStore())
 
-	if rw.ShouldRewrite(50) {
+	if m.ShouldRewrite(50) {
 		t.Error("should not rewrite when size < RewriteSize")
 	}
 
-	if !rw.ShouldRewrite(100) {
+	if !m.ShouldRewrite(100) {
 		t.Error("should rewrite when size >= RewriteSize")
 	}
 }
 
-func TestAOFRewriterShouldRewriteInProgress(t *testing.T) {
-	store := &mockStore{data: make(map[string]interface{})}
-	cfg := AOFConfig{RewriteSize: 100}
-	rw := NewAOFRewriter(cfg, store)
+func TestAOFManagerShouldRewriteInProgress(t *testing.T) {
+	cfg := AOFConfig{RewriteSize: 100, RewritePct: 100}
+	m := NewAOFManager(cfg, store.NewStore())
 
-	rw.rewriting.Store(true)
-	if rw.ShouldRewrite(1000) {
+	m.rewriting.Store(true)
+	if m.ShouldRewrite(1000) {
 		t.Error("should not rewrite when already in progress")
 	}
 }
 
 func TestNewAOFManager(t *testing.T) {
-	store := &mockStore{data: make(map[string]interface{})}
 	cfg := AOFConfig{Enabled: false}
 
-	m := NewAOFManager(cfg, store)
+	m := NewAOFManager(cfg, store.NewStore())
 	if m == nil {
 		t.Fatal("expected manager")
 	}
 }
 
 func TestAOFManagerStart(t *testing.T) {
-	store := &mockStore{data: make(map[string]interface{})}
 	cfg := AOFConfig{Enabled: false}
 
-	m := NewAOFManager(cfg, store)
+	m := NewAOFManager(cfg, store.NewStore())
 	err := m.Start()
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
@@ -287,21 +258,19 @@ func TestAOFManagerStart(t *testing.T) {
 }
 
 func TestAOFManagerAppend(t *testing.T) {
-	store := &mockStore{data: make(map[string]interface{})}
 	cfg := AOFConfig{Enabled: false}
 
-	m := NewAOFManager(cfg, store)
-	err := m.Append("SET", [][]byte{[]byte("key"), []byte("value")})
+	m := NewAOFManager(cfg, store.NewStore())
+	err := m.Append("", "SET", [][]byte{[]byte("key"), []byte("value")})
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
 }
 
 func TestAOFManagerSize(t *testing.T) {
-	store := &mockStore{data: make(map[string]interface{})}
 	cfg := AOFConfig{Enabled: false}
 
-	m := NewAOFManager(cfg, store)
+	m := NewAOFManager(cfg, store.NewStore())
 	size := m.Size()
 	if size != 0 {
 		t.Errorf("expected 0, got %d", size)
@@ -309,10 +278,9 @@ func TestAOFManagerSize(t *testing.T) {
 }
 
 func TestAOFManagerDirty(t *testing.T) {
-	store := &mockStore{data: make(map[string]interface{})}
 	cfg := AOFConfig{Enabled: false}
 
-	m := NewAOFManager(cfg, store)
+	m := NewAOFManager(cfg, store.NewStore())
 	dirty := m.Dirty()
 	if dirty != 0 {
 		t.Errorf("expected 0, got %d", dirty)
@@ -320,10 +288,9 @@ func TestAOFManagerDirty(t *testing.T) {
 }
 
 func TestAOFManagerFlush(t *testing.T) {
-	store := &mockStore{data: make(map[string]interface{})}
 	cfg := AOFConfig{Enabled: false}
 
-	m := NewAOFManager(cfg, store)
+	m := NewAOFManager(cfg, store.NewStore())
 	err := m.Flush()
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
@@ -331,27 +298,21 @@ func TestAOFManagerFlush(t *testing.T) {
 }
 
 func TestAOFManagerIsRewriting(t *testing.T) {
-	store := &mockStore{data: make(map[string]interface{})}
 	cfg := AOFConfig{Enabled: false}
 
-	m := NewAOFManager(cfg, store)
+	m := NewAOFManager(cfg, store.NewStore())
 	if m.IsRewriting() {
 		t.Error("expected not rewriting")
 	}
 }
 
 func TestAOFManagerInfo(t *testing.T) {
-	store := &mockStore{data: make(map[string]interface{})}
 	cfg := AOFConfig{Enabled: true}
 
-	m := NewAOFManager(cfg, store)
+	m := NewAOFManager(cfg, store.NewStore())
 	info := m.Info()
 
-	if info == nil {
-		t.Fatal("expected info")
-	}
-
-	if info["aof_enabled"] != true {
+	if !info.Enabled {
 		t.Error("expected aof_enabled to be true")
 	}
 }
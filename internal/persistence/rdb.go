@@ -1,11 +1,16 @@
 package persistence
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -23,26 +28,116 @@ const (
 	RDBVersion11 RDBVersion = 11
 )
 
+// Opcodes and string encodings of the RDB format. Value types live in
+// rdb_values.go.
+const (
+	rdbOpcodeTags          = 0xE0 // CacheStorm: tags of the next key
+	rdbOpcodeNamespace     = 0xE1 // CacheStorm: select a namespace by name
+	rdbOpcodeState         = 0xE2 // CacheStorm: state of a StateProvider
+	rdbOpcodeFunction2     = 0xF5
+	rdbOpcodeFunctionPreGA = 0xF6
+	rdbOpcodeModuleAux     = 0xF7
+	rdbOpcodeIdle          = 0xF8
+	rdbOpcodeFreq          = 0xF9
+	rdbOpcodeAux           = 0xFA
+	rdbOpcodeResizeDB      = 0xFB
+	rdbOpcodeExpireTimeMS  = 0xFC
+	rdbOpcodeExpireTime    = 0xFD
+	rdbOpcodeSelectDB      = 0xFE
+	rdbOpcodeEOF           = 0xFF
+
+	rdbLen32 = 0x80
+	rdbLen64 = 0x81
+
+	rdbEncInt8  = 0
+	rdbEncInt16 = 1
+	rdbEncInt32 = 2
+	rdbEncLZF   = 3
+
+	// Strings up to this length are never worth compressing.
+	rdbCompressMinLen = 20
+	// Same as Redis' proto-max-bulk-len; anything longer is corruption.
+	rdbMaxStringLen = 512 << 20
+
+	// Aux field marking files written by CacheStorm in its native format.
+	// Files without it come from Redis or from a RedisCompatible writer.
+	rdbAuxFormat = "cachestorm-format"
+	// Aux field of a full resync's payload: the database the replication
+	// stream has selected where the payload leaves off, as Redis names it.
+	rdbAuxReplStreamDB = "repl-stream-db"
+)
+
+var errRDBUnexpectedEOF = errors.New("unexpected end of RDB file")
+
 type RDBConfig struct {
 	Version     RDBVersion
 	Compression bool
 	Checksum    bool
+	// RedisCompatible writes a file stock Redis can load: no tags, geo sets
+	// as sorted sets of geohash scores, streams as listpacks, and only the
+	// numbered databases. Keys with no Redis equivalent are skipped.
+	RedisCompatible bool
+	// ReplStreamDB is the namespace the replication stream has selected at
+	// the snapshot, for the payload of a full resync. A replica continuing
+	// its master's stream has no SELECT to go by until the next one.
+	ReplStreamDB string
 }
 
 type RDBWriter struct {
 	config RDBConfig
 	store  *store.Store
 	mu     sync.Mutex
+
+	// sorted writes the members of hashes, sets, sorted sets and geo sets
+	// in order, so that a key's encoding only changes with its contents.
+	sorted bool
+	// filter, when set, is handed each key of the snapshot encoded as it
+	// would be written, and decides whether it is.
+	filter func(db, key string, encoded []byte) bool
 }
 
 func NewRDBWriter(s *store.Store, cfg RDBConfig) *RDBWriter {
+	if cfg.Version == 0 {
+		cfg.Version = RDBVersion11
+	}
 	return &RDBWriter{
 		config: cfg,
 		store:  s,
 	}
 }
 
+// Save writes a snapshot of the store to path, replacing any file there only
+// once the new one is complete.
 func (w *RDBWriter) Save(path string) error {
+	snap := w.store.Snapshot()
+	defer snap.Release()
+	return w.SaveSnapshot(path, snap)
+}
+
+// SaveSnapshot writes snap, taken from the writer's store, to path. Taking
+// the snapshot separately lets a background save record the moment it
+// started from. Registered states are saved as they are now.
+func (w *RDBWriter) SaveSnapshot(path string, snap *store.Snapshot) error {
+	states, err := captureStates()
+	if err != nil {
+		return err
+	}
+	return w.saveSnapshot(path, snap, states)
+}
+
+// WriteSnapshot writes snap, taken from the writer's store, to f instead of
+// a file, such as to a replica being resynchronized. Registered states are
+// written as they are now.
+func (w *RDBWriter) WriteSnapshot(f io.Writer, snap *store.Snapshot) error {
+	states, err := captureStates()
+	if err != nil {
+		return err
+	}
+	return w.writeSnapshot(f, snap, states)
+}
+
+// saveSnapshot writes snap and the states captured with it to path.
+func (w *RDBWriter) saveSnapshot(path string, snap *store.Snapshot, states []savedState) error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
@@ -58,7 +153,11 @@ func (w *RDBWriter) Save(path string) error {
 		return fmt.Errorf("failed to create file: %v", err)
 	}
 
-	if err := w.writeRDB(f); err != nil {
+	bw := bufio.NewWriter(f)
+	if err := w.writeSnapshot(bw, snap, states); err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
 		f.Close()
 		os.Remove(tempPath)
 		return err
@@ -84,16 +183,37 @@ func (w *RDBWriter) Save(path string) error {
 	return nil
 }
 
+// writeRDB writes a complete snapshot to f.
 func (w *RDBWriter) writeRDB(f io.Writer) error {
-	if err := w.writeHeader(f); err != nil {
+	snap := w.store.Snapshot()
+	defer snap.Release()
+	states, err := captureStates()
+	if err != nil {
 		return err
 	}
+	return w.writeSnapshot(f, snap, states)
+}
 
-	if err := w.writeDatabase(f, 0); err != nil {
+// writeSnapshot writes snap and states to f. Everything up to and including
+// the EOF opcode is covered by the checksum written by writeEnd.
+func (w *RDBWriter) writeSnapshot(f io.Writer, snap *store.Snapshot, states []savedState) error {
+	cw := &crcWriter{w: f}
+
+	if err := w.writeHeader(cw); err != nil {
 		return err
 	}
 
-	if err := w.writeEnd(f); err != nil {
+	for _, db := range w.databases(snap) {
+		if err := w.writeDatabase(cw, db); err != nil {
+			return err
+		}
+	}
+
+	if err := w.writeStates(cw, states); err != nil {
+		return err
+	}
+
+	if err := w.writeEnd(cw); err != nil {
 		return err
 	}
 
@@ -115,6 +235,21 @@ func (w *RDBWriter) writeHeader(f io.Writer) error {
 		{"ctime", fmt.Sprintf("%d", time.Now().Unix())},
 		{"used-mem", fmt.Sprintf("%d", w.store.MemUsage())},
 	}
+	if !w.config.RedisCompatible {
+		auxFields = append(auxFields, struct {
+			key   string
+			value string
+		}{rdbAuxFormat, "1"})
+	}
+	if ns := w.config.ReplStreamDB; ns != "" {
+		if index, numbered := store.NamespaceDB(ns); numbered {
+			ns = strconv.Itoa(index)
+		}
+		auxFields = append(auxFields, struct {
+			key   string
+			value string
+		}{rdbAuxReplStreamDB, ns})
+	}
 
 	for _, aux := range auxFields {
 		if err := w.writeAuxField(f, aux.key, aux.value); err != nil {
@@ -126,7 +261,7 @@ func (w *RDBWriter) writeHeader(f io.Writer) error {
 }
 
 func (w *RDBWriter) writeAuxField(f io.Writer, key, value string) error {
-	if err := w.writeByte(f, 0xFA); err != nil {
+	if err := w.writeByte(f, rdbOpcodeAux); err != nil {
 		return err
 	}
 	if err := w.writeString(f, key); err != nil {
@@ -135,46 +270,129 @@ func (w *RDBWriter) writeAuxField(f io.Writer, key, value string) error {
 	return w.writeString(f, value)
 }
 
-func (w *RDBWriter) writeDatabase(f io.Writer, db int) error {
-	if err := w.writeByte(f, 0xFE); err != nil {
-		return err
+// databases orders the keyspaces of snap for writing: the default one
+// first, then the numbered databases in order and the other namespaces by
+// name. Namespaces other than the default one are left out when empty.
+func (w *RDBWriter) databases(snap *store.Snapshot) []*store.SnapshotDB {
+	root := store.DBNamespace(0)
+	dbs := make([]*store.SnapshotDB, 0, len(snap.Databases()))
+	for _, db := range snap.Databases() {
+		if db.Name != root && db.Keys == 0 {
+			continue
+		}
+		if _, numbered := store.NamespaceDB(db.Name); !numbered && w.config.RedisCompatible {
+			logger.Warn().Str("namespace", db.Name).Msg("Redis has no named databases, namespace not exported")
+			continue
+		}
+		dbs = append(dbs, db)
 	}
-	if err := w.writeLength(f, db); err != nil {
-		return err
+	sortDatabases(dbs)
+	return dbs
+}
+
+// sortDatabases puts the default keyspace first, then the numbered
+// databases in order and the other namespaces by name.
+func sortDatabases(dbs []*store.SnapshotDB) {
+	sort.Slice(dbs, func(i, j int) bool {
+		a, aNumbered := store.NamespaceDB(dbs[i].Name)
+		b, bNumbered := store.NamespaceDB(dbs[j].Name)
+		if aNumbered != bNumbered {
+			return aNumbered
+		}
+		if aNumbered {
+			return a < b
+		}
+		return dbs[i].Name < dbs[j].Name
+	})
+}
+
+// writeDatabase writes one keyspace. Namespaces backing a numbered database
+// are selected the way Redis selects databases; others by name. The resize
+// hint only carries the key count, since counting expiries would take a
+// pass over the snapshot.
+func (w *RDBWriter) writeDatabase(f io.Writer, db *store.SnapshotDB) error {
+	if index, numbered := store.NamespaceDB(db.Name); numbered {
+		if err := w.writeByte(f, rdbOpcodeSelectDB); err != nil {
+			return err
+		}
+		if err := w.writeLength(f, index); err != nil {
+			return err
+		}
+	} else {
+		if err := w.writeByte(f, rdbOpcodeNamespace); err != nil {
+			return err
+		}
+		if err := w.writeString(f, db.Name); err != nil {
+			return err
+		}
 	}
 
-	resizeDB := w.store.KeyCount()
-	if err := w.writeByte(f, 0xFB); err != nil {
+	if err := w.writeByte(f, rdbOpcodeResizeDB); err != nil {
 		return err
 	}
-	if err := w.writeLength(f, int(resizeDB)); err != nil {
+	if err := w.writeLength(f, int(db.Keys)); err != nil {
 		return err
 	}
 	if err := w.writeLength(f, 0); err != nil {
 		return err
 	}
 
-	entries := w.store.GetAll()
-	for key, entry := range entries {
-		if entry == nil || entry.IsExpired() {
-			continue
+	skipped := 0
+	var buf bytes.Buffer
+	err := db.Range(func(key string, entry *store.Entry) error {
+		if entry.Value == nil || entry.IsExpired() {
+			return nil
 		}
-
-		if err := w.writeEntry(f, key, entry); err != nil {
+		if w.config.RedisCompatible && !w.hasRedisEncoding(entry.Value) {
+			skipped++
+			return nil
+		}
+		if w.filter == nil {
+			return w.writeEntry(f, key, entry)
+		}
+		buf.Reset()
+		if err := w.writeEntry(&buf, key, entry); err != nil {
 			return err
 		}
+		if !w.filter(db.Name, key, buf.Bytes()) {
+			return nil
+		}
+		_, err := f.Write(buf.Bytes())
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if skipped > 0 {
+		logger.Warn().Str("namespace", db.Name).Int("keys", skipped).Msg("keys with no Redis encoding not exported")
 	}
 
 	return nil
 }
 
+// writeEntry writes one key with its optional tags and expiry, which precede
+// the value type byte the way Redis writes expiries.
 func (w *RDBWriter) writeEntry(f io.Writer, key string, entry *store.Entry) error {
-	if entry.TTL() > 0 {
-		if err := w.writeByte(f, 0xFC); err != nil {
+	if len(entry.Tags) > 0 && !w.config.RedisCompatible {
+		if err := w.writeByte(f, rdbOpcodeTags); err != nil {
+			return err
+		}
+		if err := w.writeLength(f, len(entry.Tags)); err != nil {
+			return err
+		}
+		for _, tag := range entry.Tags {
+			if err := w.writeString(f, tag); err != nil {
+				return err
+			}
+		}
+	}
+
+	if entry.ExpiresAt > 0 {
+		if err := w.writeByte(f, rdbOpcodeExpireTimeMS); err != nil {
 			return err
 		}
 		expiresAt := time.Unix(0, entry.ExpiresAt).UnixMilli()
-		if err := binary.Write(f, binary.LittleEndian, expiresAt); err != nil {
+		if err := w.writeUint64(f, uint64(expiresAt)); err != nil {
 			return err
 		}
 	}
@@ -191,72 +409,42 @@ func (w *RDBWriter) writeEntry(f io.Writer, key string, entry *store.Entry) erro
 	return w.writeValue(f, entry.Value, valueType)
 }
 
-func (w *RDBWriter) getValueType(v store.Value) int {
-	switch v.(type) {
-	case *store.StringValue:
-		return 0
-	case *store.ListValue:
-		return 1
-	case *store.SetValue:
-		return 2
-	case *store.HashValue:
-		return 3
-	case *store.SortedSetValue:
-		return 4
-	default:
-		return 0
+// writeStates writes the state of each provider under its name. Redis has
+// nothing to load them into, so compatible files leave them out.
+func (w *RDBWriter) writeStates(f io.Writer, states []savedState) error {
+	if w.config.RedisCompatible {
+		if len(states) > 0 {
+			logger.Warn().Int("states", len(states)).Msg("Redis cannot load subsystem state, not exported")
+		}
+		return nil
 	}
-}
-
-func (w *RDBWriter) writeValue(f io.Writer, v store.Value, valueType int) error {
-	switch vt := v.(type) {
-	case *store.StringValue:
-		return w.writeString(f, string(vt.Data))
-	case *store.ListValue:
-		items := vt.Elements
-		if err := w.writeLength(f, len(items)); err != nil {
+	for _, s := range states {
+		if err := w.writeByte(f, rdbOpcodeState); err != nil {
 			return err
 		}
-		for _, item := range items {
-			if err := w.writeString(f, string(item)); err != nil {
-				return err
-			}
-		}
-	case *store.SetValue:
-		members := vt.Members
-		if err := w.writeLength(f, len(members)); err != nil {
+		if err := w.writeString(f, s.name); err != nil {
 			return err
 		}
-		for member := range members {
-			if err := w.writeString(f, member); err != nil {
-				return err
-			}
-		}
-	case *store.HashValue:
-		fields := vt.Fields
-		if err := w.writeLength(f, len(fields)); err != nil {
+		if err := w.writeBytes(f, s.data); err != nil {
 			return err
 		}
-		for field, value := range fields {
-			if err := w.writeString(f, field); err != nil {
-				return err
-			}
-			if err := w.writeString(f, string(value)); err != nil {
-				return err
-			}
-		}
-	default:
-		return w.writeString(f, v.String())
 	}
 	return nil
 }
 
+// writeEnd writes the EOF opcode and the checksum of the file so far, or
+// zeros when checksums are disabled or f does not track one.
 func (w *RDBWriter) writeEnd(f io.Writer) error {
-	if err := w.writeByte(f, 0xFF); err != nil {
+	if err := w.writeByte(f, rdbOpcodeEOF); err != nil {
 		return err
 	}
 
+	var crc uint64
+	if cw, ok := f.(*crcWriter); ok && w.config.Checksum {
+		crc = cw.crc
+	}
 	checksum := make([]byte, 8)
+	binary.LittleEndian.PutUint64(checksum, crc)
 	_, err := f.Write(checksum)
 	return err
 }
@@ -266,38 +454,104 @@ func (w *RDBWriter) writeByte(f io.Writer, b byte) error {
 	return err
 }
 
+func (w *RDBWriter) writeUint64(f io.Writer, v uint64) error {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, v)
+	_, err := f.Write(buf)
+	return err
+}
+
+func (w *RDBWriter) writeFloat64(f io.Writer, v float64) error {
+	return w.writeUint64(f, math.Float64bits(v))
+}
+
 func (w *RDBWriter) writeLength(f io.Writer, length int) error {
-	if length < 64 {
+	switch {
+	case length < 1<<6:
 		return w.writeByte(f, byte(length))
-	} else if length < 16384 {
-		buf := make([]byte, 2)
-		buf[0] = byte((length >> 8) | 0x40)
-		buf[1] = byte(length & 0xFF)
+	case length < 1<<14:
+		_, err := f.Write([]byte{byte(length>>8) | 0x40, byte(length)})
+		return err
+	case length <= math.MaxUint32:
+		buf := make([]byte, 5)
+		buf[0] = rdbLen32
+		binary.BigEndian.PutUint32(buf[1:], uint32(length))
 		_, err := f.Write(buf)
 		return err
-	} else {
-		buf := make([]byte, 4)
-		buf[0] = byte((length >> 24) | 0x80)
-		buf[1] = byte((length >> 16) & 0xFF)
-		buf[2] = byte((length >> 8) & 0xFF)
-		buf[3] = byte(length & 0xFF)
+	default:
+		buf := make([]byte, 9)
+		buf[0] = rdbLen64
+		binary.BigEndian.PutUint64(buf[1:], uint64(length))
 		_, err := f.Write(buf)
 		return err
 	}
 }
 
 func (w *RDBWriter) writeString(f io.Writer, s string) error {
-	length := len(s)
-	if err := w.writeLength(f, length); err != nil {
+	return w.writeBytes(f, []byte(s))
+}
+
+// writeBytes writes b as an RDB string: integer encoded when b is the
+// canonical form of a 32-bit integer, LZF compressed when compression is on
+// and pays off, raw otherwise.
+func (w *RDBWriter) writeBytes(f io.Writer, b []byte) error {
+	if len(b) > 0 && len(b) <= 11 {
+		if n, err := strconv.ParseInt(string(b), 10, 32); err == nil && strconv.FormatInt(n, 10) == string(b) {
+			return w.writeInt(f, n)
+		}
+	}
+
+	if w.config.Compression && len(b) > rdbCompressMinLen {
+		if compressed := lzfCompress(b); compressed != nil {
+			if err := w.writeByte(f, 0xC0|rdbEncLZF); err != nil {
+				return err
+			}
+			if err := w.writeLength(f, len(compressed)); err != nil {
+				return err
+			}
+			if err := w.writeLength(f, len(b)); err != nil {
+				return err
+			}
+			_, err := f.Write(compressed)
+			return err
+		}
+	}
+
+	if err := w.writeLength(f, len(b)); err != nil {
 		return err
 	}
-	_, err := f.Write([]byte(s))
+	_, err := f.Write(b)
 	return err
 }
 
+func (w *RDBWriter) writeInt(f io.Writer, n int64) error {
+	switch {
+	case n >= math.MinInt8 && n <= math.MaxInt8:
+		_, err := f.Write([]byte{0xC0 | rdbEncInt8, byte(n)})
+		return err
+	case n >= math.MinInt16 && n <= math.MaxInt16:
+		buf := []byte{0xC0 | rdbEncInt16, 0, 0}
+		binary.LittleEndian.PutUint16(buf[1:], uint16(n))
+		_, err := f.Write(buf)
+		return err
+	default:
+		buf := []byte{0xC0 | rdbEncInt32, 0, 0, 0, 0}
+		binary.LittleEndian.PutUint32(buf[1:], uint32(n))
+		_, err := f.Write(buf)
+		return err
+	}
+}
+
 type RDBReader struct {
 	store *store.Store
 	mu    sync.Mutex
+
+	// keepStates leaves the registered states alone on load and keeps the
+	// ones read in states instead.
+	keepStates bool
+	states     []savedState
+	// replStreamDB is the namespace of the last snapshot's repl-stream-db.
+	replStreamDB string
 }
 
 func NewRDBReader(s *store.Store) *RDBReader {
@@ -306,7 +560,56 @@ func NewRDBReader(s *store.Store) *RDBReader {
 	}
 }
 
+// rdbEntry is a key decoded from a snapshot, held back until the whole file
+// has been read and its checksum verified.
+type rdbEntry struct {
+	db       string // namespace
+	key      string
+	value    store.Value
+	expireAt int64 // unix milliseconds, 0 when the key does not expire
+	tags     []string
+}
+
+// rdbLoad is what loading a snapshot does to the keys already in the store.
+type rdbLoad int
+
+const (
+	loadReplace    rdbLoad = iota // empty the databases the snapshot selects
+	loadMerge                     // keep the existing keys
+	loadReplaceAll                // empty every database
+)
+
+// Load replaces the databases present in the file with its contents. Both
+// CacheStorm snapshots and Redis dump files are accepted.
 func (r *RDBReader) Load(path string) error {
+	return r.load(path, loadReplace)
+}
+
+// LoadMerge adds the contents of the file to the store without emptying it
+// first. Keys in the file replace existing keys of the same name.
+func (r *RDBReader) LoadMerge(path string) error {
+	return r.load(path, loadMerge)
+}
+
+// ReplaceFrom reads a snapshot from rd, such as the payload of a full
+// resynchronization, and makes it the whole dataset: the databases it does
+// not mention end up empty too. rd must end where the snapshot does, as
+// the reader buffers ahead of what it decodes.
+func (r *RDBReader) ReplaceFrom(rd io.Reader) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.readRDB(rd, loadReplaceAll)
+}
+
+// ReplStreamDB returns the namespace the replication stream had selected
+// where the snapshot last loaded leaves off, or "" if it does not say.
+func (r *RDBReader) ReplStreamDB() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.replStreamDB
+}
+
+func (r *RDBReader) load(path string, mode rdbLoad) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
@@ -316,7 +619,7 @@ func (r *RDBReader) Load(path string) error {
 	}
 	defer f.Close()
 
-	if err := r.readRDB(f); err != nil {
+	if err := r.readRDB(f, mode); err != nil {
 		return err
 	}
 
@@ -324,9 +627,17 @@ func (r *RDBReader) Load(path string) error {
 	return nil
 }
 
-func (r *RDBReader) readRDB(f io.Reader) error {
+// readRDB decodes a snapshot and, once the checksum matches, loads it as
+// the mode says: replacing the databases it selects or all of them, or
+// adding to them when merging. The
+// registered states it holds replace the current ones; without merging,
+// the states it lacks are emptied. A file that fails to decode leaves the
+// store alone.
+func (r *RDBReader) readRDB(f io.Reader, mode rdbLoad) error {
+	cr := &crcReader{r: bufio.NewReader(f)}
+
 	header := make([]byte, 9)
-	if _, err := io.ReadFull(f, header); err != nil {
+	if _, err := io.ReadFull(cr, header); err != nil {
 		return fmt.Errorf("failed to read header: %v", err)
 	}
 
@@ -344,142 +655,205 @@ func (r *RDBReader) readRDB(f io.Reader) error {
 		return fmt.Errorf("unsupported RDB version: %d", version)
 	}
 
+	var (
+		entries  []rdbEntry
+		selected = make(map[string]bool)
+		db       = store.DBNamespace(0)
+		native   bool
+		streamDB string
+		expireAt int64
+		tags     []string
+		states   []savedState
+	)
+
 	for {
-		opcode, err := r.readByte(f)
+		opcode, err := r.readByte(cr)
 		if err != nil {
 			if err == io.EOF {
-				break
+				return errRDBUnexpectedEOF
 			}
 			return err
 		}
 
 		switch opcode {
-		case 0xFA:
-			key, err := r.readString(f)
+		case rdbOpcodeAux:
+			key, err := r.readString(cr)
 			if err != nil {
 				return err
 			}
-			value, err := r.readString(f)
+			value, err := r.readString(cr)
 			if err != nil {
 				return err
 			}
-			_ = key
-			_ = value
+			switch key {
+			case rdbAuxFormat:
+				native = true
+			case rdbAuxReplStreamDB:
+				streamDB = value
+				if index, err := strconv.Atoi(value); err == nil {
+					streamDB = store.DBNamespace(index)
+				}
+			}
 
-		case 0xFB:
-			_, err := r.readLength(f)
-			if err != nil {
+		case rdbOpcodeModuleAux:
+			if err := r.skipModuleAux(cr); err != nil {
 				return err
 			}
-			_, err = r.readLength(f)
-			if err != nil {
+
+		case rdbOpcodeFunction2:
+			if _, err := r.readBytes(cr); err != nil {
 				return err
 			}
+			logger.Warn().Msg("RDB contains a function library, skipped")
 
-		case 0xFE:
-			r.store.Flush()
+		case rdbOpcodeFunctionPreGA:
+			return fmt.Errorf("pre-release function format is not supported")
 
-		case 0xFC:
-			var expiresAt int64
-			if err := binary.Read(f, binary.LittleEndian, &expiresAt); err != nil {
+		case rdbOpcodeIdle:
+			if _, err := r.readLength64(cr); err != nil {
 				return err
 			}
-			_ = expiresAt
 
-		case 0xFD:
-			var expiresAt uint32
-			if err := binary.Read(f, binary.LittleEndian, &expiresAt); err != nil {
+		case rdbOpcodeFreq:
+			if _, err := r.readByte(cr); err != nil {
 				return err
 			}
-			_ = expiresAt
-
-		case 0xFF:
-			return nil
 
-		default:
-			if err := r.readEntry(f, opcode); err != nil {
+		case rdbOpcodeResizeDB:
+			if _, err := r.readLength(cr); err != nil {
+				return err
+			}
+			if _, err := r.readLength(cr); err != nil {
 				return err
 			}
-		}
-	}
 
-	return nil
-}
+		case rdbOpcodeSelectDB:
+			index, err := r.readLength(cr)
+			if err != nil {
+				return err
+			}
+			db = store.DBNamespace(index)
+			selected[db] = true
 
-func (r *RDBReader) readEntry(f io.Reader, valueType byte) error {
-	key, err := r.readString(f)
-	if err != nil {
-		return err
-	}
+		case rdbOpcodeNamespace:
+			if db, err = r.readString(cr); err != nil {
+				return err
+			}
+			selected[db] = true
 
-	var value store.Value
+		case rdbOpcodeExpireTimeMS:
+			ms, err := r.readUint64(cr)
+			if err != nil {
+				return err
+			}
+			expireAt = int64(ms)
 
-	switch valueType {
-	case 0:
-		strVal, err := r.readString(f)
-		if err != nil {
-			return err
-		}
-		value = &store.StringValue{Data: []byte(strVal)}
+		case rdbOpcodeExpireTime:
+			var secs uint32
+			if err := binary.Read(cr, binary.LittleEndian, &secs); err != nil {
+				return err
+			}
+			expireAt = int64(secs) * 1000
 
-	case 1:
-		length, err := r.readLength(f)
-		if err != nil {
-			return err
-		}
-		items := make([][]byte, length)
-		for i := 0; i < length; i++ {
-			item, err := r.readString(f)
+		case rdbOpcodeState:
+			name, err := r.readString(cr)
 			if err != nil {
 				return err
 			}
-			items[i] = []byte(item)
-		}
-		value = &store.ListValue{Elements: items}
-
-	case 2:
-		length, err := r.readLength(f)
-		if err != nil {
-			return err
-		}
-		members := make(map[string]struct{})
-		for i := 0; i < length; i++ {
-			member, err := r.readString(f)
+			data, err := r.readBytes(cr)
 			if err != nil {
 				return err
 			}
-			members[member] = struct{}{}
-		}
-		value = &store.SetValue{Members: members}
+			states = append(states, savedState{name: name, data: data})
 
-	case 3:
-		length, err := r.readLength(f)
-		if err != nil {
-			return err
-		}
-		fields := make(map[string][]byte)
-		for i := 0; i < length; i++ {
-			field, err := r.readString(f)
+		case rdbOpcodeTags:
+			n, err := r.readLength(cr)
 			if err != nil {
 				return err
 			}
-			val, err := r.readString(f)
+			tags = make([]string, 0, min(n, 64))
+			for i := 0; i < n; i++ {
+				tag, err := r.readString(cr)
+				if err != nil {
+					return err
+				}
+				tags = append(tags, tag)
+			}
+
+		case rdbOpcodeEOF:
+			computed := cr.crc
+			var stored uint64
+			if err := binary.Read(cr.r, binary.LittleEndian, &stored); err != nil {
+				return fmt.Errorf("failed to read checksum: %v", err)
+			}
+			// A zero checksum means the writer had checksums disabled.
+			if stored != 0 && stored != computed {
+				return fmt.Errorf("wrong RDB checksum: expected %016x, got %016x", stored, computed)
+			}
+			if err := r.apply(entries, selected, mode); err != nil {
+				return err
+			}
+			r.replStreamDB = streamDB
+			if r.keepStates {
+				r.states = states
+				return nil
+			}
+			return restoreStates(states, mode != loadMerge)
+
+		default:
+			key, err := r.readString(cr)
 			if err != nil {
 				return err
 			}
-			fields[field] = []byte(val)
+			value, err := r.readValue(cr, opcode)
+			if err != nil {
+				return fmt.Errorf("failed to read key %q: %v", key, err)
+			}
+			switch sv := value.(type) {
+			case nil:
+				logger.Warn().Str("key", key).Msg("RDB key holds a Redis module value, skipped")
+			case *store.StringValue:
+				if !native {
+					value = fromRedisString(sv.Data)
+				}
+			}
+			if value != nil {
+				entries = append(entries, rdbEntry{db: db, key: key, value: value, expireAt: expireAt, tags: tags})
+			}
+			expireAt, tags = 0, nil
 		}
-		value = &store.HashValue{Fields: fields}
+	}
+}
 
-	default:
-		strVal, err := r.readString(f)
-		if err != nil {
-			return err
+// apply loads decoded entries into the store, first emptying the databases
+// the mode says to. Keys that expired while on disk are dropped.
+func (r *RDBReader) apply(entries []rdbEntry, selected map[string]bool, mode rdbLoad) error {
+	switch mode {
+	case loadReplace:
+		for db := range selected {
+			r.store.ForNamespace(db).Flush()
+		}
+	case loadReplaceAll:
+		if nm := r.store.GetNamespaceManager(); nm != nil {
+			nm.FlushAll()
+		} else {
+			r.store.Flush()
 		}
-		value = &store.StringValue{Data: []byte(strVal)}
 	}
 
-	r.store.Set(key, value, store.SetOptions{})
+	now := time.Now()
+	for _, e := range entries {
+		opts := store.SetOptions{Tags: e.tags}
+		if e.expireAt > 0 {
+			opts.TTL = time.UnixMilli(e.expireAt).Sub(now)
+			if opts.TTL <= 0 {
+				continue
+			}
+		}
+		if err := r.store.ForNamespace(e.db).Set(e.key, e.value, opts); err != nil {
+			return fmt.Errorf("failed to load key %q: %v", e.key, err)
+		}
+	}
 	return nil
 }
 
@@ -489,183 +863,152 @@ func (r *RDBReader) readByte(f io.Reader) (byte, error) {
 	return buf[0], err
 }
 
-func (r *RDBReader) readLength(f io.Reader) (int, error) {
-	b, err := r.readByte(f)
-	if err != nil {
+func (r *RDBReader) readUint64(f io.Reader) (uint64, error) {
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(f, buf); err != nil {
 		return 0, err
 	}
+	return binary.LittleEndian.Uint64(buf), nil
+}
 
-	encType := (b & 0xC0) >> 6
-
-	switch encType {
-	case 0:
-		return int(b & 0x3F), nil
-	case 1:
-		b2, err := r.readByte(f)
-		if err != nil {
-			return 0, err
-		}
-		return int(b&0x3F)<<8 | int(b2), nil
-	case 2:
-		buf := make([]byte, 4)
-		if _, err := io.ReadFull(f, buf); err != nil {
-			return 0, err
-		}
-		return int(buf[0])<<24 | int(buf[1])<<16 | int(buf[2])<<8 | int(buf[3]), nil
-	default:
-		return 0, fmt.Errorf("unsupported length encoding: %d", encType)
-	}
+func (r *RDBReader) readFloat64(f io.Reader) (float64, error) {
+	bits, err := r.readUint64(f)
+	return math.Float64frombits(bits), err
 }
 
-func (r *RDBReader) readString(f io.Reader) (string, error) {
-	length, err := r.readLength(f)
+func (r *RDBReader) readLength(f io.Reader) (int, error) {
+	length, encoded, err := r.readLengthEnc(f)
 	if err != nil {
-		return "", err
+		return 0, err
 	}
-
-	buf := make([]byte, length)
-	if _, err := io.ReadFull(f, buf); err != nil {
-		return "", err
+	if encoded {
+		return 0, fmt.Errorf("unexpected string encoding %d in length", length)
 	}
-
-	return string(buf), nil
+	return length, nil
 }
 
-type PersistenceManager struct {
-	store     *store.Store
-	config    Config
-	rdbWriter *RDBWriter
-	rdbReader *RDBReader
-	lastSave  time.Time
-	dirty     int64
-	stopCh    chan struct{}
-	wg        sync.WaitGroup
-	mu        sync.Mutex
-}
-
-type Config struct {
-	DataDir        string
-	RDBEnabled     bool
-	RDBFilename    string
-	RDBInterval    time.Duration
-	AOFRewriteSize int64
+// readLength64 reads a length that may use all 64 bits, such as a stream ID
+// part or a module ID.
+func (r *RDBReader) readLength64(f io.Reader) (uint64, error) {
+	n, encoded, err := r.readLengthRaw(f)
+	if err != nil {
+		return 0, err
+	}
+	if encoded {
+		return 0, fmt.Errorf("unexpected string encoding %d in length", n)
+	}
+	return n, nil
 }
 
-func NewPersistenceManager(s *store.Store, cfg Config) *PersistenceManager {
-	pm := &PersistenceManager{
-		store:  s,
-		config: cfg,
-		stopCh: make(chan struct{}),
+// readLengthEnc reads a length, or a string encoding type when the top two
+// bits are set, in which case encoded is true.
+func (r *RDBReader) readLengthEnc(f io.Reader) (length int, encoded bool, err error) {
+	n, encoded, err := r.readLengthRaw(f)
+	if err != nil {
+		return 0, false, err
 	}
-
-	pm.rdbWriter = NewRDBWriter(s, RDBConfig{
-		Version:     RDBVersion11,
-		Compression: false,
-		Checksum:    true,
-	})
-	pm.rdbReader = NewRDBReader(s)
-
-	return pm
+	if n > math.MaxInt32 {
+		return 0, false, fmt.Errorf("length %d out of range", n)
+	}
+	return int(n), encoded, nil
 }
 
-func (pm *PersistenceManager) Start() error {
-	if pm.config.RDBEnabled {
-		pm.wg.Add(1)
-		go pm.autoSaveLoop()
+func (r *RDBReader) readLengthRaw(f io.Reader) (length uint64, encoded bool, err error) {
+	b, err := r.readByte(f)
+	if err != nil {
+		return 0, false, err
 	}
 
-	if pm.config.RDBFilename != "" {
-		rdbPath := filepath.Join(pm.config.DataDir, pm.config.RDBFilename)
-		if _, err := os.Stat(rdbPath); err == nil {
-			if err := pm.rdbReader.Load(rdbPath); err != nil {
-				logger.Error().Err(err).Msg("Failed to load RDB file")
+	switch b >> 6 {
+	case 0:
+		return uint64(b & 0x3F), false, nil
+	case 1:
+		b2, err := r.readByte(f)
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(b&0x3F)<<8 | uint64(b2), false, nil
+	case 2:
+		switch b {
+		case rdbLen32:
+			buf := make([]byte, 4)
+			if _, err := io.ReadFull(f, buf); err != nil {
+				return 0, false, err
+			}
+			return uint64(binary.BigEndian.Uint32(buf)), false, nil
+		case rdbLen64:
+			buf := make([]byte, 8)
+			if _, err := io.ReadFull(f, buf); err != nil {
+				return 0, false, err
 			}
+			return binary.BigEndian.Uint64(buf), false, nil
 		}
+		return 0, false, fmt.Errorf("unsupported length encoding: %#x", b)
+	default:
+		return uint64(b & 0x3F), true, nil
 	}
-
-	return nil
 }
 
-func (pm *PersistenceManager) Stop() {
-	close(pm.stopCh)
-	pm.wg.Wait()
-
-	pm.mu.Lock()
-	if pm.dirty > 0 {
-		pm.saveRDB()
-	}
-	pm.mu.Unlock()
+func (r *RDBReader) readString(f io.Reader) (string, error) {
+	b, err := r.readBytes(f)
+	return string(b), err
 }
 
-func (pm *PersistenceManager) autoSaveLoop() {
-	defer pm.wg.Done()
-
-	interval := pm.config.RDBInterval
-	if interval == 0 {
-		interval = 5 * time.Minute
+func (r *RDBReader) readBytes(f io.Reader) ([]byte, error) {
+	length, encoded, err := r.readLengthEnc(f)
+	if err != nil {
+		return nil, err
 	}
 
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-pm.stopCh:
-			return
-		case <-ticker.C:
-			pm.mu.Lock()
-			if pm.dirty > 0 {
-				pm.saveRDB()
+	if encoded {
+		switch length {
+		case rdbEncInt8:
+			b, err := r.readByte(f)
+			if err != nil {
+				return nil, err
+			}
+			return strconv.AppendInt(nil, int64(int8(b)), 10), nil
+		case rdbEncInt16:
+			var n int16
+			if err := binary.Read(f, binary.LittleEndian, &n); err != nil {
+				return nil, err
+			}
+			return strconv.AppendInt(nil, int64(n), 10), nil
+		case rdbEncInt32:
+			var n int32
+			if err := binary.Read(f, binary.LittleEndian, &n); err != nil {
+				return nil, err
+			}
+			return strconv.AppendInt(nil, int64(n), 10), nil
+		case rdbEncLZF:
+			clen, err := r.readLength(f)
+			if err != nil {
+				return nil, err
+			}
+			ulen, err := r.readLength(f)
+			if err != nil {
+				return nil, err
+			}
+			if clen > rdbMaxStringLen || ulen > rdbMaxStringLen {
+				return nil, fmt.Errorf("string length %d exceeds limit", max(clen, ulen))
+			}
+			compressed := make([]byte, clen)
+			if _, err := io.ReadFull(f, compressed); err != nil {
+				return nil, err
 			}
-			pm.mu.Unlock()
+			return lzfDecompress(compressed, ulen)
+		default:
+			return nil, fmt.Errorf("unknown string encoding: %d", length)
 		}
 	}
-}
 
-func (pm *PersistenceManager) saveRDB() {
-	if pm.config.RDBFilename == "" {
-		return
+	if length > rdbMaxStringLen {
+		return nil, fmt.Errorf("string length %d exceeds limit", length)
 	}
-
-	rdbPath := filepath.Join(pm.config.DataDir, pm.config.RDBFilename)
-	if err := pm.rdbWriter.Save(rdbPath); err != nil {
-		logger.Error().Err(err).Msg("Failed to save RDB file")
-		return
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(f, buf); err != nil {
+		return nil, err
 	}
 
-	pm.dirty = 0
-	pm.lastSave = time.Now()
-}
-
-func (pm *PersistenceManager) BGSAVE() error {
-	pm.mu.Lock()
-	defer pm.mu.Unlock()
-
-	go pm.saveRDB()
-	return nil
-}
-
-func (pm *PersistenceManager) SAVE() error {
-	pm.mu.Lock()
-	defer pm.mu.Unlock()
-
-	return pm.rdbWriter.Save(filepath.Join(pm.config.DataDir, pm.config.RDBFilename))
-}
-
-func (pm *PersistenceManager) LastSave() time.Time {
-	pm.mu.Lock()
-	defer pm.mu.Unlock()
-	return pm.lastSave
-}
-
-func (pm *PersistenceManager) Dirty() int64 {
-	pm.mu.Lock()
-	defer pm.mu.Unlock()
-	return pm.dirty
-}
-
-func (pm *PersistenceManager) MarkDirty() {
-	pm.mu.Lock()
-	defer pm.mu.Unlock()
-	pm.dirty++
+	return buf, nil
 }
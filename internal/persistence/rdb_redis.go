@@ -0,0 +1,1025 @@
+package persistence
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cachestorm/cachestorm/internal/logger"
+	"github.com/cachestorm/cachestorm/internal/store"
+)
+
+// Redis value types CacheStorm only meets in dump files written by Redis.
+// Redis keeps small collections in compact blobs (ziplists, listpacks and
+// intsets) that are saved as a single RDB string; they are unpacked into the
+// plain store values on load.
+const (
+	rdbTypeZSet             = 3
+	rdbTypeModule           = 6
+	rdbTypeModule2          = 7
+	rdbTypeHashZipmap       = 9
+	rdbTypeListZiplist      = 10
+	rdbTypeSetIntset        = 11
+	rdbTypeZSetZiplist      = 12
+	rdbTypeHashZiplist      = 13
+	rdbTypeListQuicklist    = 14
+	rdbTypeStreamListpacks  = 15
+	rdbTypeHashListpack     = 16
+	rdbTypeZSetListpack     = 17
+	rdbTypeListQuicklist2   = 18
+	rdbTypeStreamListpacks2 = 19
+	rdbTypeSetListpack      = 20
+	rdbTypeStreamListpacks3 = 21
+
+	// Module values are a sequence of opcodes, each followed by its payload.
+	rdbModuleOpcodeEOF    = 0
+	rdbModuleOpcodeSInt   = 1
+	rdbModuleOpcodeUInt   = 2
+	rdbModuleOpcodeFloat  = 3
+	rdbModuleOpcodeDouble = 4
+	rdbModuleOpcodeString = 5
+
+	// Quicklist node containers.
+	quicklistNodePlain  = 1
+	quicklistNodePacked = 2
+
+	// Stream entry flags.
+	streamItemDeleted    = 1
+	streamItemSameFields = 2
+
+	// Redis limits geohashes to the latitudes Web Mercator can represent and
+	// stores them with 26 bits per coordinate.
+	redisGeoLatLimit = 85.05112878
+	redisGeoStep     = 26
+)
+
+var errCorruptBlob = errors.New("corrupt ziplist or listpack")
+
+// readRedisValue decodes the Redis value types. Module values are skipped
+// and reported as a nil value.
+func (r *RDBReader) readRedisValue(f io.Reader, valueType byte) (store.Value, error) {
+	switch valueType {
+	case rdbTypeZSet:
+		n, err := r.readLength(f)
+		if err != nil {
+			return nil, err
+		}
+		members := make(map[string]float64, min(n, 1024))
+		for i := 0; i < n; i++ {
+			member, err := r.readString(f)
+			if err != nil {
+				return nil, err
+			}
+			score, err := r.readDoubleString(f)
+			if err != nil {
+				return nil, err
+			}
+			members[member] = score
+		}
+		return &store.SortedSetValue{Members: members}, nil
+
+	case rdbTypeModule2:
+		id, err := r.readLength64(f)
+		if err != nil {
+			return nil, err
+		}
+		if err := r.skipModuleData(f); err != nil {
+			return nil, fmt.Errorf("module %s: %v", moduleName(id), err)
+		}
+		return nil, nil
+
+	case rdbTypeListQuicklist:
+		n, err := r.readLength(f)
+		if err != nil {
+			return nil, err
+		}
+		var items [][]byte
+		for i := 0; i < n; i++ {
+			blob, err := r.readBytes(f)
+			if err != nil {
+				return nil, err
+			}
+			node, err := ziplistEntries(blob)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, node...)
+		}
+		return &store.ListValue{Elements: items}, nil
+
+	case rdbTypeListQuicklist2:
+		n, err := r.readLength(f)
+		if err != nil {
+			return nil, err
+		}
+		var items [][]byte
+		for i := 0; i < n; i++ {
+			container, err := r.readLength(f)
+			if err != nil {
+				return nil, err
+			}
+			blob, err := r.readBytes(f)
+			if err != nil {
+				return nil, err
+			}
+			switch container {
+			case quicklistNodePlain:
+				items = append(items, blob)
+			case quicklistNodePacked:
+				node, err := listpackEntries(blob)
+				if err != nil {
+					return nil, err
+				}
+				items = append(items, node...)
+			default:
+				return nil, fmt.Errorf("unknown quicklist container %d", container)
+			}
+		}
+		return &store.ListValue{Elements: items}, nil
+
+	case rdbTypeStreamListpacks, rdbTypeStreamListpacks2, rdbTypeStreamListpacks3:
+		return r.readRedisStream(f, valueType)
+
+	case rdbTypeModule:
+		return nil, fmt.Errorf("pre-release module values are not supported")
+	case rdbTypeHashZipmap:
+		return nil, fmt.Errorf("zipmap encoded hashes are not supported")
+	}
+
+	// The remaining types are a single blob.
+	blob, err := r.readBytes(f)
+	if err != nil {
+		return nil, err
+	}
+	var elems [][]byte
+	switch valueType {
+	case rdbTypeSetIntset:
+		elems, err = intsetEntries(blob)
+	case rdbTypeListZiplist, rdbTypeZSetZiplist, rdbTypeHashZiplist:
+		elems, err = ziplistEntries(blob)
+	default:
+		elems, err = listpackEntries(blob)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch valueType {
+	case rdbTypeListZiplist:
+		return &store.ListValue{Elements: elems}, nil
+
+	case rdbTypeSetIntset, rdbTypeSetListpack:
+		members := make(map[string]struct{}, len(elems))
+		for _, e := range elems {
+			members[string(e)] = struct{}{}
+		}
+		return &store.SetValue{Members: members}, nil
+
+	case rdbTypeHashZiplist, rdbTypeHashListpack:
+		if len(elems)%2 != 0 {
+			return nil, errCorruptBlob
+		}
+		fields := make(map[string][]byte, len(elems)/2)
+		for i := 0; i < len(elems); i += 2 {
+			fields[string(elems[i])] = elems[i+1]
+		}
+		return &store.HashValue{Fields: fields}, nil
+
+	default: // sorted sets
+		if len(elems)%2 != 0 {
+			return nil, errCorruptBlob
+		}
+		members := make(map[string]float64, len(elems)/2)
+		for i := 0; i < len(elems); i += 2 {
+			score, err := strconv.ParseFloat(string(elems[i+1]), 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid sorted set score %q", elems[i+1])
+			}
+			members[string(elems[i])] = score
+		}
+		return &store.SortedSetValue{Members: members}, nil
+	}
+}
+
+// readDoubleString reads a score of the pre-RDB 8 sorted set type: a length
+// byte and the ASCII number, with three lengths reserved for NaN and the
+// infinities.
+func (r *RDBReader) readDoubleString(f io.Reader) (float64, error) {
+	n, err := r.readByte(f)
+	if err != nil {
+		return 0, err
+	}
+	switch n {
+	case 253:
+		return math.NaN(), nil
+	case 254:
+		return math.Inf(1), nil
+	case 255:
+		return math.Inf(-1), nil
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(f, buf); err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(string(buf), 64)
+}
+
+// skipModuleAux skips the aux data of a Redis module. Nothing CacheStorm
+// serves depends on it.
+func (r *RDBReader) skipModuleAux(f io.Reader) error {
+	id, err := r.readLength64(f)
+	if err != nil {
+		return err
+	}
+	if err := r.skipModuleData(f); err != nil {
+		return fmt.Errorf("module %s aux data: %v", moduleName(id), err)
+	}
+	logger.Warn().Str("module", moduleName(id)).Msg("RDB contains Redis module aux data, skipped")
+	return nil
+}
+
+func (r *RDBReader) skipModuleData(f io.Reader) error {
+	for {
+		opcode, err := r.readLength(f)
+		if err != nil {
+			return err
+		}
+		switch opcode {
+		case rdbModuleOpcodeEOF:
+			return nil
+		case rdbModuleOpcodeSInt, rdbModuleOpcodeUInt:
+			_, err = r.readLength64(f)
+		case rdbModuleOpcodeFloat:
+			_, err = io.CopyN(io.Discard, f, 4)
+		case rdbModuleOpcodeDouble:
+			_, err = io.CopyN(io.Discard, f, 8)
+		case rdbModuleOpcodeString:
+			_, err = r.readBytes(f)
+		default:
+			return fmt.Errorf("unknown module opcode %d", opcode)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// moduleName recovers the nine character type name packed into the top 54
+// bits of a module ID.
+func moduleName(id uint64) string {
+	const charset = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+	name := make([]byte, 9)
+	cid := id >> 10
+	for i := 8; i >= 0; i-- {
+		name[i] = charset[cid&63]
+		cid >>= 6
+	}
+	return string(name)
+}
+
+// readRedisStream reads a stream saved as a radix tree of listpacks. Each
+// node is keyed by its master ID and starts with a master entry listing the
+// node's entry count, deleted count and field names; entries store their ID
+// as a delta from the master ID and either repeat the master fields
+// (SAMEFIELDS) or carry their own.
+func (r *RDBReader) readRedisStream(f io.Reader, valueType byte) (store.Value, error) {
+	stream := store.NewStreamValue(0)
+
+	nodes, err := r.readLength(f)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < nodes; i++ {
+		key, err := r.readBytes(f)
+		if err != nil {
+			return nil, err
+		}
+		if len(key) != 16 {
+			return nil, fmt.Errorf("stream node key of %d bytes", len(key))
+		}
+		blob, err := r.readBytes(f)
+		if err != nil {
+			return nil, err
+		}
+		elems, err := listpackEntries(blob)
+		if err != nil {
+			return nil, err
+		}
+		if err := appendStreamNode(stream, binary.BigEndian.Uint64(key), binary.BigEndian.Uint64(key[8:]), elems); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := r.readLength64(f); err != nil { // length, recomputed below
+		return nil, err
+	}
+	if stream.LastID, err = r.readStreamID(f); err != nil {
+		return nil, err
+	}
+	if valueType >= rdbTypeStreamListpacks2 {
+		// first ID, max deleted ID and entries added
+		for i := 0; i < 5; i++ {
+			if _, err := r.readLength64(f); err != nil {
+				return nil, err
+			}
+		}
+	}
+	stream.Length = int64(len(stream.Entries))
+
+	ngroups, err := r.readLength(f)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < ngroups; i++ {
+		name, err := r.readString(f)
+		if err != nil {
+			return nil, err
+		}
+		g := store.NewConsumerGroup(name)
+		if g.LastID, err = r.readStreamID(f); err != nil {
+			return nil, err
+		}
+		if valueType >= rdbTypeStreamListpacks2 {
+			if _, err := r.readLength64(f); err != nil { // entries read
+				return nil, err
+			}
+		}
+
+		npending, err := r.readLength(f)
+		if err != nil {
+			return nil, err
+		}
+		for j := 0; j < npending; j++ {
+			id, err := r.readRawStreamID(f)
+			if err != nil {
+				return nil, err
+			}
+			delivered, err := r.readUint64(f)
+			if err != nil {
+				return nil, err
+			}
+			deliveries, err := r.readLength64(f)
+			if err != nil {
+				return nil, err
+			}
+			g.Pending[id] = &store.PendingEntry{ID: id, DeliveryTS: int64(delivered), Deliveries: int64(deliveries)}
+		}
+
+		nconsumers, err := r.readLength(f)
+		if err != nil {
+			return nil, err
+		}
+		for j := 0; j < nconsumers; j++ {
+			c := &store.Consumer{Active: true}
+			if c.Name, err = r.readString(f); err != nil {
+				return nil, err
+			}
+			seen, err := r.readUint64(f)
+			if err != nil {
+				return nil, err
+			}
+			c.SeenTime = int64(seen)
+			if valueType >= rdbTypeStreamListpacks3 {
+				if _, err := r.readUint64(f); err != nil { // active time
+					return nil, err
+				}
+			}
+			owned, err := r.readLength(f)
+			if err != nil {
+				return nil, err
+			}
+			for k := 0; k < owned; k++ {
+				id, err := r.readRawStreamID(f)
+				if err != nil {
+					return nil, err
+				}
+				p, ok := g.Pending[id]
+				if !ok {
+					return nil, fmt.Errorf("consumer %q owns %s, which is not pending in group %q", c.Name, id, name)
+				}
+				p.Consumer = c.Name
+				c.Pending++
+			}
+			g.Consumers[c.Name] = c
+		}
+		stream.Groups[name] = g
+	}
+	return stream, nil
+}
+
+// appendStreamNode adds the live entries of one stream listpack node.
+func appendStreamNode(stream *store.StreamValue, masterMS, masterSeq uint64, elems [][]byte) error {
+	lp := &listpackCursor{elems: elems}
+	count := lp.int()
+	deleted := lp.int()
+	nfields := lp.int()
+	if lp.err != nil || nfields < 0 || nfields > int64(len(elems)) {
+		return errCorruptBlob
+	}
+	masterFields := make([]string, nfields)
+	for i := range masterFields {
+		masterFields[i] = string(lp.next())
+	}
+	lp.next() // master entry terminator
+
+	for n := int64(0); n < count+deleted && lp.err == nil; n++ {
+		flags := lp.int()
+		ms := masterMS + uint64(lp.int())
+		seq := masterSeq + uint64(lp.int())
+
+		var fields map[string][]byte
+		if flags&streamItemSameFields != 0 {
+			fields = make(map[string][]byte, nfields)
+			for _, field := range masterFields {
+				fields[field] = lp.next()
+			}
+		} else {
+			own := lp.int()
+			if own < 0 || own > int64(len(elems)) {
+				return errCorruptBlob
+			}
+			fields = make(map[string][]byte, own)
+			for j := int64(0); j < own; j++ {
+				field := lp.next()
+				fields[string(field)] = lp.next()
+			}
+		}
+		lp.next() // entry length, for backward iteration
+
+		if flags&streamItemDeleted != 0 {
+			continue
+		}
+		stream.Entries = append(stream.Entries, &store.StreamEntry{
+			ID:        formatStreamID(ms, seq),
+			Fields:    fields,
+			CreatedAt: time.UnixMilli(int64(ms)),
+		})
+	}
+	return lp.err
+}
+
+func (r *RDBReader) readStreamID(f io.Reader) (string, error) {
+	ms, err := r.readLength64(f)
+	if err != nil {
+		return "", err
+	}
+	seq, err := r.readLength64(f)
+	if err != nil {
+		return "", err
+	}
+	return formatStreamID(ms, seq), nil
+}
+
+// readRawStreamID reads an ID saved as 128 big endian bits, the way Redis
+// saves the IDs of pending entries.
+func (r *RDBReader) readRawStreamID(f io.Reader) (string, error) {
+	buf := make([]byte, 16)
+	if _, err := io.ReadFull(f, buf); err != nil {
+		return "", err
+	}
+	return formatStreamID(binary.BigEndian.Uint64(buf), binary.BigEndian.Uint64(buf[8:])), nil
+}
+
+func formatStreamID(ms, seq uint64) string {
+	return strconv.FormatUint(ms, 10) + "-" + strconv.FormatUint(seq, 10)
+}
+
+func parseStreamID(id string) (ms, seq uint64, err error) {
+	msPart, seqPart, _ := strings.Cut(id, "-")
+	if ms, err = strconv.ParseUint(msPart, 10, 64); err != nil {
+		return 0, 0, fmt.Errorf("invalid stream ID %q", id)
+	}
+	if seqPart != "" {
+		if seq, err = strconv.ParseUint(seqPart, 10, 64); err != nil {
+			return 0, 0, fmt.Errorf("invalid stream ID %q", id)
+		}
+	}
+	return ms, seq, nil
+}
+
+// fromRedisString turns a string from a Redis dump into the value a
+// registered codec recognises in it, or leaves it a string.
+func fromRedisString(data []byte) store.Value {
+	valueCodecs.mu.RLock()
+	defer valueCodecs.mu.RUnlock()
+	for _, c := range valueCodecs.byType {
+		if c.FromRedis == nil {
+			continue
+		}
+		if v, ok := c.FromRedis(data); ok {
+			return v
+		}
+	}
+	return &store.StringValue{Data: data}
+}
+
+// listpackCursor walks decoded listpack elements, remembering the first
+// problem instead of failing every call.
+type listpackCursor struct {
+	elems [][]byte
+	pos   int
+	err   error
+}
+
+func (c *listpackCursor) next() []byte {
+	if c.pos >= len(c.elems) {
+		c.err = errCorruptBlob
+		return nil
+	}
+	e := c.elems[c.pos]
+	c.pos++
+	return e
+}
+
+func (c *listpackCursor) int() int64 {
+	e := c.next()
+	if c.err != nil {
+		return 0
+	}
+	n, err := strconv.ParseInt(string(e), 10, 64)
+	if err != nil {
+		c.err = errCorruptBlob
+	}
+	return n
+}
+
+// ziplistEntries decodes a ziplist: a 10 byte header, then entries made of
+// the previous entry's length, an encoding that holds either a string length
+// or an integer type, and the payload, ending with 0xFF.
+func ziplistEntries(zl []byte) ([][]byte, error) {
+	if len(zl) < 11 {
+		return nil, errCorruptBlob
+	}
+	var out [][]byte
+	p := 10
+	for {
+		if p >= len(zl) {
+			return nil, errCorruptBlob
+		}
+		if zl[p] == 0xFF {
+			return out, nil
+		}
+		if zl[p] < 0xFE {
+			p++
+		} else {
+			p += 5
+		}
+		if p >= len(zl) {
+			return nil, errCorruptBlob
+		}
+
+		enc := zl[p]
+		var (
+			strLen = -1
+			intLen int
+		)
+		switch {
+		case enc>>6 == 0:
+			strLen, p = int(enc&0x3F), p+1
+		case enc>>6 == 1:
+			if p+2 > len(zl) {
+				return nil, errCorruptBlob
+			}
+			strLen, p = int(enc&0x3F)<<8|int(zl[p+1]), p+2
+		case enc>>6 == 2:
+			if p+5 > len(zl) {
+				return nil, errCorruptBlob
+			}
+			strLen, p = int(binary.BigEndian.Uint32(zl[p+1:])), p+5
+		case enc == 0xC0:
+			intLen = 2
+		case enc == 0xD0:
+			intLen = 4
+		case enc == 0xE0:
+			intLen = 8
+		case enc == 0xF0:
+			intLen = 3
+		case enc == 0xFE:
+			intLen = 1
+		case enc >= 0xF1 && enc <= 0xFD:
+			out = append(out, strconv.AppendInt(nil, int64(enc&0x0F)-1, 10))
+			p++
+			continue
+		default:
+			return nil, errCorruptBlob
+		}
+
+		if strLen >= 0 {
+			if strLen > len(zl)-p {
+				return nil, errCorruptBlob
+			}
+			out = append(out, zl[p:p+strLen])
+			p += strLen
+			continue
+		}
+		p++
+		if intLen > len(zl)-p {
+			return nil, errCorruptBlob
+		}
+		out = append(out, strconv.AppendInt(nil, littleEndianInt(zl[p:p+intLen]), 10))
+		p += intLen
+	}
+}
+
+// listpackEntries decodes a listpack: a 6 byte header, then entries made of
+// an encoding, the payload and the entry's length backwards, ending with
+// 0xFF.
+func listpackEntries(lp []byte) ([][]byte, error) {
+	if len(lp) < 7 {
+		return nil, errCorruptBlob
+	}
+	var out [][]byte
+	p := 6
+	for {
+		if p >= len(lp) {
+			return nil, errCorruptBlob
+		}
+		enc := lp[p]
+		if enc == 0xFF {
+			return out, nil
+		}
+
+		var (
+			hdr    int // encoding bytes before the payload
+			strLen = -1
+			elem   []byte
+		)
+		switch {
+		case enc&0x80 == 0:
+			hdr, elem = 1, strconv.AppendInt(nil, int64(enc&0x7F), 10)
+		case enc&0xC0 == 0x80:
+			hdr, strLen = 1, int(enc&0x3F)
+		case enc&0xE0 == 0xC0:
+			if p+2 > len(lp) {
+				return nil, errCorruptBlob
+			}
+			v := int64(enc&0x1F)<<8 | int64(lp[p+1])
+			if v >= 1<<12 {
+				v -= 1 << 13
+			}
+			hdr, elem = 2, strconv.AppendInt(nil, v, 10)
+		case enc&0xF0 == 0xE0:
+			if p+2 > len(lp) {
+				return nil, errCorruptBlob
+			}
+			hdr, strLen = 2, int(enc&0x0F)<<8|int(lp[p+1])
+		case enc == 0xF0:
+			if p+5 > len(lp) {
+				return nil, errCorruptBlob
+			}
+			hdr, strLen = 5, int(binary.LittleEndian.Uint32(lp[p+1:]))
+		case enc >= 0xF1 && enc <= 0xF4:
+			size := [...]int{2, 3, 4, 8}[enc-0xF1]
+			if p+1+size > len(lp) {
+				return nil, errCorruptBlob
+			}
+			hdr, elem = 1+size, strconv.AppendInt(nil, littleEndianInt(lp[p+1:p+1+size]), 10)
+		default:
+			return nil, errCorruptBlob
+		}
+
+		entryLen := hdr
+		if strLen >= 0 {
+			if strLen > len(lp)-p-hdr {
+				return nil, errCorruptBlob
+			}
+			elem = lp[p+hdr : p+hdr+strLen]
+			entryLen += strLen
+		}
+		out = append(out, elem)
+		p += entryLen + listpackBacklenSize(entryLen)
+	}
+}
+
+func listpackBacklenSize(n int) int {
+	switch {
+	case n <= 127:
+		return 1
+	case n < 16383:
+		return 2
+	case n < 2097151:
+		return 3
+	case n < 268435455:
+		return 4
+	default:
+		return 5
+	}
+}
+
+// intsetEntries decodes an intset: the integer width, the count and the
+// sorted integers, all little endian.
+func intsetEntries(is []byte) ([][]byte, error) {
+	if len(is) < 8 {
+		return nil, errCorruptBlob
+	}
+	width := int(binary.LittleEndian.Uint32(is))
+	n := int(binary.LittleEndian.Uint32(is[4:]))
+	if width != 2 && width != 4 && width != 8 || n > (len(is)-8)/width {
+		return nil, errCorruptBlob
+	}
+	out := make([][]byte, n)
+	for i := range out {
+		off := 8 + i*width
+		out[i] = strconv.AppendInt(nil, littleEndianInt(is[off:off+width]), 10)
+	}
+	return out, nil
+}
+
+// littleEndianInt sign-extends a little endian integer of up to 8 bytes.
+func littleEndianInt(b []byte) int64 {
+	var v uint64
+	for i := len(b) - 1; i >= 0; i-- {
+		v = v<<8 | uint64(b[i])
+	}
+	shift := 64 - 8*uint(len(b))
+	return int64(v<<shift) >> shift
+}
+
+// redisValueType maps a value to the Redis type it is exported as.
+func (w *RDBWriter) redisValueType(v store.Value) int {
+	switch v.(type) {
+	case *store.ListValue:
+		return rdbTypeList
+	case *store.SetValue:
+		return rdbTypeSet
+	case *store.HashValue:
+		return rdbTypeHash
+	case *store.SortedSetValue, *store.GeoValue:
+		return rdbTypeZSet2
+	case *store.StreamValue:
+		return rdbTypeStreamListpacks
+	}
+	return rdbTypeString
+}
+
+// hasRedisEncoding reports whether a value can be exported to Redis.
+func (w *RDBWriter) hasRedisEncoding(v store.Value) bool {
+	switch v.(type) {
+	case *store.StringValue, *store.ListValue, *store.SetValue, *store.HashValue,
+		*store.SortedSetValue, *store.GeoValue, *store.StreamValue:
+		return true
+	}
+	c, ok := codecFor(v)
+	return ok && c.ToRedis != nil
+}
+
+// writeRedisGeo writes a geo set the way Redis keeps one: a sorted set
+// scored by the 52 bit interleaved geohash of each point.
+func (w *RDBWriter) writeRedisGeo(f io.Writer, v *store.GeoValue) error {
+	if err := w.writeLength(f, len(v.Points)); err != nil {
+		return err
+	}
+	for member, p := range v.Points {
+		if err := w.writeString(f, member); err != nil {
+			return err
+		}
+		if err := w.writeFloat64(f, float64(redisGeohash(p.Lon, p.Lat))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func redisGeohash(lon, lat float64) uint64 {
+	const cells = 1 << redisGeoStep
+	lat = math.Max(-redisGeoLatLimit, math.Min(redisGeoLatLimit, lat))
+	latCell := min(uint64((lat+redisGeoLatLimit)/(2*redisGeoLatLimit)*cells), cells-1)
+	lonCell := min(uint64((lon+180)/360*cells), cells-1)
+
+	// Latitude bits go in the even positions, longitude in the odd ones.
+	var hash uint64
+	for i := 0; i < redisGeoStep; i++ {
+		hash |= (latCell>>i&1)<<(2*i) | (lonCell>>i&1)<<(2*i+1)
+	}
+	return hash
+}
+
+// writeRedisStream writes a stream in the listpack format of Redis 5, which
+// every later version still loads. Each entry gets a node of its own, so the
+// master entry always lists exactly the entry's fields.
+func (w *RDBWriter) writeRedisStream(f io.Writer, v *store.StreamValue) error {
+	entries := v.GetRange("", "+", 0)
+	if err := w.writeLength(f, len(entries)); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		ms, seq, err := parseStreamID(e.ID)
+		if err != nil {
+			return err
+		}
+		if err := w.writeBytes(f, rawStreamID(ms, seq)); err != nil {
+			return err
+		}
+
+		fields := make([]string, 0, len(e.Fields))
+		for field := range e.Fields {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+
+		var lp listpackBuilder
+		lp.appendInt(1) // count
+		lp.appendInt(0) // deleted
+		lp.appendInt(int64(len(fields)))
+		for _, field := range fields {
+			lp.append([]byte(field))
+		}
+		lp.appendInt(0) // master entry terminator
+		lp.appendInt(streamItemSameFields)
+		lp.appendInt(0) // ms delta
+		lp.appendInt(0) // seq delta
+		for _, field := range fields {
+			lp.append(e.Fields[field])
+		}
+		lp.appendInt(int64(len(fields) + 3))
+		if err := w.writeBytes(f, lp.bytes()); err != nil {
+			return err
+		}
+	}
+
+	if err := w.writeLength(f, len(entries)); err != nil {
+		return err
+	}
+	lastID := v.GetLastID()
+	if lastID == "" {
+		lastID = "0-0"
+	}
+	if err := w.writeStreamID(f, lastID); err != nil {
+		return err
+	}
+
+	groups := v.GetGroups()
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if err := w.writeLength(f, len(names)); err != nil {
+		return err
+	}
+	for _, name := range names {
+		g := groups[name]
+		if err := w.writeString(f, name); err != nil {
+			return err
+		}
+		if err := w.writeStreamID(f, g.LastID); err != nil {
+			return err
+		}
+
+		pending := g.GetPending("-", "+", 0)
+		owned := make(map[string][][]byte)
+		consumers := g.GetAllConsumers()
+		for _, c := range consumers {
+			owned[c] = nil
+		}
+		if err := w.writeLength(f, len(pending)); err != nil {
+			return err
+		}
+		for _, p := range pending {
+			ms, seq, err := parseStreamID(p.ID)
+			if err != nil {
+				return err
+			}
+			raw := rawStreamID(ms, seq)
+			if _, err := f.Write(raw); err != nil {
+				return err
+			}
+			if err := w.writeUint64(f, uint64(p.DeliveryTS)); err != nil {
+				return err
+			}
+			if err := w.writeLength(f, int(p.Deliveries)); err != nil {
+				return err
+			}
+			if _, known := owned[p.Consumer]; !known {
+				consumers = append(consumers, p.Consumer)
+			}
+			owned[p.Consumer] = append(owned[p.Consumer], raw)
+		}
+
+		if err := w.writeLength(f, len(consumers)); err != nil {
+			return err
+		}
+		for _, name := range consumers {
+			var seen int64
+			if c := g.GetConsumer(name); c != nil {
+				seen = c.SeenTime
+			}
+			if err := w.writeString(f, name); err != nil {
+				return err
+			}
+			if err := w.writeUint64(f, uint64(seen)); err != nil {
+				return err
+			}
+			if err := w.writeLength(f, len(owned[name])); err != nil {
+				return err
+			}
+			for _, raw := range owned[name] {
+				if _, err := f.Write(raw); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (w *RDBWriter) writeStreamID(f io.Writer, id string) error {
+	ms, seq, err := parseStreamID(id)
+	if err != nil {
+		return err
+	}
+	if err := w.writeLength(f, int(ms)); err != nil {
+		return err
+	}
+	return w.writeLength(f, int(seq))
+}
+
+func rawStreamID(ms, seq uint64) []byte {
+	raw := make([]byte, 16)
+	binary.BigEndian.PutUint64(raw, ms)
+	binary.BigEndian.PutUint64(raw[8:], seq)
+	return raw
+}
+
+// listpackBuilder encodes a listpack, storing canonical integers in integer
+// form the way Redis does.
+type listpackBuilder struct {
+	body  []byte
+	count int
+}
+
+func (b *listpackBuilder) append(elem []byte) {
+	if len(elem) > 0 && len(elem) <= 20 {
+		if n, err := strconv.ParseInt(string(elem), 10, 64); err == nil && strconv.FormatInt(n, 10) == string(elem) {
+			b.appendInt(n)
+			return
+		}
+	}
+
+	start := len(b.body)
+	switch n := len(elem); {
+	case n < 1<<6:
+		b.body = append(b.body, 0x80|byte(n))
+	case n < 1<<12:
+		b.body = append(b.body, 0xE0|byte(n>>8), byte(n))
+	default:
+		b.body = append(b.body, 0xF0)
+		b.body = binary.LittleEndian.AppendUint32(b.body, uint32(n))
+	}
+	b.body = append(b.body, elem...)
+	b.finish(start)
+}
+
+func (b *listpackBuilder) appendInt(v int64) {
+	start := len(b.body)
+	switch {
+	case v >= 0 && v <= 127:
+		b.body = append(b.body, byte(v))
+	case v >= -4096 && v <= 4095:
+		u := uint64(v) & (1<<13 - 1)
+		b.body = append(b.body, 0xC0|byte(u>>8), byte(u))
+	case v >= math.MinInt16 && v <= math.MaxInt16:
+		b.body = append(b.body, 0xF1)
+		b.body = binary.LittleEndian.AppendUint16(b.body, uint16(v))
+	case v >= -1<<23 && v < 1<<23:
+		b.body = append(b.body, 0xF2, byte(v), byte(v>>8), byte(v>>16))
+	case v >= math.MinInt32 && v <= math.MaxInt32:
+		b.body = append(b.body, 0xF3)
+		b.body = binary.LittleEndian.AppendUint32(b.body, uint32(v))
+	default:
+		b.body = append(b.body, 0xF4)
+		b.body = binary.LittleEndian.AppendUint64(b.body, uint64(v))
+	}
+	b.finish(start)
+}
+
+// finish appends the backwards length of the entry that starts at start:
+// seven bits per byte, most significant first, with the high bit set on all
+// but the first byte.
+func (b *listpackBuilder) finish(start int) {
+	n := len(b.body) - start
+	size := listpackBacklenSize(n)
+	for i := size - 1; i >= 0; i-- {
+		c := byte(n>>(7*uint(i))) & 127
+		if i < size-1 {
+			c |= 128
+		}
+		b.body = append(b.body, c)
+	}
+	b.count++
+}
+
+func (b *listpackBuilder) bytes() []byte {
+	total := 6 + len(b.body) + 1
+	out := make([]byte, 6, total)
+	binary.LittleEndian.PutUint32(out, uint32(total))
+	binary.LittleEndian.PutUint16(out[4:], uint16(min(b.count, math.MaxUint16)))
+	out = append(out, b.body...)
+	return append(out, 0xFF)
+}
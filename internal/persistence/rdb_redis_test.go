@@ -0,0 +1,404 @@
+package persistence
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cachestorm/cachestorm/internal/store"
+)
+
+// redisDump builds an RDB file byte by byte the way Redis lays one out.
+type redisDump struct {
+	w   *RDBWriter
+	buf bytes.Buffer
+}
+
+func newRedisDump() *redisDump {
+	d := &redisDump{w: NewRDBWriter(store.NewStore(), RDBConfig{})}
+	d.buf.WriteString("REDIS0011")
+	d.op(rdbOpcodeAux)
+	d.str("redis-ver")
+	d.str("7.2.4")
+	return d
+}
+
+func (d *redisDump) op(b byte)          { d.buf.WriteByte(b) }
+func (d *redisDump) raw(b ...byte)      { d.buf.Write(b) }
+func (d *redisDump) length(n int)       { _ = d.w.writeLength(&d.buf, n) }
+func (d *redisDump) str(s string)       { _ = d.w.writeString(&d.buf, s) }
+func (d *redisDump) blob(b []byte)      { _ = d.w.writeBytes(&d.buf, b) }
+func (d *redisDump) uint64(v uint64)    { _ = d.w.writeUint64(&d.buf, v) }
+func (d *redisDump) streamID(id uint64) { d.length(int(id)); d.length(0) }
+
+func (d *redisDump) key(valueType byte, key string) {
+	d.op(valueType)
+	d.str(key)
+}
+
+func (d *redisDump) load(t *testing.T, s *store.Store) {
+	t.Helper()
+	d.op(rdbOpcodeEOF)
+	d.raw(0, 0, 0, 0, 0, 0, 0, 0)
+	if err := NewRDBReader(s).readRDB(bytes.NewReader(d.buf.Bytes()), loadReplace); err != nil {
+		t.Fatalf("readRDB: %v", err)
+	}
+}
+
+// testZiplist encodes items the way Redis 6 does: small integers as
+// immediates, other integers as int16 and everything else as short strings.
+func testZiplist(items ...string) []byte {
+	var body []byte
+	prev := 0
+	for _, item := range items {
+		start := len(body)
+		body = append(body, byte(prev))
+		if n, err := strconv.ParseInt(item, 10, 16); err == nil && n >= 0 && n <= 12 {
+			body = append(body, 0xF1+byte(n))
+		} else if err == nil {
+			body = append(body, 0xC0)
+			body = binary.LittleEndian.AppendUint16(body, uint16(n))
+		} else {
+			body = append(body, byte(len(item)))
+			body = append(body, item...)
+		}
+		prev = len(body) - start
+	}
+	zl := make([]byte, 10, 10+len(body)+1)
+	binary.LittleEndian.PutUint32(zl, uint32(10+len(body)+1))
+	binary.LittleEndian.PutUint32(zl[4:], uint32(10+len(body)-prev))
+	binary.LittleEndian.PutUint16(zl[8:], uint16(len(items)))
+	zl = append(zl, body...)
+	return append(zl, 0xFF)
+}
+
+func testListpack(items ...string) []byte {
+	var lp listpackBuilder
+	for _, item := range items {
+		lp.append([]byte(item))
+	}
+	return lp.bytes()
+}
+
+func TestListpackEncoding(t *testing.T) {
+	// A hash {"a": "1"} as Redis 7 saves it.
+	want := []byte{0x0C, 0, 0, 0, 0x02, 0, 0x81, 'a', 0x02, 0x01, 0x01, 0xFF}
+	if got := testListpack("a", "1"); !bytes.Equal(got, want) {
+		t.Fatalf("listpack = % x, want % x", got, want)
+	}
+
+	items := []string{"0", "127", "128", "-5", "-4096", "4095", "40000", "-8388608", "2147483647", "-9223372036854775808",
+		"", "007", string(bytes.Repeat([]byte("x"), 100)), string(bytes.Repeat([]byte("y"), 5000))}
+	got, err := listpackEntries(testListpack(items...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(items) {
+		t.Fatalf("decoded %d entries, want %d", len(got), len(items))
+	}
+	for i := range items {
+		if string(got[i]) != items[i] {
+			t.Errorf("entry %d = %.20q, want %.20q", i, got[i], items[i])
+		}
+	}
+
+	if _, err := listpackEntries(testListpack("a")[:8]); err == nil {
+		t.Error("truncated listpack decoded without error")
+	}
+}
+
+func TestRDBReadsRedisEncodings(t *testing.T) {
+	d := newRedisDump()
+	d.op(rdbOpcodeModuleAux)
+	d.raw(rdbLen64)
+	d.raw(0x12, 0x34, 0x56, 0x78, 0x9A, 0xBC, 0xDE, 0xF0)
+	d.length(rdbModuleOpcodeUInt)
+	d.length(2)
+	d.length(rdbModuleOpcodeString)
+	d.str("state")
+	d.length(rdbModuleOpcodeDouble)
+	d.uint64(math.Float64bits(1.5))
+	d.length(rdbModuleOpcodeEOF)
+	d.op(rdbOpcodeFunction2)
+	d.str("#!lua name=lib\nredis.register_function('f', function() return 1 end)")
+
+	d.op(rdbOpcodeSelectDB)
+	d.length(0)
+	d.op(rdbOpcodeResizeDB)
+	d.length(9)
+	d.length(1)
+
+	d.key(rdbTypeListZiplist, "zl-list")
+	d.blob(testZiplist("a", "7", "-300", "bc"))
+	d.key(rdbTypeSetIntset, "intset")
+	d.blob([]byte{2, 0, 0, 0, 3, 0, 0, 0, 0xFF, 0xFF, 1, 0, 0x10, 0x27})
+	d.key(rdbTypeHashZiplist, "zl-hash")
+	d.blob(testZiplist("f", "1"))
+	d.key(rdbTypeZSetListpack, "lp-zset")
+	d.blob(testListpack("m", "1.5", "n", "-2"))
+	d.key(rdbTypeSetListpack, "lp-set")
+	d.blob(testListpack("x", "42"))
+
+	d.op(rdbOpcodeFreq)
+	d.raw(5)
+	d.key(rdbTypeListQuicklist2, "ql")
+	d.length(2)
+	d.length(quicklistNodePacked)
+	d.blob(testListpack("1", "two"))
+	d.length(quicklistNodePlain)
+	d.blob(bytes.Repeat([]byte("z"), 30))
+
+	d.op(rdbOpcodeIdle)
+	d.length(100)
+	d.key(rdbTypeListQuicklist, "ql-v9")
+	d.length(1)
+	d.blob(testZiplist("p", "q"))
+
+	d.key(rdbTypeZSet, "old-zset")
+	d.length(2)
+	d.str("a")
+	d.raw(3, '2', '.', '5')
+	d.str("b")
+	d.raw(254)
+
+	d.op(rdbOpcodeExpireTimeMS)
+	d.uint64(uint64(time.Now().Add(time.Hour).UnixMilli()))
+	d.key(rdbTypeModule2, "bloom")
+	d.raw(rdbLen64)
+	d.raw(0x12, 0x34, 0x56, 0x78, 0x9A, 0xBC, 0xDE, 0xF0)
+	d.length(rdbModuleOpcodeSInt)
+	d.length(5)
+	d.length(rdbModuleOpcodeFloat)
+	d.raw(0, 0, 0x80, 0x3F)
+	d.length(rdbModuleOpcodeEOF)
+
+	d.key(rdbTypeString, "hll")
+	d.str("HYLL not really")
+
+	d.op(rdbOpcodeSelectDB)
+	d.length(3)
+	d.op(rdbOpcodeExpireTimeMS)
+	d.uint64(uint64(time.Now().Add(time.Hour).UnixMilli()))
+	d.key(rdbTypeString, "in-db3")
+	d.str("v")
+
+	s := store.NewStoreWithNamespaces()
+	d.load(t, s)
+
+	want := map[string]store.Value{
+		"zl-list":  &store.ListValue{Elements: [][]byte{[]byte("a"), []byte("7"), []byte("-300"), []byte("bc")}},
+		"intset":   &store.SetValue{Members: map[string]struct{}{"-1": {}, "1": {}, "10000": {}}},
+		"zl-hash":  &store.HashValue{Fields: map[string][]byte{"f": []byte("1")}},
+		"lp-zset":  &store.SortedSetValue{Members: map[string]float64{"m": 1.5, "n": -2}},
+		"lp-set":   &store.SetValue{Members: map[string]struct{}{"x": {}, "42": {}}},
+		"ql":       &store.ListValue{Elements: [][]byte{[]byte("1"), []byte("two"), bytes.Repeat([]byte("z"), 30)}},
+		"ql-v9":    &store.ListValue{Elements: [][]byte{[]byte("p"), []byte("q")}},
+		"old-zset": &store.SortedSetValue{Members: map[string]float64{"a": 2.5, "b": math.Inf(1)}},
+		"hll":      &store.StringValue{Data: []byte("HYLL not really")},
+	}
+	for key, wantValue := range want {
+		entry, ok := s.Get(key)
+		if !ok {
+			t.Errorf("%s missing", key)
+			continue
+		}
+		if !reflect.DeepEqual(entry.Value, wantValue) {
+			t.Errorf("%s = %#v, want %#v", key, entry.Value, wantValue)
+		}
+	}
+
+	if _, ok := s.Get("bloom"); ok {
+		t.Error("module value was loaded")
+	}
+	if s.KeyCount() != int64(len(want)) {
+		t.Errorf("default database has %d keys, want %d", s.KeyCount(), len(want))
+	}
+	db3 := s.ForNamespace(store.DBNamespace(3))
+	if entry, ok := db3.Get("in-db3"); !ok || entry.ExpiresAt == 0 {
+		t.Errorf("in-db3 = %+v, %v; want a key with an expiry in db3", entry, ok)
+	}
+}
+
+func TestRDBReadsRedisStream(t *testing.T) {
+	const base = 1700000000000
+
+	d := newRedisDump()
+	d.op(rdbOpcodeSelectDB)
+	d.length(0)
+	d.key(rdbTypeStreamListpacks3, "events")
+	d.length(1)
+	d.blob(rawStreamID(base, 0))
+	d.blob(testListpack(
+		"2", "1", "1", "f", "0", // master entry: 2 live, 1 deleted, fields [f]
+		"2", "0", "0", "v1", "4", // SAMEFIELDS
+		"3", "1", "0", "gone", "4", // deleted
+		"0", "2", "0", "2", "a", "x", "b", "y", "8", // own fields
+	))
+	d.length(2)
+	d.streamID(base + 2)
+	d.streamID(base)     // first ID
+	d.streamID(base + 1) // max deleted ID
+	d.length(3)          // entries added
+
+	d.length(1)
+	d.str("workers")
+	d.streamID(base)
+	d.length(1) // entries read
+	d.length(1)
+	d.raw(rawStreamID(base, 0)...)
+	d.uint64(base + 500)
+	d.length(2)
+	d.length(1)
+	d.str("alice")
+	d.uint64(base + 600)
+	d.uint64(base + 700)
+	d.length(1)
+	d.raw(rawStreamID(base, 0)...)
+
+	s := store.NewStore()
+	d.load(t, s)
+
+	entry, ok := s.Get("events")
+	if !ok {
+		t.Fatal("stream missing")
+	}
+	stream := entry.Value.(*store.StreamValue)
+	var ids []string
+	for _, e := range stream.Entries {
+		ids = append(ids, e.ID)
+	}
+	if want := []string{"1700000000000-0", "1700000000002-0"}; !reflect.DeepEqual(ids, want) {
+		t.Fatalf("entry IDs = %v, want %v", ids, want)
+	}
+	if got := string(stream.Entries[0].Fields["f"]); got != "v1" {
+		t.Errorf("first entry f = %q, want v1", got)
+	}
+	if got := stream.Entries[1].Fields; string(got["a"]) != "x" || string(got["b"]) != "y" {
+		t.Errorf("second entry fields = %q", got)
+	}
+	if stream.GetLastID() != "1700000000002-0" || stream.Len() != 2 {
+		t.Errorf("last ID %s, length %d", stream.GetLastID(), stream.Len())
+	}
+
+	g := stream.GetGroup("workers")
+	if g == nil || g.LastID != "1700000000000-0" {
+		t.Fatalf("group = %+v", g)
+	}
+	p := g.Pending["1700000000000-0"]
+	if p == nil || p.Consumer != "alice" || p.Deliveries != 2 || p.DeliveryTS != base+500 {
+		t.Errorf("pending entry = %+v", p)
+	}
+	if c := g.GetConsumer("alice"); c == nil || c.Pending != 1 || c.SeenTime != base+600 {
+		t.Errorf("consumer = %+v", c)
+	}
+}
+
+func TestRDBRedisCompatibleExport(t *testing.T) {
+	src := store.NewStoreWithNamespaces()
+	src.Set("str", &store.StringValue{Data: []byte("hello")}, store.SetOptions{Tags: []string{"t"}, TTL: time.Hour})
+	src.Set("list", &store.ListValue{Elements: [][]byte{[]byte("a"), []byte("1")}}, store.SetOptions{})
+	src.Set("hash", &store.HashValue{Fields: map[string][]byte{"f": []byte("v")}}, store.SetOptions{})
+	geo := store.NewGeoValue()
+	geo.Add("Palermo", 13.361389, 38.115556)
+	src.Set("Sicily", geo, store.SetOptions{})
+	src.Set("doc", &store.JSONValue{Data: []byte(`{"a":1}`)}, store.SetOptions{})
+
+	stream := store.NewStreamValue(0)
+	if _, err := stream.Add("1700000000000-1", map[string][]byte{"temp": []byte("21"), "room": []byte("kitchen")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Add("1700000000005-0", map[string][]byte{"temp": []byte("-3")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.CreateGroup("g", "0-0"); err != nil {
+		t.Fatal(err)
+	}
+	stream.GetGroup("g").GetOrCreateConsumer("bob")
+	stream.GetGroup("g").AddPending("1700000000000-1", "bob")
+	src.Set("stream", stream, store.SetOptions{})
+
+	src.ForNamespace("db2").Set("k", &store.StringValue{Data: []byte("two")}, store.SetOptions{})
+	src.ForNamespace("tenant").Set("k", &store.StringValue{Data: []byte("named")}, store.SetOptions{})
+
+	var buf bytes.Buffer
+	w := NewRDBWriter(src, RDBConfig{Version: RDBVersion9, Checksum: true, RedisCompatible: true})
+	if err := w.writeRDB(&buf); err != nil {
+		t.Fatal(err)
+	}
+	file := buf.Bytes()
+	if !bytes.HasPrefix(file, []byte("REDIS0009")) {
+		t.Errorf("header = %q", file[:9])
+	}
+	if bytes.Contains(file, []byte(rdbAuxFormat)) || bytes.Contains(file, []byte("tenant")) {
+		t.Error("export contains CacheStorm-only data")
+	}
+
+	dst := store.NewStoreWithNamespaces()
+	if err := NewRDBReader(dst).readRDB(bytes.NewReader(file), loadReplace); err != nil {
+		t.Fatal(err)
+	}
+
+	if e, ok := dst.Get("str"); !ok || len(e.Tags) != 0 || e.ExpiresAt == 0 {
+		t.Errorf("str = %+v, want no tags and an expiry", e)
+	}
+	if e, ok := dst.Get("list"); !ok || !reflect.DeepEqual(e.Value, &store.ListValue{Elements: [][]byte{[]byte("a"), []byte("1")}}) {
+		t.Errorf("list = %+v", e)
+	}
+	// ZSCORE Sicily Palermo in Redis.
+	if e, ok := dst.Get("Sicily"); !ok || e.Value.(*store.SortedSetValue).Members["Palermo"] != 3479099956230698 {
+		t.Errorf("Sicily = %+v, want Palermo scored 3479099956230698", e)
+	}
+	if _, ok := dst.Get("doc"); ok {
+		t.Error("JSON value was exported")
+	}
+	if e, ok := dst.ForNamespace("db2").Get("k"); !ok || string(e.Value.(*store.StringValue).Data) != "two" {
+		t.Errorf("db2 k = %+v", e)
+	}
+	if dst.ForNamespace("tenant").KeyCount() != 0 {
+		t.Error("named namespace was exported")
+	}
+
+	e, ok := dst.Get("stream")
+	if !ok {
+		t.Fatal("stream missing")
+	}
+	got := e.Value.(*store.StreamValue)
+	if len(got.Entries) != 2 || got.Entries[0].ID != "1700000000000-1" || string(got.Entries[0].Fields["room"]) != "kitchen" ||
+		string(got.Entries[1].Fields["temp"]) != "-3" || got.GetLastID() != "1700000000005-0" {
+		t.Errorf("stream entries = %+v, last ID %s", got.Entries, got.GetLastID())
+	}
+	if p := got.GetGroup("g").Pending["1700000000000-1"]; p == nil || p.Consumer != "bob" {
+		t.Errorf("pending entry = %+v", p)
+	}
+}
+
+func TestRDBNamespacesRoundTrip(t *testing.T) {
+	src := store.NewStoreWithNamespaces()
+	src.Set("k", &store.StringValue{Data: []byte("default")}, store.SetOptions{})
+	src.ForNamespace("db1").Set("k", &store.StringValue{Data: []byte("one")}, store.SetOptions{})
+	src.ForNamespace("tenant").Set("k", &store.StringValue{Data: []byte("named")}, store.SetOptions{})
+
+	var buf bytes.Buffer
+	if err := NewRDBWriter(src, RDBConfig{Checksum: true}).writeRDB(&buf); err != nil {
+		t.Fatal(err)
+	}
+	dst := store.NewStoreWithNamespaces()
+	dst.ForNamespace("db1").Set("stale", &store.StringValue{Data: []byte("x")}, store.SetOptions{})
+	if err := NewRDBReader(dst).readRDB(bytes.NewReader(buf.Bytes()), loadReplace); err != nil {
+		t.Fatal(err)
+	}
+
+	for ns, want := range map[string]string{"default": "default", "db1": "one", "tenant": "named"} {
+		e, ok := dst.ForNamespace(ns).Get("k")
+		if !ok || string(e.Value.(*store.StringValue).Data) != want {
+			t.Errorf("%s k = %+v, want %q", ns, e, want)
+		}
+	}
+	if _, ok := dst.ForNamespace("db1").Get("stale"); ok {
+		t.Error("loading did not replace db1")
+	}
+}
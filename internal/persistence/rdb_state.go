@@ -0,0 +1,191 @@
+package persistence
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/cachestorm/cachestorm/internal/logger"
+)
+
+// StateProvider is a subsystem that keeps data outside the keyspace, such
+// as search indexes, graphs or message queues. Snapshots carry its state as
+// one blob under its name, so it also survives AOF rewrites, whose base is
+// a snapshot, and reaches replicas through full resyncs.
+type StateProvider interface {
+	// StateName identifies the state in snapshots and must never change.
+	StateName() string
+	// SaveState serializes the whole state. Snapshots call it while writes
+	// are paused, so it agrees with the keyspace saved alongside.
+	SaveState() ([]byte, error)
+	// LoadState replaces the state with one returned by SaveState, or
+	// empties it when data is nil.
+	LoadState(data []byte) error
+}
+
+var stateProviders = struct {
+	mu     sync.RWMutex
+	byName map[string]StateProvider
+}{
+	byName: make(map[string]StateProvider),
+}
+
+// RegisterState makes p's state part of snapshots. It is meant to be called
+// from init and panics on a name registered twice.
+func RegisterState(p StateProvider) {
+	stateProviders.mu.Lock()
+	defer stateProviders.mu.Unlock()
+	name := p.StateName()
+	if _, taken := stateProviders.byName[name]; taken {
+		panic(fmt.Sprintf("persistence: state %q registered twice", name))
+	}
+	stateProviders.byName[name] = p
+}
+
+// savedState is the serialized state of one provider.
+type savedState struct {
+	name string
+	data []byte
+}
+
+// captureStates serializes every registered state, ordered by name.
+func captureStates() ([]savedState, error) {
+	stateProviders.mu.RLock()
+	defer stateProviders.mu.RUnlock()
+	states := make([]savedState, 0, len(stateProviders.byName))
+	for name, p := range stateProviders.byName {
+		data, err := p.SaveState()
+		if err != nil {
+			return nil, fmt.Errorf("failed to save %s state: %v", name, err)
+		}
+		states = append(states, savedState{name: name, data: data})
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].name < states[j].name })
+	return states, nil
+}
+
+// restoreStates loads the states read from a snapshot. With reset, the
+// registered states the snapshot does not hold are emptied, as a snapshot
+// replaces the whole dataset. States nobody registered are skipped.
+func restoreStates(states []savedState, reset bool) error {
+	stateProviders.mu.RLock()
+	defer stateProviders.mu.RUnlock()
+	loaded := make(map[string]bool, len(states))
+	for _, s := range states {
+		p, ok := stateProviders.byName[s.name]
+		if !ok {
+			logger.Warn().Str("state", s.name).Msg("RDB holds state of an unknown subsystem, skipped")
+			continue
+		}
+		if err := p.LoadState(s.data); err != nil {
+			return fmt.Errorf("failed to load %s state: %v", s.name, err)
+		}
+		loaded[s.name] = true
+	}
+	if !reset {
+		return nil
+	}
+	for name, p := range stateProviders.byName {
+		if loaded[name] {
+			continue
+		}
+		if err := p.LoadState(nil); err != nil {
+			return fmt.Errorf("failed to reset %s state: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// MapState adapts a package-level map guarded by mu to StateProvider. Keys
+// and values are gob-encoded, so only exported fields are kept; types with
+// unexported state must implement gob.GobEncoder. Maps inside the values
+// that decode empty are made non-nil again, as gob does not tell an empty
+// map from a missing one.
+func MapState[K comparable, V any](name string, mu sync.Locker, m *map[K]V) StateProvider {
+	return &mapState[K, V]{name: name, mu: mu, m: m}
+}
+
+type mapState[K comparable, V any] struct {
+	name string
+	mu   sync.Locker
+	m    *map[K]V
+}
+
+func (s *mapState[K, V]) StateName() string {
+	return s.name
+}
+
+func (s *mapState[K, V]) SaveState() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(*s.m); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (s *mapState[K, V]) LoadState(data []byte) error {
+	loaded := make(map[K]V)
+	if data != nil {
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&loaded); err != nil {
+			return err
+		}
+		makeMaps(reflect.ValueOf(&loaded).Elem(), make(map[uintptr]bool))
+	}
+	s.mu.Lock()
+	*s.m = loaded
+	s.mu.Unlock()
+	return nil
+}
+
+var gobDecoderType = reflect.TypeOf((*gob.GobDecoder)(nil)).Elem()
+
+// makeMaps replaces the nil maps reachable from v through pointers,
+// exported struct fields, slices, arrays and map values with empty ones.
+// Values that decode themselves are left alone, and seen holds the pointers
+// already visited.
+func makeMaps(v reflect.Value, seen map[uintptr]bool) {
+	if v.Type().Implements(gobDecoderType) || reflect.PointerTo(v.Type()).Implements(gobDecoderType) {
+		return
+	}
+	switch v.Kind() {
+	case reflect.Pointer:
+		if !v.IsNil() && !seen[v.Pointer()] {
+			seen[v.Pointer()] = true
+			makeMaps(v.Elem(), seen)
+		}
+	case reflect.Interface:
+		if !v.IsNil() {
+			makeMaps(v.Elem(), seen)
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < v.NumField(); i++ {
+			if t.Field(i).IsExported() {
+				makeMaps(v.Field(i), seen)
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			makeMaps(v.Index(i), seen)
+		}
+	case reflect.Map:
+		if v.IsNil() {
+			if v.CanSet() {
+				v.Set(reflect.MakeMap(v.Type()))
+			}
+			return
+		}
+		iter := v.MapRange()
+		for iter.Next() {
+			elem := reflect.New(iter.Value().Type()).Elem()
+			elem.Set(iter.Value())
+			makeMaps(elem, seen)
+			v.SetMapIndex(iter.Key(), elem)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package persistence
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/cachestorm/cachestorm/internal/store"
+)
+
+// registerTestState registers p for the duration of the test.
+func registerTestState(t *testing.T, p StateProvider) {
+	t.Helper()
+	RegisterState(p)
+	t.Cleanup(func() {
+		stateProviders.mu.Lock()
+		delete(stateProviders.byName, p.StateName())
+		stateProviders.mu.Unlock()
+	})
+}
+
+type testQueue struct {
+	Items  []string
+	Labels map[string]string
+}
+
+func TestRDBSavesRegisteredState(t *testing.T) {
+	var mu sync.Mutex
+	queues := map[string]*testQueue{
+		"q": {Items: []string{"a", "b"}, Labels: map[string]string{}},
+	}
+	registerTestState(t, MapState("test-queues", &mu, &queues))
+
+	s := store.NewStore()
+	s.Set("k", &store.StringValue{Data: []byte("v")}, store.SetOptions{})
+	path := filepath.Join(t.TempDir(), "dump.rdb")
+	if err := NewRDBWriter(s, RDBConfig{}).Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	queues = map[string]*testQueue{"stale": {}}
+	if err := NewRDBReader(store.NewStore()).Load(path); err != nil {
+		t.Fatal(err)
+	}
+	q, ok := queues["q"]
+	if len(queues) != 1 || !ok || len(q.Items) != 2 || q.Items[1] != "b" {
+		t.Fatalf("queues after load = %+v", queues)
+	}
+	if q.Labels == nil {
+		t.Error("empty map in the state loaded as nil")
+	}
+}
+
+func TestRDBLoadResetsStateMissingFromFile(t *testing.T) {
+	s := store.NewStore()
+	s.Set("k", &store.StringValue{Data: []byte("v")}, store.SetOptions{})
+	path := filepath.Join(t.TempDir(), "dump.rdb")
+	if err := NewRDBWriter(s, RDBConfig{}).Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	counters := map[string]int64{"c": 1}
+	registerTestState(t, MapState("test-counters", &mu, &counters))
+
+	if err := NewRDBReader(store.NewStore()).LoadMerge(path); err != nil {
+		t.Fatal(err)
+	}
+	if counters["c"] != 1 {
+		t.Errorf("merging load touched state absent from the file: %v", counters)
+	}
+	if err := NewRDBReader(store.NewStore()).Load(path); err != nil {
+		t.Fatal(err)
+	}
+	if counters == nil || len(counters) != 0 {
+		t.Errorf("counters after load = %v, want empty", counters)
+	}
+}
+
+func TestRedisCompatibleRDBLeavesStateOut(t *testing.T) {
+	var mu sync.Mutex
+	counters := map[string]int64{"c": 1}
+	registerTestState(t, MapState("test-counters", &mu, &counters))
+
+	path := filepath.Join(t.TempDir(), "dump.rdb")
+	if err := NewRDBWriter(store.NewStore(), RDBConfig{RedisCompatible: true}).Save(path); err != nil {
+		t.Fatal(err)
+	}
+	counters["c"] = 2
+	if err := NewRDBReader(store.NewStore()).LoadMerge(path); err != nil {
+		t.Fatal(err)
+	}
+	if counters["c"] != 2 {
+		t.Errorf("counters after load = %v", counters)
+	}
+}
+
+func TestRegisterStateTwicePanics(t *testing.T) {
+	var mu sync.Mutex
+	m := map[string]string{}
+	registerTestState(t, MapState("test-twice", &mu, &m))
+	defer func() {
+		if recover() == nil {
+			t.Error("second registration did not panic")
+		}
+	}()
+	RegisterState(MapState("test-twice", &mu, &m))
+}
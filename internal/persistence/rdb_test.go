@@ -1,8 +1,14 @@
 package persistence
 
 import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -371,8 +377,8 @@ func TestRDBWriterGetValueType(t *testing.T) {
 		{&store.StringValue{Data: []byte("test")}, 0},
 		{&store.ListValue{Elements: [][]byte{[]byte("a")}}, 1},
 		{&store.SetValue{Members: map[string]struct{}{"a": {}}}, 2},
-		{&store.HashValue{Fields: map[string][]byte{"f": []byte("v")}}, 3},
-		{&store.SortedSetValue{Members: map[string]float64{"a": 1.0}}, 4},
+		{&store.HashValue{Fields: map[string][]byte{"f": []byte("v")}}, 4},
+		{&store.SortedSetValue{Members: map[string]float64{"a": 1.0}}, 5},
 	}
 
 	for _, tt := range tests {
@@ -413,3 +419,233 @@ func TestRDBWriterSaveNestedPath(t *testing.T) {
 		t.Error("RDB file should exist in nested path")
 	}
 }
+
+func TestCRC64MatchesRedis(t *testing.T) {
+	// Check value from Redis' crc64.c.
+	if got := crc64Update(0, []byte("123456789")); got != 0xe9c6d914c4b8d9ca {
+		t.Errorf("crc64 = %016x", got)
+	}
+}
+
+func TestLZFRoundTrip(t *testing.T) {
+	inputs := [][]byte{
+		[]byte(strings.Repeat("abcabcabc", 100)),
+		[]byte(strings.Repeat("x", 5000)),
+		[]byte("the quick brown fox jumps over the lazy dog, the quick brown fox"),
+	}
+	for _, in := range inputs {
+		compressed := lzfCompress(in)
+		if compressed == nil {
+			t.Fatalf("%q... did not compress", in[:10])
+		}
+		out, err := lzfDecompress(compressed, len(in))
+		if err != nil || string(out) != string(in) {
+			t.Fatalf("round trip of %q...: %v", in[:10], err)
+		}
+	}
+	if lzfCompress([]byte("0123456789abcdefghijklmnopqrstuv")) != nil {
+		t.Error("incompressible input must not be compressed")
+	}
+	if _, err := lzfDecompress([]byte{0x20, 0x05}, 10); err == nil {
+		t.Error("back reference before the start must fail")
+	}
+}
+
+func TestRDBRoundTripAllTypes(t *testing.T) {
+	src := store.NewStore()
+	src.Set("str", &store.StringValue{Data: []byte("hello")}, store.SetOptions{Tags: []string{"t1", "t2"}})
+	src.Set("int", &store.StringValue{Data: []byte("-12345")}, store.SetOptions{})
+	src.Set("big", &store.StringValue{Data: []byte(strings.Repeat("compress me ", 200))}, store.SetOptions{TTL: time.Hour})
+	src.Set("list", &store.ListValue{Elements: [][]byte{[]byte("a"), []byte("1000"), []byte("c")}}, store.SetOptions{})
+	src.Set("set", &store.SetValue{Members: map[string]struct{}{"x": {}, "y": {}}}, store.SetOptions{})
+	src.Set("hash", &store.HashValue{Fields: map[string][]byte{"f": []byte("v")}}, store.SetOptions{Tags: []string{"t1"}})
+	src.Set("zset", &store.SortedSetValue{Members: map[string]float64{"a": 1.5, "b": -2}}, store.SetOptions{})
+	geo := store.NewGeoValue()
+	geo.Add("rome", 12.496365, 41.902782)
+	src.Set("geo", geo, store.SetOptions{})
+	src.Set("json", &store.JSONValue{Data: []byte(`{"a":[1,2]}`)}, store.SetOptions{})
+	ts := store.NewTimeSeriesValue(time.Hour)
+	ts.SetLabels(map[string]string{"sensor": "1"})
+	ts.Samples = append(ts.Samples, store.TimeSeriesSample{Timestamp: 1000, Value: 1.25}, store.TimeSeriesSample{Timestamp: 2000, Value: 2.5})
+	src.Set("ts", ts, store.SetOptions{})
+	stream := store.NewStreamValue(100)
+	stream.Add("1-0", map[string][]byte{"k": []byte("v1")})
+	stream.Add("2-0", map[string][]byte{"k": []byte("v2")})
+	stream.CreateGroup("g", "0")
+	stream.GetGroup("g").GetOrCreateConsumer("alice")
+	stream.GetGroup("g").AddPending("1-0", "alice")
+	src.Set("stream", stream, store.SetOptions{TTL: time.Minute})
+
+	path := filepath.Join(t.TempDir(), "all.rdb")
+	w := NewRDBWriter(src, RDBConfig{Version: RDBVersion11, Compression: true, Checksum: true})
+	if err := w.Save(path); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if info, _ := os.Stat(path); info.Size() > 1500 {
+		t.Errorf("large string was not compressed: file is %d bytes", info.Size())
+	}
+
+	dst := store.NewStore()
+	if err := NewRDBReader(dst).Load(path); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if dst.KeyCount() != src.KeyCount() {
+		t.Fatalf("loaded %d keys, saved %d", dst.KeyCount(), src.KeyCount())
+	}
+	for key, want := range src.GetAll() {
+		got, _ := dst.Get(key)
+		if got == nil || fmt.Sprintf("%T", got.Value) != fmt.Sprintf("%T", want.Value) {
+			t.Errorf("%s: got %+v, want %T", key, got, want.Value)
+			continue
+		}
+		if !reflect.DeepEqual(got.Tags, want.Tags) {
+			t.Errorf("%s: tags %v, want %v", key, got.Tags, want.Tags)
+		}
+		if (want.ExpiresAt == 0) != (got.ExpiresAt == 0) || abs(got.ExpiresAt-want.ExpiresAt) > int64(time.Second) {
+			t.Errorf("%s: expires at %d, want %d", key, got.ExpiresAt, want.ExpiresAt)
+		}
+	}
+
+	if e, _ := dst.Get("int"); string(e.Value.(*store.StringValue).Data) != "-12345" {
+		t.Errorf("int encoded string: %q", e.Value.(*store.StringValue).Data)
+	}
+	if e, _ := dst.Get("big"); string(e.Value.(*store.StringValue).Data) != strings.Repeat("compress me ", 200) {
+		t.Error("compressed string did not round trip")
+	}
+	if e, _ := dst.Get("zset"); !reflect.DeepEqual(e.Value.(*store.SortedSetValue).Members, map[string]float64{"a": 1.5, "b": -2}) {
+		t.Errorf("zset: %v", e.Value)
+	}
+	if e, _ := dst.Get("geo"); e.Value.(*store.GeoValue).Points["rome"] != geo.Points["rome"] {
+		t.Errorf("geo: %v", e.Value)
+	}
+	if e, _ := dst.Get("json"); e.Value.String() != `{"a":[1,2]}` {
+		t.Errorf("json: %v", e.Value)
+	}
+	if e, _ := dst.Get("ts"); e.Value.(*store.TimeSeriesValue).Len() != 2 || e.Value.(*store.TimeSeriesValue).Retention != time.Hour ||
+		e.Value.(*store.TimeSeriesValue).GetLabels()["sensor"] != "1" {
+		t.Errorf("time series: %+v", e.Value)
+	}
+	got, _ := dst.Get("stream")
+	sv := got.Value.(*store.StreamValue)
+	if sv.Len() != 2 || sv.GetLastID() != "2-0" || sv.MaxLen != 100 || string(sv.GetEntryByID("2-0").Fields["k"]) != "v2" {
+		t.Errorf("stream: %+v", sv)
+	}
+	if g := sv.GetGroup("g"); g == nil || g.GetPendingCount() != 1 || g.GetConsumerPending("alice") != 1 {
+		t.Errorf("stream group: %+v", g)
+	}
+	if keys := dst.GetTagIndex().GetKeys("t1"); len(keys) != 2 {
+		t.Errorf("tag index after load: %v", keys)
+	}
+}
+
+func TestRDBChecksumVerified(t *testing.T) {
+	src := store.NewStore()
+	src.Set("key", &store.StringValue{Data: []byte("value")}, store.SetOptions{})
+	path := filepath.Join(t.TempDir(), "crc.rdb")
+	if err := NewRDBWriter(src, RDBConfig{Version: RDBVersion11, Checksum: true}).Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := os.ReadFile(path)
+	if crc := binary.LittleEndian.Uint64(data[len(data)-8:]); crc != crc64Update(0, data[:len(data)-8]) {
+		t.Fatalf("footer %016x does not checksum the file", crc)
+	}
+
+	// Flip a byte of the value
+	i := strings.Index(string(data), "value")
+	data[i] = 'V'
+	os.WriteFile(path, data, 0644)
+
+	dst := store.NewStore()
+	dst.Set("existing", &store.StringValue{Data: []byte("x")}, store.SetOptions{})
+	err := NewRDBReader(dst).Load(path)
+	if err == nil || !strings.Contains(err.Error(), "wrong RDB checksum") {
+		t.Fatalf("expected checksum error, got %v", err)
+	}
+	if _, ok := dst.Get("existing"); !ok {
+		t.Error("a corrupt file must not flush the store")
+	}
+}
+
+func TestRDBSkipsKeysExpiredOnDisk(t *testing.T) {
+	var body bytes.Buffer
+	body.WriteByte(rdbOpcodeExpireTimeMS)
+	binary.Write(&body, binary.LittleEndian, time.Now().Add(-time.Minute).UnixMilli())
+	body.WriteByte(rdbTypeString)
+	writeRDBString(&body, "gone")
+	writeRDBString(&body, "v")
+	body.WriteByte(rdbTypeString)
+	writeRDBString(&body, "kept")
+	writeRDBString(&body, "v")
+
+	path := filepath.Join(t.TempDir(), "expired.rdb")
+	os.WriteFile(path, buildValidRDB("0011", body.Bytes()), 0644)
+
+	s := store.NewStore()
+	if err := NewRDBReader(s).Load(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Get("gone"); ok {
+		t.Error("expired key loaded")
+	}
+	if e, ok := s.Get("kept"); !ok || e.ExpiresAt != 0 {
+		t.Errorf("expiry leaked onto the next key: %+v", e)
+	}
+}
+
+func abs(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+func TestEncodeValueRoundTrip(t *testing.T) {
+	for _, v := range []store.Value{
+		&store.StringValue{Data: []byte(strings.Repeat("compressible ", 20))},
+		&store.StringValue{Data: []byte("42")},
+		&store.HashValue{Fields: map[string][]byte{"f": []byte("v")}},
+		&store.SortedSetValue{Members: map[string]float64{"a": 1.5}},
+	} {
+		data, err := EncodeValue(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		back, err := DecodeValue(data)
+		if err != nil {
+			t.Fatalf("decoding %T: %v", v, err)
+		}
+		if back.Type() != v.Type() || back.String() != v.String() {
+			t.Errorf("%T: got %q, want %q", v, back.String(), v.String())
+		}
+	}
+	if _, err := DecodeValue([]byte{rdbTypeString, 1, 'a', 'b'}); err == nil {
+		t.Error("trailing bytes accepted")
+	}
+}
+
+func TestRDBReplaceFrom(t *testing.T) {
+	src := store.NewStoreWithNamespaces()
+	src.Set("key", &store.StringValue{Data: []byte("value")}, store.SetOptions{})
+	path := filepath.Join(t.TempDir(), "sync.rdb")
+	if err := NewRDBWriter(src, RDBConfig{Checksum: true}).Save(path); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(path)
+
+	dst := store.NewStoreWithNamespaces()
+	dst.Set("old", &store.StringValue{Data: []byte("x")}, store.SetOptions{})
+	dst.ForNamespace("db3").Set("old", &store.StringValue{Data: []byte("x")}, store.SetOptions{})
+
+	// What follows the snapshot on the stream is not read
+	rd := bytes.NewReader(append(data, "*1\r\n$4\r\nPING\r\n"...))
+	if err := NewRDBReader(dst).ReplaceFrom(io.LimitReader(rd, int64(len(data)))); err != nil {
+		t.Fatal(err)
+	}
+	if rd.Len() != 14 {
+		t.Errorf("%d bytes left on the stream, want 14", rd.Len())
+	}
+	if _, ok := dst.Get("key"); !ok || dst.Exists("old") || dst.ForNamespace("db3").KeyCount() != 0 {
+		t.Error("the snapshot did not replace every database")
+	}
+}
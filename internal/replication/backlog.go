@@ -0,0 +1,51 @@
+package replication
+
+// backlog is a circular buffer holding the latest bytes of the replication
+// stream, so that a replica whose link dropped can be sent what it missed
+// instead of the whole dataset.
+//
+// Offsets count the bytes of the stream: the byte at offset n is the n-th
+// since the replication ID was created, and offset is the last one written.
+type backlog struct {
+	buf     []byte
+	offset  int64
+	histlen int
+}
+
+func newBacklog(size int, offset int64) *backlog {
+	return &backlog{buf: make([]byte, size), offset: offset}
+}
+
+// write appends p to the stream, overwriting the oldest bytes once the
+// buffer is full.
+func (b *backlog) write(p []byte) {
+	b.offset += int64(len(p))
+	if len(p) > len(b.buf) {
+		p = p[len(p)-len(b.buf):]
+	}
+	pos := int((b.offset - int64(len(p))) % int64(len(b.buf)))
+	n := copy(b.buf[pos:], p)
+	copy(b.buf, p[n:])
+	b.histlen = min(b.histlen+len(p), len(b.buf))
+}
+
+// firstOffset is the offset of the oldest byte held.
+func (b *backlog) firstOffset() int64 {
+	return b.offset - int64(b.histlen) + 1
+}
+
+// since returns the stream from offset on. It reports false when the bytes
+// before the end of the stream are no longer, or were never, held.
+func (b *backlog) since(offset int64) ([]byte, bool) {
+	if offset < b.firstOffset() || offset > b.offset+1 {
+		return nil, false
+	}
+	out := make([]byte, b.offset-offset+1)
+	if len(out) == 0 {
+		return out, true
+	}
+	pos := int((offset - 1) % int64(len(b.buf)))
+	n := copy(out, b.buf[pos:])
+	copy(out[n:], b.buf)
+	return out, true
+}
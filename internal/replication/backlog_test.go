@@ -0,0 +1,37 @@
+package replication
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBacklogWrapsAround(t *testing.T) {
+	b := newBacklog(8, 100)
+	if _, ok := b.since(100); ok {
+		t.Error("an empty backlog served bytes before its offset")
+	}
+	if data, ok := b.since(101); !ok || len(data) != 0 {
+		t.Errorf("since(101) = %q, %v; want nothing missing", data, ok)
+	}
+
+	b.write([]byte("abcde"))
+	b.write([]byte("fghij"))
+	if b.offset != 110 || b.firstOffset() != 103 {
+		t.Fatalf("offset %d, first %d; want 110, 103", b.offset, b.firstOffset())
+	}
+	for offset, want := range map[int64]string{103: "cdefghij", 106: "fghij", 110: "j", 111: ""} {
+		if data, ok := b.since(offset); !ok || string(data) != want {
+			t.Errorf("since(%d) = %q, %v; want %q", offset, data, ok, want)
+		}
+	}
+	for _, offset := range []int64{101, 102, 112} {
+		if _, ok := b.since(offset); ok {
+			t.Errorf("since(%d) succeeded", offset)
+		}
+	}
+
+	b.write(bytes.Repeat([]byte("z"), 20))
+	if data, ok := b.since(b.firstOffset()); !ok || string(data) != "zzzzzzzz" {
+		t.Errorf("after an oversized write: %q, %v", data, ok)
+	}
+}
@@ -0,0 +1,206 @@
+package replication
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/cachestorm/cachestorm/internal/logger"
+)
+
+// eofMarkLen is the length of the mark ending a diskless payload, which
+// the header $EOF:<mark> announces.
+const eofMarkLen = 40
+
+var errNoReceivers = errors.New("every replica of the transfer failed")
+
+// disklessTransfer is a full sync streamed to the replicas' sockets as the
+// snapshot is encoded. Replicas join it until it starts, then all take the
+// same snapshot.
+type disklessTransfer struct {
+	targets []*Resync
+	done    chan struct{}
+}
+
+// SetDisklessSync turns diskless full syncs on or off, and sets how many
+// seconds a transfer waits for more replicas before it starts.
+func (m *Manager) SetDisklessSync(enabled bool, delay int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cfg.ReplDisklessSync, m.cfg.ReplDisklessSyncDelay = enabled, delay
+}
+
+// DisklessSync returns the settings of SetDisklessSync.
+func (m *Manager) DisklessSync() (enabled bool, delay int) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.cfg.ReplDisklessSync, m.cfg.ReplDisklessSyncDelay
+}
+
+// Transfer sends a diskless full resync to w: +FULLRESYNC ReplID Offset
+// unless psync is false, as for SYNC, then $EOF:<mark>, the snapshot and
+// the mark. It joins the transfer waiting for replicas if there is one, or
+// starts one, and returns once the payload is sent. The replica's stream
+// waits for its first ACK, which says it has loaded the payload.
+func (rs *Resync) Transfer(w io.Writer, psync bool) error {
+	m := rs.m
+	rs.w, rs.psync = w, psync
+	m.mu.Lock()
+	t := m.diskless
+	if t == nil {
+		t = &disklessTransfer{done: make(chan struct{})}
+		m.diskless = t
+		go m.runDisklessSync(t, time.Duration(m.cfg.ReplDisklessSyncDelay)*time.Second)
+	}
+	t.targets = append(t.targets, rs)
+	m.mu.Unlock()
+
+	<-t.done
+	if rs.err != nil && rs.Replica != nil {
+		rs.Replica.Close()
+	}
+	return rs.err
+}
+
+// runDisklessSync waits delay for replicas to join t, then takes the
+// snapshot and streams it to all of them at once.
+func (m *Manager) runDisklessSync(t *disklessTransfer, delay time.Duration) {
+	defer logger.RecoverPanic("replication-diskless-sync")
+	defer close(t.done)
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	var stopped bool
+	select {
+	case <-timer.C:
+	case <-m.stopCh:
+		stopped = true
+	}
+	m.mu.Lock()
+	if m.diskless == t {
+		m.diskless = nil
+	}
+	targets := t.targets
+	m.mu.Unlock()
+	if stopped {
+		for _, rs := range targets {
+			rs.err = errReplicaClosed
+		}
+		return
+	}
+
+	var replid, streamDB string
+	var offset int64
+	snap := m.store.SnapshotWith(func(capture func()) {
+		m.pauseStream(func() {
+			capture()
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			replid, offset, streamDB = m.startFullSync()
+			for _, rs := range targets {
+				rs.ReplID, rs.Offset, rs.streamDB = replid, offset, streamDB
+				rs.Replica = m.addReplica(rs.ip, rs.port, StateSyncing)
+				rs.Replica.loading = true
+			}
+		})
+	})
+	defer snap.Release()
+
+	mark := generateReplicaID()
+	fan := &fanout{}
+	for _, rs := range targets {
+		header := fmt.Sprintf("$EOF:%s\r\n", mark)
+		if rs.psync {
+			header = fmt.Sprintf("+FULLRESYNC %s %d\r\n", replid, offset) + header
+		}
+		if _, err := io.WriteString(rs.w, header); err != nil {
+			rs.err = err
+			continue
+		}
+		fan.targets = append(fan.targets, rs)
+	}
+	started := time.Now()
+	bw := bufio.NewWriterSize(fan, 64*1024)
+	err := targets[0].encode(bw, snap)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		_, err = fan.Write([]byte(mark))
+	}
+	for _, rs := range fan.targets {
+		if rs.err == nil {
+			rs.err = err
+		}
+	}
+	logger.Info().Int("replicas", len(targets)).Int("sent", len(fan.targets)).Int64("offset", offset).
+		Dur("took", time.Since(started)).Err(err).Msg("diskless sync done")
+}
+
+// fanout writes to every replica of a transfer still taking it. A replica
+// whose write fails is left out from then on; the write only fails once
+// no replica is left.
+type fanout struct {
+	targets []*Resync
+}
+
+func (f *fanout) Write(p []byte) (int, error) {
+	live := f.targets[:0]
+	for _, rs := range f.targets {
+		if _, err := rs.w.Write(p); err != nil {
+			rs.err = err
+			continue
+		}
+		live = append(live, rs)
+	}
+	f.targets = live
+	if len(live) == 0 {
+		return 0, errNoReceivers
+	}
+	return len(p), nil
+}
+
+// eofReader reads a diskless payload, which ends with mark instead of
+// coming with its length. The master sends nothing after the mark until
+// the replica ACKs the payload, so the mark is the tail of what was read
+// once the master stops sending.
+type eofReader struct {
+	r     io.Reader
+	mark  []byte
+	buf   []byte // read but not returned: the last len(mark) bytes may be the mark
+	chunk []byte
+	n     int64 // payload bytes returned
+	eof   bool
+}
+
+func (e *eofReader) Read(p []byte) (int, error) {
+	for {
+		if e.eof {
+			return 0, io.EOF
+		}
+		if held := len(e.buf) - len(e.mark); held > 0 {
+			n := copy(p, e.buf[:held])
+			e.buf = append(e.buf[:0], e.buf[n:]...)
+			e.n += int64(n)
+			return n, nil
+		}
+		if bytes.Equal(e.buf, e.mark) {
+			e.eof = true
+			continue
+		}
+		if e.chunk == nil {
+			e.chunk = make([]byte, 32*1024)
+		}
+		n, err := e.r.Read(e.chunk)
+		e.buf = append(e.buf, e.chunk[:n]...)
+		if n == 0 && err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+	}
+}
@@ -0,0 +1,576 @@
+package replication
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cachestorm/cachestorm/internal/logger"
+	"github.com/cachestorm/cachestorm/internal/persistence"
+	"github.com/cachestorm/cachestorm/internal/store"
+)
+
+const (
+	defaultBacklogSize = 1024 * 1024
+
+	// A replica whose queue of the stream grows past this is disconnected,
+	// like Redis' default output buffer limit for replicas.
+	maxReplicaBuffer = 256 * 1024 * 1024
+
+	// Masters ping their replicas this often, which keeps quiet links
+	// inside the replicas' repl_timeout.
+	pingInterval = 10 * time.Second
+)
+
+var (
+	errReplicaBufferFull = errors.New("replica output buffer limit reached")
+	errReplicaClosed     = errors.New("replica disconnected")
+)
+
+// Replica is a replica attached to this node with PSYNC. The connection
+// that sent the PSYNC writes the replica's share of the stream, which
+// queues here until Next hands it over. The exported fields are guarded by
+// the manager's lock.
+type Replica struct {
+	ID          string
+	IP          string
+	Port        int
+	State       ReplicaState
+	Offset      int64
+	AOFOffset   int64 // offset the replica's AOF is fsynced up to
+	LastAckTime time.Time
+	ConnectedAt time.Time
+
+	m       *Manager
+	mu      sync.Mutex
+	pending []byte
+	err     error
+	ready   chan struct{}
+	// loading holds the stream back from a replica that was sent a diskless
+	// payload: it cannot tell the end of the payload from the stream that
+	// follows, so the stream waits for its first ACK.
+	loading bool
+}
+
+func (s ReplicaState) String() string {
+	switch s {
+	case StateConnecting:
+		return "wait_bgsave"
+	case StateSyncing:
+		return "send_bulk"
+	case StateConnected:
+		return "online"
+	}
+	return "disconnected"
+}
+
+// Next returns the stream queued for the replica since the previous call,
+// waiting until there is some. It fails once the replica has been dropped
+// or done is closed.
+func (r *Replica) Next(done <-chan struct{}) ([]byte, error) {
+	for {
+		r.mu.Lock()
+		data, err := r.pending, r.err
+		if r.loading {
+			data = nil
+		} else {
+			r.pending = nil
+		}
+		r.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		if len(data) > 0 {
+			return data, nil
+		}
+		select {
+		case <-r.ready:
+		case <-done:
+			return nil, errReplicaClosed
+		}
+	}
+}
+
+// Ack records the offsets the replica reported with REPLCONF ACK: the
+// stream it has applied and, if it has an AOF, the stream fsynced there or
+// -1. The first ACK after a full sync means the replica has loaded the
+// snapshot.
+func (r *Replica) Ack(offset, aofOffset int64) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	r.Offset = offset
+	if aofOffset >= 0 {
+		r.AOFOffset = aofOffset
+	}
+	r.LastAckTime = time.Now()
+	r.State = StateConnected
+	r.m.notifyAckWaiters()
+
+	r.mu.Lock()
+	r.loading = false
+	r.mu.Unlock()
+	r.signal()
+}
+
+// Close detaches the replica once its connection is gone.
+func (r *Replica) Close() {
+	r.m.RemoveReplica(r.ID)
+}
+
+// push queues data for the replica. It reports false once the replica has
+// been dropped, for falling too far behind or otherwise.
+func (r *Replica) push(data []byte) bool {
+	r.mu.Lock()
+	if r.err == nil && len(r.pending)+len(data) > maxReplicaBuffer {
+		r.err = errReplicaBufferFull
+		r.pending = nil
+	}
+	if r.err == nil {
+		r.pending = append(r.pending, data...)
+	}
+	ok := r.err == nil
+	r.mu.Unlock()
+	r.signal()
+	return ok
+}
+
+// drop ends the replica's stream; Next returns err from then on.
+func (r *Replica) drop(err error) {
+	r.mu.Lock()
+	if r.err == nil {
+		r.err = err
+		r.pending = nil
+	}
+	r.mu.Unlock()
+	r.signal()
+}
+
+func (r *Replica) signal() {
+	select {
+	case r.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Resync is the answer to a replica's PSYNC. A partial resync is answered
+// with +CONTINUE ReplID and the replica's stream picks up from the backlog.
+// A full one is answered with +FULLRESYNC ReplID Offset and the snapshot,
+// which is the dataset at Offset; the stream carries on from there.
+//
+// A Diskless full resync has no snapshot yet: Transfer sends it, and only
+// then are Replica, ReplID and Offset set.
+type Resync struct {
+	Replica  *Replica
+	Partial  bool
+	Diskless bool
+	ReplID   string
+	Offset   int64
+
+	store    *store.Store
+	snap     *store.Snapshot
+	streamDB string
+
+	// Diskless transfers.
+	m     *Manager
+	ip    string
+	port  int
+	w     io.Writer
+	psync bool
+	err   error
+}
+
+// WriteSnapshot writes the snapshot of a full resync to w in RDB format and
+// releases it. It must be called once for every full resync.
+func (rs *Resync) WriteSnapshot(w io.Writer) error {
+	defer rs.snap.Release()
+	return rs.encode(w, rs.snap)
+}
+
+func (rs *Resync) encode(w io.Writer, snap *store.Snapshot) error {
+	cfg := persistence.RDBConfig{Checksum: true, ReplStreamDB: rs.streamDB}
+	return persistence.NewRDBWriter(rs.store, cfg).WriteSnapshot(w, snap)
+}
+
+// SetWriteBarrier sets the function a full resync takes its snapshot under,
+// so that no write falls between the snapshot and the start of the
+// replica's stream. Without one, the snapshot is taken directly.
+func (m *Manager) SetWriteBarrier(barrier func(func())) {
+	m.barrier = barrier
+}
+
+func (m *Manager) pauseWrites(fn func()) {
+	if m.barrier == nil {
+		fn()
+		return
+	}
+	m.barrier(fn)
+}
+
+// pauseStream runs fn while the stream stands still: with writes paused on
+// a master, and between two commands from the master on a replica, whose
+// stream is its master's.
+func (m *Manager) pauseStream(fn func()) {
+	if m.GetRole() == RoleReplica {
+		m.applyMu.Lock()
+		defer m.applyMu.Unlock()
+		fn()
+		return
+	}
+	m.pauseWrites(fn)
+}
+
+// PSync attaches a replica asking for the stream of replid from offset, the
+// first byte it is missing. The replica continues from the backlog when
+// replid is this node's replication ID, or the ID it took over from as long
+// as offset is no later than where it did, and the backlog still holds
+// offset. Otherwise it needs a full resync, which is diskless when
+// repl_diskless_sync is on and the replica announced it can take a payload
+// ending with an EOF mark (capa eof).
+//
+// A replica serves its own replicas the stream of its master, under the
+// same replication ID and offsets.
+func (m *Manager) PSync(replid string, offset int64, ip string, port int, eof bool) *Resync {
+	m.mu.Lock()
+	if data, ok := m.continueFrom(replid, offset); ok {
+		r := m.addReplica(ip, port, StateConnected)
+		r.push(data)
+		rs := &Resync{Replica: r, Partial: true, ReplID: m.replID}
+		m.mu.Unlock()
+		logger.Info().Str("replica", r.addr()).Int64("offset", offset).Int("backlog_bytes", len(data)).
+			Msg("partial resync accepted")
+		return rs
+	}
+	diskless := eof && m.cfg.ReplDisklessSync
+	m.mu.Unlock()
+
+	if diskless {
+		logger.Info().Str("replica", net.JoinHostPort(ip, strconv.Itoa(port))).Str("replid", replid).
+			Int64("offset", offset).Msg("full resync needed, diskless")
+		return &Resync{Diskless: true, store: m.store, m: m, ip: ip, port: port}
+	}
+	rs := &Resync{store: m.store}
+	rs.snap = m.store.SnapshotWith(func(capture func()) {
+		m.pauseStream(func() {
+			capture()
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			rs.ReplID, rs.Offset, rs.streamDB = m.startFullSync()
+			rs.Replica = m.addReplica(ip, port, StateSyncing)
+		})
+	})
+	logger.Info().Str("replica", rs.Replica.addr()).Str("replid", replid).Int64("offset", offset).
+		Msg("full resync needed")
+	return rs
+}
+
+// startFullSync prepares the stream for replicas taking a snapshot captured
+// now. It returns the replication ID and offset the snapshot is at, and
+// the namespace the stream has selected there if the replicas must be told.
+// m.mu must be held.
+func (m *Manager) startFullSync() (replid string, offset int64, streamDB string) {
+	if m.backlog == nil {
+		m.backlog = newBacklog(m.backlogSize, m.masterOffset.Load())
+	}
+	if m.GetRole() == RoleMaster {
+		// The next write selects its namespace again.
+		m.seldb = ""
+	} else {
+		// The stream is the master's, which selects it again when it likes.
+		streamDB = m.seldb
+	}
+	return m.replID, m.masterOffset.Load(), streamDB
+}
+
+// continueFrom returns the stream a replica asking for replid from offset
+// is missing, if it can be served from the backlog. m.mu must be held.
+func (m *Manager) continueFrom(replid string, offset int64) ([]byte, bool) {
+	if m.backlog == nil {
+		return nil, false
+	}
+	if replid != m.replID && (replid != m.replID2 || offset > m.secondOffset) {
+		return nil, false
+	}
+	return m.backlog.since(offset)
+}
+
+// addReplica registers a new replica. m.mu must be held.
+func (m *Manager) addReplica(ip string, port int, state ReplicaState) *Replica {
+	m.replicaSeq++
+	now := time.Now()
+	r := &Replica{
+		ID:          strconv.FormatInt(m.replicaSeq, 10),
+		IP:          ip,
+		Port:        port,
+		State:       state,
+		ConnectedAt: now,
+		LastAckTime: now,
+		m:           m,
+		ready:       make(chan struct{}, 1),
+	}
+	m.replicas[r.ID] = r
+	return r
+}
+
+func (r *Replica) addr() string {
+	return r.IP + ":" + strconv.Itoa(r.Port)
+}
+
+// Feed appends a write applied on this master to the replication stream,
+// preceded by a SELECT, or a NAMESPACE for a namespace that is not a
+// numbered database, when it applies to another namespace than the
+// previous one. Nothing is recorded while the node is a replica, or while
+// it has neither replicas nor a backlog.
+func (m *Manager) Feed(namespace, name string, args [][]byte) {
+	if m.GetRole() != RoleMaster {
+		return
+	}
+	if namespace == "" {
+		namespace = store.DBNamespace(0)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.backlog == nil && len(m.replicas) == 0 {
+		return
+	}
+	var data []byte
+	if namespace != m.seldb {
+		if db, ok := store.NamespaceDB(namespace); ok {
+			data = appendCommand(data, "SELECT", [][]byte{[]byte(strconv.Itoa(db))})
+		} else {
+			data = appendCommand(data, "NAMESPACE", [][]byte{[]byte(namespace)})
+		}
+		m.seldb = namespace
+	}
+	m.appendStream(appendCommand(data, name, args))
+}
+
+// appendStream adds data to the replication stream: it advances the
+// offset and goes to the backlog and to every replica. m.mu must be held.
+func (m *Manager) appendStream(data []byte) {
+	m.masterOffset.Add(int64(len(data)))
+	if m.backlog != nil {
+		m.backlog.write(data)
+	}
+	for id, r := range m.replicas {
+		if !r.push(data) {
+			delete(m.replicas, id)
+			if len(m.replicas) == 0 {
+				m.idleSince = time.Now()
+			}
+			logger.Warn().Str("replica", r.addr()).Msg("replica dropped, output buffer limit reached")
+		}
+	}
+}
+
+// RemoveReplica detaches a replica and ends its stream.
+func (m *Manager) RemoveReplica(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if r, ok := m.replicas[id]; ok {
+		r.drop(errReplicaClosed)
+		delete(m.replicas, id)
+		if len(m.replicas) == 0 {
+			m.idleSince = time.Now()
+		}
+		logger.Info().Str("id", id).Msg("replica disconnected")
+	}
+}
+
+// dropReplicas detaches every replica. m.mu must be held.
+func (m *Manager) dropReplicas() {
+	for id, r := range m.replicas {
+		r.drop(errReplicaClosed)
+		delete(m.replicas, id)
+	}
+	m.idleSince = time.Now()
+}
+
+// ResetHistory starts a new history after the dataset was replaced other
+// than through the stream, as by a reload or a restore. The replicas are
+// dropped and the backlog freed under a new replication ID, so that none
+// continues from the old dataset: they all resync. A replica also drops
+// its link, to resync from its master.
+func (m *Manager) ResetHistory() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.dropReplicas()
+	m.backlog = nil
+	m.replID = generateReplicaID()
+	m.replID2, m.secondOffset = noReplID, -1
+	m.seldb = ""
+	if m.GetRole() == RoleReplica {
+		m.resumable = false
+		if m.masterConn != nil {
+			m.masterConn.Close()
+		}
+	}
+	logger.Info().Str("replid", m.replID).Msg("dataset replaced, replication history reset")
+}
+
+func (m *Manager) UpdateReplicaOffset(id string, offset int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if replica, ok := m.replicas[id]; ok {
+		replica.Offset = offset
+		replica.LastAckTime = time.Now()
+		m.notifyAckWaiters()
+	}
+}
+
+// WaitForAcks blocks until n replicas have acknowledged the stream up to
+// offset, or with fsynced set have fsynced it to their AOF, or until
+// timeout passes, and returns how many have. A timeout of 0 waits as long
+// as it takes. The replicas are asked for an ACK right away rather than
+// waiting for the next periodic one.
+func (m *Manager) WaitForAcks(n int, offset int64, fsynced bool, timeout time.Duration) int {
+	m.mu.Lock()
+	acked := m.countAcked(offset, fsynced)
+	if acked >= n {
+		m.mu.Unlock()
+		return acked
+	}
+	ch := make(chan struct{}, 1)
+	m.ackWaiters[ch] = struct{}{}
+	if len(m.replicas) > 0 {
+		m.appendStream(appendCommand(nil, "REPLCONF", [][]byte{[]byte("GETACK"), []byte("*")}))
+	}
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		delete(m.ackWaiters, ch)
+		m.mu.Unlock()
+	}()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	for {
+		select {
+		case <-ch:
+		case <-expired:
+			m.mu.RLock()
+			defer m.mu.RUnlock()
+			return m.countAcked(offset, fsynced)
+		}
+		m.mu.RLock()
+		acked = m.countAcked(offset, fsynced)
+		m.mu.RUnlock()
+		if acked >= n {
+			return acked
+		}
+	}
+}
+
+// SetMinReplicas sets how many replicas must have acknowledged the stream
+// within maxLag seconds for the master to accept writes. 0 replicas turns
+// the check off.
+func (m *Manager) SetMinReplicas(n, maxLag int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cfg.MinReplicasToWrite, m.cfg.MinReplicasMaxLag = n, maxLag
+}
+
+// MinReplicas returns the settings of SetMinReplicas.
+func (m *Manager) MinReplicas() (n, maxLag int) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.cfg.MinReplicasToWrite, m.cfg.MinReplicasMaxLag
+}
+
+// EnoughReplicas reports whether this node may accept writes as far as
+// min_replicas_to_write is concerned. Replicas always may, since their
+// writes come from the master.
+func (m *Manager) EnoughReplicas() bool {
+	if m.GetRole() != RoleMaster {
+		return true
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.cfg.MinReplicasToWrite <= 0 || m.goodReplicas() >= m.cfg.MinReplicasToWrite
+}
+
+// goodReplicas counts the online replicas that acknowledged the stream in
+// the last min_replicas_max_lag seconds. m.mu must be held.
+func (m *Manager) goodReplicas() int {
+	n := 0
+	for _, r := range m.replicas {
+		// In whole seconds, as INFO reports the lag
+		if r.State == StateConnected && int(time.Since(r.LastAckTime).Seconds()) <= m.cfg.MinReplicasMaxLag {
+			n++
+		}
+	}
+	return n
+}
+
+// countAcked counts the online replicas that acknowledged offset. m.mu
+// must be held.
+func (m *Manager) countAcked(offset int64, fsynced bool) int {
+	n := 0
+	for _, r := range m.replicas {
+		acked := r.Offset
+		if fsynced {
+			acked = r.AOFOffset
+		}
+		if r.State == StateConnected && acked >= offset {
+			n++
+		}
+	}
+	return n
+}
+
+// notifyAckWaiters wakes the WaitForAcks calls. m.mu must be held.
+func (m *Manager) notifyAckWaiters() {
+	for ch := range m.ackWaiters {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// cron runs the master's periodic work until the manager stops: pinging
+// the replicas, and freeing the backlog once there have been no replicas
+// for repl_backlog_ttl.
+func (m *Manager) cron() {
+	defer m.wg.Done()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	lastPing := time.Now()
+	for {
+		select {
+		case <-m.stopCh:
+			return
+		case <-ticker.C:
+		}
+		if m.GetRole() != RoleMaster {
+			continue
+		}
+		m.mu.Lock()
+		if len(m.replicas) > 0 && time.Since(lastPing) >= pingInterval {
+			m.appendStream(appendCommand(nil, "PING", nil))
+			lastPing = time.Now()
+		}
+		if m.backlog != nil && len(m.replicas) == 0 && m.backlogTTL > 0 && time.Since(m.idleSince) >= m.backlogTTL {
+			m.freeBacklog()
+		}
+		m.mu.Unlock()
+	}
+}
+
+// freeBacklog releases the backlog. No replica can continue this node's
+// history without it, so the history gets a new ID. m.mu must be held.
+func (m *Manager) freeBacklog() {
+	m.backlog = nil
+	m.replID = generateReplicaID()
+	m.replID2, m.secondOffset = noReplID, -1
+	logger.Info().Dur("ttl", m.backlogTTL).Msg("replication backlog freed, no replicas")
+}
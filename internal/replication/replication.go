@@ -2,7 +2,9 @@ package replication
 
 import (
 	"bufio"
+	"crypto/rand"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"net"
@@ -14,6 +16,8 @@ import (
 
 	"github.com/cachestorm/cachestorm/internal/config"
 	"github.com/cachestorm/cachestorm/internal/logger"
+	"github.com/cachestorm/cachestorm/internal/persistence"
+	"github.com/cachestorm/cachestorm/internal/resp"
 	"github.com/cachestorm/cachestorm/internal/store"
 )
 
@@ -33,37 +37,67 @@ const (
 	StateDisconnected
 )
 
-type Replica struct {
-	ID           string
-	Conn         net.Conn
-	IP           string
-	Port         int
-	State        ReplicaState
-	Offset       int64
-	LastAckTime  time.Time
-	ConnectedAt  time.Time
-	Writer       *bufio.Writer
-	Capabilities map[string]bool
-}
-
 type Manager struct {
-	mu             sync.RWMutex
-	cfg            *config.ReplicationConfig
-	store          *store.Store
-	role           atomic.Int32
-	masterConn     net.Conn
-	masterOffset   atomic.Int64
-	masterID       string
-	replicas       map[string]*Replica
-	replicaID      string
-	replBacklog    []byte
-	replBacklogIdx atomic.Int64
-	stopCh         chan struct{}
-	wg             sync.WaitGroup
-	onRoleChange   func(Role)
-	stopped        atomic.Bool
+	mu           sync.RWMutex
+	cfg          *config.ReplicationConfig
+	store        *store.Store
+	role         atomic.Int32
+	masterConn   net.Conn
+	masterOffset atomic.Int64
+	masterID     string
+	replicas     map[string]*Replica
+	replicaSeq   int64
+	stopCh       chan struct{}
+	wg           sync.WaitGroup
+	onRoleChange func(Role)
+	stopped      atomic.Bool
+
+	// The replication stream, whose offset is masterOffset. replID names
+	// the history of the dataset, and replID2 the history it continued
+	// from up to secondOffset when this node stopped following its master.
+	// resumable is set while replID and the offset describe the dataset,
+	// so that a replica may ask its master to continue from them.
+	replID       string
+	replID2      string
+	secondOffset int64
+	resumable    bool
+	backlog      *backlog
+	backlogSize  int
+	backlogTTL   time.Duration
+	idleSince    time.Time // since when a master has had no replicas
+	seldb        string    // namespace the stream last selected, "" for none
+	barrier      func(func())
+	ackWaiters   map[chan struct{}]struct{}
+	diskless     *disklessTransfer // waiting for replicas to join
+
+	// Replica side. The loop following the current master exits when
+	// followStop is closed, then closes followDone. applyMu is held while
+	// a command from the master is applied and added to the stream.
+	applyMu    sync.Mutex
+	executor   func(name string, args [][]byte) error
+	onFullSync func()
+	aofSync    func() error
+	followStop chan struct{}
+	followDone chan struct{}
+	syncing    atomic.Bool
+	lastIO     atomic.Int64 // unix nanoseconds of the last read from the master
+	readOffset atomic.Int64 // offset of the stream read from the master
+	linkDown   time.Time    // since when the link to the master has been down
 }
 
+const (
+	// Delays between attempts to reach a master, doubling while it stays
+	// unreachable.
+	minReconnectDelay = 100 * time.Millisecond
+	maxReconnectDelay = 5 * time.Second
+
+	ackInterval = time.Second
+)
+
+// noReplID is the secondary replication ID of a node that has not taken
+// over from a master.
+var noReplID = strings.Repeat("0", 40)
+
 var globalManager *Manager
 var managerOnce sync.Once
 
@@ -73,31 +107,79 @@ func GetManager() *Manager {
 
 func InitManager(cfg *config.ReplicationConfig, s *store.Store) *Manager {
 	managerOnce.Do(func() {
-		globalManager = &Manager{
-			cfg:         cfg,
-			store:       s,
-			replicas:    make(map[string]*Replica),
-			replBacklog: make([]byte, 1024*1024),
-			replicaID:   generateReplicaID(),
-			stopCh:      make(chan struct{}),
-		}
-		if cfg.Role == "replica" || cfg.Role == "slave" {
-			globalManager.role.Store(int32(RoleReplica))
-		} else {
-			globalManager.role.Store(int32(RoleMaster))
-		}
+		globalManager = NewManager(cfg, s)
 	})
 	return globalManager
 }
 
+// NewManager returns a manager for the server holding s, in the role cfg
+// gives it. Nothing connects until Start.
+func NewManager(cfg *config.ReplicationConfig, s *store.Store) *Manager {
+	size, err := config.ParseMemorySize(cfg.ReplBacklogSize)
+	if err != nil || size <= 0 {
+		size = defaultBacklogSize
+	}
+	m := &Manager{
+		cfg:          cfg,
+		store:        s,
+		replicas:     make(map[string]*Replica),
+		replID:       generateReplicaID(),
+		replID2:      noReplID,
+		secondOffset: -1,
+		backlogSize:  int(size),
+		backlogTTL:   time.Duration(cfg.ReplBacklogTTL) * time.Second,
+		idleSince:    time.Now(),
+		ackWaiters:   make(map[chan struct{}]struct{}),
+		stopCh:       make(chan struct{}),
+	}
+	if cfg.Role == "replica" || cfg.Role == "slave" {
+		m.role.Store(int32(RoleReplica))
+	} else {
+		m.role.Store(int32(RoleMaster))
+	}
+	return m
+}
+
+// generateReplicaID returns a new replication ID: 40 random hex digits.
 func generateReplicaID() string {
-	return fmt.Sprintf("%x", time.Now().UnixNano())
+	b := make([]byte, 20)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// SetExecutor sets the function that applies the master's command stream
+// to the local dataset.
+func (m *Manager) SetExecutor(fn func(name string, args [][]byte) error) {
+	m.executor = fn
+}
+
+// OnFullSync registers a function called each time the dataset has been
+// replaced by the master's, before the command stream is applied.
+func (m *Manager) OnFullSync(fn func()) {
+	m.onFullSync = fn
 }
 
+// SetAOFSync sets the function that fsyncs this node's AOF. A replica with
+// one reports the offset it has fsynced along with its ACKs, which is what
+// WAITAOF on the master waits for.
+func (m *Manager) SetAOFSync(fn func() error) {
+	m.aofSync = fn
+}
+
+// Start begins replicating the configured master when the node is a
+// replica. The master need not be up: the link is retried until it is.
 func (m *Manager) Start() error {
-	if m.GetRole() == RoleReplica {
-		return m.connectToMaster()
+	m.wg.Add(1)
+	go m.cron()
+	if m.GetRole() != RoleReplica {
+		return nil
 	}
+	if m.cfg.MasterHost == "" || m.cfg.MasterPort == 0 {
+		return fmt.Errorf("master host/port not configured")
+	}
+	m.mu.Lock()
+	m.follow(m.cfg.MasterHost, m.cfg.MasterPort)
+	m.mu.Unlock()
 	return nil
 }
 
@@ -106,13 +188,11 @@ func (m *Manager) Stop() {
 		return
 	}
 	close(m.stopCh)
+	m.mu.Lock()
 	if m.masterConn != nil {
 		m.masterConn.Close()
 	}
-	m.mu.Lock()
-	for _, r := range m.replicas {
-		r.Conn.Close()
-	}
+	m.dropReplicas()
 	m.mu.Unlock()
 	m.wg.Wait()
 }
@@ -121,10 +201,15 @@ func (m *Manager) GetRole() Role {
 	return Role(m.role.Load())
 }
 
+// GetReplicaID returns the replication ID of the node's dataset.
 func (m *Manager) GetReplicaID() string {
-	return m.replicaID
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.replID
 }
 
+// GetMasterOffset returns the replication offset: the bytes of the stream
+// this node has sent as a master, or applied as a replica.
 func (m *Manager) GetMasterOffset() int64 {
 	return m.masterOffset.Load()
 }
@@ -150,259 +235,524 @@ func (m *Manager) GetInfo() string {
 	defer m.mu.RUnlock()
 
 	var sb strings.Builder
-	role := m.GetRole()
-
-	if role == RoleMaster {
-		sb.WriteString("# Replication\r\n")
+	sb.WriteString("# Replication\r\n")
+	if m.GetRole() == RoleMaster {
 		sb.WriteString("role:master\r\n")
-		sb.WriteString(fmt.Sprintf("connected_replicas:%d\r\n", len(m.replicas)))
-
-		i := 0
-		for _, r := range m.replicas {
-			if r.State == StateConnected {
-				sb.WriteString(fmt.Sprintf("slave%d:ip=%s,port=%d,state=online,offset=%d,lag=%d\r\n",
-					i, r.IP, r.Port, r.Offset, int(time.Since(r.LastAckTime).Seconds())))
-				i++
-			}
-		}
-		sb.WriteString(fmt.Sprintf("master_replid:%s\r\n", m.replicaID))
-		sb.WriteString(fmt.Sprintf("master_repl_offset:%d\r\n", m.replBacklogIdx.Load()))
-		sb.WriteString("repl_backlog_active:1\r\n")
-		sb.WriteString("repl_backlog_size:1048576\r\n")
-		sb.WriteString(fmt.Sprintf("repl_backlog_first_byte_offset:%d\r\n", m.replBacklogIdx.Load()))
 	} else {
-		sb.WriteString("# Replication\r\n")
 		sb.WriteString("role:slave\r\n")
 		sb.WriteString(fmt.Sprintf("master_host:%s\r\n", m.cfg.MasterHost))
 		sb.WriteString(fmt.Sprintf("master_port:%d\r\n", m.cfg.MasterPort))
 		sb.WriteString(fmt.Sprintf("master_link_status:%s\r\n", m.getMasterLinkStatus()))
 		sb.WriteString(fmt.Sprintf("master_last_io_seconds_ago:%d\r\n", m.getSecondsSinceMasterIO()))
 		sb.WriteString(fmt.Sprintf("master_sync_in_progress:%d\r\n", m.getSyncInProgress()))
+		sb.WriteString(fmt.Sprintf("slave_read_repl_offset:%d\r\n", m.readOffset.Load()))
 		sb.WriteString(fmt.Sprintf("slave_repl_offset:%d\r\n", m.masterOffset.Load()))
-		sb.WriteString(fmt.Sprintf("slave_priority:100\r\n"))
+		if m.masterConn == nil {
+			sb.WriteString(fmt.Sprintf("master_link_down_since_seconds:%d\r\n", int(time.Since(m.linkDown).Seconds())))
+		}
+		sb.WriteString("slave_priority:100\r\n")
 		sb.WriteString(fmt.Sprintf("slave_read_only:%d\r\n", boolToInt(m.cfg.ReadOnly)))
 	}
 
-	return sb.String()
-}
-
-func (m *Manager) connectToMaster() error {
-	if m.cfg.MasterHost == "" || m.cfg.MasterPort == 0 {
-		return fmt.Errorf("master host/port not configured")
+	// A replica's own replicas take its master's stream from it.
+	sb.WriteString(fmt.Sprintf("connected_replicas:%d\r\n", len(m.replicas)))
+	i := 0
+	for _, r := range m.replicas {
+		sb.WriteString(fmt.Sprintf("slave%d:ip=%s,port=%d,state=%s,offset=%d,lag=%d\r\n",
+			i, r.IP, r.Port, r.State, r.Offset, int(time.Since(r.LastAckTime).Seconds())))
+		i++
+	}
+	if m.GetRole() == RoleMaster && m.cfg.MinReplicasToWrite > 0 {
+		sb.WriteString(fmt.Sprintf("min_slaves_good_slaves:%d\r\n", m.goodReplicas()))
 	}
 
-	addr := net.JoinHostPort(m.cfg.MasterHost, strconv.Itoa(m.cfg.MasterPort))
-	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
-	if err != nil {
-		logger.Error().Err(err).Msg("failed to connect to master")
-		return err
+	sb.WriteString(fmt.Sprintf("master_replid:%s\r\n", m.replID))
+	sb.WriteString(fmt.Sprintf("master_replid2:%s\r\n", m.replID2))
+	sb.WriteString(fmt.Sprintf("master_repl_offset:%d\r\n", m.masterOffset.Load()))
+	sb.WriteString(fmt.Sprintf("second_repl_offset:%d\r\n", m.secondOffset))
+	var first int64
+	var histlen int
+	if m.backlog != nil {
+		first, histlen = m.backlog.firstOffset(), m.backlog.histlen
 	}
+	sb.WriteString(fmt.Sprintf("repl_backlog_active:%d\r\n", boolToInt(m.backlog != nil)))
+	sb.WriteString(fmt.Sprintf("repl_backlog_size:%d\r\n", m.backlogSize))
+	sb.WriteString(fmt.Sprintf("repl_backlog_first_byte_offset:%d\r\n", first))
+	sb.WriteString(fmt.Sprintf("repl_backlog_histlen:%d\r\n", histlen))
 
-	m.masterConn = conn
-	logger.Info().Str("addr", addr).Msg("connected to master")
+	return sb.String()
+}
 
+// follow starts the replication loop against host:port, once the loop
+// following the previous master has exited. m.mu must be held.
+func (m *Manager) follow(host string, port int) {
+	prev := m.unfollow()
+	if m.masterConn == nil {
+		m.linkDown = time.Now()
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	m.followStop, m.followDone = stop, done
 	m.wg.Add(1)
-	go m.syncWithMaster()
+	go func() {
+		defer m.wg.Done()
+		defer close(done)
+		if prev != nil {
+			<-prev
+		}
+		m.replicate(net.JoinHostPort(host, strconv.Itoa(port)), stop)
+	}()
+}
 
-	return nil
+// unfollow ends the replication loop, if any, and returns a channel closed
+// once it has exited. m.mu must be held.
+func (m *Manager) unfollow() <-chan struct{} {
+	if m.followStop == nil {
+		return nil
+	}
+	close(m.followStop)
+	m.followStop = nil
+	return m.followDone
 }
 
-func (m *Manager) syncWithMaster() {
-	defer m.wg.Done()
-	defer m.masterConn.Close()
+// replicate keeps a link to the master at addr until stop or the manager
+// is stopped, reconnecting with backoff whenever the link fails.
+func (m *Manager) replicate(addr string, stop <-chan struct{}) {
 	defer logger.RecoverPanic("replication-sync")
 
-	reader := bufio.NewReader(m.masterConn)
-	writer := bufio.NewWriter(m.masterConn)
-
-	if err := m.sendHandshake(writer); err != nil {
-		logger.Error().Err(err).Msg("handshake failed")
-		return
-	}
-
+	delay := minReconnectDelay
 	for {
+		started := time.Now()
+		err := m.syncWithMaster(addr, stop)
 		select {
+		case <-stop:
+			return
 		case <-m.stopCh:
 			return
 		default:
 		}
+		// A link that held for a while was not a failed attempt.
+		if time.Since(started) > maxReconnectDelay {
+			delay = minReconnectDelay
+		}
+		logger.Warn().Err(err).Str("master", addr).Dur("retry_in", delay).Msg("replication link lost")
 
-		line, err := reader.ReadString('\n')
-		if err != nil {
-			if err != io.EOF {
-				logger.Error().Err(err).Msg("read from master failed")
-			}
+		select {
+		case <-time.After(delay):
+		case <-stop:
+			return
+		case <-m.stopCh:
 			return
 		}
-
-		line = strings.TrimSpace(line)
-		m.handleMasterResponse(line, reader)
+		delay = min(delay*2, maxReconnectDelay)
 	}
 }
 
-func (m *Manager) sendHandshake(writer *bufio.Writer) error {
-	if _, err := writer.WriteString("*1\r\n$4\r\nPING\r\n"); err != nil {
-		return err
-	}
-	if err := writer.Flush(); err != nil {
+// syncWithMaster runs one link to the master: the handshake, a full sync
+// unless the master lets the replica continue where it left off, then the
+// command stream until the connection fails or stop is closed.
+func (m *Manager) syncWithMaster(addr string, stop <-chan struct{}) error {
+	conn, err := m.connectToMaster(addr)
+	if err != nil {
 		return err
 	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		// Closing the connection is what interrupts a blocked read.
+		select {
+		case <-stop:
+		case <-m.stopCh:
+		case <-done:
+		}
+		conn.Close()
+	}()
 
-	if _, err := fmt.Fprintf(writer, "*3\r\n$5\r\nREPLCONF\r\n$8\r\nlistening-port\r\n$4\r\n%d\r\n",
-		m.cfg.ReplicaAnnouncePort); err != nil {
-		return err
+	link := m.newMasterLink(conn)
+	full, err := m.sendHandshake(link)
+	if err != nil {
+		return fmt.Errorf("handshake failed: %w", err)
 	}
-	if err := writer.Flush(); err != nil {
-		return err
+	if full {
+		if err := m.receiveRDB(link.r); err != nil {
+			return err
+		}
+		// A master that sent the payload without its length holds the
+		// stream back until it hears the payload is loaded.
+		if err := m.ack(link, m.masterOffset.Load()); err != nil {
+			return err
+		}
 	}
 
-	if _, err := writer.WriteString("*3\r\n$5\r\nREPLCONF\r\n$4\r\ncapa\r\n$6\r\npsync2\r\n"); err != nil {
-		return err
-	}
-	if err := writer.Flush(); err != nil {
-		return err
+	m.mu.Lock()
+	m.masterConn = conn
+	m.readOffset.Store(m.masterOffset.Load())
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		if m.masterConn == conn {
+			m.masterConn = nil
+			m.linkDown = time.Now()
+		}
+		m.mu.Unlock()
+	}()
+	logger.Info().Str("master", addr).Int64("offset", m.masterOffset.Load()).Msg("replication link up")
+
+	go m.sendAcks(link, done)
+	return m.streamCommands(link)
+}
+
+func (m *Manager) connectToMaster(addr string) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		return nil, err
 	}
+	logger.Info().Str("addr", addr).Msg("connected to master")
+	return conn, nil
+}
 
-	psyncCmd := fmt.Sprintf("*3\r\n$5\r\nPSYNC\r\n$40\r\n%s\r\n$1\r\n%d\r\n",
-		strings.Repeat("?", 40), -1)
-	if _, err := writer.WriteString(psyncCmd); err != nil {
-		return err
+// masterLink is a connection to the master. Replies to GETACK and the
+// periodic ACKs are written from different goroutines, hence wmu.
+type masterLink struct {
+	conn net.Conn
+	r    *bufio.Reader
+	wmu  sync.Mutex
+	w    *bufio.Writer
+}
+
+func (m *Manager) newMasterLink(conn net.Conn) *masterLink {
+	timeout := time.Duration(m.cfg.ReplTimeout) * time.Second
+	return &masterLink{
+		conn: conn,
+		r:    bufio.NewReader(&masterReader{m: m, conn: conn, timeout: timeout}),
+		w:    bufio.NewWriter(conn),
 	}
-	if err := writer.Flush(); err != nil {
-		return err
+}
+
+// send writes a command to the master.
+func (l *masterLink) send(args ...string) error {
+	l.wmu.Lock()
+	defer l.wmu.Unlock()
+	fmt.Fprintf(l.w, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(l.w, "$%d\r\n%s\r\n", len(a), a)
 	}
+	return l.w.Flush()
+}
 
-	return nil
+// call sends a command during the handshake and returns the master's
+// one-line reply.
+func (l *masterLink) call(args ...string) (string, error) {
+	if err := l.send(args...); err != nil {
+		return "", err
+	}
+	line, err := l.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
 }
 
-func (m *Manager) handleMasterResponse(line string, reader *bufio.Reader) {
-	if strings.HasPrefix(line, "+FULLRESYNC") {
-		parts := strings.Fields(line[11:])
-		if len(parts) >= 2 {
-			m.mu.Lock()
-			m.masterID = parts[0]
-			if offset, err := strconv.ParseInt(parts[1], 10, 64); err == nil {
-				m.masterOffset.Store(offset)
-			}
-			m.mu.Unlock()
-			logger.Info().Str("master_id", m.masterID).Msg("full sync started")
-		}
-		m.receiveRDB(reader)
-	} else if strings.HasPrefix(line, "+CONTINUE") {
-		logger.Info().Msg("partial sync continued")
-	} else if strings.HasPrefix(line, "$") {
-		length, err := strconv.Atoi(line[1:])
-		if err != nil {
-			logger.Error().Err(err).Str("line", line).Msg("invalid bulk length in replication stream")
-		} else if length > 0 {
-			buf := make([]byte, length)
-			if _, err := io.ReadFull(reader, buf); err == nil {
-				m.processWriteCommand(buf)
-			}
-		}
+// ack reports offset to the master, adding FACK and the same offset once
+// the AOF has been fsynced: every write applied up to offset has been
+// appended to it by then.
+func (m *Manager) ack(link *masterLink, offset int64) error {
+	off := strconv.FormatInt(offset, 10)
+	if m.aofSync != nil && m.aofSync() == nil {
+		return link.send("REPLCONF", "ACK", off, "FACK", off)
 	}
+	return link.send("REPLCONF", "ACK", off)
+}
+
+// masterReader reads from the master, failing once it has been silent for
+// longer than the replication timeout. Masters ping their replicas to stay
+// inside it.
+type masterReader struct {
+	m       *Manager
+	conn    net.Conn
+	timeout time.Duration
+}
 
-	m.masterOffset.Add(1)
+func (r *masterReader) Read(p []byte) (int, error) {
+	if r.timeout > 0 {
+		r.conn.SetReadDeadline(time.Now().Add(r.timeout))
+	}
+	n, err := r.conn.Read(p)
+	if n > 0 {
+		r.m.lastIO.Store(time.Now().UnixNano())
+	}
+	return n, err
 }
 
-func (m *Manager) receiveRDB(reader *bufio.Reader) {
-	line, err := reader.ReadString('\n')
+// sendHandshake introduces the replica and sends PSYNC: with the
+// replication ID and offset of its dataset when it has one the master may
+// continue, and "? -1" for a full sync otherwise. It reports whether the
+// master answered with a full sync.
+func (m *Manager) sendHandshake(link *masterLink) (bool, error) {
+	// A master that requires a password answers -NOAUTH, which AUTH fixes.
+	reply, err := link.call("PING")
 	if err != nil {
-		return
+		return false, err
+	}
+	if strings.HasPrefix(reply, "-") && !strings.HasPrefix(reply, "-NOAUTH") {
+		return false, fmt.Errorf("PING: %s", reply[1:])
+	}
+	if m.cfg.MasterAuth != "" {
+		if reply, err = link.call("AUTH", m.cfg.MasterAuth); err != nil {
+			return false, err
+		}
+		if strings.HasPrefix(reply, "-") {
+			return false, fmt.Errorf("AUTH: %s", reply[1:])
+		}
 	}
-	line = strings.TrimSpace(line)
 
-	if strings.HasPrefix(line, "$") {
-		length, err := strconv.ParseInt(line[1:], 10, 64)
-		if err != nil {
-			logger.Error().Err(err).Str("line", line).Msg("invalid RDB length")
-			return
+	// The master only uses these for INFO, so errors are not fatal.
+	if m.cfg.ReplicaAnnouncePort > 0 {
+		if _, err := link.call("REPLCONF", "listening-port", strconv.Itoa(m.cfg.ReplicaAnnouncePort)); err != nil {
+			return false, err
 		}
-		if length > 0 {
-			buf := make([]byte, length)
-			if _, err := io.ReadFull(reader, buf); err != nil {
-				logger.Error().Err(err).Msg("failed to read RDB data")
-				return
-			}
-			logger.Info().Int64("size", length).Msg("RDB received, syncing complete")
+	}
+	if m.cfg.ReplicaAnnounceIP != "" {
+		if _, err := link.call("REPLCONF", "ip-address", m.cfg.ReplicaAnnounceIP); err != nil {
+			return false, err
 		}
 	}
-}
+	if _, err := link.call("REPLCONF", "capa", "eof", "capa", "psync2"); err != nil {
+		return false, err
+	}
 
-func (m *Manager) processWriteCommand(data []byte) {
-}
+	replid, offset := "?", int64(-1)
+	m.mu.RLock()
+	if m.resumable {
+		replid, offset = m.replID, m.masterOffset.Load()+1
+	}
+	m.mu.RUnlock()
+	if reply, err = link.call("PSYNC", replid, strconv.FormatInt(offset, 10)); err != nil {
+		return false, err
+	}
+	return m.handleMasterResponse(reply)
+}
+
+// handleMasterResponse reads the master's answer to PSYNC and reports
+// whether it is a full sync. A master continuing under another replication
+// ID than the one asked for has taken over from the previous master; the
+// replica takes the new ID and keeps the old one as its secondary ID.
+func (m *Manager) handleMasterResponse(line string) (bool, error) {
+	if rest, ok := strings.CutPrefix(line, "+CONTINUE"); ok {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if id := strings.TrimSpace(rest); id != "" && id != m.replID {
+			m.replID2, m.secondOffset = m.replID, m.masterOffset.Load()+1
+			m.replID = id
+			// This node's replicas reconnect to learn the new ID.
+			m.dropReplicas()
+		}
+		m.masterID = m.replID
+		if m.backlog == nil {
+			m.backlog = newBacklog(m.backlogSize, m.masterOffset.Load())
+		}
+		logger.Info().Str("master_id", m.replID).Int64("offset", m.masterOffset.Load()).Msg("partial resync accepted")
+		return false, nil
+	}
 
-func (m *Manager) AddReplica(conn net.Conn, ip string, port int, capabilities map[string]bool) *Replica {
+	rest, ok := strings.CutPrefix(line, "+FULLRESYNC ")
+	if !ok {
+		return false, fmt.Errorf("unexpected reply to PSYNC: %q", line)
+	}
+	parts := strings.Fields(rest)
+	if len(parts) != 2 {
+		return false, fmt.Errorf("malformed FULLRESYNC: %q", line)
+	}
+	offset, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return false, fmt.Errorf("malformed FULLRESYNC: %q", line)
+	}
 	m.mu.Lock()
-	defer m.mu.Unlock()
-
-	replica := &Replica{
-		ID:           generateReplicaID(),
-		Conn:         conn,
-		IP:           ip,
-		Port:         port,
-		State:        StateConnected,
-		ConnectedAt:  time.Now(),
-		LastAckTime:  time.Now(),
-		Writer:       bufio.NewWriter(conn),
-		Capabilities: capabilities,
+	m.masterID = parts[0]
+	// Until the payload is loaded the dataset belongs to no history.
+	m.resumable = false
+	m.masterOffset.Store(offset)
+	m.mu.Unlock()
+	logger.Info().Str("master_id", parts[0]).Int64("offset", offset).Msg("full sync started")
+	return true, nil
+}
+
+// receiveRDB reads the full-sync payload and replaces the dataset with it.
+// A payload that fails to load leaves the dataset as it was. Once loaded,
+// the dataset takes the master's replication ID and offset, and the backlog
+// starts over from there.
+func (m *Manager) receiveRDB(reader *bufio.Reader) error {
+	var line string
+	for line == "" {
+		// The master sends bare newlines while it prepares the payload.
+		s, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(s)
+	}
+	var payload io.Reader
+	var eof *eofReader
+	var size int64
+	if mark, ok := strings.CutPrefix(line, "$EOF:"); ok && len(mark) == eofMarkLen {
+		// A diskless payload, whose length the master did not know.
+		eof = &eofReader{r: reader, mark: []byte(mark)}
+		payload = eof
+	} else {
+		var err error
+		size, err = strconv.ParseInt(strings.TrimPrefix(line, "$"), 10, 64)
+		if !strings.HasPrefix(line, "$") || err != nil || size <= 0 {
+			return fmt.Errorf("invalid sync payload header %q", line)
+		}
+		payload = io.LimitReader(reader, size)
 	}
 
-	m.replicas[replica.ID] = replica
-
-	logger.Info().
-		Str("id", replica.ID).
-		Str("ip", ip).
-		Int("port", port).
-		Msg("replica connected")
+	m.syncing.Store(true)
+	defer m.syncing.Store(false)
+	rdb := persistence.NewRDBReader(m.store)
+	if err := rdb.ReplaceFrom(payload); err != nil {
+		return fmt.Errorf("loading sync payload: %w", err)
+	}
+	if _, err := io.Copy(io.Discard, payload); err != nil {
+		return err
+	}
 
-	return replica
+	m.mu.Lock()
+	m.replID = m.masterID
+	m.replID2, m.secondOffset = noReplID, -1
+	m.backlog = newBacklog(m.backlogSize, m.masterOffset.Load())
+	m.resumable = true
+	// This node's replicas hold the dataset just replaced.
+	m.dropReplicas()
+	m.seldb = rdb.ReplStreamDB()
+	m.mu.Unlock()
+	if m.seldb != "" {
+		// The master is a replica itself, whose stream goes on in the
+		// namespace it had selected.
+		m.processWriteCommand(selectCommand(m.seldb))
+	}
+	if eof != nil {
+		size = eof.n
+	}
+	logger.Info().Int64("size", size).Bool("diskless", eof != nil).Msg("full sync loaded")
+	if m.onFullSync != nil {
+		m.onFullSync()
+	}
+	return nil
 }
 
-func (m *Manager) RemoveReplica(id string) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+// streamCommands applies the master's command stream, adding each command
+// to this node's own stream: the offset and the backlog.
+func (m *Manager) streamCommands(link *masterLink) error {
+	rd := resp.NewReader(link.r)
+	for {
+		name, args, err := rd.ReadCommand()
+		if err != nil {
+			return err
+		}
+		data := appendCommand(nil, name, args)
+		m.readOffset.Add(int64(len(data)))
+		getack := strings.EqualFold(name, "REPLCONF") && len(args) > 0 && strings.EqualFold(string(args[0]), "GETACK")
+		// The offset acknowledged excludes the GETACK itself.
+		acked := m.masterOffset.Load()
+
+		m.applyMu.Lock()
+		if !getack {
+			m.processWriteCommand(name, args)
+		}
+		m.mu.Lock()
+		if ns, ok := selectedNamespace(name, args); ok {
+			m.seldb = ns
+		}
+		m.appendStream(data)
+		m.mu.Unlock()
+		m.applyMu.Unlock()
 
-	if replica, ok := m.replicas[id]; ok {
-		replica.Conn.Close()
-		delete(m.replicas, id)
-		logger.Info().Str("id", id).Msg("replica disconnected")
+		if getack {
+			if err := m.ack(link, acked); err != nil {
+				return err
+			}
+		}
 	}
 }
 
-func (m *Manager) UpdateReplicaOffset(id string, offset int64) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-
-	if replica, ok := m.replicas[id]; ok {
-		replica.Offset = offset
-		replica.LastAckTime = time.Now()
+// selectedNamespace returns the namespace a SELECT or NAMESPACE of the
+// stream selects.
+func selectedNamespace(name string, args [][]byte) (string, bool) {
+	if len(args) != 1 {
+		return "", false
+	}
+	switch strings.ToUpper(name) {
+	case "SELECT":
+		db, err := strconv.Atoi(string(args[0]))
+		if err != nil {
+			return "", false
+		}
+		return store.DBNamespace(db), true
+	case "NAMESPACE":
+		return string(args[0]), true
 	}
+	return "", false
 }
 
-func (m *Manager) PropagateCommand(cmd []byte) {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
+// selectCommand is the command of the stream selecting namespace, the
+// inverse of selectedNamespace.
+func selectCommand(namespace string) (string, [][]byte) {
+	if db, ok := store.NamespaceDB(namespace); ok {
+		return "SELECT", [][]byte{[]byte(strconv.Itoa(db))}
+	}
+	return "NAMESPACE", [][]byte{[]byte(namespace)}
+}
 
-	newIdx := m.replBacklogIdx.Add(1)
-	idx := int(newIdx) % len(m.replBacklog)
-	copy(m.replBacklog[idx:], cmd)
+// processWriteCommand applies one command from the master. The master has
+// already accepted it, so a failure here is logged rather than fatal.
+func (m *Manager) processWriteCommand(name string, args [][]byte) {
+	if m.executor == nil {
+		return
+	}
+	if err := m.executor(name, args); err != nil {
+		logger.Warn().Err(err).Str("cmd", name).Msg("replicated command failed")
+	}
+}
 
-	for id, replica := range m.replicas {
-		if replica.State == StateConnected && replica.Writer != nil {
-			if _, err := replica.Writer.Write(cmd); err != nil {
-				logger.Error().Err(err).Str("replica", id).Msg("failed to write to replica")
-				continue
-			}
-			if err := replica.Writer.Flush(); err != nil {
-				logger.Error().Err(err).Str("replica", id).Msg("failed to flush replica writer")
-				continue
+// sendAcks reports the replication offset to the master every ackInterval
+// until done is closed.
+func (m *Manager) sendAcks(link *masterLink, done <-chan struct{}) {
+	ticker := time.NewTicker(ackInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := m.ack(link, m.masterOffset.Load()); err != nil {
+				link.conn.Close()
+				return
 			}
-			replica.Offset++
 		}
 	}
 }
 
+// appendCommand appends a command to buf as the RESP array it travels as
+// in the replication stream, whose length is what the offset counts.
+func appendCommand(buf []byte, name string, args [][]byte) []byte {
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)+1), 10)
+	buf = append(buf, '\r', '\n')
+	buf = appendBulk(buf, []byte(name))
+	for _, a := range args {
+		buf = appendBulk(buf, a)
+	}
+	return buf
+}
+
+func appendBulk(buf, b []byte) []byte {
+	buf = append(buf, '$')
+	buf = strconv.AppendInt(buf, int64(len(b)), 10)
+	buf = append(buf, '\r', '\n')
+	buf = append(buf, b...)
+	return append(buf, '\r', '\n')
+}
+
 func (m *Manager) getMasterLinkStatus() string {
 	if m.masterConn == nil {
 		return "down"
@@ -410,12 +760,52 @@ func (m *Manager) getMasterLinkStatus() string {
 	return "up"
 }
 
+// getSecondsSinceMasterIO is -1 while the link is down. m.mu must be held.
 func (m *Manager) getSecondsSinceMasterIO() int {
-	return 0
+	last := m.lastIO.Load()
+	if m.masterConn == nil || last == 0 {
+		return -1
+	}
+	return int(time.Since(time.Unix(0, last)).Seconds())
+}
+
+// MasterLinkUp reports whether this node is a replica streaming from its
+// master, past the handshake and any full sync.
+func (m *Manager) MasterLinkUp() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.GetRole() == RoleReplica && m.masterConn != nil
+}
+
+// ReadOnly reports whether a replica refuses writes from its clients.
+func (m *Manager) ReadOnly() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.cfg.ReadOnly
+}
+
+func (m *Manager) SetReadOnly(readOnly bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cfg.ReadOnly = readOnly
+}
+
+// ServeStaleData reports whether a replica answers from its dataset while
+// the link to its master is down.
+func (m *Manager) ServeStaleData() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.cfg.ServeStaleData
+}
+
+func (m *Manager) SetServeStaleData(serve bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cfg.ServeStaleData = serve
 }
 
 func (m *Manager) getSyncInProgress() int {
-	return 0
+	return boolToInt(m.syncing.Load())
 }
 
 func (m *Manager) SetRole(role Role) {
@@ -429,32 +819,41 @@ func (m *Manager) OnRoleChange(fn func(Role)) {
 	m.onRoleChange = fn
 }
 
+// ReplicaOf follows the master at host:port, or with "no" and 1 stops
+// following one. A node that stops following takes a new replication ID
+// and keeps the previous one as its secondary ID, which lets the replicas
+// of its former master continue from it. A master that starts following
+// drops its replicas and asks the new master to continue its own history.
 func (m *Manager) ReplicaOf(host string, port int) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
 	if host == "no" && port == 1 {
+		if m.GetRole() == RoleReplica && m.resumable {
+			m.replID2, m.secondOffset = m.replID, m.masterOffset.Load()+1
+			m.replID = generateReplicaID()
+		}
+		m.seldb = ""
 		m.SetRole(RoleMaster)
+		m.unfollow()
 		if m.masterConn != nil {
 			m.masterConn.Close()
 			m.masterConn = nil
 		}
 		m.cfg.MasterHost = ""
 		m.cfg.MasterPort = 0
-		logger.Info().Msg("promoted to master")
+		logger.Info().Str("replid", m.replID).Str("replid2", m.replID2).Msg("promoted to master")
 		return nil
 	}
 
+	if m.GetRole() == RoleMaster {
+		m.dropReplicas()
+		m.resumable = true
+	}
 	m.cfg.MasterHost = host
 	m.cfg.MasterPort = port
 	m.SetRole(RoleReplica)
-
-	go func() {
-		if err := m.connectToMaster(); err != nil {
-			logger.Error().Err(err).Msg("failed to connect to new master")
-		}
-	}()
-
+	m.follow(host, port)
 	return nil
 }
 
@@ -12,26 +12,14 @@ import (
 	"time"
 
 	"github.com/cachestorm/cachestorm/internal/config"
+	"github.com/cachestorm/cachestorm/internal/resp"
 	"github.com/cachestorm/cachestorm/internal/store"
 )
 
 // newTestManager creates a fresh Manager instance for isolated testing,
 // bypassing the sync.Once singleton.
 func newTestManager(cfg *config.ReplicationConfig, s *store.Store) *Manager {
-	m := &Manager{
-		cfg:         cfg,
-		store:       s,
-		replicas:    make(map[string]*Replica),
-		replBacklog: make([]byte, 1024*1024),
-		replicaID:   generateReplicaID(),
-		stopCh:      make(chan struct{}),
-	}
-	if cfg.Role == "replica" || cfg.Role == "slave" {
-		m.role.Store(int32(RoleReplica))
-	} else {
-		m.role.Store(int32(RoleMaster))
-	}
-	return m
+	return NewManager(cfg, s)
 }
 
 // errWriter is a writer that always returns an error.
@@ -41,40 +29,6 @@ func (e *errWriter) Write(b []byte) (int, error) {
 	return 0, errors.New("write error")
 }
 
-// countingErrWriter fails after a certain number of bytes written.
-type countingErrWriter struct {
-	written   int
-	failAfter int
-}
-
-func (w *countingErrWriter) Write(b []byte) (int, error) {
-	if w.written+len(b) > w.failAfter {
-		remaining := w.failAfter - w.written
-		if remaining <= 0 {
-			return 0, errors.New("write limit reached")
-		}
-		w.written += remaining
-		return remaining, errors.New("write limit reached")
-	}
-	w.written += len(b)
-	return len(b), nil
-}
-
-// nthCallErrWriter fails on the nth Write call (0-indexed).
-type nthCallErrWriter struct {
-	calls    int
-	failOnCall int
-}
-
-func (w *nthCallErrWriter) Write(b []byte) (int, error) {
-	call := w.calls
-	w.calls++
-	if call == w.failOnCall {
-		return 0, errors.New("write error on call")
-	}
-	return len(b), nil
-}
-
 // errConn is a net.Conn that returns errors on Write and configurable on Read.
 type errConn struct {
 	readData   *bytes.Buffer
@@ -109,389 +63,176 @@ func (c *errConn) SetDeadline(t time.Time) error      { return nil }
 func (c *errConn) SetReadDeadline(t time.Time) error  { return nil }
 func (c *errConn) SetWriteDeadline(t time.Time) error { return nil }
 
-// --- Tests for syncWithMaster ---
-
-func TestSyncWithMaster_HandshakeError(t *testing.T) {
-	// Use net.Pipe; close the server side immediately so handshake write fails.
-	m := newTestManager(&config.ReplicationConfig{
-		Role:       "replica",
-		MasterHost: "127.0.0.1",
-		MasterPort: 6379,
-	}, store.NewStore())
-
-	server, client := net.Pipe()
-	m.masterConn = client
-
-	// Close server immediately so writes to client fail
-	server.Close()
-
-	m.wg.Add(1)
-	m.syncWithMaster()
-	// syncWithMaster should return without blocking
-}
-
-func TestSyncWithMaster_ReadsLines(t *testing.T) {
-	// Provide data that syncWithMaster can read line-by-line, then EOF.
-	m := newTestManager(&config.ReplicationConfig{
-		Role:       "replica",
-		MasterHost: "127.0.0.1",
-		MasterPort: 6379,
-	}, store.NewStore())
-
-	server, client := net.Pipe()
-	m.masterConn = client
+// --- Tests for sendHandshake ---
 
+// scriptedMaster answers each command the replica sends on conn with the
+// reply for its name, recording the commands.
+func scriptedMaster(conn net.Conn, replies map[string]string) <-chan []string {
+	got := make(chan []string, 1)
 	go func() {
-		// Consume the handshake from the client side
-		buf := make([]byte, 4096)
+		defer close(got)
+		var cmds []string
+		r := bufio.NewReader(conn)
 		for {
-			_, err := server.Read(buf)
+			name, args, err := resp.NewReader(r).ReadCommand()
 			if err != nil {
+				got <- cmds
 				return
 			}
-		}
-	}()
-
-	// Write some data the syncWithMaster loop can read, then close
-	go func() {
-		time.Sleep(50 * time.Millisecond)
-		// Send CONTINUE response followed by close
-		server.Write([]byte("+CONTINUE\n"))
-		time.Sleep(20 * time.Millisecond)
-		server.Close()
-	}()
-
-	m.wg.Add(1)
-	m.syncWithMaster()
-}
-
-func TestSyncWithMaster_StopChannel(t *testing.T) {
-	m := newTestManager(&config.ReplicationConfig{
-		Role:                "replica",
-		MasterHost:          "127.0.0.1",
-		MasterPort:          6379,
-		ReplicaAnnouncePort: 6380,
-	}, store.NewStore())
-
-	server, client := net.Pipe()
-	m.masterConn = client
-
-	// Pre-close stopCh so the for-loop's select immediately takes the stopCh case
-	close(m.stopCh)
-
-	go func() {
-		// Consume handshake data from server side so writes don't block
-		buf := make([]byte, 4096)
-		for {
-			server.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
-			_, err := server.Read(buf)
-			if err != nil {
-				break
-			}
-		}
-		server.Close()
-	}()
-
-	m.wg.Add(1)
-	m.syncWithMaster()
-	client.Close()
-}
-
-func TestSyncWithMaster_NonEOFReadError(t *testing.T) {
-	m := newTestManager(&config.ReplicationConfig{
-		Role:                "replica",
-		MasterHost:          "127.0.0.1",
-		MasterPort:          6379,
-		ReplicaAnnouncePort: 6380,
-	}, store.NewStore())
-
-	server, client := net.Pipe()
-	m.masterConn = client
-
-	go func() {
-		// Consume handshake data from server side
-		buf := make([]byte, 4096)
-		for i := 0; i < 20; i++ {
-			server.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
-			_, err := server.Read(buf)
-			if err != nil {
-				break
+			cmd := name
+			for _, a := range args {
+				cmd += " " + string(a)
 			}
+			cmds = append(cmds, cmd)
+			conn.Write([]byte(replies[name] + "\r\n"))
 		}
-		server.SetReadDeadline(time.Time{}) // clear deadline
-
-		// After handshake, set a read deadline on the client side so
-		// ReadString returns a timeout error (non-EOF).
-		client.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
-
-		// Keep the server alive long enough for the timeout to trigger
-		time.Sleep(200 * time.Millisecond)
-		server.Close()
 	}()
-
-	m.wg.Add(1)
-	m.syncWithMaster()
+	return got
 }
 
-// --- Tests for sendHandshake error paths ---
-
-func TestSendHandshake_WriteStringError(t *testing.T) {
+func TestSendHandshake_Auth(t *testing.T) {
 	m := newTestManager(&config.ReplicationConfig{
 		Role:                "replica",
+		MasterAuth:          "secret",
+		ReplicaAnnounceIP:   "10.0.0.2",
 		ReplicaAnnouncePort: 6380,
 	}, store.NewStore())
 
-	// Writer backed by a closed pipe will error immediately
 	server, client := net.Pipe()
-	server.Close()
-	writer := bufio.NewWriter(client)
-
-	err := m.sendHandshake(writer)
-	// The first write or flush should fail since the pipe is closed
-	if err == nil {
-		// It's possible the bufio.Writer buffers until flush
-		// Either way, the function ran through the error paths
-		t.Log("sendHandshake returned nil (buffered), which is acceptable")
+	got := scriptedMaster(server, map[string]string{
+		"PING":     "-NOAUTH Authentication required.",
+		"AUTH":     "+OK",
+		"REPLCONF": "+OK",
+		"PSYNC":    "+FULLRESYNC 0123456789abcdef 42",
+	})
+	if full, err := m.sendHandshake(m.newMasterLink(client)); err != nil || !full {
+		t.Fatalf("handshake: full %v, err %v", full, err)
 	}
 	client.Close()
-}
-
-func TestSendHandshake_FlushErrors(t *testing.T) {
-	// Use a very small buffer writer backed by an errWriter so flushes fail
-	m := newTestManager(&config.ReplicationConfig{
-		Role:                "replica",
-		ReplicaAnnouncePort: 6380,
-	}, store.NewStore())
 
-	w := bufio.NewWriterSize(&errWriter{}, 1) // buffer size 1 forces early flushes
-	err := m.sendHandshake(w)
-	if err == nil {
-		t.Error("expected error from sendHandshake with errWriter")
+	want := "PING|AUTH secret|REPLCONF listening-port 6380|REPLCONF ip-address 10.0.0.2|REPLCONF capa eof capa psync2|PSYNC ? -1"
+	if cmds := strings.Join(<-got, "|"); cmds != want {
+		t.Errorf("handshake sent %s, want %s", cmds, want)
+	}
+	if m.masterID != "0123456789abcdef" || m.GetMasterOffset() != 42 {
+		t.Errorf("master %q at %d", m.masterID, m.GetMasterOffset())
 	}
 }
 
-func TestSendHandshake_FailAtVariousStages(t *testing.T) {
-	m := newTestManager(&config.ReplicationConfig{
-		Role:                "replica",
-		ReplicaAnnouncePort: 6380,
-	}, store.NewStore())
-
-	// With a large bufio buffer (8192), data stays buffered until Flush().
-	// Each Flush() makes one Write() call to the underlying writer.
-	// Flush calls: 0=PING, 1=REPLCONF port, 2=REPLCONF capa, 3=PSYNC
-	// By failing on call N, we test the Flush error at each stage.
-	for failCall := 0; failCall <= 4; failCall++ {
-		ew := &nthCallErrWriter{failOnCall: failCall}
-		w := bufio.NewWriterSize(ew, 8192)
-		err := m.sendHandshake(w)
-		if failCall < 4 && err == nil {
-			t.Errorf("expected error when failing on call %d", failCall)
-		}
+func TestSendHandshake_Errors(t *testing.T) {
+	cases := []struct {
+		name    string
+		replies map[string]string
+	}{
+		{"ping refused", map[string]string{"PING": "-ERR no"}},
+		{"wrong password", map[string]string{"PING": "-NOAUTH", "AUTH": "-WRONGPASS invalid password"}},
+		{"psync refused", map[string]string{"PING": "+PONG", "AUTH": "+OK", "REPLCONF": "+OK", "PSYNC": "-ERR no"}},
 	}
-
-	// Also test with countingErrWriter and small buffer to hit WriteString
-	// error paths (when data exceeds buffer).
-	failPoints := []int{0, 5, 18, 30, 60, 100, 150, 200, 250}
-	for _, fp := range failPoints {
-		cw := &countingErrWriter{failAfter: fp}
-		w := bufio.NewWriterSize(cw, 1)
-		_ = m.sendHandshake(w)
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newTestManager(&config.ReplicationConfig{Role: "replica", MasterAuth: "pw"}, store.NewStore())
+			server, client := net.Pipe()
+			got := scriptedMaster(server, tc.replies)
+			if _, err := m.sendHandshake(m.newMasterLink(client)); err == nil {
+				t.Error("expected the handshake to fail")
+			}
+			client.Close()
+			<-got
+		})
 	}
-}
-
-// --- Tests for handleMasterResponse ---
-
-func TestHandleMasterResponse_FULLRESYNCIncomplete(t *testing.T) {
-	m := newTestManager(&config.ReplicationConfig{Role: "replica"}, store.NewStore())
-
-	// FULLRESYNC with only 1 part (missing offset)
-	reader := bufio.NewReader(strings.NewReader("$0\n"))
-	m.handleMasterResponse("+FULLRESYNC abcdef", reader)
-	// Should not crash; masterID should not be set since parts < 2
-}
-
-func TestHandleMasterResponse_BulkInvalidLength(t *testing.T) {
-	m := newTestManager(&config.ReplicationConfig{Role: "replica"}, store.NewStore())
-
-	reader := bufio.NewReader(strings.NewReader(""))
-	m.handleMasterResponse("$notanumber", reader)
-	// Covers the error branch in bulk string parsing
-}
-
-func TestHandleMasterResponse_BulkZeroLength(t *testing.T) {
-	m := newTestManager(&config.ReplicationConfig{Role: "replica"}, store.NewStore())
-
-	reader := bufio.NewReader(strings.NewReader(""))
-	m.handleMasterResponse("$0", reader)
-	// length == 0 does not read data
-}
-
-func TestHandleMasterResponse_BulkReadError(t *testing.T) {
-	m := newTestManager(&config.ReplicationConfig{Role: "replica"}, store.NewStore())
-
-	// Request 100 bytes but provide only 3 - io.ReadFull will fail
-	reader := bufio.NewReader(strings.NewReader("abc"))
-	m.handleMasterResponse("$100", reader)
-}
 
-func TestHandleMasterResponse_UnrecognizedLine(t *testing.T) {
+	// A master that hangs up
 	m := newTestManager(&config.ReplicationConfig{Role: "replica"}, store.NewStore())
-
-	reader := bufio.NewReader(strings.NewReader(""))
-	m.handleMasterResponse("+OK", reader)
-	// Covers the "none of the if branches match" path; just increments offset
-}
-
-// --- Tests for receiveRDB ---
-
-func TestReceiveRDB_ReadError(t *testing.T) {
-	m := newTestManager(&config.ReplicationConfig{Role: "replica"}, store.NewStore())
-
-	// Empty reader returns immediate EOF
-	reader := bufio.NewReader(strings.NewReader(""))
-	m.receiveRDB(reader)
-}
-
-func TestReceiveRDB_InvalidLength(t *testing.T) {
-	m := newTestManager(&config.ReplicationConfig{Role: "replica"}, store.NewStore())
-
-	reader := bufio.NewReader(strings.NewReader("$notanumber\n"))
-	m.receiveRDB(reader)
-}
-
-func TestReceiveRDB_ReadDataError(t *testing.T) {
-	m := newTestManager(&config.ReplicationConfig{Role: "replica"}, store.NewStore())
-
-	// Claim 100 bytes but provide only 5
-	reader := bufio.NewReader(strings.NewReader("$100\nhello"))
-	m.receiveRDB(reader)
-}
-
-func TestReceiveRDB_ZeroLength(t *testing.T) {
-	m := newTestManager(&config.ReplicationConfig{Role: "replica"}, store.NewStore())
-
-	reader := bufio.NewReader(strings.NewReader("$0\n"))
-	m.receiveRDB(reader)
-}
-
-func TestReceiveRDB_NonDollarPrefix(t *testing.T) {
-	m := newTestManager(&config.ReplicationConfig{Role: "replica"}, store.NewStore())
-
-	reader := bufio.NewReader(strings.NewReader("+OK\n"))
-	m.receiveRDB(reader)
-	// Line doesn't start with "$", so nothing happens
-}
-
-func TestReceiveRDB_SuccessfulRead(t *testing.T) {
-	m := newTestManager(&config.ReplicationConfig{Role: "replica"}, store.NewStore())
-
-	reader := bufio.NewReader(strings.NewReader("$5\nhello"))
-	m.receiveRDB(reader)
-}
-
-// --- Tests for PropagateCommand with connected replicas ---
-
-func TestPropagateCommand_WriteError(t *testing.T) {
-	m := newTestManager(&config.ReplicationConfig{Role: "master"}, store.NewStore())
-
-	conn := &errConn{writeErr: errors.New("write failed")}
-	replica := &Replica{
-		ID:     "r1",
-		Conn:   conn,
-		State:  StateConnected,
-		Writer: bufio.NewWriter(conn),
+	if _, err := m.sendHandshake(m.newMasterLink(&errConn{writeErr: errors.New("write failed")})); err == nil {
+		t.Error("expected error from a connection that cannot be written")
 	}
-	m.replicas["r1"] = replica
-
-	m.PropagateCommand([]byte("*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\nvalue\r\n"))
-	// Covers the Write error branch
 }
 
-func TestPropagateCommand_FlushError(t *testing.T) {
-	m := newTestManager(&config.ReplicationConfig{Role: "master"}, store.NewStore())
-
-	// Use net.Pipe: close reader side so flush fails after buffering
-	server, client := net.Pipe()
-	server.Close()
+// --- Tests for syncWithMaster ---
 
-	replica := &Replica{
-		ID:     "r2",
-		Conn:   client,
-		State:  StateConnected,
-		Writer: bufio.NewWriterSize(client, 1), // tiny buffer forces immediate flush
+func TestSyncWithMaster_StopInterruptsHandshake(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
 	}
-	m.replicas["r2"] = replica
-
-	m.PropagateCommand([]byte("*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\nvalue\r\n"))
-	client.Close()
-}
-
-func TestPropagateCommand_SuccessfulWrite(t *testing.T) {
-	m := newTestManager(&config.ReplicationConfig{Role: "master"}, store.NewStore())
-
-	server, client := net.Pipe()
-	// Consume data on the server side
+	defer ln.Close()
 	go func() {
-		buf := make([]byte, 4096)
-		for {
-			_, err := server.Read(buf)
-			if err != nil {
-				return
-			}
+		// A master that never answers
+		conn, err := ln.Accept()
+		if err == nil {
+			defer conn.Close()
+			io.Copy(io.Discard, conn)
 		}
 	}()
 
-	replica := &Replica{
-		ID:     "r3",
-		Conn:   client,
-		State:  StateConnected,
-		Writer: bufio.NewWriter(client),
+	m := newTestManager(&config.ReplicationConfig{Role: "replica"}, store.NewStore())
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() { done <- m.syncWithMaster(ln.Addr().String(), stop) }()
+	time.Sleep(50 * time.Millisecond)
+	close(stop)
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("expected an error from the interrupted link")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("syncWithMaster did not return after stop")
 	}
-	m.replicas["r3"] = replica
-
-	m.PropagateCommand([]byte("*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\nvalue\r\n"))
+}
 
-	if replica.Offset != 1 {
-		t.Errorf("expected replica offset 1, got %d", replica.Offset)
+func TestStreamCommands_BadInput(t *testing.T) {
+	m := newTestManager(&config.ReplicationConfig{Role: "replica"}, store.NewStore())
+	link := m.newMasterLink(&errConn{readData: bytes.NewBufferString("+OK\r\n")})
+	if err := m.streamCommands(link); err == nil {
+		t.Error("expected error for a reply in the command stream")
+	}
+	if m.GetMasterOffset() != 0 {
+		t.Errorf("offset %d after a bad command", m.GetMasterOffset())
 	}
-
-	client.Close()
-	server.Close()
 }
 
-func TestPropagateCommand_DisconnectedReplica(t *testing.T) {
-	m := newTestManager(&config.ReplicationConfig{Role: "master"}, store.NewStore())
+// --- Tests for the replica streams ---
 
-	replica := &Replica{
-		ID:     "r4",
-		Conn:   &mockConn{},
-		State:  StateDisconnected,
-		Writer: bufio.NewWriter(&mockConn{}),
+func TestFeed_NothingToFeed(t *testing.T) {
+	m := newTestManager(&config.ReplicationConfig{Role: "master"}, store.NewStore())
+	m.Feed("default", "SET", [][]byte{[]byte("k"), []byte("v")})
+	if m.GetMasterOffset() != 0 {
+		t.Errorf("offset %d without replicas or backlog", m.GetMasterOffset())
 	}
-	m.replicas["r4"] = replica
 
-	m.PropagateCommand([]byte("*3\r\n$3\r\nSET\r\n"))
-	// Disconnected replicas are skipped
-	if replica.Offset != 0 {
-		t.Errorf("expected offset 0 for disconnected replica, got %d", replica.Offset)
+	m.SetRole(RoleReplica)
+	m.backlog = newBacklog(64, 0)
+	m.Feed("default", "SET", [][]byte{[]byte("k"), []byte("v")})
+	if m.GetMasterOffset() != 0 {
+		t.Errorf("a replica fed its own writes into the stream, offset %d", m.GetMasterOffset())
 	}
 }
 
-func TestPropagateCommand_NilWriter(t *testing.T) {
+func TestFeed_SelectsNamespace(t *testing.T) {
 	m := newTestManager(&config.ReplicationConfig{Role: "master"}, store.NewStore())
+	r := m.PSync("?", -1, "10.0.0.1", 6380, false)
+	r.WriteSnapshot(io.Discard)
 
-	replica := &Replica{
-		ID:     "r5",
-		Conn:   &mockConn{},
-		State:  StateConnected,
-		Writer: nil,
-	}
-	m.replicas["r5"] = replica
+	m.Feed("", "SET", [][]byte{[]byte("a"), []byte("1")})
+	m.Feed("default", "DEL", [][]byte{[]byte("a")})
+	m.Feed("db2", "DEL", [][]byte{[]byte("b")})
+	m.Feed("sessions", "DEL", [][]byte{[]byte("c")})
 
-	m.PropagateCommand([]byte("*3\r\n$3\r\nSET\r\n"))
-	// nil Writer means the replica is skipped (State == Connected but Writer == nil)
-	if replica.Offset != 0 {
-		t.Errorf("expected offset 0 for nil-writer replica, got %d", replica.Offset)
+	data, err := r.Replica.Next(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "*2\r\n$6\r\nSELECT\r\n$1\r\n0\r\n*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n1\r\n" +
+		"*2\r\n$3\r\nDEL\r\n$1\r\na\r\n" +
+		"*2\r\n$6\r\nSELECT\r\n$1\r\n2\r\n*2\r\n$3\r\nDEL\r\n$1\r\nb\r\n" +
+		"*2\r\n$9\r\nNAMESPACE\r\n$8\r\nsessions\r\n*2\r\n$3\r\nDEL\r\n$1\r\nc\r\n"
+	if string(data) != want {
+		t.Errorf("stream %q, want %q", data, want)
+	}
+	if m.GetMasterOffset() != int64(len(want)) {
+		t.Errorf("offset %d, want %d", m.GetMasterOffset(), len(want))
 	}
 }
 
@@ -500,17 +241,14 @@ func TestPropagateCommand_NilWriter(t *testing.T) {
 func TestRemoveReplica_ExistingReplica(t *testing.T) {
 	m := newTestManager(&config.ReplicationConfig{Role: "master"}, store.NewStore())
 
-	conn := &errConn{}
-	replica := &Replica{
-		ID:   "remove-me",
-		Conn: conn,
-	}
-	m.replicas["remove-me"] = replica
+	m.mu.Lock()
+	replica := m.addReplica("10.0.0.1", 6380, StateConnected)
+	m.mu.Unlock()
 
-	m.RemoveReplica("remove-me")
+	m.RemoveReplica(replica.ID)
 
-	if !conn.closed {
-		t.Error("expected connection to be closed")
+	if _, err := replica.Next(nil); err == nil {
+		t.Error("expected the stream of a removed replica to end")
 	}
 	if len(m.replicas) != 0 {
 		t.Errorf("expected 0 replicas, got %d", len(m.replicas))
@@ -523,8 +261,7 @@ func TestUpdateReplicaOffset_ExistingReplica(t *testing.T) {
 	m := newTestManager(&config.ReplicationConfig{Role: "master"}, store.NewStore())
 
 	replica := &Replica{
-		ID:   "update-me",
-		Conn: &mockConn{},
+		ID: "update-me",
 	}
 	m.replicas["update-me"] = replica
 
@@ -572,6 +309,7 @@ func TestReplicaOf_NoOneWithMasterConn(t *testing.T) {
 
 func TestReplicaOf_SetNewMaster(t *testing.T) {
 	m := newTestManager(&config.ReplicationConfig{Role: "master"}, store.NewStore())
+	defer m.Stop()
 
 	// Use localhost with a port that is almost certainly not listening,
 	// so the dial fails quickly with "connection refused" (not a timeout).
@@ -588,104 +326,65 @@ func TestReplicaOf_SetNewMaster(t *testing.T) {
 		t.Errorf("expected MasterHost 127.0.0.1, got %s", m.cfg.MasterHost)
 	}
 
-	// Wait for the background goroutine to try connectToMaster and hit the
-	// error logging branch (line 453-455). Connection refused is fast.
-	time.Sleep(500 * time.Millisecond)
-}
-
-// --- Tests for connectToMaster ---
-
-func TestConnectToMaster_EmptyHost(t *testing.T) {
-	m := newTestManager(&config.ReplicationConfig{
-		Role:       "replica",
-		MasterHost: "",
-		MasterPort: 0,
-	}, store.NewStore())
-
-	err := m.connectToMaster()
-	if err == nil {
-		t.Error("expected error for empty host/port")
+	// Switching masters ends the loop following the old one.
+	first := m.followDone
+	if err := m.ReplicaOf("127.0.0.1", 59433); err != nil {
+		t.Fatalf("unexpected error: %v", err)
 	}
-	if !strings.Contains(err.Error(), "not configured") {
-		t.Errorf("expected 'not configured' error, got: %v", err)
+	select {
+	case <-first:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the loop following the previous master is still running")
 	}
 }
 
-func TestConnectToMaster_EmptyPort(t *testing.T) {
-	m := newTestManager(&config.ReplicationConfig{
-		Role:       "replica",
-		MasterHost: "127.0.0.1",
-		MasterPort: 0,
-	}, store.NewStore())
+// --- Tests for connectToMaster ---
 
-	err := m.connectToMaster()
-	if err == nil {
-		t.Error("expected error for zero port")
+func TestStart_NotConfigured(t *testing.T) {
+	for _, cfg := range []*config.ReplicationConfig{
+		{Role: "replica", MasterHost: "", MasterPort: 0},
+		{Role: "replica", MasterHost: "127.0.0.1", MasterPort: 0},
+	} {
+		m := newTestManager(cfg, store.NewStore())
+		err := m.Start()
+		if err == nil || !strings.Contains(err.Error(), "not configured") {
+			t.Errorf("expected 'not configured' error, got: %v", err)
+		}
 	}
 }
 
 func TestConnectToMaster_ConnectionRefused(t *testing.T) {
-	m := newTestManager(&config.ReplicationConfig{
-		Role:       "replica",
-		MasterHost: "127.0.0.1",
-		MasterPort: 59123, // unlikely to be listening
-	}, store.NewStore())
+	m := newTestManager(&config.ReplicationConfig{Role: "replica"}, store.NewStore())
 
-	err := m.connectToMaster()
+	_, err := m.connectToMaster("127.0.0.1:59123") // unlikely to be listening
 	if err == nil {
 		t.Error("expected connection error")
 	}
 }
 
 func TestConnectToMaster_Success(t *testing.T) {
-	// Start a listener, connect to it, then close everything.
 	ln, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
 		t.Fatalf("failed to listen: %v", err)
 	}
 	defer ln.Close()
 
-	addr := ln.Addr().(*net.TCPAddr)
-
-	m := newTestManager(&config.ReplicationConfig{
-		Role:       "replica",
-		MasterHost: "127.0.0.1",
-		MasterPort: addr.Port,
-	}, store.NewStore())
-
-	// Accept connections on the listener
 	var wg sync.WaitGroup
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 		conn, err := ln.Accept()
-		if err != nil {
-			return
-		}
-		// Drain data then close
-		buf := make([]byte, 4096)
-		for {
-			_, err := conn.Read(buf)
-			if err != nil {
-				conn.Close()
-				return
-			}
+		if err == nil {
+			conn.Close()
 		}
 	}()
 
-	err = m.connectToMaster()
+	m := newTestManager(&config.ReplicationConfig{Role: "replica"}, store.NewStore())
+	conn, err := m.connectToMaster(ln.Addr().String())
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
-
-	// Clean up
-	m.stopped.Store(false)
-	m.stopCh = make(chan struct{})
-	close(m.stopCh)
-	if m.masterConn != nil {
-		m.masterConn.Close()
-	}
-	m.wg.Wait()
+	conn.Close()
 	wg.Wait()
 }
 
@@ -698,10 +397,15 @@ func TestStart_Replica(t *testing.T) {
 		MasterPort: 59876, // nothing listening
 	}, store.NewStore())
 
-	err := m.Start()
-	if err == nil {
-		t.Error("expected error from connectToMaster since nothing is listening")
+	// The master being down is not an error: the link is retried.
+	if err := m.Start(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if info := m.GetInfo(); !strings.Contains(info, "master_link_status:down") {
+		t.Errorf("expected the link to be down:\n%s", info)
 	}
+	m.Stop()
 }
 
 func TestStart_Master(t *testing.T) {
@@ -713,6 +417,7 @@ func TestStart_Master(t *testing.T) {
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
+	m.Stop()
 }
 
 // --- Tests for Stop ---
@@ -733,18 +438,17 @@ func TestStop_WithMasterConn(t *testing.T) {
 func TestStop_WithReplicas(t *testing.T) {
 	m := newTestManager(&config.ReplicationConfig{Role: "master"}, store.NewStore())
 
-	conn1 := &errConn{}
-	conn2 := &errConn{}
-	m.replicas["r1"] = &Replica{ID: "r1", Conn: conn1}
-	m.replicas["r2"] = &Replica{ID: "r2", Conn: conn2}
+	m.mu.Lock()
+	r1 := m.addReplica("10.0.0.1", 6380, StateConnected)
+	r2 := m.addReplica("10.0.0.2", 6380, StateConnected)
+	m.mu.Unlock()
 
 	m.Stop()
 
-	if !conn1.closed {
-		t.Error("expected replica r1 connection to be closed")
-	}
-	if !conn2.closed {
-		t.Error("expected replica r2 connection to be closed")
+	for _, r := range []*Replica{r1, r2} {
+		if _, err := r.Next(nil); err == nil {
+			t.Errorf("expected the stream of replica %s to end", r.ID)
+		}
 	}
 }
 
@@ -908,17 +612,7 @@ func TestInitManager_SlaveRole(t *testing.T) {
 	}
 }
 
-// --- Tests for processWriteCommand ---
-
-func TestProcessWriteCommand_Coverage(t *testing.T) {
-	m := newTestManager(&config.ReplicationConfig{Role: "replica"}, store.NewStore())
-	// processWriteCommand is currently a no-op; verify it doesn't panic
-	m.processWriteCommand(nil)
-	m.processWriteCommand([]byte{})
-	m.processWriteCommand([]byte("SET key value"))
-}
-
-// --- Tests for SyncWriter with errors ---
+// --- Tests for SyncWriter error paths ---
 
 func TestSyncWriter_WriteRDBHeader_Error(t *testing.T) {
 	w := NewSyncWriter(&errWriter{})
@@ -990,90 +684,6 @@ func TestSyncWriter_WriteStringValue_Error(t *testing.T) {
 	}
 }
 
-// --- Tests for AddReplica ---
-
-func TestAddReplica_Full(t *testing.T) {
-	m := newTestManager(&config.ReplicationConfig{Role: "master"}, store.NewStore())
-
-	server, client := net.Pipe()
-	defer server.Close()
-
-	caps := map[string]bool{"eof": true, "psync2": true}
-	replica := m.AddReplica(client, "10.0.0.5", 6380, caps)
-
-	if replica.ID == "" {
-		t.Error("expected non-empty replica ID")
-	}
-	if replica.IP != "10.0.0.5" {
-		t.Errorf("expected IP 10.0.0.5, got %s", replica.IP)
-	}
-	if replica.Port != 6380 {
-		t.Errorf("expected port 6380, got %d", replica.Port)
-	}
-	if replica.State != StateConnected {
-		t.Errorf("expected StateConnected, got %d", replica.State)
-	}
-	if !replica.Capabilities["eof"] {
-		t.Error("expected eof capability")
-	}
-	if replica.Writer == nil {
-		t.Error("expected Writer to be set")
-	}
-
-	// Verify it was added to the map
-	if m.GetReplicaCount() != 1 {
-		t.Errorf("expected 1 replica, got %d", m.GetReplicaCount())
-	}
-
-	client.Close()
-}
-
-// --- Integration-style test for syncWithMaster reading FULLRESYNC ---
-
-func TestSyncWithMaster_FullResyncFlow(t *testing.T) {
-	m := newTestManager(&config.ReplicationConfig{
-		Role:                "replica",
-		MasterHost:          "127.0.0.1",
-		MasterPort:          6379,
-		ReplicaAnnouncePort: 6380,
-	}, store.NewStore())
-
-	server, client := net.Pipe()
-	m.masterConn = client
-
-	go func() {
-		// Consume handshake data
-		buf := make([]byte, 4096)
-		for i := 0; i < 10; i++ {
-			server.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
-			_, err := server.Read(buf)
-			if err != nil {
-				break
-			}
-		}
-		// Send FULLRESYNC response
-		server.Write([]byte("+FULLRESYNC abc123def456 1000\n"))
-		// Send RDB length and data
-		server.Write([]byte("$5\nhello"))
-		time.Sleep(20 * time.Millisecond)
-		// Send a bulk write command
-		server.Write([]byte("$3\nSET"))
-		time.Sleep(20 * time.Millisecond)
-		// Close to end the loop
-		server.Close()
-	}()
-
-	m.wg.Add(1)
-	m.syncWithMaster()
-	// Verify masterID was set
-	m.mu.Lock()
-	id := m.masterID
-	m.mu.Unlock()
-	if id != "abc123def456" {
-		t.Logf("masterID: %s (may vary due to timing)", id)
-	}
-}
-
 // --- Test boolToInt completeness (already tested but verifying via newTestManager) ---
 
 func TestBoolToInt_Additional(t *testing.T) {
@@ -1085,37 +695,6 @@ func TestBoolToInt_Additional(t *testing.T) {
 	}
 }
 
-// --- Test for sendHandshake successful path through net.Pipe ---
-
-func TestSendHandshake_Success(t *testing.T) {
-	m := newTestManager(&config.ReplicationConfig{
-		Role:                "replica",
-		ReplicaAnnouncePort: 6380,
-	}, store.NewStore())
-
-	server, client := net.Pipe()
-
-	// Drain server in background
-	go func() {
-		buf := make([]byte, 4096)
-		for {
-			_, err := server.Read(buf)
-			if err != nil {
-				return
-			}
-		}
-	}()
-
-	writer := bufio.NewWriter(client)
-	err := m.sendHandshake(writer)
-	if err != nil {
-		t.Errorf("unexpected error: %v", err)
-	}
-
-	client.Close()
-	server.Close()
-}
-
 // --- Test for Stop with nil masterConn ---
 
 func TestStop_NilMasterConn(t *testing.T) {
@@ -3,12 +3,23 @@ package replication
 import (
 	"bufio"
 	"bytes"
+	"errors"
+	"fmt"
+	"io"
 	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/cachestorm/cachestorm/internal/config"
+	"github.com/cachestorm/cachestorm/internal/persistence"
+	"github.com/cachestorm/cachestorm/internal/resp"
 	"github.com/cachestorm/cachestorm/internal/store"
 )
 
@@ -217,13 +228,13 @@ func TestManagerUpdateReplicaOffset(t *testing.T) {
 	m.UpdateReplicaOffset("nonexistent", 100)
 }
 
-func TestManagerPropagateCommand(t *testing.T) {
+func TestManagerFeed(t *testing.T) {
 	m := GetManager()
 	if m == nil {
 		t.Fatal("expected manager")
 	}
 
-	m.PropagateCommand([]byte("*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\nvalue\r\n"))
+	m.Feed("default", "SET", [][]byte{[]byte("key"), []byte("value")})
 }
 
 func TestBoolToInt(t *testing.T) {
@@ -253,9 +264,10 @@ func TestGetSecondsSinceMasterIO(t *testing.T) {
 		t.Fatal("expected manager")
 	}
 
+	// There is no link to the master, hence no last I/O
 	seconds := m.getSecondsSinceMasterIO()
-	if seconds != 0 {
-		t.Errorf("expected 0, got %d", seconds)
+	if seconds != -1 {
+		t.Errorf("expected -1, got %d", seconds)
 	}
 }
 
@@ -444,15 +456,16 @@ func TestConnectToMasterError(t *testing.T) {
 		t.Fatal("expected manager")
 	}
 
-	originalRole := m.GetRole()
-	m.SetRole(RoleReplica)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
 
-	err := m.connectToMaster()
-	if err == nil {
+	if _, err := m.connectToMaster(addr); err == nil {
 		t.Error("expected error connecting to invalid master")
 	}
-
-	m.SetRole(originalRole)
 }
 
 func TestGetMasterLinkStatusUp(t *testing.T) {
@@ -497,13 +510,15 @@ func TestManagerAddReplica(t *testing.T) {
 	originalRole := m.GetRole()
 	m.SetRole(RoleMaster)
 
-	conn := &mockConn{}
-	m.AddReplica(conn, "127.0.0.1", 6380, map[string]bool{"eof": true})
-
-	count := m.GetReplicaCount()
-	_ = count
+	rs := m.PSync("?", -1, "127.0.0.1", 6380, false)
+	if err := rs.WriteSnapshot(io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if rs.Partial || rs.Replica.State != StateSyncing {
+		t.Errorf("PSYNC ? -1 got partial %v, state %s", rs.Partial, rs.Replica.State)
+	}
 
-	m.RemoveReplica("test-replica-2")
+	rs.Replica.Close()
 	m.SetRole(originalRole)
 }
 
@@ -516,8 +531,8 @@ func TestManagerPropagateToReplicas(t *testing.T) {
 	originalRole := m.GetRole()
 	m.SetRole(RoleMaster)
 
-	m.PropagateCommand([]byte("*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\nvalue\r\n"))
-	m.PropagateCommand([]byte("*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n"))
+	m.Feed("default", "SET", [][]byte{[]byte("key"), []byte("value")})
+	m.Feed("db1", "DEL", [][]byte{[]byte("key")})
 
 	m.SetRole(originalRole)
 }
@@ -554,96 +569,645 @@ func (m *mockConn) SetReadDeadline(t time.Time) error  { return nil }
 func (m *mockConn) SetWriteDeadline(t time.Time) error { return nil }
 
 func TestReplicationHandleMasterResponse(t *testing.T) {
-	m := GetManager()
-	if m == nil {
-		t.Fatal("expected manager")
+	m := newTestManager(&config.ReplicationConfig{Role: "replica"}, store.NewStore())
+
+	if full, err := m.handleMasterResponse("+FULLRESYNC abc123 1000"); err != nil || !full {
+		t.Fatalf("full %v, err %v", full, err)
+	}
+	if m.masterID != "abc123" || m.GetMasterOffset() != 1000 {
+		t.Errorf("master %q at %d, want abc123 at 1000", m.masterID, m.GetMasterOffset())
+	}
+
+	// A master continuing under another ID took over from the one the
+	// replica followed, which becomes the secondary ID.
+	m.replID = "abc123"
+	if full, err := m.handleMasterResponse("+CONTINUE def456"); err != nil || full {
+		t.Fatalf("full %v, err %v", full, err)
+	}
+	if m.replID != "def456" || m.replID2 != "abc123" || m.secondOffset != 1001 {
+		t.Errorf("replid %s, replid2 %s up to %d", m.replID, m.replID2, m.secondOffset)
+	}
+	if full, err := m.handleMasterResponse("+CONTINUE"); err != nil || full || m.replID != "def456" {
+		t.Errorf("bare CONTINUE: full %v, err %v, replid %s", full, err, m.replID)
 	}
 
-	t.Run("FULLRESYNC", func(t *testing.T) {
-		line := "+FULLRESYNC abc123 1000"
-		reader := bufio.NewReader(strings.NewReader(""))
-		m.handleMasterResponse(line, reader)
+	for _, line := range []string{"+FULLRESYNC abc123", "+FULLRESYNC abc123 x", "-ERR no", "+OK"} {
+		if _, err := m.handleMasterResponse(line); err == nil {
+			t.Errorf("handleMasterResponse(%q) succeeded", line)
+		}
+	}
+}
 
-		m.mu.Lock()
-		id := m.masterID
-		m.mu.Unlock()
+func TestReplicationReceiveRDB(t *testing.T) {
+	s := store.NewStore()
+	s.Set("old", &store.StringValue{Data: []byte("v")}, store.SetOptions{})
+	m := newTestManager(&config.ReplicationConfig{Role: "replica"}, s)
 
-		if id != "abc123" {
-			t.Errorf("Expected masterID abc123, got %s", id)
+	for _, stream := range []string{"", "+OK\n", "$0\n", "$x\n", "$5\nhello", "$100\nhello"} {
+		if err := m.receiveRDB(bufio.NewReader(strings.NewReader(stream))); err == nil {
+			t.Errorf("receiveRDB(%q) succeeded", stream)
 		}
-	})
+	}
+	if !s.Exists("old") {
+		t.Error("a payload that failed to load changed the dataset")
+	}
+}
 
-	t.Run("CONTINUE", func(t *testing.T) {
-		line := "+CONTINUE"
-		reader := bufio.NewReader(strings.NewReader(""))
-		m.handleMasterResponse(line, reader)
-	})
+func TestReplicationProcessWriteCommand(t *testing.T) {
+	m := newTestManager(&config.ReplicationConfig{Role: "replica"}, store.NewStore())
+	m.processWriteCommand("SET", [][]byte{[]byte("k"), []byte("v")})
 
-	t.Run("Bulk string", func(t *testing.T) {
-		line := "$5"
-		reader := bufio.NewReader(strings.NewReader("hello"))
-		m.handleMasterResponse(line, reader)
+	var got []string
+	m.SetExecutor(func(name string, args [][]byte) error {
+		got = append(got, name+" "+string(bytes.Join(args, []byte(" "))))
+		return errors.New("failed")
 	})
+	m.processWriteCommand("SET", [][]byte{[]byte("k"), []byte("v")})
+	if len(got) != 1 || got[0] != "SET k v" {
+		t.Errorf("executed %q", got)
+	}
 }
 
-func TestReplicationReceiveRDB(t *testing.T) {
-	m := GetManager()
-	if m == nil {
-		t.Fatal("expected manager")
+func TestAppendCommand(t *testing.T) {
+	args := [][]byte{[]byte("key"), []byte("0123456789")}
+	want := "*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$10\r\n0123456789\r\n"
+	if got := appendCommand([]byte("x"), "SET", args); string(got) != "x"+want {
+		t.Errorf("appendCommand = %q, want %q", got, want)
 	}
+}
 
-	t.Run("With data", func(t *testing.T) {
-		reader := bufio.NewReader(strings.NewReader("$5\nhello"))
-		m.receiveRDB(reader)
-	})
+// fakeMaster is the master end of a replication link. It answers the
+// handshake and sends a full sync holding its store.
+type fakeMaster struct {
+	t    *testing.T
+	ln   net.Listener
+	data *store.Store
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func startFakeMaster(t *testing.T) *fakeMaster {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	return &fakeMaster{t: t, ln: ln, data: store.NewStoreWithNamespaces()}
+}
 
-	t.Run("Empty", func(t *testing.T) {
-		reader := bufio.NewReader(strings.NewReader("$0\n"))
-		m.receiveRDB(reader)
+func (f *fakeMaster) port() int {
+	return f.ln.Addr().(*net.TCPAddr).Port
+}
+
+// accept takes the replica's connection and runs a full sync at offset.
+func (f *fakeMaster) accept(offset int64) {
+	f.t.Helper()
+	f.handshake()
+	f.fullSync(offset)
+}
+
+// handshake takes the replica's connection and answers its handshake up to
+// the PSYNC, which it returns.
+func (f *fakeMaster) handshake() []string {
+	f.t.Helper()
+	conn, err := f.ln.Accept()
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	f.t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	f.conn, f.r = conn, bufio.NewReader(conn)
+
+	for {
+		cmd := f.read()
+		switch strings.ToUpper(cmd[0]) {
+		case "PING":
+			f.send("+PONG\r\n")
+			continue
+		case "REPLCONF":
+			f.send("+OK\r\n")
+			continue
+		case "PSYNC":
+			return cmd
+		default:
+			f.t.Fatalf("unexpected handshake command %q", cmd)
+		}
+	}
+}
+
+// fullSync answers the PSYNC with a full sync of the store at offset.
+func (f *fakeMaster) fullSync(offset int64) {
+	f.t.Helper()
+	path := filepath.Join(f.t.TempDir(), "sync.rdb")
+	if err := persistence.NewRDBWriter(f.data, persistence.RDBConfig{Checksum: true}).Save(path); err != nil {
+		f.t.Fatal(err)
+	}
+	payload, err := os.ReadFile(path)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	f.send(fmt.Sprintf("+FULLRESYNC %040d %d\r\n\n$%d\r\n%s", 7, offset, len(payload), payload))
+}
+
+func (f *fakeMaster) send(data string) {
+	f.t.Helper()
+	if _, err := f.conn.Write([]byte(data)); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+// propagate sends a command down the stream and returns its length.
+func (f *fakeMaster) propagate(args ...string) int64 {
+	f.t.Helper()
+	cmd := fmt.Sprintf("*%d\r\n", len(args))
+	for _, a := range args {
+		cmd += fmt.Sprintf("$%d\r\n%s\r\n", len(a), a)
+	}
+	f.send(cmd)
+	return int64(len(cmd))
+}
+
+// read returns the next command from the replica.
+func (f *fakeMaster) read() []string {
+	f.t.Helper()
+	name, args, err := resp.NewReader(f.r).ReadCommand()
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	cmd := []string{name}
+	for _, a := range args {
+		cmd = append(cmd, string(a))
+	}
+	return cmd
+}
+
+// waitAck reads the replica's ACKs until one reports offset. Periodic
+// ACKs may arrive before it.
+func (f *fakeMaster) waitAck(offset int64) {
+	f.t.Helper()
+	want := strconv.FormatInt(offset, 10)
+	for {
+		cmd := f.read()
+		if len(cmd) != 3 || cmd[0] != "REPLCONF" || cmd[1] != "ACK" {
+			f.t.Fatalf("replica sent %q, want an ACK", cmd)
+		}
+		if cmd[2] == want {
+			return
+		}
+	}
+}
+
+func TestReplicaFollowsMaster(t *testing.T) {
+	master := startFakeMaster(t)
+	master.data.Set("synced", &store.StringValue{Data: []byte("1")}, store.SetOptions{})
+	master.data.ForNamespace("db2").Set("other", &store.StringValue{Data: []byte("2")}, store.SetOptions{})
+
+	local := store.NewStoreWithNamespaces()
+	local.Set("stale", &store.StringValue{Data: []byte("x")}, store.SetOptions{})
+	local.ForNamespace("db5").Set("stale", &store.StringValue{Data: []byte("x")}, store.SetOptions{})
+
+	m := newTestManager(&config.ReplicationConfig{
+		Role:        "replica",
+		MasterHost:  "127.0.0.1",
+		MasterPort:  master.port(),
+		ReplTimeout: 60,
+	}, local)
+	var mu sync.Mutex
+	var executed []string
+	m.SetExecutor(func(name string, args [][]byte) error {
+		mu.Lock()
+		executed = append(executed, name)
+		mu.Unlock()
+		if name == "set" {
+			return local.Set(string(args[0]), &store.StringValue{Data: args[1]}, store.SetOptions{})
+		}
+		return nil
 	})
+	fullSyncs := make(chan struct{}, 2)
+	m.OnFullSync(func() { fullSyncs <- struct{}{} })
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	master.accept(100)
+	<-fullSyncs
+	if local.Exists("stale") || local.ForNamespace("db5").KeyCount() != 0 {
+		t.Error("the full sync kept keys the master does not have")
+	}
+	if !local.Exists("synced") || !local.ForNamespace("db2").Exists("other") {
+		t.Error("the full sync lost keys")
+	}
+
+	offset := int64(100)
+	offset += master.propagate("SELECT", "0")
+	offset += master.propagate("set", "k", "v")
+	getack := master.propagate("REPLCONF", "GETACK", "*")
+	master.waitAck(offset)
+	offset += getack
+	offset += master.propagate("PING")
+	master.waitAck(offset)
+
+	if e, ok := local.Get("k"); !ok || e.Value.String() != "v" {
+		t.Errorf("k = %+v, %v after the stream", e, ok)
+	}
+	mu.Lock()
+	if strings.Join(executed, " ") != "SELECT set PING" {
+		t.Errorf("executed %q; GETACK is for the link only", executed)
+	}
+	mu.Unlock()
+	info := m.GetInfo()
+	if m.GetMasterOffset() != offset || !m.MasterLinkUp() || !strings.Contains(info, "master_link_status:up") ||
+		!strings.Contains(info, fmt.Sprintf("slave_read_repl_offset:%d\r\n", offset)) ||
+		strings.Contains(info, "master_last_io_seconds_ago:-1") {
+		t.Errorf("offset %d, want %d; INFO:\n%s", m.GetMasterOffset(), offset, info)
+	}
+
+	// A dropped link is resumed where the replica stopped when the master
+	// still has the stream from there.
+	master.conn.Close()
+	for m.MasterLinkUp() {
+		time.Sleep(time.Millisecond)
+	}
+	if info := m.GetInfo(); !strings.Contains(info, "master_link_status:down") ||
+		!strings.Contains(info, "master_last_io_seconds_ago:-1") || !strings.Contains(info, "master_link_down_since_seconds:") {
+		t.Errorf("INFO with the link down:\n%s", info)
+	}
+	psync := master.handshake()
+	if want := []string{"PSYNC", fmt.Sprintf("%040d", 7), strconv.FormatInt(offset+1, 10)}; !slices.Equal(psync, want) {
+		t.Fatalf("replica sent %q, want %q", psync, want)
+	}
+	master.send("+CONTINUE\r\n")
+	offset += master.propagate("set", "k2", "v2")
+	offset += master.propagate("REPLCONF", "GETACK", "*")
+	master.waitAck(offset)
+	if !local.Exists("k") || !local.Exists("k2") || len(fullSyncs) != 0 {
+		t.Errorf("after continuing: k %v, k2 %v, %d full syncs", local.Exists("k"), local.Exists("k2"), len(fullSyncs))
+	}
+
+	// Otherwise it is retried with a fresh full sync.
+	master.conn.Close()
+	master.data.Set("later", &store.StringValue{Data: []byte("3")}, store.SetOptions{})
+	master.accept(500)
+	<-fullSyncs
+	if !local.Exists("later") || local.Exists("k") || m.GetMasterOffset() != 500 {
+		t.Errorf("after resyncing: later %v, k %v, offset %d", local.Exists("later"), local.Exists("k"), m.GetMasterOffset())
+	}
 }
 
-func TestReplicationProcessWriteCommand(t *testing.T) {
-	m := GetManager()
-	if m == nil {
-		t.Fatal("expected manager")
+func TestReplicaRetriesUnreachableMaster(t *testing.T) {
+	master := startFakeMaster(t)
+	port := master.port()
+	master.ln.Close()
+
+	m := newTestManager(&config.ReplicationConfig{
+		Role:       "replica",
+		MasterHost: "127.0.0.1",
+		MasterPort: port,
+	}, store.NewStoreWithNamespaces())
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
 	}
+	defer m.Stop()
 
-	// processWriteCommand is a no-op currently
-	m.processWriteCommand([]byte("SET key value"))
+	// Let a few attempts fail before the master comes up.
+	time.Sleep(300 * time.Millisecond)
+	ln, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Skipf("port %d was taken meanwhile: %v", port, err)
+	}
+	master.ln = ln
+	t.Cleanup(func() { ln.Close() })
+	master.accept(0)
+	master.waitAck(0)
 }
 
-func TestReplicationSyncWithMasterMock(t *testing.T) {
-	t.Skip("Skipping due to deadlock issues in pipe connections - syncWithMaster blocks indefinitely")
+func TestPSyncContinuesFromBacklog(t *testing.T) {
+	m := newTestManager(&config.ReplicationConfig{Role: "master", ReplBacklogSize: "64"}, store.NewStoreWithNamespaces())
+
+	full := m.PSync("?", -1, "127.0.0.1", 6380, false)
+	if full.Partial || full.ReplID != m.GetReplicaID() || full.Offset != 0 {
+		t.Fatalf("PSYNC ? -1 got %+v", full)
+	}
+	if err := full.WriteSnapshot(io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	m.Feed("default", "SET", [][]byte{[]byte("k"), []byte("v")})
+	stream, err := full.Replica.Next(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "*2\r\n$6\r\nSELECT\r\n$1\r\n0\r\n*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$1\r\nv\r\n"; string(stream) != want {
+		t.Errorf("stream %q, want %q", stream, want)
+	}
+	full.Replica.Close()
+
+	partial := m.PSync(full.ReplID, 1, "127.0.0.1", 6380, false)
+	if !partial.Partial {
+		t.Fatal("PSYNC from the start of the backlog needed a full resync")
+	}
+	if data, _ := partial.Replica.Next(nil); !bytes.Equal(data, stream) {
+		t.Errorf("continued with %q, want %q", data, stream)
+	}
+	partial.Replica.Close()
+
+	// The stream outgrows the 64 byte backlog.
+	m.Feed("default", "SET", [][]byte{[]byte("k"), bytes.Repeat([]byte("v"), 64)})
+	offset := m.GetMasterOffset()
+	for _, req := range []struct {
+		replid string
+		offset int64
+	}{{full.ReplID, 1}, {full.ReplID, offset + 2}, {"0123456789012345678901234567890123456789", offset + 1}} {
+		rs := m.PSync(req.replid, req.offset, "127.0.0.1", 6380, false)
+		if rs.Partial {
+			t.Errorf("PSYNC %s %d continued", req.replid, req.offset)
+		} else {
+			rs.WriteSnapshot(io.Discard)
+		}
+		rs.Replica.Close()
+	}
+
+	// A replica promoted to master serves replicas of its former master up
+	// to where it left that master's history.
+	m.ReplicaOf("127.0.0.1", 1)
+	m.ReplicaOf("no", 1)
+	defer m.Stop()
+	if m.GetReplicaID() == full.ReplID {
+		t.Fatal("the promoted replica kept its replication ID")
+	}
+	m.Feed("default", "DEL", [][]byte{[]byte("k")})
+	if rs := m.PSync(full.ReplID, offset+1, "127.0.0.1", 6380, false); !rs.Partial || rs.ReplID != m.GetReplicaID() {
+		t.Errorf("PSYNC on the former ID got %+v", rs)
+	} else {
+		rs.Replica.Close()
+	}
+	if rs := m.PSync(full.ReplID, m.GetMasterOffset()+1, "127.0.0.1", 6380, false); rs.Partial {
+		t.Error("PSYNC on the former ID past the promotion continued")
+	} else {
+		rs.WriteSnapshot(io.Discard)
+	}
 }
 
-func TestReplicationSendHandshakeMock(t *testing.T) {
-	m := GetManager()
-	if m == nil {
-		t.Fatal("expected manager")
+func TestResetHistoryMakesReplicasResync(t *testing.T) {
+	m := newTestManager(&config.ReplicationConfig{Role: "master"}, store.NewStoreWithNamespaces())
+	defer m.Stop()
+
+	full := m.PSync("?", -1, "127.0.0.1", 6380, false)
+	if err := full.WriteSnapshot(io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	m.Feed("db1", "SET", [][]byte{[]byte("k"), []byte("v")})
+	if _, err := full.Replica.Next(nil); err != nil {
+		t.Fatal(err)
 	}
 
-	// Create a pipe
-	server, client := net.Pipe()
-	defer server.Close()
+	m.ResetHistory()
+	if m.GetReplicaID() == full.ReplID {
+		t.Fatal("the replication ID survived the reset")
+	}
+	if m.GetReplicaCount() != 0 {
+		t.Errorf("%d replicas still attached", m.GetReplicaCount())
+	}
+	if _, err := full.Replica.Next(nil); err == nil {
+		t.Error("the dropped replica's stream went on")
+	}
+	rs := m.PSync(full.ReplID, m.GetMasterOffset()+1, "127.0.0.1", 6380, false)
+	defer rs.Replica.Close()
+	if rs.Partial {
+		t.Fatal("PSYNC continued the history from before the reset")
+	}
+	rs.WriteSnapshot(io.Discard)
+
+	// The new stream selects its namespace again.
+	m.Feed("db1", "DEL", [][]byte{[]byte("k")})
+	if data, _ := rs.Replica.Next(nil); !bytes.HasPrefix(data, []byte("*2\r\n$6\r\nSELECT\r\n$1\r\n1\r\n")) {
+		t.Errorf("stream after the reset = %q", data)
+	}
+}
+
+func TestWaitForAcks(t *testing.T) {
+	m := newTestManager(&config.ReplicationConfig{Role: "master", MinReplicasMaxLag: 10}, store.NewStoreWithNamespaces())
+	defer m.Stop()
+	if got := m.WaitForAcks(0, 0, false, 0); got != 0 {
+		t.Errorf("waiting for no replica got %d", got)
+	}
 
-	writer := bufio.NewWriter(client)
+	rs := m.PSync("?", -1, "127.0.0.1", 6380, false)
+	rs.WriteSnapshot(io.Discard)
+	m.Feed("default", "SET", [][]byte{[]byte("k"), []byte("v")})
+	offset := m.GetMasterOffset()
+	if got := m.WaitForAcks(1, offset, false, 20*time.Millisecond); got != 0 {
+		t.Errorf("WaitForAcks = %d before any ACK", got)
+	}
+	stream, _ := rs.Replica.Next(nil)
+	if !bytes.HasSuffix(stream, []byte("*3\r\n$8\r\nREPLCONF\r\n$6\r\nGETACK\r\n$1\r\n*\r\n")) {
+		t.Errorf("the replica was not asked for an ACK: %q", stream)
+	}
 
-	// Read responses in goroutine
 	go func() {
-		buf := make([]byte, 1024)
-		for {
-			n, err := server.Read(buf)
-			if err != nil {
-				return
+		time.Sleep(20 * time.Millisecond)
+		rs.Replica.Ack(offset, -1)
+	}()
+	if got := m.WaitForAcks(1, offset, false, 0); got != 1 {
+		t.Errorf("WaitForAcks = %d after the ACK", got)
+	}
+	if got := m.WaitForAcks(1, offset, true, 20*time.Millisecond); got != 0 {
+		t.Errorf("WaitForAcks counted %d replicas without an AOF", got)
+	}
+	rs.Replica.Ack(offset, offset)
+	if got := m.WaitForAcks(1, offset, true, 0); got != 1 {
+		t.Errorf("WaitForAcks = %d after the FACK", got)
+	}
+
+	if !m.EnoughReplicas() {
+		t.Error("writes refused without min_replicas_to_write")
+	}
+	m.SetMinReplicas(2, 10)
+	if m.EnoughReplicas() {
+		t.Error("writes accepted with 1 of 2 replicas")
+	}
+	m.SetMinReplicas(1, 10)
+	if !m.EnoughReplicas() || !strings.Contains(m.GetInfo(), "min_slaves_good_slaves:1") {
+		t.Errorf("1 good replica not counted; INFO:\n%s", m.GetInfo())
+	}
+	rs.Replica.Close()
+	if m.EnoughReplicas() {
+		t.Error("writes accepted once the replica left")
+	}
+}
+
+func TestReplicaAcksAOFOffset(t *testing.T) {
+	master := startFakeMaster(t)
+	m := newTestManager(&config.ReplicationConfig{
+		Role:        "replica",
+		MasterHost:  "127.0.0.1",
+		MasterPort:  master.port(),
+		ReplTimeout: 60,
+	}, store.NewStoreWithNamespaces())
+	var fsyncs atomic.Int64
+	m.SetAOFSync(func() error {
+		fsyncs.Add(1)
+		return nil
+	})
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	master.accept(100)
+	master.propagate("REPLCONF", "GETACK", "*")
+	if cmd := master.read(); !slices.Equal(cmd, []string{"REPLCONF", "ACK", "100", "FACK", "100"}) {
+		t.Errorf("replica sent %q", cmd)
+	}
+	if fsyncs.Load() == 0 {
+		t.Error("the replica acknowledged an AOF offset without fsyncing")
+	}
+}
+
+func TestDisklessSyncSharesOneTransfer(t *testing.T) {
+	data := store.NewStoreWithNamespaces()
+	data.Set("k", &store.StringValue{Data: []byte("v")}, store.SetOptions{})
+	m := newTestManager(&config.ReplicationConfig{Role: "master", ReplDisklessSync: true, ReplDisklessSyncDelay: 1}, data)
+	defer m.Stop()
+
+	// Both replicas connect within the delay.
+	var out [2]bytes.Buffer
+	var rs [2]*Resync
+	var wg sync.WaitGroup
+	for i := range rs {
+		rs[i] = m.PSync("?", -1, "127.0.0.1", 6380+i, true)
+		if !rs[i].Diskless {
+			t.Fatalf("PSYNC from a replica with capa eof got %+v", rs[i])
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := rs[i].Transfer(&out[i], true); err != nil {
+				t.Error(err)
 			}
-			_ = n
+		}()
+	}
+	wg.Wait()
+	if out[0].Len() == 0 || out[0].String() != out[1].String() {
+		t.Fatalf("the replicas got different transfers:\n%q\n%q", out[0].String(), out[1].String())
+	}
+
+	r := bufio.NewReader(&out[0])
+	line, _ := r.ReadString('\n')
+	if want := fmt.Sprintf("+FULLRESYNC %s 0\r\n", m.GetReplicaID()); line != want {
+		t.Errorf("transfer starts with %q, want %q", line, want)
+	}
+	loaded := store.NewStoreWithNamespaces()
+	replica := newTestManager(&config.ReplicationConfig{Role: "replica"}, loaded)
+	if _, err := replica.handleMasterResponse(strings.TrimSuffix(line, "\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := replica.receiveRDB(r); err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.Exists("k") || r.Buffered() != 0 {
+		t.Errorf("loaded k %v, %d bytes left over", loaded.Exists("k"), r.Buffered())
+	}
+
+	// The stream waits until the replica says it has loaded the payload.
+	m.Feed("default", "SET", [][]byte{[]byte("k2"), []byte("v")})
+	done := make(chan struct{})
+	time.AfterFunc(50*time.Millisecond, func() { close(done) })
+	if data, err := rs[0].Replica.Next(done); err == nil {
+		t.Fatalf("the stream %q went out before the replica's ACK", data)
+	}
+	rs[0].Replica.Ack(0, -1)
+	if data, err := rs[0].Replica.Next(nil); err != nil || !bytes.Contains(data, []byte("k2")) {
+		t.Errorf("stream after the ACK %q, %v", data, err)
+	}
+}
+
+func TestReplicaServesItsReplicas(t *testing.T) {
+	master := startFakeMaster(t)
+	local := store.NewStoreWithNamespaces()
+	m := newTestManager(&config.ReplicationConfig{
+		Role:        "replica",
+		MasterHost:  "127.0.0.1",
+		MasterPort:  master.port(),
+		ReplTimeout: 60,
+	}, local)
+	ns := store.DBNamespace(0)
+	m.SetExecutor(func(name string, args [][]byte) error {
+		switch name {
+		case "SELECT":
+			db, _ := strconv.Atoi(string(args[0]))
+			ns = store.DBNamespace(db)
+		case "set":
+			return local.ForNamespace(ns).Set(string(args[0]), &store.StringValue{Data: args[1]}, store.SetOptions{})
 		}
-	}()
+		return nil
+	})
+	fullSyncs := make(chan struct{}, 2)
+	m.OnFullSync(func() { fullSyncs <- struct{}{} })
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	master.accept(100)
+	<-fullSyncs
+
+	offset := int64(100)
+	offset += master.propagate("SELECT", "1")
+	offset += master.propagate("set", "k", "v")
+	getack := master.propagate("REPLCONF", "GETACK", "*")
+	master.waitAck(offset)
+	offset += getack
+
+	// The sub-replica gets the master's history, and the namespace its
+	// stream is in, since the SELECT went by before it connected.
+	sub := m.PSync("?", -1, "127.0.0.1", 6381, false)
+	if sub.Partial || sub.ReplID != fmt.Sprintf("%040d", 7) || sub.Offset != offset {
+		t.Fatalf("PSYNC ? -1 on the replica got %+v, want offset %d", sub, offset)
+	}
+	var payload bytes.Buffer
+	if err := sub.WriteSnapshot(&payload); err != nil {
+		t.Fatal(err)
+	}
+	loaded := store.NewStoreWithNamespaces()
+	subm := newTestManager(&config.ReplicationConfig{Role: "replica"}, loaded)
+	var selected []string
+	subm.SetExecutor(func(name string, args [][]byte) error {
+		selected = append(selected, name+" "+string(args[0]))
+		return nil
+	})
+	subm.handleMasterResponse(fmt.Sprintf("+FULLRESYNC %s %d", sub.ReplID, sub.Offset))
+	if err := subm.receiveRDB(bufio.NewReader(strings.NewReader(fmt.Sprintf("$%d\r\n%s", payload.Len(), payload.Bytes())))); err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.ForNamespace("db1").Exists("k") || !slices.Equal(selected, []string{"SELECT 1"}) {
+		t.Errorf("sub-replica loaded k %v, executed %q", loaded.ForNamespace("db1").Exists("k"), selected)
+	}
 
-	err := m.sendHandshake(writer)
-	if err != nil {
-		t.Errorf("sendHandshake failed: %v", err)
+	// The master's stream goes on to the sub-replica as is.
+	set := "*3\r\n$3\r\nset\r\n$2\r\nk2\r\n$2\r\nv2\r\n"
+	offset += master.propagate("set", "k2", "v2")
+	if data, err := sub.Replica.Next(nil); string(data) != set {
+		t.Fatalf("sub-replica stream %q, %v; want %q", data, err, set)
+	}
+	if info := m.GetInfo(); !strings.Contains(info, "connected_replicas:1\r\n") || !strings.Contains(info, "port=6381") {
+		t.Errorf("INFO of the replica:\n%s", info)
+	}
+	sub.Replica.Close()
+	partial := m.PSync(sub.ReplID, sub.Offset+1, "127.0.0.1", 6381, false)
+	if !partial.Partial || partial.ReplID != sub.ReplID {
+		t.Fatalf("PSYNC %s %d on the replica got %+v", sub.ReplID, sub.Offset+1, partial)
+	}
+	if data, _ := partial.Replica.Next(nil); string(data) != set {
+		t.Errorf("continued with %q, want %q", data, set)
+	}
+
+	// A full sync of the replica leaves its replicas with a dataset it no
+	// longer has.
+	master.conn.Close()
+	master.accept(500)
+	<-fullSyncs
+	if _, err := partial.Replica.Next(nil); err == nil {
+		t.Error("the sub-replica stayed attached through its master's full sync")
 	}
-	client.Close()
 }
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"errors"
 	"io"
+	"math"
 	"strconv"
 )
 
@@ -60,6 +61,38 @@ func (r *Reader) ReadValue() (*Value, error) {
 			return nil, err
 		}
 		return NullValue(), nil
+	case TypeMap:
+		return r.readMap(TypeMap)
+	case TypeSet, TypePush:
+		v, err := r.readArray()
+		if err != nil {
+			return nil, err
+		}
+		v.Type = Type(b)
+		return v, nil
+	case TypeDouble:
+		return r.readDouble()
+	case TypeBoolean:
+		return r.readBoolean()
+	case TypeBigNumber:
+		line, err := r.readLine()
+		if err != nil {
+			return nil, err
+		}
+		return BigNumberValue(string(line)), nil
+	case TypeVerbatim:
+		return r.readVerbatim()
+	case TypeAttribute:
+		attrs, err := r.readMap(TypeAttribute)
+		if err != nil {
+			return nil, err
+		}
+		v, err := r.ReadValue()
+		if err != nil {
+			return nil, err
+		}
+		v.Attrs = attrs
+		return v, nil
 	default:
 		return nil, ErrInvalidType
 	}
@@ -193,6 +226,80 @@ func (r *Reader) readArray() (*Value, error) {
 	return ArrayValue(elements), nil
 }
 
+func (r *Reader) readMap(t Type) (*Value, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+
+	count, err := strconv.ParseInt(string(line), 10, 64)
+	if err != nil || count < 0 {
+		return nil, ErrInvalidFormat
+	}
+	if count > MaxArrayElements/2 {
+		return nil, ErrArrayTooLarge
+	}
+
+	pairs := make([]*Value, 0, count*2)
+	for i := int64(0); i < count*2; i++ {
+		val, err := r.ReadValue()
+		if err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, val)
+	}
+
+	v := MapPairs(pairs...)
+	v.Type = t
+	return v, nil
+}
+
+func (r *Reader) readDouble() (*Value, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+	switch string(line) {
+	case "inf", "+inf":
+		return DoubleValue(math.Inf(1)), nil
+	case "-inf":
+		return DoubleValue(math.Inf(-1)), nil
+	case "nan", "-nan":
+		return DoubleValue(math.NaN()), nil
+	}
+	f, err := strconv.ParseFloat(string(line), 64)
+	if err != nil {
+		return nil, ErrInvalidFormat
+	}
+	return DoubleValue(f), nil
+}
+
+func (r *Reader) readBoolean() (*Value, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+	switch string(line) {
+	case "t":
+		return BooleanValue(true), nil
+	case "f":
+		return BooleanValue(false), nil
+	default:
+		return nil, ErrInvalidFormat
+	}
+}
+
+func (r *Reader) readVerbatim() (*Value, error) {
+	v, err := r.readBulkString()
+	if err != nil {
+		return nil, err
+	}
+	if len(v.Bulk) < 4 || v.Bulk[3] != ':' {
+		return nil, ErrInvalidFormat
+	}
+	return &Value{Type: TypeVerbatim, Format: string(v.Bulk[:3]), Bulk: v.Bulk[4:]}, nil
+}
+
 func (r *Reader) readLine() ([]byte, error) {
 	line, err := r.rd.ReadBytes('\n')
 	if err != nil {
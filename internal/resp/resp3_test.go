@@ -0,0 +1,117 @@
+package resp
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func TestRESP3RoundTrip(t *testing.T) {
+	values := []*Value{
+		MapPairs(BulkString("a"), IntegerValue(1), IntegerValue(2), BulkString("b")),
+		SetValue([]*Value{BulkString("x"), BulkString("y")}),
+		DoubleValue(3.25),
+		DoubleValue(math.Inf(-1)),
+		BooleanValue(true),
+		BooleanValue(false),
+		BigNumberValue("3492890328409238509324850943850943825024385"),
+		VerbatimValue("txt", "Some string"),
+		PushValue([]*Value{BulkString("invalidate"), NullValue()}),
+		NullValue(),
+	}
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.SetProtocol(3)
+	for _, v := range values {
+		if err := w.WriteValue(v); err != nil {
+			t.Fatalf("write %c: %v", v.Type, err)
+		}
+	}
+
+	r := NewReader(&buf)
+	for _, want := range values {
+		got, err := r.ReadValue()
+		if err != nil {
+			t.Fatalf("read %c: %v", want.Type, err)
+		}
+		if got.Type != want.Type {
+			t.Fatalf("expected type %c, got %c", want.Type, got.Type)
+		}
+		if got.String() != want.String() {
+			t.Errorf("type %c: expected %q, got %q", want.Type, want.String(), got.String())
+		}
+	}
+}
+
+func TestRESP3MapKeepsOrderAndIndex(t *testing.T) {
+	r := NewReader(bytes.NewReader([]byte("%2\r\n+z\r\n:1\r\n+a\r\n:2\r\n")))
+	v, err := r.ReadValue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v.Array) != 4 || v.Array[0].Str != "z" {
+		t.Fatalf("unexpected pairs: %+v", v.Array)
+	}
+	if v.Map["a"].Int != 2 {
+		t.Errorf("expected a=2, got %+v", v.Map["a"])
+	}
+}
+
+func TestRESP3AttributeAttachesToReply(t *testing.T) {
+	r := NewReader(bytes.NewReader([]byte("|1\r\n+ttl\r\n:3600\r\n$5\r\nhello\r\n")))
+	v, err := r.ReadValue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(v.Bulk) != "hello" {
+		t.Fatalf("expected reply after attribute, got %+v", v)
+	}
+	if v.Attrs == nil || v.Attrs.Map["ttl"].Int != 3600 {
+		t.Errorf("expected ttl attribute, got %+v", v.Attrs)
+	}
+}
+
+func TestRESP2DowngradesRESP3Types(t *testing.T) {
+	tests := []struct {
+		v    *Value
+		want string
+	}{
+		{MapPairs(BulkString("k"), BulkString("v")), "*2\r\n$1\r\nk\r\n$1\r\nv\r\n"},
+		{MapValue(map[string]*Value{"b": IntegerValue(2), "a": IntegerValue(1)}), "*4\r\n$1\r\na\r\n:1\r\n$1\r\nb\r\n:2\r\n"},
+		{SetValue([]*Value{BulkString("m")}), "*1\r\n$1\r\nm\r\n"},
+		{DoubleValue(1.5), "$3\r\n1.5\r\n"},
+		{BooleanValue(true), ":1\r\n"},
+		{BigNumberValue("12345678901234567890"), "$20\r\n12345678901234567890\r\n"},
+		{VerbatimValue("txt", "hi"), "$2\r\nhi\r\n"},
+		{NullValue(), "$-1\r\n"},
+		{AttributeValue(BulkString("k"), BulkString("v")), ""},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		w := NewWriter(&buf)
+		w.SetProtocol(2)
+		if err := w.WriteValue(tt.v); err != nil {
+			t.Fatalf("write %c: %v", tt.v.Type, err)
+		}
+		if buf.String() != tt.want {
+			t.Errorf("type %c: expected %q, got %q", tt.v.Type, tt.want, buf.String())
+		}
+	}
+}
+
+func TestRESP3NativeEncoding(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.SetProtocol(3)
+	w.WriteMap([]*Value{BulkString("proto"), IntegerValue(3)})
+	w.WriteDouble(math.Inf(1))
+	w.WriteBoolean(false)
+	w.WriteNullBulkString()
+	w.WriteVerbatim("mkd", "# x")
+
+	want := "%1\r\n$5\r\nproto\r\n:3\r\n,inf\r\n#f\r\n_\r\n=7\r\nmkd:# x\r\n"
+	if buf.String() != want {
+		t.Errorf("expected %q, got %q", want, buf.String())
+	}
+}
@@ -71,6 +71,22 @@ func TestWriteNullArray(t *testing.T) {
 	}
 }
 
+func TestWriteArrayHeader(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+
+	w.WriteArrayHeader(2)
+	w.WriteValueNoFlush(BulkString("a"))
+	w.WriteValueNoFlush(BulkString("b"))
+	if err := w.Flush(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if buf.String() != "*2\r\n$1\r\na\r\n$1\r\nb\r\n" {
+		t.Errorf("unexpected output %q", buf.String())
+	}
+}
+
 func TestWriteValueNullBulkString(t *testing.T) {
 	var buf bytes.Buffer
 	w := NewWriter(&buf)
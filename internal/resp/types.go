@@ -1,5 +1,10 @@
 package resp
 
+import (
+	"math"
+	"strconv"
+)
+
 type Type byte
 
 const (
@@ -10,17 +15,36 @@ const (
 	TypeArray        Type = '*'
 	TypeMap          Type = '%'
 	TypeNull         Type = '_'
+
+	// RESP3 types
+	TypeSet       Type = '~'
+	TypeDouble    Type = ','
+	TypeBoolean   Type = '#'
+	TypeBigNumber Type = '('
+	TypeVerbatim  Type = '='
+	TypeAttribute Type = '|'
+	TypePush      Type = '>'
 )
 
+// Value is a decoded RESP2/RESP3 reply.
+//
+// Maps and attributes keep their entries in Array as flattened key/value
+// pairs, in wire order, so non-string keys and ordering survive a round
+// trip. Map is a convenience index keyed by each key's String() form; a value
+// built with MapValue has only Map set and is written with sorted keys.
 type Value struct {
 	Type   Type
 	Str    string
 	Int    int64
+	Float  float64
+	Bool   bool
 	Bulk   []byte
 	Array  []*Value
 	Map    map[string]*Value
 	IsNull bool
 	Err    string
+	Format string // verbatim string format, e.g. "txt" or "mkd"
+	Attrs  *Value // attribute map that preceded this reply, if any
 }
 
 func SimpleString(s string) *Value {
@@ -69,6 +93,49 @@ func MapValue(m map[string]*Value) *Value {
 	return &Value{Type: TypeMap, Map: m}
 }
 
+// MapPairs builds a map from flattened key/value pairs, preserving order.
+func MapPairs(pairs ...*Value) *Value {
+	v := &Value{Type: TypeMap, Array: pairs, Map: make(map[string]*Value, len(pairs)/2)}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		v.Map[pairs[i].String()] = pairs[i+1]
+	}
+	return v
+}
+
+func SetValue(items []*Value) *Value {
+	return &Value{Type: TypeSet, Array: items}
+}
+
+func DoubleValue(f float64) *Value {
+	return &Value{Type: TypeDouble, Float: f}
+}
+
+func BooleanValue(b bool) *Value {
+	return &Value{Type: TypeBoolean, Bool: b}
+}
+
+// BigNumberValue holds an arbitrary precision integer in its decimal form.
+func BigNumberValue(s string) *Value {
+	return &Value{Type: TypeBigNumber, Str: s}
+}
+
+// VerbatimValue builds a verbatim string; format is a three letter hint
+// such as "txt" or "mkd".
+func VerbatimValue(format, s string) *Value {
+	return &Value{Type: TypeVerbatim, Format: format, Bulk: []byte(s)}
+}
+
+func PushValue(items []*Value) *Value {
+	return &Value{Type: TypePush, Array: items}
+}
+
+// AttributeValue builds an attribute map from flattened key/value pairs.
+func AttributeValue(pairs ...*Value) *Value {
+	v := MapPairs(pairs...)
+	v.Type = TypeAttribute
+	return v
+}
+
 func OK() *Value {
 	return SimpleString("OK")
 }
@@ -101,7 +168,41 @@ func (v *Value) String() string {
 		return "(array)"
 	case TypeNull:
 		return "(nil)"
+	case TypeMap, TypeAttribute:
+		return "(map)"
+	case TypeSet:
+		return "(set)"
+	case TypePush:
+		return "(push)"
+	case TypeDouble:
+		return FormatDouble(v.Float)
+	case TypeBoolean:
+		if v.Bool {
+			return "true"
+		}
+		return "false"
+	case TypeBigNumber:
+		return v.Str
+	case TypeVerbatim:
+		return string(v.Bulk)
 	default:
 		return "(unknown)"
 	}
 }
+
+// FormatDouble renders a float the way replies carry it: shortest exact
+// decimal form, with inf, -inf and nan spelled out.
+func FormatDouble(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	case math.IsNaN(f):
+		return "nan"
+	}
+	if abs := math.Abs(f); abs != 0 && (abs >= 1e21 || abs < 1e-6) {
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
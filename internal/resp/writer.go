@@ -3,44 +3,61 @@ package resp
 import (
 	"bufio"
 	"io"
+	"sort"
 	"strconv"
 )
 
 type Writer struct {
-	wr *bufio.Writer
+	wr       *bufio.Writer
+	protocol int
 }
 
 func NewWriter(wr io.Writer) *Writer {
 	return &Writer{wr: bufio.NewWriter(wr)}
 }
 
+// SetProtocol selects the protocol version negotiated with the client. With
+// version 2, RESP3-only types are downgraded to their RESP2 equivalents
+// (maps and sets become arrays, doubles and big numbers bulk strings,
+// booleans integers, null a null bulk string). With version 3, or before a
+// version is chosen, every type is written natively.
+func (w *Writer) SetProtocol(version int) {
+	w.protocol = version
+}
+
+// Protocol returns the negotiated protocol version, or 0 if none was set.
+func (w *Writer) Protocol() int {
+	return w.protocol
+}
+
+// IsRESP3 reports whether the client negotiated RESP3, i.e. whether
+// handlers should pick RESP3 reply shapes.
+func (w *Writer) IsRESP3() bool {
+	return w.protocol == 3
+}
+
+func (w *Writer) resp2() bool {
+	return w.protocol == 2
+}
+
 func (w *Writer) Flush() error {
 	return w.wr.Flush()
 }
 
+// WriteRaw writes b as is, for data that is not a RESP value, such as the
+// snapshot sent to a replica or the replication stream.
+func (w *Writer) WriteRaw(b []byte) error {
+	if _, err := w.wr.Write(b); err != nil {
+		return err
+	}
+	return w.wr.Flush()
+}
+
 func (w *Writer) WriteValue(v *Value) error {
-	switch v.Type {
-	case TypeSimpleString:
-		return w.WriteSimpleString(v.Str)
-	case TypeError:
-		return w.WriteError(v.Err)
-	case TypeInteger:
-		return w.WriteInteger(v.Int)
-	case TypeBulkString:
-		if v.IsNull {
-			return w.WriteNullBulkString()
-		}
-		return w.WriteBulkBytes(v.Bulk)
-	case TypeArray:
-		if v.IsNull {
-			return w.WriteNullArray()
-		}
-		return w.WriteArray(v.Array)
-	case TypeNull:
-		return w.WriteNull()
-	default:
-		return ErrInvalidType
+	if err := w.WriteValueNoFlush(v); err != nil {
+		return err
 	}
+	return w.wr.Flush()
 }
 
 func (w *Writer) WriteSimpleString(s string) error {
@@ -106,6 +123,9 @@ func (w *Writer) WriteBulkBytes(b []byte) error {
 }
 
 func (w *Writer) WriteNullBulkString() error {
+	if w.IsRESP3() {
+		return w.WriteNull()
+	}
 	if err := w.wr.WriteByte(byte(TypeBulkString)); err != nil {
 		return err
 	}
@@ -116,6 +136,9 @@ func (w *Writer) WriteNullBulkString() error {
 }
 
 func (w *Writer) WriteNull() error {
+	if w.resp2() {
+		return w.WriteNullBulkString()
+	}
 	if err := w.wr.WriteByte(byte(TypeNull)); err != nil {
 		return err
 	}
@@ -126,6 +149,9 @@ func (w *Writer) WriteNull() error {
 }
 
 func (w *Writer) WriteNullArray() error {
+	if w.IsRESP3() {
+		return w.WriteNull()
+	}
 	if err := w.wr.WriteByte(byte(TypeArray)); err != nil {
 		return err
 	}
@@ -153,57 +179,196 @@ func (w *Writer) WriteArray(items []*Value) error {
 	return w.wr.Flush()
 }
 
+// WriteArrayHeader starts an array of n elements, for replies too large to
+// build first. The caller writes the elements next, with WriteBulkBytes or
+// WriteValueNoFlush, and flushes when done.
+func (w *Writer) WriteArrayHeader(n int64) error {
+	w.writeLine(TypeArray, strconv.FormatInt(n, 10))
+	return nil
+}
+
 func (w *Writer) WriteValueNoFlush(v *Value) error {
 	switch v.Type {
 	case TypeSimpleString:
-		w.wr.WriteByte(byte(TypeSimpleString))
-		w.wr.WriteString(v.Str)
-		w.wr.WriteString("\r\n")
-		return nil
+		w.writeLine(TypeSimpleString, v.Str)
 	case TypeError:
-		w.wr.WriteByte(byte(TypeError))
-		w.wr.WriteString(v.Err)
-		w.wr.WriteString("\r\n")
-		return nil
+		w.writeLine(TypeError, v.Err)
 	case TypeInteger:
-		w.wr.WriteByte(byte(TypeInteger))
-		w.wr.WriteString(strconv.FormatInt(v.Int, 10))
-		w.wr.WriteString("\r\n")
-		return nil
+		w.writeLine(TypeInteger, strconv.FormatInt(v.Int, 10))
 	case TypeBulkString:
 		if v.IsNull {
-			w.wr.WriteByte(byte(TypeBulkString))
-			w.wr.WriteString("-1\r\n")
+			w.writeNullBulk()
 			return nil
 		}
-		w.wr.WriteByte(byte(TypeBulkString))
-		w.wr.WriteString(strconv.Itoa(len(v.Bulk)))
-		w.wr.WriteString("\r\n")
-		w.wr.Write(v.Bulk)
-		w.wr.WriteString("\r\n")
-		return nil
+		w.writeBulk(TypeBulkString, v.Bulk)
 	case TypeArray:
 		if v.IsNull {
-			w.wr.WriteByte(byte(TypeArray))
-			w.wr.WriteString("-1\r\n")
+			if w.IsRESP3() {
+				w.writeLine(TypeNull, "")
+				return nil
+			}
+			w.writeLine(TypeArray, "-1")
+			return nil
+		}
+		return w.writeAggregate(TypeArray, v.Array)
+	case TypeNull:
+		if w.resp2() {
+			w.writeNullBulk()
+			return nil
+		}
+		w.writeLine(TypeNull, "")
+	case TypeMap:
+		return w.writeAggregate(TypeMap, mapPairs(v))
+	case TypeSet:
+		return w.writeAggregate(TypeSet, v.Array)
+	case TypePush:
+		return w.writeAggregate(TypePush, v.Array)
+	case TypeAttribute:
+		if w.resp2() {
 			return nil
 		}
-		w.wr.WriteByte(byte(TypeArray))
-		w.wr.WriteString(strconv.Itoa(len(v.Array)))
-		w.wr.WriteString("\r\n")
-		for _, item := range v.Array {
-			if err := w.WriteValueNoFlush(item); err != nil {
-				return err
+		return w.writeAggregate(TypeAttribute, mapPairs(v))
+	case TypeDouble:
+		if w.resp2() {
+			w.writeBulk(TypeBulkString, []byte(FormatDouble(v.Float)))
+			return nil
+		}
+		w.writeLine(TypeDouble, FormatDouble(v.Float))
+	case TypeBoolean:
+		if w.resp2() {
+			n := "0"
+			if v.Bool {
+				n = "1"
 			}
+			w.writeLine(TypeInteger, n)
+			return nil
 		}
-		return nil
-	case TypeNull:
-		w.wr.WriteByte(byte(TypeNull))
-		w.wr.WriteString("\r\n")
-		return nil
+		b := "f"
+		if v.Bool {
+			b = "t"
+		}
+		w.writeLine(TypeBoolean, b)
+	case TypeBigNumber:
+		if w.resp2() {
+			w.writeBulk(TypeBulkString, []byte(v.Str))
+			return nil
+		}
+		w.writeLine(TypeBigNumber, v.Str)
+	case TypeVerbatim:
+		if w.resp2() {
+			w.writeBulk(TypeBulkString, v.Bulk)
+			return nil
+		}
+		format := v.Format
+		if len(format) != 3 {
+			format = "txt"
+		}
+		w.writeBulk(TypeVerbatim, append([]byte(format+":"), v.Bulk...))
 	default:
 		return ErrInvalidType
 	}
+	return nil
+}
+
+// WriteMap writes a map from flattened key/value pairs.
+func (w *Writer) WriteMap(pairs []*Value) error {
+	if err := w.writeAggregate(TypeMap, pairs); err != nil {
+		return err
+	}
+	return w.wr.Flush()
+}
+
+func (w *Writer) WriteSet(items []*Value) error {
+	if err := w.writeAggregate(TypeSet, items); err != nil {
+		return err
+	}
+	return w.wr.Flush()
+}
+
+func (w *Writer) WritePush(items []*Value) error {
+	if err := w.writeAggregate(TypePush, items); err != nil {
+		return err
+	}
+	return w.wr.Flush()
+}
+
+func (w *Writer) WriteDouble(f float64) error {
+	return w.WriteValue(DoubleValue(f))
+}
+
+func (w *Writer) WriteBoolean(b bool) error {
+	return w.WriteValue(BooleanValue(b))
+}
+
+func (w *Writer) WriteBigNumber(s string) error {
+	return w.WriteValue(BigNumberValue(s))
+}
+
+func (w *Writer) WriteVerbatim(format, s string) error {
+	return w.WriteValue(VerbatimValue(format, s))
+}
+
+// writeAggregate writes an array-like type. In RESP2 mode maps, sets and
+// pushes are written as plain arrays.
+func (w *Writer) writeAggregate(t Type, items []*Value) error {
+	n := len(items)
+	if t == TypeMap || t == TypeAttribute {
+		if w.resp2() {
+			t = TypeArray
+		} else {
+			n /= 2
+		}
+	} else if w.resp2() {
+		t = TypeArray
+	}
+	w.writeLine(t, strconv.Itoa(n))
+	for _, item := range items {
+		if err := w.WriteValueNoFlush(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *Writer) writeLine(t Type, s string) {
+	w.wr.WriteByte(byte(t))
+	w.wr.WriteString(s)
+	w.wr.WriteString("\r\n")
+}
+
+func (w *Writer) writeBulk(t Type, b []byte) {
+	w.wr.WriteByte(byte(t))
+	w.wr.WriteString(strconv.Itoa(len(b)))
+	w.wr.WriteString("\r\n")
+	w.wr.Write(b)
+	w.wr.WriteString("\r\n")
+}
+
+func (w *Writer) writeNullBulk() {
+	if w.IsRESP3() {
+		w.writeLine(TypeNull, "")
+		return
+	}
+	w.wr.WriteByte(byte(TypeBulkString))
+	w.wr.WriteString("-1\r\n")
+}
+
+// mapPairs returns a map's entries as flattened key/value pairs. Maps built
+// from a Go map are emitted with sorted keys so replies are deterministic.
+func mapPairs(v *Value) []*Value {
+	if v.Array != nil || v.Map == nil {
+		return v.Array
+	}
+	keys := make([]string, 0, len(v.Map))
+	for k := range v.Map {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]*Value, 0, len(keys)*2)
+	for _, k := range keys {
+		pairs = append(pairs, BulkString(k), v.Map[k])
+	}
+	return pairs
 }
 
 func (w *Writer) WriteOK() error {
@@ -0,0 +1,67 @@
+package search
+
+import (
+	"bytes"
+	"encoding/gob"
+)
+
+// savedIndex is an index as kept in snapshots. The inverted and field
+// indexes are rebuilt from the documents on load.
+type savedIndex struct {
+	Name      string
+	Schema    Schema
+	Documents []*Document
+}
+
+func (m *IndexManager) StateName() string {
+	return "search"
+}
+
+// SaveState serializes the indexes with their documents.
+func (m *IndexManager) SaveState() ([]byte, error) {
+	m.mu.RLock()
+	saved := make([]savedIndex, 0, len(m.indexes))
+	for _, idx := range m.indexes {
+		idx.mu.RLock()
+		s := savedIndex{Name: idx.Name, Schema: idx.Schema, Documents: make([]*Document, 0, len(idx.Documents))}
+		for _, doc := range idx.Documents {
+			s.Documents = append(s.Documents, doc)
+		}
+		idx.mu.RUnlock()
+		saved = append(saved, s)
+	}
+	m.mu.RUnlock()
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(saved); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// LoadState replaces the indexes with those saved by SaveState.
+func (m *IndexManager) LoadState(data []byte) error {
+	var saved []savedIndex
+	if data != nil {
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&saved); err != nil {
+			return err
+		}
+	}
+
+	loaded := NewIndexManager()
+	for _, s := range saved {
+		_ = loaded.CreateIndex(s.Name, s.Schema)
+		idx := loaded.indexes[s.Name]
+		for _, doc := range s.Documents {
+			if doc.Fields == nil {
+				doc.Fields = make(map[string]string)
+			}
+			_ = idx.AddDocument(doc)
+		}
+	}
+
+	m.mu.Lock()
+	m.indexes = loaded.indexes
+	m.mu.Unlock()
+	return nil
+}
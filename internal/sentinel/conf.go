@@ -0,0 +1,199 @@
+package sentinel
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cachestorm/cachestorm/internal/logger"
+)
+
+// loadConfig reads the configuration file, in the format of Redis
+// Sentinel's sentinel.conf: one "sentinel <option> <args...>" line per
+// setting. A missing file is not an error; it is written by Start.
+func (s *Sentinel) loadConfig() error {
+	data, err := os.ReadFile(s.configFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading sentinel config: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := s.applyConfigLine(strings.Fields(line)); err != nil {
+			return fmt.Errorf("%s:%d: %w", s.configFile, lineNo, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// applyConfigLine applies one line of the configuration file. s.mu must be
+// held.
+func (s *Sentinel) applyConfigLine(f []string) error {
+	if strings.ToLower(f[0]) != "sentinel" || len(f) < 3 {
+		return fmt.Errorf("line should start with the sentinel keyword and an option")
+	}
+	option, args := strings.ToLower(f[1]), f[2:]
+
+	arity := map[string]int{
+		"myid": 1, "current-epoch": 1, "monitor": 4,
+		"down-after-milliseconds": 2, "failover-timeout": 2, "parallel-syncs": 2,
+		"auth-pass": 2, "config-epoch": 2, "leader-epoch": 2,
+		"known-replica": 3, "known-slave": 3, "known-sentinel": 4,
+	}
+	n, ok := arity[option]
+	if !ok {
+		return fmt.Errorf("unknown option '%s'", f[1])
+	}
+	if len(args) != n {
+		return fmt.Errorf("wrong number of arguments for '%s'", option)
+	}
+
+	switch option {
+	case "myid":
+		// An ID given in the Config takes precedence.
+		if s.id == "" {
+			s.id = args[0]
+		}
+		return nil
+	case "current-epoch":
+		epoch, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid epoch '%s'", args[0])
+		}
+		s.currentEpoch = max(s.currentEpoch, epoch)
+		return nil
+	case "monitor":
+		port, err1 := strconv.Atoi(args[2])
+		quorum, err2 := strconv.Atoi(args[3])
+		if err1 != nil || err2 != nil || quorum <= 0 {
+			return fmt.Errorf("invalid port or quorum")
+		}
+		if _, exists := s.masters[args[0]]; exists {
+			return fmt.Errorf("master '%s' defined twice", args[0])
+		}
+		s.masters[args[0]] = s.newMaster(args[0], args[1], port, quorum)
+		return nil
+	}
+
+	m, ok := s.masters[args[0]]
+	if !ok {
+		return fmt.Errorf("no such master '%s'", args[0])
+	}
+	if option == "auth-pass" {
+		m.AuthPass = args[1]
+		return nil
+	}
+	if option == "known-sentinel" {
+		port, err := strconv.Atoi(args[2])
+		if err != nil {
+			return fmt.Errorf("invalid port '%s'", args[2])
+		}
+		if s.peer(m.Name, args[3]) == nil {
+			s.sentinels[m.Name] = append(s.sentinels[m.Name], &SentinelPeer{ID: args[3], RunID: args[3], Addr: args[1], Port: port})
+		}
+		return nil
+	}
+	if option == "known-replica" || option == "known-slave" {
+		port, err := strconv.Atoi(args[2])
+		if err != nil {
+			return fmt.Errorf("invalid port '%s'", args[2])
+		}
+		if m.replica(args[1], port) == nil {
+			m.Replicas = append(m.Replicas, &ReplicaInfo{Addr: args[1], Port: port, Priority: 100})
+		}
+		return nil
+	}
+
+	v, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || v < 0 {
+		return fmt.Errorf("invalid value '%s' for '%s'", args[1], option)
+	}
+	switch option {
+	case "down-after-milliseconds":
+		m.DownAfter = time.Duration(v) * time.Millisecond
+	case "failover-timeout":
+		m.FailoverTimeout = time.Duration(v) * time.Millisecond
+	case "parallel-syncs":
+		m.ParallelSyncs = int(v)
+	case "config-epoch":
+		m.Epoch = v
+	case "leader-epoch":
+		m.LeaderEpoch = v
+	}
+	return nil
+}
+
+// saveConfig rewrites the configuration file, if there is one, atomically.
+// s.mu must be held.
+func (s *Sentinel) saveConfig() error {
+	if s.configFile == "" {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "sentinel myid %s\n", s.id)
+	fmt.Fprintf(&buf, "sentinel current-epoch %d\n", s.currentEpoch)
+	for _, name := range s.masterNames() {
+		m := s.masters[name]
+		fmt.Fprintf(&buf, "sentinel monitor %s %s %d %d\n", name, m.Addr, m.Port, m.Quorum)
+		fmt.Fprintf(&buf, "sentinel down-after-milliseconds %s %d\n", name, m.DownAfter.Milliseconds())
+		fmt.Fprintf(&buf, "sentinel failover-timeout %s %d\n", name, m.FailoverTimeout.Milliseconds())
+		fmt.Fprintf(&buf, "sentinel parallel-syncs %s %d\n", name, m.ParallelSyncs)
+		if m.AuthPass != "" {
+			fmt.Fprintf(&buf, "sentinel auth-pass %s %s\n", name, m.AuthPass)
+		}
+		fmt.Fprintf(&buf, "sentinel config-epoch %s %d\n", name, m.Epoch)
+		fmt.Fprintf(&buf, "sentinel leader-epoch %s %d\n", name, m.LeaderEpoch)
+		for _, r := range m.Replicas {
+			fmt.Fprintf(&buf, "sentinel known-replica %s %s %d\n", name, r.Addr, r.Port)
+		}
+		for _, p := range s.sentinels[name] {
+			fmt.Fprintf(&buf, "sentinel known-sentinel %s %s %d %s\n", name, p.Addr, p.Port, p.RunID)
+		}
+	}
+
+	path := s.configFile
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("writing sentinel config: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing sentinel config: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("syncing sentinel config: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("writing sentinel config: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("renaming sentinel config: %w", err)
+	}
+	return nil
+}
+
+// persist saves the configuration after a change, logging failures: the
+// change stands either way. s.mu must be held.
+func (s *Sentinel) persist() {
+	if err := s.saveConfig(); err != nil {
+		logger.Error().Err(err).Msg("Failed to save sentinel config")
+	}
+}
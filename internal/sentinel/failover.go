@@ -0,0 +1,316 @@
+package sentinel
+
+import (
+	"math/rand"
+	"time"
+)
+
+// electionTimeout is how long a sentinel seeks the votes of the others
+// before giving up the failover to another one.
+func electionTimeout(m *MasterInfo) time.Duration {
+	return min(10*time.Second, m.FailoverTimeout)
+}
+
+// failoverStep moves the failover of m on, starting one when the master
+// is objectively down and no failover was tried recently. s.mu must be
+// held.
+func (s *Sentinel) failoverStep(m *MasterInfo, now time.Time) {
+	switch m.FailoverState {
+	case failoverNone:
+		if m.State == MasterStateODown && !now.Before(m.tryAfter) && now.Sub(m.failoverStart) > 2*m.FailoverTimeout {
+			s.startFailover(m, false)
+		}
+	case failoverWaitStart:
+		s.waitElection(m, now)
+	case failoverSelectReplica:
+		s.promoteReplica(m, now)
+	case failoverSendNoOne:
+		s.sendNoOne(m, now)
+	case failoverWaitPromotion:
+		s.waitPromotion(m, now)
+	case failoverReconfigure:
+		s.reconfigureReplicas(m, now)
+	}
+}
+
+// startFailover starts a failover of m in a new epoch, in which the
+// sentinel votes for itself. A forced failover does not wait for the votes
+// of the others. s.mu must be held.
+func (s *Sentinel) startFailover(m *MasterInfo, forced bool) {
+	now := time.Now()
+	s.currentEpoch++
+	m.failoverEpoch = s.currentEpoch
+	m.failoverStart = now
+	m.forced = forced
+	s.emit("+new-epoch", "%d", s.currentEpoch)
+	s.emit("+try-failover", "master %s %s %d", m.Name, m.Addr, m.Port)
+	s.setFailoverState(m, failoverWaitStart, now)
+	s.voteLeader(m, s.currentEpoch, s.id)
+	for _, p := range s.sentinels[m.Name] {
+		if p.node != nil {
+			p.node.lastAsk = time.Time{}
+		}
+	}
+	s.persist()
+}
+
+func (s *Sentinel) setFailoverState(m *MasterInfo, state string, now time.Time) {
+	m.FailoverState = state
+	m.stateChanged = now
+}
+
+// abortFailover gives the failover of m up. Another is not tried before
+// twice the failover timeout has passed. s.mu must be held.
+func (s *Sentinel) abortFailover(m *MasterInfo, event string) {
+	s.emit(event, "master %s %s %d", m.Name, m.Addr, m.Port)
+	s.setFailoverState(m, failoverNone, time.Now())
+	m.promoted, m.forced = nil, false
+	for _, r := range m.Replicas {
+		r.reconf = ""
+	}
+}
+
+// voteLeader records the vote of this sentinel for the leader of the
+// failover of m in epoch, the first sentinel to ask for it in that epoch,
+// and returns the leader voted for. s.mu must be held.
+func (s *Sentinel) voteLeader(m *MasterInfo, epoch int64, runID string) (string, int64) {
+	if epoch > s.currentEpoch {
+		s.currentEpoch = epoch
+		s.emit("+new-epoch", "%d", epoch)
+		s.persist()
+	}
+	if m.LeaderEpoch < epoch && s.currentEpoch <= epoch {
+		m.Leader, m.LeaderEpoch = runID, s.currentEpoch
+		s.emit("+vote-for-leader", "%s %d", runID, m.LeaderEpoch)
+		s.persist()
+		// Leave the failover to the sentinel voted for.
+		if runID != s.id {
+			m.failoverStart = time.Now()
+		}
+	}
+	return m.Leader, m.LeaderEpoch
+}
+
+// isMasterDownByAddr answers another sentinel asking about the master at
+// host:port and, unless runID is "*", for its vote in epoch.
+func (s *Sentinel) isMasterDownByAddr(host string, port int, epoch int64, runID string) (bool, string, int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, m := range s.masters {
+		if m.Addr != host || m.Port != port {
+			continue
+		}
+		down := m.State >= MasterStateSDown
+		if runID == "*" {
+			return down, "*", 0
+		}
+		leader, leaderEpoch := s.voteLeader(m, epoch, runID)
+		return down, leader, leaderEpoch
+	}
+	return false, "*", 0
+}
+
+// electedLeader returns the sentinel with the most votes in the epoch of
+// the failover of m, and its votes.
+func (s *Sentinel) electedLeader(m *MasterInfo) (string, int) {
+	votes := make(map[string]int)
+	if m.LeaderEpoch == m.failoverEpoch && m.Leader != "" {
+		votes[m.Leader]++
+	}
+	for _, p := range s.sentinels[m.Name] {
+		if p.LeaderEpoch == m.failoverEpoch && p.Leader != "" {
+			votes[p.Leader]++
+		}
+	}
+	var leader string
+	for id, n := range votes {
+		if n > votes[leader] || (n == votes[leader] && id < leader) {
+			leader = id
+		}
+	}
+	return leader, votes[leader]
+}
+
+// waitElection goes on with the failover once this sentinel has the votes
+// of both the quorum and a majority of the sentinels it knows.
+func (s *Sentinel) waitElection(m *MasterInfo, now time.Time) {
+	if !m.forced {
+		leader, votes := s.electedLeader(m)
+		needed := max(s.quorumOf(m), (len(s.sentinels[m.Name])+1)/2+1)
+		if leader != s.id || votes < needed {
+			if now.Sub(m.stateChanged) > electionTimeout(m) {
+				s.abortFailover(m, "-failover-abort-not-elected")
+			}
+			return
+		}
+		s.emit("+elected-leader", "master %s %s %d", m.Name, m.Addr, m.Port)
+	}
+	s.emit("+failover-state-select-slave", "master %s %s %d", m.Name, m.Addr, m.Port)
+	s.setFailoverState(m, failoverSelectReplica, now)
+	s.promoteReplica(m, now)
+}
+
+// selectReplica returns the replica to promote: one that is up, answered
+// INFO recently and follows the master, preferring the lowest priority,
+// then the largest replication offset. s.mu must be held.
+func (s *Sentinel) selectReplica(m *MasterInfo, now time.Time) *ReplicaInfo {
+	var best *ReplicaInfo
+	for _, r := range m.Replicas {
+		if r.node == nil || r.State == "s_down" || r.Role != "slave" || r.Priority == 0 {
+			continue
+		}
+		if now.Sub(r.node.lastOK) > 5*pingPeriod(m) || now.Sub(r.node.lastInfo) > 5*infoPeriod(m) {
+			continue
+		}
+		if best == nil || r.Priority < best.Priority ||
+			(r.Priority == best.Priority && (r.Offset > best.Offset ||
+				(r.Offset == best.Offset && r.node.addr < best.node.addr))) {
+			best = r
+		}
+	}
+	return best
+}
+
+func (s *Sentinel) promoteReplica(m *MasterInfo, now time.Time) {
+	r := s.selectReplica(m, now)
+	if r == nil {
+		s.abortFailover(m, "-failover-abort-no-good-slave")
+		return
+	}
+	m.promoted = r
+	s.emit("+selected-slave", "slave %s:%d %s %d @ %s %s %d", r.Addr, r.Port, r.Addr, r.Port, m.Name, m.Addr, m.Port)
+	s.setFailoverState(m, failoverSendNoOne, now)
+	s.sendNoOne(m, now)
+}
+
+// sendNoOne turns the selected replica into a master, retrying until the
+// failover times out.
+func (s *Sentinel) sendNoOne(m *MasterInfo, now time.Time) {
+	if now.Sub(m.stateChanged) > m.FailoverTimeout {
+		s.abortFailover(m, "-failover-abort-slave-timeout")
+		return
+	}
+	r := m.promoted
+	s.replicaOf(m, r.node, "", 0, func(err error) {
+		if err != nil || m.FailoverState != failoverSendNoOne || m.promoted != r {
+			return
+		}
+		s.emit("+failover-state-wait-promotion", "slave %s:%d %s %d @ %s %s %d", r.Addr, r.Port, r.Addr, r.Port, m.Name, m.Addr, m.Port)
+		s.setFailoverState(m, failoverWaitPromotion, time.Now())
+		// Look at its role right away
+		r.node.lastInfo = time.Time{}
+	})
+}
+
+// waitPromotion waits for the selected replica to report itself master,
+// which gives the new configuration the epoch of the failover.
+func (s *Sentinel) waitPromotion(m *MasterInfo, now time.Time) {
+	r := m.promoted
+	if r.Role != "master" {
+		if now.Sub(m.stateChanged) > m.FailoverTimeout {
+			s.abortFailover(m, "-failover-abort-slave-timeout")
+		}
+		return
+	}
+	m.Epoch = m.failoverEpoch
+	s.emit("+promoted-slave", "slave %s:%d %s %d @ %s %s %d", r.Addr, r.Port, r.Addr, r.Port, m.Name, m.Addr, m.Port)
+	s.emit("+failover-state-reconf-slaves", "master %s %s %d", m.Name, m.Addr, m.Port)
+	s.setFailoverState(m, failoverReconfigure, now)
+	s.persist()
+	s.reconfigureReplicas(m, now)
+}
+
+// reconfigureReplicas points the other replicas at the promoted one, at
+// most ParallelSyncs at a time, and switches the master once they all
+// follow it. Replicas that are down are left to be fixed when they come
+// back; once the failover times out, the remaining ones are all sent
+// REPLICAOF and the master switched regardless.
+func (s *Sentinel) reconfigureReplicas(m *MasterInfo, now time.Time) {
+	p := m.promoted
+	timedOut := now.Sub(m.stateChanged) > m.FailoverTimeout
+	inProgress, pending := 0, 0
+	for _, r := range m.Replicas {
+		if r == p || r.reconf != "sent" {
+			continue
+		}
+		if r.MasterHost == p.Addr && r.MasterPort == p.Port && r.MasterLinkUp {
+			r.reconf = "done"
+			s.emit("+slave-reconf-done", "slave %s:%d %s %d @ %s %s %d", r.Addr, r.Port, r.Addr, r.Port, m.Name, m.Addr, m.Port)
+			continue
+		}
+		inProgress++
+	}
+	for _, r := range m.Replicas {
+		if r == p || r.reconf == "done" || r.node == nil || (r.State == "s_down" && !timedOut) {
+			continue
+		}
+		pending++
+		if r.reconf != "" || (inProgress >= m.ParallelSyncs && !timedOut) {
+			continue
+		}
+		r.reconf = "sent"
+		inProgress++
+		s.replicaOf(m, r.node, p.Addr, p.Port, func(err error) {
+			if err != nil {
+				if r.reconf == "sent" {
+					r.reconf = ""
+				}
+				return
+			}
+			s.emit("+slave-reconf-sent", "slave %s:%d %s %d @ %s %s %d", r.Addr, r.Port, r.Addr, r.Port, m.Name, m.Addr, m.Port)
+			r.node.lastInfo = time.Time{}
+		})
+	}
+
+	if timedOut {
+		s.emit("-failover-end-for-timeout", "master %s %s %d", m.Name, m.Addr, m.Port)
+	} else if pending > 0 {
+		return
+	}
+	s.emit("+failover-end", "master %s %s %d", m.Name, m.Addr, m.Port)
+	s.switchMaster(m, p.Addr, p.Port)
+}
+
+// switchMaster makes host:port the master of m's group, keeping the former
+// master as a replica to be reconfigured when it comes back. s.mu must be
+// held.
+func (s *Sentinel) switchMaster(m *MasterInfo, host string, port int) {
+	oldHost, oldPort := m.Addr, m.Port
+	var promoted *node
+	replicas := make([]*ReplicaInfo, 0, len(m.Replicas)+1)
+	for _, r := range m.Replicas {
+		if r.Addr == host && r.Port == port {
+			promoted = r.node
+			continue
+		}
+		r.reconf = ""
+		replicas = append(replicas, r)
+	}
+	if m.replica(oldHost, oldPort) == nil {
+		replicas = append(replicas, &ReplicaInfo{Addr: oldHost, Port: oldPort, Priority: 100, node: m.node})
+	} else if m.node != nil {
+		m.node.close()
+	}
+	m.Replicas = replicas
+	m.Addr, m.Port = host, port
+	m.node = promoted
+	m.State = MasterStateNone
+	m.Flags = []string{"master"}
+	m.promoted, m.forced = nil, false
+	s.setFailoverState(m, failoverNone, time.Now())
+	for _, p := range s.sentinels[m.Name] {
+		p.Down = false
+	}
+
+	s.emit("+switch-master", "%s %s %d %s %d", m.Name, oldHost, oldPort, host, port)
+	if fn := s.onFailover; fn != nil {
+		go fn(m.Name, host, port)
+	}
+	s.persist()
+}
+
+// failoverJitter spreads the failover attempts of the sentinels that see a
+// master down at once, so one of them usually asks for votes first.
+func failoverJitter(m *MasterInfo) time.Duration {
+	return time.Duration(rand.Int63n(int64(askPeriod(m)) + 1))
+}
@@ -0,0 +1,509 @@
+package sentinel
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cachestorm/cachestorm/internal/resp"
+)
+
+// fakeNet is a group of fake data nodes: just enough of a server for
+// sentinels to monitor, with INFO replication reflecting the REPLICAOF
+// commands the nodes were sent.
+type fakeNet struct {
+	mu    sync.Mutex
+	nodes []*fakeNode
+}
+
+type fakeNode struct {
+	net  *fakeNet
+	ln   net.Listener
+	host string
+	port int
+
+	// Guarded by net.mu.
+	down       bool
+	masterHost string
+	masterPort int
+	offset     int64
+	replicaOfs []string
+	conns      map[*fakeConn]bool
+	subs       map[*fakeConn]bool
+}
+
+type fakeConn struct {
+	conn net.Conn
+	wmu  sync.Mutex
+	w    *resp.Writer
+}
+
+func (c *fakeConn) write(v *resp.Value) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.w.WriteValue(v)
+}
+
+func (fn *fakeNet) add(t *testing.T, master *fakeNode, offset int64) *fakeNode {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	n := &fakeNode{
+		net:    fn,
+		ln:     ln,
+		host:   "127.0.0.1",
+		port:   ln.Addr().(*net.TCPAddr).Port,
+		offset: offset,
+		conns:  make(map[*fakeConn]bool),
+		subs:   make(map[*fakeConn]bool),
+	}
+	if master != nil {
+		n.masterHost, n.masterPort = master.host, master.port
+	}
+	fn.mu.Lock()
+	fn.nodes = append(fn.nodes, n)
+	fn.mu.Unlock()
+	t.Cleanup(func() {
+		ln.Close()
+		n.setDown(true)
+	})
+	go n.serve()
+	return n
+}
+
+func (n *fakeNode) serve() {
+	for {
+		conn, err := n.ln.Accept()
+		if err != nil {
+			return
+		}
+		go n.handle(conn)
+	}
+}
+
+func (n *fakeNode) handle(conn net.Conn) {
+	c := &fakeConn{conn: conn, w: resp.NewWriter(conn)}
+	n.net.mu.Lock()
+	if n.down {
+		n.net.mu.Unlock()
+		conn.Close()
+		return
+	}
+	n.conns[c] = true
+	n.net.mu.Unlock()
+	defer func() {
+		n.net.mu.Lock()
+		delete(n.conns, c)
+		delete(n.subs, c)
+		n.net.mu.Unlock()
+		conn.Close()
+	}()
+
+	r := resp.NewReader(bufio.NewReader(conn))
+	for {
+		cmd, args, err := r.ReadCommand()
+		if err != nil {
+			return
+		}
+		c.write(n.command(c, strings.ToUpper(cmd), args))
+	}
+}
+
+func (n *fakeNode) command(c *fakeConn, cmd string, args [][]byte) *resp.Value {
+	n.net.mu.Lock()
+	defer n.net.mu.Unlock()
+	switch cmd {
+	case "PING":
+		return resp.PONG()
+	case "INFO":
+		return resp.BulkString(n.info())
+	case "REPLICAOF":
+		if strings.EqualFold(string(args[0]), "NO") {
+			n.masterHost, n.masterPort = "", 0
+			n.replicaOfs = append(n.replicaOfs, "NO ONE")
+		} else {
+			n.masterHost = string(args[0])
+			n.masterPort, _ = strconv.Atoi(string(args[1]))
+			n.replicaOfs = append(n.replicaOfs, net.JoinHostPort(n.masterHost, string(args[1])))
+		}
+		return resp.OK()
+	case "SUBSCRIBE":
+		n.subs[c] = true
+		return resp.ArrayValue([]*resp.Value{resp.BulkString("subscribe"), resp.BulkBytes(args[0]), resp.IntegerValue(1)})
+	case "PUBLISH":
+		msg := resp.ArrayValue([]*resp.Value{resp.BulkString("message"), resp.BulkBytes(args[0]), resp.BulkBytes(args[1])})
+		for sub := range n.subs {
+			go sub.write(msg)
+		}
+		return resp.IntegerValue(int64(len(n.subs)))
+	}
+	return resp.ErrorValue("ERR unknown command '" + cmd + "'")
+}
+
+// info renders INFO replication. net.mu must be held.
+func (n *fakeNode) info() string {
+	var sb strings.Builder
+	sb.WriteString("# Replication\r\n")
+	if n.masterHost == "" {
+		sb.WriteString("role:master\r\n")
+		i := 0
+		for _, r := range n.net.nodes {
+			if !r.down && r.masterHost == n.host && r.masterPort == n.port {
+				fmt.Fprintf(&sb, "slave%d:ip=%s,port=%d,state=online,offset=%d,lag=0\r\n", i, r.host, r.port, r.offset)
+				i++
+			}
+		}
+		fmt.Fprintf(&sb, "connected_slaves:%d\r\nmaster_repl_offset:%d\r\n", i, n.offset)
+		return sb.String()
+	}
+	link := "down"
+	for _, m := range n.net.nodes {
+		if m.host == n.masterHost && m.port == n.masterPort && !m.down && m.masterHost == "" {
+			link = "up"
+		}
+	}
+	fmt.Fprintf(&sb, "role:slave\r\nmaster_host:%s\r\nmaster_port:%d\r\nmaster_link_status:%s\r\n", n.masterHost, n.masterPort, link)
+	fmt.Fprintf(&sb, "slave_repl_offset:%d\r\nslave_priority:100\r\n", n.offset)
+	return sb.String()
+}
+
+// setDown makes the node refuse every connection, as if it crashed, or
+// serve again.
+func (n *fakeNode) setDown(down bool) {
+	n.net.mu.Lock()
+	defer n.net.mu.Unlock()
+	n.down = down
+	if down {
+		for c := range n.conns {
+			c.conn.Close()
+		}
+	}
+}
+
+func (n *fakeNode) following() (string, []string) {
+	n.net.mu.Lock()
+	defer n.net.mu.Unlock()
+	if n.masterHost == "" {
+		return "", append([]string(nil), n.replicaOfs...)
+	}
+	return net.JoinHostPort(n.masterHost, strconv.Itoa(n.masterPort)), append([]string(nil), n.replicaOfs...)
+}
+
+func (n *fakeNode) addr() string {
+	return net.JoinHostPort(n.host, strconv.Itoa(n.port))
+}
+
+func freePort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+// startSentinel starts a sentinel serving on its own port, with periods
+// short enough for the tests.
+func startSentinel(t *testing.T, cfg Config) *Sentinel {
+	t.Helper()
+	cfg.Addr = "127.0.0.1"
+	if cfg.Port == 0 {
+		cfg.Port = freePort(t)
+	}
+	if cfg.DownAfter == 0 {
+		cfg.DownAfter = 300 * time.Millisecond
+	}
+	if cfg.FailoverTime == 0 {
+		cfg.FailoverTime = 2 * time.Second
+	}
+	s := New(cfg)
+	s.period = 20 * time.Millisecond
+	if err := s.Start(); err != nil {
+		t.Fatalf("start sentinel: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go s.Serve(ctx, cfg.Port)
+	t.Cleanup(func() {
+		cancel()
+		s.Stop()
+	})
+	return s
+}
+
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// topology starts a master with two replicas, the second one further
+// ahead, and n sentinels monitoring it with quorum.
+func topology(t *testing.T, n, quorum int) (*fakeNode, []*fakeNode, []*Sentinel) {
+	t.Helper()
+	fn := &fakeNet{}
+	master := fn.add(t, nil, 300)
+	replicas := []*fakeNode{fn.add(t, master, 100), fn.add(t, master, 200)}
+	sentinels := make([]*Sentinel, n)
+	for i := range sentinels {
+		sentinels[i] = startSentinel(t, Config{Quorum: quorum})
+		if err := sentinels[i].Monitor("mymaster", master.host, master.port, quorum); err != nil {
+			t.Fatalf("monitor: %v", err)
+		}
+	}
+	return master, replicas, sentinels
+}
+
+func waitDiscovery(t *testing.T, sentinels []*Sentinel, replicas int) {
+	t.Helper()
+	for i, s := range sentinels {
+		waitFor(t, 5*time.Second, fmt.Sprintf("sentinel %d to discover the group", i), func() bool {
+			m, _ := s.GetMaster("mymaster")
+			s.mu.RLock()
+			peers := len(s.sentinels["mymaster"])
+			s.mu.RUnlock()
+			return len(m.Replicas) == replicas && peers == len(sentinels)-1
+		})
+	}
+}
+
+func masterAddr(s *Sentinel) string {
+	host, port, _ := s.GetMasterAddr("mymaster")
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// subscribeEvents subscribes to a sentinel's events as a client would.
+func subscribeEvents(t *testing.T, s *Sentinel, events ...string) (net.Conn, *resp.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(s.port)))
+	if err != nil {
+		t.Fatalf("dial sentinel: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	fmt.Fprintf(conn, "SUBSCRIBE %s\r\n", strings.Join(events, " "))
+	r := resp.NewReader(bufio.NewReader(conn))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for range events {
+		if v, err := r.ReadValue(); err != nil || len(v.Array) != 3 || string(v.Array[0].Bulk) != "subscribe" {
+			t.Fatalf("subscribe reply: %v %v", v, err)
+		}
+	}
+	return conn, r
+}
+
+func TestSentinelsDiscoverReplicasAndPeers(t *testing.T) {
+	_, replicas, sentinels := topology(t, 3, 2)
+	waitDiscovery(t, sentinels, 2)
+
+	m, _ := sentinels[0].GetMaster("mymaster")
+	for _, r := range replicas {
+		found := false
+		for _, known := range m.Replicas {
+			found = found || (known.Addr == r.host && known.Port == r.port)
+		}
+		if !found {
+			t.Errorf("replica %s not discovered", r.addr())
+		}
+	}
+
+	sentinels[0].mu.RLock()
+	peers := sentinels[0].sentinels["mymaster"]
+	for _, p := range peers {
+		if p.RunID != sentinels[1].ID() && p.RunID != sentinels[2].ID() {
+			t.Errorf("unexpected peer %s", p.RunID)
+		}
+	}
+	sentinels[0].mu.RUnlock()
+}
+
+func TestSentinelsFailOverDownMaster(t *testing.T) {
+	master, replicas, sentinels := topology(t, 3, 2)
+	waitDiscovery(t, sentinels, 2)
+	conn, events := subscribeEvents(t, sentinels[0], "+switch-master")
+
+	master.setDown(true)
+
+	conn.SetReadDeadline(time.Now().Add(20 * time.Second))
+	v, err := events.ReadValue()
+	if err != nil {
+		t.Fatalf("no +switch-master event: %v", err)
+	}
+	want := fmt.Sprintf("mymaster %s %d %s %d", master.host, master.port, replicas[1].host, replicas[1].port)
+	if len(v.Array) != 3 || string(v.Array[2].Bulk) != want {
+		t.Fatalf("event = %v, want message %q", v, want)
+	}
+
+	for i, s := range sentinels {
+		waitFor(t, 5*time.Second, fmt.Sprintf("sentinel %d to switch", i), func() bool {
+			return masterAddr(s) == replicas[1].addr()
+		})
+	}
+
+	// The replica with the largest offset was promoted and the other one
+	// follows it.
+	if following, cmds := replicas[1].following(); following != "" || len(cmds) == 0 || cmds[0] != "NO ONE" {
+		t.Errorf("promoted replica follows %q after %v", following, cmds)
+	}
+	waitFor(t, 5*time.Second, "the other replica to follow the new master", func() bool {
+		following, _ := replicas[0].following()
+		return following == replicas[1].addr()
+	})
+
+	// The old master is turned into a replica when it comes back.
+	master.setDown(false)
+	waitFor(t, 10*time.Second, "the old master to be reconfigured", func() bool {
+		following, _ := master.following()
+		return following == replicas[1].addr()
+	})
+}
+
+func TestSentinelDoesNotFailOverWithoutQuorum(t *testing.T) {
+	master, replicas, sentinels := topology(t, 1, 2)
+	waitDiscovery(t, sentinels, 2)
+
+	master.setDown(true)
+	waitFor(t, 5*time.Second, "the master to be subjectively down", func() bool {
+		m, _ := sentinels[0].GetMaster("mymaster")
+		return m.State == MasterStateSDown
+	})
+	time.Sleep(time.Second)
+
+	m, _ := sentinels[0].GetMaster("mymaster")
+	if m.State != MasterStateSDown || m.FailoverState != failoverNone {
+		t.Errorf("state = %d, failover state %q; want subjectively down only", m.State, m.FailoverState)
+	}
+	for _, r := range replicas {
+		if _, cmds := r.following(); len(cmds) != 0 {
+			t.Errorf("replica %s was sent %v", r.addr(), cmds)
+		}
+	}
+}
+
+func TestSentinelManualFailover(t *testing.T) {
+	master, replicas, sentinels := topology(t, 1, 1)
+	waitDiscovery(t, sentinels, 2)
+	s := sentinels[0]
+	waitFor(t, 5*time.Second, "the replicas to report their role", func() bool {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		return s.selectReplica(s.masters["mymaster"], time.Now()) != nil
+	})
+
+	if v := s.handleSentinel([]string{"FAILOVER", "mymaster"}); v.Type == resp.TypeError {
+		t.Fatalf("SENTINEL FAILOVER: %s", v.Err)
+	}
+	waitFor(t, 10*time.Second, "the failover", func() bool {
+		return masterAddr(s) == replicas[1].addr()
+	})
+
+	// The old master, still up, now follows the promoted replica.
+	waitFor(t, 10*time.Second, "the old master to be reconfigured", func() bool {
+		following, _ := master.following()
+		return following == replicas[1].addr()
+	})
+	if m, _ := s.GetMaster("mymaster"); m.Epoch != 1 {
+		t.Errorf("config epoch = %d, want 1", m.Epoch)
+	}
+}
+
+func TestSentinelVotesOncePerEpoch(t *testing.T) {
+	s := New(Config{ID: "s1"})
+	s.Monitor("mymaster", "10.0.0.1", 6379, 2)
+
+	tests := []struct {
+		epoch      int64
+		runID      string
+		wantLeader string
+		wantEpoch  int64
+	}{
+		{3, "a", "a", 3},
+		{3, "b", "a", 3},
+		{2, "b", "a", 3},
+		{4, "b", "b", 4},
+		{4, "*", "*", 0},
+	}
+	for _, tt := range tests {
+		_, leader, epoch := s.isMasterDownByAddr("10.0.0.1", 6379, tt.epoch, tt.runID)
+		if leader != tt.wantLeader || epoch != tt.wantEpoch {
+			t.Errorf("vote for %s in epoch %d = %s/%d, want %s/%d", tt.runID, tt.epoch, leader, epoch, tt.wantLeader, tt.wantEpoch)
+		}
+	}
+	if s.currentEpoch != 4 {
+		t.Errorf("current epoch = %d, want 4", s.currentEpoch)
+	}
+	if _, leader, _ := s.isMasterDownByAddr("10.0.0.9", 6379, 5, "c"); leader != "*" {
+		t.Errorf("vote for an unknown master = %s, want *", leader)
+	}
+}
+
+func TestSentinelConfigSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sentinel.conf")
+	fn := &fakeNet{}
+	master := fn.add(t, nil, 0)
+	replica := fn.add(t, master, 0)
+
+	s := startSentinel(t, Config{ConfigFile: path})
+	s.Monitor("mymaster", master.host, master.port, 2)
+	s.Set("mymaster", "down-after-milliseconds", "250")
+	waitDiscovery(t, []*Sentinel{s}, 1)
+	s.processHello(fmt.Sprintf("10.0.0.2,26379,%s,5,mymaster,%s,%d,0", strings.Repeat("b", 40), master.host, master.port))
+	id := s.ID()
+	s.Stop()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read config: %v", err)
+	}
+	if !strings.Contains(string(data), "sentinel known-replica mymaster "+replica.host) {
+		t.Errorf("config does not list the replica:\n%s", data)
+	}
+
+	restarted := startSentinel(t, Config{ConfigFile: path})
+	if restarted.ID() != id {
+		t.Errorf("ID = %s after restart, want %s", restarted.ID(), id)
+	}
+	m, ok := restarted.GetMaster("mymaster")
+	if !ok {
+		t.Fatal("master not monitored after restart")
+	}
+	if m.Addr != master.host || m.Port != master.port || m.Quorum != 2 || m.DownAfter != 250*time.Millisecond {
+		t.Errorf("master = %s:%d quorum %d down-after %v", m.Addr, m.Port, m.Quorum, m.DownAfter)
+	}
+	if len(m.Replicas) != 1 || m.Replicas[0].Port != replica.port {
+		t.Errorf("replicas = %+v", m.Replicas)
+	}
+	restarted.mu.RLock()
+	defer restarted.mu.RUnlock()
+	if restarted.currentEpoch != 5 {
+		t.Errorf("current epoch = %d, want 5", restarted.currentEpoch)
+	}
+	if peers := restarted.sentinels["mymaster"]; len(peers) != 1 || peers[0].Addr != "10.0.0.2" {
+		t.Errorf("sentinels = %+v", peers)
+	}
+}
+
+func TestSentinelConfigRejectsUnknownOption(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sentinel.conf")
+	os.WriteFile(path, []byte("sentinel monitor mymaster 10.0.0.1 6379 2\nsentinel bogus mymaster 1\n"), 0o644)
+
+	s := New(Config{ConfigFile: path})
+	if err := s.Start(); err == nil || !strings.Contains(err.Error(), ":2:") {
+		s.Stop()
+		t.Errorf("Start() error = %v, want one for line 2", err)
+	}
+}
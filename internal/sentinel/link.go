@@ -0,0 +1,219 @@
+package sentinel
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cachestorm/cachestorm/internal/logger"
+	"github.com/cachestorm/cachestorm/internal/resp"
+)
+
+// node is the sentinel's link to an instance it polls: a master, a replica
+// or another sentinel. Its timestamps and busy are guarded by Sentinel.mu,
+// its connections by cmu.
+type node struct {
+	addr string
+	auth string
+
+	lastPing  time.Time // last PING sent
+	lastOK    time.Time // last valid PING reply, or when the node was added
+	lastInfo  time.Time // last INFO reply
+	lastHello time.Time // last hello published on the node
+	lastAsk   time.Time // last IS-MASTER-DOWN-BY-ADDR sent to a sentinel
+	// busy are the kinds of request in flight, so that a slow node does not
+	// pile them up.
+	busy map[string]bool
+
+	cmu    sync.Mutex
+	conn   net.Conn
+	r      *resp.Reader
+	w      *bufio.Writer
+	sub    net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newNode(host string, port int, auth string) *node {
+	return &node{
+		addr:   net.JoinHostPort(host, strconv.Itoa(port)),
+		auth:   auth,
+		lastOK: time.Now(),
+		busy:   make(map[string]bool),
+		closed: make(chan struct{}),
+	}
+}
+
+// call sends a command on the node's command connection, dialing it first
+// if needed, and returns the reply. A failed request drops the connection.
+func (n *node) call(timeout time.Duration, args ...string) (*resp.Value, error) {
+	n.cmu.Lock()
+	defer n.cmu.Unlock()
+	select {
+	case <-n.closed:
+		return nil, net.ErrClosed
+	default:
+	}
+	if n.conn == nil {
+		conn, err := net.DialTimeout("tcp", n.addr, timeout)
+		if err != nil {
+			return nil, err
+		}
+		n.conn, n.r, n.w = conn, resp.NewReader(bufio.NewReader(conn)), bufio.NewWriter(conn)
+		if n.auth != "" {
+			if v, err := n.roundTrip(timeout, "AUTH", n.auth); err != nil || v.Type == resp.TypeError {
+				n.drop()
+				return nil, fmt.Errorf("AUTH failed: %v", replyError(v, err))
+			}
+		}
+	}
+	v, err := n.roundTrip(timeout, args...)
+	if err != nil {
+		n.drop()
+		return nil, err
+	}
+	return v, nil
+}
+
+func (n *node) roundTrip(timeout time.Duration, args ...string) (*resp.Value, error) {
+	n.conn.SetDeadline(time.Now().Add(timeout))
+	if err := writeCommand(n.w, args...); err != nil {
+		return nil, err
+	}
+	return n.r.ReadValue()
+}
+
+// drop closes the command connection. n.cmu must be held.
+func (n *node) drop() {
+	if n.conn != nil {
+		n.conn.Close()
+		n.conn = nil
+	}
+}
+
+// close drops the node's connections for good.
+func (n *node) close() {
+	n.once.Do(func() { close(n.closed) })
+	n.cmu.Lock()
+	defer n.cmu.Unlock()
+	n.drop()
+	if n.sub != nil {
+		n.sub.Close()
+	}
+}
+
+// localIP returns the address the command connection leaves from, empty
+// if it is not connected.
+func (n *node) localIP() string {
+	n.cmu.Lock()
+	defer n.cmu.Unlock()
+	if n.conn == nil {
+		return ""
+	}
+	if a, ok := n.conn.LocalAddr().(*net.TCPAddr); ok {
+		return a.IP.String()
+	}
+	return ""
+}
+
+func writeCommand(w *bufio.Writer, args ...string) error {
+	fmt.Fprintf(w, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(a), a)
+	}
+	return w.Flush()
+}
+
+// replyError returns the error of a failed request or error reply.
+func replyError(v *resp.Value, err error) error {
+	if err != nil {
+		return err
+	}
+	if v != nil && v.Type == resp.TypeError {
+		return fmt.Errorf("%s", v.Err)
+	}
+	return nil
+}
+
+// spawn runs fn in its own goroutine unless a request of the same kind is
+// already in flight on n. s.mu must be held.
+func (s *Sentinel) spawn(n *node, kind string, fn func()) {
+	if n.busy[kind] {
+		return
+	}
+	n.busy[kind] = true
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer logger.RecoverPanic("sentinel-" + kind)
+		defer func() {
+			s.mu.Lock()
+			delete(n.busy, kind)
+			s.mu.Unlock()
+		}()
+		fn()
+	}()
+}
+
+// subscribe listens to the hello channel of a master or replica until the
+// node is closed, reconnecting whenever the connection fails.
+func (s *Sentinel) subscribe(n *node, retry time.Duration) {
+	defer s.wg.Done()
+	defer logger.RecoverPanic("sentinel-hello")
+	for {
+		if err := s.listenHello(n, retry); err != nil {
+			logger.Debug().Err(err).Str("addr", n.addr).Msg("sentinel hello subscription lost")
+		}
+		select {
+		case <-n.closed:
+			return
+		case <-s.stopCh:
+			return
+		case <-time.After(retry):
+		}
+	}
+}
+
+func (s *Sentinel) listenHello(n *node, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", n.addr, timeout)
+	if err != nil {
+		return err
+	}
+	n.cmu.Lock()
+	select {
+	case <-n.closed:
+		n.cmu.Unlock()
+		conn.Close()
+		return nil
+	default:
+	}
+	n.sub = conn
+	n.cmu.Unlock()
+	defer conn.Close()
+
+	r := resp.NewReader(bufio.NewReader(conn))
+	w := bufio.NewWriter(conn)
+	if n.auth != "" {
+		if err := writeCommand(w, "AUTH", n.auth); err != nil {
+			return err
+		}
+		if v, err := r.ReadValue(); err != nil || v.Type == resp.TypeError {
+			return fmt.Errorf("AUTH failed: %v", replyError(v, err))
+		}
+	}
+	if err := writeCommand(w, "SUBSCRIBE", helloChannel); err != nil {
+		return err
+	}
+	for {
+		v, err := r.ReadValue()
+		if err != nil {
+			return err
+		}
+		if len(v.Array) == 3 && string(v.Array[0].Bulk) == "message" {
+			s.processHello(string(v.Array[2].Bulk))
+		}
+	}
+}
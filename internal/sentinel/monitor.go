@@ -0,0 +1,542 @@
+package sentinel
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cachestorm/cachestorm/internal/resp"
+)
+
+// The periods of the requests sent to a master's group. Redis Sentinel's
+// are shortened for masters with a down-after below them, so detection
+// keeps up with the setting.
+
+func pingPeriod(m *MasterInfo) time.Duration {
+	return min(time.Second, m.DownAfter/2)
+}
+
+func helloPeriod(m *MasterInfo) time.Duration {
+	return min(2*time.Second, m.DownAfter/2)
+}
+
+// infoPeriod is shorter while the master is down or failing over, when
+// the roles of the replicas matter.
+func infoPeriod(m *MasterInfo) time.Duration {
+	if m.State >= MasterStateSDown || m.FailoverState != failoverNone {
+		return min(time.Second, m.DownAfter/2)
+	}
+	return min(10*time.Second, m.DownAfter)
+}
+
+// askPeriod is how often the other sentinels are asked about a down master.
+func askPeriod(m *MasterInfo) time.Duration {
+	return min(time.Second, m.DownAfter/2)
+}
+
+func requestTimeout(m *MasterInfo) time.Duration {
+	return min(time.Second, m.DownAfter)
+}
+
+// checkMasters runs one round of monitoring: it sends the requests that
+// are due to every instance and moves masters through the down states and
+// their failovers.
+func (s *Sentinel) checkMasters() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for _, m := range s.masters {
+		s.applyDefaults(m)
+		s.poll(m, now)
+		s.checkDown(m, now)
+		s.checkReplicas(m, now)
+		s.failoverStep(m, now)
+		m.NumReplicas = len(m.Replicas)
+		m.NumSentinels = len(s.sentinels[m.Name])
+	}
+}
+
+// applyDefaults fills the settings m was created without from the
+// sentinel's. s.mu must be held.
+func (s *Sentinel) applyDefaults(m *MasterInfo) {
+	if m.DownAfter <= 0 {
+		m.DownAfter = s.downAfter
+	}
+	if m.FailoverTimeout <= 0 {
+		m.FailoverTimeout = s.failoverTime
+	}
+	if m.ParallelSyncs <= 0 {
+		m.ParallelSyncs = s.parallelSyncs
+	}
+}
+
+// nodeOf returns the node at host:port kept in *np, replacing it if the
+// instance moved. Masters and replicas are also subscribed to the hello
+// channel. s.mu must be held.
+func (s *Sentinel) nodeOf(np **node, host string, port int, m *MasterInfo, subscribe bool) *node {
+	n := *np
+	if n != nil && n.addr == net.JoinHostPort(host, strconv.Itoa(port)) {
+		return n
+	}
+	if n != nil {
+		n.close()
+	}
+	n = newNode(host, port, m.AuthPass)
+	*np = n
+	if subscribe && s.running.Load() {
+		s.wg.Add(1)
+		go s.subscribe(n, helloPeriod(m))
+	}
+	return n
+}
+
+// closeNodes drops the links to the master's group. s.mu must be held.
+func (s *Sentinel) closeNodes(m *MasterInfo) {
+	if m.node != nil {
+		m.node.close()
+		m.node = nil
+	}
+	for _, r := range m.Replicas {
+		if r.node != nil {
+			r.node.close()
+			r.node = nil
+		}
+	}
+	for _, p := range s.sentinels[m.Name] {
+		if p.node != nil {
+			p.node.close()
+			p.node = nil
+		}
+	}
+}
+
+// poll sends the requests that are due to the master, its replicas and the
+// other sentinels monitoring it. s.mu must be held.
+func (s *Sentinel) poll(m *MasterInfo, now time.Time) {
+	mn := s.nodeOf(&m.node, m.Addr, m.Port, m, true)
+	s.pollNode(m, nil, mn, now)
+	m.LastPing, m.LastOkPing = mn.lastPing, mn.lastOK
+	for _, r := range m.Replicas {
+		rn := s.nodeOf(&r.node, r.Addr, r.Port, m, true)
+		s.pollNode(m, r, rn, now)
+		r.LastPing = rn.lastPing
+	}
+
+	down := m.State >= MasterStateSDown
+	for _, p := range s.sentinels[m.Name] {
+		// Answers about an earlier outage no longer count.
+		if !down || now.Sub(p.lastReply) > 5*askPeriod(m) {
+			p.Down = false
+		}
+		if !down && m.FailoverState != failoverWaitStart {
+			continue
+		}
+		pn := s.nodeOf(&p.node, p.Addr, p.Port, m, false)
+		if now.Sub(pn.lastAsk) >= askPeriod(m) {
+			pn.lastAsk = now
+			s.ask(m, p, pn)
+		}
+	}
+}
+
+// pollNode pings the master, or replica r, and asks for its INFO and
+// publishes hellos on it when they are due. s.mu must be held.
+func (s *Sentinel) pollNode(m *MasterInfo, r *ReplicaInfo, n *node, now time.Time) {
+	timeout := requestTimeout(m)
+	if now.Sub(n.lastPing) >= pingPeriod(m) && !n.busy["ping"] {
+		n.lastPing = now
+		s.spawn(n, "ping", func() {
+			v, err := n.call(timeout, "PING")
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if validPong(v, err) {
+				n.lastOK = time.Now()
+			}
+		})
+	}
+	if now.Sub(n.lastInfo) >= infoPeriod(m) && !n.busy["info"] {
+		s.spawn(n, "info", func() {
+			v, err := n.call(timeout, "INFO", "replication")
+			if err != nil || v.Type == resp.TypeError {
+				return
+			}
+			info := parseInfo(string(v.Bulk))
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			n.lastInfo = time.Now()
+			// The instance may have been replaced by a failover meanwhile
+			if (r == nil && m.node == n) || (r != nil && r.node == n) {
+				s.refreshFromInfo(m, r, info)
+			}
+		})
+	}
+	if now.Sub(n.lastHello) >= helloPeriod(m) && !n.busy["hello"] {
+		n.lastHello = now
+		payload := s.helloFor(m)
+		s.spawn(n, "hello", func() {
+			ip, port := s.announceAddr(n)
+			n.call(timeout, "PUBLISH", helloChannel, fmt.Sprintf(payload, ip, port))
+		})
+	}
+}
+
+// validPong reports whether v is a reply that shows the instance is up:
+// PONG, or the errors of an instance that is loading or has lost its
+// master.
+func validPong(v *resp.Value, err error) bool {
+	if err != nil {
+		return false
+	}
+	if v.Type == resp.TypeError {
+		return strings.HasPrefix(v.Err, "LOADING") || strings.HasPrefix(v.Err, "MASTERDOWN")
+	}
+	return true
+}
+
+// ask asks the sentinel p whether it also sees m down and, while this
+// sentinel seeks to run the failover, for its vote. s.mu must be held.
+func (s *Sentinel) ask(m *MasterInfo, p *SentinelPeer, n *node) {
+	runID := "*"
+	if m.FailoverState == failoverWaitStart && !m.forced {
+		runID = s.id
+	}
+	args := []string{"SENTINEL", "IS-MASTER-DOWN-BY-ADDR", m.Addr, strconv.Itoa(m.Port),
+		strconv.FormatInt(s.currentEpoch, 10), runID}
+	timeout := requestTimeout(m)
+	s.spawn(n, "ask", func() {
+		v, err := n.call(timeout, args...)
+		if err != nil || v.Type != resp.TypeArray || len(v.Array) != 3 {
+			return
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		p.lastReply = time.Now()
+		p.Down = v.Array[0].Int == 1
+		if leader := string(v.Array[1].Bulk); leader != "*" {
+			p.Leader, p.LeaderEpoch = leader, v.Array[2].Int
+		}
+	})
+}
+
+// checkDown moves the master and its replicas in and out of the down
+// states. s.mu must be held.
+func (s *Sentinel) checkDown(m *MasterInfo, now time.Time) {
+	sdown := m.node != nil && now.Sub(m.node.lastOK) > m.DownAfter
+	switch {
+	case sdown && m.State < MasterStateSDown:
+		m.State = MasterStateSDown
+		m.Flags = []string{"master", "s_down"}
+		s.emit("+sdown", "master %s %s %d", m.Name, m.Addr, m.Port)
+	case !sdown && m.State >= MasterStateSDown:
+		if m.State == MasterStateODown {
+			s.emit("-odown", "master %s %s %d", m.Name, m.Addr, m.Port)
+		}
+		s.emit("-sdown", "master %s %s %d", m.Name, m.Addr, m.Port)
+		fallthrough
+	case !sdown && m.State == MasterStateNone:
+		m.State = MasterStateOK
+		m.Flags = []string{"master"}
+	}
+
+	if m.State >= MasterStateSDown {
+		odown := s.checkODown(m)
+		if odown && m.State != MasterStateODown {
+			m.State = MasterStateODown
+			m.Flags = []string{"master", "s_down", "o_down"}
+			m.tryAfter = now.Add(failoverJitter(m))
+			s.emit("+odown", "master %s %s %d #quorum %d/%d", m.Name, m.Addr, m.Port, s.downVotes(m), s.quorumOf(m))
+		} else if !odown && m.State == MasterStateODown {
+			m.State = MasterStateSDown
+			m.Flags = []string{"master", "s_down"}
+			s.emit("-odown", "master %s %s %d", m.Name, m.Addr, m.Port)
+		}
+	}
+
+	for _, r := range m.Replicas {
+		if r.node == nil {
+			continue
+		}
+		down := now.Sub(r.node.lastOK) > m.DownAfter
+		if down && r.State != "s_down" {
+			r.State = "s_down"
+			s.emit("+sdown", "slave %s:%d %s %d @ %s %s %d", r.Addr, r.Port, r.Addr, r.Port, m.Name, m.Addr, m.Port)
+		} else if !down && r.State == "s_down" {
+			r.State = "online"
+			s.emit("-sdown", "slave %s:%d %s %d @ %s %s %d", r.Addr, r.Port, r.Addr, r.Port, m.Name, m.Addr, m.Port)
+		} else if !down && r.State == "" {
+			r.State = "online"
+		}
+	}
+}
+
+// checkODown reports whether enough sentinels see the master down: this
+// one, which is only asked once it does, and the peers that said so.
+// s.mu must be held.
+func (s *Sentinel) checkODown(master *MasterInfo) bool {
+	return s.downVotes(master) >= s.quorumOf(master)
+}
+
+func (s *Sentinel) downVotes(m *MasterInfo) int {
+	votes := 1
+	for _, p := range s.sentinels[m.Name] {
+		if p.Down {
+			votes++
+		}
+	}
+	return votes
+}
+
+func (s *Sentinel) quorumOf(m *MasterInfo) int {
+	if m.Quorum > 0 {
+		return m.Quorum
+	}
+	return s.quorum
+}
+
+// nodeInfo is what the sentinel reads from INFO replication.
+type nodeInfo struct {
+	role         string
+	masterHost   string
+	masterPort   int
+	masterLinkUp bool
+	offset       int64
+	priority     int
+	replicas     []replicaEntry
+}
+
+type replicaEntry struct {
+	ip     string
+	port   int
+	offset int64
+	lag    int64
+}
+
+func parseInfo(s string) *nodeInfo {
+	info := &nodeInfo{priority: 100}
+	for _, line := range strings.Split(s, "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if !ok {
+			continue
+		}
+		switch {
+		case key == "role":
+			info.role = value
+		case key == "master_host":
+			info.masterHost = value
+		case key == "master_port":
+			info.masterPort, _ = strconv.Atoi(value)
+		case key == "master_link_status":
+			info.masterLinkUp = value == "up"
+		case key == "slave_repl_offset":
+			info.offset, _ = strconv.ParseInt(value, 10, 64)
+		case key == "master_repl_offset" && info.role == "master":
+			info.offset, _ = strconv.ParseInt(value, 10, 64)
+		case key == "slave_priority" || key == "replica_priority":
+			info.priority, _ = strconv.Atoi(value)
+		case strings.HasPrefix(key, "slave") && key[len("slave"):] != "" && isDigits(key[len("slave"):]):
+			var e replicaEntry
+			for _, field := range strings.Split(value, ",") {
+				k, v, _ := strings.Cut(field, "=")
+				switch k {
+				case "ip":
+					e.ip = v
+				case "port":
+					e.port, _ = strconv.Atoi(v)
+				case "offset":
+					e.offset, _ = strconv.ParseInt(v, 10, 64)
+				case "lag":
+					e.lag, _ = strconv.ParseInt(v, 10, 64)
+				}
+			}
+			if e.ip != "" && e.port > 0 {
+				info.replicas = append(info.replicas, e)
+			}
+		}
+	}
+	return info
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// refreshFromInfo records the INFO of the master, when r is nil, or of
+// replica r: the master's INFO is how replicas are discovered. s.mu must
+// be held.
+func (s *Sentinel) refreshFromInfo(m *MasterInfo, r *ReplicaInfo, info *nodeInfo) {
+	if r == nil {
+		for _, e := range info.replicas {
+			known := m.replica(e.ip, e.port)
+			if known == nil {
+				known = &ReplicaInfo{Addr: e.ip, Port: e.port, Priority: 100}
+				m.Replicas = append(m.Replicas, known)
+				s.emit("+slave", "slave %s:%d %s %d @ %s %s %d", e.ip, e.port, e.ip, e.port, m.Name, m.Addr, m.Port)
+				s.persist()
+			}
+			known.Offset, known.Lag = e.offset, e.lag
+		}
+		return
+	}
+	if info.role != r.Role || info.masterHost != r.MasterHost || info.masterPort != r.MasterPort {
+		r.roleChanged = time.Now()
+	}
+	r.Role, r.MasterHost, r.MasterPort = info.role, info.masterHost, info.masterPort
+	r.MasterLinkUp, r.Priority = info.masterLinkUp, info.priority
+	r.Offset = info.offset
+}
+
+func (m *MasterInfo) replica(host string, port int) *ReplicaInfo {
+	for _, r := range m.Replicas {
+		if r.Addr == host && r.Port == port {
+			return r
+		}
+	}
+	return nil
+}
+
+// checkReplicas points the replicas that follow another master, or that
+// act as masters themselves like a former master coming back, at the
+// master. Replicas get a moment to settle first, and nothing is changed
+// while the master is down or failing over. s.mu must be held.
+func (s *Sentinel) checkReplicas(m *MasterInfo, now time.Time) {
+	if m.State != MasterStateOK || m.FailoverState != failoverNone {
+		return
+	}
+	settle := 4 * helloPeriod(m)
+	for _, r := range m.Replicas {
+		if r.node == nil || r.State != "online" || r.Role == "" || now.Sub(r.roleChanged) < settle {
+			continue
+		}
+		var event string
+		switch {
+		case r.Role == "master":
+			event = "+convert-to-slave"
+		case r.MasterHost != m.Addr || r.MasterPort != m.Port:
+			event = "+fix-slave-config"
+		default:
+			continue
+		}
+		s.emit(event, "slave %s:%d %s %d @ %s %s %d", r.Addr, r.Port, r.Addr, r.Port, m.Name, m.Addr, m.Port)
+		r.roleChanged = now
+		s.replicaOf(m, r.node, m.Addr, m.Port, nil)
+	}
+}
+
+// replicaOf sends REPLICAOF host port, or REPLICAOF NO ONE when host is
+// empty, to n and calls done, if not nil, with the outcome under s.mu.
+// s.mu must be held.
+func (s *Sentinel) replicaOf(m *MasterInfo, n *node, host string, port int, done func(error)) {
+	args := []string{"REPLICAOF", "NO", "ONE"}
+	if host != "" {
+		args = []string{"REPLICAOF", host, strconv.Itoa(port)}
+	}
+	timeout := requestTimeout(m)
+	s.spawn(n, "replicaof", func() {
+		err := replyError(n.call(timeout, args...))
+		if done != nil {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			done(err)
+		}
+	})
+}
+
+// helloFor returns the hello announcing this sentinel's view of m, with
+// verbs for the address the sentinel is reached at. s.mu must be held.
+func (s *Sentinel) helloFor(m *MasterInfo) string {
+	host, port := m.currentAddr()
+	return fmt.Sprintf("%%s,%%d,%s,%d,%s,%s,%d,%d", s.id, s.currentEpoch, m.Name, host, port, m.Epoch)
+}
+
+// announceAddr returns the address other sentinels reach this one at.
+func (s *Sentinel) announceAddr(n *node) (string, int) {
+	ip, port := s.announceIP, s.announcePort
+	if ip == "" {
+		ip = s.addr
+		if ip == "" || net.ParseIP(ip).IsUnspecified() {
+			ip = n.localIP()
+		}
+	}
+	if port == 0 {
+		port = s.port
+	}
+	return ip, port
+}
+
+// processHello handles a hello seen on a node: it discovers the sentinel
+// that sent it and adopts its epoch and its view of the master when they
+// are newer.
+func (s *Sentinel) processHello(payload string) {
+	f := strings.Split(payload, ",")
+	if len(f) != 8 {
+		return
+	}
+	port, err1 := strconv.Atoi(f[1])
+	epoch, err2 := strconv.ParseInt(f[3], 10, 64)
+	masterPort, err3 := strconv.Atoi(f[6])
+	configEpoch, err4 := strconv.ParseInt(f[7], 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+		return
+	}
+	ip, runID, name, masterIP := f[0], f[2], f[4], f[5]
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.masters[name]
+	if !ok || runID == s.id {
+		return
+	}
+
+	p := s.peer(name, runID)
+	if p == nil {
+		// A sentinel restarted with a new ID replaces the old one
+		peers := s.sentinels[name][:0]
+		for _, old := range s.sentinels[name] {
+			if old.Addr == ip && old.Port == port {
+				s.emit("-dup-sentinel", "master %s %s %d #duplicate of %s:%d or %s", name, m.Addr, m.Port, ip, port, old.RunID)
+				if old.node != nil {
+					old.node.close()
+				}
+				continue
+			}
+			peers = append(peers, old)
+		}
+		p = &SentinelPeer{ID: runID, RunID: runID, Addr: ip, Port: port}
+		s.sentinels[name] = append(peers, p)
+		s.emit("+sentinel", "sentinel %s %s %d @ %s %s %d", runID, ip, port, name, m.Addr, m.Port)
+		s.persist()
+	}
+	p.Addr, p.Port = ip, port
+	p.LastSeen, p.Epoch = time.Now(), epoch
+
+	if epoch > s.currentEpoch {
+		s.currentEpoch = epoch
+		s.emit("+new-epoch", "%d", epoch)
+		s.persist()
+	}
+	if configEpoch > m.Epoch {
+		m.Epoch = configEpoch
+		if masterIP != m.Addr || masterPort != m.Port {
+			s.emit("+config-update-from", "sentinel %s %s %d @ %s %s %d", runID, ip, port, name, m.Addr, m.Port)
+			s.switchMaster(m, masterIP, masterPort)
+		}
+		s.persist()
+	}
+}
+
+func (s *Sentinel) peer(master, runID string) *SentinelPeer {
+	for _, p := range s.sentinels[master] {
+		if p.RunID == runID {
+			return p
+		}
+	}
+	return nil
+}
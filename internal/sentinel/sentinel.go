@@ -1,10 +1,9 @@
 package sentinel
 
 import (
-	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
-	"net"
-	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -22,11 +21,29 @@ const (
 	MasterStateODown
 )
 
+// Failover states, in the order a failover goes through them.
+const (
+	failoverNone          = ""
+	failoverWaitStart     = "wait_start"
+	failoverSelectReplica = "select_slave"
+	failoverSendNoOne     = "send_slaveof_noone"
+	failoverWaitPromotion = "wait_promotion"
+	failoverReconfigure   = "reconf_slaves"
+)
+
+// helloChannel is where sentinels announce themselves and their view of a
+// master on every node of the master's group.
+const helloChannel = "__sentinel__:hello"
+
 type Sentinel struct {
 	mu            sync.RWMutex
 	id            string
 	addr          string
 	port          int
+	announceIP    string
+	announcePort  int
+	configFile    string
+	currentEpoch  int64
 	masters       map[string]*MasterInfo
 	sentinels     map[string][]*SentinelPeer
 	running       atomic.Bool
@@ -36,7 +53,11 @@ type Sentinel struct {
 	parallelSyncs int
 	failoverTime  time.Duration
 	quorum        int
-	onFailover    func(master string, newAddr string, newPort int)
+	// period is how often the instances are checked; the requests sent to
+	// them have their own, longer periods.
+	period     time.Duration
+	onFailover func(master string, newAddr string, newPort int)
+	subs       map[*subscriber]struct{}
 }
 
 type MasterInfo struct {
@@ -51,9 +72,27 @@ type MasterInfo struct {
 	Flags         []string
 	Replicas      []*ReplicaInfo
 	FailoverState string
-	Leader        string
-	Epoch         int64
-	Quorum        int
+	// Leader is the sentinel this one voted for in LeaderEpoch to run the
+	// failover of the master.
+	Leader      string
+	LeaderEpoch int64
+	// Epoch is the configuration epoch: the epoch of the failover that
+	// made the master what it is. Sentinels adopt the address announced
+	// with the highest one.
+	Epoch           int64
+	Quorum          int
+	DownAfter       time.Duration
+	FailoverTimeout time.Duration
+	ParallelSyncs   int
+	AuthPass        string
+
+	node          *node
+	failoverEpoch int64
+	failoverStart time.Time
+	tryAfter      time.Time
+	stateChanged  time.Time
+	forced        bool
+	promoted      *ReplicaInfo
 }
 
 type ReplicaInfo struct {
@@ -63,6 +102,19 @@ type ReplicaInfo struct {
 	LastPing time.Time
 	Offset   int64
 	Lag      int64
+	// What the replica reports about itself in INFO replication.
+	Role         string
+	MasterHost   string
+	MasterPort   int
+	MasterLinkUp bool
+	Priority     int
+
+	node *node
+	// roleChanged is when the role or master reported last changed.
+	roleChanged time.Time
+	// reconf is how far the replica is in following the promoted replica
+	// during a failover: "", "sent" or "done".
+	reconf string
 }
 
 type SentinelPeer struct {
@@ -72,6 +124,13 @@ type SentinelPeer struct {
 	LastSeen time.Time
 	RunID    string
 	Epoch    int64
+	// What the peer last answered to IS-MASTER-DOWN-BY-ADDR.
+	Down        bool
+	Leader      string
+	LeaderEpoch int64
+
+	node      *node
+	lastReply time.Time
 }
 
 type Config struct {
@@ -82,6 +141,15 @@ type Config struct {
 	ParallelSyncs int
 	FailoverTime  time.Duration
 	Quorum        int
+	// AnnounceIP and AnnouncePort are the address other sentinels reach
+	// this one at; by default Addr and Port, or the local address of the
+	// connection the hello is sent on when Addr is a wildcard.
+	AnnounceIP   string
+	AnnouncePort int
+	// ConfigFile keeps the monitored masters and what was learnt about
+	// them across restarts. It is read by Start and rewritten on every
+	// change.
+	ConfigFile string
 }
 
 func New(cfg Config) *Sentinel {
@@ -102,6 +170,9 @@ func New(cfg Config) *Sentinel {
 		id:            cfg.ID,
 		addr:          cfg.Addr,
 		port:          cfg.Port,
+		announceIP:    cfg.AnnounceIP,
+		announcePort:  cfg.AnnouncePort,
+		configFile:    cfg.ConfigFile,
 		masters:       make(map[string]*MasterInfo),
 		sentinels:     make(map[string][]*SentinelPeer),
 		stopCh:        make(chan struct{}),
@@ -109,18 +180,33 @@ func New(cfg Config) *Sentinel {
 		parallelSyncs: cfg.ParallelSyncs,
 		failoverTime:  cfg.FailoverTime,
 		quorum:        cfg.Quorum,
+		period:        100 * time.Millisecond,
+		subs:          make(map[*subscriber]struct{}),
 	}
 }
 
+// Start loads the configuration file, if any, and starts monitoring.
 func (s *Sentinel) Start() error {
+	if s.configFile != "" {
+		if err := s.loadConfig(); err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	if s.id == "" {
+		s.id = newRunID()
+	}
+	if err := s.saveConfig(); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	s.mu.Unlock()
+
 	s.running.Store(true)
 
 	s.wg.Add(1)
 	go s.monitorLoop()
 
-	s.wg.Add(1)
-	go s.gossipLoop()
-
 	logger.Info().Str("id", s.id).Msg("Sentinel started")
 	return nil
 }
@@ -130,30 +216,26 @@ func (s *Sentinel) Stop() {
 		return
 	}
 	close(s.stopCh)
+	s.mu.Lock()
+	for _, m := range s.masters {
+		s.closeNodes(m)
+	}
+	s.mu.Unlock()
 	s.wg.Wait()
 	logger.Info().Msg("Sentinel stopped")
 }
 
-func (s *Sentinel) monitorLoop() {
-	defer s.wg.Done()
-
-	ticker := time.NewTicker(1 * time.Second)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-s.stopCh:
-			return
-		case <-ticker.C:
-			s.checkMasters()
-		}
-	}
+// ID returns the run ID the sentinel announces itself with.
+func (s *Sentinel) ID() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.id
 }
 
-func (s *Sentinel) gossipLoop() {
+func (s *Sentinel) monitorLoop() {
 	defer s.wg.Done()
 
-	ticker := time.NewTicker(2 * time.Second)
+	ticker := time.NewTicker(s.period)
 	defer ticker.Stop()
 
 	for {
@@ -161,132 +243,9 @@ func (s *Sentinel) gossipLoop() {
 		case <-s.stopCh:
 			return
 		case <-ticker.C:
-			s.gossipSentinels()
-		}
-	}
-}
-
-func (s *Sentinel) checkMasters() {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	for name, master := range s.masters {
-		if s.isReachable(master.Addr, master.Port) {
-			master.State = MasterStateOK
-			master.LastOkPing = time.Now()
-			master.Flags = []string{"master"}
-		} else {
-			if master.State == MasterStateOK || master.State == MasterStateNone {
-				master.State = MasterStateSDown
-				master.Flags = []string{"master", "s_down"}
-				logger.Warn().
-					Str("master", name).
-					Msg("Master marked as subjectively down")
-			}
-
-			if s.checkODown(master) {
-				master.State = MasterStateODown
-				master.Flags = []string{"master", "s_down", "o_down"}
-				logger.Error().
-					Str("master", name).
-					Msg("Master marked as objectively down")
-
-				go func(name string, master *MasterInfo) {
-					defer logger.RecoverPanic("sentinel-failover")
-					s.startFailover(name, master)
-				}(name, master)
-			}
-		}
-	}
-}
-
-func (s *Sentinel) isReachable(addr string, port int) bool {
-	conn, err := net.DialTimeout("tcp",
-		net.JoinHostPort(addr, strconv.Itoa(port)),
-		2*time.Second)
-	if err != nil {
-		return false
-	}
-	conn.Close()
-	return true
-}
-
-func (s *Sentinel) checkODown(master *MasterInfo) bool {
-	s.mu.RLock()
-	peers := s.sentinels[master.Name]
-	s.mu.RUnlock()
-
-	downCount := 0
-	for _, peer := range peers {
-		if time.Since(peer.LastSeen) < s.downAfter {
-			downCount++
-		}
-	}
-
-	return downCount+1 >= s.quorum
-}
-
-func (s *Sentinel) startFailover(name string, master *MasterInfo) {
-	s.mu.Lock()
-	if master.FailoverState != "" {
-		s.mu.Unlock()
-		return
-	}
-	master.FailoverState = "waiting"
-	s.mu.Unlock()
-
-	logger.Info().Str("master", name).Msg("Starting failover")
-
-	// Wait for failover delay (configurable, default 5s)
-	failoverDelay := s.failoverTime
-	if failoverDelay == 0 {
-		failoverDelay = 5 * time.Second
-	}
-
-	select {
-	case <-time.After(failoverDelay):
-	case <-s.stopCh:
-		return
-	}
-
-	var bestReplica *ReplicaInfo
-	s.mu.RLock()
-	for _, r := range master.Replicas {
-		if bestReplica == nil || r.Offset > bestReplica.Offset {
-			bestReplica = r
+			s.checkMasters()
 		}
 	}
-	s.mu.RUnlock()
-
-	if bestReplica == nil {
-		logger.Error().Str("master", name).Msg("No replica available for failover")
-		s.mu.Lock()
-		master.FailoverState = ""
-		s.mu.Unlock()
-		return
-	}
-
-	s.mu.Lock()
-	master.Addr = bestReplica.Addr
-	master.Port = bestReplica.Port
-	master.State = MasterStateOK
-	master.FailoverState = ""
-	master.Flags = []string{"master"}
-	master.Epoch++
-	s.mu.Unlock()
-
-	logger.Info().
-		Str("master", name).
-		Str("new_addr", bestReplica.Addr).
-		Int("new_port", bestReplica.Port).
-		Msg("Failover completed")
-
-	if s.onFailover != nil {
-		s.onFailover(name, bestReplica.Addr, bestReplica.Port)
-	}
-}
-
-func (s *Sentinel) gossipSentinels() {
 }
 
 func (s *Sentinel) Monitor(name, addr string, port, quorum int) error {
@@ -297,54 +256,79 @@ func (s *Sentinel) Monitor(name, addr string, port, quorum int) error {
 		return fmt.Errorf("master '%s' already monitored", name)
 	}
 
-	s.masters[name] = &MasterInfo{
-		Name:     name,
-		Addr:     addr,
-		Port:     port,
-		State:    MasterStateNone,
-		Quorum:   quorum,
-		Replicas: make([]*ReplicaInfo, 0),
-	}
-
-	logger.Info().
-		Str("name", name).
-		Str("addr", addr).
-		Int("port", port).
-		Msg("Monitoring master")
-
+	s.masters[name] = s.newMaster(name, addr, port, quorum)
+	s.emit("+monitor", "master %s %s %d quorum %d", name, addr, port, quorum)
+	s.persist()
 	return nil
 }
 
+func (s *Sentinel) newMaster(name, addr string, port, quorum int) *MasterInfo {
+	return &MasterInfo{
+		Name:            name,
+		Addr:            addr,
+		Port:            port,
+		State:           MasterStateNone,
+		Quorum:          quorum,
+		Replicas:        make([]*ReplicaInfo, 0),
+		DownAfter:       s.downAfter,
+		FailoverTimeout: s.failoverTime,
+		ParallelSyncs:   s.parallelSyncs,
+	}
+}
+
 func (s *Sentinel) Remove(name string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if _, exists := s.masters[name]; !exists {
+	m, exists := s.masters[name]
+	if !exists {
 		return fmt.Errorf("master '%s' not monitored", name)
 	}
 
+	s.closeNodes(m)
 	delete(s.masters, name)
 	delete(s.sentinels, name)
+	s.emit("-monitor", "master %s %s %d", name, m.Addr, m.Port)
+	s.persist()
 
 	return nil
 }
 
+// Masters returns a copy of every monitored master.
 func (s *Sentinel) Masters() []*MasterInfo {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
 	result := make([]*MasterInfo, 0, len(s.masters))
 	for _, m := range s.masters {
-		result = append(result, m)
+		result = append(result, m.snapshot())
 	}
 	return result
 }
 
+// GetMaster returns a copy of the master monitored as name.
 func (s *Sentinel) GetMaster(name string) (*MasterInfo, bool) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	m, ok := s.masters[name]
-	return m, ok
+	if !ok {
+		return nil, false
+	}
+	return m.snapshot(), true
+}
+
+// snapshot copies what callers outside the package may read of m.
+func (m *MasterInfo) snapshot() *MasterInfo {
+	c := *m
+	c.node, c.promoted = nil, nil
+	c.Flags = append([]string(nil), m.Flags...)
+	c.Replicas = make([]*ReplicaInfo, len(m.Replicas))
+	for i, r := range m.Replicas {
+		rc := *r
+		rc.node = nil
+		c.Replicas[i] = &rc
+	}
+	return &c
 }
 
 func (s *Sentinel) GetMasterAddr(name string) (string, int, error) {
@@ -379,21 +363,24 @@ func (s *Sentinel) CKQUORUM(name string) (int, error) {
 	return alive + 1, nil
 }
 
+// Failover starts a failover of the master without asking the other
+// sentinels, whether or not the master is down.
 func (s *Sentinel) Failover(name string) error {
 	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	m, ok := s.masters[name]
 	if !ok {
-		s.mu.Unlock()
 		return fmt.Errorf("master '%s' not monitored", name)
 	}
-
-	if m.FailoverState != "" {
-		s.mu.Unlock()
+	if m.FailoverState != failoverNone {
 		return fmt.Errorf("failover already in progress")
 	}
-	s.mu.Unlock()
+	if s.selectReplica(m, time.Now()) == nil {
+		return fmt.Errorf("no suitable replica to promote")
+	}
 
-	go s.startFailover(name, m)
+	s.startFailover(m, true)
 	return nil
 }
 
@@ -402,18 +389,26 @@ func (s *Sentinel) Reset(pattern string) int {
 	defer s.mu.Unlock()
 
 	count := 0
-	for name := range s.masters {
+	for name, m := range s.masters {
 		if matchPattern(name, pattern) {
+			s.closeNodes(m)
 			delete(s.masters, name)
 			delete(s.sentinels, name)
 			count++
 		}
 	}
+	if count > 0 {
+		s.persist()
+	}
 
 	return count
 }
 
+// OnFailover calls fn, from its own goroutine, whenever a master is
+// replaced by one of its replicas.
 func (s *Sentinel) OnFailover(fn func(master string, newAddr string, newPort int)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.onFailover = fn
 }
 
@@ -429,9 +424,18 @@ func (s *Sentinel) Info() map[string]interface{} {
 		"running":       s.running.Load(),
 		"down_after_ms": s.downAfter.Milliseconds(),
 		"quorum":        s.quorum,
+		"current_epoch": s.currentEpoch,
 	}
 }
 
+// emit logs a sentinel event and publishes it to the clients subscribed to
+// it, as Redis Sentinel does. s.mu must be held.
+func (s *Sentinel) emit(event, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	logger.Info().Str("event", event).Msg(msg)
+	s.publish(event, msg)
+}
+
 func matchPattern(s, pattern string) bool {
 	if pattern == "*" {
 		return true
@@ -448,138 +452,11 @@ func matchPattern(s, pattern string) bool {
 	return s == pattern
 }
 
-func (s *Sentinel) Serve(ctx context.Context, port int) error {
-	addr := net.JoinHostPort(s.addr, strconv.Itoa(port))
-	ln, err := net.Listen("tcp", addr)
-	if err != nil {
-		return err
-	}
-
-	logger.Info().Str("addr", addr).Msg("Sentinel listening")
-
-	go func() {
-		<-ctx.Done()
-		ln.Close()
-	}()
-
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			return err
-		}
-
-		go s.handleConnection(conn)
-	}
-}
-
-func (s *Sentinel) handleConnection(conn net.Conn) {
-	defer conn.Close()
-
-	buf := make([]byte, 4096)
-	for {
-		n, err := conn.Read(buf)
-		if err != nil {
-			return
-		}
-
-		data := string(buf[:n])
-		lines := strings.Split(data, "\r\n")
-
-		for _, line := range lines {
-			if line == "" {
-				continue
-			}
-
-			response := s.handleCommand(line)
-			if _, err := conn.Write([]byte(response + "\r\n")); err != nil {
-				return
-			}
-		}
-	}
-}
-
-func (s *Sentinel) handleCommand(cmd string) string {
-	parts := strings.Fields(cmd)
-	if len(parts) == 0 {
-		return "-ERR empty command"
-	}
-
-	switch strings.ToUpper(parts[0]) {
-	case "PING":
-		return "+PONG"
-	case "SENTINEL":
-		if len(parts) < 2 {
-			return "-ERR wrong number of arguments"
-		}
-		return s.handleSentinel(parts[1:])
-	case "INFO":
-		return "+OK"
-	default:
-		return "-ERR unknown command '" + parts[0] + "'"
-	}
-}
-
-func (s *Sentinel) handleSentinel(parts []string) string {
-	if len(parts) == 0 {
-		return "-ERR wrong number of arguments"
-	}
-
-	switch strings.ToUpper(parts[0]) {
-	case "MASTERS":
-		return s.formatMasters()
-	case "MASTER":
-		if len(parts) < 2 {
-			return "-ERR wrong number of arguments"
-		}
-		return s.formatMaster(parts[1])
-	case "GETMASTER":
-		if len(parts) < 2 {
-			return "-ERR wrong number of arguments"
-		}
-		addr, port, err := s.GetMasterAddr(parts[1])
-		if err != nil {
-			return "-ERR " + err.Error()
-		}
-		return fmt.Sprintf("*2\r\n$%d\r\n%s\r\n:%d\r\n", len(addr), addr, port)
-	case "RESET":
-		if len(parts) < 2 {
-			return "-ERR wrong number of arguments"
-		}
-		count := s.Reset(parts[1])
-		return fmt.Sprintf(":%d", count)
-	default:
-		return "-ERR unknown subcommand '" + parts[0] + "'"
-	}
-}
-
-func (s *Sentinel) formatMasters() string {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-
-	var result strings.Builder
-	for _, m := range s.masters {
-		result.WriteString(fmt.Sprintf("name:%s\r\nip:%s\r\nport:%d\r\nflags:%s\r\nnum-replicas:%d\r\n",
-			m.Name, m.Addr, m.Port, strings.Join(m.Flags, ","), m.NumReplicas))
-	}
-	return result.String()
-}
-
-func (s *Sentinel) formatMaster(name string) string {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-
-	m, ok := s.masters[name]
-	if !ok {
-		return "-ERR no such master"
+// newRunID returns a random 40 character run ID.
+func newRunID() string {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%040x", time.Now().UnixNano())
 	}
-
-	return fmt.Sprintf("*28\r\n"+
-		"$4\r\nname\r\n$%d\r\n%s\r\n"+
-		"$2\r\nip\r\n$%d\r\n%s\r\n"+
-		"$4\r\nport\r\n:%d\r\n"+
-		"$5\r\nflags\r\n$%d\r\n%s\r\n",
-		len(m.Name), m.Name,
-		len(m.Addr), m.Addr,
-		m.Port,
-		len(strings.Join(m.Flags, ",")), strings.Join(m.Flags, ","))
+	return hex.EncodeToString(b)
 }
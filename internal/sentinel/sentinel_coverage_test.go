@@ -5,9 +5,10 @@ import (
 	"fmt"
 	"net"
 	"strings"
-	"sync"
 	"testing"
 	"time"
+
+	"github.com/cachestorm/cachestorm/internal/resp"
 )
 
 // --- Tests for checkODown ---
@@ -49,8 +50,8 @@ func TestCheckODown_WithActivePeers(t *testing.T) {
 	// Add peers that have been seen recently
 	s.mu.Lock()
 	s.sentinels["mymaster"] = []*SentinelPeer{
-		{ID: "s2", LastSeen: time.Now()},
-		{ID: "s3", LastSeen: time.Now()},
+		{ID: "s2", LastSeen: time.Now(), Down: true},
+		{ID: "s3", LastSeen: time.Now(), Down: true},
 	}
 	s.mu.Unlock()
 
@@ -58,7 +59,7 @@ func TestCheckODown_WithActivePeers(t *testing.T) {
 	master := s.masters["mymaster"]
 	s.mu.RUnlock()
 
-	// 2 active peers + self = 3 >= quorum 2 -> true
+	// 2 peers seeing it down + self = 3 >= quorum 2 -> true
 	result := s.checkODown(master)
 	if !result {
 		t.Error("expected true with 2 active peers + self >= quorum 2")
@@ -81,7 +82,7 @@ func TestCheckODown_WithStalePeers(t *testing.T) {
 	master := s.masters["mymaster"]
 	s.mu.RUnlock()
 
-	// Stale peers don't count; only self = 1 < quorum 3 -> false
+	// Peers that did not report the master down don't count; only self = 1 < quorum 3 -> false
 	result := s.checkODown(master)
 	if result {
 		t.Error("expected false with only stale peers")
@@ -90,186 +91,96 @@ func TestCheckODown_WithStalePeers(t *testing.T) {
 
 // --- Tests for startFailover ---
 
-func TestStartFailover_AlreadyInProgress(t *testing.T) {
-	s := New(Config{ID: "s1", FailoverTime: 50 * time.Millisecond})
+func TestStartFailover_VotesForItselfInNewEpoch(t *testing.T) {
+	s := New(Config{ID: "s1"})
 	s.Monitor("mymaster", "127.0.0.1", 6379, 2)
 
-	master := &MasterInfo{
-		Name:          "mymaster",
-		FailoverState: "waiting", // already in progress
-	}
-
-	// Should return immediately without doing anything
-	s.startFailover("mymaster", master)
-}
-
-func TestStartFailover_NoReplicas(t *testing.T) {
-	s := New(Config{ID: "s1", FailoverTime: 10 * time.Millisecond})
-	s.Monitor("mymaster", "127.0.0.1", 6379, 2)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	master := s.masters["mymaster"]
+	s.startFailover(master, false)
 
-	master := &MasterInfo{
-		Name:          "mymaster",
-		FailoverState: "",
-		Replicas:      []*ReplicaInfo{},
+	if s.currentEpoch != 1 || master.failoverEpoch != 1 {
+		t.Errorf("expected epoch 1, got current %d failover %d", s.currentEpoch, master.failoverEpoch)
 	}
-
-	s.startFailover("mymaster", master)
-
-	// After completion, FailoverState should be reset to ""
-	s.mu.RLock()
-	state := master.FailoverState
-	s.mu.RUnlock()
-	if state != "" {
-		t.Errorf("expected empty FailoverState, got %s", state)
+	if master.FailoverState != failoverWaitStart {
+		t.Errorf("expected state %s, got %s", failoverWaitStart, master.FailoverState)
+	}
+	if master.Leader != "s1" || master.LeaderEpoch != 1 {
+		t.Errorf("expected vote for s1 in epoch 1, got %s in %d", master.Leader, master.LeaderEpoch)
 	}
 }
 
-func TestStartFailover_WithBestReplica(t *testing.T) {
+func TestStartFailover_AbortsWhenNotElected(t *testing.T) {
 	s := New(Config{ID: "s1", FailoverTime: 10 * time.Millisecond})
 	s.Monitor("mymaster", "127.0.0.1", 6379, 2)
 
-	master := &MasterInfo{
-		Name:          "mymaster",
-		Addr:          "127.0.0.1",
-		Port:          6379,
-		FailoverState: "",
-		Replicas: []*ReplicaInfo{
-			{Addr: "10.0.0.1", Port: 6380, Offset: 100},
-			{Addr: "10.0.0.2", Port: 6381, Offset: 200},
-			{Addr: "10.0.0.3", Port: 6382, Offset: 150},
-		},
-		Epoch: 0,
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	master := s.masters["mymaster"]
+	s.sentinels["mymaster"] = []*SentinelPeer{
+		{ID: "s2", RunID: "s2", Leader: "s2", LeaderEpoch: 1},
+		{ID: "s3", RunID: "s3"},
 	}
+	s.startFailover(master, false)
 
-	s.startFailover("mymaster", master)
-
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-
-	// Best replica is the one with highest offset (200 at 10.0.0.2:6381)
-	if master.Addr != "10.0.0.2" {
-		t.Errorf("expected new master addr 10.0.0.2, got %s", master.Addr)
+	// One vote out of the two needed
+	s.failoverStep(master, time.Now())
+	if master.FailoverState != failoverWaitStart {
+		t.Fatalf("expected to wait for votes, got state %q", master.FailoverState)
 	}
-	if master.Port != 6381 {
-		t.Errorf("expected new master port 6381, got %d", master.Port)
-	}
-	if master.State != MasterStateOK {
-		t.Errorf("expected MasterStateOK, got %d", master.State)
-	}
-	if master.FailoverState != "" {
-		t.Errorf("expected empty FailoverState, got %s", master.FailoverState)
-	}
-	if master.Epoch != 1 {
-		t.Errorf("expected epoch 1, got %d", master.Epoch)
+	s.failoverStep(master, time.Now().Add(20*time.Millisecond))
+	if master.FailoverState != failoverNone {
+		t.Errorf("expected failover aborted, got state %q", master.FailoverState)
 	}
 }
 
-func TestStartFailover_WithCallback(t *testing.T) {
-	s := New(Config{ID: "s1", FailoverTime: 10 * time.Millisecond})
-
-	var callbackMaster string
-	var callbackAddr string
-	var callbackPort int
-	var mu sync.Mutex
-
-	s.OnFailover(func(master, newAddr string, newPort int) {
-		mu.Lock()
-		defer mu.Unlock()
-		callbackMaster = master
-		callbackAddr = newAddr
-		callbackPort = newPort
-	})
-
-	master := &MasterInfo{
-		Name:          "mymaster",
-		FailoverState: "",
-		Replicas: []*ReplicaInfo{
-			{Addr: "10.0.0.1", Port: 6380, Offset: 500},
-		},
-		Epoch: 0,
-	}
-
-	s.startFailover("mymaster", master)
+func TestStartFailover_NoGoodReplica(t *testing.T) {
+	s := New(Config{ID: "s1"})
+	s.Monitor("mymaster", "127.0.0.1", 6379, 2)
 
-	mu.Lock()
-	defer mu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	master := s.masters["mymaster"]
+	// Replicas never heard from can't be promoted
+	master.Replicas = []*ReplicaInfo{{Addr: "10.0.0.1", Port: 6380, Offset: 100}}
+	s.startFailover(master, true)
+	s.failoverStep(master, time.Now())
 
-	if callbackMaster != "mymaster" {
-		t.Errorf("expected callback master 'mymaster', got '%s'", callbackMaster)
-	}
-	if callbackAddr != "10.0.0.1" {
-		t.Errorf("expected callback addr '10.0.0.1', got '%s'", callbackAddr)
-	}
-	if callbackPort != 6380 {
-		t.Errorf("expected callback port 6380, got %d", callbackPort)
+	if master.FailoverState != failoverNone || master.Addr != "127.0.0.1" {
+		t.Errorf("expected failover aborted, got state %q and master %s", master.FailoverState, master.Addr)
 	}
 }
 
-func TestStartFailover_StopDuringWait(t *testing.T) {
-	s := New(Config{ID: "s1", FailoverTime: 5 * time.Second})
+func TestSelectReplica_Preference(t *testing.T) {
+	s := New(Config{ID: "s1"})
+	s.Monitor("mymaster", "127.0.0.1", 6379, 2)
 
-	master := &MasterInfo{
-		Name:          "mymaster",
-		FailoverState: "",
-		Replicas: []*ReplicaInfo{
-			{Addr: "10.0.0.1", Port: 6380, Offset: 100},
-		},
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	master := s.masters["mymaster"]
+	now := time.Now()
+	replica := func(port, priority int, offset int64, role string) *ReplicaInfo {
+		n := newNode("10.0.0.1", port, "")
+		n.lastInfo = now
+		return &ReplicaInfo{Addr: "10.0.0.1", Port: port, Priority: priority, Offset: offset, Role: role, node: n}
 	}
-
-	done := make(chan struct{})
-	go func() {
-		s.startFailover("mymaster", master)
-		close(done)
-	}()
-
-	// Close stopCh to interrupt the failover wait
-	time.Sleep(20 * time.Millisecond)
-	close(s.stopCh)
-
-	select {
-	case <-done:
-		// Good - startFailover returned
-	case <-time.After(2 * time.Second):
-		t.Error("startFailover did not return after stopCh closed")
+	master.Replicas = []*ReplicaInfo{
+		replica(6380, 100, 100, "slave"),
+		replica(6381, 100, 200, "slave"),
+		replica(6382, 0, 900, "slave"),
+		replica(6383, 100, 900, "master"),
 	}
-}
-
-func TestStartFailover_SingleReplica(t *testing.T) {
-	s := New(Config{ID: "s1", FailoverTime: 10 * time.Millisecond})
-
-	master := &MasterInfo{
-		Name:          "mymaster",
-		Addr:          "127.0.0.1",
-		Port:          6379,
-		FailoverState: "",
-		Replicas: []*ReplicaInfo{
-			{Addr: "10.0.0.1", Port: 6380, Offset: 0},
-		},
+	if best := s.selectReplica(master, now); best == nil || best.Port != 6381 {
+		t.Errorf("expected the largest offset to win, got %+v", best)
 	}
 
-	s.startFailover("mymaster", master)
-
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-
-	if master.Addr != "10.0.0.1" {
-		t.Errorf("expected failover to 10.0.0.1, got %s", master.Addr)
-	}
-	if master.Flags[0] != "master" {
-		t.Errorf("expected 'master' flag, got %v", master.Flags)
+	master.Replicas = append(master.Replicas, replica(6384, 50, 0, "slave"))
+	if best := s.selectReplica(master, now); best == nil || best.Port != 6384 {
+		t.Errorf("expected the lowest priority to win, got %+v", best)
 	}
 }
 
-// --- Tests for gossipSentinels ---
-
-func TestGossipSentinels_NoPeers(t *testing.T) {
-	s := New(Config{ID: "s1"})
-	s.Monitor("mymaster", "127.0.0.1", 6379, 2)
-
-	// gossipSentinels is a no-op, but we call it directly to ensure coverage
-	s.gossipSentinels()
-}
-
 // --- Tests for Serve ---
 
 func TestServe_ListenError(t *testing.T) {
@@ -379,8 +290,8 @@ func TestServe_WithClientConnection(t *testing.T) {
 		t.Fatalf("read error: %v", err)
 	}
 	response = string(buf[:n])
-	if !strings.Contains(response, "+OK") {
-		t.Errorf("expected +OK in response, got: %s", response)
+	if !strings.Contains(response, "# Sentinel") {
+		t.Errorf("expected sentinel info in response, got: %s", response)
 	}
 
 	// Send UNKNOWN command
@@ -495,17 +406,17 @@ func TestHandleCommand_AllBranches(t *testing.T) {
 	}{
 		{"PING", "PING", "+PONG"},
 		{"ping lowercase", "ping", "+PONG"},
-		{"INFO", "INFO", "+OK"},
-		{"info lowercase", "info", "+OK"},
-		{"empty", "", "-ERR empty command"},
+		{"INFO", "INFO", "sentinel_masters:1"},
+		{"info lowercase", "info", "master0:name=mymaster,status=ok"},
+		{"ROLE", "ROLE", "sentinel"},
 		{"SENTINEL no args", "SENTINEL", "-ERR wrong number of arguments"},
-		{"SENTINEL MASTERS", "SENTINEL MASTERS", "name:mymaster"},
+		{"SENTINEL MASTERS", "SENTINEL MASTERS", "mymaster"},
 		{"unknown", "RANDOMCMD", "-ERR unknown command"},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result := s.handleCommand(tt.cmd)
+			result := wire(s.handleCommand(nil, strings.Fields(tt.cmd)))
 			if !strings.Contains(result, tt.expect) {
 				t.Errorf("handleCommand(%q) = %q, expected to contain %q", tt.cmd, result, tt.expect)
 			}
@@ -528,10 +439,20 @@ func TestHandleSentinel_AllSubcommands(t *testing.T) {
 		expect string
 	}{
 		{"empty parts", []string{}, "-ERR wrong number of arguments"},
-		{"MASTERS", []string{"MASTERS"}, "name:mymaster"},
-		{"MASTER with name", []string{"MASTER", "mymaster"}, "*28"},
+		{"MASTERS", []string{"MASTERS"}, "mymaster"},
+		{"MASTER with name", []string{"MASTER", "mymaster"}, "*24"},
 		{"MASTER missing name", []string{"MASTER"}, "-ERR wrong number of arguments"},
-		{"MASTER nonexistent", []string{"MASTER", "missing"}, "-ERR no such master"},
+		{"MASTER nonexistent", []string{"MASTER", "missing"}, "-ERR No such master"},
+		{"REPLICAS none", []string{"REPLICAS", "mymaster"}, "*0"},
+		{"SENTINELS none", []string{"SENTINELS", "mymaster"}, "*0"},
+		{"GET-MASTER-ADDR-BY-NAME", []string{"GET-MASTER-ADDR-BY-NAME", "mymaster"}, "$4\r\n6379"},
+		{"GET-MASTER-ADDR-BY-NAME nonexistent", []string{"GET-MASTER-ADDR-BY-NAME", "missing"}, "*-1"},
+		{"CKQUORUM", []string{"CKQUORUM", "mymaster"}, "-NOQUORUM 1 usable Sentinels"},
+		{"IS-MASTER-DOWN-BY-ADDR", []string{"IS-MASTER-DOWN-BY-ADDR", "127.0.0.1", "6379", "0", "*"}, ":0"},
+		{"SET bad option", []string{"SET", "mymaster", "color", "blue"}, "-ERR Invalid argument"},
+		{"SET quorum", []string{"SET", "mymaster", "quorum", "1"}, "+OK"},
+		{"MYID", []string{"MYID"}, "s1"},
+		{"FAILOVER without replicas", []string{"FAILOVER", "mymaster"}, "-NOGOODSLAVE"},
 		{"GETMASTER with name", []string{"GETMASTER", "mymaster"}, "*2"},
 		{"GETMASTER missing name", []string{"GETMASTER"}, "-ERR wrong number of arguments"},
 		{"GETMASTER nonexistent", []string{"GETMASTER", "missing"}, "-ERR"},
@@ -542,7 +463,7 @@ func TestHandleSentinel_AllSubcommands(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result := s.handleSentinel(tt.parts)
+			result := wire(s.handleSentinel(tt.parts))
 			if !strings.Contains(result, tt.expect) {
 				t.Errorf("handleSentinel(%v) = %q, expected to contain %q", tt.parts, result, tt.expect)
 			}
@@ -550,69 +471,35 @@ func TestHandleSentinel_AllSubcommands(t *testing.T) {
 	}
 }
 
-// --- Tests for formatMasters ---
+// --- Tests for SENTINEL MASTERS ---
 
-func TestFormatMasters_Empty(t *testing.T) {
-	s := New(Config{ID: "s1"})
-
-	result := s.formatMasters()
-	if result != "" {
-		t.Errorf("expected empty string for no masters, got: %q", result)
-	}
-}
-
-func TestFormatMasters_Multiple(t *testing.T) {
+func TestSentinelMasters_Multiple(t *testing.T) {
 	s := New(Config{ID: "s1"})
 	s.Monitor("master1", "10.0.0.1", 6379, 2)
 	s.Monitor("master2", "10.0.0.2", 6380, 3)
 
 	s.mu.Lock()
-	s.masters["master1"].Flags = []string{"master"}
-	s.masters["master1"].NumReplicas = 2
+	s.masters["master1"].Replicas = []*ReplicaInfo{{Addr: "10.0.0.3", Port: 6379}, {Addr: "10.0.0.4", Port: 6379}}
 	s.masters["master2"].Flags = []string{"master", "s_down"}
-	s.masters["master2"].NumReplicas = 1
 	s.mu.Unlock()
 
-	result := s.formatMasters()
-	if !strings.Contains(result, "name:master1") {
-		t.Error("expected master1 in output")
-	}
-	if !strings.Contains(result, "name:master2") {
-		t.Error("expected master2 in output")
+	v := s.handleSentinel([]string{"MASTERS"})
+	if len(v.Array) != 2 {
+		t.Fatalf("expected 2 masters, got %d", len(v.Array))
 	}
-	if !strings.Contains(result, "num-replicas:2") {
-		t.Error("expected num-replicas:2 in output")
-	}
-}
-
-// --- Tests for formatMaster ---
-
-func TestFormatMaster_Existing(t *testing.T) {
-	s := New(Config{ID: "s1"})
-	s.Monitor("mymaster", "10.0.0.1", 6379, 2)
-
-	s.mu.Lock()
-	s.masters["mymaster"].Flags = []string{"master"}
-	s.mu.Unlock()
-
-	result := s.formatMaster("mymaster")
-	if !strings.Contains(result, "*28") {
-		t.Errorf("expected *28 prefix, got: %s", result)
+	fields := func(v *resp.Value) map[string]string {
+		m := make(map[string]string)
+		for i := 0; i+1 < len(v.Array); i += 2 {
+			m[string(v.Array[i].Bulk)] = string(v.Array[i+1].Bulk)
+		}
+		return m
 	}
-	if !strings.Contains(result, "mymaster") {
-		t.Errorf("expected mymaster in output, got: %s", result)
+	m1, m2 := fields(v.Array[0]), fields(v.Array[1])
+	if m1["name"] != "master1" || m1["num-slaves"] != "2" || m1["flags"] != "master" {
+		t.Errorf("unexpected master1 fields: %v", m1)
 	}
-	if !strings.Contains(result, "10.0.0.1") {
-		t.Errorf("expected 10.0.0.1 in output, got: %s", result)
-	}
-}
-
-func TestFormatMaster_Nonexistent(t *testing.T) {
-	s := New(Config{ID: "s1"})
-
-	result := s.formatMaster("missing")
-	if result != "-ERR no such master" {
-		t.Errorf("expected '-ERR no such master', got: %s", result)
+	if m2["name"] != "master2" || m2["flags"] != "master,s_down" || m2["quorum"] != "3" {
+		t.Errorf("unexpected master2 fields: %v", m2)
 	}
 }
 
@@ -652,8 +539,10 @@ func TestFailover_Success(t *testing.T) {
 	s.Monitor("mymaster", "127.0.0.1", 6379, 2)
 
 	s.mu.Lock()
+	n := newNode("10.0.0.1", 6380, "")
+	n.lastInfo = time.Now()
 	s.masters["mymaster"].Replicas = []*ReplicaInfo{
-		{Addr: "10.0.0.1", Port: 6380, Offset: 100},
+		{Addr: "10.0.0.1", Port: 6380, Offset: 100, Role: "slave", Priority: 100, node: n},
 	}
 	s.mu.Unlock()
 
@@ -662,8 +551,10 @@ func TestFailover_Success(t *testing.T) {
 		t.Fatalf("unexpected error: %v", err)
 	}
 
-	// Wait for async failover to complete
-	time.Sleep(50 * time.Millisecond)
+	master, _ := s.GetMaster("mymaster")
+	if master.FailoverState != failoverWaitStart {
+		t.Errorf("expected failover started, got state %q", master.FailoverState)
+	}
 }
 
 // --- Tests for Reset ---
@@ -876,165 +767,60 @@ func TestMatchPattern_Comprehensive(t *testing.T) {
 }
 
 // --- Tests for checkMasters ---
-// NOTE: checkMasters has a re-entrant lock issue when calling checkODown
-// for unreachable masters (checkMasters holds mu.Lock, checkODown tries
-// mu.RLock). We can only safely test the reachable-master path directly.
 
 func TestCheckMasters_ReachableMaster(t *testing.T) {
-	// Start a real listener so the master is reachable
-	ln, err := net.Listen("tcp", "127.0.0.1:0")
-	if err != nil {
-		t.Fatalf("failed to listen: %v", err)
-	}
-	defer ln.Close()
-
-	port := ln.Addr().(*net.TCPAddr).Port
-
-	// Accept connections in background
-	go func() {
-		for {
-			conn, err := ln.Accept()
-			if err != nil {
-				return
-			}
-			conn.Close()
-		}
-	}()
+	fn := &fakeNet{}
+	node := fn.add(t, nil, 0)
+	replica := fn.add(t, node, 0)
 
 	s := New(Config{ID: "s1", DownAfter: 10 * time.Second})
 
 	s.mu.Lock()
 	s.masters["mymaster"] = &MasterInfo{
 		Name:     "mymaster",
-		Addr:     "127.0.0.1",
-		Port:     port,
-		State:    MasterStateSDown, // was down, now reachable
+		Addr:     node.host,
+		Port:     node.port,
+		State:    MasterStateNone,
 		Replicas: []*ReplicaInfo{},
 	}
 	s.mu.Unlock()
 
-	s.checkMasters()
-
-	s.mu.RLock()
-	master := s.masters["mymaster"]
-	s.mu.RUnlock()
+	waitFor(t, 5*time.Second, "the replica to be discovered", func() bool {
+		s.checkMasters()
+		master, _ := s.GetMaster("mymaster")
+		return len(master.Replicas) == 1
+	})
 
+	master, _ := s.GetMaster("mymaster")
 	if master.State != MasterStateOK {
 		t.Errorf("expected MasterStateOK, got %d", master.State)
 	}
-	if master.LastOkPing.IsZero() {
-		t.Error("expected LastOkPing to be set")
+	if master.Replicas[0].Port != replica.port {
+		t.Errorf("expected replica port %d, got %d", replica.port, master.Replicas[0].Port)
 	}
 	if len(master.Flags) != 1 || master.Flags[0] != "master" {
 		t.Errorf("expected flags [master], got %v", master.Flags)
 	}
-}
-
-func TestCheckMasters_Empty(t *testing.T) {
-	s := New(Config{ID: "s1"})
-	// No masters registered - should not panic
-	s.checkMasters()
-}
-
-func TestCheckMasters_MultipleMasters_AllReachable(t *testing.T) {
-	ln1, err := net.Listen("tcp", "127.0.0.1:0")
-	if err != nil {
-		t.Fatalf("failed to listen: %v", err)
-	}
-	defer ln1.Close()
-	ln2, err := net.Listen("tcp", "127.0.0.1:0")
-	if err != nil {
-		t.Fatalf("failed to listen: %v", err)
-	}
-	defer ln2.Close()
-
-	go func() {
-		for {
-			conn, err := ln1.Accept()
-			if err != nil {
-				return
-			}
-			conn.Close()
-		}
-	}()
-	go func() {
-		for {
-			conn, err := ln2.Accept()
-			if err != nil {
-				return
-			}
-			conn.Close()
-		}
-	}()
-
-	s := New(Config{ID: "s1", DownAfter: 10 * time.Second})
-
-	port1 := ln1.Addr().(*net.TCPAddr).Port
-	port2 := ln2.Addr().(*net.TCPAddr).Port
-
-	s.mu.Lock()
-	s.masters["m1"] = &MasterInfo{
-		Name:     "m1",
-		Addr:     "127.0.0.1",
-		Port:     port1,
-		State:    MasterStateNone,
-		Replicas: []*ReplicaInfo{},
-	}
-	s.masters["m2"] = &MasterInfo{
-		Name:     "m2",
-		Addr:     "127.0.0.1",
-		Port:     port2,
-		State:    MasterStateNone,
-		Replicas: []*ReplicaInfo{},
-	}
-	s.mu.Unlock()
-
-	s.checkMasters()
-
-	s.mu.RLock()
-	m1 := s.masters["m1"]
-	m2 := s.masters["m2"]
-	s.mu.RUnlock()
-
-	if m1.State != MasterStateOK {
-		t.Errorf("expected m1 MasterStateOK, got %d", m1.State)
-	}
-	if m2.State != MasterStateOK {
-		t.Errorf("expected m2 MasterStateOK, got %d", m2.State)
+	if master.DownAfter != 10*time.Second {
+		t.Errorf("expected the sentinel's down-after, got %v", master.DownAfter)
 	}
 }
 
-// --- Tests for isReachable ---
-
-func TestIsReachable_Reachable(t *testing.T) {
-	ln, err := net.Listen("tcp", "127.0.0.1:0")
-	if err != nil {
-		t.Fatalf("failed to listen: %v", err)
-	}
-	defer ln.Close()
-
-	port := ln.Addr().(*net.TCPAddr).Port
-	go func() {
-		for {
-			conn, err := ln.Accept()
-			if err != nil {
-				return
-			}
-			conn.Close()
-		}
-	}()
+func TestCheckMasters_UnreachableMaster(t *testing.T) {
+	s := New(Config{ID: "s1", DownAfter: 50 * time.Millisecond})
+	s.Monitor("mymaster", "127.0.0.1", freePort(t), 2)
 
-	s := New(Config{ID: "s1"})
-	if !s.isReachable("127.0.0.1", port) {
-		t.Error("expected reachable for active listener")
-	}
+	waitFor(t, 5*time.Second, "the master to be subjectively down", func() bool {
+		s.checkMasters()
+		master, _ := s.GetMaster("mymaster")
+		return master.State == MasterStateSDown
+	})
 }
 
-func TestIsReachable_Unreachable(t *testing.T) {
+func TestCheckMasters_Empty(t *testing.T) {
 	s := New(Config{ID: "s1"})
-	if s.isReachable("127.0.0.1", 59999) {
-		t.Error("expected unreachable for non-listening port")
-	}
+	// No masters registered - should not panic
+	s.checkMasters()
 }
 
 // --- Test Serve full flow with Accept and context cancellation ---
@@ -1065,10 +851,9 @@ func TestServe_FullFlow(t *testing.T) {
 	}
 }
 
-// --- Test for monitorLoop and gossipLoop via Start/Stop ---
-// Only test with no masters to avoid the checkODown deadlock.
+// --- Test for monitorLoop via Start/Stop ---
 
-func TestMonitorAndGossipLoops_NoMasters(t *testing.T) {
+func TestMonitorLoop_NoMasters(t *testing.T) {
 	s := New(Config{ID: "s1", DownAfter: 50 * time.Millisecond})
 	// No masters - checkMasters will iterate nothing
 
@@ -1077,110 +862,8 @@ func TestMonitorAndGossipLoops_NoMasters(t *testing.T) {
 		t.Fatalf("unexpected error: %v", err)
 	}
 
-	// Let the loops run for a couple ticks
+	// Let the loop run for a couple ticks
 	time.Sleep(150 * time.Millisecond)
 
 	s.Stop()
 }
-
-func TestMonitorAndGossipLoops_ReachableMaster(t *testing.T) {
-	// Use a reachable master so checkMasters doesn't hit the deadlock path
-	ln, err := net.Listen("tcp", "127.0.0.1:0")
-	if err != nil {
-		t.Fatalf("failed to listen: %v", err)
-	}
-	defer ln.Close()
-
-	go func() {
-		for {
-			conn, err := ln.Accept()
-			if err != nil {
-				return
-			}
-			conn.Close()
-		}
-	}()
-
-	port := ln.Addr().(*net.TCPAddr).Port
-
-	s := New(Config{ID: "s1", DownAfter: 50 * time.Millisecond})
-	s.Monitor("mymaster", "127.0.0.1", port, 2)
-
-	err = s.Start()
-	if err != nil {
-		t.Fatalf("unexpected error: %v", err)
-	}
-
-	// Let the loops tick a couple of times
-	time.Sleep(2500 * time.Millisecond)
-
-	s.Stop()
-
-	master, ok := s.GetMaster("mymaster")
-	if !ok {
-		t.Fatal("expected master")
-	}
-	if master.State != MasterStateOK {
-		t.Errorf("expected MasterStateOK after monitoring, got %d", master.State)
-	}
-}
-
-// --- Test for startFailover with zero failoverTime ---
-
-func TestStartFailover_ZeroFailoverTime(t *testing.T) {
-	s := New(Config{ID: "s1"})
-	// Explicitly set failoverTime to 0 to test the default
-	s.failoverTime = 0
-
-	master := &MasterInfo{
-		Name:          "mymaster",
-		FailoverState: "",
-		Replicas: []*ReplicaInfo{
-			{Addr: "10.0.0.1", Port: 6380, Offset: 100},
-		},
-	}
-
-	done := make(chan struct{})
-	go func() {
-		s.startFailover("mymaster", master)
-		close(done)
-	}()
-
-	// Since failoverTime is 0, the function uses 5s default.
-	// Close stopCh to break out of the wait.
-	time.Sleep(20 * time.Millisecond)
-	close(s.stopCh)
-
-	select {
-	case <-done:
-		// Success
-	case <-time.After(2 * time.Second):
-		t.Error("startFailover did not return")
-	}
-}
-
-// --- Test for startFailover with nil onFailover ---
-
-func TestStartFailover_NilCallback(t *testing.T) {
-	s := New(Config{ID: "s1", FailoverTime: 10 * time.Millisecond})
-	// onFailover is nil by default
-
-	master := &MasterInfo{
-		Name:          "mymaster",
-		FailoverState: "",
-		Replicas: []*ReplicaInfo{
-			{Addr: "10.0.0.1", Port: 6380, Offset: 100},
-		},
-		Epoch: 0,
-	}
-
-	// Should complete without panic even with nil callback
-	s.startFailover("mymaster", master)
-
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-
-	if master.Addr != "10.0.0.1" {
-		t.Errorf("expected addr 10.0.0.1, got %s", master.Addr)
-	}
-}
@@ -1,10 +1,13 @@
 package sentinel
 
 import (
+	"bytes"
 	"context"
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/cachestorm/cachestorm/internal/resp"
 )
 
 func TestNewSentinel(t *testing.T) {
@@ -322,14 +325,14 @@ func TestHandleCommand(t *testing.T) {
 		expect string
 	}{
 		{"PING", "+PONG"},
-		{"", "-ERR empty command"},
 		{"UNKNOWN", "-ERR unknown command 'UNKNOWN'"},
 		{"SENTINEL", "-ERR wrong number of arguments"},
-		{"INFO", "+OK"},
+		{"INFO", "$"},
+		{"SUBSCRIBE +switch-master", "-ERR"},
 	}
 
 	for _, tt := range tests {
-		result := s.handleCommand(tt.cmd)
+		result := wire(s.handleCommand(nil, strings.Fields(tt.cmd)))
 		if !strings.HasPrefix(result, tt.expect) {
 			t.Errorf("handleCommand(%s) = %s, expected prefix %s", tt.cmd, result, tt.expect)
 		}
@@ -346,10 +349,15 @@ func TestHandleSentinel(t *testing.T) {
 		expect string
 	}{
 		{[]string{}, "-ERR wrong number of arguments"},
-		{[]string{"MASTERS"}, "name:mymaster"},
+		{[]string{"MASTERS"}, "mymaster"},
 		{[]string{"MASTER"}, "-ERR wrong number of arguments"},
-		{[]string{"MASTER", "mymaster"}, "*28"},
-		{[]string{"MASTER", "nonexistent"}, "-ERR no such master"},
+		{[]string{"MASTER", "mymaster"}, "*24"},
+		{[]string{"MASTER", "nonexistent"}, "-ERR No such master"},
+		{[]string{"MONITOR", "other", "127.0.0.1", "6380"}, "-ERR wrong number of arguments"},
+		{[]string{"MONITOR", "other", "127.0.0.1", "0", "2"}, "-ERR Invalid port"},
+		{[]string{"MONITOR", "other", "127.0.0.1", "6380", "2"}, "+OK"},
+		{[]string{"MONITOR", "other", "127.0.0.1", "6380", "2"}, "-ERR"},
+		{[]string{"REMOVE", "other"}, "+OK"},
 		{[]string{"GETMASTER"}, "-ERR wrong number of arguments"},
 		{[]string{"GETMASTER", "mymaster"}, "*2"},
 		{[]string{"GETMASTER", "nonexistent"}, "-ERR"},
@@ -359,40 +367,41 @@ func TestHandleSentinel(t *testing.T) {
 	}
 
 	for _, tt := range tests {
-		result := s.handleSentinel(tt.parts)
+		result := wire(s.handleSentinel(tt.parts))
 		if !strings.Contains(result, tt.expect) {
 			t.Errorf("handleSentinel(%v) = %s, expected to contain %s", tt.parts, result, tt.expect)
 		}
 	}
 }
 
-func TestFormatMasters(t *testing.T) {
-	cfg := Config{ID: "sentinel-1"}
-	s := New(cfg)
-	s.Monitor("mymaster", "127.0.0.1", 6379, 2)
-
-	result := s.formatMasters()
-	if !strings.Contains(result, "name:mymaster") {
-		t.Errorf("expected 'name:mymaster' in result, got %s", result)
+func TestSentinelEvents(t *testing.T) {
+	s := New(Config{ID: "sentinel-1"})
+	sub := &subscriber{
+		channels: map[string]bool{"+monitor": true},
+		patterns: map[string]bool{"*": true},
+		out:      make(chan []string, 8),
 	}
-}
+	s.subs[sub] = struct{}{}
 
-func TestFormatMaster(t *testing.T) {
-	cfg := Config{ID: "sentinel-1"}
-	s := New(cfg)
 	s.Monitor("mymaster", "127.0.0.1", 6379, 2)
 
-	result := s.formatMaster("mymaster")
-	if !strings.Contains(result, "mymaster") {
-		t.Errorf("expected 'mymaster' in result, got %s", result)
+	msg := <-sub.out
+	if strings.Join(msg, " ") != "message +monitor master mymaster 127.0.0.1 6379 quorum 2" {
+		t.Errorf("unexpected message %q", msg)
 	}
-
-	result = s.formatMaster("nonexistent")
-	if !strings.Contains(result, "-ERR") {
-		t.Errorf("expected error for nonexistent master, got %s", result)
+	msg = <-sub.out
+	if msg[0] != "pmessage" || msg[1] != "*" || msg[2] != "+monitor" {
+		t.Errorf("unexpected pattern message %q", msg)
 	}
 }
 
+// wire returns v as sent to a client.
+func wire(v *resp.Value) string {
+	var buf bytes.Buffer
+	resp.NewWriter(&buf).WriteValue(v)
+	return buf.String()
+}
+
 func TestSentinelServeContextCancel(t *testing.T) {
 	cfg := Config{ID: "sentinel-1", Addr: "127.0.0.1"}
 	s := New(cfg)
@@ -406,38 +415,25 @@ func TestSentinelServeContextCancel(t *testing.T) {
 	}
 }
 
-func TestIsReachable(t *testing.T) {
-	cfg := Config{ID: "sentinel-1"}
-	s := New(cfg)
-
-	result := s.isReachable("127.0.0.1", 59999)
-	if result {
-		t.Error("expected unreachable for non-listening port")
-	}
-}
-
 func TestSentinelCheckMasters(t *testing.T) {
 	cfg := Config{ID: "sentinel-1", DownAfter: 100 * time.Millisecond}
 	s := New(cfg)
 	s.Monitor("mymaster", "127.0.0.1", 59998, 2)
 
-	s.mu.Lock()
-	for name, master := range s.masters {
-		if s.isReachable(master.Addr, master.Port) {
-			master.State = MasterStateOK
-		} else {
-			master.State = MasterStateSDown
-		}
-		_ = name
-	}
-	s.mu.Unlock()
-
+	s.checkMasters()
 	master, ok := s.GetMaster("mymaster")
 	if !ok {
 		t.Fatal("expected master")
 	}
-	if master.State != MasterStateSDown && master.State != MasterStateNone {
-		t.Logf("master state: %d", master.State)
+	if master.State != MasterStateOK {
+		t.Errorf("expected MasterStateOK before down-after passes, got %d", master.State)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	s.checkMasters()
+	master, _ = s.GetMaster("mymaster")
+	if master.State != MasterStateSDown {
+		t.Errorf("expected MasterStateSDown, got %d", master.State)
 	}
 }
 
@@ -473,58 +469,32 @@ func TestSentinelStartFailoverNoReplica(t *testing.T) {
 	cfg := Config{ID: "sentinel-1", DownAfter: 100 * time.Millisecond}
 	s := New(cfg)
 
-	s.Monitor("mymaster", "127.0.0.1", 59998, 2)
+	s.Monitor("mymaster", "127.0.0.1", 59998, 1)
 
 	s.mu.Lock()
+	defer s.mu.Unlock()
 	master := s.masters["mymaster"]
 	master.State = MasterStateODown
 	master.Replicas = []*ReplicaInfo{}
-	master.FailoverState = ""
-	s.mu.Unlock()
-
-	go s.startFailover("mymaster", &MasterInfo{
-		Name:          "mymaster",
-		Addr:          "127.0.0.1",
-		Port:          59998,
-		State:         MasterStateODown,
-		Replicas:      []*ReplicaInfo{},
-		FailoverState: "",
-	})
-
-	time.Sleep(100 * time.Millisecond)
-}
-
-func TestSentinelStartFailoverWithReplica(t *testing.T) {
-	cfg := Config{ID: "sentinel-1", DownAfter: 100 * time.Millisecond}
-	s := New(cfg)
-
-	_ = false
-	s.OnFailover(func(master, newAddr string, newPort int) {
-	})
 
-	s.Monitor("mymaster", "127.0.0.1", 59998, 2)
-
-	s.mu.Lock()
-	master := s.masters["mymaster"]
-	master.State = MasterStateODown
-	master.Replicas = []*ReplicaInfo{{Addr: "127.0.0.1", Port: 6380, Offset: 100}}
-	master.FailoverState = ""
-	master.Epoch = 0
-	s.mu.Unlock()
-
-	masterCopy := &MasterInfo{
-		Name:          "mymaster",
-		Addr:          "127.0.0.1",
-		Port:          59998,
-		State:         MasterStateODown,
-		Replicas:      []*ReplicaInfo{{Addr: "127.0.0.1", Port: 6380, Offset: 100}},
-		FailoverState: "",
-		Epoch:         0,
+	s.failoverStep(master, time.Now())
+	if master.FailoverState != failoverWaitStart {
+		t.Fatalf("expected failover started, got state %q", master.FailoverState)
+	}
+	// Elected by its own vote, then finds nothing to promote
+	s.failoverStep(master, time.Now())
+	if master.FailoverState != failoverNone {
+		t.Errorf("expected failover aborted without replicas, got state %q", master.FailoverState)
+	}
+	if s.currentEpoch != 1 {
+		t.Errorf("expected epoch 1 after the attempt, got %d", s.currentEpoch)
 	}
 
-	go s.startFailover("mymaster", masterCopy)
-
-	time.Sleep(200 * time.Millisecond)
+	// Not retried before twice the failover timeout
+	s.failoverStep(master, time.Now())
+	if s.currentEpoch != 1 {
+		t.Errorf("expected no new attempt, got epoch %d", s.currentEpoch)
+	}
 }
 
 func TestSentinelFailoverAlreadyInProgress(t *testing.T) {
@@ -542,7 +512,7 @@ func TestSentinelFailoverAlreadyInProgress(t *testing.T) {
 	}
 }
 
-func TestSentinelFailoverSuccess(t *testing.T) {
+func TestSentinelFailoverNoGoodReplica(t *testing.T) {
 	cfg := Config{ID: "sentinel-1"}
 	s := New(cfg)
 	s.Monitor("mymaster", "127.0.0.1", 6379, 2)
@@ -552,11 +522,9 @@ func TestSentinelFailoverSuccess(t *testing.T) {
 	s.mu.Unlock()
 
 	err := s.Failover("mymaster")
-	if err != nil {
-		t.Fatalf("unexpected error: %v", err)
+	if err == nil || !strings.Contains(err.Error(), "no suitable replica") {
+		t.Fatalf("expected no suitable replica error, got %v", err)
 	}
-
-	time.Sleep(100 * time.Millisecond)
 }
 
 func TestMasterStateConstants(t *testing.T) {
@@ -720,23 +688,6 @@ func TestSentinelResetContainsMatch(t *testing.T) {
 	}
 }
 
-func TestSentinelGossipSentinels(t *testing.T) {
-	cfg := Config{ID: "sentinel-1"}
-	s := New(cfg)
-
-	s.gossipSentinels()
-}
-
-func TestSentinelIsReachableWithTimeout(t *testing.T) {
-	cfg := Config{ID: "sentinel-1"}
-	s := New(cfg)
-
-	result := s.isReachable("192.0.2.1", 59999)
-	if result {
-		t.Error("expected unreachable for TEST-NET-1 address")
-	}
-}
-
 func TestSentinelHandleConnection(t *testing.T) {
 	cfg := Config{ID: "sentinel-1", Addr: "127.0.0.1", Port: 0}
 	s := New(cfg)
@@ -904,29 +855,3 @@ func TestSentinelCheckODownDirect(t *testing.T) {
 	// Result depends on quorum configuration
 	_ = result
 }
-
-func TestSentinelGossipSentinelsDirect(t *testing.T) {
-	cfg := Config{ID: "sentinel-1"}
-	s := New(cfg)
-	s.Monitor("mymaster", "127.0.0.1", 6379, 2)
-
-	// gossipSentinels sends messages to other sentinels
-	// We just verify it doesn't panic
-	done := make(chan struct{})
-	go func() {
-		s.gossipSentinels()
-		close(done)
-	}()
-
-	select {
-	case <-done:
-	case <-time.After(time.Second):
-		t.Error("gossipSentinels did not complete")
-	}
-}
-
-type SentinelGossipMessage struct {
-	Type       string `json:"type"`
-	SentinelID string `json:"sentinel_id"`
-	Timestamp  int64  `json:"timestamp"`
-}
@@ -0,0 +1,570 @@
+package sentinel
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cachestorm/cachestorm/internal/logger"
+	"github.com/cachestorm/cachestorm/internal/resp"
+)
+
+func (s *Sentinel) Serve(ctx context.Context, port int) error {
+	addr := net.JoinHostPort(s.addr, strconv.Itoa(port))
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	logger.Info().Str("addr", addr).Msg("Sentinel listening")
+
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+
+		go s.handleConnection(conn)
+	}
+}
+
+// client is a connection to the sentinel. Event messages are written from
+// their own goroutine, hence wmu.
+type client struct {
+	wmu sync.Mutex
+	w   *resp.Writer
+	sub *subscriber
+}
+
+func (c *client) write(v *resp.Value) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.w.WriteValue(v)
+}
+
+// subscriber holds the event channels and patterns a client subscribed to.
+// Its maps are guarded by Sentinel.mu.
+type subscriber struct {
+	channels map[string]bool
+	patterns map[string]bool
+	// out buffers the messages for the client; when it is full, as with a
+	// client that stopped reading, messages are dropped.
+	out  chan []string
+	done chan struct{}
+}
+
+func (s *Sentinel) handleConnection(conn net.Conn) {
+	defer conn.Close()
+
+	c := &client{w: resp.NewWriter(conn)}
+	defer s.unsubscribeAll(c)
+	r := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		if v := s.handleCommand(c, args); v != nil {
+			if err := c.write(v); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readCommand reads a command sent as a RESP array or, as from telnet, as
+// an inline line of words.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if b[0] != '*' {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		return strings.Fields(line), nil
+	}
+	cmd, rest, err := resp.NewReader(r).ReadCommand()
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, 0, len(rest)+1)
+	args = append(args, cmd)
+	for _, a := range rest {
+		args = append(args, string(a))
+	}
+	return args, nil
+}
+
+// handleCommand runs a command from c and returns its reply, nil if it
+// was written already.
+func (s *Sentinel) handleCommand(c *client, args []string) *resp.Value {
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return resp.PONG()
+	case "SENTINEL":
+		if len(args) < 2 {
+			return resp.ErrorValue("ERR wrong number of arguments for 'sentinel' command")
+		}
+		return s.handleSentinel(args[1:])
+	case "INFO":
+		return resp.BulkString(s.infoString())
+	case "ROLE":
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		names := make([]*resp.Value, 0, len(s.masters))
+		for _, name := range s.masterNames() {
+			names = append(names, resp.BulkString(name))
+		}
+		return resp.ArrayValue([]*resp.Value{resp.BulkString("sentinel"), resp.ArrayValue(names)})
+	case "SUBSCRIBE", "PSUBSCRIBE", "UNSUBSCRIBE", "PUNSUBSCRIBE":
+		if c == nil {
+			return resp.ErrorValue("ERR subscriptions need a connection")
+		}
+		if err := s.subscribeCommand(c, strings.ToLower(args[0]), args[1:]); err != nil {
+			return resp.ErrorValue("ERR " + err.Error())
+		}
+		return nil
+	default:
+		return resp.ErrorValue(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+	}
+}
+
+func (s *Sentinel) handleSentinel(parts []string) *resp.Value {
+	if len(parts) == 0 {
+		return resp.ErrorValue("ERR wrong number of arguments for 'sentinel' command")
+	}
+	sub := strings.ToUpper(parts[0])
+	arity := map[string]int{
+		"MASTER": 2, "REPLICAS": 2, "SLAVES": 2, "SENTINELS": 2, "GET-MASTER-ADDR-BY-NAME": 2,
+		"GETMASTER": 2, "REMOVE": 2, "RESET": 2, "FAILOVER": 2, "CKQUORUM": 2,
+		"MONITOR": 5, "IS-MASTER-DOWN-BY-ADDR": 5, "SET": 4,
+	}
+	if n, ok := arity[sub]; ok && len(parts) < n {
+		return resp.ErrorValue(fmt.Sprintf("ERR wrong number of arguments for 'sentinel|%s' command", strings.ToLower(sub)))
+	}
+
+	switch sub {
+	case "MASTERS":
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		result := make([]*resp.Value, 0, len(s.masters))
+		for _, name := range s.masterNames() {
+			result = append(result, s.masterFields(s.masters[name]))
+		}
+		return resp.ArrayValue(result)
+
+	case "MASTER", "REPLICAS", "SLAVES", "SENTINELS":
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		m, ok := s.masters[parts[1]]
+		if !ok {
+			return resp.ErrorValue("ERR No such master with that name")
+		}
+		var result []*resp.Value
+		switch sub {
+		case "MASTER":
+			return s.masterFields(m)
+		case "SENTINELS":
+			for _, p := range s.sentinels[m.Name] {
+				result = append(result, peerFields(p))
+			}
+		default:
+			for _, r := range m.Replicas {
+				result = append(result, replicaFields(r))
+			}
+		}
+		return resp.ArrayValue(result)
+
+	case "GET-MASTER-ADDR-BY-NAME":
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		m, ok := s.masters[parts[1]]
+		if !ok {
+			return resp.NullArray()
+		}
+		host, port := m.currentAddr()
+		return resp.ArrayValue([]*resp.Value{resp.BulkString(host), resp.BulkString(strconv.Itoa(port))})
+
+	case "GETMASTER":
+		addr, port, err := s.GetMasterAddr(parts[1])
+		if err != nil {
+			return resp.ErrorValue("ERR " + err.Error())
+		}
+		return resp.ArrayValue([]*resp.Value{resp.BulkString(addr), resp.IntegerValue(int64(port))})
+
+	case "MONITOR":
+		port, err1 := strconv.Atoi(parts[3])
+		quorum, err2 := strconv.Atoi(parts[4])
+		if err1 != nil || port <= 0 || port > 65535 {
+			return resp.ErrorValue("ERR Invalid port number")
+		}
+		if err2 != nil || quorum <= 0 {
+			return resp.ErrorValue("ERR Quorum must be 1 or greater.")
+		}
+		if err := s.Monitor(parts[1], parts[2], port, quorum); err != nil {
+			return resp.ErrorValue("ERR " + err.Error())
+		}
+		return resp.OK()
+
+	case "REMOVE":
+		if err := s.Remove(parts[1]); err != nil {
+			return resp.ErrorValue("ERR " + err.Error())
+		}
+		return resp.OK()
+
+	case "SET":
+		if len(parts)%2 != 0 {
+			return resp.ErrorValue("ERR wrong number of arguments for 'sentinel|set' command")
+		}
+		for i := 2; i < len(parts); i += 2 {
+			if err := s.Set(parts[1], parts[i], parts[i+1]); err != nil {
+				return resp.ErrorValue("ERR " + err.Error())
+			}
+		}
+		return resp.OK()
+
+	case "RESET":
+		return resp.IntegerValue(int64(s.Reset(parts[1])))
+
+	case "FAILOVER":
+		if err := s.Failover(parts[1]); err != nil {
+			if strings.Contains(err.Error(), "replica") {
+				return resp.ErrorValue("NOGOODSLAVE No suitable replica to promote")
+			}
+			if strings.Contains(err.Error(), "in progress") {
+				return resp.ErrorValue("INPROG Failover already in progress")
+			}
+			return resp.ErrorValue("ERR " + err.Error())
+		}
+		return resp.OK()
+
+	case "CKQUORUM":
+		usable, err := s.CKQUORUM(parts[1])
+		if err != nil {
+			return resp.ErrorValue("ERR " + err.Error())
+		}
+		s.mu.RLock()
+		m := s.masters[parts[1]]
+		quorum, voters := s.quorumOf(m), len(s.sentinels[m.Name])+1
+		s.mu.RUnlock()
+		switch {
+		case usable < quorum:
+			return resp.ErrorValue(fmt.Sprintf("NOQUORUM %d usable Sentinels. Not enough available Sentinels to reach the specified quorum for this master", usable))
+		case usable < voters/2+1:
+			return resp.ErrorValue(fmt.Sprintf("NOQUORUM %d usable Sentinels. Not enough available Sentinels to reach the majority and authorize a failover", usable))
+		}
+		return resp.SimpleString(fmt.Sprintf("OK %d usable Sentinels. Quorum and failover authorization can be reached", usable))
+
+	case "IS-MASTER-DOWN-BY-ADDR":
+		port, err1 := strconv.Atoi(parts[2])
+		epoch, err2 := strconv.ParseInt(parts[3], 10, 64)
+		if err1 != nil || err2 != nil {
+			return resp.ErrorValue("ERR value is not an integer or out of range")
+		}
+		down, leader, leaderEpoch := s.isMasterDownByAddr(parts[1], port, epoch, parts[4])
+		downFlag := int64(0)
+		if down {
+			downFlag = 1
+		}
+		return resp.ArrayValue([]*resp.Value{
+			resp.IntegerValue(downFlag), resp.BulkString(leader), resp.IntegerValue(leaderEpoch),
+		})
+
+	case "MYID":
+		return resp.BulkString(s.ID())
+
+	case "FLUSHCONFIG":
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if err := s.saveConfig(); err != nil {
+			return resp.ErrorValue("ERR " + err.Error())
+		}
+		return resp.OK()
+
+	default:
+		return resp.ErrorValue(fmt.Sprintf("ERR unknown subcommand '%s'", parts[0]))
+	}
+}
+
+// Set changes one of the settings of the master monitored as name, as
+// SENTINEL SET does.
+func (s *Sentinel) Set(name, option, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, ok := s.masters[name]
+	if !ok {
+		return fmt.Errorf("No such master with that name")
+	}
+	n, err := strconv.Atoi(value)
+	switch option = strings.ToLower(option); option {
+	case "down-after-milliseconds", "failover-timeout", "parallel-syncs", "quorum":
+		if err != nil || n <= 0 {
+			return fmt.Errorf("Invalid argument '%s' for SENTINEL SET '%s'", value, option)
+		}
+	}
+	switch option {
+	case "down-after-milliseconds":
+		m.DownAfter = time.Duration(n) * time.Millisecond
+	case "failover-timeout":
+		m.FailoverTimeout = time.Duration(n) * time.Millisecond
+	case "parallel-syncs":
+		m.ParallelSyncs = n
+	case "quorum":
+		m.Quorum = n
+	case "auth-pass":
+		m.AuthPass = value
+		// The links authenticate when they connect
+		s.closeNodes(m)
+	default:
+		return fmt.Errorf("Invalid argument '%s' for SENTINEL SET", option)
+	}
+	s.emit("+set", "master %s %s %d %s %s", m.Name, m.Addr, m.Port, option, value)
+	s.persist()
+	return nil
+}
+
+// currentAddr is the address of the master, which becomes the promoted
+// replica's once it took over during a failover.
+func (m *MasterInfo) currentAddr() (string, int) {
+	if m.promoted != nil && m.FailoverState == failoverReconfigure {
+		return m.promoted.Addr, m.promoted.Port
+	}
+	return m.Addr, m.Port
+}
+
+func (s *Sentinel) masterNames() []string {
+	names := make([]string, 0, len(s.masters))
+	for name := range s.masters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// fields returns the flattened name/value pairs SENTINEL MASTER and its
+// siblings reply with.
+func fields(kv ...string) *resp.Value {
+	items := make([]*resp.Value, len(kv))
+	for i, s := range kv {
+		items[i] = resp.BulkString(s)
+	}
+	return resp.ArrayValue(items)
+}
+
+func sinceMillis(t time.Time) string {
+	if t.IsZero() {
+		return "0"
+	}
+	return strconv.FormatInt(time.Since(t).Milliseconds(), 10)
+}
+
+func (s *Sentinel) masterFields(m *MasterInfo) *resp.Value {
+	flags := m.Flags
+	if len(flags) == 0 {
+		flags = []string{"master"}
+	}
+	if m.FailoverState != failoverNone {
+		flags = append(append([]string(nil), flags...), "failover_in_progress")
+	}
+	kv := []string{
+		"name", m.Name,
+		"ip", m.Addr,
+		"port", strconv.Itoa(m.Port),
+		"flags", strings.Join(flags, ","),
+		"last-ok-ping-reply", sinceMillis(m.LastOkPing),
+		"down-after-milliseconds", strconv.FormatInt(m.DownAfter.Milliseconds(), 10),
+		"num-slaves", strconv.Itoa(len(m.Replicas)),
+		"num-other-sentinels", strconv.Itoa(len(s.sentinels[m.Name])),
+		"quorum", strconv.Itoa(s.quorumOf(m)),
+		"failover-timeout", strconv.FormatInt(m.FailoverTimeout.Milliseconds(), 10),
+		"parallel-syncs", strconv.Itoa(m.ParallelSyncs),
+		"config-epoch", strconv.FormatInt(m.Epoch, 10),
+	}
+	if m.FailoverState != failoverNone {
+		kv = append(kv, "failover-state", m.FailoverState)
+	}
+	return fields(kv...)
+}
+
+func replicaFields(r *ReplicaInfo) *resp.Value {
+	flags := "slave"
+	if r.State == "s_down" {
+		flags += ",s_down"
+	}
+	link := "err"
+	if r.MasterLinkUp {
+		link = "ok"
+	}
+	return fields(
+		"name", net.JoinHostPort(r.Addr, strconv.Itoa(r.Port)),
+		"ip", r.Addr,
+		"port", strconv.Itoa(r.Port),
+		"flags", flags,
+		"role-reported", r.Role,
+		"master-link-status", link,
+		"master-host", r.MasterHost,
+		"master-port", strconv.Itoa(r.MasterPort),
+		"slave-priority", strconv.Itoa(r.Priority),
+		"slave-repl-offset", strconv.FormatInt(r.Offset, 10),
+	)
+}
+
+func peerFields(p *SentinelPeer) *resp.Value {
+	leader := p.Leader
+	if leader == "" {
+		leader = "?"
+	}
+	return fields(
+		"name", p.RunID,
+		"ip", p.Addr,
+		"port", strconv.Itoa(p.Port),
+		"runid", p.RunID,
+		"flags", "sentinel",
+		"last-hello-message", sinceMillis(p.LastSeen),
+		"voted-leader", leader,
+		"voted-leader-epoch", strconv.FormatInt(p.LeaderEpoch, 10),
+	)
+}
+
+func (s *Sentinel) infoString() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var sb strings.Builder
+	sb.WriteString("# Server\r\n")
+	sb.WriteString(fmt.Sprintf("run_id:%s\r\n", s.id))
+	sb.WriteString(fmt.Sprintf("tcp_port:%d\r\n", s.port))
+	sb.WriteString("\r\n# Sentinel\r\n")
+	sb.WriteString(fmt.Sprintf("sentinel_masters:%d\r\n", len(s.masters)))
+	sb.WriteString("sentinel_tilt:0\r\n")
+	sb.WriteString(fmt.Sprintf("sentinel_current_epoch:%d\r\n", s.currentEpoch))
+	for i, name := range s.masterNames() {
+		m := s.masters[name]
+		status := "ok"
+		switch m.State {
+		case MasterStateSDown:
+			status = "sdown"
+		case MasterStateODown:
+			status = "odown"
+		}
+		sb.WriteString(fmt.Sprintf("master%d:name=%s,status=%s,address=%s,slaves=%d,sentinels=%d\r\n",
+			i, name, status, net.JoinHostPort(m.Addr, strconv.Itoa(m.Port)), len(m.Replicas), len(s.sentinels[name])+1))
+	}
+	return sb.String()
+}
+
+// subscribeCommand runs SUBSCRIBE, PSUBSCRIBE or their opposites for c,
+// writing a reply per channel.
+func (s *Sentinel) subscribeCommand(c *client, cmd string, names []string) error {
+	s.mu.Lock()
+	if c.sub == nil {
+		c.sub = &subscriber{
+			channels: make(map[string]bool),
+			patterns: make(map[string]bool),
+			out:      make(chan []string, 1024),
+			done:     make(chan struct{}),
+		}
+		s.subs[c.sub] = struct{}{}
+		go s.deliver(c)
+	}
+	sub := c.sub
+	set := sub.channels
+	if strings.HasPrefix(cmd, "p") {
+		set = sub.patterns
+	}
+	subscribing := !strings.Contains(cmd, "unsubscribe")
+	if !subscribing && len(names) == 0 {
+		for name := range set {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	replies := make([]*resp.Value, 0, len(names))
+	for _, name := range names {
+		if subscribing {
+			set[name] = true
+		} else {
+			delete(set, name)
+		}
+		replies = append(replies, resp.ArrayValue([]*resp.Value{
+			resp.BulkString(cmd), resp.BulkString(name), resp.IntegerValue(int64(len(sub.channels) + len(sub.patterns))),
+		}))
+	}
+	s.mu.Unlock()
+
+	if len(names) == 0 {
+		return fmt.Errorf("wrong number of arguments for '%s' command", cmd)
+	}
+	for _, v := range replies {
+		if err := c.write(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deliver writes the event messages for c until the connection ends.
+func (s *Sentinel) deliver(c *client) {
+	for {
+		select {
+		case msg := <-c.sub.out:
+			items := make([]*resp.Value, len(msg))
+			for i, part := range msg {
+				items[i] = resp.BulkString(part)
+			}
+			if c.write(resp.ArrayValue(items)) != nil {
+				return
+			}
+		case <-c.sub.done:
+			return
+		}
+	}
+}
+
+func (s *Sentinel) unsubscribeAll(c *client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c.sub != nil {
+		delete(s.subs, c.sub)
+		close(c.sub.done)
+	}
+}
+
+// publish sends an event to the subscribed clients. s.mu must be held.
+func (s *Sentinel) publish(event, msg string) {
+	for sub := range s.subs {
+		if sub.channels[event] {
+			sub.send([]string{"message", event, msg})
+		}
+		for pattern := range sub.patterns {
+			if matchPattern(event, pattern) {
+				sub.send([]string{"pmessage", pattern, event, msg})
+			}
+		}
+	}
+}
+
+func (sub *subscriber) send(msg []string) {
+	select {
+	case sub.out <- msg:
+	default:
+	}
+}
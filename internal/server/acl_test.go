@@ -0,0 +1,232 @@
+package server
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/cachestorm/cachestorm/internal/command"
+	"github.com/cachestorm/cachestorm/internal/resp"
+	"github.com/cachestorm/cachestorm/internal/store"
+)
+
+func startACLTest(t *testing.T) (string, *command.Router) {
+	t.Helper()
+	router := newPubSubTestRouter()
+	command.RegisterScriptCommands(router)
+	router.SetRequirePass("admin-secret")
+	return startTestConnections(t, store.NewStoreWithNamespaces(), router), router
+}
+
+func expectError(t *testing.T, v *resp.Value, want string) {
+	t.Helper()
+	if v.Type != resp.TypeError || v.Err != want {
+		t.Errorf("expected error %q, got %+v", want, v)
+	}
+}
+
+func TestACLLeastPrivilegeUser(t *testing.T) {
+	addr, _ := startACLTest(t)
+	admin := dialTestClient(t, addr)
+	if v := admin.do("AUTH", "admin-secret"); v.Str != "OK" {
+		t.Fatalf("AUTH default: %+v", v)
+	}
+	if v := admin.do("ACL", "SETUSER", "orders", "on", ">orders-pw", "~orders:*", "&orders.*",
+		"-@all", "+@read", "+@write", "-@dangerous", "+publish", "+multi", "+exec", "+acl|whoami"); v.Str != "OK" {
+		t.Fatalf("ACL SETUSER: %+v", v)
+	}
+	admin.do("SET", "billing:1", "secret")
+
+	svc := dialTestClient(t, addr)
+	expectError(t, svc.do("AUTH", "orders", "wrong"), "WRONGPASS invalid username-password pair or user is disabled.")
+	if v := svc.do("AUTH", "orders", "orders-pw"); v.Str != "OK" {
+		t.Fatalf("AUTH orders: %+v", v)
+	}
+	if v := svc.do("ACL", "WHOAMI"); string(v.Bulk) != "orders" {
+		t.Errorf("ACL WHOAMI: %+v", v)
+	}
+
+	if v := svc.do("SET", "orders:1", "new"); v.Str != "OK" {
+		t.Errorf("SET on own prefix: %+v", v)
+	}
+	if v := svc.do("GET", "orders:1"); string(v.Bulk) != "new" {
+		t.Errorf("GET on own prefix: %+v", v)
+	}
+	expectError(t, svc.do("GET", "billing:1"), "NOPERM No permissions to access a key")
+	expectError(t, svc.do("MGET", "orders:1", "billing:1"), "NOPERM No permissions to access a key")
+	expectError(t, svc.do("FLUSHALL"), "NOPERM User orders has no permissions to run the 'flushall' command")
+	expectError(t, svc.do("CLIENT", "LIST"), "NOPERM User orders has no permissions to run the 'client|list' command")
+	if v := svc.do("PUBLISH", "orders.created", "1"); v.Type != resp.TypeInteger {
+		t.Errorf("PUBLISH on own channel: %+v", v)
+	}
+	expectError(t, svc.do("PUBLISH", "billing.paid", "1"), "NOPERM No permissions to access a channel")
+
+	// A denied command aborts the transaction like any other queueing error
+	svc.do("MULTI")
+	expectError(t, svc.do("DEL", "billing:1"), "NOPERM No permissions to access a key")
+	if v := svc.do("EXEC"); v.Type != resp.TypeError || !strings.HasPrefix(v.Err, "EXECABORT") {
+		t.Errorf("expected EXECABORT, got %+v", v)
+	}
+	if v := admin.do("GET", "billing:1"); string(v.Bulk) != "secret" {
+		t.Errorf("denied DEL ran anyway: %+v", v)
+	}
+
+	if v := admin.do("ACL", "DRYRUN", "orders", "GET", "billing:1"); string(v.Bulk) != "User orders has no permissions to access the 'billing:1' key" {
+		t.Errorf("ACL DRYRUN denied: %+v", v)
+	}
+	if v := admin.do("ACL", "DRYRUN", "orders", "GET", "orders:1"); v.Str != "OK" {
+		t.Errorf("ACL DRYRUN allowed: %+v", v)
+	}
+
+	log := admin.do("ACL", "LOG")
+	if len(log.Array) == 0 {
+		t.Fatalf("expected ACL LOG entries, got %+v", log)
+	}
+	newest := make(map[string]*resp.Value)
+	for i := 0; i+1 < len(log.Array[0].Array); i += 2 {
+		newest[string(log.Array[0].Array[i].Bulk)] = log.Array[0].Array[i+1]
+	}
+	if string(newest["reason"].Bulk) != "key" || string(newest["context"].Bulk) != "multi" ||
+		string(newest["object"].Bulk) != "billing:1" || string(newest["username"].Bulk) != "orders" {
+		t.Errorf("unexpected newest ACL LOG entry %+v", newest)
+	}
+	if v := admin.do("ACL", "LOG", "RESET"); v.Str != "OK" {
+		t.Errorf("ACL LOG RESET: %+v", v)
+	}
+
+	// Disabling the user logs its connections out
+	admin.do("ACL", "SETUSER", "orders", "off")
+	expectError(t, svc.do("GET", "orders:1"), "NOAUTH Authentication required.")
+}
+
+func TestACLScriptsAndPatternSubscriptions(t *testing.T) {
+	addr, _ := startACLTest(t)
+	admin := dialTestClient(t, addr)
+	admin.do("AUTH", "admin-secret")
+	admin.do("ACL", "SETUSER", "reader", "on", "nopass", "~cache:*", "&news.*",
+		"+@read", "+@scripting", "+@pubsub")
+
+	c := dialTestClient(t, addr)
+	c.do("AUTH", "reader", "anything")
+	v := c.do("EVAL", "return redis.call('GET', 'private')", "0")
+	if v.Type != resp.TypeError || !strings.Contains(v.Err, "can't access at least one of the keys") {
+		t.Errorf("expected script key denial, got %+v", v)
+	}
+
+	expectError(t, c.do("PSUBSCRIBE", "news.s*"), "NOPERM No permissions to access a channel")
+	c.send("PSUBSCRIBE", "news.*")
+	expectFrame(t, c.read(), "psubscribe", "news.*", "1")
+}
+
+func TestACLSaveAndLoad(t *testing.T) {
+	addr, router := startACLTest(t)
+	path := filepath.Join(t.TempDir(), "users.acl")
+	if err := router.SetACLFile(path); err != nil {
+		t.Fatalf("SetACLFile: %v", err)
+	}
+
+	admin := dialTestClient(t, addr)
+	admin.do("AUTH", "admin-secret")
+	admin.do("ACL", "SETUSER", "svc", "on", ">pw", "~svc:*", "+get")
+	if v := admin.do("ACL", "SAVE"); v.Str != "OK" {
+		t.Fatalf("ACL SAVE: %+v", v)
+	}
+	admin.do("ACL", "DELUSER", "svc")
+	if v := admin.do("ACL", "LOAD"); v.Str != "OK" {
+		t.Fatalf("ACL LOAD: %+v", v)
+	}
+
+	v := admin.do("ACL", "GETUSER", "svc")
+	if v.Type == resp.TypeNull || len(v.Array) < 10 || string(v.Array[7].Bulk) != "~svc:*" {
+		t.Fatalf("ACL GETUSER after LOAD: %+v", v)
+	}
+	c := dialTestClient(t, addr)
+	if v := c.do("AUTH", "svc", "pw"); v.Str != "OK" {
+		t.Errorf("AUTH with loaded user: %+v", v)
+	}
+}
+
+func TestACLModuleCommands(t *testing.T) {
+	addr, router := startACLTest(t)
+	command.RegisterProbabilisticCommands(router)
+	command.RegisterTSCommands(router)
+	router.Register(&command.CommandDef{Name: "KEYED", Arity: -1, FirstKey: 1, LastKey: 1, KeyStep: 1,
+		Handler: func(ctx *command.Context) error { return ctx.WriteOK() }})
+	admin := dialTestClient(t, addr)
+	admin.do("AUTH", "admin-secret")
+	admin.do("ACL", "SETUSER", "reader", "on", "nopass", "~metrics:*", "+@read")
+	admin.do("ACL", "SETUSER", "noadd", "on", "nopass", "allkeys", "+@all", "-@write")
+	admin.do("ACL", "SETUSER", "scoped", "on", "nopass", "~metrics:*", "+@all")
+
+	reader := dialTestClient(t, addr)
+	reader.do("AUTH", "reader", "x")
+	if v := reader.do("TS.GET", "metrics:cpu"); v.Type == resp.TypeError {
+		t.Errorf("TS.GET as +@read: %+v", v)
+	}
+	if v := reader.do("CMS.QUERY", "metrics:hits", "a"); v.Type == resp.TypeError {
+		t.Errorf("CMS.QUERY as +@read: %+v", v)
+	}
+	expectError(t, reader.do("TS.ADD", "metrics:cpu", "1", "1"), "NOPERM User reader has no permissions to run the 'ts.add' command")
+
+	noadd := dialTestClient(t, addr)
+	noadd.do("AUTH", "noadd", "x")
+	expectError(t, noadd.do("BF.ADD", "seen", "a"), "NOPERM User noadd has no permissions to run the 'bf.add' command")
+	expectError(t, noadd.do("TS.ADD", "metrics:cpu", "1", "1"), "NOPERM User noadd has no permissions to run the 'ts.add' command")
+
+	scoped := dialTestClient(t, addr)
+	scoped.do("AUTH", "scoped", "x")
+	if v := scoped.do("BF.ADD", "metrics:seen", "a"); v.Type != resp.TypeInteger {
+		t.Errorf("BF.ADD on own prefix: %+v", v)
+	}
+	expectError(t, scoped.do("BF.ADD", "billing:seen", "a"), "NOPERM No permissions to access a key")
+	expectError(t, scoped.do("TS.MADD", "metrics:cpu", "1", "1", "billing:cpu", "1", "1"), "NOPERM No permissions to access a key")
+	// A keyed command called without its key cannot be checked
+	expectError(t, scoped.do("KEYED"), "NOPERM No permissions to access a key")
+}
+
+func TestACLAdminCommandsAreDangerous(t *testing.T) {
+	addr, router := startACLTest(t)
+	command.RegisterUtilityExtCommands(router)
+	admin := dialTestClient(t, addr)
+	admin.do("AUTH", "admin-secret")
+	admin.do("ACL", "SETUSER", "ops", "on", "nopass", "allkeys", "allchannels", "+@all", "-@dangerous")
+
+	ops := dialTestClient(t, addr)
+	ops.do("AUTH", "ops", "x")
+	expectError(t, ops.do("BACKUP.RESTORE", "nightly"), "NOPERM User ops has no permissions to run the 'backup.restore' command")
+	expectError(t, ops.do("BACKUP.DELETE", "nightly"), "NOPERM User ops has no permissions to run the 'backup.delete' command")
+	if v := admin.do("ACL", "DRYRUN", "ops", "BACKUP.CREATE"); v.Type != resp.TypeBulkString {
+		t.Errorf("ACL DRYRUN BACKUP.CREATE: %+v", v)
+	}
+}
+
+func TestACLDumpAllSkipsForbiddenKeys(t *testing.T) {
+	addr, _ := startACLTest(t)
+	admin := dialTestClient(t, addr)
+	admin.do("AUTH", "admin-secret")
+	value := strings.Repeat("v", 1000)
+	for i := 0; i < 300; i++ {
+		admin.do("SET", "orders:"+strconv.Itoa(i), value)
+	}
+	admin.do("SET", "billing:1", "secret")
+	admin.do("ACL", "SETUSER", "exporter", "on", "nopass", "~orders:*", "+dumpall", "+ping")
+
+	c := dialTestClient(t, addr)
+	c.do("AUTH", "exporter", "x")
+	v := c.do("DUMPALL")
+	if len(v.Array) != 300 {
+		t.Fatalf("DUMPALL returned %d records, want 300", len(v.Array))
+	}
+	for _, rec := range v.Array {
+		if !strings.Contains(string(rec.Bulk), `"key":"orders:`) {
+			t.Fatalf("DUMPALL returned a forbidden key: %s", rec.Bulk)
+		}
+	}
+	if v := c.do("PING"); v.Str != "PONG" {
+		t.Errorf("PING after DUMPALL: %+v", v)
+	}
+	if v := admin.do("DUMPALL"); len(v.Array) != 301 {
+		t.Errorf("DUMPALL for the default user returned %d records", len(v.Array))
+	}
+}
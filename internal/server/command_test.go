@@ -0,0 +1,92 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/cachestorm/cachestorm/internal/command"
+	"github.com/cachestorm/cachestorm/internal/resp"
+	"github.com/cachestorm/cachestorm/internal/store"
+)
+
+func TestCommandArityErrors(t *testing.T) {
+	addr := startTestConnections(t, store.NewStoreWithNamespaces(), newSessionTestRouter())
+	c := dialTestClient(t, addr)
+
+	expectError(t, c.do("GET"), "ERR wrong number of arguments for 'get' command")
+	expectError(t, c.do("GET", "a", "b"), "ERR wrong number of arguments for 'get' command")
+	if v := c.do("MGET", "a", "b", "c"); len(v.Array) != 3 {
+		t.Errorf("MGET with variadic keys: %+v", v)
+	}
+
+	// An arity error queues nothing and aborts the transaction
+	c.do("MULTI")
+	expectError(t, c.do("SET", "k"), "ERR wrong number of arguments for 'set' command")
+	if v := c.do("EXEC"); v.Type != resp.TypeError || !strings.HasPrefix(v.Err, "EXECABORT") {
+		t.Errorf("expected EXECABORT, got %+v", v)
+	}
+}
+
+func TestCommandInfoAndGetKeys(t *testing.T) {
+	addr := startTestConnections(t, store.NewStoreWithNamespaces(), newSessionTestRouter())
+	c := dialTestClient(t, addr)
+
+	v := c.do("COMMAND", "INFO", "mset", "nosuchcommand")
+	if len(v.Array) != 2 || !v.Array[1].IsNull {
+		t.Fatalf("COMMAND INFO: %+v", v)
+	}
+	info := v.Array[0].Array
+	if string(info[0].Bulk) != "mset" || info[1].Int != -3 || info[3].Int != 1 || info[4].Int != -1 || info[5].Int != 2 {
+		t.Errorf("unexpected MSET info %+v", v.Array[0])
+	}
+	flags := map[string]bool{}
+	for _, f := range info[2].Array {
+		flags[f.Str] = true
+	}
+	if !flags["write"] || !flags["denyoom"] || flags["readonly"] {
+		t.Errorf("unexpected MSET flags %+v", info[2])
+	}
+
+	if v := c.do("COMMAND", "INFO", "zunionstore"); v.Array[0].Array[2].Array[len(v.Array[0].Array[2].Array)-1].Str != "movablekeys" {
+		t.Errorf("expected movablekeys for ZUNIONSTORE, got %+v", v.Array[0].Array[2])
+	}
+
+	expectFrame(t, c.do("COMMAND", "GETKEYS", "MSET", "a", "1", "b", "2"), "a", "b")
+	expectFrame(t, c.do("COMMAND", "GETKEYS", "ZUNIONSTORE", "dst", "2", "s1", "s2", "WEIGHTS", "1", "2"), "dst", "s1", "s2")
+	expectError(t, c.do("COMMAND", "GETKEYS", "PING"), "ERR The command has no key arguments")
+	expectError(t, c.do("COMMAND", "GETKEYS", "GET"), "ERR Invalid number of arguments specified for command")
+
+	count := c.do("COMMAND", "COUNT").Int
+	if all := c.do("COMMAND"); int64(len(all.Array)) != count || count == 0 {
+		t.Errorf("COMMAND returned %d entries, COMMAND COUNT %d", len(all.Array), count)
+	}
+	expectFrame(t, c.do("COMMAND", "LIST", "FILTERBY", "PATTERN", "hgeta*"), "hgetall")
+	docs := c.do("COMMAND", "DOCS", "get")
+	if len(docs.Array) != 2 || string(docs.Array[0].Bulk) != "get" {
+		t.Errorf("COMMAND DOCS get: %+v", docs)
+	}
+}
+
+func TestCommandDenyOOMAndReadOnlyReplica(t *testing.T) {
+	s := store.NewStoreWithNamespaces()
+	s.ConfigureMemory(1000, store.EvictionNoEviction, 70, 90, 5)
+	addr := startTestConnections(t, s, newSessionTestRouter())
+	c := dialTestClient(t, addr)
+
+	c.do("SET", "k", "v")
+	s.MemoryTracker().Add(2000)
+	expectError(t, c.do("SET", "k", "v2"), "OOM command not allowed when used memory > 'maxmemory'.")
+	if v := c.do("DEL", "k"); v.Int != 1 {
+		t.Errorf("DEL is not denyoom and must run over maxmemory: %+v", v)
+	}
+	s.MemoryTracker().Sub(2000)
+
+	command.InitReplicationManager(s)
+	command.GetReplicationManager().ReplicaOf("127.0.0.1", 6399)
+	t.Cleanup(func() { command.GetReplicationManager().ReplicaOf("", 0) })
+
+	expectError(t, c.do("SET", "k", "v"), "READONLY You can't write against a read only replica.")
+	if v := c.do("GET", "k"); !v.IsNull {
+		t.Errorf("reads must be served by a replica: %+v", v)
+	}
+}
@@ -2,14 +2,19 @@ package server
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io"
 	"net"
 	"runtime/debug"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/cachestorm/cachestorm/internal/activeactive"
 	"github.com/cachestorm/cachestorm/internal/command"
 	"github.com/cachestorm/cachestorm/internal/logger"
+	"github.com/cachestorm/cachestorm/internal/replication"
 	"github.com/cachestorm/cachestorm/internal/resp"
 	"github.com/cachestorm/cachestorm/internal/store"
 )
@@ -33,10 +38,21 @@ type Connection struct {
 	readTimeout  time.Duration
 	writeTimeout time.Duration
 	subscriber   *store.Subscriber // PubSub subscriber, persists across commands
+	session      *command.Session  // transaction, auth and namespace state, persists across commands
+	writeMu      sync.Mutex        // serialises command replies with delivered pub/sub messages and pushes
+	reply        bytes.Buffer      // the reply of the running command, written under writeMu once it is done
+	replyWriter  *resp.Writer      // writes to reply
+	done         chan struct{}     // closed by Close to stop the push writer
+	closeOnce    sync.Once
+	// replica is set once a PSYNC made this connection a replica's link.
+	replica *replication.Replica
+	// peer is set once an ACTIVEACTIVE SYNC made this connection an
+	// active-active peer's link.
+	peer *activeactive.Stream
 }
 
 func NewConnection(id int64, conn net.Conn, s *store.Store, r *command.Router) *Connection {
-	return &Connection{
+	c := &Connection{
 		ID:           id,
 		conn:         conn,
 		reader:       resp.NewReader(bufio.NewReader(conn)),
@@ -47,13 +63,34 @@ func NewConnection(id int64, conn net.Conn, s *store.Store, r *command.Router) *
 		createdAt:    time.Now(),
 		readTimeout:  defaultReadTimeout,
 		writeTimeout: defaultWriteTimeout,
+		session:      command.NewSession(id, remoteAddr(conn)),
+		done:         make(chan struct{}),
 	}
+	c.replyWriter = resp.NewWriter(&c.reply)
+	c.session.SelectNamespace(c.namespace)
+	c.writer.SetProtocol(c.session.Protocol())
+	return c
 }
 
+// streamingCommands write straight to the socket while they run: the
+// snapshot for a replica, which the replication stream then follows, and
+// exports too large to hold in memory.
+var streamingCommands = map[string]bool{
+	"SYNC":    true,
+	"PSYNC":   true,
+	"DUMPALL": true,
+}
+
+// maxReplyBuffer is the most memory kept for replies between commands.
+const maxReplyBuffer = 64 * 1024
+
 func (c *Connection) Handle() {
 	defer c.Close()
 	defer c.recoverPanic()
 
+	command.RegisterSession(c.session)
+	go c.deliverPushes()
+
 	logger.Debug().
 		Int64("conn_id", c.ID).
 		Str("remote", c.conn.RemoteAddr().String()).
@@ -80,29 +117,150 @@ func (c *Connection) Handle() {
 
 		c.lastCmd = cmd
 
-		ctx := command.NewContextWithClient(cmd, args, c.store, c.writer, c.ID, c.conn.RemoteAddr().String())
-		// Share the subscriber across commands so PubSub state persists
-		if c.subscriber != nil {
-			ctx.Subscriber = c.subscriber
-		}
-
 		if cmd == "QUIT" {
+			c.writeMu.Lock()
 			c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
 			c.writer.WriteOK()
+			c.writeMu.Unlock()
 			return
 		}
 
-		c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+		// The reply is built apart and written once the command is done,
+		// so that pushes and messages are not held back while it runs,
+		// as a blocking command may for long.
+		streaming := streamingCommands[strings.ToUpper(cmd)]
+		w := c.replyWriter
+		if streaming {
+			c.writeMu.Lock()
+			c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+			w = c.writer
+		} else {
+			c.reply.Reset()
+			w.SetProtocol(c.session.Protocol())
+		}
+		ctx := command.NewContextWithSession(cmd, args, c.store, w, c.session)
+		// Share the subscriber across commands so PubSub state persists
+		if c.subscriber != nil {
+			ctx.Subscriber = c.subscriber
+		}
+
 		if err := c.router.Execute(ctx); err != nil {
 			if err == command.ErrUnknownCommand {
-				c.writer.WriteError("ERR unknown command '" + cmd + "'")
+				w.WriteError("ERR unknown command '" + cmd + "'")
 			} else {
-				c.writer.WriteError(err.Error())
+				w.WriteError(err.Error())
 			}
 		}
+		if !streaming {
+			c.writeMu.Lock()
+			c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+			if c.reply.Len() > 0 {
+				c.writer.WriteRaw(c.reply.Bytes())
+			}
+		}
+		c.writer.SetProtocol(c.session.Protocol())
+		c.writeMu.Unlock()
+		if c.reply.Cap() > maxReplyBuffer {
+			c.reply = bytes.Buffer{}
+		}
+
 		// Capture subscriber if created during this command (e.g. SUBSCRIBE)
 		if ctx.Subscriber != nil && c.subscriber == nil {
 			c.subscriber = ctx.Subscriber
+			c.session.SetSubscriber(c.subscriber)
+			go c.deliverMessages(c.subscriber)
+		}
+		// After PSYNC the connection carries the replication stream
+		if r := c.session.Replica(); r != nil && c.replica == nil {
+			c.replica = r
+			go c.deliverReplication(r)
+		}
+		if p := c.session.Peer(); p != nil && c.peer == nil {
+			c.peer = p
+			go c.deliverPeer(p)
+		}
+	}
+}
+
+// deliverPeer writes this node's operations to an active-active peer until
+// the connection is closed.
+func (c *Connection) deliverPeer(p *activeactive.Stream) {
+	for {
+		data, err := p.Next(c.done)
+		if err != nil {
+			c.conn.Close()
+			return
+		}
+		c.writeMu.Lock()
+		c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+		err = c.writer.WriteRaw(data)
+		c.writeMu.Unlock()
+		if err != nil {
+			c.conn.Close()
+			return
+		}
+	}
+}
+
+// deliverReplication writes the replication stream to a replica until the
+// connection is closed or the master drops the replica.
+func (c *Connection) deliverReplication(r *replication.Replica) {
+	for {
+		data, err := r.Next(c.done)
+		if err != nil {
+			c.conn.Close()
+			return
+		}
+		c.writeMu.Lock()
+		c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+		err = c.writer.WriteRaw(data)
+		c.writeMu.Unlock()
+		if err != nil {
+			c.conn.Close()
+			return
+		}
+	}
+}
+
+// deliverMessages drains the subscriber's queue onto the socket until the
+// subscriber is closed. Frames are written between command replies, never
+// inside one.
+func (c *Connection) deliverMessages(sub *store.Subscriber) {
+	for msg := range sub.Channel() {
+		c.writeMu.Lock()
+		c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+		err := c.writer.WriteValue(command.PubSubFrame(msg, c.writer.IsRESP3()))
+		c.writeMu.Unlock()
+		if err != nil {
+			// A subscriber that cannot keep up is disconnected; Handle's
+			// read fails and Close cleans up the subscription.
+			c.conn.Close()
+			return
+		}
+	}
+}
+
+// deliverPushes writes out-of-band frames queued on the session, such as
+// client-side caching invalidations, until the connection is closed. A
+// client whose queue overflowed is disconnected.
+func (c *Connection) deliverPushes() {
+	for {
+		select {
+		case <-c.session.Overflowed():
+			logger.Warn().Int64("conn_id", c.ID).Msg("push queue full, closing the connection")
+			c.conn.Close()
+			return
+		case v := <-c.session.Pushes():
+			c.writeMu.Lock()
+			c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+			err := c.writer.WriteValue(v)
+			c.writeMu.Unlock()
+			if err != nil {
+				c.conn.Close()
+				return
+			}
+		case <-c.done:
+			return
 		}
 	}
 }
@@ -127,6 +285,14 @@ func (c *Connection) Close() {
 		}
 		c.subscriber = nil
 	}
+	if c.replica != nil {
+		c.replica.Close()
+	}
+	if c.peer != nil {
+		c.peer.Close()
+	}
+	command.UnregisterSession(c.session)
+	c.closeOnce.Do(func() { close(c.done) })
 	c.conn.Close()
 	logger.Debug().
 		Int64("conn_id", c.ID).
@@ -137,6 +303,18 @@ func (c *Connection) RemoteAddr() string {
 	return c.conn.RemoteAddr().String()
 }
 
+// Session returns the per-connection state shared by all of its commands.
+func (c *Connection) Session() *command.Session {
+	return c.session
+}
+
+func remoteAddr(conn net.Conn) string {
+	if addr := conn.RemoteAddr(); addr != nil {
+		return addr.String()
+	}
+	return ""
+}
+
 func isClosedError(err error) bool {
 	if err == nil {
 		return false
@@ -17,6 +17,7 @@ import (
 
 	"github.com/cachestorm/cachestorm/internal/command"
 	"github.com/cachestorm/cachestorm/internal/logger"
+	"github.com/cachestorm/cachestorm/internal/persistence"
 	"github.com/cachestorm/cachestorm/internal/store"
 )
 
@@ -195,6 +196,8 @@ func NewHTTPServer(s *store.Store, router *command.Router, cfg *HTTPConfig) *HTT
 	mux.HandleFunc("/api/execute", h.authMiddleware(h.handleExecute))
 	mux.HandleFunc("/api/slowlog", h.authMiddleware(h.handleSlowlog))
 	mux.HandleFunc("/api/stats", h.authMiddleware(h.handleStats))
+	mux.HandleFunc("/api/export", h.authMiddleware(h.handleExport))
+	mux.HandleFunc("/api/import", h.authMiddleware(h.handleImport))
 	mux.HandleFunc("/api/login", h.handleLogin)
 
 	// pprof endpoints for production debugging (auth-protected)
@@ -815,9 +818,10 @@ func (h *HTTPServer) handleExecute(w http.ResponseWriter, r *http.Request) {
 	}
 
 	ctx := &command.Context{
-		Command: upperCmd,
-		Args:    args,
-		Store:   h.store,
+		Command:    upperCmd,
+		Args:       args,
+		Store:      h.store,
+		RemoteAddr: r.RemoteAddr,
 	}
 
 	result, err := h.router.ExecuteHTTP(ctx)
@@ -865,6 +869,61 @@ func (h *HTTPServer) handleStats(w http.ResponseWriter, _ *http.Request) {
 	})
 }
 
+// handleExport streams the keyspace as NDJSON, narrowed by the match,
+// namespace and tag query parameters. Exports outlast the write timeout,
+// so it is lifted for the request.
+func (h *HTTPServer) handleExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		h.writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	q := r.URL.Query()
+	filter := persistence.NDJSONFilter{
+		Match:     q.Get("match"),
+		Namespace: q.Get("namespace"),
+		Tag:       q.Get("tag"),
+	}
+
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="cachestorm.ndjson"`)
+	// The status is sent with the first record, so a failure part way
+	// through can only cut the stream short.
+	if n, err := persistence.ExportNDJSON(w, h.store, filter); err != nil {
+		logger.Error().Err(err).Int64("keys", n).Msg("HTTP export failed")
+	}
+}
+
+// handleImport loads an NDJSON upload into the keyspace, replacing keys of
+// the same name. Uploads are streamed rather than buffered, and the read
+// timeout is lifted for them like the write timeout is for exports.
+// Replicas and nodes with active-active peers refuse them.
+func (h *HTTPServer) handleImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" && r.Method != "PUT" {
+		h.writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if err := command.CheckDatasetReplace(); err != nil {
+		h.writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	_ = rc.SetReadDeadline(time.Time{})
+	_ = rc.SetWriteDeadline(time.Time{})
+	n, err := command.ImportNDJSON(r.Body, h.store)
+	if err != nil {
+		h.writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"error":    err.Error(),
+			"imported": n,
+		})
+		return
+	}
+	h.writeJSON(w, http.StatusOK, map[string]interface{}{
+		"imported": n,
+	})
+}
+
 func (h *HTTPServer) handleLogin(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		h.writeError(w, http.StatusMethodNotAllowed, "method not allowed")
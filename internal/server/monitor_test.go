@@ -0,0 +1,100 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/cachestorm/cachestorm/internal/command"
+	"github.com/cachestorm/cachestorm/internal/store"
+)
+
+var monitorLinePattern = regexp.MustCompile(`^\d+\.\d{6} \[(\S+) (\S+)\] (.*)$`)
+
+// readMonitorLine returns the db, source and quoted command of the next
+// MONITOR line.
+func readMonitorLine(t *testing.T, c *testClient) (string, string, string) {
+	t.Helper()
+	v := c.read()
+	m := monitorLinePattern.FindStringSubmatch(v.Str)
+	if m == nil {
+		t.Fatalf("unexpected MONITOR line %+v", v)
+	}
+	return m[1], m[2], m[3]
+}
+
+func TestMonitorStreamsCommands(t *testing.T) {
+	router := newSessionTestRouter()
+	command.RegisterScriptCommands(router)
+	router.SetRequirePass("secret")
+	addr := startTestConnections(t, store.NewStoreWithNamespaces(), router)
+
+	mon := dialTestClient(t, addr)
+	mon.do("AUTH", "secret")
+	if v := mon.do("MONITOR"); v.Str != "OK" {
+		t.Fatalf("MONITOR: %+v", v)
+	}
+
+	c := dialTestClient(t, addr)
+	c.do("AUTH", "default", "secret")
+	if _, _, cmd := readMonitorLine(t, mon); cmd != `"auth" "(redacted)" "(redacted)"` {
+		t.Errorf("AUTH not redacted: %s", cmd)
+	}
+
+	c.do("SET", "user:1", "line\nbreak")
+	db, source, cmd := readMonitorLine(t, mon)
+	if db != "0" || source != c.conn.LocalAddr().String() || cmd != `"set" "user:1" "line\nbreak"` {
+		t.Errorf("SET line: db=%s source=%s cmd=%s", db, source, cmd)
+	}
+
+	c.do("SELECT", "2")
+	readMonitorLine(t, mon)
+	c.do("MULTI")
+	c.do("INCR", "n")
+	c.do("EXEC")
+	var seen []string
+	for i := 0; i < 3; i++ {
+		db, _, cmd := readMonitorLine(t, mon)
+		seen = append(seen, db+" "+cmd)
+	}
+	if got := strings.Join(seen, ", "); got != `2 "multi", 2 "exec", 2 "incr" "n"` {
+		t.Errorf("transaction lines: %s", got)
+	}
+
+	c.do("EVAL", "return redis.call('GET', redis.KEYS[1])", "1", "n")
+	readMonitorLine(t, mon)
+	db, source, cmd = readMonitorLine(t, mon)
+	if db != "2" || source != "lua" || cmd != `"get" "n"` {
+		t.Errorf("script line: db=%s source=%s cmd=%s", db, source, cmd)
+	}
+
+	if v := mon.do("RESET"); v.Str != "RESET" {
+		t.Fatalf("RESET: %+v", v)
+	}
+	c.do("GET", "n")
+	if v := mon.do("PING"); v.Str != "PONG" {
+		t.Errorf("expected monitoring to stop after RESET, got %+v", v)
+	}
+}
+
+func TestMonitorShowsHTTPCommands(t *testing.T) {
+	s := store.NewStoreWithNamespaces()
+	router := newSessionTestRouter()
+	mon := dialTestClient(t, startTestConnections(t, s, router))
+	if v := mon.do("MONITOR"); v.Str != "OK" {
+		t.Fatalf("MONITOR: %+v", v)
+	}
+
+	req := httptest.NewRequest("POST", "/api/execute", strings.NewReader(`{"command":"set","args":["k","v"]}`))
+	w := httptest.NewRecorder()
+	NewHTTPServer(s, router, &HTTPConfig{}).handleExecute(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("execute status %d: %s", w.Code, w.Body.String())
+	}
+	db, source, cmd := readMonitorLine(t, mon)
+	if db != "0" || source != req.RemoteAddr || cmd != `"set" "k" "v"` {
+		t.Errorf("HTTP line: db=%s source=%s cmd=%s", db, source, cmd)
+	}
+}
@@ -0,0 +1,394 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cachestorm/cachestorm/internal/command"
+	"github.com/cachestorm/cachestorm/internal/config"
+	"github.com/cachestorm/cachestorm/internal/persistence"
+	"github.com/cachestorm/cachestorm/internal/resp"
+	"github.com/cachestorm/cachestorm/internal/store"
+)
+
+func persistenceTestConfig(dir string) *config.Config {
+	return &config.Config{
+		Server: config.ServerConfig{Bind: "127.0.0.1"},
+		Persistence: config.PersistenceConfig{
+			Enabled:     true,
+			AOF:         true,
+			AOFSync:     "always",
+			DataDir:     dir,
+			RDBFilename: "dump.rdb",
+		},
+	}
+}
+
+func TestNewLoadsRDBBeforeAOF(t *testing.T) {
+	dir := t.TempDir()
+
+	snapshot := store.NewStore()
+	snapshot.Set("counter", &store.StringValue{Data: []byte("10")}, store.SetOptions{})
+	snapshot.Set("tagged", &store.StringValue{Data: []byte("v")}, store.SetOptions{Tags: []string{"t"}})
+	snapshot.Set("list", &store.ListValue{Elements: [][]byte{[]byte("a")}}, store.SetOptions{})
+	w := persistence.NewRDBWriter(snapshot, persistence.RDBConfig{Version: persistence.RDBVersion11, Checksum: true})
+	if err := w.Save(filepath.Join(dir, "dump.rdb")); err != nil {
+		t.Fatal(err)
+	}
+	aof := "*2\r\n$4\r\nINCR\r\n$7\r\ncounter\r\n*3\r\n$5\r\nRPUSH\r\n$4\r\nlist\r\n$1\r\nb\r\n"
+	if err := os.WriteFile(filepath.Join(dir, "appendonly.aof"), []byte(aof), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := New(persistenceTestConfig(dir))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if e, ok := s.store.Get("counter"); !ok || e.Value.String() != "11" {
+		t.Errorf("counter = %+v, want the snapshot value incremented by the AOF", e)
+	}
+	if keys := s.store.GetTagIndex().GetKeys("t"); len(keys) != 1 || keys[0] != "tagged" {
+		t.Errorf("tags not restored: %v", keys)
+	}
+	if e, ok := s.store.Get("list"); !ok || len(e.Value.(*store.ListValue).Elements) != 2 {
+		t.Errorf("list = %+v", e)
+	}
+}
+
+func TestNewRejectsCorruptRDB(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "dump.rdb"), []byte("REDIS0011\xfe\x00"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(persistenceTestConfig(dir)); err == nil || !strings.Contains(err.Error(), "dump.rdb") {
+		t.Fatalf("expected startup to fail on a truncated snapshot, got %v", err)
+	}
+}
+
+func TestNewLoadsTruncatedAOF(t *testing.T) {
+	dir := t.TempDir()
+	aof := "*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n1\r\n*3\r\n$3\r\nSET\r\n$1\r\nb\r\n$1"
+	if err := os.WriteFile(filepath.Join(dir, "appendonly.aof"), []byte(aof), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := persistenceTestConfig(dir)
+	if _, err := New(cfg); err == nil {
+		t.Fatal("truncated AOF loaded without aof_load_truncated")
+	}
+
+	cfg.Persistence.AOFLoadTruncated = true
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if e, ok := s.store.Get("a"); !ok || e.Value.String() != "1" {
+		t.Errorf("a = %+v, want the commands before the incomplete one", e)
+	}
+}
+
+func TestNewRestoresAOFUntil(t *testing.T) {
+	dir := t.TempDir()
+	aofDir := filepath.Join(dir, "appendonlydir")
+	if err := os.MkdirAll(aofDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	incr := "#TS:100\r\n*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n1\r\n#TS:200\r\n*3\r\n$3\r\nSET\r\n$1\r\nb\r\n$1\r\n2\r\n"
+	if err := os.WriteFile(filepath.Join(aofDir, "appendonly.aof.1.incr.aof"), []byte(incr), 0644); err != nil {
+		t.Fatal(err)
+	}
+	manifest := "file appendonly.aof.1.incr.aof seq 1 type i\n"
+	if err := os.WriteFile(filepath.Join(aofDir, "appendonly.aof.manifest"), []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := persistenceTestConfig(dir)
+	cfg.Persistence.AOFRestoreUntil = time.Unix(150, 0).UTC().Format(time.RFC3339)
+	for i := 0; i < 2; i++ {
+		s, err := New(cfg)
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		if _, ok := s.store.Get("a"); !ok {
+			t.Error("write before the instant lost")
+		}
+		if _, ok := s.store.Get("b"); ok {
+			t.Error("write after the instant replayed")
+		}
+	}
+}
+
+func TestBackupRestoreReachesAOF(t *testing.T) {
+	dir := t.TempDir()
+	cfg := persistenceTestConfig(dir)
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	run := func(args ...string) {
+		t.Helper()
+		argv := make([][]byte, len(args)-1)
+		for i, a := range args[1:] {
+			argv[i] = []byte(a)
+		}
+		ctx := command.NewContext(args[0], argv, s.store, resp.NewWriter(io.Discard))
+		if err := s.router.Execute(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	run("SET", "kept", "1")
+	run("BACKUP.CREATE", "before")
+	run("SET", "dropped", "1")
+	replID := s.repl.GetReplicaID()
+	run("BACKUP.RESTORE", "before")
+	if s.repl.GetReplicaID() == replID {
+		t.Error("replicas may continue the history from before the restore")
+	}
+	if err := s.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "backups", "before", "manifest.json")); err != nil {
+		t.Fatalf("backup not written under data_dir: %v", err)
+	}
+
+	restarted, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := restarted.store.Get("kept"); !ok {
+		t.Error("restored key lost on restart")
+	}
+	if _, ok := restarted.store.Get("dropped"); ok {
+		t.Error("key removed by the restore came back from the AOF")
+	}
+}
+
+func TestImportMakesReplicasResync(t *testing.T) {
+	s, err := New(persistenceTestConfig(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	replID := s.repl.GetReplicaID()
+	if n, err := command.ImportNDJSON(strings.NewReader(`{"key":"k","type":"string","value":"1"}`), s.store); n != 1 || err != nil {
+		t.Fatalf("ImportNDJSON = %d, %v", n, err)
+	}
+	if s.repl.GetReplicaID() == replID {
+		t.Error("replicas may continue the history from before the import")
+	}
+}
+
+func TestReplacingTheDatasetIsRefused(t *testing.T) {
+	replica := persistenceTestConfig(t.TempDir())
+	replica.Replication = config.ReplicationConfig{Role: "replica", MasterHost: "127.0.0.1", MasterPort: 1, ServeStaleData: true, ReplTimeout: 60}
+	peered := persistenceTestConfig(t.TempDir())
+	peered.ActiveActive = config.ActiveActiveConfig{Enabled: true, NodeID: "a", Peers: []string{"127.0.0.1:1"}}
+
+	for _, tt := range []struct {
+		name string
+		cfg  *config.Config
+		want string
+	}{
+		{"replica", replica, "READONLY You can't replace the dataset of a replica."},
+		{"active-active", peered, "ERR the dataset cannot be replaced while active-active peers are attached"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := New(tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { command.EnableActiveActive(nil) })
+			var out bytes.Buffer
+			run := func(args ...string) {
+				t.Helper()
+				out.Reset()
+				argv := make([][]byte, len(args)-1)
+				for i, a := range args[1:] {
+					argv[i] = []byte(a)
+				}
+				if err := s.router.Execute(command.NewContext(args[0], argv, s.store, resp.NewWriter(&out))); err != nil {
+					t.Fatal(err)
+				}
+			}
+			run("SET", "kept", "1")
+			run("BACKUP.CREATE", "before")
+			run("DEL", "kept")
+			run("BACKUP.RESTORE", "before")
+			if got := strings.TrimSpace(out.String()); got != "-"+tt.want {
+				t.Errorf("BACKUP.RESTORE replied %q", got)
+			}
+			if _, ok := s.store.Get("kept"); ok {
+				t.Error("the backup was restored")
+			}
+
+			if _, err := command.ImportNDJSON(strings.NewReader(`{"key":"kept","type":"string","value":"1"}`), s.store); err == nil || err.Error() != tt.want {
+				t.Errorf("ImportNDJSON err = %v", err)
+			}
+			w := httptest.NewRecorder()
+			NewHTTPServer(s.store, s.router, &HTTPConfig{}).handleImport(w, httptest.NewRequest("POST", "/api/import", strings.NewReader(`{"key":"kept","type":"string","value":"1"}`)))
+			if w.Code != http.StatusConflict {
+				t.Errorf("HTTP import status %d: %s", w.Code, w.Body.String())
+			}
+			if _, ok := s.store.Get("kept"); ok {
+				t.Error("the upload was imported")
+			}
+		})
+	}
+}
+
+func TestAOFKeepsNamespacesApartOnRestart(t *testing.T) {
+	dir := t.TempDir()
+	cfg := persistenceTestConfig(dir)
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	run := func(sess *command.Session, args ...string) {
+		t.Helper()
+		argv := make([][]byte, len(args)-1)
+		for i, a := range args[1:] {
+			argv[i] = []byte(a)
+		}
+		ctx := command.NewContextWithSession(args[0], argv, s.store, resp.NewWriter(io.Discard), sess)
+		if err := s.router.Execute(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db0, db1, tenant := command.NewSession(1, "a"), command.NewSession(2, "b"), command.NewSession(3, "c")
+	run(db1, "SELECT", "1")
+	run(tenant, "NAMESPACE", "tenant")
+	run(db0, "SET", "k", "zero")
+	run(db1, "SET", "k", "one")
+	run(tenant, "SET", "k", "tenant")
+	run(db0, "SET", "only0", "v")
+	run(db1, "DEL", "missing")
+	if err := s.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ns, want := range map[string]string{"default": "zero", "db1": "one", "tenant": "tenant"} {
+		if e, ok := restarted.store.ForNamespace(ns).Get("k"); !ok || e.Value.String() != want {
+			t.Errorf("%s: k = %+v, want %q", ns, e, want)
+		}
+	}
+	if _, ok := restarted.store.ForNamespace("db1").Get("only0"); ok {
+		t.Error("db0 write replayed into db1")
+	}
+	if _, ok := restarted.store.Get("only0"); !ok {
+		t.Error("db0 write lost after switching back")
+	}
+}
+
+func TestServerSavesSnapshotOnStop(t *testing.T) {
+	dir := t.TempDir()
+	cfg := persistenceTestConfig(dir)
+	cfg.Persistence.AOF = false
+	cfg.Persistence.Save = "3600 1"
+
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	s.store.Set("k", &store.StringValue{Data: []byte("v")}, store.SetOptions{})
+	s.store.ForNamespace("db2").Set("other", &store.StringValue{Data: []byte("v")}, store.SetOptions{})
+	if err := s.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := restarted.store.Get("k"); !ok {
+		t.Error("key not saved on shutdown")
+	}
+	if _, ok := restarted.store.ForNamespace("db2").Get("other"); !ok {
+		t.Error("db2 key not saved on shutdown")
+	}
+	if dirty := restarted.snapshots.Dirty(); dirty != 0 {
+		t.Errorf("dirty = %d after loading the snapshot", dirty)
+	}
+}
+
+func TestNewRejectsInvalidSaveRules(t *testing.T) {
+	cfg := persistenceTestConfig(t.TempDir())
+	cfg.Persistence.Save = "60"
+	if _, err := New(cfg); err == nil {
+		t.Fatal("expected invalid save rules to fail startup")
+	}
+}
+
+func TestServerRewritesAOFAndPrefersItOverRDB(t *testing.T) {
+	dir := t.TempDir()
+	cfg := persistenceTestConfig(dir)
+
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	incr := func() {
+		ctx := command.NewContext("INCR", [][]byte{[]byte("counter")}, s.store, resp.NewWriter(io.Discard))
+		if err := s.router.Execute(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		incr()
+	}
+	if err := s.aof.BGREWRITEAOF(); err != nil {
+		t.Fatal(err)
+	}
+	incr()
+	for s.aof.IsRewriting() {
+		time.Sleep(time.Millisecond)
+	}
+	incr()
+	if err := s.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// A stale snapshot must not be loaded under the multi-part AOF.
+	stale := store.NewStore()
+	stale.Set("stale", &store.StringValue{Data: []byte("v")}, store.SetOptions{})
+	w := persistence.NewRDBWriter(stale, persistence.RDBConfig{Version: persistence.RDBVersion11, Checksum: true})
+	if err := w.Save(filepath.Join(dir, "dump.rdb")); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := restarted.store.Get("counter"); !ok || e.Value.String() != "102" {
+		t.Errorf("counter = %+v, want 102", e)
+	}
+	if _, ok := restarted.store.Get("stale"); ok {
+		t.Error("snapshot loaded on top of the AOF")
+	}
+	if bases, _ := filepath.Glob(filepath.Join(dir, "appendonlydir", "*.base.rdb")); len(bases) != 1 {
+		t.Errorf("base files = %v, want only the rewritten one", bases)
+	}
+}
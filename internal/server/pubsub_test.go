@@ -0,0 +1,114 @@
+package server
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/cachestorm/cachestorm/internal/command"
+	"github.com/cachestorm/cachestorm/internal/resp"
+	"github.com/cachestorm/cachestorm/internal/store"
+)
+
+func newPubSubTestRouter() *command.Router {
+	router := newSessionTestRouter()
+	command.RegisterPubSubCommands(router)
+	return router
+}
+
+func expectFrame(t *testing.T, v *resp.Value, want ...string) {
+	t.Helper()
+	if len(v.Array) != len(want) {
+		t.Fatalf("expected %d elements %v, got %+v", len(want), want, v)
+	}
+	for i, w := range want {
+		got := string(v.Array[i].Bulk)
+		if v.Array[i].Type == resp.TypeInteger {
+			got = strconv.FormatInt(v.Array[i].Int, 10)
+		}
+		if got != w {
+			t.Errorf("element %d: expected %q, got %q", i, w, got)
+		}
+	}
+}
+
+func TestPubSubDeliversToSubscriber(t *testing.T) {
+	addr := startTestConnections(t, store.NewStore(), newPubSubTestRouter())
+	sub := dialTestClient(t, addr)
+	pub := dialTestClient(t, addr)
+
+	sub.send("SUBSCRIBE", "chat", "alerts")
+	expectFrame(t, sub.read(), "subscribe", "chat", "1")
+	expectFrame(t, sub.read(), "subscribe", "alerts", "2")
+	sub.send("PSUBSCRIBE", "news.*")
+	expectFrame(t, sub.read(), "psubscribe", "news.*", "3")
+
+	if v := pub.do("PUBLISH", "chat", "hello"); v.Int != 1 {
+		t.Fatalf("PUBLISH chat: %+v", v)
+	}
+	expectFrame(t, sub.read(), "message", "chat", "hello")
+
+	pub.do("PUBLISH", "news.tech", "release")
+	expectFrame(t, sub.read(), "pmessage", "news.*", "news.tech", "release")
+
+	sub.send("UNSUBSCRIBE")
+	expectFrame(t, sub.read(), "unsubscribe", "alerts", "2")
+	expectFrame(t, sub.read(), "unsubscribe", "chat", "1")
+	if v := pub.do("PUBLISH", "chat", "gone"); v.Int != 0 {
+		t.Errorf("expected no receivers after UNSUBSCRIBE, got %+v", v)
+	}
+}
+
+func TestPubSubSubscribedModeRestrictions(t *testing.T) {
+	addr := startTestConnections(t, store.NewStore(), newPubSubTestRouter())
+	c := dialTestClient(t, addr)
+
+	c.send("SUBSCRIBE", "chat")
+	c.read()
+
+	v := c.do("GET", "k")
+	if v.Type != resp.TypeError || v.Err != "ERR Can't execute 'get': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context" {
+		t.Fatalf("expected subscribed-mode error, got %+v", v)
+	}
+	expectFrame(t, c.do("PING"), "pong", "")
+
+	if v := c.do("RESET"); v.Str != "RESET" {
+		t.Fatalf("RESET: %+v", v)
+	}
+	if v := c.do("PING"); v.Str != "PONG" {
+		t.Errorf("expected normal PING after RESET, got %+v", v)
+	}
+	if v := c.do("GET", "k"); !v.IsNull {
+		t.Errorf("expected commands allowed after RESET, got %+v", v)
+	}
+}
+
+func TestPubSubRESP3PushesAndShardChannels(t *testing.T) {
+	addr := startTestConnections(t, store.NewStore(), newPubSubTestRouter())
+	sub := dialTestClient(t, addr)
+	pub := dialTestClient(t, addr)
+
+	sub.do("HELLO", "3")
+	sub.send("SSUBSCRIBE", "orders")
+	v := sub.read()
+	if v.Type != resp.TypePush {
+		t.Fatalf("expected push confirmation, got %+v", v)
+	}
+	expectFrame(t, v, "ssubscribe", "orders", "1")
+
+	// RESP3 clients are not restricted while subscribed
+	if v := sub.do("SET", "k", "v"); v.Str != "OK" {
+		t.Fatalf("SET while subscribed over RESP3: %+v", v)
+	}
+
+	if v := pub.do("PUBLISH", "orders", "ignored"); v.Int != 0 {
+		t.Errorf("PUBLISH must not reach shard channels, got %+v", v)
+	}
+	if v := pub.do("SPUBLISH", "orders", "new"); v.Int != 1 {
+		t.Fatalf("SPUBLISH: %+v", v)
+	}
+	v = sub.read()
+	if v.Type != resp.TypePush {
+		t.Fatalf("expected push message, got %+v", v)
+	}
+	expectFrame(t, v, "smessage", "orders", "new")
+}
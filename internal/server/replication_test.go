@@ -0,0 +1,453 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cachestorm/cachestorm/internal/command"
+	"github.com/cachestorm/cachestorm/internal/config"
+	"github.com/cachestorm/cachestorm/internal/persistence"
+	"github.com/cachestorm/cachestorm/internal/resp"
+	"github.com/cachestorm/cachestorm/internal/store"
+)
+
+// serveFullSync answers one replica's handshake on ln with a full sync of
+// data followed by stream, and holds the link open until the test ends.
+func serveFullSync(t *testing.T, ln net.Listener, data *store.Store, stream string) {
+	path := filepath.Join(t.TempDir(), "sync.rdb")
+	if err := persistence.NewRDBWriter(data, persistence.RDBConfig{Checksum: true}).Save(path); err != nil {
+		t.Fatal(err)
+	}
+	payload, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := resp.NewReader(bufio.NewReader(conn))
+		for {
+			name, args, err := r.ReadCommand()
+			if err != nil {
+				return
+			}
+			switch name {
+			case "PING":
+				conn.Write([]byte("+PONG\r\n"))
+			case "REPLCONF":
+				// ACKs get no reply.
+				if len(args) == 0 || !strings.EqualFold(string(args[0]), "ACK") {
+					conn.Write([]byte("+OK\r\n"))
+				}
+			case "PSYNC":
+				fmt.Fprintf(conn, "+FULLRESYNC %040d 0\r\n$%d\r\n%s%s", 1, len(payload), payload, stream)
+			}
+		}
+	}()
+}
+
+func TestReplicaAppliesMasterStream(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	master := store.NewStoreWithNamespaces()
+	master.Set("synced", &store.StringValue{Data: []byte("1")}, store.SetOptions{})
+	serveFullSync(t, ln, master, "*2\r\n$6\r\nSELECT\r\n$1\r\n1\r\n*3\r\n$3\r\nset\r\n$1\r\nk\r\n$1\r\nv\r\n"+
+		"*2\r\n$6\r\nSELECT\r\n$1\r\n0\r\n*3\r\n$3\r\nset\r\n$2\r\nk0\r\n$1\r\nv\r\n")
+
+	dir := t.TempDir()
+	cfg := persistenceTestConfig(dir)
+	cfg.Replication = config.ReplicationConfig{
+		Role:        "replica",
+		MasterHost:  "127.0.0.1",
+		MasterPort:  ln.Addr().(*net.TCPAddr).Port,
+		ReplTimeout: 60,
+	}
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.store.Set("local", &store.StringValue{Data: []byte("x")}, store.SetOptions{})
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !s.store.Exists("k0") {
+		if time.Now().After(deadline) {
+			t.Fatal("the replicated SET never arrived")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !s.store.ForNamespace("db1").Exists("k") || s.store.Exists("k") {
+		t.Error("SELECT in the stream did not carry over to the next command")
+	}
+	if s.store.Exists("local") || !s.store.Exists("synced") {
+		t.Errorf("after the full sync: local %v, synced %v", s.store.Exists("local"), s.store.Exists("synced"))
+	}
+	if err := s.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The full sync and the stream both reached the replica's AOF.
+	cfg.Replication = config.ReplicationConfig{}
+	restarted, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !restarted.store.Exists("synced") || !restarted.store.Exists("k0") || restarted.store.Exists("local") {
+		t.Error("the replica's AOF does not hold the replicated dataset")
+	}
+}
+
+// psync sends PSYNC on a new connection to addr and returns the reply line.
+func psync(t *testing.T, addr, replid string, offset int64) (net.Conn, *bufio.Reader, string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	off := strconv.FormatInt(offset, 10)
+	fmt.Fprintf(conn, "*3\r\n$5\r\nPSYNC\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(replid), replid, len(off), off)
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, r, strings.TrimSuffix(line, "\r\n")
+}
+
+func expectStream(t *testing.T, r *bufio.Reader, want string) {
+	t.Helper()
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(r, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("stream %q, want %q", got, want)
+	}
+}
+
+func TestMasterResumesReplicaFromBacklog(t *testing.T) {
+	s, err := New(&config.Config{Server: config.ServerConfig{Bind: "127.0.0.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// Cleanups run last in first out, so the connections close first and
+	// Stop has nothing to drain.
+	t.Cleanup(func() { s.Stop(context.Background()) })
+	addr := s.listener.Addr().String()
+	client := dialTestClient(t, addr)
+	client.do("SET", "before", "1")
+
+	conn, r, line := psync(t, addr, "?", -1)
+	var replid string
+	var offset int64
+	if _, err := fmt.Sscanf(line, "+FULLRESYNC %s %d", &replid, &offset); err != nil {
+		t.Fatalf("PSYNC ? -1 got %q", line)
+	}
+	var size int
+	if _, err := fmt.Fscanf(r, "$%d\r\n", &size); err != nil {
+		t.Fatal(err)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(payload, []byte("before")) {
+		t.Error("the snapshot does not hold the key written before the sync")
+	}
+
+	client.do("SET", "k", "v")
+	stream := "*2\r\n$6\r\nSELECT\r\n$1\r\n0\r\n*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$1\r\nv\r\n"
+	expectStream(t, r, stream)
+	offset += int64(len(stream))
+	conn.Close()
+
+	// The write made while the replica was away comes from the backlog.
+	client.do("SET", "k2", "v2")
+	_, r, line = psync(t, addr, replid, offset+1)
+	if line != "+CONTINUE "+replid {
+		t.Fatalf("PSYNC %s %d got %q", replid, offset+1, line)
+	}
+	expectStream(t, r, "*3\r\n$3\r\nSET\r\n$2\r\nk2\r\n$2\r\nv2\r\n")
+}
+
+func TestWaitCountsReplicaAcks(t *testing.T) {
+	s, err := New(&config.Config{Server: config.ServerConfig{Bind: "127.0.0.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Stop(context.Background()) })
+	addr := s.listener.Addr().String()
+	client := dialTestClient(t, addr)
+
+	if v := client.do("WAIT", "1", "50"); v.Int != 0 {
+		t.Errorf("WAIT without replicas = %d", v.Int)
+	}
+	client.do("CONFIG", "SET", "min-replicas-to-write", "1")
+	expectError(t, client.do("SET", "k", "v"), "NOREPLICAS Not enough good replicas to write.")
+
+	conn, r, line := psync(t, addr, "?", -1)
+	var offset int64
+	if _, err := fmt.Sscanf(line, "+FULLRESYNC %s %d", new(string), &offset); err != nil {
+		t.Fatalf("PSYNC ? -1 got %q", line)
+	}
+	var size int
+	fmt.Fscanf(r, "$%d\r\n", &size)
+	io.ReadFull(r, make([]byte, size))
+	fmt.Fprintf(conn, "*3\r\n$8\r\nREPLCONF\r\n$3\r\nACK\r\n$%d\r\n%d\r\n", len(strconv.FormatInt(offset, 10)), offset)
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(string(client.do("INFO", "replication").Bulk), "state=online") {
+		if time.Now().After(deadline) {
+			t.Fatal("the replica never came online")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if v := client.do("SET", "k", "v"); v.Str != "OK" {
+		t.Fatalf("SET with a replica online got %+v", v)
+	}
+	set := "*2\r\n$6\r\nSELECT\r\n$1\r\n0\r\n*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$1\r\nv\r\n"
+	expectStream(t, r, set)
+	offset += int64(len(set))
+
+	// The replica answers the GETACK WAIT sends.
+	go func() {
+		getack := make([]byte, len("*3\r\n$8\r\nREPLCONF\r\n$6\r\nGETACK\r\n$1\r\n*\r\n"))
+		if _, err := io.ReadFull(r, getack); err != nil {
+			return
+		}
+		off := strconv.FormatInt(offset, 10)
+		fmt.Fprintf(conn, "*3\r\n$8\r\nREPLCONF\r\n$3\r\nACK\r\n$%d\r\n%s\r\n", len(off), off)
+	}()
+	if v := client.do("WAIT", "1", "0"); v.Int != 1 {
+		t.Errorf("WAIT = %+v, want 1", v)
+	}
+}
+
+func TestReplicaRefusesWritesAndStaleReads(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	cfg := &config.Config{Server: config.ServerConfig{Bind: "127.0.0.1"}}
+	cfg.Replication = config.ReplicationConfig{
+		Role:           "replica",
+		MasterHost:     "127.0.0.1",
+		MasterPort:     ln.Addr().(*net.TCPAddr).Port,
+		ReadOnly:       true,
+		ServeStaleData: true,
+		ReplTimeout:    60,
+	}
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Stop(context.Background()) })
+	client := dialTestClient(t, s.listener.Addr().String())
+	if v := client.do("HELLO", "3"); v.Type != resp.TypeMap || string(v.Map["role"].Bulk) != "replica" {
+		t.Errorf("HELLO on a replica = %+v", v)
+	}
+	client.do("HELLO", "2")
+
+	// The master has not answered yet: stale reads are served until
+	// replica-serve-stale-data is turned off.
+	if v := client.do("GET", "k"); !v.IsNull {
+		t.Errorf("GET with stale data served = %+v", v)
+	}
+	client.do("CONFIG", "SET", "replica-serve-stale-data", "no")
+	expectError(t, client.do("GET", "k"), "MASTERDOWN Link with MASTER is down and replica-serve-stale-data is set to 'no'.")
+	if v := client.do("INFO", "replication"); !strings.Contains(string(v.Bulk), "master_link_status:down") {
+		t.Errorf("INFO replication:\n%s", v.Bulk)
+	}
+
+	master := store.NewStoreWithNamespaces()
+	master.Set("k", &store.StringValue{Data: []byte("v")}, store.SetOptions{})
+	serveFullSync(t, ln, master, "")
+	deadline := time.Now().Add(5 * time.Second)
+	for !s.repl.MasterLinkUp() {
+		if time.Now().After(deadline) {
+			t.Fatal("the link to the master never came up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if v := client.do("GET", "k"); string(v.Bulk) != "v" {
+		t.Errorf("GET with the link up = %+v", v)
+	}
+	expectError(t, client.do("SET", "k", "v2"), "READONLY You can't write against a read only replica.")
+	expectError(t, client.do("EVAL", "return redis.call('SET', 'k', 'v2')", "0"), "READONLY You can't write against a read only replica.")
+}
+
+func TestReplicaOfWhileServingReads(t *testing.T) {
+	s, err := New(&config.Config{Server: config.ServerConfig{Bind: "127.0.0.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Stop(context.Background()) })
+	client := dialTestClient(t, s.listener.Addr().String())
+
+	// What REPLICAOF does switches the role back and forth while the
+	// client's commands check it; run with -race.
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				command.GetReplicationManager().ReplicaOf("", 0)
+				return
+			default:
+			}
+			command.GetReplicationManager().ReplicaOf("127.0.0.1", 1)
+			command.GetReplicationManager().ReplicaOf("", 0)
+			time.Sleep(100 * time.Microsecond)
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		client.do("GET", "k")
+		client.do("SET", "k", "v")
+		client.do("ROLE")
+		client.do("HELLO", "2")
+		client.do("INFO", "replication")
+	}
+	close(stop)
+	<-done
+	if v := client.do("ROLE"); string(v.Array[0].Bulk) != "master" {
+		t.Errorf("ROLE after REPLICAOF NO ONE = %+v", v)
+	}
+}
+
+func TestMasterStreamsDisklessSync(t *testing.T) {
+	cfg := &config.Config{Server: config.ServerConfig{Bind: "127.0.0.1"}}
+	cfg.Replication = config.ReplicationConfig{ReplDisklessSync: true}
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Stop(context.Background()) })
+	addr := s.listener.Addr().String()
+	client := dialTestClient(t, addr)
+	client.do("SET", "before", "1")
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	fmt.Fprint(conn, "*3\r\n$8\r\nREPLCONF\r\n$4\r\ncapa\r\n$3\r\neof\r\n*3\r\n$5\r\nPSYNC\r\n$1\r\n?\r\n$2\r\n-1\r\n")
+	var replid, mark string
+	var offset int64
+	if _, err := fmt.Fscanf(r, "+OK\r\n+FULLRESYNC %s %d\r\n$EOF:%s\r\n", &replid, &offset, &mark); err != nil || len(mark) != 40 {
+		t.Fatalf("diskless sync header: %v, mark %q", err, mark)
+	}
+	// Nothing follows the mark until the replica ACKs.
+	var payload []byte
+	for !bytes.HasSuffix(payload, []byte(mark)) {
+		b, err := r.ReadByte()
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload = append(payload, b)
+	}
+	if !bytes.HasPrefix(payload, []byte("REDIS")) || !bytes.Contains(payload, []byte("before")) {
+		t.Errorf("payload %q", payload)
+	}
+
+	client.do("SET", "k", "v")
+	off := strconv.FormatInt(offset, 10)
+	fmt.Fprintf(conn, "*3\r\n$8\r\nREPLCONF\r\n$3\r\nACK\r\n$%d\r\n%s\r\n", len(off), off)
+	expectStream(t, r, "*2\r\n$6\r\nSELECT\r\n$1\r\n0\r\n*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$1\r\nv\r\n")
+}
+
+func TestReplicaServesSubReplicas(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	cfg := &config.Config{Server: config.ServerConfig{Bind: "127.0.0.1"}}
+	cfg.Replication = config.ReplicationConfig{
+		Role:           "replica",
+		MasterHost:     "127.0.0.1",
+		MasterPort:     ln.Addr().(*net.TCPAddr).Port,
+		ReadOnly:       true,
+		ServeStaleData: true,
+		ReplTimeout:    60,
+	}
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Stop(context.Background()) })
+	addr := s.listener.Addr().String()
+
+	// Not before the replica has its master's dataset.
+	if _, _, line := psync(t, addr, "?", -1); line != "-NOMASTERLINK Can't SYNC while not connected with my master" {
+		t.Errorf("PSYNC with the link down got %q", line)
+	}
+
+	master := store.NewStoreWithNamespaces()
+	master.Set("k", &store.StringValue{Data: []byte("v")}, store.SetOptions{})
+	set := "*3\r\n$3\r\nset\r\n$2\r\nk2\r\n$1\r\nv\r\n"
+	serveFullSync(t, ln, master, set)
+	deadline := time.Now().Add(5 * time.Second)
+	for !s.store.Exists("k2") {
+		if time.Now().After(deadline) {
+			t.Fatal("the replica never applied the stream")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The sub-replica continues the master's history from the replica.
+	_, r, line := psync(t, addr, fmt.Sprintf("%040d", 1), 1)
+	if want := fmt.Sprintf("+CONTINUE %040d", 1); line != want {
+		t.Fatalf("PSYNC on the replica got %q, want %q", line, want)
+	}
+	expectStream(t, r, set)
+	_, _, line = psync(t, addr, "?", -1)
+	if want := fmt.Sprintf("+FULLRESYNC %040d %d", 1, len(set)); line != want {
+		t.Errorf("PSYNC ? -1 on the replica got %q, want %q", line, want)
+	}
+}
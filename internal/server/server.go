@@ -3,6 +3,8 @@ package server
 import (
 	"context"
 	"crypto/tls"
+	"errors"
+	"fmt"
 	"net"
 	"os"
 	"path/filepath"
@@ -12,38 +14,25 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/cachestorm/cachestorm/internal/activeactive"
 	"github.com/cachestorm/cachestorm/internal/command"
 	"github.com/cachestorm/cachestorm/internal/config"
 	"github.com/cachestorm/cachestorm/internal/logger"
 	"github.com/cachestorm/cachestorm/internal/persistence"
+	"github.com/cachestorm/cachestorm/internal/replication"
 	"github.com/cachestorm/cachestorm/internal/store"
 )
 
-// writeCommands lists commands that mutate state and should be persisted to AOF
-var writeCommands = map[string]bool{
-	"SET": true, "SETNX": true, "SETEX": true, "PSETEX": true, "MSET": true, "MSETNX": true,
-	"APPEND": true, "INCR": true, "DECR": true, "INCRBY": true, "DECRBY": true, "INCRBYFLOAT": true,
-	"DEL": true, "UNLINK": true, "RENAME": true, "RENAMENX": true, "EXPIRE": true, "EXPIREAT": true,
-	"PEXPIRE": true, "PEXPIREAT": true, "PERSIST": true,
-	"HSET": true, "HSETNX": true, "HMSET": true, "HDEL": true, "HINCRBY": true, "HINCRBYFLOAT": true,
-	"LPUSH": true, "RPUSH": true, "LPOP": true, "RPOP": true, "LSET": true, "LREM": true,
-	"LTRIM": true, "LINSERT": true, "RPOPLPUSH": true, "LMOVE": true,
-	"SADD": true, "SREM": true, "SPOP": true, "SMOVE": true,
-	"ZADD": true, "ZREM": true, "ZINCRBY": true, "ZRANGESTORE": true,
-	"XADD": true, "XDEL": true, "XTRIM": true,
-	"PFADD": true, "PFMERGE": true,
-	"SETBIT": true, "BITOP": true, "BITFIELD": true,
-	"GEOADD": true, "GEORADIUS": true,
-	"SETTAG": true, "INVALIDATE": true,
-}
-
 type Server struct {
 	cfg        *config.Config
 	listener   net.Listener
 	router     *command.Router
 	store      *store.Store
 	httpServer *HTTPServer
-	aof        *persistence.AOFWriter
+	aof        *persistence.AOFManager
+	snapshots  *persistence.PersistenceManager
+	repl       *replication.Manager
+	aa         *activeactive.Engine
 	conns      sync.Map
 	connID     atomic.Int64
 	connCount  atomic.Int64
@@ -55,7 +44,7 @@ type Server struct {
 func New(cfg *config.Config) (*Server, error) {
 	s := &Server{
 		cfg:    cfg,
-		store:  store.NewStore(),
+		store:  store.NewStoreWithNamespaces(),
 		router: command.NewRouter(),
 		stopCh: make(chan struct{}),
 	}
@@ -73,6 +62,25 @@ func New(cfg *config.Config) (*Server, error) {
 			Str("eviction_policy", cfg.Memory.EvictionPolicy).
 			Msg("memory limits configured")
 	}
+	if cfg.Memory.TierDir != "" {
+		segmentSize, err := config.ParseMemorySize(cfg.Memory.TierSegmentSize)
+		if err != nil {
+			return nil, fmt.Errorf("invalid memory.tier_segment_size: %w", err)
+		}
+		if err := s.store.ConfigureTier(store.TierConfig{
+			Dir:          cfg.Memory.TierDir,
+			SegmentSize:  segmentSize,
+			CompactRatio: cfg.Memory.TierCompactRatio,
+			Encode:       persistence.EncodeValue,
+			Decode:       persistence.DecodeValue,
+		}); err != nil {
+			return nil, fmt.Errorf("disk tier: %w", err)
+		}
+		if s.store.Evictor() == nil || parseEvictionPolicy(cfg.Memory.EvictionPolicy) == store.EvictionNoEviction {
+			logger.Warn().Msg("disk tier enabled without max_memory and an eviction policy, nothing will be moved to it")
+		}
+		logger.Info().Str("dir", cfg.Memory.TierDir).Msg("disk tier enabled")
+	}
 
 	command.RegisterStringCommands(s.router)
 	command.RegisterServerCommands(s.router)
@@ -127,10 +135,16 @@ func New(cfg *config.Config) (*Server, error) {
 	command.RegisterMLCommands(s.router)
 
 	command.InitReplicationManager(s.store)
+	command.EnableTracking(s.store)
 
 	if cfg.Server.RequirePass != "" {
 		s.router.SetRequirePass(cfg.Server.RequirePass)
 	}
+	if cfg.Server.ACLFile != "" {
+		if err := s.router.SetACLFile(cfg.Server.ACLFile); err != nil {
+			return nil, err
+		}
+	}
 
 	if cfg.HTTP.Enabled {
 		httpCfg := &HTTPConfig{
@@ -142,50 +156,146 @@ func New(cfg *config.Config) (*Server, error) {
 		s.httpServer.connCount = func() int64 { return s.connCount.Load() }
 	}
 
-	// Configure AOF persistence
-	if cfg.Persistence.Enabled && cfg.Persistence.AOF {
-		dataDir := cfg.Persistence.DataDir
-		if dataDir == "" {
-			dataDir = "."
-		}
+	dataDir := cfg.Persistence.DataDir
+	if dataDir == "" {
+		dataDir = "."
+	}
+	if cfg.Persistence.Enabled {
 		if err := os.MkdirAll(dataDir, 0755); err != nil {
 			return nil, err
 		}
-		aofCfg := persistence.AOFConfig{
-			Enabled:    true,
-			Filename:   "appendonly.aof",
-			DataDir:    dataDir,
-			SyncPolicy: persistence.SyncPolicyFromString(cfg.Persistence.AOFSync),
+		if cfg.Persistence.AOF {
+			aof, err := newAOFManager(s.store, cfg.Persistence, dataDir)
+			if err != nil {
+				return nil, err
+			}
+			aof.SetWriteBarrier(s.router.PauseWrites)
+			s.aof = aof
 		}
-		s.aof = persistence.NewAOFWriter(aofCfg)
-
-		// Load existing AOF data
-		aofPath := filepath.Join(dataDir, "appendonly.aof")
-		if _, err := os.Stat(aofPath); err == nil {
-			reader := persistence.NewAOFReader()
-			commands, err := reader.Load(aofPath)
+		if cfg.Persistence.RDBFilename != "" {
+			pm, err := newSnapshotManager(s.store, cfg.Persistence, dataDir)
 			if err != nil {
-				logger.Warn().Err(err).Msg("failed to load AOF, starting fresh")
-			} else if len(commands) > 0 {
-				s.replayAOF(commands)
-				logger.Info().Int("commands", len(commands)).Msg("AOF data restored")
+				return nil, err
 			}
+			pm.SetWriteBarrier(s.router.PauseWrites)
+			// A multi-part AOF holds the whole dataset in its base, so the
+			// snapshot is only loaded under a single-file AOF or none
+			if s.aof == nil || !s.aof.Exists() {
+				if err := pm.Load(); err != nil {
+					return nil, err
+				}
+			}
+			s.snapshots = pm
+			command.EnableSnapshots(pm)
+		}
+		bm, err := newBackupManager(s.store, cfg.Persistence, dataDir)
+		if err != nil {
+			return nil, err
 		}
+		bm.SetWriteBarrier(s.router.PauseWrites)
+		command.EnableBackups(bm)
+	}
 
-		// Set post-execute hook on router to persist write commands
-		s.router.SetPostExecute(func(cmd string, args [][]byte) {
-			upperCmd := strings.ToUpper(cmd)
-			if writeCommands[upperCmd] {
-				if err := s.aof.Append(upperCmd, args); err != nil {
-					logger.Error().Err(err).Str("cmd", cmd).Msg("AOF append failed")
-				}
+	if s.aof != nil {
+		if until := cfg.Persistence.AOFRestoreUntil; until != "" {
+			if err := restoreAOF(s.aof, until); err != nil {
+				return nil, err
+			}
+		}
+		commands, err := s.aof.Load()
+		if err != nil {
+			return nil, fmt.Errorf("loading AOF: %w (cachestorm check-aof -fix repairs it)", err)
+		}
+		if len(commands) > 0 {
+			s.replayAOF(commands)
+			logger.Info().Int("commands", len(commands)).Msg("AOF data restored")
+		}
+		// Replayed writes are already on disk
+		if s.snapshots != nil {
+			s.snapshots.ResetDirty()
+		}
+
+		// The router passes every write to the hook, already in the form
+		// to replay
+		s.router.SetPostExecute(func(namespace, cmd string, args [][]byte) {
+			if err := s.aof.Append(namespace, cmd, args); err != nil {
+				logger.Error().Err(err).Str("cmd", cmd).Msg("AOF append failed")
 			}
 		})
+		command.EnableAOF(s.aof)
+	}
+
+	s.setupReplication()
+	if cfg.ActiveActive.Enabled {
+		s.setupActiveActive()
 	}
 
 	return s, nil
 }
 
+// setupReplication applies the master's stream through the router, so a
+// replica's writes reach its AOF like any others, and lets REPLICAOF start
+// and stop replicating.
+func (s *Server) setupReplication() {
+	s.repl = replication.NewManager(&s.cfg.Replication, s.store)
+	s.repl.SetWriteBarrier(s.router.PauseWrites)
+	s.router.SetReplicationFeed(s.repl.Feed)
+	command.EnableReplication(s.repl)
+	// One session for the whole stream, since SELECT carries over between
+	// commands
+	sess := command.NewSession(0, "master")
+	s.repl.SetExecutor(func(name string, args [][]byte) error {
+		ctx := command.NewContextWithSession(strings.ToUpper(name), args, s.store, nil, sess)
+		return s.router.ExecuteSilent(ctx)
+	})
+	if s.aof != nil {
+		s.repl.SetAOFSync(s.aof.Flush)
+	}
+	s.repl.OnFullSync(func() {
+		// The AOF describes the dataset the sync replaced
+		if s.aof != nil {
+			if err := s.aof.Rewrite(); err != nil {
+				logger.Error().Err(err).Msg("AOF rewrite after full sync failed")
+			}
+		}
+	})
+
+	rm := command.GetReplicationManager()
+	if s.repl.GetRole() == replication.RoleReplica {
+		rm.ReplicaOf(s.cfg.Replication.MasterHost, s.cfg.Replication.MasterPort)
+	}
+	rm.OnReplicaOf(func(host string, port int) {
+		if host == "" {
+			host, port = "no", 1
+		}
+		if err := s.repl.ReplicaOf(host, port); err != nil {
+			logger.Error().Err(err).Msg("REPLICAOF failed")
+		}
+	})
+}
+
+// setupActiveActive records every write as an operation for the
+// active-active peers, and sends the writes that merging the peers'
+// operations makes to the AOF and the replicas.
+func (s *Server) setupActiveActive() {
+	s.aa = activeactive.NewEngine(&s.cfg.ActiveActive, s.store)
+	s.aa.SetKeys(s.router.Keys)
+	s.aa.SetWriteBarrier(s.router.PauseWrites)
+	s.aa.SetFeed(func(namespace, cmd string, args [][]byte) {
+		if s.aof != nil {
+			if err := s.aof.Append(namespace, cmd, args); err != nil {
+				logger.Error().Err(err).Str("cmd", cmd).Msg("AOF append failed")
+			}
+		}
+		s.repl.Feed(namespace, cmd, args)
+	})
+	s.router.SetReplicationFeed(func(namespace, cmd string, args [][]byte) {
+		s.repl.Feed(namespace, cmd, args)
+		s.aa.Observe(namespace, cmd, args)
+	})
+	command.EnableActiveActive(s.aa)
+}
+
 func (s *Server) Start(_ context.Context) error {
 	// Start AOF writer if configured
 	if s.aof != nil {
@@ -193,6 +303,17 @@ func (s *Server) Start(_ context.Context) error {
 			return err
 		}
 	}
+	if s.snapshots != nil {
+		s.snapshots.StartAutoSave()
+	}
+	if s.repl != nil {
+		if err := s.repl.Start(); err != nil {
+			return fmt.Errorf("starting replication: %w", err)
+		}
+	}
+	if s.aa != nil {
+		s.aa.Start()
+	}
 
 	addr := net.JoinHostPort(s.cfg.Server.Bind, strconv.Itoa(s.cfg.Server.Port))
 
@@ -351,11 +472,27 @@ func (s *Server) Stop(ctx context.Context) error {
 		}
 	}
 
-	// 5. Stop AOF writer (flush remaining data)
+	// 5. Drop the links to the master and the peers so no more writes arrive
+	if s.repl != nil {
+		s.repl.Stop()
+	}
+	if s.aa != nil {
+		s.aa.Stop()
+	}
+
+	// 6. Save a final snapshot if anything changed since the last one
+	if s.snapshots != nil {
+		s.snapshots.Stop()
+	}
+
+	// 7. Stop AOF writer (flush remaining data)
 	if s.aof != nil {
 		s.aof.Stop()
 	}
 
+	// 8. Remove the disk tier's segments, which only mean anything to this process
+	s.store.CloseTier()
+
 	logger.Info().Msg("CacheStorm server stopped")
 	return nil
 }
@@ -364,11 +501,103 @@ func (s *Server) Store() *store.Store {
 	return s.store
 }
 
+// newSnapshotManager configures RDB snapshots from the save rules and
+// snapshot_interval, which saves whenever anything changed in the interval.
+func newSnapshotManager(st *store.Store, cfg config.PersistenceConfig, dataDir string) (*persistence.PersistenceManager, error) {
+	rules, err := persistence.ParseSaveRules(cfg.Save)
+	if err != nil {
+		return nil, fmt.Errorf("invalid persistence.save: %w", err)
+	}
+	var interval time.Duration
+	if cfg.SnapshotInterval != "" {
+		interval, err = time.ParseDuration(cfg.SnapshotInterval)
+		if err != nil || interval < 0 {
+			return nil, fmt.Errorf("invalid persistence.snapshot_interval %q", cfg.SnapshotInterval)
+		}
+	}
+	return persistence.NewPersistenceManager(st, persistence.Config{
+		DataDir:     dataDir,
+		RDBEnabled:  true,
+		RDBFilename: cfg.RDBFilename,
+		RDBInterval: interval,
+		SaveRules:   rules,
+	}), nil
+}
+
+// newAOFManager configures the multi-part AOF and its automatic rewrites.
+func newAOFManager(st *store.Store, cfg config.PersistenceConfig, dataDir string) (*persistence.AOFManager, error) {
+	maxSize, err := config.ParseMemorySize(cfg.MaxAOFSize)
+	if err != nil {
+		return nil, fmt.Errorf("invalid persistence.max_aof_size: %w", err)
+	}
+	minSize, err := config.ParseMemorySize(cfg.AOFRewriteMinSize)
+	if err != nil {
+		return nil, fmt.Errorf("invalid persistence.aof_rewrite_min_size: %w", err)
+	}
+	return persistence.NewAOFManager(persistence.AOFConfig{
+		Enabled:       true,
+		Filename:      "appendonly.aof",
+		DataDir:       dataDir,
+		SyncPolicy:    persistence.SyncPolicyFromString(cfg.AOFSync),
+		RewriteSize:   minSize,
+		RewritePct:    cfg.AOFRewritePercentage,
+		MaxSize:       maxSize,
+		AutoRewrite:   true,
+		LoadTruncated: cfg.AOFLoadTruncated,
+		Timestamps:    cfg.AOFTimestampEnabled,
+	}, st), nil
+}
+
+// newBackupManager configures the BACKUP.* directory and retention.
+func newBackupManager(st *store.Store, cfg config.PersistenceConfig, dataDir string) (*persistence.BackupManager, error) {
+	dir := cfg.BackupDir
+	if dir == "" {
+		dir = filepath.Join(dataDir, "backups")
+	}
+	if cfg.BackupRetention < 0 {
+		return nil, fmt.Errorf("invalid persistence.backup_retention %d", cfg.BackupRetention)
+	}
+	var maxAge time.Duration
+	if cfg.BackupMaxAge != "" {
+		var err error
+		maxAge, err = time.ParseDuration(cfg.BackupMaxAge)
+		if err != nil || maxAge < 0 {
+			return nil, fmt.Errorf("invalid persistence.backup_max_age %q", cfg.BackupMaxAge)
+		}
+	}
+	return persistence.NewBackupManager(st, persistence.BackupConfig{
+		Dir:       dir,
+		Retention: cfg.BackupRetention,
+		MaxAge:    maxAge,
+	}), nil
+}
+
+// restoreAOF cuts the AOF back to persistence.aof_restore_until. A restore
+// already made is not repeated, as it would drop the writes made since.
+func restoreAOF(aof *persistence.AOFManager, until string) error {
+	t, err := time.Parse(time.RFC3339, until)
+	if err != nil {
+		return fmt.Errorf("invalid persistence.aof_restore_until: %w", err)
+	}
+	_, err = aof.RestoreUntil(t)
+	if errors.Is(err, persistence.ErrAOFRestored) {
+		logger.Info().Str("until", until).Msg("AOF already restored to aof_restore_until, remove the setting")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("restoring AOF until %s: %w", until, err)
+	}
+	return nil
+}
+
 func (s *Server) replayAOF(commands []persistence.Command) {
 	replayed := 0
 	failed := 0
+	// One session for the whole file, since SELECT carries over between
+	// commands
+	sess := command.NewSession(0, "aof")
 	for _, cmd := range commands {
-		ctx := command.NewContext(cmd.Name, cmd.Args, s.store, nil)
+		ctx := command.NewContextWithSession(strings.ToUpper(cmd.Name), cmd.Args, s.store, nil, sess)
 		if err := s.router.ExecuteSilent(ctx); err != nil {
 			failed++
 			if failed <= 10 {
@@ -2724,12 +2724,8 @@ func TestNewServerWithCorruptAOF(t *testing.T) {
 		},
 	}
 
-	s, err := New(cfg)
-	if err != nil {
-		t.Fatalf("unexpected error: %v", err)
-	}
-	if s == nil {
-		t.Fatal("expected server even with corrupt AOF")
+	if _, err := New(cfg); err == nil {
+		t.Fatal("expected a corrupt AOF to stop startup")
 	}
 }
 
@@ -40,6 +40,50 @@ func TestNewServer(t *testing.T) {
 	}
 }
 
+func TestRegisteredReadCommandsAreNotWrites(t *testing.T) {
+	s, err := New(&config.Config{Server: config.ServerConfig{Bind: "127.0.0.1", Port: 6380}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	readVerbs := map[string]bool{
+		"AVAILABLE": true, "BULKGET": true, "CHECK": true, "EXISTS": true,
+		"GET": true, "GETALL": true, "INCLUDES": true, "INDEXOF": true,
+		"INFO": true, "LASTINDEXOF": true, "LIST": true, "_LIST": true,
+		"MEXISTS": true, "MGET": true, "PEEK": true, "QUERY": true,
+		"RANGE": true, "REVRANGE": true, "SEARCH": true, "VALUE": true,
+	}
+	// These use up what they check: a rate limit's request, a quota.
+	consuming := map[string]bool{
+		"BACKPRESSURE.CHECK": true, "CANARY.CHECK": true, "HEALTHX.CHECK": true,
+		"QUOTAX.CHECK": true, "RATELIMIT.CHECK": true, "SLIDING.CHECK": true,
+		"THROTTLEX.CHECK": true,
+	}
+	checked := 0
+	for name, def := range s.router.Commands() {
+		dot := strings.LastIndexByte(name, '.')
+		if dot < 0 || !readVerbs[name[dot+1:]] || consuming[name] {
+			continue
+		}
+		checked++
+		if def.HasFlag(command.FlagWrite) {
+			t.Errorf("%s is flagged write", name)
+		}
+	}
+	if checked < 100 {
+		t.Errorf("only %d read commands checked", checked)
+	}
+	for _, name := range []string{"CMS.QUERY", "TOPK.QUERY", "GRAPH.QUERY", "TS.GET", "FT._LIST"} {
+		if def, _ := s.router.Get(name); !def.HasFlag(command.FlagReadOnly) {
+			t.Errorf("%s is not flagged readonly: %v", name, def.Flags)
+		}
+	}
+	for _, name := range []string{"BF.ADD", "TS.MADD", "FT.CREATE", "GRAPH.ADDNODE", "BATCH.SET"} {
+		if def, _ := s.router.Get(name); !def.HasFlag(command.FlagWrite) || def.FirstKey != 1 {
+			t.Errorf("%s: flags %v, first key %d", name, def.Flags, def.FirstKey)
+		}
+	}
+}
+
 func TestNewServerWithHTTP(t *testing.T) {
 	cfg := &config.Config{
 		Server: config.ServerConfig{
@@ -224,6 +268,52 @@ func TestHTTPServerKeysPOST(t *testing.T) {
 	}
 }
 
+func TestHTTPServerExportImport(t *testing.T) {
+	// Servers started by earlier tests leave their stopped AOF and
+	// replication registered.
+	command.EnableAOF(nil)
+	command.EnableReplication(nil)
+	h := newTestHTTPServerWithNamespaces()
+	h.store.Set("user:1", &store.StringValue{Data: []byte("ada")}, store.SetOptions{Tags: []string{"users"}})
+	h.store.Set("order:1", &store.StringValue{Data: []byte("o")}, store.SetOptions{})
+	h.store.ForNamespace("db1").Set("user:2", &store.ListValue{Elements: [][]byte{[]byte("x")}}, store.SetOptions{})
+
+	req := httptest.NewRequest("GET", "/api/export?match=user:*", nil)
+	w := httptest.NewRecorder()
+	h.handleExport(w, req)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("export status %d, content type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	dump := w.Body.String()
+	if lines := strings.Count(dump, "\n"); lines != 2 {
+		t.Fatalf("exported %d records, want 2:\n%s", lines, dump)
+	}
+
+	target := newTestHTTPServerWithNamespaces()
+	req = httptest.NewRequest("POST", "/api/import", strings.NewReader(dump))
+	w = httptest.NewRecorder()
+	target.handleImport(w, req)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"imported":2`) {
+		t.Fatalf("import status %d: %s", w.Code, w.Body.String())
+	}
+	if e, ok := target.store.Get("user:1"); !ok || e.Value.String() != "ada" || len(e.Tags) != 1 {
+		t.Errorf("user:1 = %+v", e)
+	}
+	if _, ok := target.store.ForNamespace("db1").Get("user:2"); !ok {
+		t.Error("namespaced key not imported")
+	}
+	if _, ok := target.store.Get("order:1"); ok {
+		t.Error("key outside the pattern imported")
+	}
+
+	req = httptest.NewRequest("POST", "/api/import", strings.NewReader("{}\n"))
+	w = httptest.NewRecorder()
+	target.handleImport(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("invalid upload status %d", w.Code)
+	}
+}
+
 func TestHTTPServerKeyGET(t *testing.T) {
 	h := newTestHTTPServer()
 	h.store.Set("mykey", &store.StringValue{Data: []byte("myvalue")}, store.SetOptions{})
@@ -1353,3 +1443,43 @@ func TestConnectionHandleMultipleCommands(t *testing.T) {
 		conn.Close()
 	}
 }
+
+func TestHTTPCommandsRunLikeClientCommands(t *testing.T) {
+	s := store.NewStoreWithNamespaces()
+	router := newSessionTestRouter()
+	client := dialTestClient(t, startTestConnections(t, s, router))
+	httpDo := func(cmd string, args ...string) error {
+		argv := make([][]byte, len(args))
+		for i, a := range args {
+			argv[i] = []byte(a)
+		}
+		_, err := router.ExecuteHTTP(&command.Context{Command: cmd, Args: argv, Store: s})
+		return err
+	}
+
+	// A write through the API aborts a transaction watching its key, even
+	// one changing a value in place
+	if err := httpDo("HSET", "h", "f", "1"); err != nil {
+		t.Fatal(err)
+	}
+	client.do("WATCH", "h")
+	if err := httpDo("HSET", "h", "f", "2"); err != nil {
+		t.Fatal(err)
+	}
+	client.do("MULTI")
+	client.do("SET", "k", "mine")
+	if v := client.do("EXEC"); !v.IsNull {
+		t.Errorf("EXEC after a write through the API = %+v", v)
+	}
+
+	if err := httpDo("GET"); err == nil || !strings.Contains(err.Error(), "wrong number of arguments") {
+		t.Errorf("GET without a key err = %v", err)
+	}
+	router.ACL().DefaultUser.DenyCommand("del")
+	if err := httpDo("DEL", "h"); err == nil || !strings.Contains(err.Error(), "NOPERM") {
+		t.Errorf("DEL denied by ACL err = %v", err)
+	}
+	if _, ok := s.Get("h"); !ok {
+		t.Error("the denied DEL ran")
+	}
+}
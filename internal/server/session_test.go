@@ -0,0 +1,267 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cachestorm/cachestorm/internal/command"
+	"github.com/cachestorm/cachestorm/internal/resp"
+	"github.com/cachestorm/cachestorm/internal/store"
+)
+
+// testClient speaks RESP to a Connection over a real TCP socket.
+type testClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *resp.Reader
+}
+
+// testConnID hands out connection IDs that are unique across tests, since
+// sessions are registered globally by ID.
+var testConnID atomic.Int64
+
+// startTestConnections serves every accepted socket with a Connection bound
+// to the given store and router, and returns the listener address.
+func startTestConnections(t *testing.T, s *store.Store, router *command.Router) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go NewConnection(testConnID.Add(1), conn, s, router).Handle()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func dialTestClient(t *testing.T, addr string) *testClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testClient{t: t, conn: conn, reader: resp.NewReader(bufio.NewReader(conn))}
+}
+
+func (c *testClient) send(args ...string) {
+	c.t.Helper()
+	items := make([]*resp.Value, len(args))
+	for i, a := range args {
+		items[i] = resp.BulkString(a)
+	}
+	w := resp.NewWriter(c.conn)
+	if err := w.WriteArray(items); err != nil {
+		c.t.Fatalf("write error: %v", err)
+	}
+}
+
+func (c *testClient) read() *resp.Value {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	v, err := c.reader.ReadValue()
+	if err != nil {
+		c.t.Fatalf("read error: %v", err)
+	}
+	return v
+}
+
+func (c *testClient) do(args ...string) *resp.Value {
+	c.t.Helper()
+	c.send(args...)
+	return c.read()
+}
+
+func newSessionTestRouter() *command.Router {
+	router := command.NewRouter()
+	command.RegisterServerCommands(router)
+	command.RegisterStringCommands(router)
+	command.RegisterKeyCommands(router)
+	command.RegisterHashCommands(router)
+	command.RegisterTransactionCommands(router)
+	command.RegisterNamespaceCommands(router)
+	command.RegisterClientCommands(router)
+	return router
+}
+
+func TestSessionMultiExecQueuesAcrossCommands(t *testing.T) {
+	s := store.NewStoreWithNamespaces()
+	addr := startTestConnections(t, s, newSessionTestRouter())
+	c := dialTestClient(t, addr)
+
+	if v := c.do("MULTI"); v.Str != "OK" {
+		t.Fatalf("MULTI: %+v", v)
+	}
+	if v := c.do("SET", "k", "v"); v.Str != "QUEUED" {
+		t.Fatalf("SET in MULTI: %+v", v)
+	}
+	if v := c.do("HSET", "h", "f", "1"); v.Str != "QUEUED" {
+		t.Fatalf("HSET in MULTI: %+v", v)
+	}
+	if _, ok := s.Get("k"); ok {
+		t.Fatal("queued SET must not run before EXEC")
+	}
+
+	v := c.do("EXEC")
+	if v.Type != resp.TypeArray || len(v.Array) != 2 {
+		t.Fatalf("EXEC: %+v", v)
+	}
+	if v.Array[0].Str != "OK" || v.Array[1].Int != 1 {
+		t.Errorf("EXEC results: %+v %+v", v.Array[0], v.Array[1])
+	}
+	if _, ok := s.Get("h"); !ok {
+		t.Error("HSET from transaction was not applied")
+	}
+}
+
+func TestSessionUnknownCommandAbortsExec(t *testing.T) {
+	addr := startTestConnections(t, store.NewStore(), newSessionTestRouter())
+	c := dialTestClient(t, addr)
+
+	c.do("MULTI")
+	c.do("SET", "k", "v")
+	if v := c.do("NOSUCHCMD"); v.Type != resp.TypeError {
+		t.Fatalf("expected error, got %+v", v)
+	}
+	if v := c.do("EXEC"); v.Type != resp.TypeError || v.Err[:9] != "EXECABORT" {
+		t.Fatalf("expected EXECABORT, got %+v", v)
+	}
+}
+
+func TestSessionWatchAbortsOnConcurrentWrite(t *testing.T) {
+	addr := startTestConnections(t, store.NewStore(), newSessionTestRouter())
+	a := dialTestClient(t, addr)
+	b := dialTestClient(t, addr)
+
+	a.do("HSET", "balance", "amount", "10")
+	a.do("WATCH", "balance")
+	b.do("HSET", "balance", "amount", "20")
+
+	a.do("MULTI")
+	a.do("HSET", "balance", "amount", "11")
+	if v := a.do("EXEC"); !v.IsNull {
+		t.Fatalf("expected nil EXEC after concurrent write, got %+v", v)
+	}
+
+	// Watches are dropped after EXEC, so the retry succeeds
+	a.do("WATCH", "balance")
+	a.do("MULTI")
+	a.do("HSET", "balance", "amount", "21")
+	if v := a.do("EXEC"); v.Type != resp.TypeArray || len(v.Array) != 1 {
+		t.Fatalf("expected retry to commit, got %+v", v)
+	}
+}
+
+func TestSessionSelectIsolatesKeyspaces(t *testing.T) {
+	s := store.NewStoreWithNamespaces()
+	addr := startTestConnections(t, s, newSessionTestRouter())
+	c := dialTestClient(t, addr)
+
+	c.do("SET", "k", "zero")
+	if v := c.do("SELECT", "1"); v.Str != "OK" {
+		t.Fatalf("SELECT: %+v", v)
+	}
+	if v := c.do("GET", "k"); !v.IsNull {
+		t.Fatalf("expected empty db1, got %+v", v)
+	}
+	c.do("SET", "k", "one")
+	c.do("SELECT", "0")
+	if v := c.do("GET", "k"); string(v.Bulk) != "zero" {
+		t.Fatalf("expected db0 value, got %+v", v)
+	}
+
+	other := dialTestClient(t, addr)
+	if v := other.do("GET", "k"); string(v.Bulk) != "zero" {
+		t.Fatalf("new connection must start in db0, got %+v", v)
+	}
+}
+
+func TestSessionAuthPersists(t *testing.T) {
+	router := newSessionTestRouter()
+	router.SetRequirePass("secret")
+	addr := startTestConnections(t, store.NewStore(), router)
+	c := dialTestClient(t, addr)
+
+	if v := c.do("GET", "k"); v.Type != resp.TypeError {
+		t.Fatalf("expected NOAUTH, got %+v", v)
+	}
+	if v := c.do("AUTH", "secret"); v.Str != "OK" {
+		t.Fatalf("AUTH: %+v", v)
+	}
+	if v := c.do("GET", "k"); v.Type == resp.TypeError {
+		t.Fatalf("expected authenticated session, got %+v", v)
+	}
+	if v := c.do("CLIENT", "SETNAME", "worker"); v.Str != "OK" {
+		t.Fatalf("CLIENT SETNAME: %+v", v)
+	}
+	if v := c.do("CLIENT", "GETNAME"); string(v.Bulk) != "worker" {
+		t.Fatalf("CLIENT GETNAME: %+v", v)
+	}
+}
+
+func TestSessionHelloNegotiatesRESP3(t *testing.T) {
+	router := newSessionTestRouter()
+	command.RegisterSortedSetCommands(router)
+	addr := startTestConnections(t, store.NewStore(), router)
+	c := dialTestClient(t, addr)
+
+	// RESP2 by default: missing values are null bulk strings
+	c.send("ZSCORE", "z", "m")
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	line, _ := bufio.NewReader(c.conn).ReadString('\n')
+	if line != "$-1\r\n" {
+		t.Fatalf("expected RESP2 null, got %q", line)
+	}
+
+	c = dialTestClient(t, addr)
+	v := c.do("HELLO", "3", "SETNAME", "near-cache")
+	if v.Type != resp.TypeMap || v.Map["proto"].Int != 3 {
+		t.Fatalf("HELLO 3: %+v", v)
+	}
+	if v := c.do("CLIENT", "GETNAME"); string(v.Bulk) != "near-cache" {
+		t.Errorf("SETNAME via HELLO: %+v", v)
+	}
+
+	c.do("HSET", "h", "f", "v")
+	if v := c.do("HGETALL", "h"); v.Type != resp.TypeMap || string(v.Map["f"].Bulk) != "v" {
+		t.Errorf("HGETALL in RESP3: %+v", v)
+	}
+	c.do("ZADD", "z", "1.5", "m")
+	if v := c.do("ZSCORE", "z", "m"); v.Type != resp.TypeDouble || v.Float != 1.5 {
+		t.Errorf("ZSCORE in RESP3: %+v", v)
+	}
+	if v := c.do("HELLO", "4"); v.Type != resp.TypeError || v.Err[:7] != "NOPROTO" {
+		t.Errorf("HELLO 4: %+v", v)
+	}
+}
+
+func TestSessionHelloAuth(t *testing.T) {
+	router := newSessionTestRouter()
+	router.SetRequirePass("secret")
+	addr := startTestConnections(t, store.NewStore(), router)
+	c := dialTestClient(t, addr)
+
+	if v := c.do("HELLO", "3"); v.Type != resp.TypeError {
+		t.Fatalf("expected NOAUTH, got %+v", v)
+	}
+	if v := c.do("HELLO", "3", "AUTH", "default", "wrong"); v.Type != resp.TypeError {
+		t.Fatalf("expected WRONGPASS, got %+v", v)
+	}
+	if v := c.do("HELLO", "3", "AUTH", "default", "secret"); v.Type != resp.TypeMap {
+		t.Fatalf("expected handshake map, got %+v", v)
+	}
+	if v := c.do("GET", "k"); v.Type != resp.TypeNull {
+		t.Errorf("expected RESP3 null after HELLO AUTH, got %+v", v)
+	}
+}
@@ -0,0 +1,252 @@
+package server
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cachestorm/cachestorm/internal/command"
+	"github.com/cachestorm/cachestorm/internal/resp"
+	"github.com/cachestorm/cachestorm/internal/store"
+)
+
+func startTrackingTest(t *testing.T) string {
+	t.Helper()
+	s := store.NewStoreWithNamespaces()
+	command.EnableTracking(s)
+	router := newSessionTestRouter()
+	command.RegisterPubSubCommands(router)
+	return startTestConnections(t, s, router)
+}
+
+// expectInvalidate reads the next frame and checks it is an invalidation of
+// keys; no keys means a flush (null payload).
+func expectInvalidate(t *testing.T, c *testClient, keys ...string) {
+	t.Helper()
+	v := c.read()
+	if v.Type != resp.TypePush || len(v.Array) != 2 || string(v.Array[0].Bulk) != "invalidate" {
+		t.Fatalf("expected invalidate push, got %+v", v)
+	}
+	if len(keys) == 0 {
+		if !v.Array[1].IsNull {
+			t.Fatalf("expected flush invalidation, got %+v", v.Array[1])
+		}
+		return
+	}
+	if len(v.Array[1].Array) != len(keys) {
+		t.Fatalf("expected keys %v, got %+v", keys, v.Array[1])
+	}
+	for i, key := range keys {
+		if got := string(v.Array[1].Array[i].Bulk); got != key {
+			t.Errorf("key %d: expected %q, got %q", i, key, got)
+		}
+	}
+}
+
+// expectNoPush checks that nothing is queued ahead of the next reply.
+func expectNoPush(t *testing.T, c *testClient) {
+	t.Helper()
+	if v := c.do("PING"); v.Str != "PONG" {
+		t.Fatalf("expected no pending push, got %+v", v)
+	}
+}
+
+func TestTrackingDefaultModeInvalidatesReadKeys(t *testing.T) {
+	addr := startTrackingTest(t)
+	reader := dialTestClient(t, addr)
+	writer := dialTestClient(t, addr)
+
+	reader.do("HELLO", "3")
+	if v := reader.do("CLIENT", "TRACKING", "ON"); v.Str != "OK" {
+		t.Fatalf("CLIENT TRACKING ON: %+v", v)
+	}
+	writer.do("SET", "k", "v1")
+	reader.do("GET", "k")
+
+	writer.do("SET", "k", "v2")
+	expectInvalidate(t, reader, "k")
+
+	// Tracking is one-shot until the key is read again
+	writer.do("SET", "k", "v3")
+	expectNoPush(t, reader)
+
+	reader.do("HGETALL", "h")
+	writer.do("HSET", "h", "f", "1")
+	expectInvalidate(t, reader, "h")
+
+	writer.do("SET", "untracked", "x")
+	expectNoPush(t, reader)
+}
+
+func TestTrackingInvalidatesOnExpiryAndFlush(t *testing.T) {
+	addr := startTrackingTest(t)
+	reader := dialTestClient(t, addr)
+	writer := dialTestClient(t, addr)
+
+	reader.do("HELLO", "3")
+	reader.do("CLIENT", "TRACKING", "ON")
+	writer.do("SET", "session", "abc", "PX", "20")
+	reader.do("GET", "session")
+
+	time.Sleep(40 * time.Millisecond)
+	writer.do("EXISTS", "session")
+	expectInvalidate(t, reader, "session")
+
+	writer.do("FLUSHALL")
+	expectInvalidate(t, reader)
+}
+
+func TestTrackingBroadcastPrefixes(t *testing.T) {
+	addr := startTrackingTest(t)
+	reader := dialTestClient(t, addr)
+	writer := dialTestClient(t, addr)
+
+	reader.do("HELLO", "3")
+	if v := reader.do("CLIENT", "TRACKING", "ON", "BCAST", "PREFIX", "user:"); v.Str != "OK" {
+		t.Fatalf("CLIENT TRACKING BCAST: %+v", v)
+	}
+
+	writer.do("SET", "user:1", "alice")
+	expectInvalidate(t, reader, "user:1")
+	writer.do("SET", "user:1", "bob")
+	expectInvalidate(t, reader, "user:1")
+	writer.do("SET", "order:1", "x")
+	expectNoPush(t, reader)
+
+	v := reader.do("CLIENT", "TRACKINGINFO")
+	if v.Type != resp.TypeMap || len(v.Map["flags"].Array) != 2 || string(v.Map["flags"].Array[1].Bulk) != "bcast" {
+		t.Errorf("CLIENT TRACKINGINFO: %+v", v)
+	}
+}
+
+func TestTrackingRedirectToRESP2Subscriber(t *testing.T) {
+	addr := startTrackingTest(t)
+	listener := dialTestClient(t, addr)
+	reader := dialTestClient(t, addr)
+	writer := dialTestClient(t, addr)
+
+	id := listener.do("CLIENT", "ID").Int
+	listener.send("SUBSCRIBE", "__redis__:invalidate")
+	listener.read()
+
+	if v := reader.do("CLIENT", "TRACKING", "ON", "REDIRECT", strconv.FormatInt(id, 10)); v.Str != "OK" {
+		t.Fatalf("CLIENT TRACKING REDIRECT: %+v", v)
+	}
+	if v := reader.do("CLIENT", "GETREDIR"); v.Int != id {
+		t.Errorf("CLIENT GETREDIR: %+v", v)
+	}
+	reader.do("GET", "k")
+	writer.do("DEL", "k")
+	writer.do("SET", "k", "v")
+
+	v := listener.read()
+	if len(v.Array) != 3 || string(v.Array[1].Bulk) != "__redis__:invalidate" || len(v.Array[2].Array) != 1 || string(v.Array[2].Array[0].Bulk) != "k" {
+		t.Fatalf("expected invalidation message for k, got %+v", v)
+	}
+	if v := reader.do("CLIENT", "TRACKING", "ON", "REDIRECT", "999999"); v.Type != resp.TypeError {
+		t.Errorf("expected error for unknown redirect target, got %+v", v)
+	}
+}
+
+func TestTrackingOptInAndNoLoop(t *testing.T) {
+	addr := startTrackingTest(t)
+	reader := dialTestClient(t, addr)
+	writer := dialTestClient(t, addr)
+
+	reader.do("HELLO", "3")
+	if v := reader.do("CLIENT", "CACHING", "YES"); v.Type != resp.TypeError {
+		t.Fatalf("expected CLIENT CACHING to require OPTIN, got %+v", v)
+	}
+	reader.do("CLIENT", "TRACKING", "ON", "OPTIN", "NOLOOP")
+
+	reader.do("GET", "a")
+	if v := reader.do("CLIENT", "CACHING", "YES"); v.Str != "OK" {
+		t.Fatalf("CLIENT CACHING YES: %+v", v)
+	}
+	reader.do("GET", "b")
+
+	writer.do("SET", "a", "1")
+	writer.do("SET", "b", "1")
+	expectInvalidate(t, reader, "b")
+	expectNoPush(t, reader)
+
+	// NOLOOP: the client's own writes do not invalidate its cache
+	reader.do("CLIENT", "CACHING", "YES")
+	reader.do("GET", "b")
+	reader.do("SET", "b", "2")
+	expectNoPush(t, reader)
+}
+
+func TestTrackingRegistersKeysBeforeReading(t *testing.T) {
+	s := store.NewStoreWithNamespaces()
+	command.EnableTracking(s)
+	router := newSessionTestRouter()
+	// A read during which the key is written, as by another client
+	router.Register(&command.CommandDef{
+		Name: "RACYGET", Arity: 2, Flags: []string{command.FlagReadOnly}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+		Handler: func(ctx *command.Context) error {
+			ctx.Store.Set(ctx.ArgString(0), &store.StringValue{Data: []byte("new")}, store.SetOptions{})
+			return ctx.WriteBulkString("old")
+		},
+	})
+	reader := dialTestClient(t, startTestConnections(t, s, router))
+
+	reader.do("HELLO", "3")
+	reader.do("CLIENT", "TRACKING", "ON")
+	reader.send("RACYGET", "k")
+	v := reader.read()
+	if v.Type == resp.TypePush {
+		v = reader.read()
+	} else {
+		expectInvalidate(t, reader, "k")
+	}
+	if string(v.Bulk) != "old" {
+		t.Errorf("RACYGET = %+v", v)
+	}
+}
+
+func TestTrackingPushesReachBlockedClients(t *testing.T) {
+	s := store.NewStoreWithNamespaces()
+	command.EnableTracking(s)
+	router := newSessionTestRouter()
+	command.RegisterListCommands(router)
+	addr := startTestConnections(t, s, router)
+	reader := dialTestClient(t, addr)
+	writer := dialTestClient(t, addr)
+
+	reader.do("HELLO", "3")
+	reader.do("CLIENT", "TRACKING", "ON")
+	reader.do("GET", "k")
+	reader.send("BLPOP", "list", "10")
+	time.Sleep(50 * time.Millisecond)
+	writer.do("SET", "k", "v")
+	expectInvalidate(t, reader, "k")
+
+	writer.do("LPUSH", "list", "x")
+	if v := reader.read(); len(v.Array) != 2 || string(v.Array[1].Bulk) != "x" {
+		t.Errorf("BLPOP = %+v", v)
+	}
+}
+
+func TestConnectionClosedWhenPushesOverflow(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := NewConnection(testConnID.Add(1), server, store.NewStore(), newSessionTestRouter())
+	go conn.Handle()
+
+	// Nothing reads the pipe, so the first push is never written
+	for i := 0; i <= 300; i++ {
+		conn.Session().Push(resp.SimpleString("x"))
+	}
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1024)
+	for {
+		if _, err := client.Read(buf); err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				t.Fatal("the connection of a client not reading its pushes stayed open")
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package store
+
+import (
+	"time"
+
+	"github.com/cachestorm/cachestorm/internal/crdt"
+)
+
+// grave is the CRDT metadata a deleted key left behind.
+type grave struct {
+	meta *crdt.Meta
+	at   time.Time
+}
+
+// bury keeps the CRDT metadata of an entry leaving the shard. Called with
+// s.mu held.
+func (s *Shard) bury(key string, entry *Entry) {
+	if entry.CRDT == nil {
+		return
+	}
+	if s.graves == nil {
+		s.graves = make(map[string]grave)
+	}
+	s.graves[key] = grave{meta: entry.CRDT, at: time.Now()}
+}
+
+// unbury hands the metadata a deleted key left to the entry recreating
+// it. Called with s.mu held.
+func (s *Shard) unbury(key string, entry *Entry) {
+	g, ok := s.graves[key]
+	if !ok {
+		return
+	}
+	delete(s.graves, key)
+	if entry.CRDT == nil {
+		entry.CRDT = g.meta
+	}
+}
+
+// CRDT returns the active-active metadata of key: its entry's, or the one
+// the key left when it was deleted, expired or evicted.
+func (s *Store) CRDT(key string) (*crdt.Meta, bool) {
+	shard := s.shards[s.shardIndex(key)]
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	if entry, ok := shard.data[key]; ok {
+		return entry.CRDT, entry.CRDT != nil
+	}
+	g, ok := shard.graves[key]
+	return g.meta, ok
+}
+
+// SetCRDT makes m the active-active metadata of key, on its entry if it
+// exists and as left by a deleted key otherwise.
+func (s *Store) SetCRDT(key string, m *crdt.Meta) {
+	shard := s.shards[s.shardIndex(key)]
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if entry, ok := shard.data[key]; ok {
+		entry.CRDT = m
+		return
+	}
+	if shard.graves == nil {
+		shard.graves = make(map[string]grave)
+	}
+	shard.graves[key] = grave{meta: m, at: time.Now()}
+}
+
+// RangeCRDT calls fn with every key that has active-active metadata, live
+// or deleted.
+func (s *Store) RangeCRDT(fn func(key string, m *crdt.Meta)) {
+	type keyMeta struct {
+		key  string
+		meta *crdt.Meta
+	}
+	for _, shard := range s.shards {
+		var metas []keyMeta
+		shard.mu.RLock()
+		for key, entry := range shard.data {
+			if entry.CRDT != nil {
+				metas = append(metas, keyMeta{key, entry.CRDT})
+			}
+		}
+		for key, g := range shard.graves {
+			metas = append(metas, keyMeta{key, g.meta})
+		}
+		shard.mu.RUnlock()
+		for _, km := range metas {
+			fn(km.key, km.meta)
+		}
+	}
+}
+
+// PruneCRDT forgets the metadata of keys deleted before t and returns how
+// many it dropped. A write made elsewhere before the delete but arriving
+// after this can bring such a key back.
+func (s *Store) PruneCRDT(t time.Time) int {
+	pruned := 0
+	for _, shard := range s.shards {
+		shard.mu.Lock()
+		for key, g := range shard.graves {
+			if g.at.Before(t) {
+				delete(shard.graves, key)
+				pruned++
+			}
+		}
+		shard.mu.Unlock()
+	}
+	return pruned
+}
@@ -4,6 +4,8 @@ import (
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/cachestorm/cachestorm/internal/crdt"
 )
 
 type DataType uint8
@@ -196,6 +198,10 @@ type Entry struct {
 	CreatedAt   int64
 	LastAccess  atomic.Int64
 	AccessCount atomic.Uint64
+	// CRDT is the key's metadata under active-active replication, nil
+	// without it. It carries over to the entries replacing this one and,
+	// once the key is deleted, stays with the shard; see Store.CRDT.
+	CRDT *crdt.Meta
 }
 
 func NewEntry(value Value) *Entry {
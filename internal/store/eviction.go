@@ -100,6 +100,19 @@ func (ec *EvictionController) evictOne() bool {
 		return false
 	}
 
+	// With a disk tier the victim's value moves to disk and the key stays.
+	// Keys already on disk, values that cannot be encoded and shards being
+	// written to are evicted as they would be without one.
+	if ec.store.tier != nil {
+		err := ec.store.spill(key)
+		if err == nil {
+			return true
+		}
+		if err != errTierCold && err != errTierBusy && err != ErrKeyNotFound {
+			logger.Warn().Err(err).Str("key", key).Msg("moving value to disk tier failed, evicting key")
+		}
+	}
+
 	// Get entry before deleting to avoid race condition
 	// where key could be re-created between Delete and Get
 	var entry *Entry
@@ -185,41 +198,87 @@ func (ec *EvictionController) selectRandom() string {
 	shard := ec.store.shards[shardIdx]
 	shard.mu.RLock()
 	defer shard.mu.RUnlock()
-	for key := range shard.data {
-		return key
+	key, _ := ec.pick(shard)
+	return key
+}
+
+// pick returns a key of the shard, preferring one whose value is in memory
+// when the store has a disk tier, so eviction moves values to disk before
+// evicting the keys already there. Called with shard.mu held.
+func (ec *EvictionController) pick(shard *Shard) (string, *Entry) {
+	var coldKey string
+	var coldEntry *Entry
+	for key, entry := range shard.data {
+		if ec.store.tier == nil || !entry.isCold() {
+			return key, entry
+		}
+		if coldEntry == nil {
+			coldKey, coldEntry = key, entry
+		}
+		if shard.cold == int64(len(shard.data)) {
+			break
+		}
 	}
-	return ""
+	return coldKey, coldEntry
 }
 
 func (ec *EvictionController) sampleKeys() []candidate {
 	candidates := make([]candidate, 0, ec.sampleSize)
+	var cold []candidate
 
-	for i := 0; i < ec.sampleSize; i++ {
+	for i := 0; i < ec.sampleSize*2 && len(candidates) < ec.sampleSize; i++ {
 		ec.rndMu.Lock()
 		shardIdx := ec.rnd.Intn(NumShards)
 		ec.rndMu.Unlock()
 		shard := ec.store.shards[shardIdx]
 
 		shard.mu.RLock()
-		if len(shard.data) == 0 {
-			shard.mu.RUnlock()
-			continue
-		}
-
-		for key, entry := range shard.data {
-			candidates = append(candidates, candidate{
+		if key, entry := ec.pick(shard); entry != nil {
+			c := candidate{
 				key:         key,
 				lastAccess:  entry.LastAccess.Load(),
 				accessCount: entry.AccessCount.Load(),
-			})
-			break
+			}
+			if entry.isCold() {
+				cold = append(cold, c)
+			} else {
+				candidates = append(candidates, c)
+			}
 		}
 		shard.mu.RUnlock()
 	}
 
+	// Keys already on disk are the least recently used but have nothing
+	// left to move; they are only evicted once no value is in memory.
+	if len(candidates) == 0 && len(cold) > 0 {
+		if c, ok := ec.findResident(); ok {
+			return []candidate{c}
+		}
+		return cold
+	}
 	return candidates
 }
 
+// findResident looks through the shards, from a random one on, for a key
+// whose value is in memory.
+func (ec *EvictionController) findResident() (candidate, bool) {
+	ec.rndMu.Lock()
+	start := ec.rnd.Intn(NumShards)
+	ec.rndMu.Unlock()
+	for i := 0; i < NumShards; i++ {
+		shard := ec.store.shards[(start+i)&ShardMask]
+		shard.mu.RLock()
+		key, entry := ec.pick(shard)
+		if entry != nil && !entry.isCold() {
+			c := candidate{key: key, lastAccess: entry.LastAccess.Load(), accessCount: entry.AccessCount.Load()}
+			shard.mu.RUnlock()
+			return c, true
+		}
+		shard.mu.RUnlock()
+	}
+	return candidate{}, false
+}
+
 func (ec *EvictionController) sampleVolatileKeys() []candidate {
 	candidates := make([]candidate, 0, ec.sampleSize)
 
@@ -2,6 +2,8 @@ package store
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -22,6 +24,33 @@ type NamespaceManager struct {
 	mu         sync.RWMutex
 	namespaces map[string]*Namespace
 	defaultNS  *Namespace
+	root       *Store
+}
+
+// DBNamespace names the namespace behind the numbered database index, so
+// SELECT and snapshots agree on where each database lives.
+func DBNamespace(index int) string {
+	if index == 0 {
+		return "default"
+	}
+	return "db" + strconv.Itoa(index)
+}
+
+// NamespaceDB is the inverse of DBNamespace. It reports false for namespaces
+// that do not back a numbered database.
+func NamespaceDB(name string) (int, bool) {
+	if name == "default" {
+		return 0, true
+	}
+	digits, ok := strings.CutPrefix(name, "db")
+	if !ok {
+		return 0, false
+	}
+	index, err := strconv.Atoi(digits)
+	if err != nil || index <= 0 || strconv.Itoa(index) != digits {
+		return 0, false
+	}
+	return index, true
 }
 
 func NewNamespaceManager() *NamespaceManager {
@@ -51,14 +80,33 @@ func NewNamespaceManagerNoCycle() *NamespaceManager {
 }
 
 func (nm *NamespaceManager) createNamespace(name string) *Namespace {
+	st := NewStore()
+	if nm.root != nil {
+		// Pub/sub channels are not scoped by namespace, and every namespace
+		// store can reach its siblings through the shared manager.
+		st.pubsub = nm.root.pubsub
+		st.namespaceMgr = nm
+		st.invalidate.Store(nm.root.invalidate.Load())
+		st.changes = nm.root.changes
+		st.snapMu = nm.root.snapMu
+		st.memTracker = nm.root.memTracker
+		st.evictor = nm.root.evictor
+		st.tier = nm.root.tier
+	}
 	return &Namespace{
 		Name:      name,
-		Store:     NewStore(),
+		Store:     st,
 		Tags:      NewTagIndex(),
 		CreatedAt: time.Now(),
 	}
 }
 
+// setRoot makes root the store behind the default namespace.
+func (nm *NamespaceManager) setRoot(root *Store) {
+	nm.root = root
+	nm.defaultNS.Store = root
+}
+
 func (nm *NamespaceManager) Get(name string) *Namespace {
 	nm.mu.RLock()
 	defer nm.mu.RUnlock()
@@ -455,3 +455,125 @@ func (cf *CuckooFilter) Info() map[string]interface{} {
 		"load_factor": float64(cf.count) / float64(cf.size*cf.bucketSize),
 	}
 }
+
+// Snapshots persist the filters with gob, which only sees exported fields,
+// so each type encodes an exported copy of its state.
+
+type bloomFilterState struct {
+	Bits     []bool
+	Size     uint
+	HashFunc uint
+	K        uint
+	Count    uint
+}
+
+func (bf *BloomFilter) GobEncode() ([]byte, error) {
+	bf.mu.RLock()
+	defer bf.mu.RUnlock()
+	return gobEncode(bloomFilterState{Bits: bf.bits, Size: bf.size, HashFunc: bf.hashFunc, K: bf.k, Count: bf.count})
+}
+
+func (bf *BloomFilter) GobDecode(data []byte) error {
+	var s bloomFilterState
+	if err := gobDecode(data, &s); err != nil {
+		return err
+	}
+	bf.mu.Lock()
+	defer bf.mu.Unlock()
+	if s.Bits == nil {
+		s.Bits = make([]bool, s.Size)
+	}
+	bf.bits, bf.size, bf.hashFunc, bf.k, bf.count = s.Bits, s.Size, s.HashFunc, s.K, s.Count
+	return nil
+}
+
+type countMinSketchState struct {
+	Matrix [][]uint
+	Depth  uint
+	Width  uint
+	Count  uint64
+}
+
+func (cms *CountMinSketch) GobEncode() ([]byte, error) {
+	cms.mu.RLock()
+	defer cms.mu.RUnlock()
+	return gobEncode(countMinSketchState{Matrix: cms.matrix, Depth: cms.depth, Width: cms.width, Count: cms.count})
+}
+
+func (cms *CountMinSketch) GobDecode(data []byte) error {
+	var s countMinSketchState
+	if err := gobDecode(data, &s); err != nil {
+		return err
+	}
+	cms.mu.Lock()
+	defer cms.mu.Unlock()
+	if uint(len(s.Matrix)) != s.Depth {
+		s.Matrix = make([][]uint, s.Depth)
+	}
+	for i := range s.Matrix {
+		if uint(len(s.Matrix[i])) != s.Width {
+			s.Matrix[i] = make([]uint, s.Width)
+		}
+	}
+	cms.matrix, cms.depth, cms.width, cms.count = s.Matrix, s.Depth, s.Width, s.Count
+	return nil
+}
+
+type topKState struct {
+	Items map[string]uint64
+	K     int
+	Count uint64
+}
+
+func (tk *TopK) GobEncode() ([]byte, error) {
+	tk.mu.RLock()
+	defer tk.mu.RUnlock()
+	return gobEncode(topKState{Items: tk.items, K: tk.k, Count: tk.count})
+}
+
+func (tk *TopK) GobDecode(data []byte) error {
+	var s topKState
+	if err := gobDecode(data, &s); err != nil {
+		return err
+	}
+	tk.mu.Lock()
+	defer tk.mu.Unlock()
+	if s.Items == nil {
+		s.Items = make(map[string]uint64)
+	}
+	tk.items, tk.k, tk.count = s.Items, s.K, s.Count
+	return nil
+}
+
+type cuckooFilterState struct {
+	Buckets    [][]byte
+	Size       uint
+	BucketSize uint
+	Count      uint
+	Kicks      uint
+}
+
+func (cf *CuckooFilter) GobEncode() ([]byte, error) {
+	cf.mu.RLock()
+	defer cf.mu.RUnlock()
+	return gobEncode(cuckooFilterState{Buckets: cf.buckets, Size: cf.size, BucketSize: cf.bucketSize, Count: cf.count, Kicks: cf.kicks})
+}
+
+func (cf *CuckooFilter) GobDecode(data []byte) error {
+	var s cuckooFilterState
+	if err := gobDecode(data, &s); err != nil {
+		return err
+	}
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+	if uint(len(s.Buckets)) != s.Size {
+		s.Buckets = make([][]byte, s.Size)
+	}
+	for i := range s.Buckets {
+		if uint(len(s.Buckets[i])) != s.BucketSize {
+			s.Buckets[i] = make([]byte, s.BucketSize)
+		}
+	}
+	cf.buckets, cf.size, cf.bucketSize, cf.count, cf.kicks = s.Buckets, s.Size, s.BucketSize, s.Count, s.Kicks
+	return nil
+}
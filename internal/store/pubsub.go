@@ -1,41 +1,73 @@
 package store
 
 import (
+	"sort"
 	"sync"
 	"sync/atomic"
 )
 
 type PubSub struct {
-	mu          sync.RWMutex
-	channels    map[string]map[*Subscriber]struct{}
-	patterns    map[string]map[*Subscriber]struct{}
-	subscribers map[*Subscriber]struct{}
+	mu            sync.RWMutex
+	channels      map[string]map[*Subscriber]struct{}
+	patterns      map[string]map[*Subscriber]struct{}
+	shardChannels map[string]map[*Subscriber]struct{}
+	subscribers   map[*Subscriber]struct{}
 }
 
+// Message kinds, named after the first element of the frame delivered to
+// the client.
+const (
+	MessageKindMessage  = "message"
+	MessageKindPMessage = "pmessage"
+	MessageKindSMessage = "smessage"
+)
+
+// Message is a published payload queued for one subscriber. Pattern is only
+// set for pmessage deliveries.
+type Message struct {
+	Kind    string
+	Pattern string
+	Channel string
+	Payload []byte
+}
+
+// Subscriber is the receiving end of one client's subscriptions. Its
+// channel, pattern and shard channel sets are guarded by the owning
+// PubSub's lock.
 type Subscriber struct {
 	ID        int64
-	ch        chan []byte
+	ch        chan *Message
 	mu        sync.Mutex
 	closed    bool
 	dropCount atomic.Int64
+
+	channels      map[string]struct{}
+	patterns      map[string]struct{}
+	shardChannels map[string]struct{}
 }
 
 func NewPubSub() *PubSub {
 	return &PubSub{
-		channels:    make(map[string]map[*Subscriber]struct{}),
-		patterns:    make(map[string]map[*Subscriber]struct{}),
-		subscribers: make(map[*Subscriber]struct{}),
+		channels:      make(map[string]map[*Subscriber]struct{}),
+		patterns:      make(map[string]map[*Subscriber]struct{}),
+		shardChannels: make(map[string]map[*Subscriber]struct{}),
+		subscribers:   make(map[*Subscriber]struct{}),
 	}
 }
 
 func NewSubscriber(id int64) *Subscriber {
 	return &Subscriber{
-		ID: id,
-		ch: make(chan []byte, 256),
+		ID:            id,
+		ch:            make(chan *Message, 256),
+		channels:      make(map[string]struct{}),
+		patterns:      make(map[string]struct{}),
+		shardChannels: make(map[string]struct{}),
 	}
 }
 
-func (s *Subscriber) Send(message []byte) bool {
+// Send queues a message without blocking. Messages for a subscriber whose
+// queue is full are dropped and counted.
+func (s *Subscriber) Send(msg *Message) bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -44,7 +76,7 @@ func (s *Subscriber) Send(message []byte) bool {
 	}
 
 	select {
-	case s.ch <- message:
+	case s.ch <- msg:
 		return true
 	default:
 		s.dropCount.Add(1)
@@ -56,7 +88,9 @@ func (s *Subscriber) DropCount() int64 {
 	return s.dropCount.Load()
 }
 
-func (s *Subscriber) Channel() <-chan []byte {
+// Channel returns the queue of pending messages. It is closed when the
+// subscriber is removed.
+func (s *Subscriber) Channel() <-chan *Message {
 	return s.ch
 }
 
@@ -93,10 +127,7 @@ func (ps *PubSub) Subscribe(sub *Subscriber, channels ...string) int {
 			break
 		}
 
-		if ps.channels[ch] == nil {
-			ps.channels[ch] = make(map[*Subscriber]struct{})
-		}
-		ps.channels[ch][sub] = struct{}{}
+		addSubscription(ps.channels, sub.channels, ch, sub)
 		subscribed++
 	}
 
@@ -107,19 +138,14 @@ func (ps *PubSub) Unsubscribe(sub *Subscriber, channels ...string) int {
 	ps.mu.Lock()
 	defer ps.mu.Unlock()
 
-	count := 0
 	if len(channels) == 0 {
-		for ch := range ps.channels {
-			delete(ps.channels[ch], sub)
+		channels = keys(sub.channels)
+	}
+	count := 0
+	for _, ch := range channels {
+		if removeSubscription(ps.channels, sub.channels, ch, sub) {
 			count++
 		}
-	} else {
-		for _, ch := range channels {
-			if subs, exists := ps.channels[ch]; exists {
-				delete(subs, sub)
-				count++
-			}
-		}
 	}
 
 	ps.checkRemoveSubscriber(sub)
@@ -133,10 +159,7 @@ func (ps *PubSub) PSubscribe(sub *Subscriber, patterns ...string) int {
 	ps.subscribers[sub] = struct{}{}
 
 	for _, p := range patterns {
-		if ps.patterns[p] == nil {
-			ps.patterns[p] = make(map[*Subscriber]struct{})
-		}
-		ps.patterns[p][sub] = struct{}{}
+		addSubscription(ps.patterns, sub.patterns, p, sub)
 	}
 
 	return len(patterns)
@@ -146,18 +169,50 @@ func (ps *PubSub) PUnsubscribe(sub *Subscriber, patterns ...string) int {
 	ps.mu.Lock()
 	defer ps.mu.Unlock()
 
-	count := 0
 	if len(patterns) == 0 {
-		for p := range ps.patterns {
-			delete(ps.patterns[p], sub)
+		patterns = keys(sub.patterns)
+	}
+	count := 0
+	for _, p := range patterns {
+		if removeSubscription(ps.patterns, sub.patterns, p, sub) {
 			count++
 		}
-	} else {
-		for _, p := range patterns {
-			if subs, exists := ps.patterns[p]; exists {
-				delete(subs, sub)
-				count++
-			}
+	}
+
+	ps.checkRemoveSubscriber(sub)
+	return count
+}
+
+// SSubscribe subscribes to shard channels. Shard channels are a separate
+// namespace from regular channels and are only reached by SPublish.
+func (ps *PubSub) SSubscribe(sub *Subscriber, channels ...string) int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	ps.subscribers[sub] = struct{}{}
+
+	subscribed := 0
+	for _, ch := range channels {
+		if len(ch) == 0 || len(ch) > maxChannelNameLength {
+			continue
+		}
+		addSubscription(ps.shardChannels, sub.shardChannels, ch, sub)
+		subscribed++
+	}
+	return subscribed
+}
+
+func (ps *PubSub) SUnsubscribe(sub *Subscriber, channels ...string) int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if len(channels) == 0 {
+		channels = keys(sub.shardChannels)
+	}
+	count := 0
+	for _, ch := range channels {
+		if removeSubscription(ps.shardChannels, sub.shardChannels, ch, sub) {
+			count++
 		}
 	}
 
@@ -165,18 +220,89 @@ func (ps *PubSub) PUnsubscribe(sub *Subscriber, patterns ...string) int {
 	return count
 }
 
+// SubscriptionCount returns the number of channels and patterns the
+// subscriber is subscribed to, as reported in (P)SUBSCRIBE replies.
+func (ps *PubSub) SubscriptionCount(sub *Subscriber) int {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	return len(sub.channels) + len(sub.patterns)
+}
+
+// ShardSubscriptionCount returns the number of shard channels the subscriber
+// is subscribed to.
+func (ps *PubSub) ShardSubscriptionCount(sub *Subscriber) int {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	return len(sub.shardChannels)
+}
+
+// IsSubscribed reports whether the subscriber is subscribed to channel.
+func (ps *PubSub) IsSubscribed(sub *Subscriber, channel string) bool {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	_, ok := sub.channels[channel]
+	return ok
+}
+
+// SubscribedChannels returns the subscriber's channels in sorted order.
+func (ps *PubSub) SubscribedChannels(sub *Subscriber) []string {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	return keys(sub.channels)
+}
+
+// SubscribedPatterns returns the subscriber's patterns in sorted order.
+func (ps *PubSub) SubscribedPatterns(sub *Subscriber) []string {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	return keys(sub.patterns)
+}
+
+// SubscribedShardChannels returns the subscriber's shard channels in sorted
+// order.
+func (ps *PubSub) SubscribedShardChannels(sub *Subscriber) []string {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	return keys(sub.shardChannels)
+}
+
 func (ps *PubSub) checkRemoveSubscriber(sub *Subscriber) {
-	for _, subs := range ps.channels {
-		if _, exists := subs[sub]; exists {
-			return
-		}
+	if len(sub.channels) == 0 && len(sub.patterns) == 0 && len(sub.shardChannels) == 0 {
+		delete(ps.subscribers, sub)
 	}
-	for _, subs := range ps.patterns {
-		if _, exists := subs[sub]; exists {
-			return
+}
+
+func addSubscription(index map[string]map[*Subscriber]struct{}, own map[string]struct{}, name string, sub *Subscriber) {
+	if index[name] == nil {
+		index[name] = make(map[*Subscriber]struct{})
+	}
+	index[name][sub] = struct{}{}
+	own[name] = struct{}{}
+}
+
+// removeSubscription drops sub from name and reports whether it was
+// subscribed. Empty entries are deleted so PUBSUB CHANNELS stays accurate.
+func removeSubscription(index map[string]map[*Subscriber]struct{}, own map[string]struct{}, name string, sub *Subscriber) bool {
+	if _, ok := own[name]; !ok {
+		return false
+	}
+	delete(own, name)
+	if subs, exists := index[name]; exists {
+		delete(subs, sub)
+		if len(subs) == 0 {
+			delete(index, name)
 		}
 	}
-	delete(ps.subscribers, sub)
+	return true
+}
+
+func keys(set map[string]struct{}) []string {
+	result := make([]string, 0, len(set))
+	for k := range set {
+		result = append(result, k)
+	}
+	sort.Strings(result)
+	return result
 }
 
 func (ps *PubSub) Publish(channel string, message []byte) int {
@@ -186,8 +312,9 @@ func (ps *PubSub) Publish(channel string, message []byte) int {
 	count := 0
 
 	if subs, exists := ps.channels[channel]; exists {
+		msg := &Message{Kind: MessageKindMessage, Channel: channel, Payload: message}
 		for sub := range subs {
-			if sub.Send(message) {
+			if sub.Send(msg) {
 				count++
 			}
 		}
@@ -195,8 +322,9 @@ func (ps *PubSub) Publish(channel string, message []byte) int {
 
 	for pattern, subs := range ps.patterns {
 		if matchPattern(channel, pattern) {
+			msg := &Message{Kind: MessageKindPMessage, Pattern: pattern, Channel: channel, Payload: message}
 			for sub := range subs {
-				if sub.Send(message) {
+				if sub.Send(msg) {
 					count++
 				}
 			}
@@ -206,6 +334,23 @@ func (ps *PubSub) Publish(channel string, message []byte) int {
 	return count
 }
 
+// SPublish delivers a message to the subscribers of a shard channel.
+func (ps *PubSub) SPublish(channel string, message []byte) int {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	count := 0
+	if subs, exists := ps.shardChannels[channel]; exists {
+		msg := &Message{Kind: MessageKindSMessage, Channel: channel, Payload: message}
+		for sub := range subs {
+			if sub.Send(msg) {
+				count++
+			}
+		}
+	}
+	return count
+}
+
 func (ps *PubSub) Channels(pattern string) []string {
 	ps.mu.RLock()
 	defer ps.mu.RUnlock()
@@ -234,6 +379,30 @@ func (ps *PubSub) NumSub(channels ...string) map[string]int {
 	return result
 }
 
+func (ps *PubSub) ShardChannels(pattern string) []string {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	channels := make([]string, 0)
+	for ch := range ps.shardChannels {
+		if pattern == "" || matchPattern(ch, pattern) {
+			channels = append(channels, ch)
+		}
+	}
+	return channels
+}
+
+func (ps *PubSub) ShardNumSub(channels ...string) map[string]int {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	result := make(map[string]int)
+	for _, ch := range channels {
+		result[ch] = len(ps.shardChannels[ch])
+	}
+	return result
+}
+
 func (ps *PubSub) NumPat() int {
 	ps.mu.RLock()
 	defer ps.mu.RUnlock()
@@ -245,12 +414,25 @@ func (ps *PubSub) NumPat() int {
 	return count
 }
 
-func (ps *PubSub) RemoveSubscriber(sub *Subscriber) {
+// UnsubscribeAll drops every channel, pattern and shard channel
+// subscription but leaves the subscriber open for reuse (RESET).
+func (ps *PubSub) UnsubscribeAll(sub *Subscriber) {
 	ps.Unsubscribe(sub)
 	ps.PUnsubscribe(sub)
+	ps.SUnsubscribe(sub)
+}
+
+func (ps *PubSub) RemoveSubscriber(sub *Subscriber) {
+	ps.UnsubscribeAll(sub)
 	sub.Close()
 }
 
+// MatchPattern reports whether s matches the glob pattern, where '*'
+// matches any run of bytes and '?' a single byte.
+func MatchPattern(s, pattern string) bool {
+	return matchPattern(s, pattern)
+}
+
 func matchPattern(s, pattern string) bool {
 	if pattern == "*" {
 		return true
@@ -2,6 +2,7 @@ package store
 
 import (
 	"sync"
+	"sync/atomic"
 )
 
 const (
@@ -14,6 +15,16 @@ type Shard struct {
 	data     map[string]*Entry
 	keyCount int64
 	memUsage int64
+	snap     *shardSnapshot
+	// cold counts the entries whose value is in the disk tier. writing is
+	// the number of commands modifying keys of the shard and writes the
+	// number that ever started; see Store.BeginWrite.
+	cold    int64
+	writing atomic.Int32
+	writes  atomic.Uint64
+	// graves holds the CRDT metadata of deleted keys, which active-active
+	// replication needs to order the delete against writes made elsewhere.
+	graves map[string]grave
 }
 
 func NewShard() *Shard {
@@ -35,12 +46,18 @@ func (s *Shard) Set(key string, entry *Entry) int64 {
 
 	keyOverhead := int64(len(key)) + 16 // key string + map entry overhead
 
+	s.preserve(key)
 	oldMem := int64(0)
 	if old, exists := s.data[key]; exists {
 		oldMem = old.MemoryUsage() + keyOverhead
 		s.memUsage -= oldMem
+		s.forget(old)
+		if entry.CRDT == nil {
+			entry.CRDT = old.CRDT
+		}
 	} else {
 		s.keyCount++
+		s.unbury(key, entry)
 	}
 
 	newMem := entry.MemoryUsage() + keyOverhead
@@ -59,10 +76,13 @@ func (s *Shard) Delete(key string) (int64, bool) {
 		return 0, false
 	}
 
+	s.preserve(key)
 	keyOverhead := int64(len(key)) + 16
 	mem := entry.MemoryUsage() + keyOverhead
 	s.memUsage -= mem
 	s.keyCount--
+	s.forget(entry)
+	s.bury(key, entry)
 	delete(s.data, key)
 
 	return mem, true
@@ -100,6 +120,15 @@ func (s *Shard) Keys() []string {
 func (s *Shard) Flush() int64 {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if s.snap != nil {
+		for key := range s.data {
+			s.preserve(key)
+		}
+	}
+	for key, entry := range s.data {
+		s.forget(entry)
+		s.bury(key, entry)
+	}
 	freed := s.memUsage
 	s.data = make(map[string]*Entry)
 	s.keyCount = 0
@@ -0,0 +1,257 @@
+package store
+
+import (
+	"sync"
+)
+
+// Snapshot is a point-in-time view of a store and its namespaces, used to
+// save the dataset while clients keep writing. Taking one only holds every
+// shard lock long enough to mark it; from then on a shard keeps the entries
+// it replaces, deletes or is about to change in place until the snapshot
+// has read that shard.
+//
+// Only one snapshot of a store exists at a time: Snapshot blocks until the
+// previous one is released.
+type Snapshot struct {
+	dbs  []*SnapshotDB
+	mu   *sync.Mutex
+	once sync.Once
+}
+
+// SnapshotDB is one namespace captured by a Snapshot.
+type SnapshotDB struct {
+	Name string
+	// Keys is the number of keys the namespace held, including ones that
+	// have expired but not been removed yet.
+	Keys  int64
+	store *Store
+}
+
+// shardSnapshot holds the entries a shard had when the snapshot was taken,
+// for the keys changed since. A nil entry marks a key that did not exist.
+type shardSnapshot struct {
+	saved map[string]*Entry
+}
+
+type snapshotEntry struct {
+	key   string
+	entry *Entry
+}
+
+// Snapshot captures the store. On the root store of a namespace manager it
+// covers every namespace, the root being "default"; any other store is
+// captured on its own as "default". Release must be called when done.
+func (s *Store) Snapshot() *Snapshot {
+	return s.SnapshotWith(nil)
+}
+
+// SnapshotWith captures the store like Snapshot, but once no other snapshot
+// is in progress it hands the capture to barrier, which must call it exactly
+// once. This lets a caller take the snapshot at the same point as other
+// state, such as the start of an AOF rewrite buffer, without holding its own
+// locks while an earlier snapshot finishes.
+func (s *Store) SnapshotWith(barrier func(capture func())) *Snapshot {
+	s.snapMu.Lock()
+	sn := &Snapshot{mu: s.snapMu}
+	if barrier == nil {
+		sn.capture(s)
+	} else {
+		barrier(func() { sn.capture(s) })
+	}
+	return sn
+}
+
+// capture marks every shard of the captured namespaces at once.
+func (sn *Snapshot) capture(s *Store) {
+	root := DBNamespace(0)
+	if nm := s.namespaceMgr; nm != nil && s.ForNamespace(root) == s {
+		for _, name := range nm.List() {
+			if ns := nm.Get(name); ns != nil && ns.Store != nil {
+				sn.dbs = append(sn.dbs, &SnapshotDB{Name: name, store: ns.Store})
+			}
+		}
+	} else {
+		sn.dbs = []*SnapshotDB{{Name: root, store: s}}
+	}
+
+	for _, db := range sn.dbs {
+		for _, shard := range db.store.shards {
+			shard.mu.Lock()
+		}
+	}
+	for _, db := range sn.dbs {
+		for _, shard := range db.store.shards {
+			db.Keys += shard.keyCount
+			shard.snap = &shardSnapshot{saved: make(map[string]*Entry)}
+		}
+		db.store.snapshotting.Store(true)
+	}
+	for _, db := range sn.dbs {
+		for _, shard := range db.store.shards {
+			shard.mu.Unlock()
+		}
+	}
+}
+
+// Databases lists the captured namespaces in no particular order.
+func (sn *Snapshot) Databases() []*SnapshotDB {
+	return sn.dbs
+}
+
+// Release stops preserving entries for the snapshot and lets the next one
+// be taken. It is safe to call more than once.
+func (sn *Snapshot) Release() {
+	sn.once.Do(func() {
+		for _, db := range sn.dbs {
+			db.store.snapshotting.Store(false)
+			for _, shard := range db.store.shards {
+				shard.mu.Lock()
+				shard.snap = nil
+				shard.mu.Unlock()
+			}
+		}
+		sn.mu.Unlock()
+	})
+}
+
+// Range calls fn for every key of the namespace as it was when the snapshot
+// was taken, shard by shard, stopping at the first error. The entries are
+// private copies or entries no longer in the store, so fn may read them
+// while clients modify the keys. Range can only be called once per
+// snapshot: each shard stops preserving entries once it has been read.
+func (db *SnapshotDB) Range(fn func(key string, entry *Entry) error) error {
+	for _, shard := range db.store.shards {
+		for _, e := range shard.readSnapshot() {
+			if err := fn(e.key, e.entry); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// preserve records key's current entry before the shard replaces or
+// removes it. Called with s.mu held.
+func (s *Shard) preserve(key string) {
+	if s.snap == nil {
+		return
+	}
+	if _, ok := s.snap.saved[key]; !ok {
+		s.snap.saved[key] = s.data[key]
+	}
+}
+
+// preserveCopy records a copy of key's entry before a command changes it in
+// place. The copy is made without the shard lock because cloning a value
+// takes the value's own lock, which command handlers hold while calling
+// back into the store.
+func (s *Shard) preserveCopy(key string) {
+	s.mu.RLock()
+	entry := s.data[key]
+	pending := s.snap != nil && entry != nil
+	if pending {
+		_, saved := s.snap.saved[key]
+		pending = !saved
+	}
+	s.mu.RUnlock()
+	if !pending {
+		return
+	}
+
+	copied := entry.clone()
+	s.mu.Lock()
+	if s.snap != nil && s.data[key] == entry {
+		if _, saved := s.snap.saved[key]; !saved {
+			s.snap.saved[key] = copied
+		}
+	}
+	s.mu.Unlock()
+}
+
+// readSnapshot returns the shard's entries as of the snapshot and stops
+// preserving them. Entries still live are copied; a command that preserved
+// one of them in the meantime changed it after its copy was taken, so the
+// preserved entry wins.
+func (s *Shard) readSnapshot() []snapshotEntry {
+	s.mu.RLock()
+	snap := s.snap
+	if snap == nil {
+		s.mu.RUnlock()
+		return nil
+	}
+	entries := make([]snapshotEntry, 0, len(s.data)+len(snap.saved))
+	var live []int
+	for key, entry := range s.data {
+		if _, ok := snap.saved[key]; ok {
+			continue
+		}
+		live = append(live, len(entries))
+		entries = append(entries, snapshotEntry{key: key, entry: entry})
+	}
+	var cold []int
+	for key, entry := range snap.saved {
+		if entry != nil {
+			if entry.isCold() {
+				cold = append(cold, len(entries))
+			}
+			entries = append(entries, snapshotEntry{key: key, entry: entry})
+		}
+	}
+	s.mu.RUnlock()
+
+	copies := make([]*Entry, len(live))
+	for i, idx := range live {
+		copies[i] = entries[idx].entry.clone()
+	}
+	// Entries preserved while their value was in the disk tier are read
+	// back here; compaction waits for the snapshot, so their records are
+	// still there.
+	for _, idx := range cold {
+		entries[idx].entry = entries[idx].entry.clone()
+	}
+
+	s.mu.Lock()
+	for i, idx := range live {
+		if saved, ok := snap.saved[entries[idx].key]; ok {
+			entries[idx].entry = saved
+		} else {
+			entries[idx].entry = copies[i]
+		}
+	}
+	if s.snap == snap {
+		s.snap = nil
+	}
+	s.mu.Unlock()
+	return entries
+}
+
+// PreserveForSnapshot keeps a copy of the entries of keys for a snapshot in
+// progress. Commands call it before modifying values in place; replacing
+// or deleting keys is tracked by the store itself.
+func (s *Store) PreserveForSnapshot(keys []string) {
+	if !s.snapshotting.Load() {
+		return
+	}
+	for _, key := range keys {
+		s.shards[s.shardIndex(key)].preserveCopy(key)
+	}
+}
+
+func (s *Store) preserveForSnapshot(shard *Shard, key string) {
+	if s.snapshotting.Load() {
+		shard.preserveCopy(key)
+	}
+}
+
+// clone copies the entry and its value for a snapshot.
+func (e *Entry) clone() *Entry {
+	c := &Entry{
+		Value:     e.Value.Clone(),
+		Tags:      append([]string(nil), e.Tags...),
+		ExpiresAt: e.ExpiresAt,
+		CreatedAt: e.CreatedAt,
+	}
+	c.LastAccess.Store(e.LastAccess.Load())
+	c.AccessCount.Store(e.AccessCount.Load())
+	return c
+}
@@ -0,0 +1,97 @@
+package store
+
+import (
+	"testing"
+)
+
+func snapshotContents(t *testing.T, db *SnapshotDB) map[string]string {
+	t.Helper()
+	got := make(map[string]string)
+	if err := db.Range(func(key string, entry *Entry) error {
+		got[key] = entry.Value.String()
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestSnapshotIsPointInTime(t *testing.T) {
+	s := NewStore()
+	s.Set("replaced", &StringValue{Data: []byte("old")}, SetOptions{})
+	s.Set("deleted", &StringValue{Data: []byte("old")}, SetOptions{})
+	s.Set("mutated", &HashValue{Fields: map[string][]byte{"f": []byte("old")}}, SetOptions{})
+	s.Set("kept", &StringValue{Data: []byte("old")}, SetOptions{})
+
+	snap := s.Snapshot()
+	defer snap.Release()
+
+	s.Set("replaced", &StringValue{Data: []byte("new")}, SetOptions{})
+	s.Delete("deleted")
+	s.Set("added", &StringValue{Data: []byte("new")}, SetOptions{})
+	s.PreserveForSnapshot([]string{"mutated"})
+	entry, _ := s.Get("mutated")
+	entry.Value.(*HashValue).Fields["f"] = []byte("new")
+
+	dbs := snap.Databases()
+	if len(dbs) != 1 || dbs[0].Name != "default" || dbs[0].Keys != 4 {
+		t.Fatalf("databases = %+v", dbs)
+	}
+	got := snapshotContents(t, dbs[0])
+	want := map[string]string{"replaced": "old", "deleted": "old", "kept": "old"}
+	for key, val := range want {
+		if got[key] != val {
+			t.Errorf("%s = %q, want %q", key, got[key], val)
+		}
+	}
+	if _, ok := got["added"]; ok {
+		t.Error("snapshot includes a key added after it was taken")
+	}
+	if got["mutated"] != "f: old" {
+		t.Errorf("snapshot saw the in-place change: %q", got["mutated"])
+	}
+
+	// Once read, shards stop preserving entries.
+	s.Set("kept", &StringValue{Data: []byte("new")}, SetOptions{})
+	if n := len(s.shards[s.shardIndex("kept")].readSnapshot()); n != 0 {
+		t.Errorf("shard still holds %d snapshot entries after Range", n)
+	}
+}
+
+func TestSnapshotSurvivesFlush(t *testing.T) {
+	s := NewStoreWithNamespaces()
+	s.Set("a", &StringValue{Data: []byte("1")}, SetOptions{})
+	s.ForNamespace("db1").Set("b", &StringValue{Data: []byte("2")}, SetOptions{})
+
+	snap := s.Snapshot()
+	s.Flush()
+	s.ForNamespace("db1").Flush()
+
+	names := make(map[string]map[string]string)
+	for _, db := range snap.Databases() {
+		names[db.Name] = snapshotContents(t, db)
+	}
+	snap.Release()
+	if names["default"]["a"] != "1" || names["db1"]["b"] != "2" {
+		t.Errorf("snapshot = %v", names)
+	}
+
+	// Release lets the next snapshot be taken.
+	s.Snapshot().Release()
+}
+
+func TestStoreChangesSharedByNamespaces(t *testing.T) {
+	s := NewStoreWithNamespaces()
+	start := s.Changes()
+	s.Set("a", &StringValue{Data: []byte("1")}, SetOptions{})
+	s.ForNamespace("db2").Set("b", &StringValue{Data: []byte("2")}, SetOptions{})
+	s.Delete("a")
+	if got := s.Changes() - start; got != 3 {
+		t.Errorf("changes = %d, want 3", got)
+	}
+
+	s.ForNamespace("db2").Flush()
+	if got := s.ForNamespace("db2").Changes() - start; got != 4 {
+		t.Errorf("changes after flushing one key = %d, want 4", got)
+	}
+}
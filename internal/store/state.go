@@ -0,0 +1,257 @@
+package store
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/gob"
+	"time"
+)
+
+func gobEncode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// gobDecode decodes data into v, leaving v untouched when data is nil.
+func gobDecode(data []byte, v interface{}) error {
+	if data == nil {
+		return nil
+	}
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// savedSeries is a time series as kept in snapshots.
+type savedSeries struct {
+	Key       string
+	Samples   []TimeSeriesSample
+	Labels    map[string]string
+	Retention int64
+}
+
+func (m *TimeSeriesManager) StateName() string {
+	return "timeseries"
+}
+
+// SaveState serializes every series with its samples.
+func (m *TimeSeriesManager) SaveState() ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	saved := make([]savedSeries, 0, len(m.series))
+	for key, ts := range m.series {
+		ts.mu.RLock()
+		s := savedSeries{Key: key, Samples: append([]TimeSeriesSample(nil), ts.Samples...), Labels: make(map[string]string, len(ts.Labels)), Retention: int64(ts.Retention)}
+		for k, v := range ts.Labels {
+			s.Labels[k] = v
+		}
+		ts.mu.RUnlock()
+		saved = append(saved, s)
+	}
+	return gobEncode(saved)
+}
+
+// LoadState replaces the series with those saved by SaveState and rebuilds
+// the label index.
+func (m *TimeSeriesManager) LoadState(data []byte) error {
+	var saved []savedSeries
+	if err := gobDecode(data, &saved); err != nil {
+		return err
+	}
+	loaded := NewTimeSeriesManager()
+	for _, s := range saved {
+		if s.Labels == nil {
+			s.Labels = make(map[string]string)
+		}
+		_ = loaded.Create(s.Key, 0, s.Labels)
+		ts := loaded.series[s.Key]
+		ts.Retention = time.Duration(s.Retention)
+		if s.Samples != nil {
+			ts.Samples = s.Samples
+		}
+	}
+	m.mu.Lock()
+	m.series, m.byLabel = loaded.series, loaded.byLabel
+	m.mu.Unlock()
+	return nil
+}
+
+// savedWorkflows is the workflow state as kept in snapshots, state machines
+// included.
+type savedWorkflows struct {
+	Workflows     map[string]*Workflow
+	Templates     map[string]*WorkflowTemplate
+	StateMachines map[string]*StateMachine
+}
+
+func (wm *WorkflowManager) StateName() string {
+	return "workflow"
+}
+
+// SaveState serializes the workflows, templates and state machines.
+func (wm *WorkflowManager) SaveState() ([]byte, error) {
+	wm.mu.RLock()
+	defer wm.mu.RUnlock()
+	stateMachinesMu.RLock()
+	defer stateMachinesMu.RUnlock()
+	for _, sm := range stateMachines {
+		sm.mu.RLock()
+		defer sm.mu.RUnlock()
+	}
+	return gobEncode(savedWorkflows{Workflows: wm.Workflows, Templates: wm.Templates, StateMachines: stateMachines})
+}
+
+// LoadState replaces the workflows, templates and state machines with those
+// saved by SaveState.
+func (wm *WorkflowManager) LoadState(data []byte) error {
+	var saved savedWorkflows
+	if err := gobDecode(data, &saved); err != nil {
+		return err
+	}
+	if saved.Workflows == nil {
+		saved.Workflows = make(map[string]*Workflow)
+	}
+	if saved.Templates == nil {
+		saved.Templates = make(map[string]*WorkflowTemplate)
+	}
+	if saved.StateMachines == nil {
+		saved.StateMachines = make(map[string]*StateMachine)
+	}
+	for _, w := range saved.Workflows {
+		if w.Variables == nil {
+			w.Variables = make(map[string]string)
+		}
+	}
+	for _, sm := range saved.StateMachines {
+		if sm.States == nil {
+			sm.States = make(map[string]State)
+		}
+	}
+
+	wm.mu.Lock()
+	wm.Workflows, wm.Templates = saved.Workflows, saved.Templates
+	wm.mu.Unlock()
+	stateMachinesMu.Lock()
+	stateMachines = saved.StateMachines
+	stateMachinesMu.Unlock()
+	return nil
+}
+
+func (js *JobScheduler) StateName() string {
+	return "jobs"
+}
+
+// SaveState serializes the scheduled jobs.
+func (js *JobScheduler) SaveState() ([]byte, error) {
+	js.mu.RLock()
+	defer js.mu.RUnlock()
+	return gobEncode(js.Jobs)
+}
+
+// LoadState replaces the jobs with those saved by SaveState.
+func (js *JobScheduler) LoadState(data []byte) error {
+	jobs := make(map[string]*Job)
+	if err := gobDecode(data, &jobs); err != nil {
+		return err
+	}
+	js.mu.Lock()
+	js.Jobs = jobs
+	js.mu.Unlock()
+	return nil
+}
+
+// The priority queue keeps its items unexported, and the LRU list is
+// cyclic, which gob cannot encode, so both save a flat copy instead.
+
+type priorityQueueState struct {
+	Items []*PriorityItem
+}
+
+func (pq *PriorityQueue) GobEncode() ([]byte, error) {
+	pq.mu.RLock()
+	defer pq.mu.RUnlock()
+	return gobEncode(priorityQueueState{Items: pq.items})
+}
+
+func (pq *PriorityQueue) GobDecode(data []byte) error {
+	var s priorityQueueState
+	if err := gobDecode(data, &s); err != nil {
+		return err
+	}
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+	pq.items = make([]*PriorityItem, 0, len(s.Items))
+	for _, item := range s.Items {
+		if item != nil {
+			pq.items = append(pq.items, item)
+		}
+	}
+	heap.Init(pq)
+	return nil
+}
+
+type lruCacheState struct {
+	// Keys and Values run from the most to the least recently used.
+	Keys     []string
+	Values   []string
+	Capacity int
+}
+
+func (lru *LRUCache) GobEncode() ([]byte, error) {
+	lru.mu.RLock()
+	defer lru.mu.RUnlock()
+	s := lruCacheState{Capacity: lru.Capacity}
+	for node := lru.Head; node != nil; node = node.Next {
+		s.Keys = append(s.Keys, node.Key)
+		s.Values = append(s.Values, node.Value)
+	}
+	return gobEncode(s)
+}
+
+func (lru *LRUCache) GobDecode(data []byte) error {
+	var s lruCacheState
+	if err := gobDecode(data, &s); err != nil {
+		return err
+	}
+	if len(s.Values) != len(s.Keys) {
+		return StoreError("corrupt LRU cache")
+	}
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+	lru.Items = make(map[string]*LRUNode, len(s.Keys))
+	lru.Head, lru.Tail = nil, nil
+	lru.Capacity, lru.Size = s.Capacity, 0
+	for i := len(s.Keys) - 1; i >= 0; i-- {
+		node := &LRUNode{Key: s.Keys[i], Value: s.Values[i]}
+		lru.Items[node.Key] = node
+		lru.addToFront(node)
+		lru.Size++
+	}
+	return nil
+}
+
+type reservoirSamplerState struct {
+	Data    []float64
+	MaxSize int
+	Count   int64
+}
+
+func (rs *ReservoirSampler) GobEncode() ([]byte, error) {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+	return gobEncode(reservoirSamplerState{Data: rs.Data, MaxSize: rs.MaxSize, Count: rs.Count})
+}
+
+func (rs *ReservoirSampler) GobDecode(data []byte) error {
+	var s reservoirSamplerState
+	if err := gobDecode(data, &s); err != nil {
+		return err
+	}
+	loaded := NewReservoirSampler(s.MaxSize)
+	loaded.Data = append(loaded.Data, s.Data...)
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.Data, rs.MaxSize, rs.Count, rs.rng = loaded.Data, s.MaxSize, s.Count, loaded.rng
+	return nil
+}
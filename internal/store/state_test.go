@@ -0,0 +1,105 @@
+package store
+
+import (
+	"testing"
+	"time"
+)
+
+// gobRoundTrip encodes v and decodes it into out.
+func gobRoundTrip(t *testing.T, v, out interface{}) {
+	t.Helper()
+	data, err := gobEncode(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gobDecode(data, out); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProbabilisticGobRoundTrip(t *testing.T) {
+	cms := NewCountMinSketch(4, 100)
+	cms.Add([]byte("a"), 3)
+	var cms2 *CountMinSketch
+	gobRoundTrip(t, cms, &cms2)
+	if cms2.Count([]byte("a")) != 3 {
+		t.Errorf("count-min count = %d, want 3", cms2.Count([]byte("a")))
+	}
+
+	tk := NewTopK(2)
+	tk.Add("x", 5)
+	var tk2 *TopK
+	gobRoundTrip(t, tk, &tk2)
+	if tk2.Query("x") != 5 {
+		t.Errorf("top-k count = %d, want 5", tk2.Query("x"))
+	}
+
+	cf := NewCuckooFilter(64, 4)
+	cf.Add([]byte("item"))
+	var cf2 *CuckooFilter
+	gobRoundTrip(t, cf, &cf2)
+	if !cf2.Exists([]byte("item")) || cf2.Count() != 1 {
+		t.Error("cuckoo filter lost its item")
+	}
+}
+
+func TestManagerStateRoundTrip(t *testing.T) {
+	m := NewTimeSeriesManager()
+	_ = m.Create("ts", time.Hour, map[string]string{"host": "a"})
+	ts, _ := m.Get("ts")
+	ts.Add(0, 1.5)
+	data, err := m.SaveState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := NewTimeSeriesManager()
+	if err := loaded.LoadState(data); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := loaded.Get("ts"); !ok || len(got.Samples) != 1 || got.Samples[0].Value != 1.5 {
+		t.Errorf("series after load = %+v", got)
+	}
+	if keys := loaded.QueryByLabels(map[string]string{"host": "a"}, ""); len(keys) != 1 {
+		t.Errorf("label index after load = %v", keys)
+	}
+	if err := loaded.LoadState(nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := loaded.Get("ts"); ok {
+		t.Error("LoadState(nil) kept the series")
+	}
+
+	js := NewJobScheduler()
+	js.Create("j", "job", "PING", time.Second)
+	data, err = js.SaveState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	js2 := NewJobScheduler()
+	if err := js2.LoadState(data); err != nil {
+		t.Fatal(err)
+	}
+	if j, ok := js2.Get("j"); !ok || j.Interval != time.Second {
+		t.Errorf("job after load = %+v", j)
+	}
+}
+
+func TestDataStructureGobRoundTrip(t *testing.T) {
+	pq := NewPriorityQueue()
+	pq.PushItem("low", 5)
+	pq.PushItem("high", 1)
+	var pq2 *PriorityQueue
+	gobRoundTrip(t, pq, &pq2)
+	if v, _, _ := pq2.Peek(); pq2.Size() != 2 || v != "high" {
+		t.Errorf("priority queue after load: size %d, head %q", pq2.Size(), v)
+	}
+
+	rs := NewReservoirSampler(2)
+	rs.AddBatch([]float64{1, 2, 3})
+	var rs2 *ReservoirSampler
+	gobRoundTrip(t, rs, &rs2)
+	rs2.Add(4)
+	if len(rs2.Get()) != 2 {
+		t.Errorf("reservoir after load = %v", rs2.Get())
+	}
+}
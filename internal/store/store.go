@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cachestorm/cachestorm/internal/logger"
@@ -40,6 +41,11 @@ type SetOptions struct {
 	Tags    []string
 }
 
+// InvalidationFunc receives keys whose value was changed or removed, whether
+// by a command, expiry or eviction. A nil slice means the keyspace was
+// flushed.
+type InvalidationFunc func(keys []string)
+
 type Store struct {
 	shards       [NumShards]*Shard
 	tagIndex     *TagIndex
@@ -50,6 +56,12 @@ type Store struct {
 	versionMu    sync.RWMutex
 	memTracker   *MemoryTracker
 	evictor      *EvictionController
+	tier         *DiskTier
+	invalidate   atomic.Pointer[InvalidationFunc]
+	// changes and snapMu are shared by every namespace of a store.
+	changes      *atomic.Int64
+	snapMu       *sync.Mutex
+	snapshotting atomic.Bool
 }
 
 func NewStore() *Store {
@@ -58,6 +70,8 @@ func NewStore() *Store {
 		pubsub:      NewPubSub(),
 		keyNotifier: NewKeyNotifier(),
 		versions:    make(map[string]int64),
+		changes:     new(atomic.Int64),
+		snapMu:      new(sync.Mutex),
 	}
 	for i := 0; i < NumShards; i++ {
 		s.shards[i] = NewShard()
@@ -66,15 +80,41 @@ func NewStore() *Store {
 }
 
 // ConfigureMemory sets up memory tracking and eviction. Call after NewStore().
+// The tracker counts the resident bytes of every namespace of the store.
 func (s *Store) ConfigureMemory(maxMemory int64, policy EvictionPolicy, warningPct, criticalPct, sampleSize int) {
 	s.memTracker = NewMemoryTracker(maxMemory, warningPct, criticalPct)
 	s.evictor = NewEvictionController(policy, maxMemory, s, s.memTracker, sampleSize)
+	for _, ks := range s.keyspaces() {
+		s.memTracker.Add(ks.MemUsage())
+		ks.memTracker, ks.evictor = s.memTracker, s.evictor
+	}
+}
+
+// trackMemory reports a change in the resident size of the keyspace to the
+// memory tracker.
+func (s *Store) trackMemory(delta int64) {
+	if s.memTracker != nil && delta != 0 {
+		s.memTracker.Add(delta)
+	}
 }
 
 func (s *Store) MemoryTracker() *MemoryTracker {
 	return s.memTracker
 }
 
+// OverMemoryLimit reports whether memory use is still above the limit after
+// trying to evict keys, in which case commands that may grow the dataset
+// are refused.
+func (s *Store) OverMemoryLimit() bool {
+	if s.memTracker == nil || s.memTracker.Max() == 0 || s.memTracker.CanAllocate(0) {
+		return false
+	}
+	if s.evictor != nil {
+		_ = s.evictor.CheckAndEvict()
+	}
+	return !s.memTracker.CanAllocate(0)
+}
+
 func (s *Store) Evictor() *EvictionController {
 	return s.evictor
 }
@@ -90,23 +130,77 @@ func NewStoreWithNamespaces() *Store {
 		pubsub:       NewPubSub(),
 		keyNotifier:  NewKeyNotifier(),
 		versions:     make(map[string]int64),
+		changes:      new(atomic.Int64),
+		snapMu:       new(sync.Mutex),
 	}
 	for i := 0; i < NumShards; i++ {
 		s.shards[i] = NewShard()
 	}
+	s.namespaceMgr.setRoot(s)
 	return s
 }
 
+// ForNamespace returns the keyspace backing the named namespace, creating it
+// on first use. Stores without a namespace manager only have one keyspace
+// and always resolve to themselves.
+func (s *Store) ForNamespace(name string) *Store {
+	if s.namespaceMgr == nil {
+		return s
+	}
+	if name == "" {
+		name = "default"
+	}
+	ns := s.namespaceMgr.Get(name)
+	if ns == nil {
+		ns = s.namespaceMgr.GetOrCreate(name)
+	}
+	if ns.Store == nil {
+		return s
+	}
+	return ns.Store
+}
+
+// SetInvalidationHook registers fn to be told about modified keys. It applies
+// to every namespace of the store, including ones created later.
+func (s *Store) SetInvalidationHook(fn InvalidationFunc) {
+	s.invalidate.Store(&fn)
+	if s.namespaceMgr == nil {
+		return
+	}
+	for _, name := range s.namespaceMgr.List() {
+		if ns := s.namespaceMgr.Get(name); ns != nil && ns.Store != nil && ns.Store != s {
+			ns.Store.invalidate.Store(&fn)
+		}
+	}
+}
+
+func (s *Store) notifyInvalidation(keys []string) {
+	s.changes.Add(int64(len(keys)))
+	if fn := s.invalidate.Load(); fn != nil && *fn != nil {
+		(*fn)(keys)
+	}
+}
+
+// Changes counts key modifications across every namespace of the store since
+// it was created. Persistence compares it between saves the way Redis
+// tracks dirty keys.
+func (s *Store) Changes() int64 {
+	return s.changes.Load()
+}
+
 func (s *Store) GetVersion(key string) int64 {
 	s.versionMu.RLock()
 	defer s.versionMu.RUnlock()
 	return s.versions[key]
 }
 
+// IncrementVersion marks key as modified, for WATCH and client-side caching
+// invalidation.
 func (s *Store) IncrementVersion(key string) {
 	s.versionMu.Lock()
-	defer s.versionMu.Unlock()
 	s.versions[key]++
+	s.versionMu.Unlock()
+	s.notifyInvalidation([]string{key})
 }
 
 func (s *Store) DeleteVersion(key string) {
@@ -142,11 +236,19 @@ func (s *Store) Get(key string) (*Entry, bool) {
 	}
 
 	if entry.IsExpired() {
-		shard.Delete(key)
+		mem, _ := shard.Delete(key)
+		s.trackMemory(-mem)
 		s.DeleteVersion(key) // Clean up version to prevent memory leak
+		s.notifyInvalidation([]string{key})
 		return nil, false
 	}
 
+	if entry.isCold() {
+		if entry, exists = s.faultIn(shard, key, entry); !exists {
+			return nil, false
+		}
+	}
+
 	entry.Touch()
 	return entry, true
 }
@@ -211,7 +313,7 @@ func (s *Store) Set(key string, value Value, opts SetOptions) error {
 		s.tagIndex.AddTags(key, opts.Tags)
 	}
 
-	shard.Set(key, entry)
+	s.trackMemory(shard.Set(key, entry))
 	s.IncrementVersion(key)
 	s.keyNotifier.NotifyKey(key)
 	return nil
@@ -225,7 +327,7 @@ func (s *Store) SetEntry(key string, entry *Entry) {
 
 	idx := s.shardIndex(key)
 	shard := s.shards[idx]
-	shard.Set(key, entry)
+	s.trackMemory(shard.Set(key, entry))
 	s.IncrementVersion(key)
 }
 
@@ -239,7 +341,8 @@ func (s *Store) Delete(key string) bool {
 	}
 
 	s.tagIndex.RemoveKey(key, entry.Tags)
-	_, deleted := shard.Delete(key)
+	mem, deleted := shard.Delete(key)
+	s.trackMemory(-mem)
 	if deleted {
 		s.IncrementVersion(key)
 		s.DeleteVersion(key)
@@ -265,6 +368,8 @@ func (s *Store) DeleteBatch(keys []string) int {
 	}
 
 	deleted := 0
+	var freed int64
+	removed := make([]string, 0, len(keys))
 	s.versionMu.Lock()
 	for shard, shardKeys := range shardOps {
 		shard.mu.Lock()
@@ -275,16 +380,25 @@ func (s *Store) DeleteBatch(keys []string) int {
 			}
 			keyOverhead := int64(len(key)) + 16
 			mem := entry.MemoryUsage() + keyOverhead
+			shard.preserve(key)
 			shard.memUsage -= mem
+			freed += mem
 			shard.keyCount--
+			shard.forget(entry)
+			shard.bury(key, entry)
 			delete(shard.data, key)
 			delete(s.versions, key)
+			removed = append(removed, key)
 			deleted++
 		}
 		shard.mu.Unlock()
 	}
 	s.versionMu.Unlock()
+	s.trackMemory(-freed)
 
+	if deleted > 0 {
+		s.notifyInvalidation(removed)
+	}
 	return deleted
 }
 
@@ -298,8 +412,10 @@ func (s *Store) Exists(key string) bool {
 	}
 
 	if entry.IsExpired() {
-		shard.Delete(key)
+		mem, _ := shard.Delete(key)
+		s.trackMemory(-mem)
 		s.DeleteVersion(key) // Clean up version to prevent memory leak
+		s.notifyInvalidation([]string{key})
 		return false
 	}
 
@@ -331,6 +447,7 @@ func (s *Store) SetTTL(key string, ttl time.Duration) bool {
 		return false
 	}
 
+	s.preserveForSnapshot(shard, key)
 	entry.SetTTL(ttl)
 	return true
 }
@@ -344,6 +461,7 @@ func (s *Store) SetExpiresAt(key string, expiresAt int64) bool {
 		return false
 	}
 
+	s.preserveForSnapshot(shard, key)
 	entry.SetExpiresAt(expiresAt)
 	return true
 }
@@ -357,6 +475,7 @@ func (s *Store) Persist(key string) bool {
 		return false
 	}
 
+	s.preserveForSnapshot(shard, key)
 	entry.ExpiresAt = 0
 	return true
 }
@@ -413,12 +532,14 @@ func (s *Store) Keys() []string {
 func (s *Store) Flush() {
 	keyCount := s.KeyCount()
 	for i := 0; i < NumShards; i++ {
-		s.shards[i].Flush()
+		s.trackMemory(-s.shards[i].Flush())
 	}
 	// Clear version map to prevent memory leak
 	s.versionMu.Lock()
 	s.versions = make(map[string]int64)
 	s.versionMu.Unlock()
+	s.changes.Add(keyCount)
+	s.notifyInvalidation(nil)
 	logger.Info().Int64("flushed_keys", keyCount).Msg("store flushed")
 }
 
@@ -443,9 +564,14 @@ func (s *Store) GetAll() map[string]*Entry {
 	for i := 0; i < NumShards; i++ {
 		shardData := s.shards[i].GetAll()
 		for k, v := range shardData {
-			if !v.IsExpired() {
-				result[k] = v
+			if v.IsExpired() {
+				continue
+			}
+			if v.isCold() {
+				// A copy, read from disk without making it resident.
+				v = v.clone()
 			}
+			result[k] = v
 		}
 	}
 	return result
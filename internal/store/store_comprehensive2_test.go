@@ -160,17 +160,17 @@ func TestPubSubRemoveSubscriber(t *testing.T) {
 func TestSubscriberSend(t *testing.T) {
 	sub := NewSubscriber(1)
 
-	if !sub.Send([]byte("message1")) {
+	if !sub.Send(&Message{Payload: []byte("message1")}) {
 		t.Error("send should succeed")
 	}
 
-	if !sub.Send([]byte("message2")) {
+	if !sub.Send(&Message{Payload: []byte("message2")}) {
 		t.Error("send should succeed")
 	}
 
 	sub.Close()
 
-	if sub.Send([]byte("message3")) {
+	if sub.Send(&Message{Payload: []byte("message3")}) {
 		t.Error("send should fail after close")
 	}
 }
@@ -805,7 +805,7 @@ func TestRLECompressDecompress(t *testing.T) {
 func TestSubscriberSend_Closed(t *testing.T) {
 	sub := NewSubscriber(1)
 	sub.Close()
-	ok := sub.Send([]byte("test"))
+	ok := sub.Send(&Message{Payload: []byte("test")})
 	if ok {
 		t.Fatal("expected false for closed subscriber")
 	}
@@ -815,10 +815,10 @@ func TestSubscriberSend_Full(t *testing.T) {
 	sub := NewSubscriber(1)
 	// Fill the channel
 	for i := 0; i < 256; i++ {
-		sub.Send([]byte("test"))
+		sub.Send(&Message{Payload: []byte("test")})
 	}
 	// Next send should drop
-	ok := sub.Send([]byte("overflow"))
+	ok := sub.Send(&Message{Payload: []byte("overflow")})
 	if ok {
 		t.Fatal("expected false for full channel")
 	}
@@ -1,6 +1,7 @@
 package store
 
 import (
+	"strings"
 	"testing"
 	"time"
 )
@@ -346,3 +347,29 @@ func TestStoreSetExpiresAt(t *testing.T) {
 		t.Error("TTL should be set")
 	}
 }
+
+func TestStoreInvalidationHook(t *testing.T) {
+	s := NewStoreWithNamespaces()
+	var got [][]string
+	s.SetInvalidationHook(func(keys []string) { got = append(got, keys) })
+
+	s.Set("a", &StringValue{Data: []byte("1")}, SetOptions{})
+	s.Delete("a")
+	s.Set("b", &StringValue{Data: []byte("1")}, SetOptions{TTL: time.Millisecond})
+	time.Sleep(5 * time.Millisecond)
+	s.Get("b")
+	s.Set("c", &StringValue{Data: []byte("1")}, SetOptions{})
+	s.DeleteBatch([]string{"c", "missing"})
+	s.Flush()
+	s.ForNamespace("db1").Set("d", &StringValue{Data: []byte("1")}, SetOptions{})
+
+	want := [][]string{{"a"}, {"a"}, {"b"}, {"b"}, {"c"}, {"c"}, nil, {"d"}}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d notifications, got %v", len(want), got)
+	}
+	for i := range want {
+		if strings.Join(got[i], ",") != strings.Join(want[i], ",") || (want[i] == nil) != (got[i] == nil) {
+			t.Errorf("notification %d: expected %v, got %v", i, want[i], got[i])
+		}
+	}
+}
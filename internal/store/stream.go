@@ -226,6 +226,23 @@ func (v *StreamValue) String() string {
 	}
 	return result
 }
+func (g *ConsumerGroup) clone() *ConsumerGroup {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	cloned := NewConsumerGroup(g.Name)
+	cloned.LastID = g.LastID
+	for name, consumer := range g.Consumers {
+		c := *consumer
+		cloned.Consumers[name] = &c
+	}
+	for id, pending := range g.Pending {
+		p := *pending
+		cloned.Pending[id] = &p
+	}
+	return cloned
+}
+
 func (v *StreamValue) Clone() Value {
 	v.mu.RLock()
 	defer v.mu.RUnlock()
@@ -250,8 +267,7 @@ func (v *StreamValue) Clone() Value {
 	}
 
 	for name, group := range v.Groups {
-		cloned.Groups[name] = NewConsumerGroup(group.Name)
-		cloned.Groups[name].LastID = group.LastID
+		cloned.Groups[name] = group.clone()
 	}
 
 	return cloned
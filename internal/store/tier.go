@@ -0,0 +1,548 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cachestorm/cachestorm/internal/logger"
+)
+
+// TierConfig configures the disk tier of a store.
+type TierConfig struct {
+	// Dir holds the segment files. Segments left there by a previous run
+	// are removed: the stubs pointing into them only ever live in memory.
+	Dir string
+	// SegmentSize is the size at which the tier starts a new segment.
+	SegmentSize int64
+	// CompactRatio is the share of a segment, between 0 and 1, that must be
+	// dead before the segment is compacted.
+	CompactRatio float64
+	// Encode and Decode serialize values; the store has no encoding of its
+	// own, so the caller supplies the persistence one.
+	Encode func(Value) ([]byte, error)
+	Decode func([]byte) (Value, error)
+}
+
+// TierStats describes the disk tier of a store, across its namespaces.
+type TierStats struct {
+	Segments    int
+	DiskBytes   int64
+	LiveBytes   int64
+	ColdKeys    int64
+	Spilled     int64
+	Faulted     int64
+	Compactions int64
+}
+
+// DiskTier keeps the values of cold keys in append-only segment files. When
+// a store has one, eviction moves the value of its victim to the active
+// segment and leaves a stub in the key's entry instead of deleting the key;
+// Get reads the value back and makes it resident again.
+//
+// Records are never rewritten in place. Values read back, overwritten or
+// deleted leave dead records behind, and a segment is compacted, its live
+// records copied to the active segment, once enough of it is dead.
+type DiskTier struct {
+	cfg  TierConfig
+	root *Store
+
+	mu       sync.Mutex
+	segments map[int]*tierSegment
+	active   *tierSegment
+	nextID   int
+
+	compacting  atomic.Bool
+	coldKeys    atomic.Int64
+	spilled     atomic.Int64
+	faulted     atomic.Int64
+	compactions atomic.Int64
+}
+
+// tierSegment is one segment file. Its counters are guarded by the tier's mu.
+type tierSegment struct {
+	tier *DiskTier
+	id   int
+	path string
+	f    *os.File
+	size int64 // bytes written
+	dead int64 // bytes of records no stub points to
+	live int   // records a stub points to
+}
+
+// coldValue stands in for a value moved to the disk tier. It answers Type
+// without reading the value back; Clone and String read it from the
+// segment, so snapshots get the actual value.
+type coldValue struct {
+	seg  *tierSegment
+	off  int64
+	n    int
+	typ  DataType
+	size int64 // SizeOf of the value when resident
+}
+
+// coldStubSize is what a stub counts for in memory accounting.
+const coldStubSize = 48
+
+// tierRecordHeader is the length and CRC-32 of the payload that follows.
+const tierRecordHeader = 8
+
+var (
+	// errTierBusy is returned by spill when the key's shard is being
+	// written to, as the value may be changing while it is saved.
+	errTierBusy = errors.New("shard is being written to")
+	// errTierCold is returned by spill for a key already on disk.
+	errTierCold = errors.New("value already on disk")
+)
+
+func (v *coldValue) Type() DataType { return v.typ }
+func (v *coldValue) SizeOf() int64  { return coldStubSize }
+
+func (v *coldValue) Clone() Value {
+	value, err := v.load()
+	if err != nil {
+		logger.Error().Err(err).Str("segment", v.seg.path).Msg("reading value from disk tier failed")
+		return v
+	}
+	return value
+}
+
+func (v *coldValue) String() string {
+	value, err := v.load()
+	if err != nil {
+		return ""
+	}
+	return value.String()
+}
+
+func (v *coldValue) load() (Value, error) {
+	data, err := v.seg.read(v.off, v.n)
+	if err != nil {
+		return nil, err
+	}
+	return v.seg.tier.cfg.Decode(data)
+}
+
+// release marks the record dead once no entry points to it any more.
+func (v *coldValue) release() {
+	t := v.seg.tier
+	t.coldKeys.Add(-1)
+	t.mu.Lock()
+	v.seg.dead += tierRecordHeader + int64(v.n)
+	v.seg.live--
+	compact := t.shouldCompact(v.seg)
+	t.mu.Unlock()
+	if compact {
+		t.compactAsync()
+	}
+}
+
+func (seg *tierSegment) read(off int64, n int) ([]byte, error) {
+	buf := make([]byte, tierRecordHeader+n)
+	if _, err := seg.f.ReadAt(buf, off); err != nil {
+		return nil, err
+	}
+	if int(binary.LittleEndian.Uint32(buf)) != n {
+		return nil, fmt.Errorf("%s: bad record length at offset %d", seg.path, off)
+	}
+	data := buf[tierRecordHeader:]
+	if crc32.ChecksumIEEE(data) != binary.LittleEndian.Uint32(buf[4:]) {
+		return nil, fmt.Errorf("%s: checksum mismatch at offset %d", seg.path, off)
+	}
+	return data, nil
+}
+
+// ConfigureTier gives the store and its namespaces a disk tier, which
+// eviction then moves cold values to instead of deleting their keys. Call
+// after NewStoreWithNamespaces and before serving clients.
+func (s *Store) ConfigureTier(cfg TierConfig) error {
+	if cfg.Encode == nil || cfg.Decode == nil {
+		return errors.New("disk tier needs an encoding")
+	}
+	if cfg.SegmentSize <= 0 {
+		cfg.SegmentSize = 64 << 20
+	}
+	if cfg.CompactRatio <= 0 || cfg.CompactRatio > 1 {
+		cfg.CompactRatio = 0.5
+	}
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return err
+	}
+	stale, err := filepath.Glob(filepath.Join(cfg.Dir, "segment-*.tier"))
+	if err != nil {
+		return err
+	}
+	for _, path := range stale {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+
+	t := &DiskTier{cfg: cfg, root: s, segments: make(map[int]*tierSegment)}
+	for _, ks := range s.keyspaces() {
+		ks.tier = t
+	}
+	return nil
+}
+
+// CloseTier closes and removes the segment files, losing the values of the
+// keys still on disk. Call on shutdown, after the last snapshot.
+func (s *Store) CloseTier() {
+	t := s.tier
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for id, seg := range t.segments {
+		seg.f.Close()
+		os.Remove(seg.path)
+		delete(t.segments, id)
+	}
+	t.active = nil
+}
+
+// TierStats reports on the disk tier, and false when the store has none.
+func (s *Store) TierStats() (TierStats, bool) {
+	t := s.tier
+	if t == nil {
+		return TierStats{}, false
+	}
+	stats := TierStats{
+		ColdKeys:    t.coldKeys.Load(),
+		Spilled:     t.spilled.Load(),
+		Faulted:     t.faulted.Load(),
+		Compactions: t.compactions.Load(),
+	}
+	t.mu.Lock()
+	for _, seg := range t.segments {
+		stats.Segments++
+		stats.DiskBytes += seg.size
+		stats.LiveBytes += seg.size - seg.dead
+	}
+	t.mu.Unlock()
+	return stats, true
+}
+
+// ColdKeyCount is the number of keys of this namespace whose value is on
+// disk; the others are resident.
+func (s *Store) ColdKeyCount() int64 {
+	var count int64
+	for _, shard := range s.shards {
+		shard.mu.RLock()
+		count += shard.cold
+		shard.mu.RUnlock()
+	}
+	return count
+}
+
+// BeginWrite is called before a command that may change the values of keys
+// in place, and the function it returns once the command is done. Values in
+// a shard with a write in progress are not moved to the disk tier, whose
+// copy could miss the change.
+func (s *Store) BeginWrite(keys []string) (done func()) {
+	if s.tier == nil || len(keys) == 0 {
+		return func() {}
+	}
+	shards := make([]*Shard, len(keys))
+	for i, key := range keys {
+		shards[i] = s.shards[s.shardIndex(key)]
+		shards[i].writing.Add(1)
+		shards[i].writes.Add(1)
+	}
+	return func() {
+		for _, shard := range shards {
+			shard.writing.Add(-1)
+		}
+	}
+}
+
+// keyspaces lists the store and, on the root of a namespace manager, every
+// namespace.
+func (s *Store) keyspaces() []*Store {
+	stores := []*Store{s}
+	if nm := s.namespaceMgr; nm != nil && s.ForNamespace(DBNamespace(0)) == s {
+		for _, name := range nm.List() {
+			if ns := nm.Get(name); ns != nil && ns.Store != nil && ns.Store != s {
+				stores = append(stores, ns.Store)
+			}
+		}
+	}
+	return stores
+}
+
+// spill moves the value of key to the disk tier, leaving a stub in its
+// entry. The value is written out without holding the shard lock, so the
+// move is abandoned if anything wrote to the shard in the meantime.
+func (s *Store) spill(key string) error {
+	shard := s.shards[s.shardIndex(key)]
+	writes := shard.writes.Load()
+	if shard.writing.Load() > 0 {
+		return errTierBusy
+	}
+	entry, ok := shard.Get(key)
+	if !ok {
+		return ErrKeyNotFound
+	}
+	if _, cold := entry.Value.(*coldValue); cold {
+		return errTierCold
+	}
+
+	data, err := s.tier.cfg.Encode(entry.Value)
+	if err != nil {
+		return err
+	}
+	cv, err := s.tier.append(data, entry.Value.Type(), entry.Value.SizeOf())
+	if err != nil {
+		return err
+	}
+
+	shard.mu.Lock()
+	if shard.data[key] != entry || shard.writing.Load() > 0 || shard.writes.Load() != writes {
+		shard.mu.Unlock()
+		cv.release()
+		return errTierBusy
+	}
+	delta := shard.replace(key, entry.withValue(cv))
+	shard.cold++
+	shard.mu.Unlock()
+
+	s.trackMemory(delta)
+	s.tier.spilled.Add(1)
+	return nil
+}
+
+// faultIn reads the value of a cold entry back from disk and makes it
+// resident, returning the entry now stored under key. The entry may have
+// been replaced or moved by compaction while the value was read, in which
+// case the read is retried on the current one.
+func (s *Store) faultIn(shard *Shard, key string, entry *Entry) (*Entry, bool) {
+	for {
+		cv, cold := entry.Value.(*coldValue)
+		if !cold {
+			return entry, true
+		}
+		value, err := cv.load()
+
+		shard.mu.Lock()
+		current, exists := shard.data[key]
+		if !exists {
+			shard.mu.Unlock()
+			return nil, false
+		}
+		if current != entry {
+			shard.mu.Unlock()
+			entry = current
+			continue
+		}
+		if err != nil {
+			// The value is lost: drop the key rather than keep a stub no
+			// command can use.
+			mem := entry.MemoryUsage() + int64(len(key)) + 16
+			shard.preserve(key)
+			shard.memUsage -= mem
+			shard.keyCount--
+			shard.forget(entry)
+			delete(shard.data, key)
+			shard.mu.Unlock()
+			logger.Error().Err(err).Str("key", key).Msg("reading value from disk tier failed, key dropped")
+			s.trackMemory(-mem)
+			s.tagIndex.RemoveKey(key, entry.Tags)
+			s.DeleteVersion(key)
+			s.notifyInvalidation([]string{key})
+			return nil, false
+		}
+		resident := entry.withValue(value)
+		delta := shard.replace(key, resident)
+		shard.cold--
+		shard.mu.Unlock()
+
+		cv.release()
+		s.trackMemory(delta)
+		s.tier.faulted.Add(1)
+		return resident, true
+	}
+}
+
+// replace swaps the entry stored under key for one holding the same data,
+// returning the change in memory use. Snapshots need not preserve the old
+// entry: a copy of either gives the same value. Called with s.mu held.
+func (s *Shard) replace(key string, entry *Entry) int64 {
+	delta := entry.MemoryUsage() - s.data[key].MemoryUsage()
+	s.data[key] = entry
+	s.memUsage += delta
+	return delta
+}
+
+// forget drops the disk tier record of an entry leaving the shard. Called
+// with s.mu held.
+func (s *Shard) forget(entry *Entry) {
+	if cv, ok := entry.Value.(*coldValue); ok {
+		s.cold--
+		cv.release()
+	}
+}
+
+// withValue copies the entry with another value.
+func (e *Entry) withValue(v Value) *Entry {
+	c := &Entry{
+		Value:     v,
+		Tags:      e.Tags,
+		ExpiresAt: e.ExpiresAt,
+		CreatedAt: e.CreatedAt,
+		CRDT:      e.CRDT,
+	}
+	c.LastAccess.Store(e.LastAccess.Load())
+	c.AccessCount.Store(e.AccessCount.Load())
+	return c
+}
+
+// isCold reports whether the entry's value is on disk.
+func (e *Entry) isCold() bool {
+	_, cold := e.Value.(*coldValue)
+	return cold
+}
+
+// append writes a record to the active segment, starting a new one when
+// the active segment is full.
+func (t *DiskTier) append(data []byte, typ DataType, size int64) (*coldValue, error) {
+	record := make([]byte, tierRecordHeader+len(data))
+	binary.LittleEndian.PutUint32(record, uint32(len(data)))
+	binary.LittleEndian.PutUint32(record[4:], crc32.ChecksumIEEE(data))
+	copy(record[tierRecordHeader:], data)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.active == nil || t.active.size >= t.cfg.SegmentSize {
+		if err := t.roll(); err != nil {
+			return nil, err
+		}
+	}
+	seg := t.active
+	if _, err := seg.f.WriteAt(record, seg.size); err != nil {
+		return nil, err
+	}
+	cv := &coldValue{seg: seg, off: seg.size, n: len(data), typ: typ, size: size}
+	seg.size += int64(len(record))
+	seg.live++
+	t.coldKeys.Add(1)
+	return cv, nil
+}
+
+// roll starts a new active segment. Called with t.mu held.
+func (t *DiskTier) roll() error {
+	t.nextID++
+	path := filepath.Join(t.cfg.Dir, fmt.Sprintf("segment-%06d.tier", t.nextID))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	previous := t.active
+	t.active = &tierSegment{tier: t, id: t.nextID, path: path, f: f}
+	t.segments[t.nextID] = t.active
+	if previous != nil && t.shouldCompact(previous) {
+		t.compactAsync()
+	}
+	return nil
+}
+
+// shouldCompact reports whether seg is full and dead enough to compact.
+// Called with t.mu held.
+func (t *DiskTier) shouldCompact(seg *tierSegment) bool {
+	if seg == t.active || seg.size == 0 {
+		return false
+	}
+	return seg.live == 0 || float64(seg.dead)/float64(seg.size) >= t.cfg.CompactRatio
+}
+
+func (t *DiskTier) compactAsync() {
+	if t.compacting.CompareAndSwap(false, true) {
+		go func() {
+			defer t.compacting.Store(false)
+			t.compact()
+		}()
+	}
+}
+
+// compact copies the live records of the segments due for compaction to
+// the active segment, pointing their keys at the copies, and removes the
+// segments. Snapshots are held off meanwhile: the entries they preserve may
+// point into those segments.
+func (t *DiskTier) compact() {
+	t.root.snapMu.Lock()
+	defer t.root.snapMu.Unlock()
+
+	t.mu.Lock()
+	due := make(map[*tierSegment]bool)
+	for _, seg := range t.segments {
+		if t.shouldCompact(seg) {
+			due[seg] = true
+		}
+	}
+	t.mu.Unlock()
+	if len(due) == 0 {
+		return
+	}
+
+	moved := 0
+	for _, ks := range t.root.keyspaces() {
+		for _, shard := range ks.shards {
+			shard.mu.Lock()
+			for key, entry := range shard.data {
+				cv, ok := entry.Value.(*coldValue)
+				if !ok || !due[cv.seg] {
+					continue
+				}
+				copied, err := t.move(cv)
+				if err != nil {
+					// Leave the segment alone; it is retried on the
+					// next compaction.
+					logger.Error().Err(err).Str("segment", cv.seg.path).Msg("disk tier compaction failed")
+					delete(due, cv.seg)
+					continue
+				}
+				shard.data[key] = entry.withValue(copied)
+				moved++
+			}
+			shard.mu.Unlock()
+		}
+	}
+
+	t.mu.Lock()
+	ids := make([]int, 0, len(due))
+	for seg := range due {
+		ids = append(ids, seg.id)
+		seg.f.Close()
+		os.Remove(seg.path)
+		delete(t.segments, seg.id)
+	}
+	t.mu.Unlock()
+	sort.Ints(ids)
+	t.compactions.Add(1)
+	logger.Info().Ints("segments", ids).Int("moved", moved).Msg("disk tier compacted")
+}
+
+// move copies the record of cv to the active segment, returning the stub
+// pointing at the copy; the old record stops counting as live.
+func (t *DiskTier) move(cv *coldValue) (*coldValue, error) {
+	data, err := cv.seg.read(cv.off, cv.n)
+	if err != nil {
+		return nil, err
+	}
+	copied, err := t.append(data, cv.typ, cv.size)
+	if err != nil {
+		return nil, err
+	}
+	t.coldKeys.Add(-1)
+	t.mu.Lock()
+	cv.seg.dead += tierRecordHeader + int64(cv.n)
+	cv.seg.live--
+	t.mu.Unlock()
+	return copied, nil
+}
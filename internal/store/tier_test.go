@@ -0,0 +1,185 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// newTieredStore returns a store with a disk tier that can hold strings.
+func newTieredStore(t *testing.T, segmentSize int64) *Store {
+	t.Helper()
+	s := NewStoreWithNamespaces()
+	err := s.ConfigureTier(TierConfig{
+		Dir:          t.TempDir(),
+		SegmentSize:  segmentSize,
+		CompactRatio: 0.5,
+		Encode: func(v Value) ([]byte, error) {
+			sv, ok := v.(*StringValue)
+			if !ok {
+				return nil, fmt.Errorf("cannot encode %T", v)
+			}
+			return sv.Data, nil
+		},
+		Decode: func(data []byte) (Value, error) {
+			return &StringValue{Data: data}, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.CloseTier)
+	return s
+}
+
+func TestDiskTierSpillAndFaultIn(t *testing.T) {
+	s := newTieredStore(t, 0)
+	s.ConfigureMemory(1<<30, EvictionAllKeysLRU, 70, 85, 5)
+	value := make([]byte, 1000)
+	for i := range value {
+		value[i] = byte('a' + i%26)
+	}
+	s.Set("cold", &StringValue{Data: value}, SetOptions{TTL: time.Hour, Tags: []string{"t"}})
+	s.Set("hot", &StringValue{Data: []byte("v")}, SetOptions{})
+
+	before := s.MemUsage()
+	if err := s.spill("cold"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.spill("cold"); !errors.Is(err, errTierCold) {
+		t.Errorf("second spill = %v, want errTierCold", err)
+	}
+	if s.MemUsage() >= before-900 {
+		t.Errorf("memory %d after spilling, %d before", s.MemUsage(), before)
+	}
+	if got := s.MemoryTracker().Usage(); got != s.MemUsage() {
+		t.Errorf("tracked memory %d, store holds %d", got, s.MemUsage())
+	}
+	if cold := s.ColdKeyCount(); cold != 1 || s.KeyCount() != 2 {
+		t.Errorf("cold %d of %d keys, want 1 of 2", cold, s.KeyCount())
+	}
+	if ttl := s.GetTTL("cold"); ttl <= 0 {
+		t.Errorf("cold key lost its TTL: %v", ttl)
+	}
+
+	entry, ok := s.Get("cold")
+	if !ok || string(entry.Value.(*StringValue).Data) != string(value) {
+		t.Fatalf("faulted in %+v, %v", entry, ok)
+	}
+	if len(entry.Tags) != 1 || s.ColdKeyCount() != 0 {
+		t.Errorf("tags %v, %d cold keys after faulting in", entry.Tags, s.ColdKeyCount())
+	}
+	if got := s.MemoryTracker().Usage(); got != s.MemUsage() || got < before {
+		t.Errorf("tracked memory %d, store holds %d, had %d", got, s.MemUsage(), before)
+	}
+	stats, _ := s.TierStats()
+	if stats.Spilled != 1 || stats.Faulted != 1 || stats.ColdKeys != 0 || stats.LiveBytes != 0 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
+
+func TestDiskTierEvictionKeepsKeys(t *testing.T) {
+	s := newTieredStore(t, 0)
+	s.ConfigureMemory(512*1024, EvictionAllKeysLRU, 70, 85, 5)
+	value := make([]byte, 2048)
+	for i := 0; i < 1000; i++ {
+		if err := s.Set(fmt.Sprintf("key:%d", i), &StringValue{Data: value}, SetOptions{}); err != nil {
+			t.Fatalf("set key:%d: %v", i, err)
+		}
+	}
+	if s.KeyCount() != 1000 {
+		t.Fatalf("%d keys left, want all 1000", s.KeyCount())
+	}
+	if s.ColdKeyCount() == 0 || s.MemoryTracker().Usage() > 512*1024 {
+		t.Errorf("%d cold keys, %d bytes resident", s.ColdKeyCount(), s.MemoryTracker().Usage())
+	}
+	for i := 0; i < 1000; i += 50 {
+		if e, ok := s.Get(fmt.Sprintf("key:%d", i)); !ok || len(e.Value.(*StringValue).Data) != 2048 {
+			t.Errorf("key:%d = %+v, %v", i, e, ok)
+		}
+	}
+}
+
+func TestDiskTierLeavesWrittenShardsAlone(t *testing.T) {
+	s := newTieredStore(t, 0)
+	s.Set("k", &StringValue{Data: []byte("v")}, SetOptions{})
+
+	done := s.BeginWrite([]string{"k"})
+	if err := s.spill("k"); !errors.Is(err, errTierBusy) {
+		t.Errorf("spill during a write = %v, want errTierBusy", err)
+	}
+	done()
+	if err := s.spill("k"); err != nil {
+		t.Errorf("spill after the write = %v", err)
+	}
+}
+
+func TestDiskTierCompaction(t *testing.T) {
+	s := newTieredStore(t, 256)
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key:%d", i)
+		s.Set(key, &StringValue{Data: []byte(fmt.Sprintf("value %064d", i))}, SetOptions{})
+		if err := s.spill(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before, _ := s.TierStats()
+	if before.Segments < 4 {
+		t.Fatalf("%d segments, want the records spread over several", before.Segments)
+	}
+
+	// Kill most records: deleted, overwritten or read back.
+	for i := 0; i < 15; i++ {
+		key := fmt.Sprintf("key:%d", i)
+		switch i % 3 {
+		case 0:
+			s.Delete(key)
+		case 1:
+			s.Set(key, &StringValue{Data: []byte("new")}, SetOptions{})
+		case 2:
+			s.Get(key)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stats, _ := s.TierStats()
+		if stats.Compactions > 0 && !s.tier.compacting.Load() {
+			if stats.DiskBytes >= before.DiskBytes || stats.ColdKeys != 5 {
+				t.Errorf("after compaction %+v, before %+v", stats, before)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no compaction: %+v", stats)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := 15; i < 20; i++ {
+		want := fmt.Sprintf("value %064d", i)
+		if e, ok := s.Get(fmt.Sprintf("key:%d", i)); !ok || e.Value.String() != want {
+			t.Errorf("key:%d = %+v, %v after compaction", i, e, ok)
+		}
+	}
+}
+
+func TestDiskTierSnapshot(t *testing.T) {
+	s := newTieredStore(t, 0)
+	s.Set("kept", &StringValue{Data: []byte("kept")}, SetOptions{})
+	s.Set("deleted", &StringValue{Data: []byte("deleted")}, SetOptions{})
+	s.spill("kept")
+	s.spill("deleted")
+
+	snap := s.Snapshot()
+	s.Delete("deleted")
+	got := snapshotContents(t, snap.Databases()[0])
+	snap.Release()
+
+	if got["kept"] != "kept" || got["deleted"] != "deleted" || len(got) != 2 {
+		t.Errorf("snapshot = %v", got)
+	}
+	if s.ColdKeyCount() != 1 {
+		t.Errorf("snapshot changed the tier: %d cold keys", s.ColdKeyCount())
+	}
+}
@@ -46,9 +46,13 @@ func (v *TimeSeriesValue) Clone() Value {
 	defer v.mu.RUnlock()
 	samples := make([]TimeSeriesSample, len(v.Samples))
 	copy(samples, v.Samples)
+	labels := make(map[string]string, len(v.Labels))
+	for k, l := range v.Labels {
+		labels[k] = l
+	}
 	return &TimeSeriesValue{
 		Samples:   samples,
-		Labels:    v.Labels,
+		Labels:    labels,
 		Retention: v.Retention,
 	}
 }